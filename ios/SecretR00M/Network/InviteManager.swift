@@ -94,11 +94,13 @@ final class InviteManager {
     /// Create a new invite token for a room
     /// - Parameters:
     ///   - roomID: The room ID to create an invite for
+    ///   - hostSecret: The host secret from ROOM_CREATED, which the relay requires
     ///   - relayURL: Base URL of the relay server (must be .onion for production)
     ///   - completion: Callback with result
     /// - Note: SECURITY - This method requires Tor to be ready. Use isTorReady() to check first.
     func createInviteToken(
         roomID: String,
+        hostSecret: String?,
         relayURL: URL,
         completion: @escaping (Result<InviteToken, InviteError>) -> Void
     ) {
@@ -115,6 +117,10 @@ final class InviteManager {
         request.httpMethod = "POST"
         request.setValue("application/json", forHTTPHeaderField: "Content-Type")
         request.timeoutInterval = 30
+        // SECURITY: Only the host holds the secret; never log it
+        if let hostSecret = hostSecret {
+            request.setValue("Bearer \(hostSecret)", forHTTPHeaderField: "Authorization")
+        }
         // No body needed - roomId is in the path
 
         let task = session.dataTask(with: request) { data, response, error in
@@ -318,9 +324,9 @@ final class InviteManager {
 extension InviteManager {
 
     /// Create invite token (async)
-    func createInviteToken(roomID: String, relayURL: URL) async throws -> InviteToken {
+    func createInviteToken(roomID: String, hostSecret: String?, relayURL: URL) async throws -> InviteToken {
         try await withCheckedThrowingContinuation { continuation in
-            createInviteToken(roomID: roomID, relayURL: relayURL) { result in
+            createInviteToken(roomID: roomID, hostSecret: hostSecret, relayURL: relayURL) { result in
                 switch result {
                 case .success(let token):
                     continuation.resume(returning: token)
@@ -72,9 +72,11 @@ extension HostMessage {
                   let approvalString = String(data: approvalData, encoding: .utf8) else {
                 return nil
             }
+            // The relay passes on the joiner's messages only once approved is true
             let msg: [String: Any] = [
                 "type": "JOIN_RESPONSE",
                 "clientId": clientId,
+                "approved": true,
                 "payload": approvalString
             ]
             return msg.jsonString
@@ -86,9 +88,11 @@ extension HostMessage {
                   let rejectionString = String(data: rejectionData, encoding: .utf8) else {
                 return nil
             }
+            // approved: false keeps the relay from passing on the joiner's messages
             let msg: [String: Any] = [
                 "type": "JOIN_RESPONSE",
                 "clientId": clientId,
+                "approved": false,
                 "payload": rejectionString
             ]
             return msg.jsonString
@@ -173,7 +177,7 @@ extension ClientMessage {
 
 /// Parsed incoming message types
 enum ReceivedMessage {
-    case roomCreated(roomId: String)
+    case roomCreated(roomId: String, hostSecret: String?)
     case connected(clientId: String)
     case joinRequest(clientId: String, request: JoinRequest)
     case joinResponse(approval: JoinApproval?, rejection: JoinRejection?)
@@ -227,7 +231,7 @@ enum MessageParser {
         switch type {
         case "ROOM_CREATED":
             guard let roomId = json["roomId"] as? String else { return nil }
-            return .roomCreated(roomId: roomId)
+            return .roomCreated(roomId: roomId, hostSecret: json["hostSecret"] as? String)
 
         case "CONNECTED":
             guard let clientId = json["clientId"] as? String else { return nil }
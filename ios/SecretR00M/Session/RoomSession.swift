@@ -34,6 +34,9 @@ final class RoomSession {
     /// Our participant ID
     private(set) var participantId: UUID?
 
+    /// Secret from ROOM_CREATED authorizing the room's invite API - host only, MEMORY ONLY
+    private(set) var hostSecret: String?
+
     /// Configuration
     /// Room configuration. SECURITY: May be escalated by device integrity checks.
     private(set) var configuration: RoomConfiguration
@@ -1049,6 +1052,7 @@ final class RoomSession {
         sequenceNumber = 0
         currentEpoch = 0
         pendingInviteToken = nil
+        hostSecret = nil
     }
 
     // MARK: - Message Buffer
@@ -1270,8 +1274,8 @@ extension RoomSession: WebSocketProtocolDelegate {
 
         // Process message - each case handles its own locking to avoid holding lock during delegate callbacks
         switch message {
-        case .roomCreated(let roomId):
-            handleRoomCreated(roomId: roomId)
+        case .roomCreated(let roomId, let hostSecret):
+            handleRoomCreated(roomId: roomId, hostSecret: hostSecret)
 
         case .connected(let clientId):
             handleConnected(clientId: clientId)
@@ -1343,13 +1347,14 @@ extension RoomSession: WebSocketProtocolDelegate {
 
     // MARK: - Message Handlers (lock-safe)
 
-    private func handleRoomCreated(roomId: String) {
+    private func handleRoomCreated(roomId: String, hostSecret: String?) {
         var shouldNotify = false
         var newState: RoomState?
 
         lock.lock()
         if role == .host {
             roomIdString = roomId
+            self.hostSecret = hostSecret
             state = .created(roomId: roomId)
             newState = state
             shouldNotify = true
@@ -303,7 +303,7 @@ final class HostRoomViewController: UIViewController {
         // Get relay URL - in production this would be the .onion address
         let relayURL = getRelayURL()
 
-        InviteManager.shared.createInviteToken(roomID: roomId, relayURL: relayURL) { [weak self] result in
+        InviteManager.shared.createInviteToken(roomID: roomId, hostSecret: session.hostSecret, relayURL: relayURL) { [weak self] result in
             guard let self = self else { return }
 
             // Reset button state
@@ -288,7 +288,7 @@ final class RoomSettingsViewController: UIViewController {
 
         let relayURL = getRelayURL()
 
-        InviteManager.shared.createInviteToken(roomID: roomId, relayURL: relayURL) { [weak self] result in
+        InviteManager.shared.createInviteToken(roomID: roomId, hostSecret: session.hostSecret, relayURL: relayURL) { [weak self] result in
             guard let self = self else { return }
 
             // Reset button state
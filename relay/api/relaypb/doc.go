@@ -0,0 +1,7 @@
+// Package relaypb is the relay's gRPC API, for native mobile and backend
+// clients that would rather not carry a WebSocket library. A client calls
+// Relay.Attach, sends an Attach frame naming the room, and from then on
+// exchanges room protocol messages just as it would over a WebSocket.
+package relaypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative relay.proto
@@ -0,0 +1,417 @@
+// Package client speaks the relay's WebSocket protocol for Go programs.
+//
+// A host calls Create to make a room, then Open to start taking joins and
+// Approve to let each one in; heartbeats are sent for it in the background.
+// A joiner calls Join, then Request to ask the host in and Confirm once the
+// host has answered. Both read what the relay sends from Events. Payloads
+// are passed through untouched, so whatever end-to-end encryption the room
+// uses is the application's business.
+//
+// When the relay drains a node it sends MIGRATE; the connection follows it
+// to the new address with the resume token it carries, and Events goes on
+// as before. A dial refused for load (429 or 503) is retried after the
+// relay's Retry-After.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timing
+const (
+	// HeartbeatInterval is how often a host heartbeats, well inside the
+	// relay's six-second timeout
+	HeartbeatInterval = 2 * time.Second
+	WriteTimeout      = 10 * time.Second
+	DialRetries       = 3               // Refused dials retried before giving up
+	DefaultRetryAfter = 1 * time.Second // Wait after a refusal that names none
+	eventBuffer       = 64
+)
+
+// Errors
+var (
+	ErrClosed        = errors.New("relay connection closed")
+	ErrUnexpected    = errors.New("unexpected reply from relay")
+	ErrInvalidRoomID = errors.New("room ID must be 43 base64url characters")
+)
+
+// Message is one protocol message, in either direction
+type Message struct {
+	Type     string          `json:"type"`
+	RoomID   string          `json:"roomId,omitempty"`
+	ClientID string          `json:"clientId,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Category string          `json:"category,omitempty"`
+	Role     string          `json:"role,omitempty"`
+	Secret   string          `json:"hostSecret,omitempty"` // ROOM_CREATED only
+
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"` // RATE_LIMITED and ERROR
+	Quota        string `json:"quota,omitempty"`        // RATE_LIMITED and ERROR from a tenant's quota
+	GraceMs      int64  `json:"graceMs,omitempty"`      // ROOM_CLOSE and ROOM_CLOSING
+	Approved     *bool  `json:"approved,omitempty"`     // JOIN_RESPONSE from the host; only true accepts the joiner
+	ClientSecret string `json:"clientSecret,omitempty"` // CONNECTED only
+
+	Profile json.RawMessage `json:"profile,omitempty"` // JOIN_REQUEST and PROFILE: a member's encrypted profile
+
+	URL         string `json:"url,omitempty"`         // MIGRATE only
+	ResumeToken string `json:"resumeToken,omitempty"` // MIGRATE only
+}
+
+// Error is a refusal from the relay: an ERROR message, or an HTTP status
+// in place of the upgrade
+type Error struct {
+	Status     int // HTTP status; zero for an ERROR message
+	Reason     string
+	RetryAfter time.Duration // zero when the relay named no wait
+	Quota      string        // the resource, if a tenant's quota refused it
+}
+
+func (e *Error) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("relay refused: %d %s", e.Status, e.Reason)
+	}
+	return "relay error: " + e.Reason
+}
+
+// Options tune a connection. The zero value is fine.
+type Options struct {
+	Dialer *websocket.Dialer // nil means websocket.DefaultDialer
+	Header http.Header       // sent with every dial, e.g. a User-Agent
+}
+
+func (o *Options) dialer() *websocket.Dialer {
+	if o == nil || o.Dialer == nil {
+		return websocket.DefaultDialer
+	}
+	return o.Dialer
+}
+
+func (o *Options) header() http.Header {
+	if o == nil {
+		return nil
+	}
+	return o.Header
+}
+
+// NewRoomID returns a fresh random room ID
+func NewRoomID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validRoomID(id string) bool {
+	if len(id) != 43 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// conn is the part of a connection hosts and joiners share: dialing, the
+// read loop, and following MIGRATE
+type conn struct {
+	opts  *Options
+	base  string // where we're connected, which MIGRATE may change
+	path  string // /rooms/{id} or /rooms/{id}/join
+	ready string // the message that says the relay has taken us
+
+	// onResume, if set, is given the ready message of each connection
+	// made to follow MIGRATE
+	onResume func(Message)
+
+	mu sync.Mutex // serializes writes, and holds them during a move
+	ws *websocket.Conn
+
+	events chan Message
+	done   chan struct{}
+	quit   chan struct{} // closed by close, so the read loop needn't wait on Events
+
+	errMu  sync.Mutex
+	err    error
+	closed bool
+}
+
+// dial connects to c.base and waits for the ready message, which it
+// returns
+func (c *conn) dial(ctx context.Context, query url.Values) (*websocket.Conn, Message, error) {
+	u, err := wsURL(c.base, c.path, query)
+	if err != nil {
+		return nil, Message{}, err
+	}
+	for attempt := 0; ; attempt++ {
+		ws, resp, err := c.opts.dialer().DialContext(ctx, u, c.opts.header())
+		if err == nil {
+			m, err := c.await(ctx, ws)
+			if err != nil {
+				ws.Close()
+				return nil, Message{}, err
+			}
+			return ws, m, nil
+		}
+		if resp == nil {
+			return nil, Message{}, err
+		}
+		refused := refusal(resp)
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		if !retry || attempt >= DialRetries {
+			return nil, Message{}, refused
+		}
+		wait := refused.RetryAfter
+		if wait == 0 {
+			wait = DefaultRetryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, Message{}, refused
+		case <-timer.C:
+		}
+	}
+}
+
+// await reads up to the ready message. An ERROR first is the relay turning
+// the connection down after the upgrade.
+func (c *conn) await(ctx context.Context, ws *websocket.Conn) (Message, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		ws.SetReadDeadline(deadline)
+		defer ws.SetReadDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { ws.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	for {
+		var m Message
+		if err := ws.ReadJSON(&m); err != nil {
+			if ctx.Err() != nil {
+				return Message{}, ctx.Err()
+			}
+			return Message{}, err
+		}
+		switch m.Type {
+		case c.ready:
+			return m, nil
+		case "ERROR":
+			return Message{}, messageError(m)
+		case "RATE_LIMITED", "MEMORY_WARNING":
+			// Advisory; nothing to act on before we're in
+		default:
+			return Message{}, fmt.Errorf("%w: %s", ErrUnexpected, m.Type)
+		}
+	}
+}
+
+func (c *conn) start(ws *websocket.Conn) {
+	c.ws = ws
+	c.events = make(chan Message, eventBuffer)
+	c.done = make(chan struct{})
+	c.quit = make(chan struct{})
+	go c.readLoop(ws)
+}
+
+// readLoop hands the relay's messages to Events until the connection ends
+func (c *conn) readLoop(ws *websocket.Conn) {
+	defer close(c.events)
+	defer close(c.done)
+	for {
+		var m Message
+		if err := ws.ReadJSON(&m); err != nil {
+			c.fail(err)
+			return
+		}
+		switch m.Type {
+		case "HEARTBEAT_ACK":
+			continue
+		case "MIGRATE":
+			next, err := c.migrate(m)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			ws = next
+			continue
+		case "ERROR", "ROOM_DESTROYED":
+			c.fail(messageError(m))
+		case "KICKED":
+			c.fail(&Error{Reason: "kicked"})
+		case "JOIN_TIMEOUT":
+			c.fail(&Error{Reason: "join timed out"})
+		}
+		select {
+		case c.events <- m:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// migrate follows a MIGRATE message, swapping in the new connection once
+// the relay there has taken us back. Writes wait for it.
+func (c *conn) migrate(m Message) (*websocket.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.Close()
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	// No URL means the same address, which another node now answers
+	if m.URL != "" {
+		c.base = m.URL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WriteTimeout)
+	defer cancel()
+	ws, ready, err := c.dial(ctx, url.Values{"resume": {m.ResumeToken}})
+	if err != nil {
+		return nil, fmt.Errorf("following MIGRATE: %w", err)
+	}
+	c.ws = ws
+	if c.onResume != nil {
+		c.onResume(ready)
+	}
+	return ws, nil
+}
+
+// send writes one message
+func (c *conn) send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return ErrClosed
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.ws.WriteJSON(m)
+}
+
+// sendPayload writes m carrying payload, which is sent as is if it's a
+// json.RawMessage and marshaled otherwise
+func (c *conn) sendPayload(m Message, payload any) error {
+	var err error
+	if m.Payload, err = marshalPayload(payload); err != nil {
+		return err
+	}
+	return c.send(m)
+}
+
+// close ends the connection from our side, after a last message if one
+// is given
+func (c *conn) close(last *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errMu.Lock()
+	if c.closed {
+		c.errMu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.errMu.Unlock()
+	close(c.quit)
+
+	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if last != nil {
+		c.ws.WriteJSON(*last)
+	}
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return c.ws.Close()
+}
+
+func (c *conn) isClosed() bool {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.closed
+}
+
+// fail records why the connection ended; the first reason sticks
+func (c *conn) fail(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil && !c.closed {
+		c.err = err
+	}
+}
+
+// Err reports why the connection ended: nil after Close, an *Error for
+// an ERROR, ROOM_DESTROYED, KICKED or JOIN_TIMEOUT message, or else the read error. It's only meaningful once Done is closed.
+func (c *conn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Events delivers the relay's messages, heartbeat acknowledgements and
+// MIGRATE aside. It's closed when the connection ends and must be drained,
+// or the connection stalls.
+func (c *conn) Events() <-chan Message {
+	return c.events
+}
+
+// Done is closed when the connection ends
+func (c *conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func marshalPayload(payload any) (json.RawMessage, error) {
+	switch p := payload.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		return p, nil
+	}
+	return json.Marshal(payload)
+}
+
+func messageError(m Message) *Error {
+	return &Error{Reason: m.Reason, RetryAfter: time.Duration(m.RetryAfterMs) * time.Millisecond, Quota: m.Quota}
+}
+
+// refusal turns an HTTP response in place of the upgrade into an *Error
+func refusal(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	e := &Error{Status: resp.StatusCode, Reason: strings.TrimSpace(string(body))}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// wsURL joins a ws(s):// or http(s):// base URL with path and query
+func wsURL(base, path string, query url.Values) (string, error) {
+	u, err := url.Parse(strings.TrimRight(base, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("relay URL must be ws://, wss://, http:// or https://, got %q", base)
+	}
+	u.Path += path
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
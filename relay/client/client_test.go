@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// next returns the next event, failing the test if none comes
+func next(t *testing.T, events <-chan Message) Message {
+	t.Helper()
+	select {
+	case m, ok := <-events:
+		if !ok {
+			t.Fatalf("Events closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event")
+	}
+	return Message{}
+}
+
+// TestHostFollowsMigrate verifies a host heartbeats, and that on MIGRATE
+// it resumes at the new address, picks up the new secret and carries on
+func TestHostFollowsMigrate(t *testing.T) {
+	got := make(chan Message, 16)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if r.URL.Query().Get("resume") == "tok" {
+			ws.WriteJSON(Message{Type: "ROOM_CREATED", Secret: "second"})
+			ws.WriteJSON(Message{Type: "CLIENT_MESSAGE", ClientID: "c1", Payload: []byte(`"hi"`)})
+		} else {
+			ws.WriteJSON(Message{Type: "ROOM_CREATED", Secret: "first"})
+		}
+		for {
+			var m Message
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			if m.Type == "HEARTBEAT" {
+				ws.WriteJSON(Message{Type: "HEARTBEAT_ACK"})
+			}
+			got <- m
+			if m.Type == "ROOM_OPEN" {
+				ws.WriteJSON(Message{Type: "MIGRATE", URL: srv.URL, ResumeToken: "tok"})
+				ws.WriteJSON(Message{Type: "ROOM_DESTROYED", Reason: "migrated"})
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h, err := Create(ctx, srv.URL, "", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer h.Close()
+	if !validRoomID(h.RoomID()) || h.Secret() != "first" {
+		t.Errorf("Expected a random room and secret first, got %q %q", h.RoomID(), h.Secret())
+	}
+
+	if m := next(t, got); m.Type != "HEARTBEAT" {
+		t.Errorf("Expected HEARTBEAT, got %s", m.Type)
+	}
+	h.Open()
+	if m := next(t, got); m.Type != "ROOM_OPEN" {
+		t.Errorf("Expected ROOM_OPEN, got %s", m.Type)
+	}
+
+	m := next(t, h.Events())
+	if m.Type != "CLIENT_MESSAGE" || string(m.Payload) != `"hi"` {
+		t.Errorf("Expected the message from the new node, got %+v", m)
+	}
+	if h.Secret() != "second" {
+		t.Errorf("Expected secret second, got %q", h.Secret())
+	}
+	if err := h.Broadcast("all"); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	if m := next(t, got); m.Type != "BROADCAST" || string(m.Payload) != `"all"` {
+		t.Errorf("Expected BROADCAST on the new node, got %+v", m)
+	}
+}
+
+// TestJoinRefusals verifies a load refusal is retried, other refusals and
+// an ERROR after the upgrade are returned, and the join query is sent
+func TestJoinRefusals(t *testing.T) {
+	var busy atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/rooms/"+strings.Repeat("b", 43)):
+			if busy.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+				return
+			}
+		case strings.HasPrefix(r.URL.Path, "/rooms/"+strings.Repeat("f", 43)):
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if r.URL.Query().Get("token") != "invite" {
+			ws.WriteJSON(Message{Type: "ERROR", Reason: "Invite required"})
+			return
+		}
+		ws.WriteJSON(Message{Type: "CONNECTED", ClientID: "c1", Role: "observer", ClientSecret: "s1"})
+		ws.ReadMessage()
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var refused *Error
+	_, err := Join(ctx, srv.URL, strings.Repeat("f", 43), nil)
+	if !errors.As(err, &refused) || refused.Status != http.StatusForbidden {
+		t.Errorf("Expected a 403 refusal, got %v", err)
+	}
+	_, err = Join(ctx, srv.URL, strings.Repeat("e", 43), nil)
+	if !errors.As(err, &refused) || refused.Reason != "Invite required" {
+		t.Errorf("Expected the relay's ERROR, got %v", err)
+	}
+	if _, err := Join(ctx, srv.URL, "short", nil); err != ErrInvalidRoomID {
+		t.Errorf("Expected ErrInvalidRoomID, got %v", err)
+	}
+
+	c, err := Join(ctx, srv.URL, strings.Repeat("b", 43), &JoinOptions{Token: "invite"})
+	if err != nil {
+		t.Fatalf("Expected the retry to get in, got %v", err)
+	}
+	defer c.Close()
+	if busy.Load() != 2 || c.ID() != "c1" || c.Role() != "observer" || c.Secret() != "s1" {
+		t.Errorf("Expected c1 as observer on the second dial, got %q %q %q after %d", c.ID(), c.Role(), c.Secret(), busy.Load())
+	}
+}
+
+// TestHostApproveAndReject verifies Approve and Reject each say outright
+// whether the joiner is accepted: a relay treats no answer as no
+func TestHostApproveAndReject(t *testing.T) {
+	got := make(chan Message, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.WriteJSON(Message{Type: "ROOM_CREATED", Secret: "s"})
+		for {
+			var m Message
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			if m.Type == "JOIN_RESPONSE" {
+				got <- m
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h, err := Create(ctx, srv.URL, "", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer h.Close()
+
+	h.Approve("c1", "key")
+	if m := next(t, got); m.ClientID != "c1" || m.Approved == nil || !*m.Approved || string(m.Payload) != `"key"` {
+		t.Errorf("Expected c1 approved with its key, got %+v", m)
+	}
+	h.Reject("c2", "no")
+	if m := next(t, got); m.ClientID != "c2" || m.Approved == nil || *m.Approved || string(m.Payload) != `"no"` {
+		t.Errorf("Expected c2 turned down with the reason, got %+v", m)
+	}
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Host is a room's host connection. The room lasts as long as it does.
+type Host struct {
+	conn
+	roomID string
+
+	secretMu sync.Mutex
+	secret   string
+}
+
+// InviteRequest asks for an invite over the host's socket, as the HTTP
+// create endpoint does. The zero value is a participant invite of the
+// relay's default lifetime.
+type InviteRequest struct {
+	TTLSeconds  int64  `json:"ttlSeconds,omitempty"`
+	Scope       string `json:"scope,omitempty"`       // participant, observer or cohost
+	Fingerprint string `json:"fingerprint,omitempty"` // joiner's key fingerprint the token is bound to
+	Metadata    []byte `json:"metadata,omitempty"`    // returned to the joiner on validation
+}
+
+// Invite is an INVITE_CREATED message's payload
+type Invite struct {
+	Token     string `json:"token"`
+	RoomID    string `json:"roomId"`
+	ExpiresIn int64  `json:"expiresIn"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Scope     string `json:"scope"`
+}
+
+// Stats is a ROOM_STATS message's payload
+type Stats struct {
+	Clients       int    `json:"clients"`
+	Pending       int    `json:"pending"`
+	Messages      uint64 `json:"messages"`
+	Bytes         uint64 `json:"bytes"`
+	Dropped       uint64 `json:"dropped"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// Create creates the room roomID on the relay at baseURL and becomes its
+// host; an empty roomID gets a random one. The room starts closed to
+// joins until Open.
+func Create(ctx context.Context, baseURL, roomID string, opts *Options) (*Host, error) {
+	if roomID == "" {
+		var err error
+		if roomID, err = NewRoomID(); err != nil {
+			return nil, err
+		}
+	}
+	if !validRoomID(roomID) {
+		return nil, ErrInvalidRoomID
+	}
+
+	h := &Host{roomID: roomID}
+	h.conn = conn{
+		opts:  opts,
+		base:  baseURL,
+		path:  "/rooms/" + roomID,
+		ready: "ROOM_CREATED",
+		// A room resumed elsewhere has a new secret
+		onResume: func(m Message) { h.setSecret(m.Secret) },
+	}
+	ws, created, err := h.dial(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	h.setSecret(created.Secret)
+	h.start(ws)
+	go h.heartbeat()
+	return h, nil
+}
+
+// heartbeat keeps the room alive until the connection ends
+func (h *Host) heartbeat() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.send(Message{Type: "HEARTBEAT"})
+		}
+	}
+}
+
+// RoomID returns the room's ID
+func (h *Host) RoomID() string {
+	return h.roomID
+}
+
+// Secret returns the host secret, which authorizes the room's HTTP APIs
+// such as invite creation and TURN credentials
+func (h *Host) Secret() string {
+	h.secretMu.Lock()
+	defer h.secretMu.Unlock()
+	return h.secret
+}
+
+func (h *Host) setSecret(secret string) {
+	h.secretMu.Lock()
+	h.secret = secret
+	h.secretMu.Unlock()
+}
+
+// Open starts the room taking join requests
+func (h *Host) Open() error {
+	return h.send(Message{Type: "ROOM_OPEN"})
+}
+
+// Approve answers clientID's JOIN_REQUEST with payload, typically the
+// room key sealed to the joiner. The relay passes on its messages from
+// then, and its JOIN_CONFIRM admits it.
+func (h *Host) Approve(clientID string, payload any) error {
+	approved := true
+	return h.sendPayload(Message{Type: "JOIN_RESPONSE", ClientID: clientID, Approved: &approved}, payload)
+}
+
+// Reject turns clientID's JOIN_REQUEST down, with payload, such as a
+// reason, passed on to the joiner. The relay passes on none of its
+// messages; Kick it to hang up on it as well.
+func (h *Host) Reject(clientID string, payload any) error {
+	approved := false
+	return h.sendPayload(Message{Type: "JOIN_RESPONSE", ClientID: clientID, Approved: &approved}, payload)
+}
+
+// Broadcast sends payload to every confirmed client
+func (h *Host) Broadcast(payload any) error {
+	return h.sendPayload(Message{Type: "BROADCAST"}, payload)
+}
+
+// Direct sends payload to clientID alone
+func (h *Host) Direct(clientID string, payload any) error {
+	return h.sendPayload(Message{Type: "DIRECT", ClientID: clientID}, payload)
+}
+
+// Kick removes clientID from the room
+func (h *Host) Kick(clientID string) error {
+	return h.send(Message{Type: "KICK", ClientID: clientID})
+}
+
+// RequestStats asks for the room's counters, which arrive on Events as a
+// ROOM_STATS message; Stats decodes its payload
+func (h *Host) RequestStats() error {
+	return h.send(Message{Type: "ROOM_STATS"})
+}
+
+// CreateInvite asks for an invite token, which arrives on Events as an
+// INVITE_CREATED message (Invite decodes its payload) or an INVITE_ERROR
+func (h *Host) CreateInvite(req InviteRequest) error {
+	return h.sendPayload(Message{Type: "CREATE_INVITE"}, req)
+}
+
+// Close ends the room, telling its clients, and the connection with it
+func (h *Host) Close() error {
+	return h.close(&Message{Type: "ROOM_CLOSE"})
+}
+
+// CloseAfter starts the room's closing countdown: its clients are sent
+// ROOM_CLOSING, no one else may join, and the relay destroys the room once
+// grace has passed, the host's ROOM_DESTROYED ending the connection. The
+// relay caps grace at a minute.
+func (h *Host) CloseAfter(grace time.Duration) error {
+	return h.send(Message{Type: "ROOM_CLOSE", GraceMs: grace.Milliseconds()})
+}
+
+// Stats decodes a ROOM_STATS message's payload
+func (m Message) Stats() (Stats, error) {
+	var s Stats
+	err := json.Unmarshal(m.Payload, &s)
+	return s, err
+}
+
+// Invite decodes an INVITE_CREATED message's payload
+func (m Message) Invite() (Invite, error) {
+	var inv Invite
+	err := json.Unmarshal(m.Payload, &inv)
+	return inv, err
+}
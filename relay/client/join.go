@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// JoinOptions are what a joiner presents to get in
+type JoinOptions struct {
+	Options
+	Token       string // invite token, if the room requires one
+	Fingerprint string // the joiner's key fingerprint, for a bound token
+}
+
+// Client is a joiner's connection to a room
+type Client struct {
+	conn
+	id   string
+	role string
+
+	secretMu sync.Mutex
+	secret   string
+}
+
+// Join connects to the room roomID on the relay at baseURL. The relay
+// assigns the connection an ID and the role its invite grants; it then
+// waits on the host, to whom Request introduces it.
+func Join(ctx context.Context, baseURL, roomID string, opts *JoinOptions) (*Client, error) {
+	if !validRoomID(roomID) {
+		return nil, ErrInvalidRoomID
+	}
+	if opts == nil {
+		opts = &JoinOptions{}
+	}
+	query := url.Values{}
+	if opts.Token != "" {
+		query.Set("token", opts.Token)
+	}
+	if opts.Fingerprint != "" {
+		query.Set("fingerprint", opts.Fingerprint)
+	}
+
+	c := &Client{}
+	c.conn = conn{
+		opts:  &opts.Options,
+		base:  baseURL,
+		path:  "/rooms/" + roomID + "/join",
+		ready: "CONNECTED",
+		// A resumed connection keeps its ID and role, but not its secret
+		onResume: func(m Message) { c.setSecret(m.ClientSecret) },
+	}
+	ws, connected, err := c.dial(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.id, c.role = connected.ClientID, connected.Role
+	c.setSecret(connected.ClientSecret)
+	c.start(ws)
+	return c, nil
+}
+
+// ID returns the client ID the relay assigned
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Role returns the role the invite granted: participant, observer or
+// cohost
+func (c *Client) Role() string {
+	return c.role
+}
+
+// Secret returns the client's secret, which proves it's the member
+// reporting the room on the report API
+func (c *Client) Secret() string {
+	c.secretMu.Lock()
+	defer c.secretMu.Unlock()
+	return c.secret
+}
+
+func (c *Client) setSecret(secret string) {
+	c.secretMu.Lock()
+	c.secret = secret
+	c.secretMu.Unlock()
+}
+
+// Request asks the host to let the client in, with payload typically
+// carrying the joiner's public key. The host's answer arrives on Events as
+// a JOIN_RESPONSE.
+func (c *Client) Request(payload any) error {
+	return c.sendPayload(Message{Type: "JOIN_REQUEST"}, payload)
+}
+
+// RequestWithProfile is Request with the joiner's profile, encrypted so
+// only members can read it. Once the client confirms, the relay hands it
+// to every member, and theirs to the client, as PROFILE messages.
+func (c *Client) RequestWithProfile(payload, profile any) error {
+	m := Message{Type: "JOIN_REQUEST"}
+	var err error
+	if m.Profile, err = marshalPayload(profile); err != nil {
+		return err
+	}
+	return c.sendPayload(m, payload)
+}
+
+// Confirm completes the join after the host's JOIN_RESPONSE, from which
+// point the client receives the room's messages
+func (c *Client) Confirm(payload any) error {
+	return c.sendPayload(Message{Type: "JOIN_CONFIRM"}, payload)
+}
+
+// Send sends payload to the host and the room's other clients. Observers'
+// messages are dropped.
+func (c *Client) Send(payload any) error {
+	return c.sendPayload(Message{Type: "MESSAGE"}, payload)
+}
+
+// Kick removes clientID from the room; the relay only takes this from a
+// cohost, and never against another cohost
+func (c *Client) Kick(clientID string) error {
+	return c.send(Message{Type: "KICK", ClientID: clientID})
+}
+
+// ReportError tells the host something went wrong on the client's side,
+// such as a message it couldn't decrypt
+func (c *Client) ReportError(category string, payload any) error {
+	return c.sendPayload(Message{Type: "CLIENT_ERROR", Category: category}, payload)
+}
+
+// Close leaves the room
+func (c *Client) Close() error {
+	return c.close(nil)
+}
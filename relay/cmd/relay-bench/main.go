@@ -0,0 +1,117 @@
+// Relay Bench
+//
+// Load-tests a running relay with real WebSocket connections. It opens
+// -rooms hosts, each approving -clients joiners, then has every client send
+// -rate messages a second and every host broadcast -host-rate a second for
+// -duration. It reports how long creating, connecting and joining took,
+// how long messages took through the relay, and how many of the deliveries
+// the relay owed never arrived.
+//
+// Every connection comes from this machine, so the relay's per-IP limits
+// apply to all of them together: allow the bench's address with
+// /admin/access first, or the run measures the rate limiter. Thousands of
+// connections also need a matching open file limit (ulimit -n) on both
+// ends.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/client"
+	"github.com/gorilla/websocket"
+)
+
+func main() {
+	url := flag.String("url", "ws://localhost:8443", "Relay base URL (ws:// or wss://)")
+	rooms := flag.Int("rooms", 10, "Rooms to open")
+	clients := flag.Int("clients", 10, "Clients joining each room")
+	rate := flag.Float64("rate", 1, "Messages per second each client sends")
+	hostRate := flag.Float64("host-rate", 0, "Broadcasts per second each host sends")
+	size := flag.Int("size", 256, "Padding bytes in each message")
+	duration := flag.Duration("duration", 30*time.Second, "How long to send for, once everyone has joined")
+	ramp := flag.Duration("ramp", 5*time.Second, "Time over which rooms open, and again over which each room's clients join")
+	drain := flag.Duration("drain", 2*time.Second, "Wait after sending stops for deliveries still in flight")
+	timeout := flag.Duration("timeout", 10*time.Second, "Per-connection connect timeout")
+	skipVerify := flag.Bool("insecure-skip-verify", false, "Skip TLS certificate verification")
+	jsonOut := flag.Bool("json", false, "Emit the report as JSON")
+	flag.Parse()
+
+	if *rooms < 1 || *clients < 0 {
+		fmt.Fprintln(os.Stderr, "relay-bench: -rooms must be at least 1 and -clients not negative")
+		os.Exit(2)
+	}
+
+	b := &bench{
+		url: strings.TrimSuffix(*url, "/"),
+		opts: &client.Options{Dialer: &websocket.Dialer{
+			HandshakeTimeout: *timeout,
+			TLSClientConfig:  &tls.Config{InsecureSkipVerify: *skipVerify},
+		}},
+		clients:  *clients,
+		ramp:     *ramp,
+		timeout:  *timeout,
+		rate:     *rate,
+		hostRate: *hostRate,
+		pad:      padding(*size),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	b.connecting.Add(*rooms * *clients)
+	progress("Opening %d rooms of %d clients", *rooms, *clients)
+	for i := range *rooms {
+		wg.Add(1)
+		delay := *ramp * time.Duration(i) / time.Duration(*rooms)
+		go func() {
+			select {
+			case <-time.After(delay):
+				b.runRoom(ctx, wg.Done)
+			case <-ctx.Done():
+				wg.Done()
+			}
+		}()
+	}
+
+	// Everyone who will get in has, or has had long enough
+	connected := make(chan struct{})
+	go func() {
+		b.connecting.Wait()
+		close(connected)
+	}()
+	select {
+	case <-connected:
+	case <-time.After(2**ramp + 2**timeout):
+		progress("Some clients never got in; starting anyway")
+	}
+
+	progress("%d rooms, %d clients in; sending for %v", b.stats.hosts.Load(), b.stats.joined.Load(), *duration)
+	b.sending.Store(true)
+	time.Sleep(*duration)
+	b.sending.Store(false)
+	time.Sleep(*drain)
+	cancel()
+	wg.Wait()
+
+	r := b.stats.report(b.url)
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(r)
+	} else {
+		r.print()
+	}
+	if r.RoomsFailed > 0 || r.ClientsFailed > 0 {
+		os.Exit(1)
+	}
+}
+
+// progress goes to stderr, keeping stdout for the report
+func progress(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
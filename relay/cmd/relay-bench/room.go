@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ephemeral/relay/client"
+)
+
+// probe is every benchmark message's payload
+type probe struct {
+	Sent int64  `json:"t"` // sender's clock, unix nanoseconds
+	Pad  string `json:"p,omitempty"`
+}
+
+// bench is one run's shared settings and state
+type bench struct {
+	url        string
+	opts       *client.Options
+	clients    int           // per room
+	ramp       time.Duration // over which each room's clients arrive
+	timeout    time.Duration // per connection attempt
+	rate       float64       // messages per second per client
+	hostRate   float64       // broadcasts per second per host
+	pad        string
+	stats      stats
+	sending    atomic.Bool // the send phase is on
+	connecting sync.WaitGroup
+}
+
+// room is one host and its clients
+type room struct {
+	b     *bench
+	host  *client.Host
+	ready atomic.Int64 // confirmed clients, each of whom gets broadcasts
+}
+
+func (b *bench) payload() probe {
+	return probe{Sent: time.Now().UnixNano(), Pad: b.pad}
+}
+
+// receive records a delivery
+func (b *bench) receive(payload json.RawMessage) {
+	var p probe
+	if json.Unmarshal(payload, &p) != nil || p.Sent == 0 {
+		return
+	}
+	b.stats.recv.Add(1)
+	b.stats.relay.add(time.Since(time.Unix(0, p.Sent)))
+}
+
+// ticker fires rate times a second from a random phase, or never for a
+// zero rate
+func ticker(ctx context.Context, rate float64) <-chan time.Time {
+	if rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	ch := make(chan time.Time)
+	go func() {
+		timer := time.NewTimer(rand.N(interval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-timer.C:
+				timer.Reset(interval)
+				select {
+				case ch <- t:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// runRoom creates a room, approves every joiner and starts its clients.
+// It returns once the room is over.
+func (b *bench) runRoom(ctx context.Context, done func()) {
+	defer done()
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, b.timeout)
+	h, err := client.Create(dialCtx, b.url, "", b.opts)
+	cancel()
+	if err != nil {
+		b.stats.hostsFailed.Add(1)
+		b.stats.fail("create", err)
+		for range b.clients {
+			b.connecting.Done()
+		}
+		return
+	}
+	defer h.Close()
+	b.stats.create.add(time.Since(start))
+	b.stats.hosts.Add(1)
+	r := &room{b: b, host: h}
+
+	if err := h.Open(); err != nil {
+		b.stats.fail("open", err)
+	}
+	// ROOM_OPEN has no reply; give it a moment to land
+	time.Sleep(100 * time.Millisecond)
+
+	var clients sync.WaitGroup
+	for i := range b.clients {
+		clients.Add(1)
+		delay := time.Duration(0)
+		if b.clients > 1 {
+			delay = b.ramp * time.Duration(i) / time.Duration(b.clients)
+		}
+		go r.runClient(ctx, delay, clients.Done)
+	}
+
+	broadcasts := ticker(ctx, b.hostRate)
+	for {
+		select {
+		case m, ok := <-h.Events():
+			if !ok {
+				if ctx.Err() == nil {
+					b.stats.disconnects.Add(1)
+					b.stats.fail("host", h.Err())
+				}
+				clients.Wait()
+				return
+			}
+			switch m.Type {
+			case "JOIN_REQUEST":
+				h.Approve(m.ClientID, nil)
+			case "CLIENT_MESSAGE":
+				b.receive(m.Payload)
+			case "RATE_LIMITED":
+				b.stats.rateLimited.Add(1)
+			}
+		case <-broadcasts:
+			if b.sending.Load() {
+				b.stats.expected.Add(r.ready.Load())
+				if h.Broadcast(b.payload()) == nil {
+					b.stats.sent.Add(1)
+				}
+			}
+		case <-ctx.Done():
+			clients.Wait()
+			return
+		}
+	}
+}
+
+// runClient joins after delay, then sends at the bench's rate while the
+// send phase is on
+func (r *room) runClient(ctx context.Context, delay time.Duration, done func()) {
+	defer done()
+	b := r.b
+	connecting := true
+	finishConnecting := func() {
+		if connecting {
+			connecting = false
+			b.connecting.Done()
+		}
+	}
+	defer finishConnecting()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, b.timeout)
+	c, err := client.Join(dialCtx, b.url, r.host.RoomID(), &client.JoinOptions{Options: *b.opts})
+	cancel()
+	if err != nil {
+		b.stats.joinsFailed.Add(1)
+		b.stats.fail("join", err)
+		return
+	}
+	defer c.Close()
+	b.stats.connect.add(time.Since(start))
+	if err := c.Request(nil); err != nil {
+		b.stats.joinsFailed.Add(1)
+		b.stats.fail("join", err)
+		return
+	}
+
+	joined := false
+	var sends <-chan time.Time
+	for {
+		select {
+		case m, ok := <-c.Events():
+			if !ok {
+				if ctx.Err() == nil {
+					if connecting {
+						b.stats.joinsFailed.Add(1)
+					} else {
+						b.stats.disconnects.Add(1)
+					}
+					b.stats.fail("client", c.Err())
+				}
+				return
+			}
+			switch m.Type {
+			case "JOIN_RESPONSE":
+				if joined {
+					continue
+				}
+				joined = true
+				b.stats.join.add(time.Since(start))
+				if err := c.Confirm(nil); err != nil {
+					continue
+				}
+				b.stats.joined.Add(1)
+				r.ready.Add(1)
+				defer r.ready.Add(-1)
+				finishConnecting()
+				sends = ticker(ctx, b.rate)
+			case "MESSAGE":
+				b.receive(m.Payload)
+			case "RATE_LIMITED":
+				b.stats.rateLimited.Add(1)
+			}
+		case <-sends:
+			if b.sending.Load() {
+				// The host and every other confirmed client
+				b.stats.expected.Add(r.ready.Load())
+				if c.Send(b.payload()) == nil {
+					b.stats.sent.Add(1)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func padding(size int) string {
+	return strings.Repeat("x", max(0, size))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ephemeral/relay/client"
+)
+
+// latencies collects samples of one measurement
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.samples = append(l.samples, d)
+	l.mu.Unlock()
+}
+
+// summary is a latency distribution in milliseconds
+type summary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+func (l *latencies) summary() summary {
+	l.mu.Lock()
+	s := slices.Clone(l.samples)
+	l.mu.Unlock()
+	if len(s) == 0 {
+		return summary{}
+	}
+	slices.Sort(s)
+	// Nearest rank: the smallest sample with at least q of them at or
+	// below it
+	at := func(q float64) float64 {
+		return ms(s[max(0, int(math.Ceil(q*float64(len(s))))-1)])
+	}
+	return summary{Count: len(s), P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: ms(s[len(s)-1])}
+}
+
+func (s summary) String() string {
+	if s.Count == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("p50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms  (%d)", s.P50, s.P90, s.P99, s.Max, s.Count)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// stats is everything a run measures
+type stats struct {
+	create  latencies // dial to ROOM_CREATED
+	connect latencies // dial to CONNECTED
+	join    latencies // dial to JOIN_RESPONSE, through the host's approval
+	relay   latencies // send to receipt, per delivery
+
+	hosts, hostsFailed   atomic.Int64
+	joined, joinsFailed  atomic.Int64
+	sent, expected, recv atomic.Int64
+	rateLimited          atomic.Int64
+	disconnects          atomic.Int64 // connections lost mid-run
+
+	mu       sync.Mutex
+	failures map[string]int // by reason
+}
+
+// fail counts a failure under a reason short enough to group by
+func (s *stats) fail(what string, err error) {
+	reason := err.Error()
+	var relayErr *client.Error
+	if errors.As(err, &relayErr) {
+		reason = relayErr.Reason
+		if relayErr.Status != 0 {
+			reason = fmt.Sprintf("%d %s", relayErr.Status, relayErr.Reason)
+		}
+	}
+	s.mu.Lock()
+	if s.failures == nil {
+		s.failures = make(map[string]int)
+	}
+	s.failures[what+": "+reason]++
+	s.mu.Unlock()
+}
+
+// report is the run's result, as printed with -json
+type report struct {
+	URL           string         `json:"url"`
+	Rooms         int64          `json:"rooms"`
+	RoomsFailed   int64          `json:"roomsFailed"`
+	Clients       int64          `json:"clients"`
+	ClientsFailed int64          `json:"clientsFailed"`
+	Create        summary        `json:"create"`
+	Connect       summary        `json:"connect"`
+	Join          summary        `json:"join"`
+	Relay         summary        `json:"relay"`
+	Sent          int64          `json:"sent"`
+	Expected      int64          `json:"expectedDeliveries"`
+	Received      int64          `json:"received"`
+	DropRate      float64        `json:"dropRate"`
+	RateLimited   int64          `json:"rateLimited"`
+	Disconnects   int64          `json:"disconnects"`
+	Failures      map[string]int `json:"failures,omitempty"`
+}
+
+func (s *stats) report(url string) report {
+	r := report{
+		URL:           url,
+		Rooms:         s.hosts.Load(),
+		RoomsFailed:   s.hostsFailed.Load(),
+		Clients:       s.joined.Load(),
+		ClientsFailed: s.joinsFailed.Load(),
+		Create:        s.create.summary(),
+		Connect:       s.connect.summary(),
+		Join:          s.join.summary(),
+		Relay:         s.relay.summary(),
+		Sent:          s.sent.Load(),
+		Expected:      s.expected.Load(),
+		Received:      s.recv.Load(),
+		RateLimited:   s.rateLimited.Load(),
+		Disconnects:   s.disconnects.Load(),
+	}
+	if r.Expected > 0 {
+		r.DropRate = max(0, float64(r.Expected-r.Received)/float64(r.Expected))
+	}
+	s.mu.Lock()
+	if len(s.failures) > 0 {
+		r.Failures = make(map[string]int, len(s.failures))
+		for k, v := range s.failures {
+			r.Failures[k] = v
+		}
+	}
+	s.mu.Unlock()
+	return r
+}
+
+func (r report) print() {
+	fmt.Printf("Rooms     %d created, %d failed\n", r.Rooms, r.RoomsFailed)
+	fmt.Printf("Clients   %d joined, %d failed, %d lost mid-run\n", r.Clients, r.ClientsFailed, r.Disconnects)
+	fmt.Printf("Create    %s\n", r.Create)
+	fmt.Printf("Connect   %s\n", r.Connect)
+	fmt.Printf("Join      %s\n", r.Join)
+	fmt.Printf("Relay     %s\n", r.Relay)
+	fmt.Printf("Messages  %d sent, %d deliveries expected, %d received, %.2f%% dropped\n",
+		r.Sent, r.Expected, r.Received, r.DropRate*100)
+	fmt.Printf("Limited   %d RATE_LIMITED notices\n", r.RateLimited)
+	if len(r.Failures) > 0 {
+		reasons := make([]string, 0, len(r.Failures))
+		for k := range r.Failures {
+			reasons = append(reasons, k)
+		}
+		slices.Sort(reasons)
+		fmt.Println("Failures")
+		for _, k := range reasons {
+			fmt.Printf("  %6d  %s\n", r.Failures[k], k)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/client"
+)
+
+// TestSummaryPercentiles verifies each percentile is the nearest-rank
+// sample, whatever order the samples came in
+func TestSummaryPercentiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int // 1ms, 2ms, ... up to this many
+		want    summary
+	}{
+		{"none", 0, summary{}},
+		{"one", 1, summary{Count: 1, P50: 1, P90: 1, P99: 1, Max: 1}},
+		{"two", 2, summary{Count: 2, P50: 1, P90: 2, P99: 2, Max: 2}},
+		{"ten", 10, summary{Count: 10, P50: 5, P90: 9, P99: 10, Max: 10}},
+		{"hundred", 100, summary{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}},
+		{"thousand", 1000, summary{Count: 1000, P50: 500, P90: 900, P99: 990, Max: 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l latencies
+			for _, i := range rand.Perm(tt.samples) {
+				l.add(time.Duration(i+1) * time.Millisecond)
+			}
+			if got := l.summary(); got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestReportDropRate verifies the drop rate is the share of expected
+// deliveries that never arrived, and never negative
+func TestReportDropRate(t *testing.T) {
+	tests := []struct {
+		name               string
+		expected, received int64
+		want               float64
+	}{
+		{"nothing sent", 0, 0, 0},
+		{"all delivered", 100, 100, 0},
+		{"some dropped", 100, 75, 0.25},
+		{"all dropped", 40, 0, 1},
+		// Expected deliveries count the clients ready at each send, so one
+		// getting ready as a send goes out can receive more than expected
+		{"more than expected", 100, 101, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s stats
+			s.expected.Store(tt.expected)
+			s.recv.Store(tt.received)
+			r := s.report("ws://relay")
+			if r.DropRate != tt.want || r.Expected != tt.expected || r.Received != tt.received {
+				t.Errorf("Expected a drop rate of %v, got %v (%d/%d)", tt.want, r.DropRate, r.Received, r.Expected)
+			}
+		})
+	}
+}
+
+// TestFailuresGrouped verifies failures are counted by what failed and
+// the relay's reason, with its HTTP status when it refused the upgrade
+func TestFailuresGrouped(t *testing.T) {
+	var s stats
+	if r := s.report(""); r.Failures != nil {
+		t.Errorf("Expected no failures, got %v", r.Failures)
+	}
+
+	s.fail("join", &client.Error{Status: http.StatusTooManyRequests, Reason: "rate limited"})
+	s.fail("join", fmt.Errorf("dial: %w", &client.Error{Status: http.StatusTooManyRequests, Reason: "rate limited"}))
+	s.fail("join", &client.Error{Reason: "room is not open for joins"})
+	s.fail("host", errors.New("connection reset"))
+
+	want := map[string]int{
+		"join: 429 rate limited":           2,
+		"join: room is not open for joins": 1,
+		"host: connection reset":           1,
+	}
+	got := s.report("").Failures
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected %d of %q, got %d", v, k, got[k])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key schedule labels; a change to the scheme changes these
+const (
+	wrapLabel    = "relay-chat v1 join"
+	confirmLabel = "relay-chat v1 confirm"
+)
+
+var errBadCiphertext = errors.New("message failed to decrypt")
+
+// Join payloads. Byte slices travel as base64.
+type joinRequest struct {
+	Name      string `json:"name"`
+	PublicKey []byte `json:"publicKey"` // the joiner's X25519 key
+}
+
+type joinResponse struct {
+	PublicKey []byte `json:"publicKey"` // the host's X25519 key for this join
+	RoomKey   string `json:"roomKey"`   // the room key, sealed to the joiner
+}
+
+type joinConfirm struct {
+	Proof []byte `json:"proof"` // shows the joiner holds the room key
+}
+
+// chatMessage is what every room message decrypts to
+type chatMessage struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// sealer encrypts and decrypts under one key, bound to the room
+type sealer struct {
+	aead cipher.AEAD
+	ad   []byte
+}
+
+func newSealer(key []byte, ad string) (*sealer, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, ad: []byte(ad)}, nil
+}
+
+// seal returns base64 of a random nonce followed by the ciphertext
+func (s *sealer) seal(plain []byte) string {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, s.ad))
+}
+
+func (s *sealer) open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return nil, errBadCiphertext
+	}
+	nonce, ct := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ct, s.ad)
+	if err != nil {
+		return nil, errBadCiphertext
+	}
+	return plain, nil
+}
+
+// sealMessage seals a chat message as a room payload
+func (s *sealer) sealMessage(m chatMessage) string {
+	plain, _ := json.Marshal(m)
+	return s.seal(plain)
+}
+
+// openMessage opens a room payload sealed by sealMessage
+func (s *sealer) openMessage(payload json.RawMessage) (chatMessage, error) {
+	var sealed string
+	var m chatMessage
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return m, errBadCiphertext
+	}
+	plain, err := s.open(sealed)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return m, errBadCiphertext
+	}
+	return m, nil
+}
+
+// wrapSealer is the key one join's room key is sealed under: X25519
+// between the host's key for the join and the joiner's, through HKDF,
+// bound to the room and both public keys
+func wrapSealer(priv *ecdh.PrivateKey, peer []byte, roomID string, hostPub, joinerPub []byte) (*sealer, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, []byte(roomID), []byte(wrapLabel)), key); err != nil {
+		return nil, err
+	}
+	return newSealer(key, roomID+"|"+hex.EncodeToString(hostPub)+"|"+hex.EncodeToString(joinerPub))
+}
+
+// confirmProof is the MAC a joiner returns once it has the room key
+func confirmProof(roomKey, joinerPub []byte) []byte {
+	mac := hmac.New(sha256.New, roomKey)
+	mac.Write([]byte(confirmLabel))
+	mac.Write(joinerPub)
+	return mac.Sum(nil)
+}
+
+// fingerprint is a short form of a public key for people to compare
+// aloud, so a relay swapping keys in the join shows
+func fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	h := strings.ToUpper(hex.EncodeToString(sum[:10]))
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	return key
+}
+
+// TestSealRoundTrip verifies what one sealer seals, a sealer with the same
+// key and room opens, and that a tampered message, another key or another
+// room fails
+func TestSealRoundTrip(t *testing.T) {
+	key := newKey(t)
+	s, err := newSealer(key, "room")
+	if err != nil {
+		t.Fatalf("newSealer failed: %v", err)
+	}
+
+	sealed := s.seal([]byte("hello"))
+	if plain, err := s.open(sealed); err != nil || string(plain) != "hello" {
+		t.Fatalf("Expected hello back, got %q, %v", plain, err)
+	}
+	if s.seal([]byte("hello")) == sealed {
+		t.Error("Expected a fresh nonce for every seal")
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(sealed)
+	data[len(data)-1] ^= 1
+	otherKey, _ := newSealer(newKey(t), "room")
+	otherRoom, _ := newSealer(key, "other room")
+	for name, tc := range map[string]struct {
+		s      *sealer
+		sealed string
+	}{
+		"tampered":   {s, base64.StdEncoding.EncodeToString(data)},
+		"truncated":  {s, base64.StdEncoding.EncodeToString(data[:10])},
+		"not base64": {s, "!"},
+		"other key":  {otherKey, sealed},
+		"other room": {otherRoom, sealed},
+	} {
+		if _, err := tc.s.open(tc.sealed); err != errBadCiphertext {
+			t.Errorf("%s: expected errBadCiphertext, got %v", name, err)
+		}
+	}
+
+	payload, _ := json.Marshal(s.sealMessage(chatMessage{Name: "ann", Text: "hi"}))
+	if m, err := s.openMessage(payload); err != nil || m != (chatMessage{Name: "ann", Text: "hi"}) {
+		t.Errorf("Expected ann's message back, got %+v, %v", m, err)
+	}
+	if _, err := s.openMessage(json.RawMessage(`{"text":"hi"}`)); err != errBadCiphertext {
+		t.Errorf("Expected a plaintext payload refused, got %v", err)
+	}
+}
+
+// TestWrapSealerAgrees verifies the host and the joiner derive the same
+// wrapping key for a join, and that it's bound to the room and both keys
+func TestWrapSealerAgrees(t *testing.T) {
+	hostPriv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	joinerPriv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	hostPub, joinerPub := hostPriv.PublicKey().Bytes(), joinerPriv.PublicKey().Bytes()
+
+	hostWrap, err := wrapSealer(hostPriv, joinerPub, "room", hostPub, joinerPub)
+	if err != nil {
+		t.Fatalf("wrapSealer failed: %v", err)
+	}
+	roomKey := newKey(t)
+	sealed := hostWrap.seal(roomKey)
+
+	joinerWrap, err := wrapSealer(joinerPriv, hostPub, "room", hostPub, joinerPub)
+	if err != nil {
+		t.Fatalf("wrapSealer failed: %v", err)
+	}
+	if got, err := joinerWrap.open(sealed); err != nil || !bytes.Equal(got, roomKey) {
+		t.Fatalf("Expected the joiner to unwrap the room key, got %v", err)
+	}
+
+	// A relay swapping in its own key for the host's gets a different key
+	mitm, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	mitmPub := mitm.PublicKey().Bytes()
+	otherRoom, _ := wrapSealer(joinerPriv, hostPub, "other room", hostPub, joinerPub)
+	swapped, _ := wrapSealer(joinerPriv, mitmPub, "room", mitmPub, joinerPub)
+	for name, s := range map[string]*sealer{"other room": otherRoom, "swapped key": swapped} {
+		if _, err := s.open(sealed); err == nil {
+			t.Errorf("%s: expected the room key not to unwrap", name)
+		}
+	}
+
+	if _, err := wrapSealer(joinerPriv, []byte("short"), "room", hostPub, joinerPub); err == nil {
+		t.Error("Expected a malformed peer key refused")
+	}
+}
+
+// TestConfirmProof verifies the proof depends on both the room key and
+// the joiner's key
+func TestConfirmProof(t *testing.T) {
+	roomKey, pub := newKey(t), newKey(t)
+	proof := confirmProof(roomKey, pub)
+	if !bytes.Equal(proof, confirmProof(roomKey, pub)) {
+		t.Fatal("Expected the same proof for the same keys")
+	}
+	if bytes.Equal(proof, confirmProof(newKey(t), pub)) || bytes.Equal(proof, confirmProof(roomKey, newKey(t))) {
+		t.Error("Expected a different proof for a different key")
+	}
+}
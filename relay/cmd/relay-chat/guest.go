@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ephemeral/relay/client"
+)
+
+type guest struct {
+	c    *client.Client
+	name string
+	priv *ecdh.PrivateKey
+	room *sealer // nil until the host lets us in
+}
+
+func runGuest(ctx context.Context, lines <-chan string, url, roomID, name string, opts *client.JoinOptions) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	c, err := client.Join(ctx, url, roomID, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	s := &guest{c: c, name: name, priv: priv}
+
+	pub := priv.PublicKey().Bytes()
+	if err := c.Request(joinRequest{Name: name, PublicKey: pub}); err != nil {
+		return err
+	}
+	notice("Connected as %s (%s); waiting for the host to let you in", c.ID(), c.Role())
+	notice("Your key is %s; the host should see the same", fingerprint(pub))
+
+	for {
+		select {
+		case m, ok := <-c.Events():
+			if !ok {
+				return ended(c.Err())
+			}
+			if err := s.handle(m, roomID); err != nil {
+				return err
+			}
+		case line, ok := <-lines:
+			if !ok || line == "/quit" {
+				return nil
+			}
+			if err := s.command(line); err != nil {
+				notice("%v", err)
+			}
+		}
+	}
+}
+
+func (s *guest) handle(m client.Message, roomID string) error {
+	switch m.Type {
+	case "JOIN_RESPONSE":
+		var resp joinResponse
+		if err := json.Unmarshal(m.Payload, &resp); err != nil {
+			return fmt.Errorf("malformed join response: %w", err)
+		}
+		pub := s.priv.PublicKey().Bytes()
+		wrap, err := wrapSealer(s.priv, resp.PublicKey, roomID, resp.PublicKey, pub)
+		if err != nil {
+			return err
+		}
+		roomKey, err := wrap.open(resp.RoomKey)
+		if err != nil {
+			return fmt.Errorf("room key: %w", err)
+		}
+		if s.room, err = newSealer(roomKey, roomID); err != nil {
+			return err
+		}
+		if err := s.c.Confirm(joinConfirm{Proof: confirmProof(roomKey, pub)}); err != nil {
+			return err
+		}
+		notice("You're in. Type to chat; /quit leaves")
+
+	case "MESSAGE":
+		if s.room == nil {
+			return nil
+		}
+		msg, err := s.room.openMessage(m.Payload)
+		if err != nil {
+			notice("Undecryptable message")
+			return nil
+		}
+		say(msg.Name, msg.Text)
+
+	case "KICKED":
+		notice("The host removed you")
+	case "JOIN_TIMEOUT":
+		notice("The host didn't let you in in time")
+	case "ROOM_CLOSING":
+		notice("The host is closing the room in %ds", m.GraceMs/1000)
+	case "ROOM_DESTROYED":
+		notice("The room is gone (%s)", m.Reason)
+	case "ERROR":
+		notice("Relay: %s", m.Reason)
+	case "RATE_LIMITED":
+		notice("Relay is rate limiting us (%s); retry in %dms", m.Reason, m.RetryAfterMs)
+	}
+	return nil
+}
+
+func (s *guest) command(line string) error {
+	switch {
+	case line == "":
+		return nil
+	case s.room == nil:
+		return fmt.Errorf("not in the room yet")
+	case line[0] == '/':
+		return fmt.Errorf("unknown command %s", line)
+	}
+	return s.c.Send(s.room.sealMessage(chatMessage{Name: s.name, Text: line}))
+}
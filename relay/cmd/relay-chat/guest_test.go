@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/ephemeral/relay/client"
+)
+
+// TestHandshakeWrongRoom verifies a guest can't unwrap a room key sealed
+// for another room, as when a relay replays a join response
+func TestHandshakeWrongRoom(t *testing.T) {
+	hostPriv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	hostPub, pub := hostPriv.PublicKey().Bytes(), priv.PublicKey().Bytes()
+	wrap, _ := wrapSealer(hostPriv, pub, "room a", hostPub, pub)
+
+	payload, _ := json.Marshal(joinResponse{PublicKey: hostPub, RoomKey: wrap.seal(newKey(t))})
+	resp := client.Message{Type: "JOIN_RESPONSE", Payload: payload}
+	gs := &guest{name: "bob", priv: priv}
+	if err := gs.handle(resp, "room b"); err == nil || gs.room != nil {
+		t.Error("Expected the guest to refuse a room key sealed for another room")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ephemeral/relay/client"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type hostConfig struct {
+	url         string
+	roomID      string
+	name        string
+	invite      bool
+	autoApprove bool
+	opts        *client.Options
+}
+
+// joiner is someone who has asked in
+type joiner struct {
+	name      string
+	pub       []byte
+	approved  bool // the room key has been sent; a JOIN_CONFIRM is due
+	confirmed bool
+}
+
+type host struct {
+	cfg     hostConfig
+	h       *client.Host
+	roomKey []byte
+	room    *sealer
+	joiners map[string]*joiner // by client ID
+}
+
+func runHost(ctx context.Context, lines <-chan string, cfg hostConfig) error {
+	roomKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(roomKey); err != nil {
+		return err
+	}
+	h, err := client.Create(ctx, cfg.url, cfg.roomID, cfg.opts)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	room, err := newSealer(roomKey, h.RoomID())
+	if err != nil {
+		return err
+	}
+	s := &host{cfg: cfg, h: h, roomKey: roomKey, room: room, joiners: make(map[string]*joiner)}
+
+	if err := h.Open(); err != nil {
+		return err
+	}
+	notice("Hosting room %s", h.RoomID())
+	if cfg.invite {
+		if err := h.CreateInvite(client.InviteRequest{}); err != nil {
+			return err
+		}
+	} else {
+		notice("Join with: relay-chat -url %s -join %s", cfg.url, h.RoomID())
+	}
+	notice("Type to chat; /help lists commands")
+
+	for {
+		select {
+		case m, ok := <-h.Events():
+			if !ok {
+				return ended(h.Err())
+			}
+			s.handle(m)
+		case line, ok := <-lines:
+			if !ok || line == "/quit" {
+				notice("Closing the room")
+				return nil
+			}
+			if err := s.command(line); err != nil {
+				notice("%v", err)
+			}
+		}
+	}
+}
+
+func (s *host) handle(m client.Message) {
+	switch m.Type {
+	case "JOIN_REQUEST":
+		var req joinRequest
+		if json.Unmarshal(m.Payload, &req) != nil || len(req.PublicKey) != 32 {
+			notice("Malformed join request from %s; turning it away", m.ClientID)
+			s.h.Kick(m.ClientID)
+			return
+		}
+		s.joiners[m.ClientID] = &joiner{name: req.Name, pub: req.PublicKey}
+		notice("%s asks to join as %s (%s), key %s", req.Name, m.ClientID, m.Role, fingerprint(req.PublicKey))
+		if s.cfg.autoApprove {
+			if err := s.approve(m.ClientID); err != nil {
+				notice("%v", err)
+			}
+			return
+		}
+		notice("  /approve %s or /deny %s", m.ClientID, m.ClientID)
+
+	case "JOIN_CONFIRM":
+		j := s.joiners[m.ClientID]
+		var c joinConfirm
+		json.Unmarshal(m.Payload, &c)
+		if j == nil || !j.approved || !hmac.Equal(c.Proof, confirmProof(s.roomKey, j.pub)) {
+			notice("%s failed key confirmation; removing", m.ClientID)
+			s.h.Kick(m.ClientID)
+			return
+		}
+		j.confirmed = true
+		notice("%s joined", j.name)
+
+	case "CLIENT_MESSAGE":
+		j := s.joiners[m.ClientID]
+		if j == nil || !j.confirmed {
+			return
+		}
+		msg, err := s.room.openMessage(m.Payload)
+		if err != nil {
+			notice("Undecryptable message from %s", j.name)
+			return
+		}
+		say(j.name, msg.Text)
+
+	case "CLIENT_LEFT":
+		if j := s.joiners[m.ClientID]; j != nil {
+			notice("%s left", j.name)
+			delete(s.joiners, m.ClientID)
+		}
+
+	case "INVITE_CREATED":
+		if inv, err := m.Invite(); err == nil {
+			notice("Join with: relay-chat -url %s -join %s -token %s", s.cfg.url, s.h.RoomID(), inv.Token)
+		}
+
+	case "ROOM_DESTROYED":
+		notice("The room was ended (%s)", m.Reason)
+
+	case "INVITE_ERROR", "ERROR":
+		notice("Relay: %s", m.Reason)
+
+	case "RATE_LIMITED":
+		notice("Relay is rate limiting us (%s); retry in %dms", m.Reason, m.RetryAfterMs)
+
+	case "ROOM_STATS":
+		if st, err := m.Stats(); err == nil {
+			notice("%d clients, %d pending, %d messages, %d dropped, up %ds",
+				st.Clients, st.Pending, st.Messages, st.Dropped, st.UptimeSeconds)
+		}
+	}
+}
+
+func (s *host) command(line string) error {
+	if line == "" {
+		return nil
+	}
+	if !strings.HasPrefix(line, "/") {
+		return s.h.Broadcast(s.room.sealMessage(chatMessage{Name: s.cfg.name, Text: line}))
+	}
+
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "/approve":
+		return s.approve(arg)
+	case "/deny", "/kick":
+		if s.joiners[arg] == nil {
+			return fmt.Errorf("no one is %q", arg)
+		}
+		delete(s.joiners, arg)
+		return s.h.Kick(arg)
+	case "/who":
+		ids := make([]string, 0, len(s.joiners))
+		for id := range s.joiners {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			j := s.joiners[id]
+			state := "asking"
+			switch {
+			case j.confirmed:
+				state = "in"
+			case j.approved:
+				state = "approved"
+			}
+			notice("%s %s %s, key %s", id, j.name, state, fingerprint(j.pub))
+		}
+		notice("You are %s", s.cfg.name)
+		return nil
+	case "/stats":
+		return s.h.RequestStats()
+	case "/help":
+		notice("/approve ID, /deny ID, /kick ID, /who, /stats, /quit")
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+// approve seals the room key to a joiner under a key made for this join
+func (s *host) approve(clientID string) error {
+	j := s.joiners[clientID]
+	if j == nil || j.approved {
+		return fmt.Errorf("no join request from %q", clientID)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pub := priv.PublicKey().Bytes()
+	wrap, err := wrapSealer(priv, j.pub, s.h.RoomID(), pub, j.pub)
+	if err != nil {
+		return err
+	}
+	if err := s.h.Approve(clientID, joinResponse{PublicKey: pub, RoomKey: wrap.seal(s.roomKey)}); err != nil {
+		return err
+	}
+	j.approved = true
+	notice("Approved %s", j.name)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/client"
+	"github.com/ephemeral/relay/relaytest"
+)
+
+// await hands events to handle until one of type typ has been handled
+func await(t *testing.T, events <-chan client.Message, typ string, handle func(client.Message)) client.Message {
+	t.Helper()
+	for {
+		select {
+		case m, ok := <-events:
+			if !ok {
+				t.Fatalf("Connection closed waiting for %s", typ)
+			}
+			handle(m)
+			if m.Type == typ {
+				return m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s", typ)
+		}
+	}
+}
+
+// TestHandshake runs the join handshake through a relay: the host seals
+// the room key to the guest, the guest proves it has it, and each then
+// reads what the other says
+func TestHandshake(t *testing.T) {
+	srv := httptest.NewServer(relaytest.NewRelay(t).Handler)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h, err := client.Create(ctx, srv.URL, "", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer h.Close()
+	roomKey := newKey(t)
+	room, err := newSealer(roomKey, h.RoomID())
+	if err != nil {
+		t.Fatalf("newSealer failed: %v", err)
+	}
+	hs := &host{cfg: hostConfig{name: "ann", autoApprove: true}, h: h, roomKey: roomKey, room: room, joiners: make(map[string]*joiner)}
+	hostHandle := func(m client.Message) { hs.handle(m) }
+	if err := h.Open(); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// The relay answers in order, so the room is open once stats come back
+	if err := h.RequestStats(); err != nil {
+		t.Fatalf("RequestStats failed: %v", err)
+	}
+	await(t, h.Events(), "ROOM_STATS", hostHandle)
+
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	c, err := client.Join(ctx, srv.URL, h.RoomID(), nil)
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	defer c.Close()
+	gs := &guest{c: c, name: "bob", priv: priv}
+	if err := c.Request(joinRequest{Name: "bob", PublicKey: priv.PublicKey().Bytes()}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	guestHandle := func(m client.Message) {
+		if err := gs.handle(m, h.RoomID()); err != nil {
+			t.Fatalf("Guest failed on %s: %v", m.Type, err)
+		}
+	}
+	await(t, h.Events(), "JOIN_REQUEST", hostHandle)
+	await(t, c.Events(), "JOIN_RESPONSE", guestHandle)
+	await(t, h.Events(), "JOIN_CONFIRM", hostHandle)
+	if j := hs.joiners[c.ID()]; j == nil || !j.confirmed {
+		t.Fatalf("Expected the guest confirmed, got %+v", j)
+	}
+
+	if err := gs.command("hi ann"); err != nil {
+		t.Fatalf("Guest send failed: %v", err)
+	}
+	m := await(t, h.Events(), "CLIENT_MESSAGE", hostHandle)
+	if msg, err := hs.room.openMessage(m.Payload); err != nil || msg.Text != "hi ann" {
+		t.Errorf("Expected the host to read the guest's message, got %+v, %v", msg, err)
+	}
+	if err := hs.command("hi bob"); err != nil {
+		t.Fatalf("Host send failed: %v", err)
+	}
+	m = await(t, c.Events(), "MESSAGE", guestHandle)
+	if msg, err := gs.room.openMessage(m.Payload); err != nil || msg != (chatMessage{Name: "ann", Text: "hi bob"}) {
+		t.Errorf("Expected the guest to read the host's message, got %+v, %v", msg, err)
+	}
+}
@@ -0,0 +1,84 @@
+// Relay Conformance Runner
+//
+// Runs the relay protocol behavior matrix (create, open, join, approve, kick,
+// broadcast, limits, heartbeat timeouts) against a deployed relay and prints
+// a pass/fail report. Operators and client developers use it to verify
+// third-party deployments. The checks themselves live in package
+// conformance; -schemas prints the frame schemas a client can test its own
+// frames against.
+//
+// Every check uses fresh random room IDs and only sends dummy payloads;
+// nothing the suite does needs or reveals real room content.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ephemeral/relay/conformance"
+	"github.com/gorilla/websocket"
+)
+
+func main() {
+	url := flag.String("url", "ws://localhost:8443", "Relay base URL (ws:// or wss://)")
+	skipVerify := flag.Bool("insecure-skip-verify", false, "Skip TLS certificate verification")
+	timeout := flag.Duration("timeout", conformance.DefaultTimeout, "Per-step timeout")
+	pace := flag.Duration("pace", 600*time.Millisecond, "Pause between checks to stay under the relay's join rate limit")
+	slow := flag.Bool("slow", false, "Include checks that wait for server-side timeouts")
+	limits := flag.Bool("limits", false, "Include checks that exceed the per-IP connection limits (may get this address banned for a while)")
+	version := flag.Int("version", conformance.Latest, "Protocol version to check against")
+	schemas := flag.Bool("schemas", false, "Print the frame schemas for -version as JSON and exit")
+	jsonOut := flag.Bool("json", false, "Emit the report as JSON")
+	run := flag.String("run", "", "Only run checks whose name contains this string")
+	flag.Parse()
+
+	if *schemas {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(conformance.Schemas(*version))
+		return
+	}
+
+	cfg := conformance.Config{
+		URL:     *url,
+		Timeout: *timeout,
+		Version: *version,
+		Pace:    *pace,
+		Slow:    *slow,
+		Limits:  *limits,
+		Run:     *run,
+		Dialer: &websocket.Dialer{
+			HandshakeTimeout: *timeout,
+			TLSClientConfig:  &tls.Config{InsecureSkipVerify: *skipVerify},
+		},
+	}
+
+	report, err := conformance.Run(cfg, func(res conformance.Result) {
+		if *jsonOut {
+			return
+		}
+		if res.Passed {
+			fmt.Printf("PASS  %-40s %s\n", res.Name, res.Duration)
+		} else {
+			fmt.Printf("FAIL  %-40s %s\n      %s\n", res.Name, res.Duration, res.Error)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		fmt.Printf("\n%d checks, %d passed, %d failed\n", report.Total, report.Total-report.Failed, report.Failed)
+	}
+
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// harden keeps the process's memory out of swap and crash dumps, so room
+// state and ciphertext can't outlive it on disk: every page is locked in
+// RAM, core dumps are disabled, the process is made undumpable, and a
+// crash prints no goroutine stacks.
+func harden() error {
+	if tb := os.Getenv("GOTRACEBACK"); tb != "" && tb != "none" && tb != "0" {
+		// SetTraceback can't go below what the environment asks for
+		return fmt.Errorf("GOTRACEBACK=%s overrides it; unset it", tb)
+	}
+	debug.SetTraceback("none")
+
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return fmt.Errorf("disabling core dumps: %w", err)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return fmt.Errorf("making the process undumpable: %w", errno)
+	}
+	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+		return fmt.Errorf("locking memory (needs CAP_IPC_LOCK or a large enough RLIMIT_MEMLOCK): %w", err)
+	}
+	return nil
+}
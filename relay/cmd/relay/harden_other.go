@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// harden is only implemented on Linux
+func harden() error {
+	return errors.New("not supported on this platform")
+}
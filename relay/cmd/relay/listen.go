@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ephemeral/relay/internal/proxyproto"
+)
+
+// listener is one address the relay serves rooms, invites and health on,
+// from a -listen flag or, without any, -addr
+type listener struct {
+	addr          string
+	plain         bool   // no TLS
+	certFile      string // empty means -cert
+	keyFile       string // empty means -key
+	proxyProtocol bool   // a PROXY protocol header leads every connection
+}
+
+// listeners collects the repeated -listen flag
+type listeners []listener
+
+func (l *listeners) String() string {
+	var addrs []string
+	for _, ln := range *l {
+		addrs = append(addrs, ln.addr)
+	}
+	return strings.Join(addrs, " ")
+}
+
+// Set parses ADDR[,OPTION...], where the options are plain, cert=FILE,
+// key=FILE and proxy-protocol
+func (l *listeners) Set(value string) error {
+	parts := strings.Split(value, ",")
+	ln := listener{addr: strings.TrimSpace(parts[0])}
+	if _, _, err := net.SplitHostPort(ln.addr); err != nil {
+		return fmt.Errorf("address %q: %w", ln.addr, err)
+	}
+	for _, opt := range parts[1:] {
+		name, arg, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch name {
+		case "plain":
+			ln.plain = true
+		case "cert":
+			ln.certFile = arg
+		case "key":
+			ln.keyFile = arg
+		case "proxy-protocol":
+			ln.proxyProtocol = true
+		default:
+			return fmt.Errorf("unknown option %q", name)
+		}
+	}
+	if (ln.certFile == "") != (ln.keyFile == "") {
+		return errors.New("cert= and key= go together")
+	}
+	if ln.plain && ln.certFile != "" {
+		return errors.New("plain takes no cert= or key=")
+	}
+	*l = append(*l, ln)
+	return nil
+}
+
+// tlsConfig loads the listener's certificate, or the default one. With
+// hostCAs, peers may present a client certificate signed by one of them,
+// which the handler then asks of hosts.
+func (ln listener) tlsConfig(certFile, keyFile string, hostCAs *x509.CertPool) (*tls.Config, error) {
+	if ln.certFile != "" {
+		certFile, keyFile = ln.certFile, ln.keyFile
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS cert and key files required (use -insecure or plain for development)")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+		},
+		Certificates: []tls.Certificate{cert},
+	}
+	if hostCAs != nil {
+		cfg.ClientCAs = hostCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// serve listens on the listener's address and serves handler there until
+// the listener fails. A TLS listener has its own server, so each keeps
+// its own certificate.
+func (ln listener) serve(handler http.Handler, tlsConfig *tls.Config) error {
+	nl, err := net.Listen("tcp", ln.addr)
+	if err != nil {
+		return err
+	}
+	if ln.proxyProtocol {
+		nl = proxyproto.NewListener(nl)
+	}
+
+	server := &http.Server{Addr: ln.addr, Handler: handler, TLSConfig: tlsConfig}
+	if tlsConfig == nil {
+		err = server.Serve(nl)
+	} else {
+		err = server.ServeTLS(nl, "", "")
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// loopback reports whether the listener only takes local connections, as
+// from a sidecar proxy
+func (ln listener) loopback() bool {
+	host, _, _ := net.SplitHostPort(ln.addr)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
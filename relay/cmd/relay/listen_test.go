@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+// TestListenersSet verifies -listen values parse into listeners, and that
+// options which contradict each other or aren't known are refused
+func TestListenersSet(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  listener
+		ok    bool
+	}{
+		{":8443", listener{addr: ":8443"}, true},
+		{"127.0.0.1:8080,plain", listener{addr: "127.0.0.1:8080", plain: true}, true},
+		{" :443 , cert=a.pem , key=a.key", listener{addr: ":443", certFile: "a.pem", keyFile: "a.key"}, true},
+		{"[::1]:8080,plain,proxy-protocol", listener{addr: "[::1]:8080", plain: true, proxyProtocol: true}, true},
+		{":443,cert=a.pem", listener{}, false},
+		{":443,key=a.key", listener{}, false},
+		{":8080,plain,cert=a.pem,key=a.key", listener{}, false},
+		{":8080,gzip", listener{}, false},
+		{"8080", listener{}, false},
+		{"", listener{}, false},
+	} {
+		var l listeners
+		err := l.Set(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) = %v, want ok=%v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && (len(l) != 1 || l[0] != tt.want) {
+			t.Errorf("Set(%q) gave %+v, want %+v", tt.value, l, tt.want)
+		}
+	}
+
+	var l listeners
+	l.Set(":80")
+	l.Set(":81,plain")
+	if len(l) != 2 || l.String() != ":80 :81" {
+		t.Errorf("Expected repeated flags collected, got %q", l.String())
+	}
+}
+
+// TestListenerLoopback verifies only listeners bound to a loopback
+// address count as local
+func TestListenerLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"127.1.2.3:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"relay.lan:8080": false,
+	} {
+		if got := (listener{addr: addr}).loopback(); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
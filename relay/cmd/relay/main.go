@@ -11,90 +11,578 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ephemeral/relay/internal/admin"
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/cluster"
+	"github.com/ephemeral/relay/internal/hostauth"
 	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/matrix"
 	"github.com/ephemeral/relay/internal/metrics"
 	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/report"
 	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/secheaders"
+	"github.com/ephemeral/relay/internal/tenant"
+	"github.com/ephemeral/relay/internal/tracing"
+	"github.com/ephemeral/relay/internal/turn"
 	"github.com/ephemeral/relay/internal/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/quic-go/webtransport-go"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
 	// Configuration flags
-	addr := flag.String("addr", ":8443", "Server address")
+	addr := flag.String("addr", ":8443", "Server address, when no -listen is given")
+	var listens listeners
+	flag.Var(&listens, "listen", "Address to serve on, with options: ADDR[,plain][,cert=FILE,key=FILE][,proxy-protocol]; repeat for several, e.g. -listen :443 -listen 127.0.0.1:8080,plain for a sidecar (TLS with -cert/-key unless cert=/key= or plain; replaces -addr)")
+	var spaces namespaces
+	flag.Var(&spaces, "namespace", "Room namespace to serve at /rooms/NAME/{roomId}, with a pool of rooms of its own: NAME=MAXROOMS; repeat for several, e.g. -namespace chat=5000 -namespace game=2000")
 	metricsAddr := flag.String("metrics-addr", ":9090", "Metrics server address (internal)")
 	certFile := flag.String("cert", "", "TLS certificate file")
 	keyFile := flag.String("key", "", "TLS key file")
 	insecure := flag.Bool("insecure", false, "Run without TLS (development only)")
+	grpcAddr := flag.String("grpc-addr", "", "TCP address to serve the gRPC API on for native clients, e.g. :8444; TLS with -cert/-key unless -insecure (empty disables)")
+	tcpAddr := flag.String("tcp-addr", "", "TCP address for raw length-prefixed framing, for clients without an HTTP stack, e.g. :8445; TLS with -cert/-key unless -insecure (empty disables)")
+	mqttAddr := flag.String("mqtt-addr", "", "TCP address taking MQTT 3.1.1 connections, one room each, for devices with an MQTT stack, e.g. :8883; TLS with -cert/-key unless -insecure (empty disables)")
+	webTransportAddr := flag.String("webtransport-addr", "", "UDP address to take WebTransport sessions on over HTTP/3, e.g. :8443; needs -cert and -key (empty disables)")
+	onionSocket := flag.String("onion-socket", "", "Unix socket to serve plain HTTP on for a Tor onion service (HiddenServicePort 80 unix:PATH); peers there prove work in place of per-IP limits (empty disables)")
+	powBits := flag.Int("pow-bits", ratelimit.DefaultPoWBits, "Leading zero bits of proof of work asked of each -onion-socket connection and invite request")
+	adminToken := flag.String("admin-token", os.Getenv("RELAY_ADMIN_TOKEN"), "Bearer token for the admin API on the metrics server (default $RELAY_ADMIN_TOKEN; empty disables)")
+	metricsToken := flag.String("metrics-token", os.Getenv("RELAY_METRICS_TOKEN"), "Bearer token required to scrape /metrics and /metrics.json (default $RELAY_METRICS_TOKEN; empty leaves it open)")
+	hostClientCA := flag.String("host-client-ca", "", "CA bundle for hosts: creating a room then needs a TLS client certificate signed by this CA, while joins stay open (hosts on plain listeners, WebTransport or the Matrix bridge are refused)")
+	hostKeysFile := flag.String("host-keys", "", "File of API keys allowed to create rooms, one \"NAME KEY [rooms=N] [clients=N] [bytes-per-hour=N] [tokens=N] [profile=NAME]\" per line, # for comments; hosts present one as a bearer token or auth= query parameter, while joins stay anonymous. Each key is a tenant held to its own quotas of rooms, clients, bytes relayed and invite tokens, and rate limit profile (empty disables)")
+	hostKeysManaged := flag.Bool("host-keys-managed", false, "Require hosts to present an API key, minted and revoked through the admin API, in addition to any from -host-keys")
+	hostJWTKeys := flag.String("host-jwt-keys", "", "JWKS or PEM file, or https:// URL of an identity provider's JWKS, whose keys sign JWTs allowed to create rooms; hosts present one as they would an API key (empty disables)")
+	hostJWTIssuer := flag.String("host-jwt-issuer", "", "iss host JWTs must carry (empty accepts any)")
+	hostJWTAudience := flag.String("host-jwt-audience", "", "aud host JWTs must include (empty accepts any)")
+	hostJWTRefresh := flag.Duration("host-jwt-refresh", time.Hour, "How often to fetch -host-jwt-keys again when it's a URL")
+	metricsClientCA := flag.String("metrics-client-ca", "", "CA bundle for mTLS on the metrics server: it then serves TLS with -cert/-key and requires client certificates signed by this CA")
+	pprofToken := flag.String("pprof-token", os.Getenv("RELAY_PPROF_TOKEN"), "Bearer token for /debug/pprof/ on the metrics server (default $RELAY_PPROF_TOKEN; empty disables)")
+	inviteKey := flag.String("invite-key", os.Getenv("RELAY_INVITE_KEY"), "Base64 key (>= 32 bytes) enabling stateless HMAC invite tokens (default $RELAY_INVITE_KEY; empty uses the in-memory store)")
+	inviteRedis := flag.String("invite-redis", os.Getenv("RELAY_INVITE_REDIS"), "Redis URL for invite tokens shared across nodes (default $RELAY_INVITE_REDIS; empty uses the in-memory store)")
+	turnSecret := flag.String("turn-secret", os.Getenv("RELAY_TURN_SECRET"), "static-auth-secret shared with a TURN server such as coturn, enabling POST /turn/{roomId} for hosts (default $RELAY_TURN_SECRET; empty disables)")
+	turnURIs := flag.String("turn-uris", os.Getenv("RELAY_TURN_URIS"), "Comma-separated TURN URIs handed out with credentials, e.g. turn:turn.example.org:3478?transport=udp (default $RELAY_TURN_URIS)")
+	turnTTL := flag.Duration("turn-ttl", turn.DefaultTTL, "How long minted TURN credentials stay valid (at most 24h)")
+	matrixHomeserver := flag.String("matrix-homeserver", os.Getenv("RELAY_MATRIX_HOMESERVER"), "Client-server API URL of a Matrix homeserver this relay is registered with as an application service; enables the bridge at /_matrix/app/ (default $RELAY_MATRIX_HOMESERVER; empty disables)")
+	matrixBot := flag.String("matrix-bot", os.Getenv("RELAY_MATRIX_BOT"), "Full user ID of the bridge's bot, e.g. @relay:example.org (default $RELAY_MATRIX_BOT)")
+	matrixASToken := flag.String("matrix-as-token", os.Getenv("RELAY_MATRIX_AS_TOKEN"), "as_token from the application service registration (default $RELAY_MATRIX_AS_TOKEN)")
+	matrixHSToken := flag.String("matrix-hs-token", os.Getenv("RELAY_MATRIX_HS_TOKEN"), "hs_token from the application service registration (default $RELAY_MATRIX_HS_TOKEN)")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("RELAY_TRUSTED_PROXIES"), "Comma-separated proxy IPs/CIDRs whose X-Forwarded-For is believed (default $RELAY_TRUSTED_PROXIES; empty trusts none)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Require a PROXY protocol v1/v2 header on every connection to -addr (for L4 load balancers; with -listen, use its proxy-protocol option)")
+	maxConns := flag.Int("max-conns", 10000, "Open WebSocket ceiling; upgrades beyond it get 503 (0 disables)")
+	rateProfile := flag.String("rate-profile", ratelimit.DefaultProfile, "Rate limit profile ("+ratelimit.ProfileNames()+")")
+	rateRedis := flag.String("ratelimit-redis", os.Getenv("RELAY_RATELIMIT_REDIS"), "Redis URL for per-IP request budgets shared across nodes (default $RELAY_RATELIMIT_REDIS; empty keeps them per node)")
+	rateAlgorithm := flag.String("rate-algorithm", "", "Override the profile's limiter algorithm (token-bucket, sliding-window)")
+	otlpEndpoint := flag.String("otlp-endpoint", os.Getenv("RELAY_OTLP_ENDPOINT"), "OTLP/HTTP collector URL for traces, e.g. http://collector:4318 (default $RELAY_OTLP_ENDPOINT; empty disables tracing)")
+	otlpMetrics := flag.String("otlp-metrics-endpoint", os.Getenv("RELAY_OTLP_METRICS_ENDPOINT"), "OTLP/HTTP collector URL to push metrics to, for hosts no scraper can reach (default $RELAY_OTLP_METRICS_ENDPOINT; empty disables)")
+	otlpMetricsInterval := flag.Duration("otlp-metrics-interval", metrics.DefaultPushInterval, "How often metrics are pushed to -otlp-metrics-endpoint")
+	statsdAddr := flag.String("statsd", os.Getenv("RELAY_STATSD"), "host:port of a statsd agent to emit metrics to (default $RELAY_STATSD; empty disables)")
+	dogstatsd := flag.Bool("dogstatsd", false, "Send labels to -statsd as DogStatsD tags instead of name suffixes")
+	statsdInterval := flag.Duration("statsd-interval", metrics.DefaultStatsDInterval, "How often counters and gauges are flushed to -statsd")
+	clusterRedis := flag.String("cluster-redis", os.Getenv("RELAY_CLUSTER_REDIS"), "Redis URL of a pub/sub backplane letting hosts and clients of one room use different nodes (default $RELAY_CLUSTER_REDIS; empty runs standalone)")
+	clusterNATS := flag.String("cluster-nats", os.Getenv("RELAY_CLUSTER_NATS"), "NATS URL of a backplane letting hosts and clients of one room use different nodes, in place of -cluster-redis (default $RELAY_CLUSTER_NATS)")
+	gossipBind := flag.String("gossip-bind", os.Getenv("RELAY_GOSSIP_BIND"), "host:port to gossip with peer nodes on, e.g. 0.0.0.0:7946 (default $RELAY_GOSSIP_BIND; empty disables discovery)")
+	gossipAdvertise := flag.String("gossip-advertise", "", "host:port peers should reach this node's gossip on, if not -gossip-bind")
+	gossipJoin := flag.String("gossip-join", os.Getenv("RELAY_GOSSIP_JOIN"), "Comma-separated existing peers to join; a DNS name joins every address it resolves to (default $RELAY_GOSSIP_JOIN)")
+	gossipKey := flag.String("gossip-key", os.Getenv("RELAY_GOSSIP_KEY"), "Base64 16, 24 or 32 byte key encrypting gossip (default $RELAY_GOSSIP_KEY; empty sends it in the clear)")
+	securityHeaders := flag.Bool("security-headers", true, "Set HSTS, X-Content-Type-Options, Referrer-Policy and Content-Security-Policy on HTTP responses")
+	hstsMaxAge := flag.Duration("hsts-max-age", secheaders.DefaultHSTSMaxAge, "Strict-Transport-Security max-age, sent over TLS only (0 omits it)")
+	hstsSubdomains := flag.Bool("hsts-subdomains", false, "Extend Strict-Transport-Security to subdomains")
+	csp := flag.String("csp", secheaders.DefaultCSP, "Content-Security-Policy for HTTP responses (empty omits it)")
+	referrerPolicy := flag.String("referrer-policy", secheaders.DefaultReferrerPolicy, "Referrer-Policy for HTTP responses (empty omits it)")
+	traceSample := flag.Float64("trace-sample", 0.1, "Fraction of traces kept when -otlp-endpoint is set")
+	uniformErrors := flag.Bool("uniform-join-errors", false, "Tell joiners without a valid invite only \"Room unavailable\", after the same delay, whether the room is missing, full or not open, so room IDs can't be probed")
+	joinTimeout := flag.Duration("join-timeout", websocket.DefaultJoinTimeout, "How long a joiner may wait for the host's approval before it's sent JOIN_TIMEOUT and disconnected (0 waits forever)")
+	reportThreshold := flag.Int("report-threshold", 0, "Destroy a room once this many distinct members have reported it via POST /report/{roomId}; only the count is kept (0 just counts reports)")
+	hardenMemory := flag.Bool("harden", false, "Lock all memory against swapping, disable core dumps and crash tracebacks, so room state can't reach disk (Linux; needs CAP_IPC_LOCK or a large RLIMIT_MEMLOCK)")
 	flag.Parse()
 
 	// Setup logging - UTC, no file paths
 	log.SetFlags(log.Ldate | log.Ltime | log.LUTC)
 	log.SetOutput(os.Stdout)
 
+	// Before any room exists, so none of its memory can be swapped out
+	if *hardenMemory {
+		if err := harden(); err != nil {
+			log.Fatalf("Invalid -harden: %v", err)
+		}
+		log.Println("Memory: locked, core dumps and tracebacks disabled")
+	}
+
+	profile, err := ratelimit.LookupProfile(*rateProfile)
+	if err != nil {
+		log.Fatalf("Invalid -rate-profile %q: %v", *rateProfile, err)
+	}
+	if *rateAlgorithm != "" {
+		if profile.Algorithm, err = ratelimit.ParseAlgorithm(*rateAlgorithm); err != nil {
+			log.Fatalf("Invalid -rate-algorithm %q: %v", *rateAlgorithm, err)
+		}
+	}
+
+	trusted, err := clientip.ParseTrusted(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	ips := clientip.NewResolver(trusted)
+
+	stopTracing := func(context.Context) error { return nil }
+	if *otlpEndpoint != "" {
+		if stopTracing, err = tracing.Setup(context.Background(), *otlpEndpoint, *traceSample); err != nil {
+			log.Fatalf("Invalid -otlp-endpoint: %v", err)
+		}
+		log.Printf("Tracing: OTLP, sampling %.0f%% of traces", *traceSample*100)
+	}
+
+	// Allow/deny lists, edited at runtime via /admin/access
+	access := ratelimit.NewAccessList()
+
 	// Initialize components
 	registry := room.NewRegistry()
-	connLimiter := ratelimit.NewLimiter(10, 20)       // 10 req/s, burst 20
-	msgLimiter := ratelimit.NewMessageLimiter(10, 20) // 10 msg/s per client
-	tokenStore := invite.NewTokenStore()
+	for ns, maxRooms := range spaces {
+		if err := registry.SetNamespace(ns, maxRooms); err != nil {
+			log.Fatalf("Invalid -namespace %s: %v", ns, err)
+		}
+		log.Printf("Namespace: %s, up to %d rooms", ns, maxRooms)
+	}
+
+	stopPush := func(context.Context) error { return nil }
+	if *otlpMetrics != "" {
+		if stopPush, err = metrics.Global.PushOTLP(context.Background(), *otlpMetrics, *otlpMetricsInterval, registry); err != nil {
+			log.Fatalf("Invalid -otlp-metrics-endpoint: %v", err)
+		}
+		log.Printf("Metrics: pushing over OTLP every %v", *otlpMetricsInterval)
+	}
+	stopStatsD := func() {}
+	if *statsdAddr != "" {
+		sd, err := metrics.Global.StartStatsD(*statsdAddr, *dogstatsd, *statsdInterval, registry)
+		if err != nil {
+			log.Fatalf("Invalid -statsd: %v", err)
+		}
+		stopStatsD = sd.Stop
+		log.Printf("Metrics: flushing to statsd every %v", *statsdInterval)
+	}
+
+	var shared ratelimit.Backend
+	if *rateRedis != "" {
+		backend := ratelimit.NewRedisBackend(dialRedis("-ratelimit-redis", *rateRedis), ratelimit.DefaultRedisPrefix)
+		defer backend.Stop()
+		shared = backend
+		log.Println("Rate limits: per-IP budgets shared via Redis")
+	}
+	limits := profile.NewSharedLimiters(shared)
+
+	var tokenStore invite.TokenBackend
+	switch {
+	case *inviteKey != "" && *inviteRedis != "":
+		log.Fatal("-invite-key and -invite-redis are mutually exclusive")
+
+	case *inviteRedis != "":
+		tokenStore = invite.NewRedisTokens(dialRedis("-invite-redis", *inviteRedis), invite.DefaultRedisPrefix)
+		log.Println("Invite tokens: Redis (shared)")
+
+	case *inviteKey != "":
+		key, err := base64.StdEncoding.DecodeString(*inviteKey)
+		if err != nil {
+			log.Fatalf("Invalid -invite-key: %v", err)
+		}
+		stateless, err := invite.NewStatelessTokens(key)
+		if err != nil {
+			log.Fatalf("Invalid -invite-key: %v", err)
+		}
+		tokenStore = stateless
+		log.Println("Invite tokens: stateless (HMAC-signed)")
+
+	default:
+		tokenStore = invite.NewTokenStore()
+	}
+
+	var backplane cluster.Backplane
+	switch {
+	case *clusterRedis != "" && *clusterNATS != "":
+		log.Fatal("-cluster-redis and -cluster-nats are mutually exclusive")
+
+	case *clusterRedis != "":
+		backplane = cluster.NewRedisBackplane(dialRedis("-cluster-redis", *clusterRedis), cluster.DefaultRedisPrefix)
+		log.Println("Cluster: rooms shared via Redis pub/sub")
+
+	case *clusterNATS != "":
+		conn, err := nats.Connect(*clusterNATS, nats.Name("ephemeral-relay"), nats.MaxReconnects(-1))
+		if err != nil {
+			log.Fatalf("NATS for -cluster-nats unreachable: %v", err)
+		}
+		backplane = cluster.NewNATSBackplane(conn, cluster.DefaultNATSPrefix)
+		log.Println("Cluster: rooms shared via NATS")
+	}
+	var node *cluster.Node
+	if backplane != nil {
+		if node, err = cluster.NewNode(backplane, registry); err != nil {
+			log.Fatalf("Cluster backplane unusable: %v", err)
+		}
+	}
+
+	ceiling := ratelimit.NewConnCeiling(*maxConns)
+
+	stopGossip := func() error { return nil }
+	var fleet *cluster.Gossip
+	if *gossipBind != "" {
+		key, err := base64.StdEncoding.DecodeString(*gossipKey)
+		if err != nil {
+			log.Fatalf("Invalid -gossip-key: %v", err)
+		}
+		if n := len(key); n != 0 && n != 16 && n != 24 && n != 32 {
+			log.Fatalf("Invalid -gossip-key: %d bytes, want 16, 24 or 32", n)
+		}
+		var seeds []string
+		if *gossipJoin != "" {
+			seeds = strings.Split(*gossipJoin, ",")
+		}
+		gossip, err := cluster.StartGossip(cluster.GossipConfig{
+			Name:      node.ID(),
+			Bind:      *gossipBind,
+			Advertise: *gossipAdvertise,
+			Seeds:     seeds,
+			Key:       key,
+			Load: func() cluster.Load {
+				return cluster.Load{
+					Rooms:          registry.RoomCount() - node.ProxyCount(),
+					Connections:    ceiling.Open(),
+					MaxConnections: *maxConns,
+					Draining:       node.Draining(),
+				}
+			},
+			OnLeave: node.PeerLeft,
+		})
+		if err != nil {
+			log.Fatalf("Invalid -gossip-bind: %v", err)
+		}
+		stopGossip = gossip.Close
+		fleet = gossip
+		log.Printf("Gossip: discovering peers on %s (encrypted=%v)", gossip.Addr(), len(key) > 0)
+	}
 
-	inviteHandler := invite.NewHandler(tokenStore, registry, connLimiter)
-	handler := websocket.NewHandler(registry, connLimiter, msgLimiter, inviteHandler)
+	inviteHandler := invite.NewHandler(tokenStore, registry, limits, ips, access)
+	if *inviteRedis == "" {
+		// Tokens are consumed on the host's node; joiners elsewhere ask it
+		node.ServeInvites(inviteHandler)
+	}
+	// Only the node a room's host is on can check its host secret
+	node.ServeHostCalls(inviteHandler)
+	handler := websocket.NewHandler(registry, limits, inviteHandler, ips, ceiling, access, node)
+
+	// Room lifecycle hooks: per-room state elsewhere is released on destroy.
+	// Proxies for rooms hosted on other nodes don't run them.
+	registry.OnRoomCreated(func(*room.Room) {
+		metrics.Global.IncRoomsCreated()
+	})
+	registry.OnRoomDestroyed(func(roomID, reason string) {
+		metrics.Global.IncRoomsDestroyed()
+		limits.RemoveRoom(roomID)
+		inviteHandler.RevokeRoomTokens(roomID)
+	})
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
 	mux.Handle("/rooms/", handler)
 	mux.Handle("/invite/", inviteHandler)
 
+	// Matrix users join rooms through an application service bridge
+	if *matrixHomeserver != "" {
+		if *matrixBot == "" {
+			log.Fatal("-matrix-homeserver needs -matrix-bot")
+		}
+		client, err := matrix.NewClient(*matrixHomeserver, *matrixASToken, *matrixBot)
+		if err != nil {
+			log.Fatalf("Invalid Matrix bridge settings: %v", err)
+		}
+		txns, err := matrix.NewTransactions(*matrixHSToken, handler.NewMatrixBridge(client).HandleEvent)
+		if err != nil {
+			log.Fatalf("Invalid Matrix bridge settings: %v", err)
+		}
+		mux.Handle("/_matrix/app/", txns)
+		log.Printf("Matrix bridge: %s on %s", *matrixBot, *matrixHomeserver)
+	}
+
+	// Members flag abusive rooms; past the threshold they're destroyed
+	if *reportThreshold < 0 {
+		log.Fatalf("Invalid -report-threshold: %d", *reportThreshold)
+	}
+	reportHandler := report.NewHandler(registry, *reportThreshold, limits, ips, access)
+	mux.Handle("/report/", reportHandler)
+	if *reportThreshold > 0 {
+		log.Printf("Reports: rooms destroyed after %d distinct members report them", *reportThreshold)
+	}
+
+	// TURN credentials for hosts, when the relay shares coturn's secret
+	var turnHandler *turn.Handler
+	if *turnSecret != "" {
+		var uris []string
+		for _, u := range strings.Split(*turnURIs, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				uris = append(uris, u)
+			}
+		}
+		issuer, err := turn.NewIssuer([]byte(*turnSecret), *turnTTL, uris)
+		if err != nil {
+			log.Fatalf("Invalid -turn-secret or -turn-uris: %v", err)
+		}
+		turnHandler = turn.NewHandler(issuer, registry, limits, ips, access)
+		mux.Handle("/turn/", turnHandler)
+		log.Printf("TURN credentials: %d server(s), valid %v", len(uris), *turnTTL)
+	}
+
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		// Out of the load balancer's rotation once the node is draining
+		if node.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("DRAINING"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	server := &http.Server{
-		Addr:    *addr,
-		Handler: mux,
+	// Browsers reach the invite API directly, so every response carries
+	// the security headers
+	secure := func(h http.Handler) http.Handler { return h }
+	if *securityHeaders {
+		secure = secheaders.Policy{
+			HSTSMaxAge:            *hstsMaxAge,
+			HSTSIncludeSubdomains: *hstsSubdomains,
+			ContentSecurityPolicy: *csp,
+			ReferrerPolicy:        *referrerPolicy,
+			NoSniff:               true,
+		}.Wrap
 	}
+	public := secure(mux)
 
-	// TLS configuration (if not insecure)
-	if !*insecure {
-		if *certFile == "" || *keyFile == "" {
-			log.Fatal("TLS cert and key files required (use -insecure for development)")
+	// The listeners rooms and invites are served on: each -listen, or -addr.
+	// -insecure leaves those without a certificate of their own plain.
+	if len(listens) == 0 {
+		listens = listeners{{addr: *addr, proxyProtocol: *proxyProtocol}}
+	} else if *proxyProtocol {
+		log.Fatal("-proxy-protocol applies to -addr; give -listen the proxy-protocol option instead")
+	}
+	var hostCAs *x509.CertPool
+	if *hostClientCA != "" {
+		hostCAs = loadCertPool("-host-client-ca", *hostClientCA)
+		handler.RequireHostCertificates()
+		log.Println("Hosts: client certificate required")
+	}
+	var hostKeys *hostauth.Keys
+	var hostAuth []hostauth.Authorizer
+	var tenants *tenant.Tenants
+	if *hostKeysFile != "" || *hostKeysManaged {
+		hostKeys = hostauth.NewKeys()
+		if *hostKeysFile != "" {
+			loadHostKeys(hostKeys, *hostKeysFile)
+		}
+		hostAuth = append(hostAuth, hostKeys)
+		log.Printf("Hosts: API keys accepted (%d static, managed=%v)", len(hostKeys.List()), *hostKeysManaged)
+
+		// Each key is a tenant, held to its own quotas
+		tenants = tenant.New(hostKeys, limits, shared)
+		handler.SetTenants(tenants)
+		inviteHandler.SetTenants(tenants)
+		registry.OnRoomDestroyed(func(roomID, _ string) {
+			tenants.RemoveRoom(roomID)
+		})
+	}
+	if *hostJWTKeys != "" {
+		hostAuth = append(hostAuth, loadHostJWT(*hostJWTKeys, *hostJWTIssuer, *hostJWTAudience, *hostJWTRefresh))
+		log.Printf("Hosts: JWTs accepted (issuer=%q, audience=%q)", *hostJWTIssuer, *hostJWTAudience)
+	}
+	if len(hostAuth) > 0 {
+		handler.SetHostAuthorizer(hostauth.Any(hostAuth...))
+	}
+	handler.SetJoinTimeout(*joinTimeout)
+	if *uniformErrors {
+		handler.UniformJoinErrors()
+		log.Println("Joins: refusals look alike to joiners without an invite")
+	}
+	listenerConfigs := make([]*tls.Config, len(listens))
+	for i := range listens {
+		ln := &listens[i]
+		if *insecure && ln.certFile == "" {
+			ln.plain = true
+		}
+		if ln.plain {
+			continue
+		}
+		if listenerConfigs[i], err = ln.tlsConfig(*certFile, *keyFile, hostCAs); err != nil {
+			log.Fatalf("Listener %s: %v", ln.addr, err)
+		}
+	}
+
+	// WebTransport over HTTP/3, on UDP beside the TCP listener
+	var wt *webtransport.Server
+	if *webTransportAddr != "" {
+		if *insecure {
+			log.Fatal("-webtransport-addr needs TLS and can't be used with -insecure")
+		}
+		wt = handler.EnableWebTransport(*webTransportAddr, public)
+		go func() {
+			log.Printf("WebTransport starting on %s (udp)", *webTransportAddr)
+			if err := wt.ListenAndServeTLS(*certFile, *keyFile); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("WebTransport server error: %v", err)
+			}
+		}()
+	}
+
+	// TLS for the listeners beside -addr, which don't load the keys themselves
+	var listenerTLS *tls.Config
+	if !*insecure && (*grpcAddr != "" || *tcpAddr != "" || *mqttAddr != "") {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("TLS cert and key unusable: %v", err)
 		}
+		listenerTLS = &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{cert},
+		}
+		if hostCAs != nil {
+			listenerTLS.ClientCAs = hostCAs
+			listenerTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	// The gRPC API, on a listener of its own
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		var opts []grpc.ServerOption
+		if listenerTLS != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(listenerTLS)))
+		}
+		grpcServer = handler.NewGRPCServer(opts...)
+		grpcLn, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("Invalid -grpc-addr: %v", err)
+		}
+		go func() {
+			log.Printf("gRPC API starting on %s", *grpcAddr)
+			if err := grpcServer.Serve(grpcLn); err != nil {
+				log.Printf("gRPC server error: %v", err)
+			}
+		}()
+	}
+
+	// Raw framed connections for embedded clients
+	if *tcpAddr != "" {
+		tcpLn, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatalf("Invalid -tcp-addr: %v", err)
+		}
+		if listenerTLS != nil {
+			tcpLn = tls.NewListener(tcpLn, listenerTLS)
+		}
+		go func() {
+			log.Printf("Raw TCP framing starting on %s", *tcpAddr)
+			if err := handler.ServeTCP(tcpLn); err != nil {
+				log.Printf("Raw TCP listener error: %v", err)
+			}
+		}()
+	}
+
+	// The MQTT bridge: rooms as topic pairs for constrained devices
+	if *mqttAddr != "" {
+		mqttLn, err := net.Listen("tcp", *mqttAddr)
+		if err != nil {
+			log.Fatalf("Invalid -mqtt-addr: %v", err)
+		}
+		if listenerTLS != nil {
+			mqttLn = tls.NewListener(mqttLn, listenerTLS)
+		}
+		go func() {
+			log.Printf("MQTT bridge starting on %s", *mqttAddr)
+			if err := handler.ServeMQTT(mqttLn); err != nil {
+				log.Printf("MQTT listener error: %v", err)
+			}
+		}()
+	}
 
-		server.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS13,
-			CipherSuites: []uint16{
-				tls.TLS_AES_256_GCM_SHA384,
-				tls.TLS_CHACHA20_POLY1305_SHA256,
+	// A Tor onion service. Every peer on it arrives from the local daemon,
+	// so each upgrade and invite request pays in proof of work, with
+	// challenges from /pow, in place of the per-IP limits
+	var onionServer *http.Server
+	if *onionSocket != "" {
+		pow := ratelimit.NewPoW(*powBits)
+		handler.SetProofOfWork(pow)
+		inviteHandler.SetProofOfWork(pow)
+		reportHandler.SetProofOfWork(pow)
+		if turnHandler != nil {
+			turnHandler.SetProofOfWork(pow)
+		}
+		onionMux := http.NewServeMux()
+		onionMux.Handle("/", mux)
+		onionMux.Handle("/pow", pow)
+		onionServer = &http.Server{
+			Handler: secure(onionMux),
+			ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+				return clientip.Anonymous(ctx)
 			},
 		}
+		onionLn, err := listenUnix(*onionSocket)
+		if err != nil {
+			log.Fatalf("Invalid -onion-socket: %v", err)
+		}
+		go func() {
+			log.Printf("Onion service socket on %s (proof of work: %d bits)", *onionSocket, pow.Bits())
+			if err := onionServer.Serve(onionLn); err != nil && err != http.ErrServerClosed {
+				log.Printf("Onion service error: %v", err)
+			}
+		}()
 	}
 
 	// Start metrics server (internal only)
-	go func() {
-		metricsMux := http.NewServeMux()
-		metricsMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "text/plain")
-			w.Write([]byte(metrics.Global.String(registry.RoomCount())))
-		})
-
-		metricsServer := &http.Server{
-			Addr:    *metricsAddr,
-			Handler: metricsMux,
+	var metricsCAs *x509.CertPool
+	if *metricsClientCA != "" {
+		if *certFile == "" || *keyFile == "" {
+			log.Fatalf("-metrics-client-ca needs -cert and -key")
 		}
+		metricsCAs = loadCertPool("-metrics-client-ca", *metricsClientCA)
+	}
+	adminHandler := admin.NewHandler(*adminToken, registry, access)
+	if node != nil {
+		adminHandler.SetCluster(node)
+	}
+	if fleet != nil {
+		adminHandler.SetFleet(fleet)
+	}
+	if hostKeys != nil {
+		adminHandler.SetHostKeys(hostKeys)
+	}
+	metricsServer := newMetricsServer(*metricsAddr, *metricsToken, metricsCAs, registry, adminHandler, admin.NewProfiler(*pprofToken))
 
-		log.Printf("Metrics server starting on %s", *metricsAddr)
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	go func() {
+		log.Printf("Metrics server starting on %s (mTLS=%v, token=%v)", *metricsAddr, metricsCAs != nil, *metricsToken != "")
+		var err error
+		if metricsServer.TLSConfig != nil {
+			err = metricsServer.ListenAndServeTLS(*certFile, *keyFile)
+		} else {
+			err = metricsServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Printf("Metrics server error: %v", err)
 		}
 	}()
@@ -108,25 +596,231 @@ func main() {
 		log.Println("Shutting down...")
 		// Stop background cleanup goroutines
 		tokenStore.Stop()
+		limits.Stop()
+		tenants.Stop()
+		// Hang up on every host and client, destroying their rooms, then
+		// flush buffered spans and a final metrics push
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := handler.Shutdown(ctx); err != nil {
+			log.Printf("Connections still open at shutdown: %v", err)
+		}
+		stopTracing(ctx)
+		stopPush(ctx)
+		cancel()
+		stopStatsD()
+		if wt != nil {
+			wt.Close()
+		}
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		if onionServer != nil {
+			onionServer.Close() // unlinks the socket
+		}
+		// Tell other nodes our rooms are gone rather than let them time out
+		stopGossip()
+		node.Close()
 		// All rooms will be destroyed when server stops
 		os.Exit(0)
 	}()
 
-	// Start server
-	log.Printf("Ephemeral Relay Server starting on %s", *addr)
-	log.Printf("Security: TLS=%v, Insecure=%v", !*insecure, *insecure)
+	// Start servers; the first to fail takes the process down
+	log.Printf("Rate limit profile: %s (%s)", profile.Name, profile.Algorithm)
+	errCh := make(chan error, len(listens))
+	for i, ln := range listens {
+		log.Printf("Ephemeral Relay Server starting on %s (TLS=%v, PROXY protocol=%v)", ln.addr, !ln.plain, ln.proxyProtocol)
+		if ln.plain && !ln.loopback() {
+			log.Printf("WARNING: %s is not loopback and runs in insecure mode (no TLS)", ln.addr)
+		}
+		go func() {
+			if err := ln.serve(public, listenerConfigs[i]); err != nil {
+				errCh <- fmt.Errorf("%s: %w", ln.addr, err)
+			}
+		}()
+	}
+	log.Fatalf("Server error: %v", <-errCh)
+}
+
+// listenUnix listens on a unix socket at path, replacing one an unclean
+// exit left behind, and lets the socket's group connect, as a tor daemon
+// running under its own user needs to
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// namespaces collects the repeated -namespace flag: the most rooms each
+// namespace may hold
+type namespaces map[string]int
 
-	var err error
-	if *insecure {
-		log.Println("WARNING: Running in insecure mode (no TLS)")
-		err = server.ListenAndServe()
-	} else {
-		err = server.ListenAndServeTLS(*certFile, *keyFile)
+func (n *namespaces) String() string {
+	var specs []string
+	for ns, maxRooms := range *n {
+		specs = append(specs, fmt.Sprintf("%s=%d", ns, maxRooms))
 	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses NAME=MAXROOMS
+func (n *namespaces) Set(value string) error {
+	name, limit, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("want NAME=MAXROOMS")
+	}
+	maxRooms, err := strconv.Atoi(limit)
+	if err != nil || maxRooms <= 0 {
+		return fmt.Errorf("invalid room limit %q", limit)
+	}
+	if !room.ValidNamespace(name) {
+		return room.ErrInvalidNamespace
+	}
+	if *n == nil {
+		*n = namespaces{}
+	}
+	(*n)[name] = maxRooms
+	return nil
+}
+
+// loadCertPool reads a PEM CA bundle given by flag, exiting if it's
+// unusable
+func loadCertPool(flagName, path string) *x509.CertPool {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", flagName, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("Invalid %s: no certificates found", flagName)
+	}
+	return pool
+}
+
+// loadHostKeys adds the static API keys in a -host-keys file to keys,
+// exiting if it's unusable
+func loadHostKeys(keys *hostauth.Keys, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Invalid -host-keys: %v", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			log.Fatalf("Invalid -host-keys: line %d: want NAME KEY [OPTION...]", i+1)
+		}
+		quota, err := parseQuota(fields[2:])
+		if err == nil {
+			_, err = keys.AddStatic(fields[0], fields[1], quota)
+		}
+		if err != nil {
+			log.Fatalf("Invalid -host-keys: line %d: %v", i+1, err)
+		}
+	}
+}
+
+// parseQuota parses a -host-keys line's options, rooms=N, clients=N,
+// bytes-per-hour=N, tokens=N and profile=NAME, into the quota of its key
+func parseQuota(options []string) (hostauth.Quota, error) {
+	var q hostauth.Quota
+	for _, opt := range options {
+		name, value, _ := strings.Cut(opt, "=")
+		var err error
+		switch name {
+		case "rooms":
+			q.Rooms, err = strconv.Atoi(value)
+		case "clients":
+			q.Clients, err = strconv.Atoi(value)
+		case "bytes-per-hour":
+			q.BytesPerHour, err = strconv.ParseInt(value, 10, 64)
+		case "tokens":
+			q.Tokens, err = strconv.Atoi(value)
+		case "profile":
+			q.Profile = value
+		default:
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	return q, tenant.Validate(q)
+}
+
+// loadHostJWT returns a verifier of host JWTs signed by the keys at
+// source, a file or an https:// URL, exiting if they're unusable. Keys at
+// a URL are fetched again every refresh, so the provider can rotate them;
+// a failed fetch keeps the old ones.
+func loadHostJWT(source, issuer, audience string, refresh time.Duration) *hostauth.JWT {
+	j := hostauth.NewJWT(issuer, audience)
+	if !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err == nil {
+			err = j.SetKeys(data)
+		}
+		if err != nil {
+			log.Fatalf("Invalid -host-jwt-keys: %v", err)
+		}
+		return j
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	fetch := func() error {
+		resp, err := client.Get(source)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		return j.SetKeys(data)
+	}
+	if err := fetch(); err != nil {
+		log.Fatalf("Invalid -host-jwt-keys: %v", err)
+	}
+	if refresh <= 0 {
+		return j
+	}
+	go func() {
+		for range time.Tick(refresh) {
+			if err := fetch(); err != nil {
+				log.Printf("Host JWT keys not refreshed: %v", err)
+			}
+		}
+	}()
+	return j
+}
 
-	if err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+// dialRedis connects to a Redis URL given by flag, exiting if it's unusable
+func dialRedis(flagName, url string) *redis.Client {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", flagName, err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Redis for %s unreachable: %v", flagName, err)
 	}
+	return client
 }
 
 func init() {
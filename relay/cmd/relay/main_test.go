@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tenant"
+)
+
+// TestNamespacesSet verifies -namespace values collect a room limit per
+// namespace, a repeated name taking the later limit, and that malformed
+// values are refused
+func TestNamespacesSet(t *testing.T) {
+	var n namespaces
+	for _, value := range []string{"chat=5000", "game-2=20", "chat=10"} {
+		if err := n.Set(value); err != nil {
+			t.Fatalf("Set(%q) failed: %v", value, err)
+		}
+	}
+	if len(n) != 2 || n["chat"] != 10 || n["game-2"] != 20 {
+		t.Errorf("Expected chat=10 and game-2=20, got %v", n)
+	}
+
+	for _, value := range []string{"chat", "chat=", "chat=lots", "chat=0", "chat=-1", "=5", "Chat=5", "a/b=5"} {
+		var n namespaces
+		if err := n.Set(value); err == nil {
+			t.Errorf("Expected Set(%q) refused", value)
+		}
+	}
+	if err := n.Set("Chat=5"); !errors.Is(err, room.ErrInvalidNamespace) {
+		t.Errorf("Expected ErrInvalidNamespace, got %v", err)
+	}
+}
+
+// TestParseQuota verifies a -host-keys line's options make its key's
+// quota, and that unknown options, bad numbers and quotas the tenant
+// package refuses are errors
+func TestParseQuota(t *testing.T) {
+	q, err := parseQuota([]string{"rooms=3", "clients=50", "bytes-per-hour=1073741824", "tokens=20", "profile=strict"})
+	want := hostauth.Quota{Rooms: 3, Clients: 50, BytesPerHour: 1 << 30, Tokens: 20, Profile: "strict"}
+	if err != nil || q != want {
+		t.Errorf("Expected %+v, got %+v, %v", want, q, err)
+	}
+	if q, err := parseQuota(nil); err != nil || q != (hostauth.Quota{}) {
+		t.Errorf("Expected no options to mean no quota, got %+v, %v", q, err)
+	}
+
+	for _, options := range [][]string{{"rooms"}, {"rooms=three"}, {"bytes-per-hour=1e9"}, {"seats=5"}, {"profile=unlimited"}} {
+		if _, err := parseQuota(options); err == nil {
+			t.Errorf("Expected %q refused", options)
+		}
+	}
+	if _, err := parseQuota([]string{"tokens=-1"}); !errors.Is(err, tenant.ErrNegativeQuota) {
+		t.Errorf("Expected ErrNegativeQuota, got %v", err)
+	}
+}
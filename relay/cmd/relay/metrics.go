@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/ephemeral/relay/internal/admin"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// newMetricsServer returns the internal server for scrapes, the admin API
+// and pprof. /metrics and /metrics.json need token as a bearer token
+// unless it's empty. With clientCAs the server is to be started with TLS,
+// and refuses clients without a certificate signed by one of them.
+func newMetricsServer(addr, token string, clientCAs *x509.CertPool, registry *room.Registry, adminHandler, profiler http.Handler) *http.Server {
+	scrape := func(h http.Handler) http.Handler {
+		if token == "" {
+			return h
+		}
+		return admin.RequireBearer(token, "relay-metrics", h)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", scrape(metrics.Global.Handler(registry)))
+	mux.Handle("/metrics.json", scrape(metrics.Global.JSONHandler(registry)))
+	mux.Handle("/admin/", adminHandler)
+	mux.Handle("/debug/pprof/", profiler)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	if clientCAs != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	return srv
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// TestMetricsToken verifies both scrape endpoints refuse a request without
+// the metrics token, and are open when none is set
+func TestMetricsToken(t *testing.T) {
+	srv := newMetricsServer(":0", "scrape", nil, room.NewRegistry(), http.NotFoundHandler(), http.NotFoundHandler())
+	for _, path := range []string{"/metrics", "/metrics.json"} {
+		for auth, want := range map[string]int{
+			"":              http.StatusUnauthorized,
+			"Bearer wrong":  http.StatusUnauthorized,
+			"Bearer scrape": http.StatusOK,
+		} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("GET %s with %q: expected %d, got %d", path, auth, want, rec.Code)
+			}
+		}
+	}
+
+	open := newMetricsServer(":0", "", nil, room.NewRegistry(), http.NotFoundHandler(), http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	open.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || open.TLSConfig != nil {
+		t.Errorf("Expected an open plain server without a token or CA, got %d", rec.Code)
+	}
+}
+
+// testCert issues a certificate for key, signed by parent and parentKey,
+// or self-signed if parent is nil
+func testCert(t *testing.T, tmpl *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	return cert
+}
+
+// TestMetricsClientCA verifies the metrics server turns away a client
+// without a certificate, or with one the CA didn't sign, and serves one
+// with a certificate it did
+func TestMetricsClientCA(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		return key
+	}
+	caTmpl := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "metrics CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+	clientCert := func(serial int64, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+		key := newKey()
+		cert := testCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "scraper"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}, key, ca, caKey)
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	}
+
+	caKey, otherKey := newKey(), newKey()
+	ca := testCert(t, caTmpl(1), caKey, nil, nil)
+	other := testCert(t, caTmpl(2), otherKey, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	srv := newMetricsServer(":0", "", pool, room.NewRegistry(), http.NotFoundHandler(), http.NotFoundHandler())
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	scrape := func(certs ...tls.Certificate) error {
+		client := ts.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = certs
+		resp, err := client.Get(ts.URL + "/metrics")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected 200, got %d", resp.StatusCode)
+		}
+		return nil
+	}
+	if err := scrape(); err == nil {
+		t.Error("Expected a client without a certificate refused")
+	}
+	if err := scrape(clientCert(3, other, otherKey)); err == nil {
+		t.Error("Expected a client certificate from another CA refused")
+	}
+	if err := scrape(clientCert(4, ca, caKey)); err != nil {
+		t.Errorf("Expected a client certificate from the CA accepted, got %v", err)
+	}
+}
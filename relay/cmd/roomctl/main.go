@@ -0,0 +1,302 @@
+// Room Control
+//
+// An operator's command line for a relay's admin API, which lives on the
+// metrics listener behind -admin-token. It lists rooms, destroys one, bans
+// and allows addresses, manages the API keys hosts present, drains a node
+// or takes it out of drain mode, reports cluster status and dumps metrics.
+//
+// Room IDs are the truncated ones the listing shows; nothing here ever
+// sees a full room ID, a payload or a client address.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ephemeral/relay/internal/admin"
+)
+
+const usage = `Usage: roomctl [flags] <command> [args]
+
+Commands:
+  rooms                 List rooms, oldest first
+  destroy <room>        End a room, by the ID the listing shows
+  ban <ip|cidr>         Deny an address or range
+  unban <ip|cidr>       Lift a ban
+  allow <ip|cidr>       Exempt an address or range from rate limits
+  disallow <ip|cidr>    Remove an exemption
+  access                Show the allow and deny lists
+  keys                  List the API keys allowed to host
+  keys create <name>    Mint an API key, printing its secret this once
+  keys revoke <id>      Stop a key hosting; its rooms live on
+  drain [target]        Move every room off the node and refuse new
+                        connections; target is the ws:// or wss:// base
+                        URL clients reconnect to (default: the same)
+  drain status          Report whether the node is draining
+  undrain               Take new connections again
+  cluster               Show every node's load
+  metrics               Dump metrics (Prometheus text, or JSON with -json)
+
+Flags:
+`
+
+func main() {
+	base := flag.String("url", "http://localhost:9090", "Relay metrics server URL, where the admin API is mounted")
+	token := flag.String("token", os.Getenv("RELAY_ADMIN_TOKEN"), "Admin API bearer token (default $RELAY_ADMIN_TOKEN)")
+	metricsToken := flag.String("metrics-token", os.Getenv("RELAY_METRICS_TOKEN"), "Bearer token for metrics, if required (default $RELAY_METRICS_TOKEN)")
+	caFile := flag.String("cacert", "", "CA bundle to verify the metrics server's certificate")
+	certFile := flag.String("cert", "", "Client certificate, for a metrics server requiring mTLS")
+	keyFile := flag.String("key", "", "Client certificate key")
+	skipVerify := flag.Bool("insecure-skip-verify", false, "Skip TLS certificate verification")
+	jsonOut := flag.Bool("json", false, "Print raw JSON responses")
+	timeout := flag.Duration("timeout", 30*time.Second, "Request timeout")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *skipVerify}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			fatal(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			fatal(fmt.Errorf("no certificates in %s", *caFile))
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	a := &api{
+		base:         strings.TrimSuffix(*base, "/"),
+		token:        *token,
+		metricsToken: *metricsToken,
+		http: &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	if err := run(a, flag.Args(), *jsonOut); err != nil {
+		fatal(err)
+	}
+}
+
+func run(a *api, args []string, jsonOut bool) error {
+	cmd, args := args[0], args[1:]
+	arg := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("%s takes one argument", cmd)
+		}
+		return args[0], nil
+	}
+	if cmd != "metrics" && a.token == "" {
+		return fmt.Errorf("an admin token is required (-token or $RELAY_ADMIN_TOKEN)")
+	}
+
+	switch cmd {
+	case "rooms":
+		var resp admin.RoomListResponse
+		if err := a.do(http.MethodGet, "/admin/rooms", nil, &resp); err != nil {
+			return err
+		}
+		if jsonOut {
+			return printJSON(resp)
+		}
+		fmt.Printf("%d rooms, %d clients\n", resp.RoomCount, resp.ClientSum)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROOM\tAGE\tCLIENTS\tOPEN")
+		for _, r := range resp.Rooms {
+			fmt.Fprintf(tw, "%s\t%v\t%d\t%v\n", r.ID, time.Duration(r.AgeSeconds)*time.Second, r.Clients, r.Open)
+		}
+		return tw.Flush()
+
+	case "destroy":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		var resp admin.RoomDestroyResponse
+		if err := a.do(http.MethodDelete, "/admin/rooms/"+url.PathEscape(id), nil, &resp); err != nil {
+			return err
+		}
+		return result(jsonOut, resp, "Destroyed room %s", resp.ID)
+
+	case "ban", "unban", "allow", "disallow":
+		prefix, err := arg()
+		if err != nil {
+			return err
+		}
+		list := "deny"
+		if cmd == "allow" || cmd == "disallow" {
+			list = "allow"
+		}
+		var resp admin.AccessListResponse
+		if cmd == "ban" || cmd == "allow" {
+			err = a.do(http.MethodPost, "/admin/access/"+list, admin.AccessEditRequest{Prefix: prefix}, &resp)
+		} else {
+			err = a.do(http.MethodDelete, "/admin/access/"+list+"?prefix="+url.QueryEscape(prefix), nil, &resp)
+		}
+		if err != nil {
+			return err
+		}
+		return printAccess(jsonOut, resp)
+
+	case "access":
+		var resp admin.AccessListResponse
+		if err := a.do(http.MethodGet, "/admin/access", nil, &resp); err != nil {
+			return err
+		}
+		return printAccess(jsonOut, resp)
+
+	case "keys":
+		switch {
+		case len(args) == 0:
+			var resp admin.HostKeyListResponse
+			if err := a.do(http.MethodGet, "/admin/keys", nil, &resp); err != nil {
+				return err
+			}
+			return printKeys(jsonOut, resp)
+		case len(args) == 2 && args[0] == "create":
+			var resp admin.HostKeyCreateResponse
+			if err := a.do(http.MethodPost, "/admin/keys", admin.HostKeyCreateRequest{Name: args[1]}, &resp); err != nil {
+				return err
+			}
+			return result(jsonOut, resp, "Created key %s (%s); its secret, which won't be shown again:\n%s", resp.ID, resp.Name, resp.Secret)
+		case len(args) == 2 && args[0] == "revoke":
+			var resp admin.HostKeyListResponse
+			if err := a.do(http.MethodDelete, "/admin/keys/"+url.PathEscape(args[1]), nil, &resp); err != nil {
+				return err
+			}
+			return printKeys(jsonOut, resp)
+		}
+		return fmt.Errorf("keys takes no arguments, create <name> or revoke <id>")
+
+	case "drain":
+		if len(args) == 1 && args[0] == "status" {
+			var resp admin.DrainStatusResponse
+			if err := a.do(http.MethodGet, "/admin/drain", nil, &resp); err != nil {
+				return err
+			}
+			return result(jsonOut, resp, "Draining: %v", resp.Draining)
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("drain takes at most one target")
+		}
+		var req admin.DrainRequest
+		if len(args) == 1 {
+			req.Target = args[0]
+		}
+		var resp admin.DrainResponse
+		if err := a.do(http.MethodPost, "/admin/drain", req, &resp); err != nil {
+			return err
+		}
+		return result(jsonOut, resp, "Drained %d rooms and %d clients; the node refuses new connections", resp.Rooms, resp.Clients)
+
+	case "undrain":
+		var resp admin.DrainStatusResponse
+		if err := a.do(http.MethodDelete, "/admin/drain", nil, &resp); err != nil {
+			return err
+		}
+		return result(jsonOut, resp, "Draining: %v", resp.Draining)
+
+	case "cluster":
+		var resp admin.ClusterStatusResponse
+		if err := a.do(http.MethodGet, "/admin/cluster", nil, &resp); err != nil {
+			return err
+		}
+		if jsonOut {
+			return printJSON(resp)
+		}
+		fmt.Printf("%d nodes, %d rooms, %d connections, headroom %s\n", resp.NodeCount, resp.Rooms, resp.Connections, headroom(resp.Headroom))
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NODE\tADDR\tROOMS\tCONNS\tHEADROOM\tSTATE")
+		for _, n := range resp.Nodes {
+			state := "up"
+			if n.Draining {
+				state = "draining"
+			}
+			if n.Self {
+				state += " (this node)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", n.Name, n.Addr, n.Rooms, n.Connections, headroom(n.Headroom), state)
+		}
+		return tw.Flush()
+
+	case "metrics":
+		return a.metrics(os.Stdout, jsonOut)
+	}
+	return fmt.Errorf("unknown command %q; run roomctl -h for help", cmd)
+}
+
+// result prints a one-line outcome, or resp as JSON
+func result(jsonOut bool, resp any, format string, args ...any) error {
+	if jsonOut {
+		return printJSON(resp)
+	}
+	fmt.Printf(format+"\n", args...)
+	return nil
+}
+
+func printAccess(jsonOut bool, resp admin.AccessListResponse) error {
+	if jsonOut {
+		return printJSON(resp)
+	}
+	fmt.Printf("allow: %s\n", strings.Join(resp.Allow, " "))
+	fmt.Printf("deny:  %s\n", strings.Join(resp.Deny, " "))
+	return nil
+}
+
+func printKeys(jsonOut bool, resp admin.HostKeyListResponse) error {
+	if jsonOut {
+		return printJSON(resp)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tNAME\tCREATED\tKIND")
+	for _, k := range resp.Keys {
+		kind := "managed"
+		if k.Static {
+			kind = "static"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Created.Format(time.RFC3339), kind)
+	}
+	return tw.Flush()
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func headroom(h *int) string {
+	if h == nil {
+		return "unlimited"
+	}
+	return fmt.Sprint(*h)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "roomctl:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,1120 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxMessageSize is the relay's inbound frame limit
+const maxMessageSize = 8 * 1024 * 1024
+
+// heartbeatInterval keeps hosts well inside the relay's heartbeat timeout
+const heartbeatInterval = 2 * time.Second
+
+// frame is the relay's JSON envelope
+type frame struct {
+	Type     string          `json:"type"`
+	RoomID   string          `json:"roomId,omitempty"`
+	ClientID string          `json:"clientId,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Secret   string          `json:"hostSecret,omitempty"`
+	Role     string          `json:"role,omitempty"`
+	Category string          `json:"category,omitempty"`
+
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+	Approved     bool  `json:"approved,omitempty"` // JOIN_RESPONSE from the host accepting the joiner
+}
+
+// checks is the protocol behavior matrix, run in order. Those exceeding
+// the per-IP limits come last, so a ban they earn spoils nothing else.
+var checks = []Check{
+	{Name: "create room", Since: V1, run: checkCreateRoom},
+	{Name: "duplicate room rejected", Since: V1, run: checkDuplicateRoom},
+	{Name: "invalid room id rejected", Since: V1, run: checkInvalidRoomID},
+	{Name: "join unknown room rejected", Since: V1, run: checkJoinUnknownRoom},
+	{Name: "join before open rejected", Since: V1, run: checkJoinBeforeOpen},
+	{Name: "heartbeat acknowledged", Since: V1, run: checkHeartbeatAck},
+	{Name: "unknown frames ignored", Since: V1, run: checkUnknownFrames},
+	{Name: "join request forwarded to host", Since: V1, run: checkJoinRequest},
+	{Name: "join response delivered to client", Since: V1, run: checkJoinResponse},
+	{Name: "join response reaches only its client", Since: V1, run: checkJoinResponseAddressed},
+	{Name: "join confirm forwarded to host", Since: V1, run: checkJoinConfirm},
+	{Name: "host broadcast reaches clients", Since: V1, run: checkBroadcast},
+	{Name: "client message relayed", Since: V1, run: checkClientMessage},
+	{Name: "direct message reaches one client", Since: V1, run: checkDirect},
+	{Name: "client error forwarded to host", Since: V1, run: checkClientError},
+	{Name: "kick disconnects client", Since: V1, run: checkKick},
+	{Name: "client leave notifies host", Since: V1, run: checkClientLeft},
+	{Name: "room close destroys room", Since: V1, run: checkRoomClose},
+	{Name: "room stats reported to host", Since: V1, run: checkRoomStats},
+	{Name: "host socket mints scoped invite", Since: V1, run: checkCreateInvite},
+	{Name: "failed join keeps invite", Since: V1, run: checkFailedJoinKeepsInvite},
+	{Name: "message flood rate limited", Since: V1, run: checkMessageRateLimited},
+	{Name: "oversize frame rejected", Since: V1, Slow: true, run: checkOversizeFrame},
+	{Name: "heartbeat timeout destroys room", Since: V1, Slow: true, run: checkHeartbeatTimeout},
+	{Name: "join flood rate limited", Since: V1, Limit: true, run: checkJoinRateLimited},
+}
+
+type suite struct {
+	baseURL string
+	version int
+	timeout time.Duration
+	dialer  *websocket.Dialer
+}
+
+func newSuite(cfg Config) *suite {
+	s := &suite{
+		baseURL: strings.TrimSuffix(cfg.URL, "/"),
+		version: cfg.Version,
+		timeout: cfg.Timeout,
+		dialer:  cfg.Dialer,
+	}
+	if s.version == 0 {
+		s.version = Latest
+	}
+	if s.timeout == 0 {
+		s.timeout = DefaultTimeout
+	}
+	if s.dialer == nil {
+		s.dialer = websocket.DefaultDialer
+	}
+	return s
+}
+
+// peer is one WebSocket connection to the relay
+type peer struct {
+	conn    *websocket.Conn
+	version int // every frame read is checked against its schemas
+	timeout time.Duration
+	mu      sync.Mutex // serializes writes with the heartbeat goroutine
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newRoomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// statusError is a rejected upgrade with the relay's HTTP status
+type statusError struct {
+	path string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("dial %s: HTTP %d", e.path, e.code)
+}
+
+func (s *suite) dial(path string) (*peer, error) {
+	conn, resp, err := s.dialer.Dial(s.baseURL+path, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, &statusError{path: path, code: resp.StatusCode}
+		}
+		return nil, fmt.Errorf("dial %s: %w", path, err)
+	}
+	return &peer{conn: conn, version: s.version, timeout: s.timeout, stop: make(chan struct{})}, nil
+}
+
+// host creates a room and starts heartbeating
+func (s *suite) host(roomID string) (*peer, error) {
+	p, err := s.dial("/rooms/" + roomID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.expect("ROOM_CREATED")
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	if f.RoomID != roomID {
+		p.close()
+		return nil, fmt.Errorf("ROOM_CREATED for %q, want %q", f.RoomID, roomID)
+	}
+	if f.Secret == "" {
+		p.close()
+		return nil, errors.New("ROOM_CREATED carried no host secret")
+	}
+	go p.heartbeat()
+	return p, nil
+}
+
+// openHost creates a room and opens it for joins
+func (s *suite) openHost(roomID string) (*peer, error) {
+	h, err := s.host(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.send(frame{Type: "ROOM_OPEN"}); err != nil {
+		h.close()
+		return nil, err
+	}
+	if err := h.sync(); err != nil {
+		h.close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// join connects a client and returns it with its relay-assigned ID
+func (s *suite) join(roomID string) (*peer, string, error) {
+	c, err := s.dial("/rooms/" + roomID + "/join")
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := c.expect("CONNECTED")
+	if err != nil {
+		c.close()
+		return nil, "", err
+	}
+	if f.ClientID == "" {
+		c.close()
+		return nil, "", errors.New("CONNECTED without clientId")
+	}
+	return c, f.ClientID, nil
+}
+
+// admit has the host accept a joiner. Relays pass on nothing a client
+// sends before then.
+func admit(h, c *peer, clientID string) error {
+	if err := h.send(frame{Type: "JOIN_RESPONSE", ClientID: clientID, Approved: true, Payload: json.RawMessage(`{"approved":true}`)}); err != nil {
+		return err
+	}
+	_, err := c.expect("JOIN_RESPONSE")
+	return err
+}
+
+func (p *peer) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if p.send(frame{Type: "HEARTBEAT"}) != nil {
+				return
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// sync waits until the relay has processed everything this host sent.
+// The relay handles host frames in order and ROOM_OPEN has no reply, so a
+// heartbeat round trip is the barrier.
+func (p *peer) sync() error {
+	if err := p.send(frame{Type: "HEARTBEAT"}); err != nil {
+		return err
+	}
+	p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	for {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("waiting for HEARTBEAT_ACK: %w", err)
+		}
+		var f frame
+		if json.Unmarshal(data, &f) == nil && f.Type == "HEARTBEAT_ACK" {
+			return nil
+		}
+	}
+}
+
+// stopHeartbeat stops the keepalive without closing the connection
+func (p *peer) stopHeartbeat() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *peer) close() {
+	p.stopHeartbeat()
+	p.conn.Close()
+}
+
+func (p *peer) send(f frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return p.sendRaw(data)
+}
+
+func (p *peer) sendRaw(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	return p.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// next reads the next frame other than a heartbeat ack. A frame that
+// doesn't match its schema is an error.
+func (p *peer) next(timeout time.Duration) (frame, error) {
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return frame{}, err
+		}
+		if err := Validate(p.version, FromRelay, data); err != nil {
+			return frame{}, fmt.Errorf("schema: %w", err)
+		}
+		var f frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			return frame{}, fmt.Errorf("undecodable frame: %w", err)
+		}
+		if f.Type == "HEARTBEAT_ACK" {
+			continue
+		}
+		return f, nil
+	}
+}
+
+// expect reads frames until one of msgType arrives.
+// An ERROR frame ends the wait early since the relay sends it before closing.
+func (p *peer) expect(msgType string) (frame, error) {
+	return p.expectWithin(msgType, p.timeout)
+}
+
+func (p *peer) expectWithin(msgType string, timeout time.Duration) (frame, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := p.next(time.Until(deadline))
+		if err != nil {
+			return frame{}, fmt.Errorf("waiting for %s: %w", msgType, err)
+		}
+		if f.Type == msgType {
+			return f, nil
+		}
+		if f.Type == "ERROR" {
+			return f, fmt.Errorf("waiting for %s: got ERROR %q", msgType, f.Reason)
+		}
+	}
+}
+
+// expectNothing asserts no frame (other than heartbeat acks) arrives
+func (p *peer) expectNothing(window time.Duration) error {
+	f, err := p.next(window)
+	if err == nil {
+		return fmt.Errorf("unexpected %s frame", f.Type)
+	}
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// expectClosed asserts the relay hangs up within timeout, whatever it
+// sends first. Version 1 relays may close without a close frame, so any
+// close will do.
+func (p *peer) expectClosed(timeout time.Duration) error {
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, _, err := p.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return errors.New("connection still open")
+		}
+		return nil
+	}
+}
+
+func samePayload(got, want json.RawMessage) error {
+	if !bytes.Equal(bytes.TrimSpace(got), bytes.TrimSpace(want)) {
+		return fmt.Errorf("payload %s, want %s", got, want)
+	}
+	return nil
+}
+
+// Checks
+
+func checkCreateRoom(s *suite) error {
+	h, err := s.host(newRoomID())
+	if err != nil {
+		return err
+	}
+	h.close()
+	return nil
+}
+
+func checkDuplicateRoom(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.host(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	dup, err := s.dial("/rooms/" + roomID)
+	if err != nil {
+		return err
+	}
+	defer dup.close()
+
+	if _, err := dup.expect("ROOM_CREATED"); err == nil {
+		return errors.New("second host created an existing room")
+	}
+	return nil
+}
+
+func checkInvalidRoomID(s *suite) error {
+	p, err := s.dial("/rooms/not-a-valid-room-id")
+	if err == nil {
+		p.close()
+		return errors.New("upgrade accepted for malformed room ID")
+	}
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.code != http.StatusBadRequest {
+		return fmt.Errorf("expected HTTP 400, got %v", err)
+	}
+	return nil
+}
+
+func checkJoinUnknownRoom(s *suite) error {
+	c, err := s.dial("/rooms/" + newRoomID() + "/join")
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	f, err := c.next(s.timeout)
+	if err != nil {
+		return err
+	}
+	if f.Type != "ERROR" {
+		return fmt.Errorf("expected ERROR, got %s", f.Type)
+	}
+	return c.expectClosed(s.timeout)
+}
+
+func checkJoinBeforeOpen(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.host(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, err := s.dial("/rooms/" + roomID + "/join")
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	f, err := c.next(s.timeout)
+	if err != nil {
+		return err
+	}
+	if f.Type != "ERROR" {
+		return fmt.Errorf("expected ERROR, got %s", f.Type)
+	}
+	return c.expectClosed(s.timeout)
+}
+
+func checkHeartbeatAck(s *suite) error {
+	h, err := s.host(newRoomID())
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	return h.sync()
+}
+
+func checkUnknownFrames(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := admit(h, c, clientID); err != nil {
+		return err
+	}
+
+	// Frames a relay doesn't understand are dropped, not fatal, so newer
+	// peers can talk to older relays
+	for _, data := range []string{`{"type":"NOT_A_FRAME"}`, `not json`, `[]`, `{}`} {
+		if err := h.sendRaw([]byte(data)); err != nil {
+			return err
+		}
+		if err := c.sendRaw([]byte(data)); err != nil {
+			return err
+		}
+	}
+	if err := h.sync(); err != nil {
+		return fmt.Errorf("host after unknown frames: %w", err)
+	}
+
+	payload := json.RawMessage(`"still-connected"`)
+	if err := c.send(frame{Type: "MESSAGE", Payload: payload}); err != nil {
+		return err
+	}
+	f, err := h.expect("CLIENT_MESSAGE")
+	if err != nil {
+		return fmt.Errorf("client after unknown frames: %w", err)
+	}
+	return samePayload(f.Payload, payload)
+}
+
+func checkJoinRequest(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	payload := json.RawMessage(`{"publicKey":"conformance"}`)
+	if err := c.send(frame{Type: "JOIN_REQUEST", Payload: payload}); err != nil {
+		return err
+	}
+
+	f, err := h.expect("JOIN_REQUEST")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != clientID {
+		return fmt.Errorf("JOIN_REQUEST from %q, want %q", f.ClientID, clientID)
+	}
+	return samePayload(f.Payload, payload)
+}
+
+func checkJoinResponse(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	payload := json.RawMessage(`{"approved":true}`)
+	if err := h.send(frame{Type: "JOIN_RESPONSE", ClientID: clientID, Approved: true, Payload: payload}); err != nil {
+		return err
+	}
+
+	f, err := c.expect("JOIN_RESPONSE")
+	if err != nil {
+		return err
+	}
+	return samePayload(f.Payload, payload)
+}
+
+func checkJoinResponseAddressed(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	a, aID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	b, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	if err := h.send(frame{Type: "JOIN_RESPONSE", ClientID: aID, Approved: true, Payload: json.RawMessage(`{"approved":true}`)}); err != nil {
+		return err
+	}
+	if _, err := a.expect("JOIN_RESPONSE"); err != nil {
+		return err
+	}
+	return b.expectNothing(500 * time.Millisecond)
+}
+
+func checkJoinConfirm(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err := c.send(frame{Type: "JOIN_REQUEST"}); err != nil {
+		return err
+	}
+	if _, err := h.expect("JOIN_REQUEST"); err != nil {
+		return err
+	}
+	if err := h.send(frame{Type: "JOIN_RESPONSE", ClientID: clientID, Approved: true, Payload: json.RawMessage(`{"approved":true}`)}); err != nil {
+		return err
+	}
+	if _, err := c.expect("JOIN_RESPONSE"); err != nil {
+		return err
+	}
+
+	payload := json.RawMessage(`{"keyConfirmation":"conformance"}`)
+	if err := c.send(frame{Type: "JOIN_CONFIRM", Payload: payload}); err != nil {
+		return err
+	}
+	f, err := h.expect("JOIN_CONFIRM")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != clientID {
+		return fmt.Errorf("JOIN_CONFIRM from %q, want %q", f.ClientID, clientID)
+	}
+	return samePayload(f.Payload, payload)
+}
+
+func checkBroadcast(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	a, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	b, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	payload := json.RawMessage(`"broadcast-ciphertext"`)
+	if err := h.send(frame{Type: "BROADCAST", Payload: payload}); err != nil {
+		return err
+	}
+
+	for _, c := range []*peer{a, b} {
+		f, err := c.expect("MESSAGE")
+		if err != nil {
+			return err
+		}
+		if err := samePayload(f.Payload, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkClientMessage(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	a, aID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	if err := admit(h, a, aID); err != nil {
+		return err
+	}
+	b, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	payload := json.RawMessage(`"client-ciphertext"`)
+	if err := a.send(frame{Type: "MESSAGE", Payload: payload}); err != nil {
+		return err
+	}
+
+	f, err := h.expect("CLIENT_MESSAGE")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != aID {
+		return fmt.Errorf("CLIENT_MESSAGE from %q, want %q", f.ClientID, aID)
+	}
+	if err := samePayload(f.Payload, payload); err != nil {
+		return err
+	}
+
+	f, err = b.expect("MESSAGE")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != aID {
+		return fmt.Errorf("MESSAGE from %q, want %q", f.ClientID, aID)
+	}
+	if err := samePayload(f.Payload, payload); err != nil {
+		return err
+	}
+
+	// Senders must not receive their own messages back
+	return a.expectNothing(500 * time.Millisecond)
+}
+
+func checkDirect(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	a, aID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	b, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	payload := json.RawMessage(`"direct-ciphertext"`)
+	if err := h.send(frame{Type: "DIRECT", ClientID: aID, Payload: payload}); err != nil {
+		return err
+	}
+
+	f, err := a.expect("MESSAGE")
+	if err != nil {
+		return err
+	}
+	if err := samePayload(f.Payload, payload); err != nil {
+		return err
+	}
+	return b.expectNothing(500 * time.Millisecond)
+}
+
+func checkClientError(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	payload := json.RawMessage(`{"detail":"conformance"}`)
+	if err := c.send(frame{Type: "CLIENT_ERROR", Category: "decode", Payload: payload}); err != nil {
+		return err
+	}
+	f, err := h.expect("CLIENT_ERROR")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != clientID || f.Category != "decode" {
+		return fmt.Errorf("CLIENT_ERROR from %q in %q, want %q in decode", f.ClientID, f.Category, clientID)
+	}
+	return samePayload(f.Payload, payload)
+}
+
+func checkKick(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err := h.send(frame{Type: "KICK", ClientID: clientID}); err != nil {
+		return err
+	}
+
+	f, err := c.expect("KICKED")
+	if err != nil {
+		return err
+	}
+	if f.Reason != "kicked_by_host" {
+		return fmt.Errorf("KICKED reason %q, want kicked_by_host", f.Reason)
+	}
+	if err := c.expectClosed(s.timeout); err != nil {
+		return fmt.Errorf("kicked client: %w", err)
+	}
+
+	f, err = h.expect("CLIENT_LEFT")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != clientID {
+		return fmt.Errorf("CLIENT_LEFT for %q, want %q", f.ClientID, clientID)
+	}
+	return nil
+}
+
+func checkClientLeft(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	c.close()
+
+	f, err := h.expect("CLIENT_LEFT")
+	if err != nil {
+		return err
+	}
+	if f.ClientID != clientID {
+		return fmt.Errorf("CLIENT_LEFT for %q, want %q", f.ClientID, clientID)
+	}
+	return nil
+}
+
+func checkRoomClose(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err := h.send(frame{Type: "ROOM_CLOSE"}); err != nil {
+		return err
+	}
+
+	if _, err := c.expect("ROOM_DESTROYED"); err != nil {
+		return err
+	}
+
+	// The room ID must be gone
+	late, err := s.dial("/rooms/" + roomID + "/join")
+	if err != nil {
+		return err
+	}
+	defer late.close()
+	f, err := late.next(s.timeout)
+	if err != nil {
+		return err
+	}
+	if f.Type != "ERROR" {
+		return fmt.Errorf("join after close got %s, want ERROR", f.Type)
+	}
+	return nil
+}
+
+func checkRoomStats(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err := h.send(frame{Type: "BROADCAST", Payload: json.RawMessage(`"x"`)}); err != nil {
+		return err
+	}
+	if _, err := c.expect("MESSAGE"); err != nil {
+		return err
+	}
+
+	if err := h.send(frame{Type: "ROOM_STATS"}); err != nil {
+		return err
+	}
+	f, err := h.expect("ROOM_STATS")
+	if err != nil {
+		return err
+	}
+
+	var stats struct {
+		Clients  int    `json:"clients"`
+		Pending  int    `json:"pending"`
+		Messages uint64 `json:"messages"`
+	}
+	if err := json.Unmarshal(f.Payload, &stats); err != nil {
+		return fmt.Errorf("undecodable stats: %w", err)
+	}
+	if stats.Clients != 1 || stats.Pending != 1 || stats.Messages != 1 {
+		return fmt.Errorf("stats %+v, want 1 client, 1 pending, 1 message", stats)
+	}
+	return nil
+}
+
+func checkCreateInvite(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	if err := h.send(frame{Type: "CREATE_INVITE", Payload: json.RawMessage(`{"scope":"observer"}`)}); err != nil {
+		return err
+	}
+	f, err := h.expect("INVITE_CREATED")
+	if err != nil {
+		return err
+	}
+	var created struct {
+		Token string `json:"token"`
+		Scope string `json:"scope"`
+	}
+	if err := json.Unmarshal(f.Payload, &created); err != nil || created.Token == "" {
+		return fmt.Errorf("undecodable invite %s", f.Payload)
+	}
+	if created.Scope != "observer" {
+		return fmt.Errorf("invite scope %q, want observer", created.Scope)
+	}
+
+	c, err := s.dial("/rooms/" + roomID + "/join?token=" + created.Token)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	f, err = c.expect("CONNECTED")
+	if err != nil {
+		return err
+	}
+	if f.Role != "observer" {
+		return fmt.Errorf("joined as %q, want observer", f.Role)
+	}
+	if err := admit(h, c, f.ClientID); err != nil {
+		return err
+	}
+
+	// Observers are receive-only
+	if err := c.send(frame{Type: "MESSAGE", Payload: json.RawMessage(`"hi"`)}); err != nil {
+		return err
+	}
+	return h.expectNothing(500 * time.Millisecond)
+}
+
+func checkFailedJoinKeepsInvite(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.host(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	// The scope shows in CONNECTED, which reveals whether the token was honored
+	if err := h.send(frame{Type: "CREATE_INVITE", Payload: json.RawMessage(`{"scope":"observer"}`)}); err != nil {
+		return err
+	}
+	f, err := h.expect("INVITE_CREATED")
+	if err != nil {
+		return err
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(f.Payload, &created); err != nil || created.Token == "" {
+		return fmt.Errorf("undecodable invite %s", f.Payload)
+	}
+	path := "/rooms/" + roomID + "/join?token=" + created.Token
+
+	// Room isn't open yet: the join fails and must not spend the token
+	c, err := s.dial(path)
+	if err != nil {
+		return err
+	}
+	_, err = c.expect("CONNECTED")
+	c.close()
+	if err == nil {
+		return errors.New("joined a room that was not open")
+	}
+
+	if err := h.send(frame{Type: "ROOM_OPEN"}); err != nil {
+		return err
+	}
+	if err := h.sync(); err != nil {
+		return err
+	}
+
+	c, err = s.dial(path)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	f, err = c.expect("CONNECTED")
+	if err != nil {
+		return err
+	}
+	if f.Role != "observer" {
+		return fmt.Errorf("joined as %q: the failed join spent the invite", f.Role)
+	}
+	return nil
+}
+
+func checkMessageRateLimited(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, clientID, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := admit(h, c, clientID); err != nil {
+		return err
+	}
+
+	// Well past the burst of the most relaxed profile
+	for range 300 {
+		if err := c.send(frame{Type: "MESSAGE", Payload: json.RawMessage(`"flood"`)}); err != nil {
+			return err
+		}
+	}
+
+	f, err := c.expect("RATE_LIMITED")
+	if err != nil {
+		return err
+	}
+	if f.Reason != "messages" {
+		return fmt.Errorf("RATE_LIMITED reason %q, want messages", f.Reason)
+	}
+	if f.RetryAfterMs <= 0 {
+		return fmt.Errorf("RATE_LIMITED retryAfterMs %d, want a positive delay", f.RetryAfterMs)
+	}
+	return nil
+}
+
+func checkOversizeFrame(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	big := make([]byte, maxMessageSize+1)
+	for i := range big {
+		big[i] = 'A'
+	}
+	// The write may itself fail once the relay closes the socket
+	c.sendRaw(big)
+
+	_, err = c.next(s.timeout)
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		if closeErr.Code != websocket.CloseMessageTooBig {
+			return fmt.Errorf("close code %d, want %d", closeErr.Code, websocket.CloseMessageTooBig)
+		}
+		return nil
+	}
+	if err == nil {
+		return errors.New("connection survived an oversize frame")
+	}
+	// Abrupt close without a close frame still enforces the limit
+	return nil
+}
+
+func checkHeartbeatTimeout(s *suite) error {
+	roomID := newRoomID()
+	h, err := s.openHost(roomID)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	c, _, err := s.join(roomID)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	// Go silent; the relay should destroy the room within its timeout window
+	h.stopHeartbeat()
+
+	f, err := c.expectWithin("ROOM_DESTROYED", 15*time.Second)
+	if err != nil {
+		return err
+	}
+	if f.Reason != "heartbeat_timeout" {
+		return fmt.Errorf("ROOM_DESTROYED reason %q, want heartbeat_timeout", f.Reason)
+	}
+	return nil
+}
+
+func checkJoinRateLimited(s *suite) error {
+	// Joins to a room that doesn't exist still count against the per-IP
+	// upgrade limit; the first refusal must be a 429
+	for range 200 {
+		c, err := s.dial("/rooms/" + newRoomID() + "/join")
+		if err != nil {
+			var status *statusError
+			if errors.As(err, &status) && status.code == http.StatusTooManyRequests {
+				return nil
+			}
+			return err
+		}
+		c.close()
+	}
+	return errors.New("200 join attempts never refused with HTTP 429")
+}
@@ -0,0 +1,165 @@
+// Package conformance checks a relay against the wire protocol: the
+// schema of every frame it sends, how it closes connections, the join
+// approval handshake, and its rate limits. Each check runs over real
+// WebSockets, with fresh random room IDs and dummy payloads only.
+//
+// Client implementations in other languages use it two ways. Run it
+// against the relay they test with, through cmd/relay-conformance, to
+// know the behavior they code against is the one the protocol promises;
+// and take the message schemas from Schemas, printed by
+// relay-conformance -schemas, to check the frames their own client sends
+// and accepts. Go programs can run the suite as subtests with Test.
+//
+// Checks are tagged with the protocol version that introduced them, so a
+// relay is checked against the version its clients speak.
+package conformance
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions
+const (
+	V1 = 1
+
+	// Latest is the newest version this package knows
+	Latest = V1
+)
+
+// DefaultTimeout bounds each step of a check when Config doesn't
+const DefaultTimeout = 5 * time.Second
+
+// Config says which relay to check, and which checks to run
+type Config struct {
+	URL     string            // ws:// or wss:// base URL
+	Dialer  *websocket.Dialer // nil means websocket.DefaultDialer
+	Timeout time.Duration     // per step; zero means DefaultTimeout
+	Version int               // zero means Latest
+
+	// Pace is a pause between checks, keeping a run under the relay's
+	// per-IP connection limits
+	Pace time.Duration
+
+	// Slow includes checks that wait out server-side timeouts or send
+	// very large frames
+	Slow bool
+
+	// Limits includes checks that exceed the per-IP connection limits on
+	// purpose. Against a deployed relay this can get the address running
+	// them banned for a while, so run them last or from an address the
+	// relay doesn't allowlist.
+	Limits bool
+
+	// Run, if set, keeps only the checks whose name contains it
+	Run string
+}
+
+// Check is one behavior of the protocol
+type Check struct {
+	Name  string
+	Since int  // the protocol version that introduced it
+	Slow  bool // see Config.Slow
+	Limit bool // see Config.Limits
+	run   func(s *suite) error
+}
+
+// Result is how one check went
+type Result struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is a whole run
+type Report struct {
+	URL     string   `json:"url"`
+	Version int      `json:"version"`
+	Total   int      `json:"total"`
+	Failed  int      `json:"failed"`
+	Results []Result `json:"results"`
+}
+
+// Checks returns the checks cfg selects, in the order they run
+func Checks(cfg Config) ([]Check, error) {
+	version := cfg.Version
+	if version == 0 {
+		version = Latest
+	}
+	if version < V1 || version > Latest {
+		return nil, fmt.Errorf("unknown protocol version %d", version)
+	}
+
+	var selected []Check
+	for _, c := range checks {
+		if c.Since > version || c.Slow && !cfg.Slow || c.Limit && !cfg.Limits {
+			continue
+		}
+		if cfg.Run != "" && !strings.Contains(c.Name, cfg.Run) {
+			continue
+		}
+		selected = append(selected, c)
+	}
+	return selected, nil
+}
+
+// Run runs the checks cfg selects against its relay, calling progress,
+// if not nil, after each
+func Run(cfg Config, progress func(Result)) (Report, error) {
+	selected, err := Checks(cfg)
+	if err != nil {
+		return Report{}, err
+	}
+	s := newSuite(cfg)
+	r := Report{URL: s.baseURL, Version: s.version}
+	for i, c := range selected {
+		if i > 0 {
+			time.Sleep(cfg.Pace)
+		}
+		res := s.run(c)
+		r.Results = append(r.Results, res)
+		if !res.Passed {
+			r.Failed++
+		}
+		if progress != nil {
+			progress(res)
+		}
+	}
+	r.Total = len(r.Results)
+	return r, nil
+}
+
+// Test runs the checks cfg selects as subtests of t
+func Test(t *testing.T, cfg Config) {
+	t.Helper()
+	selected, err := Checks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSuite(cfg)
+	for i, c := range selected {
+		if i > 0 {
+			time.Sleep(cfg.Pace)
+		}
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.run(s); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func (s *suite) run(c Check) Result {
+	start := time.Now()
+	err := c.run(s)
+	res := Result{Name: c.Name, Passed: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package conformance
+
+import (
+	"testing"
+
+	"github.com/ephemeral/relay/internal/testutil"
+)
+
+// TestRelayConforms verifies this repository's relay passes every check
+// but the slow ones
+func TestRelayConforms(t *testing.T) {
+	Test(t, Config{URL: testutil.NewServer(t).URL})
+}
+
+// TestRelayConformsLimits verifies the per-IP limit checks against a relay
+// that doesn't allowlist loopback
+func TestRelayConformsLimits(t *testing.T) {
+	s := testutil.NewServerWithConfig(t, testutil.Config{Limited: true})
+	Test(t, Config{URL: s.URL, Limits: true, Run: "join flood"})
+}
+
+// TestChecksSelection verifies Checks filters by version, slowness, limits
+// and name
+func TestChecksSelection(t *testing.T) {
+	all, err := Checks(Config{Slow: true, Limits: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(checks) {
+		t.Errorf("Expected all %d checks, got %d", len(checks), len(all))
+	}
+
+	fast, _ := Checks(Config{})
+	for _, c := range fast {
+		if c.Slow || c.Limit {
+			t.Errorf("Expected %q left out by default", c.Name)
+		}
+	}
+
+	kick, _ := Checks(Config{Run: "kick"})
+	if len(kick) != 1 || kick[0].Name != "kick disconnects client" {
+		t.Errorf("Expected only the kick check, got %+v", kick)
+	}
+
+	if _, err := Checks(Config{Version: Latest + 1}); err == nil {
+		t.Error("Expected an unknown version refused")
+	}
+}
+
+// TestValidate verifies frames are checked against the schema of their
+// type and sender
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		data string
+		ok   bool
+	}{
+		{"valid", FromRelay, `{"type":"CONNECTED","clientId":"c1","role":"participant","clientSecret":"s"}`, true},
+		{"optional payload", FromRelay, `{"type":"MESSAGE","payload":{"n":1}}`, true},
+		{"any payload", FromRelay, `{"type":"MESSAGE","payload":"ciphertext"}`, true},
+		{"missing required", FromRelay, `{"type":"CONNECTED","clientId":"c1"}`, false},
+		{"wrong kind", FromRelay, `{"type":"RATE_LIMITED","reason":"messages","retryAfterMs":"soon"}`, false},
+		{"unexpected field", FromRelay, `{"type":"HEARTBEAT_ACK","extra":1}`, false},
+		{"open frame", FromRelay, `{"type":"JOIN_RESPONSE","clientId":"c1","approved":true}`, true},
+		{"boolean kind", FromHost, `{"type":"JOIN_RESPONSE","clientId":"c1","approved":"yes"}`, false},
+		{"unknown type", FromRelay, `{"type":"NOT_A_FRAME"}`, false},
+		{"wrong sender", FromClient, `{"type":"BROADCAST","payload":1}`, false},
+		{"no type", FromHost, `{"payload":1}`, false},
+		{"not an object", FromHost, `[]`, false},
+	}
+	for _, tt := range tests {
+		err := Validate(V1, tt.from, []byte(tt.data))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Expected ok=%v, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
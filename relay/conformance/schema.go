@@ -0,0 +1,166 @@
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Senders of a frame
+const (
+	FromRelay  = "relay"
+	FromHost   = "host"
+	FromClient = "client"
+)
+
+// JSON kinds a field can take. Payloads are Any: they're the room's
+// ciphertext, which the relay passes through untouched.
+const (
+	String = "string"
+	Number = "number"
+	Object = "object"
+	Bool   = "boolean"
+	Any    = "any"
+)
+
+// Schema is the shape of one frame type from one sender. Every frame is a
+// JSON object with a "type" string besides the fields listed here.
+type Schema struct {
+	Type     string            `json:"type"`
+	From     string            `json:"from"`
+	Since    int               `json:"since"`
+	Required map[string]string `json:"required,omitempty"` // field name to kind
+	Optional map[string]string `json:"optional,omitempty"`
+
+	// Open frames may carry other fields too: the relay forwards the
+	// host's JOIN_RESPONSE verbatim
+	Open bool `json:"open,omitempty"`
+}
+
+var schemas = []Schema{
+	// Sent by the relay
+	{Type: "ROOM_CREATED", From: FromRelay, Since: V1, Required: map[string]string{"roomId": String, "hostSecret": String}},
+	{Type: "CONNECTED", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String, "role": String, "clientSecret": String}},
+	{Type: "ERROR", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}, Optional: map[string]string{"retryAfterMs": Number, "quota": String}},
+	{Type: "HEARTBEAT_ACK", From: FromRelay, Since: V1},
+	{Type: "JOIN_REQUEST", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String, "role": String}, Optional: map[string]string{"payload": Any, "profile": Any}},
+	{Type: "JOIN_RESPONSE", From: FromRelay, Since: V1, Optional: map[string]string{"clientId": String, "payload": Any}, Open: true},
+	{Type: "JOIN_CONFIRM", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String}, Optional: map[string]string{"payload": Any}},
+	{Type: "MESSAGE", From: FromRelay, Since: V1, Optional: map[string]string{"clientId": String, "payload": Any}},
+	{Type: "CLIENT_MESSAGE", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String}, Optional: map[string]string{"payload": Any}},
+	{Type: "CLIENT_LEFT", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String}},
+	{Type: "CLIENT_RESUMED", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String, "role": String}},
+	{Type: "CLIENT_ERROR", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String, "category": String, "payload": Any}},
+	{Type: "KICKED", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}},
+	{Type: "ROOM_DESTROYED", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}},
+	{Type: "MEMORY_WARNING", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}},
+	{Type: "ROOM_STATS", From: FromRelay, Since: V1, Required: map[string]string{"payload": Object}},
+	{Type: "INVITE_CREATED", From: FromRelay, Since: V1, Required: map[string]string{"payload": Object}},
+	{Type: "INVITE_ERROR", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}},
+	{Type: "RATE_LIMITED", From: FromRelay, Since: V1, Required: map[string]string{"reason": String}, Optional: map[string]string{"retryAfterMs": Number, "quota": String}},
+	{Type: "COVER", From: FromRelay, Since: V1, Required: map[string]string{"payload": String}},
+	{Type: "JOIN_TIMEOUT", From: FromRelay, Since: V1},
+	{Type: "ROOM_CLOSING", From: FromRelay, Since: V1, Required: map[string]string{"graceMs": Number}},
+	{Type: "PROFILE", From: FromRelay, Since: V1, Required: map[string]string{"clientId": String, "profile": Any}},
+	{Type: "MIGRATE", From: FromRelay, Since: V1, Required: map[string]string{"resumeToken": String}, Optional: map[string]string{"url": String}},
+
+	// Sent by the host
+	{Type: "HEARTBEAT", From: FromHost, Since: V1},
+	{Type: "ROOM_OPEN", From: FromHost, Since: V1},
+	{Type: "BROADCAST", From: FromHost, Since: V1, Required: map[string]string{"payload": Any}},
+	{Type: "DIRECT", From: FromHost, Since: V1, Required: map[string]string{"clientId": String, "payload": Any}},
+	{Type: "JOIN_RESPONSE", From: FromHost, Since: V1, Required: map[string]string{"clientId": String}, Optional: map[string]string{"payload": Any, "approved": Bool}, Open: true},
+	{Type: "KICK", From: FromHost, Since: V1, Required: map[string]string{"clientId": String}},
+	{Type: "ROOM_STATS", From: FromHost, Since: V1},
+	{Type: "CREATE_INVITE", From: FromHost, Since: V1, Optional: map[string]string{"payload": Object}},
+	{Type: "ROOM_CLOSE", From: FromHost, Since: V1, Optional: map[string]string{"graceMs": Number}},
+
+	// Sent by a client
+	{Type: "JOIN_REQUEST", From: FromClient, Since: V1, Optional: map[string]string{"payload": Any, "profile": Any}},
+	{Type: "JOIN_CONFIRM", From: FromClient, Since: V1, Optional: map[string]string{"payload": Any}},
+	{Type: "MESSAGE", From: FromClient, Since: V1, Required: map[string]string{"payload": Any}},
+	{Type: "KICK", From: FromClient, Since: V1, Required: map[string]string{"clientId": String}},
+	{Type: "CLIENT_ERROR", From: FromClient, Since: V1, Required: map[string]string{"category": String}, Optional: map[string]string{"payload": Any}},
+}
+
+// Schemas returns every frame's schema in a protocol version, zero
+// meaning Latest
+func Schemas(version int) []Schema {
+	if version == 0 {
+		version = Latest
+	}
+	var out []Schema
+	for _, s := range schemas {
+		if s.Since <= version {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Validate checks a frame from the given sender against its schema in a
+// protocol version
+func Validate(version int, from string, data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("not a JSON object: %s", data)
+	}
+	var typ string
+	if err := json.Unmarshal(fields["type"], &typ); err != nil || typ == "" {
+		return fmt.Errorf("no type: %s", data)
+	}
+
+	i := slices.IndexFunc(Schemas(version), func(s Schema) bool { return s.From == from && s.Type == typ })
+	if i < 0 {
+		return fmt.Errorf("unknown %s frame %s", from, typ)
+	}
+	s := Schemas(version)[i]
+
+	for name, kind := range s.Required {
+		value, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("%s without %s: %s", typ, name, data)
+		}
+		if !isKind(value, kind) {
+			return fmt.Errorf("%s with %s not a %s: %s", typ, name, kind, data)
+		}
+	}
+	for name, value := range fields {
+		if _, ok := s.Required[name]; ok || name == "type" {
+			continue
+		}
+		kind, ok := s.Optional[name]
+		if !ok {
+			if s.Open {
+				continue
+			}
+			return fmt.Errorf("%s with unexpected field %s: %s", typ, name, data)
+		}
+		if !isKind(value, kind) {
+			return fmt.Errorf("%s with %s not a %s: %s", typ, name, kind, data)
+		}
+	}
+	return nil
+}
+
+func isKind(value json.RawMessage, kind string) bool {
+	var v any
+	if json.Unmarshal(value, &v) != nil {
+		return false
+	}
+	switch kind {
+	case String:
+		_, ok := v.(string)
+		return ok
+	case Number:
+		_, ok := v.(float64)
+		return ok
+	case Object:
+		_, ok := v.(map[string]any)
+		return ok
+	case Bool:
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
@@ -0,0 +1,603 @@
+// Package admin provides the operator API for the relay server.
+// It is mounted on the internal metrics listener and requires a bearer token.
+// Responses are anonymized: truncated room IDs and counts only, never
+// payloads or client addresses. The only addresses returned are the access
+// list entries operators put there themselves and the relay nodes' own
+// gossip addresses.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ephemeral/relay/internal/cluster"
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tenant"
+)
+
+// MaxAccessBodySize bounds the JSON body of an access list edit
+const MaxAccessBodySize = 256
+
+// MaxDrainBodySize bounds the JSON body of a drain request
+const MaxDrainBodySize = 1024
+
+// MaxKeyBodySize bounds the JSON body of an API key creation
+const MaxKeyBodySize = 256
+
+// MinRoomPrefix is the shortest room ID prefix a room can be destroyed
+// by: the truncated IDs the listing shows
+const MinRoomPrefix = 8
+
+// ReasonAdmin is the ROOM_DESTROYED reason for a room an operator ended
+const ReasonAdmin = "admin_destroyed"
+
+// Cluster is the cluster node the admin API drives, when there is one
+type Cluster interface {
+	// Drain moves every room to the node(s) behind target
+	Drain(target string) (rooms, clients int)
+	// Undrain takes new connections again
+	Undrain()
+	// Draining reports whether the node is refusing new connections
+	Draining() bool
+}
+
+// Fleet is the cluster membership the admin API reports on
+type Fleet interface {
+	// Peers returns every live node with the load it last reported
+	Peers() []cluster.Peer
+}
+
+// Handler serves the admin API
+type Handler struct {
+	token    string
+	registry *room.Registry
+	access   *ratelimit.AccessList
+	cluster  Cluster        // nil when standalone
+	fleet    Fleet          // nil without gossip
+	keys     *hostauth.Keys // nil unless hosts need API keys
+}
+
+// NewHandler creates a new admin handler.
+// An empty token disables the API entirely.
+func NewHandler(token string, registry *room.Registry, access *ratelimit.AccessList) *Handler {
+	return &Handler{
+		token:    token,
+		registry: registry,
+		access:   access,
+	}
+}
+
+// SetCluster enables the cluster endpoints
+func (h *Handler) SetCluster(c Cluster) {
+	h.cluster = c
+}
+
+// SetFleet enables the cluster status endpoint
+func (h *Handler) SetFleet(f Fleet) {
+	h.fleet = f
+}
+
+// SetHostKeys enables the API key endpoints, managing the keys hosts
+// must present
+func (h *Handler) SetHostKeys(keys *hostauth.Keys) {
+	h.keys = keys
+}
+
+// RoomSummary is one room in the listing
+type RoomSummary struct {
+	ID         string `json:"id"` // truncated
+	AgeSeconds int64  `json:"ageSeconds"`
+	Clients    int    `json:"clients"`
+	Open       bool   `json:"open"`
+}
+
+// RoomListResponse is the body of GET /admin/rooms
+type RoomListResponse struct {
+	RoomCount  int            `json:"roomCount"`
+	ClientSum  int            `json:"clientCount"`
+	AgeBuckets map[string]int `json:"ageBuckets"`
+	Rooms      []RoomSummary  `json:"rooms"`
+}
+
+// AccessListResponse is the body of GET /admin/access
+type AccessListResponse struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// AccessEditRequest is the body of POST /admin/access/{allow|deny}
+type AccessEditRequest struct {
+	Prefix string `json:"prefix"` // IP or CIDR
+}
+
+// DrainRequest is the body of POST /admin/drain
+type DrainRequest struct {
+	Target string `json:"target"` // ws:// or wss:// base URL; empty reconnects to the same address
+}
+
+// DrainResponse is what POST /admin/drain moved
+type DrainResponse struct {
+	Rooms   int `json:"rooms"`
+	Clients int `json:"clients"`
+}
+
+// DrainStatusResponse is the body of GET and DELETE /admin/drain
+type DrainStatusResponse struct {
+	Draining bool `json:"draining"`
+}
+
+// RoomDestroyResponse names the room DELETE /admin/rooms/{id} destroyed
+type RoomDestroyResponse struct {
+	ID string `json:"id"` // truncated
+}
+
+// NodeStatus is one node in the cluster status
+type NodeStatus struct {
+	Name           string `json:"name"`
+	Addr           string `json:"addr"`
+	Self           bool   `json:"self,omitempty"`
+	Draining       bool   `json:"draining,omitempty"`
+	Rooms          int    `json:"rooms"`
+	Connections    int    `json:"connections"`
+	MaxConnections int    `json:"maxConnections"` // 0 when unlimited
+	Headroom       *int   `json:"headroom"`       // null when unlimited
+}
+
+// ClusterStatusResponse is the body of GET /admin/cluster
+type ClusterStatusResponse struct {
+	NodeCount   int          `json:"nodeCount"`
+	Rooms       int          `json:"rooms"`
+	Connections int          `json:"connections"`
+	Headroom    *int         `json:"headroom"` // null if any node is unlimited
+	Nodes       []NodeStatus `json:"nodes"`
+}
+
+// HostKeyListResponse is the body of GET /admin/keys
+type HostKeyListResponse struct {
+	Keys []hostauth.Key `json:"keys"`
+}
+
+// HostKeyCreateRequest is the body of POST /admin/keys
+type HostKeyCreateRequest struct {
+	Name  string         `json:"name"`
+	Quota hostauth.Quota `json:"quota"` // zero fields leave the relay's limits in place
+}
+
+// HostKeyCreateResponse is a new key with its secret
+type HostKeyCreateResponse struct {
+	hostauth.Key
+	Secret string `json:"secret"` // shown this once
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// ageBuckets are the room age ranges reported, in ascending order
+var ageBuckets = []struct {
+	label string
+	max   time.Duration
+}{
+	{"lt_1m", time.Minute},
+	{"1m_10m", 10 * time.Minute},
+	{"10m_1h", time.Hour},
+	{"1h_24h", 24 * time.Hour},
+	{"gt_24h", 0}, // catch-all
+}
+
+// ServeHTTP authenticates and routes admin requests
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if h.token == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "admin API disabled"})
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="relay-admin"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "unauthorized"})
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/admin/rooms":
+		h.handleRooms(w, r)
+	case strings.HasPrefix(path, "/admin/rooms/"):
+		h.handleRoomDestroy(w, r)
+	case path == "/admin/access":
+		h.handleAccess(w, r)
+	case strings.HasPrefix(path, "/admin/access/"):
+		h.handleAccessEdit(w, r)
+	case path == "/admin/drain":
+		h.handleDrain(w, r)
+	case path == "/admin/cluster":
+		h.handleCluster(w, r)
+	case path == "/admin/keys":
+		h.handleKeys(w, r)
+	case strings.HasPrefix(path, "/admin/keys/"):
+		h.handleKeyRevoke(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "not found"})
+	}
+}
+
+// authorized checks the bearer token in constant time
+func (h *Handler) authorized(r *http.Request) bool {
+	return hasBearer(r, h.token)
+}
+
+// hasBearer reports whether r carries token as its bearer credential,
+// comparing in constant time
+func hasBearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	presented, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// RequireBearer wraps next so only requests bearing token reach it.
+// An empty token disables next entirely (404).
+func RequireBearer(token, realm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !hasBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleRooms handles GET /admin/rooms
+func (h *Handler) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	infos := h.registry.Snapshot()
+	now := time.Now()
+
+	resp := RoomListResponse{
+		RoomCount:  len(infos),
+		AgeBuckets: make(map[string]int, len(ageBuckets)),
+		Rooms:      make([]RoomSummary, 0, len(infos)),
+	}
+	for _, b := range ageBuckets {
+		resp.AgeBuckets[b.label] = 0
+	}
+
+	for _, info := range infos {
+		age := now.Sub(info.CreatedAt)
+		resp.AgeBuckets[ageBucket(age)]++
+		resp.ClientSum += info.Clients
+		resp.Rooms = append(resp.Rooms, RoomSummary{
+			ID:         info.ID,
+			AgeSeconds: int64(age.Seconds()),
+			Clients:    info.Clients,
+			Open:       info.IsOpen,
+		})
+	}
+
+	// Oldest first for a stable listing
+	sort.Slice(resp.Rooms, func(i, j int) bool {
+		return resp.Rooms[i].AgeSeconds > resp.Rooms[j].AgeSeconds
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRoomDestroy handles DELETE /admin/rooms/{id}, where the ID may be
+// the truncated one the listing shows. The room ends as if its host had
+// closed it; a prefix matching more than one room destroys none.
+func (h *Handler) handleRoomDestroy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/admin/rooms/")
+	if len(prefix) < MinRoomPrefix {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "room ID prefix too short"})
+		return
+	}
+
+	ids := h.registry.MatchPrefix(prefix)
+	switch len(ids) {
+	case 0:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "room not found"})
+		return
+	case 1:
+	default:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "room ID prefix is ambiguous"})
+		return
+	}
+
+	h.registry.DestroyRoom(ids[0], ReasonAdmin)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RoomDestroyResponse{ID: ids[0][:MinRoomPrefix]})
+}
+
+// handleAccess handles GET /admin/access
+func (h *Handler) handleAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	h.writeAccessLists(w)
+}
+
+// handleAccessEdit handles POST /admin/access/{allow|deny} with a JSON
+// {"prefix"} body, and DELETE /admin/access/{allow|deny}?prefix=...
+// Changes apply to the next request; open connections are not dropped.
+func (h *Handler) handleAccessEdit(w http.ResponseWriter, r *http.Request) {
+	list := ratelimit.List(strings.TrimPrefix(r.URL.Path, "/admin/access/"))
+	if list != ratelimit.ListAllow && list != ratelimit.ListDeny {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "not found"})
+		return
+	}
+
+	var raw string
+	switch r.Method {
+	case http.MethodPost:
+		var req AccessEditRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, MaxAccessBodySize)).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid request body"})
+			return
+		}
+		raw = req.Prefix
+	case http.MethodDelete:
+		raw = r.URL.Query().Get("prefix")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	prefix, err := ratelimit.ParsePrefix(raw)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = h.access.Add(list, prefix)
+	} else {
+		err = h.access.Remove(list, prefix)
+	}
+	switch {
+	case errors.Is(err, ratelimit.ErrAccessNotListed):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	h.writeAccessLists(w)
+}
+
+// handleDrain handles POST /admin/drain with a JSON {"target"} body. Every
+// room on this node is moved: hosts and clients are told to reconnect to
+// target with a resume token, and the node refuses new connections from
+// then on. It is meant to run just before the node is stopped.
+//
+// GET reports whether the node is draining, and DELETE takes it out of
+// drain mode, for a node that is staying up after all.
+func (h *Handler) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.cluster == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "not running in cluster mode"})
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		h.cluster.Undrain()
+		fallthrough
+	case http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(DrainStatusResponse{Draining: h.cluster.Draining()})
+		return
+	}
+
+	var req DrainRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxDrainBodySize)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if req.Target != "" {
+		target, err := url.Parse(req.Target)
+		if err != nil || (target.Scheme != "ws" && target.Scheme != "wss") || target.Host == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "target must be a ws:// or wss:// URL"})
+			return
+		}
+	}
+
+	var resp DrainResponse
+	resp.Rooms, resp.Clients = h.cluster.Drain(req.Target)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleCluster handles GET /admin/cluster: every node's load as last
+// gossiped, which lags by up to cluster.GossipRefresh, and the totals
+func (h *Handler) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.fleet == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "peer discovery not enabled"})
+		return
+	}
+
+	peers := h.fleet.Peers()
+	resp := ClusterStatusResponse{
+		NodeCount: len(peers),
+		Nodes:     make([]NodeStatus, 0, len(peers)),
+	}
+	total, limited := 0, true
+	for _, p := range peers {
+		node := NodeStatus{
+			Name:           p.Name,
+			Addr:           p.Addr,
+			Self:           p.Self,
+			Draining:       p.Load.Draining,
+			Rooms:          p.Load.Rooms,
+			Connections:    p.Load.Connections,
+			MaxConnections: p.Load.MaxConnections,
+		}
+		if headroom, ok := p.Load.Headroom(); ok {
+			node.Headroom = &headroom
+			total += headroom
+		} else {
+			limited = false
+		}
+		resp.Rooms += node.Rooms
+		resp.Connections += node.Connections
+		resp.Nodes = append(resp.Nodes, node)
+	}
+	if limited {
+		resp.Headroom = &total
+	}
+
+	sort.Slice(resp.Nodes, func(i, j int) bool {
+		return resp.Nodes[i].Name < resp.Nodes[j].Name
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) writeAccessLists(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AccessListResponse{
+		Allow: h.access.Entries(ratelimit.ListAllow),
+		Deny:  h.access.Entries(ratelimit.ListDeny),
+	})
+}
+
+func ageBucket(age time.Duration) string {
+	for _, b := range ageBuckets {
+		if b.max == 0 || age < b.max {
+			return b.label
+		}
+	}
+	return ageBuckets[len(ageBuckets)-1].label
+}
+
+// handleKeys handles GET /admin/keys, listing the API keys allowed to
+// host, and POST /admin/keys with a JSON {"name"} body, which mints one.
+// A key's secret is in the creation response only; the relay keeps its
+// hash.
+func (h *Handler) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.keys == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "host API keys not enabled"})
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(HostKeyListResponse{Keys: h.keys.List()})
+		return
+	}
+
+	var req HostKeyCreateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxKeyBodySize)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "name required"})
+		return
+	}
+	if err := tenant.Validate(req.Quota); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	secret, key, err := h.keys.Create(req.Name, req.Quota)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "failed to create key"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HostKeyCreateResponse{Key: key, Secret: secret})
+}
+
+// handleKeyRevoke handles DELETE /admin/keys/{id}. Rooms the key created
+// live on; it just can't create more.
+func (h *Handler) handleKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+	if h.keys == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "host API keys not enabled"})
+		return
+	}
+	err := h.keys.Revoke(strings.TrimPrefix(r.URL.Path, "/admin/keys/"))
+	switch {
+	case errors.Is(err, hostauth.ErrKeyNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HostKeyListResponse{Keys: h.keys.List()})
+}
@@ -0,0 +1,383 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/cluster"
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/gorilla/websocket"
+)
+
+const testRoomID = "admin-test-room-abcdefghijklmnopqrstuvwxyz0"
+
+func newTestHandler(t *testing.T, token string) (*Handler, *room.Registry) {
+	t.Helper()
+	registry := room.NewRegistry()
+	rm, err := registry.CreateRoom(testRoomID, &websocket.Conn{})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	rm.OpenRoom()
+	rm.AddClient("client1", &websocket.Conn{})
+	return NewHandler(token, registry, ratelimit.NewAccessList()), registry
+}
+
+// TestAdminRequiresToken verifies requests without the bearer token are rejected
+func TestAdminRequiresToken(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	for _, auth := range []string{"", "Bearer wrong", "secret-token", "Basic secret-token"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/rooms", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, rec.Code)
+		}
+	}
+}
+
+// TestAdminDisabledWithoutToken verifies the API is off when no token is configured
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	h, _ := newTestHandler(t, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/rooms", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when disabled, got %d", rec.Code)
+	}
+}
+
+// TestAdminRoomListingAnonymized verifies the listing exposes truncated IDs and counts only
+func TestAdminRoomListingAnonymized(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/rooms", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	var resp RoomListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if resp.RoomCount != 1 || len(resp.Rooms) != 1 {
+		t.Fatalf("Expected 1 room, got %d", resp.RoomCount)
+	}
+	if resp.Rooms[0].ID != testRoomID[:8] {
+		t.Errorf("Room ID should be truncated to 8 chars, got %q", resp.Rooms[0].ID)
+	}
+	if resp.Rooms[0].Clients != 1 || !resp.Rooms[0].Open {
+		t.Errorf("Unexpected room summary: %+v", resp.Rooms[0])
+	}
+	if resp.AgeBuckets["lt_1m"] != 1 {
+		t.Errorf("New room should be in lt_1m bucket: %v", resp.AgeBuckets)
+	}
+}
+
+// TestAdminAccessListEdits verifies prefixes can be listed, added and removed at runtime
+func TestAdminAccessListEdits(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	do := func(method, path, body string) (*httptest.ResponseRecorder, AccessListResponse) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp AccessListResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec, resp
+	}
+
+	rec, resp := do(http.MethodPost, "/admin/access/deny", `{"prefix":"198.51.100.7/24"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding deny entry, got %d", rec.Code)
+	}
+	if len(resp.Deny) != 1 || resp.Deny[0] != "198.51.100.0/24" {
+		t.Errorf("Expected masked prefix on deny list, got %v", resp.Deny)
+	}
+	if h.access.Check("198.51.100.9") != ratelimit.VerdictDeny {
+		t.Error("Denied prefix should take effect immediately")
+	}
+
+	if rec, _ := do(http.MethodPost, "/admin/access/deny", `{"prefix":"not-an-ip"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad prefix, got %d", rec.Code)
+	}
+	if rec, _ := do(http.MethodPost, "/admin/access/other", `{"prefix":"10.0.0.1"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown list, got %d", rec.Code)
+	}
+
+	if rec, _ := do(http.MethodDelete, "/admin/access/deny?prefix=198.51.100.0/24", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 removing deny entry, got %d", rec.Code)
+	}
+	if rec, _ := do(http.MethodDelete, "/admin/access/deny?prefix=198.51.100.0/24", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 removing an unlisted prefix, got %d", rec.Code)
+	}
+
+	if _, resp := do(http.MethodGet, "/admin/access", ""); len(resp.Allow) != 0 || len(resp.Deny) != 0 {
+		t.Errorf("Expected empty lists, got %+v", resp)
+	}
+}
+
+// TestAdminHostKeys verifies keys are minted with their secret shown once,
+// listed without it, and revoked, and static keys stay
+func TestAdminHostKeys(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/admin/keys", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without host keys, got %d", rec.Code)
+	}
+
+	keys := hostauth.NewKeys()
+	static, _ := keys.AddStatic("app", "static-secret", hostauth.Quota{})
+	h.SetHostKeys(keys)
+
+	if rec := do(http.MethodPost, "/admin/keys", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a key without a name, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/admin/keys", `{"name":"ci"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 creating a key, got %d", rec.Code)
+	}
+	var created HostKeyCreateResponse
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.Name != "ci" || created.ID == "" {
+		t.Errorf("Expected the new key described, got %+v", created)
+	}
+	if err := keys.AuthorizeHost(created.Secret); err != nil {
+		t.Errorf("Expected the returned secret to host, got %v", err)
+	}
+
+	rec = do(http.MethodGet, "/admin/keys", "")
+	if strings.Contains(rec.Body.String(), created.Secret) {
+		t.Error("Listing must not include secrets")
+	}
+	var list HostKeyListResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Keys) != 2 {
+		t.Errorf("Expected 2 keys listed, got %+v", list.Keys)
+	}
+
+	if rec := do(http.MethodDelete, "/admin/keys/"+created.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 revoking, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/keys/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking twice, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/keys/"+static.ID, ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 revoking a static key, got %d", rec.Code)
+	}
+}
+
+// fakeCluster records drains
+type fakeCluster struct {
+	target   string
+	draining bool
+}
+
+func (c *fakeCluster) Drain(target string) (int, int) {
+	c.target = target
+	c.draining = true
+	return 2, 5
+}
+
+func (c *fakeCluster) Undrain()       { c.draining = false }
+func (c *fakeCluster) Draining() bool { return c.draining }
+
+// TestAdminDrain verifies the drain endpoint needs cluster mode and a
+// WebSocket target, and reports what it moved
+func TestAdminDrain(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	do := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/drain", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(`{"target":"wss://relay-2.example"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without cluster mode, got %d", rec.Code)
+	}
+
+	cluster := &fakeCluster{}
+	h.SetCluster(cluster)
+	for _, bad := range []string{`{"target":"https://relay-2.example"}`, `{"target":"wss://"}`, `not json`} {
+		if rec := do(bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", bad, rec.Code)
+		}
+	}
+	if cluster.target != "" {
+		t.Error("Expected a bad request not to drain")
+	}
+
+	rec := do(`{"target":"wss://relay-2.example"}`)
+	var resp DrainResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Rooms != 2 || resp.Clients != 5 {
+		t.Errorf("Expected 200 with the drained counts, got %d %+v", rec.Code, resp)
+	}
+	if cluster.target != "wss://relay-2.example" {
+		t.Errorf("Expected the target to be passed on, got %q", cluster.target)
+	}
+
+	for _, step := range []struct {
+		method   string
+		draining bool
+	}{{http.MethodGet, true}, {http.MethodDelete, false}, {http.MethodGet, false}} {
+		req := httptest.NewRequest(step.method, "/admin/drain", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var status DrainStatusResponse
+		json.NewDecoder(rec.Body).Decode(&status)
+		if rec.Code != http.StatusOK || status.Draining != step.draining {
+			t.Errorf("Expected %s to report draining=%v, got %d %+v", step.method, step.draining, rec.Code, status)
+		}
+	}
+}
+
+// TestAdminDestroyRoom verifies a room is destroyed by its truncated ID,
+// and that short, unknown and ambiguous prefixes destroy nothing
+func TestAdminDestroyRoom(t *testing.T) {
+	h, registry := newTestHandler(t, "secret-token")
+	if _, err := registry.CreateRoom("admin-test-other", &websocket.Conn{}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	del := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/rooms/"+id, nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for prefix, code := range map[string]int{
+		"admin":           http.StatusBadRequest,
+		"admin-te":        http.StatusConflict,
+		"nosuchroom":      http.StatusNotFound,
+		testRoomID + "xx": http.StatusNotFound,
+	} {
+		if rec := del(prefix); rec.Code != code {
+			t.Errorf("Expected %d for %q, got %d", code, prefix, rec.Code)
+		}
+	}
+	if registry.RoomCount() != 2 {
+		t.Fatalf("Expected both rooms to survive bad requests, got %d", registry.RoomCount())
+	}
+
+	rec := del("admin-test-room")
+	var resp RoomDestroyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.ID != testRoomID[:MinRoomPrefix] {
+		t.Errorf("Expected 200 naming the truncated room, got %d %+v", rec.Code, resp)
+	}
+	if registry.GetRoom(testRoomID) != nil || registry.GetRoom("admin-test-other") == nil {
+		t.Error("Expected only the matching room to be destroyed")
+	}
+}
+
+// fakeFleet reports fixed peers
+type fakeFleet []cluster.Peer
+
+func (f fakeFleet) Peers() []cluster.Peer { return f }
+
+// TestAdminClusterStatus verifies the fleet's load is listed per node and
+// totalled, with headroom left open once any node is unlimited
+func TestAdminClusterStatus(t *testing.T) {
+	h, _ := newTestHandler(t, "secret-token")
+
+	get := func() (*httptest.ResponseRecorder, ClusterStatusResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/cluster", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp ClusterStatusResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec, resp
+	}
+
+	if rec, _ := get(); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without peer discovery, got %d", rec.Code)
+	}
+
+	fleet := fakeFleet{
+		{Name: "node-b", Addr: "10.0.0.2:7946", Load: cluster.Load{Rooms: 3, Connections: 40, MaxConnections: 100}},
+		{Name: "node-a", Addr: "10.0.0.1:7946", Self: true, Load: cluster.Load{Rooms: 1, Connections: 5, MaxConnections: 50}},
+		{Name: "node-c", Addr: "10.0.0.3:7946", Load: cluster.Load{Connections: 2, MaxConnections: 100, Draining: true}},
+	}
+	h.SetFleet(fleet)
+	rec, resp := get()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if resp.NodeCount != 3 || resp.Rooms != 4 || resp.Connections != 47 {
+		t.Errorf("Expected 3 nodes, 4 rooms and 47 connections, got %+v", resp)
+	}
+	if resp.Headroom == nil || *resp.Headroom != 105 {
+		t.Errorf("Expected headroom 105, got %v", resp.Headroom)
+	}
+	if resp.Nodes[0].Name != "node-a" || !resp.Nodes[0].Self || !resp.Nodes[2].Draining {
+		t.Errorf("Expected nodes sorted by name with self and draining marked, got %+v", resp.Nodes)
+	}
+
+	h.SetFleet(append(fleet, cluster.Peer{Name: "node-d", Load: cluster.Load{Connections: 1}}))
+	if _, resp := get(); resp.Headroom != nil || resp.Nodes[3].Headroom != nil {
+		t.Errorf("Expected an unlimited node to leave headroom open, got %+v", resp)
+	}
+}
+
+// TestProfilerRequiresToken verifies pprof is off without a token and gated with one
+func TestProfilerRequiresToken(t *testing.T) {
+	get := func(h http.Handler, auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get(NewProfiler(""), "Bearer "); code != http.StatusNotFound {
+		t.Errorf("Expected 404 when disabled, got %d", code)
+	}
+
+	h := NewProfiler("profile-token")
+	if code := get(h, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", code)
+	}
+	if code := get(h, "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", code)
+	}
+	if code := get(h, "Bearer profile-token"); code != http.StatusOK {
+		t.Errorf("Expected 200 with token, got %d", code)
+	}
+}
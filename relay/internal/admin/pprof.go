@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// NewProfiler serves the net/http/pprof endpoints under /debug/pprof/ for
+// capturing CPU and heap profiles in production. It is meant for the
+// internal metrics listener and answers only requests bearing token; an
+// empty token disables it.
+func NewProfiler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return RequireBearer(token, "relay-pprof", mux)
+}
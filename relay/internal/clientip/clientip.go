@@ -0,0 +1,131 @@
+// Package clientip resolves the address a request really came from.
+// Forwarding headers are only believed when the direct peer is a
+// configured trusted proxy; otherwise anyone could spoof them to dodge
+// per-IP rate limits.
+package clientip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Errors
+var (
+	ErrInvalidProxy = errors.New("invalid trusted proxy (want IP or CIDR)")
+)
+
+// Resolver extracts client IPs. A nil Resolver trusts no proxies.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a resolver that believes forwarding headers only
+// from peers inside the trusted prefixes
+func NewResolver(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// ParseTrusted parses a comma-separated list of IPs and CIDRs
+func ParseTrusted(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, ErrInvalidProxy
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, ErrInvalidProxy
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Trusted reports whether addr is a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	if r == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type anonymousKey struct{}
+
+// Anonymous marks ctx as a connection's whose peer has no address of its
+// own, as on a Tor onion service, where every peer arrives from the local
+// daemon. Set it from http.Server.ConnContext.
+func Anonymous(ctx context.Context) context.Context {
+	return context.WithValue(ctx, anonymousKey{}, true)
+}
+
+// ClientIP returns the client address for a request.
+// With an untrusted peer this is always RemoteAddr. Behind trusted proxies,
+// X-Forwarded-For is walked from the right, skipping trusted hops, so the
+// first address no trusted proxy vouches for wins; X-Real-IP is the fallback.
+// A request on an Anonymous connection has no address, and gets "": per-IP
+// limits can't tell its peers apart and must not be applied to it.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	if req.Context().Value(anonymousKey{}) != nil {
+		return ""
+	}
+	peer := remoteAddr(req.RemoteAddr)
+	if !peer.IsValid() || !r.Trusted(peer) {
+		return hostOnly(req.RemoteAddr)
+	}
+
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break // garbage from here leftwards can't be trusted
+			}
+			if !r.Trusted(addr) || i == 0 {
+				return addr.Unmap().String()
+			}
+		}
+	}
+
+	if xri := strings.TrimSpace(req.Header.Get("X-Real-IP")); xri != "" {
+		if addr, err := netip.ParseAddr(xri); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+
+	return peer.String()
+}
+
+func remoteAddr(remote string) netip.Addr {
+	addr, err := netip.ParseAddr(hostOnly(remote))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// hostOnly strips the port from host:port, handling bracketed IPv6
+func hostOnly(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
@@ -0,0 +1,83 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// TestClientIP covers spoofing, trusted chains and header fallbacks
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("ParseTrusted failed: %v", err)
+	}
+	r := NewResolver(trusted)
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		xri    string
+		want   string
+	}{
+		{"untrusted peer ignores XFF", "203.0.113.9:5000", "1.2.3.4", "", "203.0.113.9"},
+		{"untrusted peer ignores X-Real-IP", "203.0.113.9:5000", "", "1.2.3.4", "203.0.113.9"},
+		{"trusted peer uses XFF", "10.1.2.3:5000", "198.51.100.7", "", "198.51.100.7"},
+		{"spoofed prefix is skipped", "10.1.2.3:5000", "6.6.6.6, 198.51.100.7", "", "198.51.100.7"},
+		{"trusted hops are skipped", "10.1.2.3:5000", "198.51.100.7, 192.168.1.1, 10.9.9.9", "", "198.51.100.7"},
+		{"all hops trusted takes leftmost", "10.1.2.3:5000", "10.0.0.5, 10.0.0.6", "", "10.0.0.5"},
+		{"trusted peer falls back to X-Real-IP", "192.168.1.1:5000", "", "198.51.100.8", "198.51.100.8"},
+		{"trusted peer without headers", "10.1.2.3:5000", "", "", "10.1.2.3"},
+		{"IPv6 remote", "[2001:db8::1]:5000", "1.2.3.4", "", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.xri != "" {
+			req.Header.Set("X-Real-IP", tt.xri)
+		}
+		if got := r.ClientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+// TestNilResolverTrustsNoOne verifies the zero configuration ignores headers
+func TestNilResolverTrustsNoOne(t *testing.T) {
+	var r *Resolver
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	if got := r.ClientIP(req); got != "10.1.2.3" {
+		t.Errorf("Expected RemoteAddr, got %s", got)
+	}
+}
+
+// TestParseTrustedRejectsGarbage verifies bad entries fail loudly
+func TestParseTrustedRejectsGarbage(t *testing.T) {
+	for _, list := range []string{"not-an-ip", "10.0.0.0/99", "10.0.0.1,,bogus"} {
+		if _, err := ParseTrusted(list); err != ErrInvalidProxy {
+			t.Errorf("%q: expected ErrInvalidProxy, got %v", list, err)
+		}
+	}
+}
+
+// TestAnonymousHasNoAddress verifies an onion connection's requests resolve
+// to no address, whatever they claim
+func TestAnonymousHasNoAddress(t *testing.T) {
+	r := NewResolver([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req = req.WithContext(Anonymous(req.Context()))
+
+	if got := r.ClientIP(req); got != "" {
+		t.Errorf("Expected no address, got %s", got)
+	}
+}
@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis layout
+const (
+	DefaultRedisPrefix = "relay:cluster:"
+	PublishTimeout     = time.Second // Per-publish deadline
+)
+
+// Backplane is a publish/subscribe bus shared by the relay nodes of one
+// cluster. Delivery is best effort and at most once, like the relay's own
+// send buffers; a node receives its own publications too.
+type Backplane interface {
+	// Publish sends data to every subscriber of channel
+	Publish(channel string, data []byte) error
+	// Subscribe calls fn with each message on channel until the
+	// subscription is cancelled. Calls for one channel are sequential.
+	Subscribe(channel string, fn func(data []byte)) (Subscription, error)
+	// Close cancels every subscription and releases the connection
+	Close() error
+}
+
+// Subscription is a live Subscribe
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// RedisBackplane is a Backplane over Redis pub/sub. All subscriptions
+// share one connection; Redis keeps nothing once a message is delivered.
+type RedisBackplane struct {
+	client *redis.Client
+	prefix string
+	pubsub *redis.PubSub
+
+	mu       sync.RWMutex
+	handlers map[string]func([]byte) // by full channel name
+
+	done chan struct{}
+}
+
+// NewRedisBackplane creates a backplane on client, naming channels under
+// prefix. The backplane owns the client and closes it on Close.
+func NewRedisBackplane(client *redis.Client, prefix string) *RedisBackplane {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	b := &RedisBackplane{
+		client:   client,
+		prefix:   prefix,
+		pubsub:   client.Subscribe(context.Background()),
+		handlers: make(map[string]func([]byte)),
+		done:     make(chan struct{}),
+	}
+	go b.dispatch()
+	return b
+}
+
+// Publish sends data to channel
+func (b *RedisBackplane) Publish(channel string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return b.client.Publish(ctx, b.prefix+channel, data).Err()
+}
+
+// Subscribe starts delivering channel to fn, replacing any earlier handler
+func (b *RedisBackplane) Subscribe(channel string, fn func([]byte)) (Subscription, error) {
+	name := b.prefix + channel
+
+	b.mu.Lock()
+	b.handlers[name] = fn
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	if err := b.pubsub.Subscribe(ctx, name); err != nil {
+		b.mu.Lock()
+		delete(b.handlers, name)
+		b.mu.Unlock()
+		return nil, err
+	}
+	return redisSubscription{b, name}, nil
+}
+
+// Close stops delivery and closes the Redis client
+func (b *RedisBackplane) Close() error {
+	err := b.pubsub.Close()
+	<-b.done
+	b.client.Close()
+	return err
+}
+
+// dispatch hands each message to its channel's handler. One goroutine
+// serves every channel, so handlers must not block for long.
+func (b *RedisBackplane) dispatch() {
+	defer close(b.done)
+	for msg := range b.pubsub.Channel() {
+		b.mu.RLock()
+		fn := b.handlers[msg.Channel]
+		b.mu.RUnlock()
+		if fn != nil {
+			fn([]byte(msg.Payload))
+		}
+	}
+}
+
+type redisSubscription struct {
+	b    *RedisBackplane
+	name string
+}
+
+func (s redisSubscription) Unsubscribe() error {
+	s.b.mu.Lock()
+	delete(s.b.handlers, s.name)
+	s.b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return s.b.pubsub.Unsubscribe(ctx, s.name)
+}
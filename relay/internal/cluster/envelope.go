@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Envelope kinds. The first group travels on the shared rooms channel,
+// the second on a room's own channel and the third on a node's own
+// channel. Later kinds are added at the end, on whichever channel, so
+// nodes of different versions agree on the numbering during a deploy.
+const (
+	kindHello  byte = iota + 1 // a node started and wants announcements now
+	kindHosted                 // Client: room options; Data: room hash; host here, not open for joins
+	kindOpen                   // Client: room options; Data: room hash; host here, open for joins
+	kindGone                   // Data: room hash; room destroyed
+
+	kindToHost    // Data: frame for the host
+	kindBroadcast // Client: sender to skip; Data: frame
+	kindDirect    // Client: recipient; Data: frame
+	kindKick      // Client: member to remove
+	kindDestroy   // Data: reason
+	kindConsume   // Client: request ID; Data: consumeRequest
+	kindRestore   // Data: token ID
+
+	kindConsumed // Client: request ID; Data: consumeReply
+
+	kindResume  // rooms channel; Client: resume token hash; Data: grantMessage
+	kindResumed // rooms channel; Client: resume token hash; token spent
+
+	kindApprove // Client: member the host accepted
+	kindProfile // Client: member; Data: its PROFILE frame, empty once it left
+	kindClosing // rooms channel; Data: room hash; host here, in its closing countdown
+
+	kindHostCall  // node or rooms channel; Client: request ID; Data: hostCallRequest
+	kindHostReply // Client: request ID; Data: invite.HostReply
+)
+
+var (
+	errBadEnvelope = errors.New("malformed cluster envelope")
+	errIDTooLong   = errors.New("cluster envelope ID over 255 bytes")
+)
+
+// envelope is one backplane message: a kind, the publishing node so it can
+// skip its own messages, an optional client ID and an opaque frame
+type envelope struct {
+	Kind   byte
+	Node   string
+	Client string
+	Data   []byte
+}
+
+// marshal encodes the envelope as kind, two length-prefixed strings and
+// the data. Node and client IDs are short, so one length byte suffices;
+// a longer one, which only a misbehaving peer could name, is refused
+// rather than truncated into another ID.
+func (e envelope) marshal() ([]byte, error) {
+	if len(e.Node) > 255 || len(e.Client) > 255 {
+		return nil, errIDTooLong
+	}
+	b := make([]byte, 0, 3+len(e.Node)+len(e.Client)+len(e.Data))
+	b = append(b, e.Kind, byte(len(e.Node)))
+	b = append(b, e.Node...)
+	b = append(b, byte(len(e.Client)))
+	b = append(b, e.Client...)
+	return append(b, e.Data...), nil
+}
+
+func unmarshalEnvelope(b []byte) (envelope, error) {
+	var e envelope
+	if len(b) < 2 {
+		return e, errBadEnvelope
+	}
+	e.Kind = b[0]
+	n := int(b[1])
+	b = b[2:]
+	if len(b) < n+1 {
+		return e, errBadEnvelope
+	}
+	e.Node = string(b[:n])
+	b = b[n:]
+
+	n = int(b[0])
+	b = b[1:]
+	if len(b) < n {
+		return e, errBadEnvelope
+	}
+	e.Client = string(b[:n])
+	e.Data = b[n:]
+	return e, nil
+}
+
+// roomHash names a room on the backplane. Room IDs carry 256 bits of
+// entropy, so the digest can't be reversed to join the room.
+func roomHash(roomID string) string {
+	sum := sha256.Sum256([]byte(roomID))
+	return hex.EncodeToString(sum[:])
+}
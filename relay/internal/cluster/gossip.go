@@ -0,0 +1,270 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Gossip timing
+const (
+	DefaultGossipPort = 7946
+	// GossipRefresh is how often a node re-gossips its load
+	GossipRefresh = 5 * time.Second
+	// GossipRejoin is how often a node that has no peers retries its seeds
+	GossipRejoin = 10 * time.Second
+)
+
+// Load is what a node tells its peers about itself
+type Load struct {
+	Rooms          int  `json:"rooms"` // hosted here; proxies don't count
+	Connections    int  `json:"connections"`
+	MaxConnections int  `json:"maxConnections"` // 0 when unlimited
+	Draining       bool `json:"draining,omitempty"`
+}
+
+// Headroom returns how many more connections the node takes, and false
+// if it has no limit. A draining node takes none.
+func (l Load) Headroom() (int, bool) {
+	switch {
+	case l.Draining:
+		return 0, true
+	case l.MaxConnections == 0:
+		return 0, false
+	}
+	return max(l.MaxConnections-l.Connections, 0), true
+}
+
+// Peer is one member of the gossip cluster, this node included
+type Peer struct {
+	Name string
+	Addr string
+	Load Load
+	Self bool
+}
+
+// GossipConfig configures StartGossip
+type GossipConfig struct {
+	Name      string   // unique per node, e.g. the cluster node ID; empty picks a random one
+	Bind      string   // host:port to gossip on
+	Advertise string   // host:port peers should dial, if not Bind
+	Seeds     []string // any existing members, host or host:port; a DNS name joins every address it resolves to
+	Key       []byte   // 16, 24 or 32 byte AES key sealing gossip; nil sends it in the clear
+
+	Load    func() Load       // reports this node's load; nil reports none
+	OnLeave func(name string) // a peer left or was declared dead
+}
+
+// Gossip finds the other relay nodes over SWIM-style gossip, so only a
+// seed (typically one DNS name for the whole fleet) needs configuring.
+// Each node's load rides along as its metadata. No room or client state
+// is gossiped.
+type Gossip struct {
+	cfg  GossipConfig
+	list *memberlist.Memberlist
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// StartGossip binds the gossip listener and joins whichever seeds answer.
+// Unreachable seeds are retried in the background.
+func StartGossip(cfg GossipConfig) (*Gossip, error) {
+	if cfg.Name == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		cfg.Name = hex.EncodeToString(id)
+	}
+
+	mc := memberlist.DefaultLANConfig()
+	mc.Name = cfg.Name
+	mc.SecretKey = cfg.Key
+	// memberlist logs peer addresses at debug level; keep them out
+	mc.LogOutput = io.Discard
+
+	var err error
+	if mc.BindAddr, mc.BindPort, err = splitHostPort(cfg.Bind); err != nil {
+		return nil, err
+	}
+	mc.AdvertiseAddr, mc.AdvertisePort = mc.BindAddr, mc.BindPort
+	if cfg.Advertise != "" {
+		if mc.AdvertiseAddr, mc.AdvertisePort, err = splitHostPort(cfg.Advertise); err != nil {
+			return nil, err
+		}
+	}
+	if mc.AdvertiseAddr == "0.0.0.0" || mc.AdvertiseAddr == "" {
+		// Let memberlist pick a private interface address
+		mc.AdvertiseAddr = ""
+	}
+
+	g := &Gossip{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	mc.Delegate = gossipDelegate{g}
+	mc.Events = gossipEvents{g}
+	if g.list, err = memberlist.Create(mc); err != nil {
+		return nil, err
+	}
+	g.join()
+
+	go g.run()
+	return g, nil
+}
+
+// splitHostPort parses host:port, defaulting the port
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	if portStr == "" {
+		return host, DefaultGossipPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	return host, port, err
+}
+
+// join contacts the seeds, returning how many answered
+func (g *Gossip) join() int {
+	if len(g.cfg.Seeds) == 0 {
+		return 0
+	}
+	n, err := g.list.Join(g.cfg.Seeds)
+	if err != nil && n == 0 {
+		log.Printf("Gossip: no seed reachable yet: %v", err)
+	}
+	return n
+}
+
+// run refreshes this node's load and retries the seeds while alone
+func (g *Gossip) run() {
+	defer close(g.done)
+
+	refresh := time.NewTicker(GossipRefresh)
+	defer refresh.Stop()
+	rejoin := time.NewTicker(GossipRejoin)
+	defer rejoin.Stop()
+
+	for {
+		select {
+		case <-refresh.C:
+			g.list.UpdateNode(GossipRefresh)
+		case <-rejoin.C:
+			if g.list.NumMembers() < 2 {
+				g.join()
+			}
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// Addr returns the address peers reach this node on
+func (g *Gossip) Addr() string {
+	node := g.list.LocalNode()
+	return net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+}
+
+// Peers returns every live member with the load it last reported
+func (g *Gossip) Peers() []Peer {
+	self := g.list.LocalNode().Name
+	members := g.list.Members()
+
+	peers := make([]Peer, 0, len(members))
+	for _, m := range members {
+		p := Peer{
+			Name: m.Name,
+			Addr: net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))),
+			Self: m.Name == self,
+		}
+		json.Unmarshal(m.Meta, &p.Load)
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Capacity sums the load reported by every live member.
+// MaxConnections is 0 if any member is unlimited.
+func (g *Gossip) Capacity() Load {
+	var total Load
+	unlimited := false
+	for _, p := range g.Peers() {
+		total.Rooms += p.Load.Rooms
+		total.Connections += p.Load.Connections
+		total.MaxConnections += p.Load.MaxConnections
+		unlimited = unlimited || p.Load.MaxConnections == 0
+	}
+	if unlimited {
+		total.MaxConnections = 0
+	}
+	return total
+}
+
+// Close announces this node's departure and stops gossiping
+func (g *Gossip) Close() error {
+	g.stopOnce.Do(func() { close(g.stop) })
+	<-g.done
+	g.list.Leave(time.Second)
+	return g.list.Shutdown()
+}
+
+// gossipDelegate supplies this node's metadata; gossip carries nothing else
+type gossipDelegate struct{ g *Gossip }
+
+func (d gossipDelegate) NodeMeta(limit int) []byte {
+	if d.g.cfg.Load == nil {
+		return nil
+	}
+	meta, err := json.Marshal(d.g.cfg.Load())
+	if err != nil || len(meta) > limit {
+		return nil
+	}
+	return meta
+}
+
+func (gossipDelegate) NotifyMsg([]byte)                           {}
+func (gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (gossipDelegate) LocalState(join bool) []byte                { return nil }
+func (gossipDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// gossipEvents reports membership changes
+type gossipEvents struct{ g *Gossip }
+
+func (e gossipEvents) NotifyJoin(node *memberlist.Node) {
+	if node.Name != e.g.cfg.Name {
+		log.Printf("Gossip: peer joined: %s...", truncate(node.Name))
+	}
+}
+
+func (e gossipEvents) NotifyLeave(node *memberlist.Node) {
+	if node.Name == e.g.cfg.Name {
+		return
+	}
+	log.Printf("Gossip: peer left: %s...", truncate(node.Name))
+	if e.g.cfg.OnLeave != nil {
+		// Off memberlist's goroutine: the callback may tear down rooms
+		go e.g.cfg.OnLeave(node.Name)
+	}
+}
+
+func (gossipEvents) NotifyUpdate(*memberlist.Node) {}
+
+func truncate(name string) string {
+	if len(name) > 8 {
+		return name[:8]
+	}
+	return name
+}
@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+// startTestGossip starts a member on a random loopback port
+func startTestGossip(t *testing.T, name string, load Load, seeds []string, onLeave func(string)) *Gossip {
+	t.Helper()
+	g, err := StartGossip(GossipConfig{
+		Name:    name,
+		Bind:    "127.0.0.1:0",
+		Seeds:   seeds,
+		Key:     []byte("0123456789abcdef"),
+		Load:    func() Load { return load },
+		OnLeave: onLeave,
+	})
+	if err != nil {
+		t.Fatalf("StartGossip failed: %v", err)
+	}
+	return g
+}
+
+// TestGossipDiscovery verifies members find each other through a seed,
+// see each other's load and hear when one leaves
+func TestGossipDiscovery(t *testing.T) {
+	left := make(chan string, 1)
+	a := startTestGossip(t, "node-a", Load{Rooms: 2, Connections: 10, MaxConnections: 100}, nil, func(name string) { left <- name })
+	defer a.Close()
+	b := startTestGossip(t, "node-b", Load{Rooms: 3, Connections: 5, MaxConnections: 50}, []string{a.Addr()}, nil)
+
+	eventually(t, "both members", func() bool { return len(a.Peers()) == 2 && len(b.Peers()) == 2 })
+
+	for _, p := range b.Peers() {
+		if p.Self != (p.Name == "node-b") {
+			t.Errorf("Expected only node-b to be self, got %+v", p)
+		}
+	}
+	want := Load{Rooms: 5, Connections: 15, MaxConnections: 150}
+	if got := a.Capacity(); got != want {
+		t.Errorf("Expected capacity %+v, got %+v", want, got)
+	}
+
+	b.Close()
+	select {
+	case name := <-left:
+		if name != "node-b" {
+			t.Errorf("Expected node-b to leave, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the leave")
+	}
+}
+
+// TestGossipUnlimitedCapacity verifies one unlimited member makes the
+// cluster unlimited
+func TestGossipUnlimitedCapacity(t *testing.T) {
+	a := startTestGossip(t, "node-a", Load{MaxConnections: 100}, nil, nil)
+	defer a.Close()
+	b := startTestGossip(t, "node-b", Load{}, []string{a.Addr()}, nil)
+	defer b.Close()
+
+	eventually(t, "both members", func() bool { return len(a.Peers()) == 2 })
+	if got := a.Capacity().MaxConnections; got != 0 {
+		t.Errorf("Expected unlimited capacity, got %d", got)
+	}
+}
+
+// TestLoadHeadroom verifies headroom is what's left under the limit, none
+// for a draining node and unbounded without a limit
+func TestLoadHeadroom(t *testing.T) {
+	cases := []struct {
+		load    Load
+		want    int
+		limited bool
+	}{
+		{Load{Connections: 30, MaxConnections: 100}, 70, true},
+		{Load{Connections: 120, MaxConnections: 100}, 0, true},
+		{Load{Connections: 30, MaxConnections: 100, Draining: true}, 0, true},
+		{Load{Connections: 30}, 0, false},
+	}
+	for _, c := range cases {
+		if got, limited := c.load.Headroom(); got != c.want || limited != c.limited {
+			t.Errorf("Expected %+v to have headroom %d (%v), got %d (%v)", c.load, c.want, c.limited, got, limited)
+		}
+	}
+}
+
+// TestPeerLeftClosesProxies verifies a departed node's rooms are dropped
+// at once
+func TestPeerLeftClosesProxies(t *testing.T) {
+	n, registry := newTestNode(t, redisBackplanes(t)())
+
+	n.mu.Lock()
+	n.remote[roomHash(testRoomID)] = remoteRoom{node: "gone", open: true, seen: time.Now()}
+	n.mu.Unlock()
+	proxy := n.Proxy(testRoomID)
+	proxy.AddClient("c1", nil)
+
+	n.PeerLeft("other")
+	if registry.GetRoom(testRoomID) == nil {
+		t.Fatal("Expected another node's departure to leave the proxy alone")
+	}
+	n.PeerLeft("gone")
+	if registry.GetRoom(testRoomID) != nil || n.HostedElsewhere(testRoomID) {
+		t.Error("Expected the host node's departure to close its proxy")
+	}
+}
@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ephemeral/relay/internal/invite"
+)
+
+var (
+	errNotHostedElsewhere = errors.New("room not hosted on another node")
+	errNoHostReply        = errors.New("no node answered the host call")
+)
+
+// hostCallRequest carries a host's invite API call to the node hosting its
+// room, which it names by hash as room IDs don't cross the backplane
+type hostCallRequest struct {
+	Room string          `json:"room,omitempty"` // empty for a revoke asked of every node
+	Call invite.HostCall `json:"call"`
+}
+
+// ServeHostCalls has hosts' invite API calls answered on the node hosting
+// their room, whichever node they reach: only that node holds the room's
+// host secret. It serves other nodes' calls for rooms hosted here, and
+// sends calls for rooms hosted elsewhere to their owner.
+func (n *Node) ServeHostCalls(h *invite.Handler) {
+	if n == nil {
+		return
+	}
+	n.pendingMu.Lock()
+	n.hosts = h
+	n.pendingMu.Unlock()
+	h.SetRemoteHosts(n)
+}
+
+// ForwardHostCall has the node hosting roomID answer call. With an empty
+// roomID, a revoke is asked of every node, and answered by the one holding
+// its token; only in-memory tokens, from ServeInvites, can't be looked up
+// on any node.
+func (n *Node) ForwardHostCall(roomID string, call invite.HostCall) (invite.HostReply, error) {
+	req := hostCallRequest{Call: call}
+	channel := roomsChannel
+	if roomID != "" {
+		req.Room = roomHash(roomID)
+		n.mu.Lock()
+		remote, ok := n.remote[req.Room]
+		n.mu.Unlock()
+		if !ok {
+			return invite.HostReply{}, errNotHostedElsewhere
+		}
+		channel = nodeChannel(remote.node)
+	} else {
+		n.pendingMu.Lock()
+		local := n.tokens != nil
+		n.pendingMu.Unlock()
+		if !local || call.Op != invite.HostRevoke {
+			return invite.HostReply{}, errNotHostedElsewhere
+		}
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return invite.HostReply{}, err
+	}
+	reqID, err := requestID()
+	if err != nil {
+		return invite.HostReply{}, err
+	}
+
+	ch := make(chan invite.HostReply, 1)
+	n.pendingMu.Lock()
+	n.calls[reqID] = ch
+	n.pendingMu.Unlock()
+	defer func() {
+		n.pendingMu.Lock()
+		delete(n.calls, reqID)
+		n.pendingMu.Unlock()
+	}()
+
+	n.publish(channel, envelope{Kind: kindHostCall, Client: reqID, Data: data})
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-time.After(ConsumeTimeout):
+		return invite.HostReply{}, errNoHostReply
+	}
+}
+
+// serveHostCall answers another node's host call for a room hosted here.
+// A revoke asked of every node is answered only where its token is found.
+func (n *Node) serveHostCall(msg envelope) {
+	var req hostCallRequest
+	n.pendingMu.Lock()
+	hosts := n.hosts
+	n.pendingMu.Unlock()
+	if hosts == nil || json.Unmarshal(msg.Data, &req) != nil {
+		return
+	}
+
+	var roomID string
+	if req.Room != "" {
+		if roomID = n.hostedRoom(req.Room); roomID == "" {
+			return
+		}
+	} else if req.Call.Op != invite.HostRevoke {
+		return
+	}
+
+	reply := hosts.ServeHostCall(roomID, req.Call)
+	if req.Room == "" && reply.Status == http.StatusNotFound {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	n.publish(nodeChannel(msg.Node), envelope{Kind: kindHostReply, Client: msg.Client, Data: data})
+}
+
+// hostedRoom returns the ID of the room hosted here with the given hash,
+// or "" if there's none
+func (n *Node) hostedRoom(hash string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, l := range n.links {
+		if l.hosted && roomHash(id) == hash {
+			return id
+		}
+	}
+	return ""
+}
+
+// hostReplied passes a host call's answer to the ForwardHostCall waiting
+// for it
+func (n *Node) hostReplied(msg envelope) {
+	var reply invite.HostReply
+	if json.Unmarshal(msg.Data, &reply) != nil {
+		return
+	}
+	n.pendingMu.Lock()
+	ch := n.calls[msg.Client]
+	n.pendingMu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+}
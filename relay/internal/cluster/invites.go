@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Invite forwarding timing
+const (
+	// ConsumeTimeout bounds the wait for a room's owner node to answer
+	ConsumeTimeout = 2 * time.Second
+	// LendTTL is how long the owner keeps a token consumed for another
+	// node, in case that node's join fails and it's handed back
+	LendTTL = time.Minute
+)
+
+// remoteErrors are the consume failures passed between nodes; anything
+// else reads as invite.ErrTokenNotFound
+var remoteErrors = []error{invite.ErrTokenNotFound, invite.ErrTokenAlreadyUsed, invite.ErrFingerprint, invite.ErrTokenRevoked}
+
+// consumeRequest asks a room's owner node to consume an invite token
+type consumeRequest struct {
+	Token       string `json:"token"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// consumeReply answers a consumeRequest. The room ID is left out: the
+// asking node knows it, and room IDs don't cross the backplane.
+type consumeReply struct {
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Scope     room.Role `json:"scope"`
+	Metadata  []byte    `json:"metadata,omitempty"`
+}
+
+// lentToken is a token consumed on behalf of another node
+type lentToken struct {
+	token *invite.Token
+	at    time.Time
+}
+
+// invites is a node's share of cross-node invite consumption and hosts'
+// invite API calls
+type invites struct {
+	tokens *invite.Handler // this node's tokens; nil until ServeInvites
+	hosts  *invite.Handler // answers host calls; nil until ServeHostCalls
+
+	pendingMu sync.Mutex
+	pending   map[string]chan consumeReply     // by request ID
+	calls     map[string]chan invite.HostReply // by request ID
+	lent      map[string]lentToken             // by token ID
+}
+
+func newInvites() invites {
+	return invites{
+		pending: make(map[string]chan consumeReply),
+		calls:   make(map[string]chan invite.HostReply),
+		lent:    make(map[string]lentToken),
+	}
+}
+
+// ServeInvites has invite tokens consumed on the node hosting their room:
+// it serves other nodes' requests for rooms hosted here, and sends tokens
+// for rooms proxied here to their owner. In-memory tokens then work on
+// every node, and stateless tokens are single use cluster-wide.
+func (n *Node) ServeInvites(h *invite.Handler) {
+	if n == nil {
+		return
+	}
+	n.pendingMu.Lock()
+	n.tokens = h
+	n.pendingMu.Unlock()
+	h.SetRemote(n)
+}
+
+// Proxied reports whether roomID is a proxy for a room hosted elsewhere
+func (n *Node) Proxied(roomID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := n.links[roomID]
+	return l != nil && !l.hosted
+}
+
+// ConsumeRemote consumes a token on the node hosting roomID
+func (n *Node) ConsumeRemote(roomID, tokenID, fingerprint string) (*invite.Token, error) {
+	n.mu.Lock()
+	l := n.links[roomID]
+	n.mu.Unlock()
+	if l == nil || l.hosted {
+		return nil, invite.ErrTokenNotFound
+	}
+
+	data, err := json.Marshal(consumeRequest{Token: tokenID, Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	reqID, err := requestID()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan consumeReply, 1)
+	n.pendingMu.Lock()
+	n.pending[reqID] = ch
+	n.pendingMu.Unlock()
+	defer func() {
+		n.pendingMu.Lock()
+		delete(n.pending, reqID)
+		n.pendingMu.Unlock()
+	}()
+
+	l.publish(envelope{Kind: kindConsume, Client: reqID, Data: data})
+
+	select {
+	case reply := <-ch:
+		if reply.Error != "" {
+			return nil, remoteError(reply.Error)
+		}
+		return &invite.Token{
+			ID:        tokenID,
+			RoomID:    roomID,
+			CreatedAt: reply.CreatedAt,
+			ExpiresAt: reply.ExpiresAt,
+			Used:      true,
+			Scope:     reply.Scope,
+			Metadata:  reply.Metadata,
+		}, nil
+	case <-time.After(ConsumeTimeout):
+		return nil, invite.ErrTokenNotFound
+	}
+}
+
+// RestoreRemote hands a token from ConsumeRemote back to its owner node
+func (n *Node) RestoreRemote(token *invite.Token) {
+	n.mu.Lock()
+	l := n.links[token.RoomID]
+	n.mu.Unlock()
+	if l != nil {
+		l.publish(envelope{Kind: kindRestore, Data: []byte(token.ID)})
+	}
+}
+
+// requestID returns a random ID matching a reply to its request
+func requestID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func remoteError(msg string) error {
+	for _, err := range remoteErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return invite.ErrTokenNotFound
+}
+
+// serveConsume consumes a token for a joiner on another node. A token for
+// a different room is put straight back, so no node can spend invites for
+// rooms other than the one it asks about.
+func (n *Node) serveConsume(l *link, msg envelope) {
+	var req consumeRequest
+	reply := consumeReply{Error: invite.ErrTokenNotFound.Error()}
+
+	n.pendingMu.Lock()
+	tokens := n.tokens
+	n.pendingMu.Unlock()
+
+	if tokens != nil && json.Unmarshal(msg.Data, &req) == nil {
+		token, err := tokens.ConsumeToken(l.room.ID, req.Token, req.Fingerprint)
+		switch {
+		case err != nil:
+			reply.Error = err.Error()
+		case token.RoomID != l.room.ID:
+			tokens.RestoreToken(token)
+		default:
+			reply = consumeReply{
+				CreatedAt: token.CreatedAt,
+				ExpiresAt: token.ExpiresAt,
+				Scope:     token.Scope,
+				Metadata:  token.Metadata,
+			}
+			n.pendingMu.Lock()
+			n.lent[token.ID] = lentToken{token: token, at: time.Now()}
+			n.pendingMu.Unlock()
+		}
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	n.publish(nodeChannel(msg.Node), envelope{Kind: kindConsumed, Client: msg.Client, Data: data})
+}
+
+// serveRestore takes back a token lent to another node
+func (n *Node) serveRestore(tokenID string) {
+	n.pendingMu.Lock()
+	lent, ok := n.lent[tokenID]
+	delete(n.lent, tokenID)
+	tokens := n.tokens
+	n.pendingMu.Unlock()
+
+	if ok && tokens != nil {
+		tokens.RestoreToken(lent.token)
+	}
+}
+
+// expireLent forgets tokens lent long enough ago that no join still holds them
+func (n *Node) expireLent(now time.Time) {
+	n.pendingMu.Lock()
+	defer n.pendingMu.Unlock()
+	for id, lent := range n.lent {
+		if now.Sub(lent.at) > LendTTL {
+			delete(n.lent, id)
+		}
+	}
+}
+
+// handleInbox takes requests and replies addressed to this node
+func (n *Node) handleInbox(data []byte) {
+	msg, err := unmarshalEnvelope(data)
+	if err != nil {
+		return
+	}
+
+	switch msg.Kind {
+	case kindConsumed:
+		n.consumed(msg)
+	case kindHostCall:
+		go n.serveHostCall(msg)
+	case kindHostReply:
+		n.hostReplied(msg)
+	}
+}
+
+// consumed passes a consumeReply to the ConsumeRemote waiting for it
+func (n *Node) consumed(msg envelope) {
+	var reply consumeReply
+	if json.Unmarshal(msg.Data, &reply) != nil {
+		return
+	}
+	n.pendingMu.Lock()
+	ch := n.pending[msg.Client]
+	n.pendingMu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+func newTestInvites(t *testing.T, n *Node, registry *room.Registry) *invite.Handler {
+	t.Helper()
+	store := invite.NewTokenStore()
+	t.Cleanup(store.Stop)
+	limits := ratelimit.Profile{InviteRate: 1000, InviteBurst: 1000, ProbeRate: 1000, ProbeBurst: 1000}.NewLimiters()
+	t.Cleanup(limits.Stop)
+
+	h := invite.NewHandler(store, registry, limits, nil, nil)
+	n.ServeInvites(h)
+	n.ServeHostCalls(h)
+	return h
+}
+
+// hostCall makes an invite API request with the host secret
+func hostCall(h *invite.Handler, method, path, secret, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestInviteConsumedAcrossNodes verifies a token minted on the host's node
+// admits a joiner on another node, once, and can be handed back
+func TestInviteConsumedAcrossNodes(t *testing.T) {
+	backplane := redisBackplanes(t)
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, registryB := newTestNode(t, backplane())
+	invitesA := newTestInvites(t, nodeA, registryA)
+	invitesB := newTestInvites(t, nodeB, registryB)
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	nodeA.Hosting(hostRoom)
+	otherRoom, _ := registryA.CreateRoom("other-room-0123456789-abcdefghijklmnopqrst", nil)
+	nodeA.Hosting(otherRoom)
+	eventually(t, "the room to be announced", func() bool { return nodeB.HostedElsewhere(testRoomID) })
+	nodeB.Proxy(testRoomID)
+
+	resp, err := invitesA.CreateInvite(testRoomID, invite.CreateTokenRequest{Scope: string(room.RoleObserver)})
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+
+	token, err := invitesB.ConsumeToken(testRoomID, resp.Token, "")
+	if err != nil {
+		t.Fatalf("Expected the owner node to consume the token: %v", err)
+	}
+	if token.RoomID != testRoomID || token.Scope != room.RoleObserver {
+		t.Errorf("Expected an observer token for the room, got %+v", token)
+	}
+	if _, err := invitesB.ConsumeToken(testRoomID, resp.Token, ""); err != invite.ErrTokenNotFound {
+		t.Errorf("Expected a spent token to be refused, got %v", err)
+	}
+
+	invitesB.RestoreToken(token)
+	eventually(t, "the token to be restored", func() bool {
+		_, err := invitesA.ConsumeToken(testRoomID, resp.Token, "")
+		return err == nil
+	})
+
+	// A token can't be spent through a room it doesn't belong to
+	other, _ := invitesA.CreateInvite(otherRoom.ID, invite.CreateTokenRequest{})
+	if _, err := invitesB.ConsumeToken(testRoomID, other.Token, ""); err != invite.ErrTokenNotFound {
+		t.Errorf("Expected another room's token to be refused, got %v", err)
+	}
+	if _, err := invitesA.ConsumeToken(otherRoom.ID, other.Token, ""); err != nil {
+		t.Errorf("Expected the refused token to stay valid, got %v", err)
+	}
+}
+
+// TestProxyReapKeepsOwnerTokens verifies reaping a proxy doesn't revoke
+// its room's invites in a token store the nodes share, as the room hooks
+// would for a room destroyed here
+func TestProxyReapKeepsOwnerTokens(t *testing.T) {
+	backplane := redisBackplanes(t)
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, registryB := newTestNode(t, backplane())
+	store := invite.NewTokenStore()
+	t.Cleanup(store.Stop)
+	invitesA := invite.NewHandler(store, registryA, nil, nil, nil)
+	invitesB := invite.NewHandler(store, registryB, nil, nil, nil)
+	registryA.OnRoomDestroyed(func(roomID, _ string) { invitesA.RevokeRoomTokens(roomID) })
+	registryB.OnRoomDestroyed(func(roomID, _ string) { invitesB.RevokeRoomTokens(roomID) })
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	nodeA.Hosting(hostRoom)
+	eventually(t, "the room to be announced", func() bool { return nodeB.HostedElsewhere(testRoomID) })
+	nodeB.Proxy(testRoomID)
+
+	resp, err := invitesA.CreateInvite(testRoomID, invite.CreateTokenRequest{})
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	nodeB.tick(time.Now().Add(ProxyIdle + time.Second))
+	if registryB.GetRoom(testRoomID) != nil {
+		t.Fatal("Expected the idle proxy to be reaped")
+	}
+	if _, err := invitesA.ConsumeToken(testRoomID, resp.Token, ""); err != nil {
+		t.Errorf("Expected the owner's token to survive the proxy, got %v", err)
+	}
+}
+
+// TestHostCallsForwarded verifies a host's invite API calls that reach a
+// node other than its own are answered by its own, the only one holding
+// its host secret and, here, its tokens
+func TestHostCallsForwarded(t *testing.T) {
+	backplane := redisBackplanes(t)
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, registryB := newTestNode(t, backplane())
+	invitesA := newTestInvites(t, nodeA, registryA)
+	invitesB := newTestInvites(t, nodeB, registryB)
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	nodeA.Hosting(hostRoom)
+	eventually(t, "the room to be announced", func() bool { return nodeB.HostedElsewhere(testRoomID) })
+	secret := hostRoom.HostSecret()
+
+	// Before any joiner made a proxy here, and after
+	rec := hostCall(invitesB, http.MethodPost, "/invite/create/"+testRoomID, secret, `{"scope":"observer"}`)
+	var created invite.CreateTokenResponse
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &created) != nil || created.Scope != "observer" {
+		t.Fatalf("Expected an observer token minted on the host's node, got %d %s", rec.Code, rec.Body)
+	}
+	nodeB.Proxy(testRoomID)
+	rec = hostCall(invitesB, http.MethodPost, "/invite/create-batch/"+testRoomID, secret, `{"count":2}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected a batch minted through the proxy's node, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = hostCall(invitesB, http.MethodGet, "/invite/list/"+testRoomID, secret, "")
+	var list invite.ListTokensResponse
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list.Tokens) != 3 {
+		t.Errorf("Expected the host's node to list 3 tokens, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := hostCall(invitesB, http.MethodGet, "/invite/list/"+testRoomID, "wrong", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the host's node to refuse a wrong secret, got %d", rec.Code)
+	}
+
+	// The token is held in the host's node's memory, so the revoke finds it there
+	if rec := hostCall(invitesB, http.MethodDelete, "/invite/"+created.Token, "wrong", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a revoke with a wrong secret refused, got %d", rec.Code)
+	}
+	if rec := hostCall(invitesB, http.MethodDelete, "/invite/"+created.Token, secret, ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the revoke answered by the host's node, got %d %s", rec.Code, rec.Body)
+	}
+	if _, err := invitesA.ConsumeToken(testRoomID, created.Token, ""); err == nil {
+		t.Error("Expected the revoked token gone")
+	}
+}
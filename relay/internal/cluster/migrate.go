@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Migration timing
+const (
+	// ResumeTTL is how long a resume token handed out by Drain stays good
+	ResumeTTL = time.Minute
+	// ResumeWait bounds how long a resuming client waits for its host to
+	// resume the room on another node
+	ResumeWait = 10 * time.Second
+)
+
+// ReasonMigrated is the ROOM_DESTROYED reason for a room moved off a
+// draining node. Its clients have a MIGRATE message with their resume
+// token just ahead of it.
+const ReasonMigrated = "migrated"
+
+// ErrResumeToken is returned for a resume token that is unknown, spent,
+// expired or issued for another room
+var ErrResumeToken = errors.New("invalid resume token")
+
+// Grant is what a resume token restores
+type Grant struct {
+	Host     bool      `json:"host,omitempty"`
+	Open     bool      `json:"open,omitempty"` // host only: the room was taking joins
+	ClientID string    `json:"clientId,omitempty"`
+	Role     room.Role `json:"role,omitempty"`
+
+	origin string // node the host left, if the host is moving
+}
+
+// grantMessage announces a resume token to the cluster. Only the token's
+// hash crosses the backplane, so a backplane reader can't resume anyone.
+type grantMessage struct {
+	Room   string `json:"room"` // room hash
+	Origin string `json:"origin,omitempty"`
+	Grant
+}
+
+// grant is a resume token this node will honour
+type grant struct {
+	Grant
+	room    string // room hash
+	expires time.Time
+}
+
+// migrateMessage tells a host or client to reconnect with a resume token
+type migrateMessage struct {
+	Type        string `json:"type"`
+	URL         string `json:"url,omitempty"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// Drain moves every room off this node so it can be taken down without
+// ending them. Hosts and clients are sent a MIGRATE message pointing at
+// target, an address behind which some other node answers, with a
+// single-use resume token, and their rooms are then closed here. Clients
+// held on other nodes stay connected and pick the host up again once it
+// has resumed. From now on the node refuses new connections.
+//
+// Invite tokens held in this node's memory don't survive the move.
+func (n *Node) Drain(target string) (rooms, clients int) {
+	if n == nil {
+		return 0, 0
+	}
+	n.mu.Lock()
+	n.draining = true
+	links := make([]*link, 0, len(n.links))
+	for _, l := range n.links {
+		links = append(links, l)
+	}
+	n.mu.Unlock()
+
+	for _, l := range links {
+		// Clients of a proxy can rejoin as soon as they reconnect; those of
+		// a hosted room wait for the host to come back up elsewhere
+		origin := ""
+		if l.hosted {
+			origin = n.id
+		}
+		moved := n.evacuate(l, target, origin)
+		clients += moved
+		if l.hosted {
+			rooms++
+		}
+	}
+	log.Printf("Cluster: drained %d rooms and %d clients", rooms, clients)
+	return rooms, clients
+}
+
+// Undrain takes new connections again after Drain, for a node that was
+// drained but is staying up after all. Rooms already moved stay moved.
+func (n *Node) Undrain() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.draining = false
+	n.mu.Unlock()
+	log.Printf("Cluster: no longer draining")
+}
+
+// Draining reports whether Drain has been called
+func (n *Node) Draining() bool {
+	if n == nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.draining
+}
+
+// evacuate hands the host and confirmed clients of a local room resume
+// tokens, then closes the room. Clients still waiting on the host's
+// approval get none: they join again the usual way. It returns the number
+// of clients given a token.
+func (n *Node) evacuate(l *link, target, origin string) int {
+	hash := roomHash(l.room.ID)
+
+	if l.hosted {
+		n.mu.Lock()
+		open := l.open
+		n.mu.Unlock()
+		if token, err := n.issue(hash, Grant{Host: true, Open: open, origin: origin}); err == nil {
+			l.room.SendToHost(migrateFrame(target, token))
+		}
+	}
+
+	moved := 0
+	for _, c := range l.room.ConfirmedClients() {
+		token, err := n.issue(hash, Grant{ClientID: c.ID, Role: c.Role, origin: origin})
+		if err != nil {
+			continue
+		}
+		if l.room.DeliverToClient(c.ID, migrateFrame(target, token)) {
+			moved++
+		}
+	}
+
+	if l.hosted {
+		n.registry.DestroyRoom(l.room.ID, ReasonMigrated)
+	} else {
+		l.closeProxy(ReasonMigrated)
+	}
+	return moved
+}
+
+// issue creates a resume token and tells every node about it before it's
+// handed out
+func (n *Node) issue(hash string, g Grant) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Cluster: resume token failed: %v", err)
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	key := tokenHash(token)
+
+	data, err := json.Marshal(grantMessage{Room: hash, Origin: g.origin, Grant: g})
+	if err != nil {
+		return "", err
+	}
+	n.mu.Lock()
+	n.grants[key] = grant{Grant: g, room: hash, expires: time.Now().Add(ResumeTTL)}
+	n.mu.Unlock()
+
+	n.publish(roomsChannel, envelope{Kind: kindResume, Client: key, Data: data})
+	return token, nil
+}
+
+func migrateFrame(target, token string) []byte {
+	data, _ := json.Marshal(migrateMessage{Type: "MIGRATE", URL: target, ResumeToken: token})
+	return data
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Resume spends a resume token for roomID, reporting what it restores.
+// host says which side of the room the caller is resuming; a token only
+// works for the side and room it was issued for.
+//
+// A host resuming onto a node that holds a proxy for its room takes the
+// room over: the proxy's clients are sent resume tokens of their own.
+func (n *Node) Resume(roomID, token string, host bool) (Grant, error) {
+	if n == nil || token == "" {
+		return Grant{}, ErrResumeToken
+	}
+	key := tokenHash(token)
+	hash := roomHash(roomID)
+
+	n.mu.Lock()
+	g, ok := n.grants[key]
+	ok = ok && g.room == hash && g.Host == host && time.Now().Before(g.expires)
+	if ok {
+		delete(n.grants, key)
+	}
+	proxy := n.links[roomID]
+	n.mu.Unlock()
+
+	if !ok {
+		return Grant{}, ErrResumeToken
+	}
+	n.publish(roomsChannel, envelope{Kind: kindResumed, Client: key})
+
+	if host && proxy != nil && !proxy.hosted {
+		n.evacuate(proxy, "", g.origin)
+	}
+	return g.Grant, nil
+}
+
+// Rejoin finds the room a client is resuming, waiting up to ResumeWait for
+// its host to reopen it somewhere other than the node it left.
+// It returns nil if the host doesn't come back in time, or ctx is done
+// first.
+func (n *Node) Rejoin(ctx context.Context, roomID string, g Grant) *room.Room {
+	if n == nil {
+		return nil
+	}
+	hash := roomHash(roomID)
+	ctx, cancel := context.WithTimeout(ctx, ResumeWait)
+	defer cancel()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		n.mu.Lock()
+		l := n.links[roomID]
+		remote, ok := n.remote[hash]
+		n.mu.Unlock()
+
+		switch {
+		case l != nil && l.hosted:
+			return l.room
+		case ok && remote.open && remote.node != g.origin:
+			return n.Proxy(roomID)
+		}
+		select {
+		case <-poll.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
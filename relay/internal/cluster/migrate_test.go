@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// migrateToken reads the resume token out of a MIGRATE frame
+func migrateToken(t *testing.T, data []byte) string {
+	t.Helper()
+	var msg migrateMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "MIGRATE" || msg.ResumeToken == "" {
+		t.Fatalf("Expected a MIGRATE frame, got %q", data)
+	}
+	return msg.ResumeToken
+}
+
+// TestDrainMigratesRoom verifies a drained room's host and clients get
+// resume tokens that work once, on another node, and that clients held
+// elsewhere keep their seat until the host is back
+func TestDrainMigratesRoom(t *testing.T) {
+	backplane := redisBackplanes(t)
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, registryB := newTestNode(t, backplane())
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	nodeA.Hosting(hostRoom)
+	hostRoom.OpenRoom()
+	nodeA.Opened(hostRoom)
+	local, _ := hostRoom.AddClientWithRole("c1", nil, room.RoleObserver)
+	hostRoom.ConfirmClient("c1")
+	hostRoom.AddClient("pending", nil)
+
+	eventually(t, "the room to be announced open", func() bool {
+		nodeB.mu.Lock()
+		defer nodeB.mu.Unlock()
+		return nodeB.remote[roomHash(testRoomID)].open
+	})
+	proxy := nodeB.Proxy(testRoomID)
+	remote, _ := proxy.AddClient("c2", nil)
+	proxy.ConfirmClient("c2")
+
+	rooms, clients := nodeA.Drain("wss://relay.example")
+	if rooms != 1 || clients != 1 {
+		t.Errorf("Expected 1 room and 1 client drained, got %d and %d", rooms, clients)
+	}
+	if !nodeA.Draining() || registryA.GetRoom(testRoomID) != nil {
+		t.Fatal("Expected the node to be draining with the room gone")
+	}
+	hostToken := migrateToken(t, receive(t, hostRoom.HostSendCh))
+	clientToken := migrateToken(t, receive(t, local.SendCh))
+
+	eventually(t, "the grants to reach the other node", func() bool {
+		nodeB.mu.Lock()
+		defer nodeB.mu.Unlock()
+		return len(nodeB.grants) == 2
+	})
+	if registryB.GetRoom(testRoomID) == nil {
+		t.Error("Expected the proxy to wait for the host rather than close")
+	}
+
+	if _, err := nodeB.Resume(testRoomID, clientToken, true); err != ErrResumeToken {
+		t.Errorf("Expected a client token to be refused to a host, got %v", err)
+	}
+	if _, err := nodeB.Resume("other-room-0123456789-abcdefghijklmnopqrst", hostToken, true); err != ErrResumeToken {
+		t.Errorf("Expected a token to be refused for another room, got %v", err)
+	}
+	grant, err := nodeB.Resume(testRoomID, hostToken, true)
+	if err != nil || !grant.Open {
+		t.Fatalf("Expected the host to resume an open room, got %+v, %v", grant, err)
+	}
+	if _, err := nodeB.Resume(testRoomID, hostToken, true); err != ErrResumeToken {
+		t.Errorf("Expected a resume token to work once, got %v", err)
+	}
+	eventually(t, "the spent token to be forgotten", func() bool {
+		nodeA.mu.Lock()
+		defer nodeA.mu.Unlock()
+		_, ok := nodeA.grants[tokenHash(hostToken)]
+		return !ok
+	})
+
+	// The host taking over here moves the proxy's client along too
+	remoteToken := migrateToken(t, receive(t, remote.SendCh))
+	resumed, err := registryB.CreateRoom(testRoomID, nil)
+	if err != nil {
+		t.Fatalf("Expected the host to recreate the room over the proxy: %v", err)
+	}
+	nodeB.Hosting(resumed)
+	resumed.OpenRoom()
+	nodeB.Opened(resumed)
+
+	for _, token := range []string{clientToken, remoteToken} {
+		grant, err := nodeB.Resume(testRoomID, token, false)
+		if err != nil {
+			t.Fatalf("Expected the client to resume: %v", err)
+		}
+		if nodeB.Rejoin(context.Background(), testRoomID, grant) != resumed {
+			t.Error("Expected the client to rejoin the resumed room")
+		}
+		if token == clientToken && (grant.ClientID != "c1" || grant.Role != room.RoleObserver) {
+			t.Errorf("Expected the client's ID and role back, got %+v", grant)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultNATSPrefix roots the backplane's subjects
+const DefaultNATSPrefix = "relay.cluster."
+
+// NATSBackplane is a Backplane over core NATS. Publishes are buffered and
+// flushed by the client rather than waiting on a round trip, and each
+// subscription is served by its own goroutine, so a slow room doesn't
+// hold up the others.
+type NATSBackplane struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSBackplane creates a backplane on conn, naming subjects under
+// prefix. The backplane owns the connection and closes it on Close.
+func NewNATSBackplane(conn *nats.Conn, prefix string) *NATSBackplane {
+	if prefix == "" {
+		prefix = DefaultNATSPrefix
+	}
+	return &NATSBackplane{conn: conn, prefix: prefix}
+}
+
+// subject maps a channel name to a NATS subject: "room:abc" becomes
+// "<prefix>room.abc"
+func (b *NATSBackplane) subject(channel string) string {
+	return b.prefix + strings.ReplaceAll(channel, ":", ".")
+}
+
+// Publish sends data to channel
+func (b *NATSBackplane) Publish(channel string, data []byte) error {
+	return b.conn.Publish(b.subject(channel), data)
+}
+
+// Subscribe starts delivering channel to fn
+func (b *NATSBackplane) Subscribe(channel string, fn func([]byte)) (Subscription, error) {
+	return b.conn.Subscribe(b.subject(channel), func(msg *nats.Msg) {
+		fn(msg.Data)
+	})
+}
+
+// Close flushes pending publishes and closes the connection
+func (b *NATSBackplane) Close() error {
+	err := b.conn.Flush()
+	b.conn.Close()
+	return err
+}
@@ -0,0 +1,40 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// natsBackplanes returns a factory for backplanes on one in-process
+// NATS server
+func natsBackplanes(t *testing.T) func() Backplane {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("NATS server failed: %v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	return func() Backplane {
+		conn, err := nats.Connect(srv.ClientURL())
+		if err != nil {
+			t.Fatalf("NATS connect failed: %v", err)
+		}
+		return NewNATSBackplane(conn, "")
+	}
+}
+
+// TestNATSSubjects verifies channels map onto dot-separated subjects
+func TestNATSSubjects(t *testing.T) {
+	b := NewNATSBackplane(nil, "")
+	if got := b.subject(roomChannel("abc")); got != "relay.cluster.room.abc" {
+		t.Errorf("Expected relay.cluster.room.abc, got %s", got)
+	}
+}
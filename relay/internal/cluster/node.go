@@ -0,0 +1,668 @@
+// Package cluster lets several relay nodes behind one load balancer serve
+// the same rooms. A room lives on the node its host connected to; a client
+// that lands on another node joins a proxy room there, and frames between
+// the two cross a Backplane.
+//
+// Room state stays in each node's memory. The backplane carries room
+// announcements, keyed by a hash of the room ID and with the options the
+// host chose, and the ciphertext frames the relay already forwards; room
+// IDs themselves never leave the node.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Timing
+const (
+	// AnnounceInterval is how often a node re-announces the rooms it hosts
+	AnnounceInterval = 5 * time.Second
+	// AnnounceTTL is how long an announcement stands. A node that stops
+	// announcing, e.g. because it crashed, loses its rooms after this.
+	AnnounceTTL = 3 * AnnounceInterval
+	// ProxyIdle is how long a proxy room may sit with no clients
+	ProxyIdle = AnnounceInterval
+)
+
+// Backplane channels, below the backplane's own prefix
+const roomsChannel = "rooms"
+
+func roomChannel(hash string) string {
+	return "room:" + hash
+}
+
+func nodeChannel(id string) string {
+	return "node:" + id
+}
+
+// Node is one relay's membership in a cluster. A nil *Node is a
+// standalone relay: every method is then a no-op.
+type Node struct {
+	id        string
+	backplane Backplane
+	registry  *room.Registry
+
+	mu       sync.Mutex
+	links    map[string]*link      // by room ID; hosted rooms and proxies
+	remote   map[string]remoteRoom // by room hash; rooms hosted on other nodes
+	grants   map[string]grant      // by token hash; resume tokens from Drain
+	draining bool
+
+	invites
+	rooms Subscription
+	inbox Subscription
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// remoteRoom is another node's announcement of a room
+type remoteRoom struct {
+	node    string
+	open    bool
+	closing bool   // refusing joins until it's destroyed
+	options string // the room options its proxies apply, see roomOptions
+	seen    time.Time
+}
+
+// link ties a local room to its backplane channel. It is the room's
+// Fanout, so frames for clients elsewhere are published on the channel.
+type link struct {
+	node    *Node
+	room    *room.Room
+	channel string
+	hosted  bool // the host is on this node; otherwise this is a proxy
+	open    bool // hosted only: announced as open (guarded by node.mu)
+	closing bool // hosted only: announced as closing (guarded by node.mu)
+	created time.Time
+	sub     Subscription
+	stop    chan struct{} // proxies: closed before the room is destroyed
+	halted  sync.Once
+}
+
+// NewNode joins the cluster on backplane, serving rooms from registry
+func NewNode(backplane Backplane, registry *room.Registry) (*Node, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:        hex.EncodeToString(id),
+		backplane: backplane,
+		registry:  registry,
+		links:     make(map[string]*link),
+		invites:   newInvites(),
+		remote:    make(map[string]remoteRoom),
+		grants:    make(map[string]grant),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	sub, err := backplane.Subscribe(roomsChannel, n.handleRooms)
+	if err != nil {
+		return nil, err
+	}
+	n.rooms = sub
+	if n.inbox, err = backplane.Subscribe(nodeChannel(n.id), n.handleInbox); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	registry.OnRoomDestroyed(n.roomDestroyed)
+	registry.OnProxyDestroyed(n.roomDestroyed)
+
+	// Ask the others for their rooms rather than wait out an interval
+	n.publish(roomsChannel, envelope{Kind: kindHello})
+
+	go n.run()
+	return n, nil
+}
+
+// Close withdraws this node's rooms from the cluster and leaves it
+func (n *Node) Close() error {
+	if n == nil {
+		return nil
+	}
+	close(n.stop)
+	<-n.done
+
+	n.mu.Lock()
+	for _, l := range n.links {
+		if l.hosted {
+			n.publish(roomsChannel, envelope{Kind: kindGone, Data: []byte(roomHash(l.room.ID))})
+		}
+	}
+	n.mu.Unlock()
+
+	n.rooms.Unsubscribe()
+	n.inbox.Unsubscribe()
+	return n.backplane.Close()
+}
+
+// HostedElsewhere reports whether another node has announced roomID,
+// in which case a host may not create it here
+func (n *Node) HostedElsewhere(roomID string) bool {
+	if n == nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.remote[roomHash(roomID)]
+	return ok
+}
+
+// Hosting puts a room whose host just connected here on the cluster
+func (n *Node) Hosting(rm *room.Room) error {
+	if n == nil {
+		return nil
+	}
+	hash := roomHash(rm.ID)
+	l := &link{node: n, room: rm, channel: roomChannel(hash), hosted: true, created: time.Now()}
+
+	sub, err := n.backplane.Subscribe(l.channel, l.handle)
+	if err != nil {
+		return err
+	}
+	l.sub = sub
+	rm.SetFanout(l)
+
+	n.mu.Lock()
+	n.links[rm.ID] = l
+	// A host resuming here replaces its room's old announcement
+	delete(n.remote, hash)
+	n.mu.Unlock()
+
+	n.publish(roomsChannel, envelope{Kind: kindHosted, Client: roomOptions(rm), Data: []byte(hash)})
+	return nil
+}
+
+// Opened announces that a hosted room now accepts joins
+func (n *Node) Opened(rm *room.Room) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	l := n.links[rm.ID]
+	if l != nil && l.hosted {
+		l.open = true
+	}
+	n.mu.Unlock()
+
+	if l != nil && l.hosted {
+		n.publish(roomsChannel, envelope{Kind: kindOpen, Client: roomOptions(rm), Data: []byte(roomHash(rm.ID))})
+	}
+}
+
+// Closing announces that a hosted room has begun its closing countdown,
+// so its proxies refuse joins too
+func (n *Node) Closing(rm *room.Room) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	l := n.links[rm.ID]
+	if l != nil && l.hosted {
+		l.closing = true
+	}
+	n.mu.Unlock()
+
+	if l != nil && l.hosted {
+		n.publish(roomsChannel, envelope{Kind: kindClosing, Data: []byte(roomHash(rm.ID))})
+	}
+}
+
+// Proxy returns a local stand-in for a room hosted on another node, for a
+// client joining here, or nil if no node has announced the room
+func (n *Node) Proxy(roomID string) *room.Room {
+	if n == nil {
+		return nil
+	}
+	hash := roomHash(roomID)
+
+	n.mu.Lock()
+	remote, ok := n.remote[hash]
+	if !ok {
+		n.mu.Unlock()
+		return nil
+	}
+	if l := n.links[roomID]; l != nil {
+		n.mu.Unlock()
+		return l.room
+	}
+
+	rm, err := n.registry.CreateProxyRoom(roomID)
+	if err != nil {
+		// Lost a race with another joiner, or with a host creating it here
+		n.mu.Unlock()
+		return n.registry.GetRoom(roomID)
+	}
+	applyRoomOptions(rm, remote.options)
+	if remote.open {
+		rm.OpenRoom()
+	}
+	if remote.closing {
+		rm.BeginClosing()
+	}
+
+	l := &link{node: n, room: rm, channel: roomChannel(hash), created: time.Now(), stop: make(chan struct{})}
+	sub, err := n.backplane.Subscribe(l.channel, l.handle)
+	if err == nil {
+		l.sub = sub
+		rm.SetFanout(l)
+		n.links[roomID] = l
+	}
+	n.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Cluster: proxy subscribe failed: %v", err)
+		l.closeProxy("cluster_unavailable")
+		return nil
+	}
+	go l.forwardToHost()
+	return rm
+}
+
+// ID returns the node's random cluster identity
+func (n *Node) ID() string {
+	if n == nil {
+		return ""
+	}
+	return n.id
+}
+
+// ProxyCount returns how many of the registry's rooms are proxies for
+// rooms hosted on other nodes
+func (n *Node) ProxyCount() int {
+	if n == nil {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	proxies := 0
+	for _, l := range n.links {
+		if !l.hosted {
+			proxies++
+		}
+	}
+	return proxies
+}
+
+// PeerLeft forgets the rooms of a node that membership says is gone,
+// closing their proxies here without waiting for the announcements to
+// expire
+func (n *Node) PeerLeft(id string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	for hash, remote := range n.remote {
+		if remote.node == id {
+			delete(n.remote, hash)
+		}
+	}
+	n.mu.Unlock()
+
+	n.reap(time.Now())
+}
+
+// Kick removes a client held by another node
+func (n *Node) Kick(rm *room.Room, clientID string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	l := n.links[rm.ID]
+	n.mu.Unlock()
+
+	if l != nil {
+		l.publish(envelope{Kind: kindKick, Client: clientID})
+	}
+}
+
+// Approve marks a client held by another node as accepted by the host, so
+// its messages are relayed
+func (n *Node) Approve(rm *room.Room, clientID string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	l := n.links[rm.ID]
+	n.mu.Unlock()
+
+	if l != nil {
+		l.publish(envelope{Kind: kindApprove, Client: clientID})
+	}
+}
+
+// run re-announces hosted rooms, expires stale announcements and reaps
+// proxies that have lost their host or their clients
+func (n *Node) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.tick(time.Now())
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *Node) tick(now time.Time) {
+	n.announce()
+
+	n.mu.Lock()
+	for hash, remote := range n.remote {
+		if now.Sub(remote.seen) > AnnounceTTL {
+			delete(n.remote, hash)
+		}
+	}
+	for key, g := range n.grants {
+		if now.After(g.expires) {
+			delete(n.grants, key)
+		}
+	}
+	n.mu.Unlock()
+
+	n.expireLent(now)
+	n.reap(now)
+}
+
+// reap closes proxies whose host is no longer announced, and those
+// left without clients
+func (n *Node) reap(now time.Time) {
+	n.mu.Lock()
+	reap := make(map[*link]string)
+	for _, l := range n.links {
+		if l.hosted {
+			continue
+		}
+		if _, ok := n.remote[roomHash(l.room.ID)]; !ok {
+			reap[l] = "host_disconnected"
+		} else if now.Sub(l.created) > ProxyIdle && l.room.ClientCount() == 0 {
+			reap[l] = "idle"
+		}
+	}
+	n.mu.Unlock()
+
+	for l, reason := range reap {
+		l.closeProxy(reason)
+	}
+}
+
+// announce publishes every hosted room with its open state. A closing
+// room is announced as open or hosted too, then as closing, so nodes that
+// predate closing keep its proxies.
+func (n *Node) announce() {
+	n.mu.Lock()
+	var msgs []envelope
+	for _, l := range n.links {
+		if !l.hosted {
+			continue
+		}
+		kind := kindHosted
+		if l.open {
+			kind = kindOpen
+		}
+		msgs = append(msgs, envelope{Kind: kind, Client: roomOptions(l.room), Data: []byte(roomHash(l.room.ID))})
+		if l.closing {
+			msgs = append(msgs, envelope{Kind: kindClosing, Data: []byte(roomHash(l.room.ID))})
+		}
+	}
+	n.mu.Unlock()
+
+	for _, msg := range msgs {
+		n.publish(roomsChannel, msg)
+	}
+}
+
+// handleRooms keeps the directory of remote rooms
+func (n *Node) handleRooms(data []byte) {
+	msg, err := unmarshalEnvelope(data)
+	if err != nil || msg.Node == n.id {
+		return
+	}
+
+	hash := string(msg.Data)
+	switch msg.Kind {
+	case kindHello:
+		go n.announce()
+
+	case kindHostCall:
+		go n.serveHostCall(msg)
+
+	case kindHosted, kindOpen:
+		n.mu.Lock()
+		prev, known := n.remote[hash]
+		// Rooms never close again once open, nor stop closing, so a late
+		// "hosted" that raced an "open" doesn't undo it
+		wasOpen := known && prev.open && prev.node == msg.Node
+		wasClosing := known && prev.closing && prev.node == msg.Node
+		n.remote[hash] = remoteRoom{node: msg.Node, open: msg.Kind == kindOpen || wasOpen, closing: wasClosing, options: msg.Client, seen: time.Now()}
+		var opened *room.Room
+		if msg.Kind == kindOpen && !wasOpen {
+			// A proxy made while the room was still closed can take joins now
+			for _, l := range n.links {
+				if !l.hosted && roomHash(l.room.ID) == hash {
+					opened = l.room
+				}
+			}
+		}
+		n.mu.Unlock()
+		if opened != nil {
+			opened.OpenRoom()
+		}
+
+	case kindClosing:
+		n.mu.Lock()
+		remote, known := n.remote[hash]
+		if !known || remote.node != msg.Node || remote.closing {
+			n.mu.Unlock()
+			return
+		}
+		remote.closing = true
+		n.remote[hash] = remote
+		// Proxies made before the countdown refuse joins from now on
+		var closing *room.Room
+		for _, l := range n.links {
+			if !l.hosted && roomHash(l.room.ID) == hash {
+				closing = l.room
+			}
+		}
+		n.mu.Unlock()
+		if closing != nil {
+			closing.BeginClosing()
+		}
+
+	case kindGone:
+		n.mu.Lock()
+		// The room may have moved on to another node since
+		if n.remote[hash].node == msg.Node {
+			delete(n.remote, hash)
+		}
+		n.mu.Unlock()
+
+	case kindResume:
+		var m grantMessage
+		if json.Unmarshal(msg.Data, &m) != nil {
+			return
+		}
+		m.Grant.origin = m.Origin
+		n.mu.Lock()
+		n.grants[msg.Client] = grant{Grant: m.Grant, room: m.Room, expires: time.Now().Add(ResumeTTL)}
+		n.mu.Unlock()
+
+	case kindResumed:
+		n.mu.Lock()
+		delete(n.grants, msg.Client)
+		n.mu.Unlock()
+	}
+}
+
+// roomDestroyed takes a destroyed room off the cluster. For a hosted room
+// the proxies on other nodes are told to close too, unless the room is
+// migrating: they then hold their clients until the host resumes it, or
+// until its announcement runs out.
+func (n *Node) roomDestroyed(roomID, reason string) {
+	n.mu.Lock()
+	l := n.links[roomID]
+	delete(n.links, roomID)
+	n.mu.Unlock()
+
+	if l == nil {
+		return
+	}
+	l.halt()
+	if l.hosted && reason != ReasonMigrated {
+		l.publish(envelope{Kind: kindDestroy, Data: []byte(reason)})
+		n.publish(roomsChannel, envelope{Kind: kindGone, Data: []byte(roomHash(roomID))})
+	}
+	// Off the dispatch path: the destroy may have been triggered by it
+	go l.sub.Unsubscribe()
+}
+
+func (n *Node) publish(channel string, msg envelope) {
+	msg.Node = n.id
+	data, err := msg.marshal()
+	if err != nil {
+		log.Printf("Cluster: publish failed: %v", err)
+		return
+	}
+	if err := n.backplane.Publish(channel, data); err != nil {
+		log.Printf("Cluster: publish failed: %v", err)
+	}
+}
+
+// Broadcast publishes a broadcast for clients on other nodes
+func (l *link) Broadcast(exceptID string, msg []byte) {
+	l.publish(envelope{Kind: kindBroadcast, Client: exceptID, Data: msg})
+}
+
+// Direct publishes a frame for a client on another node
+func (l *link) Direct(clientID string, msg []byte) {
+	l.publish(envelope{Kind: kindDirect, Client: clientID, Data: msg})
+}
+
+// Profile publishes a member's profile for the room's other nodes to keep
+func (l *link) Profile(clientID string, msg []byte) {
+	l.publish(envelope{Kind: kindProfile, Client: clientID, Data: msg})
+}
+
+func (l *link) publish(msg envelope) {
+	l.node.publish(l.channel, msg)
+}
+
+// handle delivers a frame from another node to this node's side of the room
+func (l *link) handle(data []byte) {
+	msg, err := unmarshalEnvelope(data)
+	if err != nil || msg.Node == l.node.id {
+		return
+	}
+
+	switch msg.Kind {
+	case kindToHost:
+		if l.hosted {
+			l.room.SendToHost(msg.Data)
+		}
+
+	case kindBroadcast:
+		l.room.DeliverToClients(msg.Client, msg.Data)
+
+	case kindDirect:
+		l.room.DeliverToClient(msg.Client, msg.Data)
+
+	case kindApprove:
+		l.room.ApproveClient(msg.Client)
+
+	case kindProfile:
+		l.room.StoreProfile(msg.Client, msg.Data)
+
+	case kindKick:
+		// The client's writer flushes KICKED and hangs up once it's removed
+		if l.room.DeliverToClient(msg.Client, []byte(`{"type":"KICKED","reason":"kicked_by_host"}`)) {
+			l.room.RemoveClient(msg.Client)
+		}
+
+	case kindConsume:
+		if l.hosted {
+			go l.node.serveConsume(l, msg)
+		}
+
+	case kindRestore:
+		if l.hosted {
+			l.node.serveRestore(string(msg.Data))
+		}
+
+	case kindDestroy:
+		if !l.hosted {
+			go l.closeProxy(string(msg.Data))
+		}
+	}
+}
+
+// forwardToHost publishes whatever the proxy's clients send the host.
+// The room's destroy queues a ROOM_DESTROYED for the host; stop is
+// closed first so it isn't passed on.
+func (l *link) forwardToHost() {
+	for frame := range l.room.HostSendCh {
+		select {
+		case <-l.stop:
+			frame.Release()
+			continue
+		default:
+		}
+		l.publish(envelope{Kind: kindToHost, Data: frame.Data})
+		frame.Release()
+	}
+}
+
+// closeProxy destroys a proxy room. Safe to call more than once.
+func (l *link) closeProxy(reason string) {
+	l.halt()
+	l.node.registry.DestroyRoom(l.room.ID, reason)
+}
+
+// halt stops a proxy forwarding to the host
+func (l *link) halt() {
+	if l.stop != nil {
+		l.halted.Do(func() { close(l.stop) })
+	}
+}
+
+// roomOptions encodes the options a host chose for its room that its
+// proxies must apply too, as a URL query. It travels in the announcement's
+// client ID, which nodes that predate room options ignore.
+func roomOptions(rm *room.Room) string {
+	v := url.Values{}
+	if pad := rm.Padding(); pad > 0 {
+		v.Set("pad", strconv.Itoa(pad))
+	}
+	if jitter := rm.Jitter(); jitter > 0 {
+		v.Set("jitter", jitter.String())
+	}
+	return v.Encode()
+}
+
+// applyRoomOptions sets announced room options on a proxy. The hosting
+// node checked them.
+func applyRoomOptions(rm *room.Room, options string) {
+	v, _ := url.ParseQuery(options)
+	if pad, err := strconv.Atoi(v.Get("pad")); err == nil {
+		rm.SetPadding(pad)
+	}
+	if jitter, err := time.ParseDuration(v.Get("jitter")); err == nil {
+		rm.SetJitter(jitter)
+	}
+}
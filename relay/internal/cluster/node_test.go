@@ -0,0 +1,257 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/redis/go-redis/v9"
+)
+
+const testRoomID = "cluster-room-0123456789-abcdefghijklmnopqrs"
+
+// redisBackplanes returns a factory for backplanes on one Redis
+func redisBackplanes(t *testing.T) func() Backplane {
+	mr := miniredis.RunT(t)
+	return func() Backplane {
+		return NewRedisBackplane(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	}
+}
+
+// newTestNode starts a node on a fresh registry
+func newTestNode(t *testing.T, backplane Backplane) (*Node, *room.Registry) {
+	t.Helper()
+	registry := room.NewRegistry()
+	n, err := NewNode(backplane, registry)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n, registry
+}
+
+// eventually polls cond until it holds or a second has passed
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, ch <-chan room.Frame) []byte {
+	t.Helper()
+	select {
+	case f := <-ch:
+		return f.Data
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a frame")
+		return nil
+	}
+}
+
+// TestEnvelopeRoundTrip verifies envelopes survive encoding
+func TestEnvelopeRoundTrip(t *testing.T) {
+	in := envelope{Kind: kindDirect, Node: "node", Client: "client", Data: []byte("ciphertext")}
+	data, err := in.marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	out, err := unmarshalEnvelope(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if out.Kind != in.Kind || out.Node != in.Node || out.Client != in.Client || !bytes.Equal(out.Data, in.Data) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+
+	for _, bad := range [][]byte{nil, {kindDirect}, {kindDirect, 5, 'a'}} {
+		if _, err := unmarshalEnvelope(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+
+	// An ID too long for its length byte would wrap into a different one
+	long := strings.Repeat("a", 256)
+	for _, e := range []envelope{{Kind: kindDirect, Client: long}, {Kind: kindDirect, Node: long}} {
+		if _, err := e.marshal(); !errors.Is(err, errIDTooLong) {
+			t.Errorf("Expected a %d byte ID refused, got %v", len(long), err)
+		}
+	}
+}
+
+// TestRoomSpansNodes verifies a client on one node and a host on another
+// exchange frames over each backplane, and that the client's node closes
+// its proxy with the room
+func TestRoomSpansNodes(t *testing.T) {
+	t.Run("redis", func(t *testing.T) { testRoomSpansNodes(t, redisBackplanes(t)) })
+	t.Run("nats", func(t *testing.T) { testRoomSpansNodes(t, natsBackplanes(t)) })
+}
+
+func testRoomSpansNodes(t *testing.T, backplane func() Backplane) {
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, registryB := newTestNode(t, backplane())
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	hostRoom.SetPadding(256)
+	hostRoom.SetJitter(50 * time.Millisecond)
+	if err := nodeA.Hosting(hostRoom); err != nil {
+		t.Fatalf("Hosting failed: %v", err)
+	}
+	hostRoom.OpenRoom()
+	nodeA.Opened(hostRoom)
+
+	eventually(t, "the room to be announced", func() bool { return nodeB.HostedElsewhere(testRoomID) })
+	if nodeA.HostedElsewhere(testRoomID) {
+		t.Error("Expected a node not to see its own room as hosted elsewhere")
+	}
+	eventually(t, "the room to be announced open", func() bool {
+		nodeB.mu.Lock()
+		defer nodeB.mu.Unlock()
+		return nodeB.remote[roomHash(testRoomID)].open
+	})
+
+	proxy := nodeB.Proxy(testRoomID)
+	if proxy == nil {
+		t.Fatal("Expected a proxy for a room hosted on another node")
+	}
+	if nodeB.Proxy(testRoomID) != proxy {
+		t.Error("Expected joiners on one node to share its proxy")
+	}
+	if proxy.Padding() != 256 || proxy.Jitter() != 50*time.Millisecond {
+		t.Errorf("Expected the proxy to take the host's room options, got padding %d, jitter %v", proxy.Padding(), proxy.Jitter())
+	}
+	client, err := proxy.AddClient("c1", nil)
+	if err != nil {
+		t.Fatalf("Expected to join the proxy of an open room: %v", err)
+	}
+
+	proxy.SendToHost([]byte("join-request"))
+	if got := string(receive(t, hostRoom.HostSendCh)); got != "join-request" {
+		t.Errorf("Expected the host to get the client's frame, got %q", got)
+	}
+
+	hostRoom.SendToClient("c1", []byte("join-response"))
+	if got := string(receive(t, client.SendCh)); got != "join-response" {
+		t.Errorf("Expected the remote client to get a direct frame, got %q", got)
+	}
+
+	if hostRoom.ApproveClient("c1") {
+		t.Error("Expected the host's room not to hold a remote client")
+	}
+	nodeA.Approve(hostRoom, "c1")
+	eventually(t, "the remote client to be approved", client.Approved)
+
+	member, _ := hostRoom.AddConfirmedClient("c2", nil, room.RoleParticipant)
+	proxy.SetProfile("c1", []byte("profile-c1"))
+	proxy.ConfirmClient("c1")
+	if got := string(receive(t, member.SendCh)); got != "profile-c1" {
+		t.Errorf("Expected the host's node to pass on the remote client's profile, got %q", got)
+	}
+
+	hostRoom.BroadcastToClients([]byte("broadcast"))
+	if got := string(receive(t, client.SendCh)); got != "broadcast" {
+		t.Errorf("Expected the remote client to get a broadcast, got %q", got)
+	}
+
+	registryA.DestroyRoom(testRoomID, "host_disconnected")
+	eventually(t, "the proxy to close", func() bool { return registryB.GetRoom(testRoomID) == nil })
+	if got := string(receive(t, client.SendCh)); !strings.Contains(got, "host_disconnected") {
+		t.Errorf("Expected the client to be told why the room closed, got %q", got)
+	}
+	eventually(t, "the room to be withdrawn", func() bool { return !nodeB.HostedElsewhere(testRoomID) })
+}
+
+// TestRoomClosingSpansNodes verifies a room's closing countdown reaches
+// its proxies, those made before it and those made after, so joins are
+// refused on every node, and that a later open announcement doesn't undo it
+func TestRoomClosingSpansNodes(t *testing.T) {
+	backplane := redisBackplanes(t)
+	nodeA, registryA := newTestNode(t, backplane())
+	nodeB, _ := newTestNode(t, backplane())
+
+	hostRoom, _ := registryA.CreateRoom(testRoomID, nil)
+	if err := nodeA.Hosting(hostRoom); err != nil {
+		t.Fatalf("Hosting failed: %v", err)
+	}
+	hostRoom.OpenRoom()
+	nodeA.Opened(hostRoom)
+	eventually(t, "the room to be announced open", func() bool {
+		nodeB.mu.Lock()
+		defer nodeB.mu.Unlock()
+		return nodeB.remote[roomHash(testRoomID)].open
+	})
+	proxy := nodeB.Proxy(testRoomID)
+	if _, err := proxy.AddClient("c1", nil); err != nil {
+		t.Fatalf("Expected to join the proxy of an open room: %v", err)
+	}
+
+	hostRoom.BeginClosing()
+	nodeA.Closing(hostRoom)
+	eventually(t, "the proxy to refuse joins", func() bool {
+		_, err := proxy.AddClient("c2", nil)
+		return errors.Is(err, room.ErrRoomClosing)
+	})
+
+	nodeA.announce()
+	nodeC, _ := newTestNode(t, backplane())
+	eventually(t, "a new node to learn the room is closing", func() bool {
+		nodeC.mu.Lock()
+		defer nodeC.mu.Unlock()
+		return nodeC.remote[roomHash(testRoomID)].closing
+	})
+	if _, err := nodeC.Proxy(testRoomID).AddClient("c3", nil); !errors.Is(err, room.ErrRoomClosing) {
+		t.Errorf("Expected a proxy made during the countdown to refuse joins, got %v", err)
+	}
+	nodeB.mu.Lock()
+	closing := nodeB.remote[roomHash(testRoomID)].closing
+	nodeB.mu.Unlock()
+	if !closing {
+		t.Error("Expected a re-announcement not to undo the countdown")
+	}
+}
+
+// TestProxyReaped verifies proxies go once their host stops announcing
+// and once they sit empty
+func TestProxyReaped(t *testing.T) {
+	nodeB, registryB := newTestNode(t, redisBackplanes(t)())
+
+	nodeB.mu.Lock()
+	nodeB.remote[roomHash(testRoomID)] = remoteRoom{node: "a", open: true, seen: time.Now()}
+	nodeB.mu.Unlock()
+
+	proxy := nodeB.Proxy(testRoomID)
+	proxy.AddClient("c1", nil)
+
+	nodeB.tick(time.Now().Add(ProxyIdle + time.Second))
+	if registryB.GetRoom(testRoomID) == nil {
+		t.Fatal("Expected a proxy with clients to survive while its host announces")
+	}
+
+	proxy.RemoveClient("c1")
+	nodeB.tick(time.Now().Add(ProxyIdle + time.Second))
+	if registryB.GetRoom(testRoomID) != nil {
+		t.Error("Expected an idle proxy to be reaped")
+	}
+
+	proxy = nodeB.Proxy(testRoomID)
+	nodeB.tick(time.Now().Add(AnnounceTTL + time.Second))
+	if registryB.GetRoom(testRoomID) != nil || nodeB.HostedElsewhere(testRoomID) {
+		t.Error("Expected the proxy to go with its host's expired announcement")
+	}
+}
+
+// TestNilNode verifies a standalone relay's nil node is inert
+func TestNilNode(t *testing.T) {
+	var n *Node
+	if n.HostedElsewhere(testRoomID) || n.Proxy(testRoomID) != nil || n.Hosting(nil) != nil || n.Close() != nil {
+		t.Error("Expected a nil node to do nothing")
+	}
+}
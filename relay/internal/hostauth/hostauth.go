@@ -0,0 +1,56 @@
+// Package hostauth decides who may create rooms on a relay that doesn't
+// let just anyone host. A would-be host presents a credential with its
+// upgrade, as a bearer token or an auth query parameter; joiners never
+// need one, so joining stays anonymous.
+//
+// The relay learns nothing about a host from its credential beyond which
+// key, or which identity provider subject, vouched for it.
+package hostauth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Errors
+var (
+	ErrNoCredential = errors.New("no host credential presented")
+	ErrUnauthorized = errors.New("host credential not accepted")
+)
+
+// Authorizer checks the credential a would-be host presented, empty if it
+// presented none
+type Authorizer interface {
+	AuthorizeHost(credential string) error
+}
+
+// FromRequest returns the credential an upgrade request presents: its
+// bearer token, or else its auth query parameter, for browsers that
+// can't set headers on a WebSocket
+func FromRequest(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer
+	}
+	return r.URL.Query().Get("auth")
+}
+
+// Any accepts a credential any of authorizers accepts, so API keys and
+// identity provider tokens can both host
+func Any(authorizers ...Authorizer) Authorizer {
+	return anyOf(authorizers)
+}
+
+type anyOf []Authorizer
+
+func (a anyOf) AuthorizeHost(credential string) error {
+	if credential == "" {
+		return ErrNoCredential
+	}
+	for _, auth := range a {
+		if auth.AuthorizeHost(credential) == nil {
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
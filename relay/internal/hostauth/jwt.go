@@ -0,0 +1,367 @@
+package hostauth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // for the RS, PS and ES algorithms' hashes
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSkew is how far a token's exp and nbf may be off the relay's clock
+const ClockSkew = time.Minute
+
+// JWT accepts signed JSON Web Tokens from an identity provider as host
+// credentials, an Authorizer. A token must be signed by one of its keys,
+// unexpired, and from its issuer for its audience where those are set.
+//
+// Nothing else is read from a token: the relay learns at most the
+// opaque subject the provider chose, never who the user is.
+type JWT struct {
+	issuer   string // empty accepts any
+	audience string // empty accepts any
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey // by key ID, "" for keys without one
+}
+
+// NewJWT returns a verifier for tokens from issuer for audience. It
+// accepts none until SetKeys gives it the provider's keys.
+func NewJWT(issuer, audience string) *JWT {
+	return &JWT{issuer: issuer, audience: audience, now: time.Now, keys: map[string]crypto.PublicKey{}}
+}
+
+// SetKeys replaces the keys tokens must be signed with, from either a
+// JWKS document, as identity providers publish, or a PEM public key or
+// certificate. Symmetric keys in a JWKS are skipped.
+func (j *JWT) SetKeys(data []byte) error {
+	keys, err := parseKeys(data)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing keys found")
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// jwtHeader is the part of a JOSE header verification reads
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the registered claims checked
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the aud claim, a string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// AuthorizeHost accepts a credential that is a valid token
+func (j *JWT) AuthorizeHost(credential string) error {
+	if credential == "" {
+		return ErrNoCredential
+	}
+	if err := j.verify(credential); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return nil
+}
+
+// verify checks a compact-serialized token's signature and claims
+func (j *JWT) verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("not a JWT")
+	}
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+
+	j.mu.RLock()
+	key, ok := j.keys[hdr.Kid]
+	j.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown key %q", hdr.Kid)
+	}
+	if err := verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("claims: %w", err)
+	}
+	now := j.now()
+	if claims.ExpiresAt == nil {
+		return errors.New("no expiry")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(ClockSkew)) {
+		return errors.New("expired")
+	}
+	if claims.NotBefore != nil && now.Add(ClockSkew).Before(unixTime(*claims.NotBefore)) {
+		return errors.New("not yet valid")
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return fmt.Errorf("issuer %q", claims.Issuer)
+	}
+	if j.audience != "" && !contains(claims.Audience, j.audience) {
+		return errors.New("not for this audience")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(0, int64(sec*float64(time.Second)))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rsaAlgorithms are the hashes of the RSA signature algorithms accepted
+var rsaAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+}
+
+// verifySignature checks sig over signed with key, by alg, which must
+// suit the key: a token can't pick a weaker algorithm than its key's
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashed := func(h crypto.Hash) []byte {
+		w := h.New()
+		w.Write(signed)
+		return w.Sum(nil)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		h, ok := rsaAlgorithms[alg]
+		switch {
+		case !ok:
+		case alg[0] == 'R':
+			return rsa.VerifyPKCS1v15(k, h, hashed(h), sig)
+		default:
+			return rsa.VerifyPSS(k, h, hashed(h), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		var h crypto.Hash
+		switch {
+		case alg == "ES256" && k.Curve == elliptic.P256():
+			h = crypto.SHA256
+		case alg == "ES384" && k.Curve == elliptic.P384():
+			h = crypto.SHA384
+		case alg == "ES512" && k.Curve == elliptic.P521():
+			h = crypto.SHA512
+		default:
+			return fmt.Errorf("algorithm %q doesn't suit the key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, hashed(h), r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q doesn't suit the key", alg)
+}
+
+// parseKeys reads a JWKS document or PEM blocks into keys by key ID. PEM
+// keys have none, so tokens naming a kid won't match them.
+func parseKeys(data []byte) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("JWKS: %w", err)
+		}
+		for _, k := range set.Keys {
+			// Encryption and shared secret keys can't vouch for anyone
+			if (k.Use != "" && k.Use != "sig") || k.Kty == "oct" {
+				continue
+			}
+			pub, err := k.publicKey()
+			if err != nil {
+				return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = pub
+		}
+		return keys, nil
+	}
+
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		var pub crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			pub = k
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			pub = cert.PublicKey
+		default:
+			continue
+		}
+		if len(keys) > 0 {
+			return nil, errors.New("PEM holds more than one key; use a JWKS document to name them")
+		}
+		keys[""] = pub
+	}
+	return keys, nil
+}
+
+// jwk is one JSON Web Key of a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) ([]byte, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err == nil && len(b) == 0 {
+			err = errors.New("missing field")
+		}
+		return b, err
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := field(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("curve %q", k.Crv)
+		}
+		x, err := field(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("bad point")
+		}
+		// Refuse points off the curve
+		if _, err := check.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("curve %q", k.Crv)
+		}
+		x, err := field(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("key type %q", k.Kty)
+}
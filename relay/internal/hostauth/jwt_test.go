@@ -0,0 +1,158 @@
+package hostauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testNow is the verifier's clock in these tests
+var testNow = time.Unix(1700000000, 0)
+
+// signJWT makes a compact JWT over claims, signed by key under alg
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims are claims a verifier for issuer "idp" and audience "relay"
+// accepts
+func validClaims() map[string]any {
+	return map[string]any{"iss": "idp", "aud": []string{"relay", "other"}, "sub": "opaque-123", "exp": testNow.Add(time.Hour).Unix()}
+}
+
+// TestJWTAuthorize verifies signed tokens from the issuer for the
+// audience host, and forged, expired or misdirected ones don't
+func TestJWTAuthorize(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"EC","kid":"ec","use":"sig","crv":"P-256","x":%q,"y":%q},
+		{"kty":"OKP","kid":"ed","crv":"Ed25519","x":%q},
+		{"kty":"EC","kid":"enc","use":"enc","crv":"P-256","x":"","y":""}
+	]}`, b64(ecKey.X.FillBytes(make([]byte, 32))), b64(ecKey.Y.FillBytes(make([]byte, 32))), b64(edPub))
+
+	j := NewJWT("idp", "relay")
+	j.now = func() time.Time { return testNow }
+	if err := j.AuthorizeHost(signJWT(t, "ES256", "ec", ecKey, validClaims())); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected tokens refused before SetKeys, got %v", err)
+	}
+	if err := j.SetKeys([]byte(jwks)); err != nil {
+		t.Fatalf("Failed to set keys: %v", err)
+	}
+
+	with := func(k string, v any) map[string]any {
+		c := validClaims()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, validClaims()), true},
+		{"EdDSA", signJWT(t, "EdDSA", "ed", edKey, validClaims()), true},
+		{"single audience", signJWT(t, "ES256", "ec", ecKey, with("aud", "relay")), true},
+		{"within clock skew", signJWT(t, "ES256", "ec", ecKey, with("exp", testNow.Add(-ClockSkew/2).Unix())), true},
+		{"other signer", signJWT(t, "ES256", "ec", otherKey, validClaims()), false},
+		{"unknown kid", signJWT(t, "ES256", "nope", ecKey, validClaims()), false},
+		{"algorithm not the key's", signJWT(t, "EdDSA", "ec", edKey, validClaims()), false},
+		{"expired", signJWT(t, "ES256", "ec", ecKey, with("exp", testNow.Add(-time.Hour).Unix())), false},
+		{"no expiry", signJWT(t, "ES256", "ec", ecKey, with("exp", nil)), false},
+		{"not yet valid", signJWT(t, "ES256", "ec", ecKey, with("nbf", testNow.Add(time.Hour).Unix())), false},
+		{"other issuer", signJWT(t, "ES256", "ec", ecKey, with("iss", "evil")), false},
+		{"other audience", signJWT(t, "ES256", "ec", ecKey, with("aud", "chat")), false},
+		{"alg none", signJWT(t, "none", "ec", ecKey, validClaims()), false},
+		{"garbage", "not.a.jwt", false},
+	}
+	for _, tt := range tests {
+		err := j.AuthorizeHost(tt.token)
+		if tt.ok && err != nil {
+			t.Errorf("%s: Expected accepted, got %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: Expected ErrUnauthorized, got %v", tt.name, err)
+		}
+	}
+}
+
+// TestJWTPEMKey verifies a PEM public key verifies tokens naming no key ID
+func TestJWTPEMKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	j := NewJWT("", "")
+	j.now = func() time.Time { return testNow }
+	if err := j.SetKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err != nil {
+		t.Fatalf("Failed to set keys: %v", err)
+	}
+
+	if err := j.AuthorizeHost(signJWT(t, "RS256", "", rsaKey, validClaims())); err != nil {
+		t.Errorf("Expected an RS256 token accepted, got %v", err)
+	}
+	if err := j.AuthorizeHost(signJWT(t, "RS256", "named", rsaKey, validClaims())); err == nil {
+		t.Error("Expected a token naming a key ID unmatched by a PEM key")
+	}
+	if err := j.SetKeys([]byte("nothing here")); err == nil {
+		t.Error("Expected keys required")
+	}
+}
+
+// TestAny verifies a credential either authorizer accepts hosts
+func TestAny(t *testing.T) {
+	keys := NewKeys()
+	keys.AddStatic("app", "secret", Quota{})
+	a := Any(NewJWT("", ""), keys)
+	if err := a.AuthorizeHost("secret"); err != nil {
+		t.Errorf("Expected the key accepted, got %v", err)
+	}
+	if err := a.AuthorizeHost("guess"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+	if err := a.AuthorizeHost(""); !errors.Is(err, ErrNoCredential) {
+		t.Errorf("Expected ErrNoCredential, got %v", err)
+	}
+}
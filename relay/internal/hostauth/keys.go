@@ -0,0 +1,142 @@
+package hostauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyLength is the number of random bytes in a key Create mints
+const KeyLength = 32
+
+// ErrKeyNotFound is a revocation naming no key
+var ErrKeyNotFound = errors.New("no such API key")
+
+// Key is what's known of an API key besides its secret, which is never
+// kept: only its hash is
+type Key struct {
+	ID      string    `json:"id"` // from the hash, safe to show and log
+	Name    string    `json:"name"`
+	Static  bool      `json:"static,omitempty"` // from the relay's configuration, not revocable
+	Created time.Time `json:"created"`
+	Quota   Quota     `json:"quota"`
+}
+
+// Quota is what hosts presenting a key may hold between them. Zero
+// fields leave the relay's own limits in place.
+type Quota struct {
+	Rooms        int    `json:"rooms,omitempty"`        // rooms open at once
+	Clients      int    `json:"clients,omitempty"`      // clients connected at once across those rooms
+	BytesPerHour int64  `json:"bytesPerHour,omitempty"` // bytes relayed through them per hour
+	Tokens       int    `json:"tokens,omitempty"`       // invite tokens outstanding across those rooms
+	Profile      string `json:"profile,omitempty"`      // rate limit profile their traffic is held to
+}
+
+// Keys is a set of API keys allowed to host, an Authorizer. Static keys
+// come from the relay's configuration; managed ones are minted and
+// revoked at runtime through the admin API.
+type Keys struct {
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]Key
+}
+
+// NewKeys returns an empty key set, which lets no one host
+func NewKeys() *Keys {
+	return &Keys{keys: make(map[[sha256.Size]byte]Key)}
+}
+
+// AddStatic allows secret to host under name, within quota, for as long
+// as the relay runs
+func (k *Keys) AddStatic(name, secret string, quota Quota) (Key, error) {
+	if secret == "" {
+		return Key{}, errors.New("empty API key")
+	}
+	return k.add(name, secret, quota, true), nil
+}
+
+// Create mints a managed key. The secret is returned this once and can't
+// be recovered.
+func (k *Keys) Create(name string, quota Quota) (secret string, key Key, err error) {
+	b := make([]byte, KeyLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", Key{}, err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, k.add(name, secret, quota, false), nil
+}
+
+func (k *Keys) add(name, secret string, quota Quota, static bool) Key {
+	sum := sha256.Sum256([]byte(secret))
+	key := Key{ID: hex.EncodeToString(sum[:6]), Name: name, Static: static, Created: time.Now(), Quota: quota}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[sum] = key
+	return key
+}
+
+// Revoke stops a managed key hosting. Rooms it already created live on.
+func (k *Keys) Revoke(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for sum, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+		if key.Static {
+			return errors.New("static API keys can only be removed from the configuration")
+		}
+		delete(k.keys, sum)
+		return nil
+	}
+	return ErrKeyNotFound
+}
+
+// List returns every key, oldest first
+func (k *Keys) List() []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// AuthorizeHost accepts a credential that is one of the keys. Keys are
+// looked up by hash, so the comparison takes no time that depends on
+// how much of a guess is right.
+func (k *Keys) AuthorizeHost(credential string) error {
+	if credential == "" {
+		return ErrNoCredential
+	}
+	sum := sha256.Sum256([]byte(credential))
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if _, ok := k.keys[sum]; !ok {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Lookup returns the key credential is, if it's one of them
+func (k *Keys) Lookup(credential string) (Key, bool) {
+	if credential == "" {
+		return Key{}, false
+	}
+	sum := sha256.Sum256([]byte(credential))
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[sum]
+	return key, ok
+}
@@ -0,0 +1,75 @@
+package hostauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestKeysAuthorize verifies static and managed keys host, anything else
+// doesn't, and a revoked key stops
+func TestKeysAuthorize(t *testing.T) {
+	k := NewKeys()
+	if _, err := k.AddStatic("app", "static-secret", Quota{}); err != nil {
+		t.Fatalf("Failed to add a static key: %v", err)
+	}
+	secret, managed, err := k.Create("ci", Quota{})
+	if err != nil {
+		t.Fatalf("Failed to create a key: %v", err)
+	}
+
+	for _, cred := range []string{"static-secret", secret} {
+		if err := k.AuthorizeHost(cred); err != nil {
+			t.Errorf("Expected %q accepted, got %v", cred, err)
+		}
+	}
+	if err := k.AuthorizeHost(""); !errors.Is(err, ErrNoCredential) {
+		t.Errorf("Expected ErrNoCredential, got %v", err)
+	}
+	if err := k.AuthorizeHost("guess"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+
+	if err := k.Revoke(managed.ID); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	if err := k.AuthorizeHost(secret); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected a revoked key refused, got %v", err)
+	}
+	if err := k.Revoke(managed.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound revoking twice, got %v", err)
+	}
+}
+
+// TestKeysListHidesSecrets verifies the listing carries IDs and names
+// only, and static keys can't be revoked
+func TestKeysListHidesSecrets(t *testing.T) {
+	k := NewKeys()
+	static, _ := k.AddStatic("app", "static-secret", Quota{})
+	k.Create("ci", Quota{})
+
+	keys := k.List()
+	if len(keys) != 2 || keys[0].ID != static.ID || !keys[0].Static {
+		t.Fatalf("Expected the static key first of two, got %+v", keys)
+	}
+	for _, key := range keys {
+		if key.ID == "" || key.ID == "static-secret" {
+			t.Errorf("Expected an ID from the hash, got %q", key.ID)
+		}
+	}
+	if err := k.Revoke(static.ID); err == nil {
+		t.Error("Expected a static key not revocable")
+	}
+}
+
+// TestFromRequest verifies the bearer token wins over the query parameter
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/rooms/x?auth=query", nil)
+	if got := FromRequest(r); got != "query" {
+		t.Errorf("Expected the query credential, got %q", got)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if got := FromRequest(r); got != "header" {
+		t.Errorf("Expected the bearer credential, got %q", got)
+	}
+}
@@ -0,0 +1,167 @@
+package invite
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/gorilla/websocket"
+)
+
+// FuzzStatelessToken verifies arbitrary token strings are refused without
+// panicking, and that whatever does validate belongs to the token
+func FuzzStatelessToken(f *testing.F) {
+	st := newTestStateless(f)
+	f.Cleanup(st.Stop)
+
+	token, err := st.CreateTokenWithOptions(handlerTestRoomID, TokenOptions{
+		Scope:    room.RoleObserver,
+		Metadata: []byte(`{"label":"fuzz"}`),
+	})
+	if err != nil {
+		f.Fatalf("Failed to create token: %v", err)
+	}
+	f.Add(token.ID)
+	f.Add(StatelessPrefix)
+	f.Add(StatelessPrefix + "AAAA")
+	f.Add(token.ID[:len(token.ID)-1])
+	f.Add("not-a-token")
+
+	f.Fuzz(func(t *testing.T, tokenID string) {
+		got, err := st.Peek(tokenID)
+		if err != nil {
+			return
+		}
+		if got.ID != tokenID {
+			t.Errorf("Expected token ID %q, got %q", tokenID, got.ID)
+		}
+		st.Consume(tokenID, "")
+	})
+}
+
+// FuzzStatelessBody verifies a correctly signed but malformed token body,
+// as only a leaked key could produce, is refused without panicking
+func FuzzStatelessBody(f *testing.F) {
+	st := newTestStateless(f)
+	f.Cleanup(st.Stop)
+
+	for _, opts := range []TokenOptions{
+		{},
+		{Scope: room.RoleObserver, Metadata: []byte(`{"label":"fuzz"}`)},
+		{Fingerprint: "fuzz-fingerprint-0123456789"},
+	} {
+		token, err := st.CreateTokenWithOptions(handlerTestRoomID, opts)
+		if err != nil {
+			f.Fatalf("Failed to create token: %v", err)
+		}
+		body, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token.ID, StatelessPrefix))
+		f.Add(body[:len(body)-statelessMACSize])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff})
+
+	f.Fuzz(func(t *testing.T, signed []byte) {
+		body := append(signed[:len(signed):len(signed)], st.mac(signed)...)
+		tokenID := StatelessPrefix + base64.RawURLEncoding.EncodeToString(body)
+		token, _, err := st.decode(tokenID)
+		if err != nil {
+			return
+		}
+		if token.Scope == "" {
+			t.Errorf("Expected a decoded token to carry a scope, got none")
+		}
+	})
+}
+
+// FuzzRedisToken verifies a corrupt record in Redis is an error, never a
+// panic, and that a record that does decode encodes back to the same token
+func FuzzRedisToken(f *testing.F) {
+	raw, err := encodeRedisToken(&Token{
+		RoomID:    handlerTestRoomID,
+		CreatedAt: time.Unix(1700000000, 0),
+		ExpiresAt: time.Unix(1700003600, 0),
+		Scope:     room.RoleParticipant,
+		Metadata:  []byte(`{"label":"fuzz"}`),
+	})
+	if err != nil {
+		f.Fatalf("Failed to encode token: %v", err)
+	}
+	f.Add(strings.Repeat("a", 32), raw)
+	f.Add("short", "{")
+	f.Add("", "")
+	f.Add("v1.token", `{"r":1}`)
+
+	f.Fuzz(func(t *testing.T, tokenID, raw string) {
+		token, err := decodeRedisToken(tokenID, raw)
+		if err != nil {
+			return
+		}
+		again, err := encodeRedisToken(token)
+		if err != nil {
+			t.Fatalf("Failed to re-encode decoded token: %v", err)
+		}
+		back, err := decodeRedisToken(tokenID, again)
+		if err != nil {
+			t.Fatalf("Failed to decode re-encoded token: %v", err)
+		}
+		if back.RoomID != token.RoomID || back.Scope != token.Scope || !back.ExpiresAt.Equal(token.ExpiresAt) {
+			t.Errorf("Expected %+v after a round trip, got %+v", token, back)
+		}
+	})
+}
+
+// FuzzHandlerPaths verifies the invite API answers any method, path,
+// credential and body without panicking
+func FuzzHandlerPaths(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ts := NewTokenStore()
+	f.Cleanup(ts.Stop)
+	registry := room.NewRegistry()
+	rm, err := registry.CreateRoom(handlerTestRoomID, &websocket.Conn{})
+	if err != nil {
+		f.Fatalf("Failed to create room: %v", err)
+	}
+	limits := ratelimit.Profile{InviteRate: 1e9, InviteBurst: 1e9, ProbeRate: 1e9, ProbeBurst: 1e9}.NewLimiters()
+	f.Cleanup(limits.Stop)
+	h := NewHandler(ts, registry, limits, nil, nil)
+
+	token, err := ts.CreateToken(handlerTestRoomID)
+	if err != nil {
+		f.Fatalf("Failed to create token: %v", err)
+	}
+	secret := rm.HostSecret()
+	f.Add("POST", "/invite/create/"+handlerTestRoomID, secret, `{"ttlSeconds":60,"scope":"observer"}`)
+	f.Add("POST", "/invite/create-batch/"+handlerTestRoomID, secret, `{"count":3}`)
+	f.Add("GET", "/invite/validate/"+token.ID, "", "")
+	f.Add("GET", "/invite/list/"+handlerTestRoomID, secret, "")
+	f.Add("GET", "/invite/qr/"+handlerTestRoomID, secret, "")
+	f.Add("DELETE", "/invite/"+token.ID, secret, "")
+	f.Add("DELETE", "/invite/"+strings.Repeat("a", 32), secret, "")
+	f.Add("GET", "/invite/validate/v1.", "", "")
+	f.Add("PUT", "/invite//", "x", "{")
+
+	f.Fuzz(func(t *testing.T, method, path, auth, body string) {
+		req := &http.Request{
+			Method:     method,
+			URL:        &url.URL{Path: path},
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			RemoteAddr: "192.0.2.1:1234",
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	})
+}
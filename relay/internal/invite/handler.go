@@ -3,45 +3,150 @@ package invite
 
 import (
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/metrics"
 	"github.com/ephemeral/relay/internal/ratelimit"
 	"github.com/ephemeral/relay/internal/room"
 )
 
-var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
-var tokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{32}$`)
+var tokenPattern = regexp.MustCompile(`^([A-Za-z0-9_-]{32}|v1\.[A-Za-z0-9_-]{20,1000})$`)
+var fingerprintPattern = regexp.MustCompile(`^[A-Za-z0-9_=+/:-]{16,128}$`)
+
+// TokenBackend issues and validates invite tokens.
+// TokenStore keeps tokens in memory; StatelessTokens signs them instead.
+type TokenBackend interface {
+	CreateToken(roomID string) (*Token, error)
+	CreateTokenWithOptions(roomID string, opts TokenOptions) (*Token, error)
+	CreateTokenBatch(roomID string, n int, opts TokenOptions) ([]*Token, error)
+	Consume(tokenID, fingerprint string) (*Token, error)
+	Restore(token *Token)
+	Peek(tokenID string) (*Token, error)
+	RevokeToken(tokenID string) error
+	RevokeRoomTokens(roomID string) int
+	ListRoomTokens(roomID string) []*Token
+	Stop()
+}
+
+// RemoteTokens consumes tokens on the relay node a room's host is
+// connected to, so in a cluster that node alone decides whether a token
+// has been spent
+type RemoteTokens interface {
+	Proxied(roomID string) bool // the room's host is on another node
+	ConsumeRemote(roomID, tokenID, fingerprint string) (*Token, error)
+	RestoreRemote(token *Token)
+}
+
+// Tenants says how many invite tokens the rooms of a tenant, an API key
+// hosts create rooms with, may have outstanding between them; 0 for no
+// limit
+type Tenants interface {
+	MaxTokens(tenant string) int
+}
 
 // Handler handles HTTP requests for invite token operations
 type Handler struct {
-	tokenStore  *TokenStore
-	registry    *room.Registry
-	rateLimiter *ratelimit.Limiter
+	tokenStore TokenBackend
+	registry   *room.Registry
+	limits     *ratelimit.Limiters
+	ips        *clientip.Resolver
+	access     *ratelimit.AccessList
+	remote     RemoteTokens   // nil unless clustered
+	hosts      RemoteHosts    // nil unless clustered
+	pow        *ratelimit.PoW // nil unless SetProofOfWork
+	tenants    Tenants        // nil unless SetTenants
+	quotaMu    sync.Mutex     // serializes counting and minting tokens against a quota
 }
 
 // NewHandler creates a new invite HTTP handler
-func NewHandler(tokenStore *TokenStore, registry *room.Registry, rateLimiter *ratelimit.Limiter) *Handler {
+func NewHandler(tokenStore TokenBackend, registry *room.Registry, limits *ratelimit.Limiters, ips *clientip.Resolver, access *ratelimit.AccessList) *Handler {
 	return &Handler{
-		tokenStore:  tokenStore,
-		registry:    registry,
-		rateLimiter: rateLimiter,
+		tokenStore: tokenStore,
+		registry:   registry,
+		limits:     limits,
+		ips:        ips,
+		access:     access,
 	}
 }
 
+// SetRemote makes tokens this node doesn't hold consumable through r
+func (h *Handler) SetRemote(r RemoteTokens) {
+	h.remote = r
+}
+
+// SetTenants holds the rooms of hosts that presented an API key to its
+// token quota. Tokens are counted as the backend lists them, so stateless
+// tokens, which it can't, are never refused for it.
+func (h *Handler) SetTenants(t Tenants) {
+	h.tenants = t
+}
+
+// SetProofOfWork makes requests with no address of their own, from the
+// onion service, each pay in work in place of the per-IP budgets
+func (h *Handler) SetProofOfWork(pow *ratelimit.PoW) {
+	h.pow = pow
+}
+
+const (
+	MaxCreateBodySize  = 2048 // Bounds the optional JSON body on token creation
+	TokenDisplayLength = 8    // Token ID prefix shown when listing
+)
+
+// Request types
+type CreateTokenRequest struct {
+	TTLSeconds  int64  `json:"ttlSeconds,omitempty"`  // Requested lifetime, clamped to server bounds
+	Scope       string `json:"scope,omitempty"`       // participant (default), observer or cohost
+	Fingerprint string `json:"fingerprint,omitempty"` // Joiner's public key fingerprint the token is bound to
+	Metadata    []byte `json:"metadata,omitempty"`    // Base64 blob, encrypted by the host, returned on validation
+}
+
+type CreateBatchRequest struct {
+	CreateTokenRequest
+	Count int `json:"count"` // 1..MaxTokensPerRoom
+}
+
 // Response types
 type CreateTokenResponse struct {
 	Token     string `json:"token"`
 	RoomID    string `json:"roomId"`
 	ExpiresIn int64  `json:"expiresIn"` // Seconds until expiration
+	ExpiresAt int64  `json:"expiresAt"` // Unix time of expiration
+	Scope     string `json:"scope"`
+}
+
+type CreateBatchResponse struct {
+	Tokens []CreateTokenResponse `json:"tokens"`
 }
 
 type ValidateTokenResponse struct {
-	Valid  bool   `json:"valid"`
-	RoomID string `json:"roomId,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Valid    bool   `json:"valid"`
+	RoomID   string `json:"roomId,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Bound    bool   `json:"bound,omitempty"`    // Join must present the matching fingerprint
+	Metadata []byte `json:"metadata,omitempty"` // The host's opaque blob, as given at creation
+	Error    string `json:"error,omitempty"`
+}
+
+type TokenSummary struct {
+	ID        string `json:"id"` // truncated
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Scope     string `json:"scope"`
+}
+
+type ListTokensResponse struct {
+	Tokens []TokenSummary `json:"tokens"`
+}
+
+type RevokeTokenResponse struct {
+	Revoked bool `json:"revoked"`
 }
 
 type ErrorResponse struct {
@@ -53,21 +158,72 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Set JSON content type for all responses
 	w.Header().Set("Content-Type", "application/json")
 
-	// Rate limiting by IP
-	clientIP := getClientIP(r)
-	if !h.rateLimiter.Allow(clientIP) {
+	// Operator access lists come before the rate limiter
+	clientIP := h.ips.ClientIP(r)
+	verdict := h.access.Check(clientIP)
+	if verdict == ratelimit.VerdictDeny {
+		metrics.Global.IncRateLimited(metrics.ScopeInvite, metrics.CauseDenylist)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "forbidden"})
+		return
+	}
+
+	// Onion service peers can't be told apart by address, so each request
+	// costs a solved challenge instead of drawing on a shared budget
+	if clientIP == "" {
+		if err := h.pow.Verify(ratelimit.PoWSolution(r)); err != nil {
+			metrics.Global.IncRateLimited(metrics.ScopeInvite, metrics.CauseNoProof)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "proof of work required"})
+			return
+		}
+	}
+
+	exempt := verdict == ratelimit.VerdictAllow || clientIP == ""
+	if wait := h.limits.Jail.Check(clientIP); wait > 0 && !exempt {
+		metrics.Global.IncRateLimited(metrics.ScopeInvite, metrics.CauseJail)
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
 		w.WriteHeader(http.StatusTooManyRequests)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "rate limited"})
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "temporarily banned"})
 		return
 	}
 
 	path := r.URL.Path
 
+	// Rate limiting by IP: minting and revoking draw on a smaller budget
+	// than lookups
+	if !exempt {
+		budget := h.limits.Probe
+		if strings.HasPrefix(path, "/invite/create") || r.Method == http.MethodDelete {
+			budget = h.limits.Invite
+		}
+		res := budget.Take(clientIP)
+		res.SetHeaders(w.Header())
+		if !res.Allowed {
+			metrics.Global.IncRateLimited(metrics.ScopeInvite, metrics.CauseLimiter)
+			if d := h.limits.Jail.Strike(clientIP); d > 0 {
+				metrics.Global.IncBans()
+				log.Printf("Client jailed for %v after repeated rate limiting", d)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "rate limited"})
+			return
+		}
+	}
+
 	switch {
 	case strings.HasPrefix(path, "/invite/create/"):
 		h.handleCreate(w, r)
+	case strings.HasPrefix(path, "/invite/create-batch/"):
+		h.handleCreateBatch(w, r)
 	case strings.HasPrefix(path, "/invite/validate/"):
 		h.handleValidate(w, r)
+	case strings.HasPrefix(path, "/invite/list/"):
+		h.handleList(w, r)
+	case strings.HasPrefix(path, "/invite/qr/"):
+		h.handleQR(w, r)
+	case r.Method == http.MethodDelete:
+		h.handleRevoke(w, r)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "not found"})
@@ -77,46 +233,154 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // handleCreate handles POST /invite/create/{roomId}
 // Creates a new single-use invite token for the specified room
 func (h *Handler) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if roomID, body, ok := readCreateRequest(w, r, "/invite/create/"); ok {
+		h.serveHost(w, roomID, HostCall{Op: HostCreate, Secret: hostSecret(r), Body: body})
+	}
+}
+
+// handleCreateBatch handles POST /invite/create-batch/{roomId}
+// Creates count tokens with shared options in one rate-limited request
+func (h *Handler) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	if roomID, body, ok := readCreateRequest(w, r, "/invite/create-batch/"); ok {
+		h.serveHost(w, roomID, HostCall{Op: HostCreateBatch, Secret: hostSecret(r), Body: body})
+	}
+}
+
+// readCreateRequest checks method and room ID for a create endpoint, then
+// reads its optional JSON body. On failure it has already written the
+// response.
+func readCreateRequest(w http.ResponseWriter, r *http.Request, prefix string) (string, []byte, bool) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
-		return
+		return "", nil, false
 	}
 
 	// Extract room ID from path
-	roomID := strings.TrimPrefix(r.URL.Path, "/invite/create/")
-	if !roomIDPattern.MatchString(roomID) {
+	roomID := strings.TrimPrefix(r.URL.Path, prefix)
+	if !room.ValidID(roomID) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid room ID format"})
-		return
+		return "", nil, false
 	}
 
-	// Verify room exists
-	rm := h.registry.GetRoom(roomID)
-	if rm == nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "room not found"})
-		return
+	// Optional body selects the lifetime (clamped to server bounds), scope, etc.
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, MaxCreateBodySize)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid request body"})
+			return "", nil, false
+		}
 	}
 
-	// Create token
-	token, err := h.tokenStore.CreateToken(roomID)
+	return roomID, body, true
+}
+
+// createErrorStatus maps token creation errors to HTTP statuses
+func createErrorStatus(err error) int {
+	switch err {
+	case ErrInvalidTTL, ErrInvalidFingerprint, ErrMetadataTooLarge, ErrInvalidCount, room.ErrUnknownRole:
+		return http.StatusBadRequest
+	case ErrTokenQuota:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// CreateErrorReason is what a host is told of a failed token creation:
+// the error itself if it's one of this package's, and otherwise, for the
+// token store backend's own errors, only that it's unavailable
+func CreateErrorReason(err error) string {
+	switch err {
+	case ErrInvalidTTL, ErrInvalidFingerprint, ErrMetadataTooLarge, ErrInvalidCount, room.ErrUnknownRole,
+		ErrTokenQuota, ErrRoomTokenLimit, ErrTooManyTokens:
+		return err.Error()
+	}
+	return "token store unavailable"
+}
+
+// CreateInvite mints a token for a room whose host has already been
+// authenticated, either by host secret over HTTP or by owning the host socket
+func (h *Handler) CreateInvite(roomID string, req CreateTokenRequest) (*CreateTokenResponse, error) {
+	resp, err := h.CreateInviteBatch(roomID, 1, req)
 	if err != nil {
-		log.Printf("Token create failed for room %s...: %v", roomID[:8], err)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
-		return
+		return nil, err
+	}
+	return &resp[0], nil
+}
+
+// CreateInviteBatch mints count tokens sharing req's options, all or nothing
+func (h *Handler) CreateInviteBatch(roomID string, count int, req CreateTokenRequest) ([]CreateTokenResponse, error) {
+	if req.TTLSeconds < 0 {
+		return nil, ErrInvalidTTL
+	}
+	scope, err := room.ParseRole(req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if req.Fingerprint != "" && !fingerprintPattern.MatchString(req.Fingerprint) {
+		return nil, ErrInvalidFingerprint
 	}
 
-	log.Printf("Token created for room %s...", roomID[:8])
+	if tenant, limit := h.tokenQuota(roomID); limit > 0 {
+		h.quotaMu.Lock()
+		defer h.quotaMu.Unlock()
+		if h.outstanding(tenant)+count > limit {
+			log.Printf("Token quota reached for room %s...", roomID[:8])
+			return nil, ErrTokenQuota
+		}
+	}
 
-	// Return token (only log truncated room ID for privacy)
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(CreateTokenResponse{
-		Token:     token.ID,
-		RoomID:    roomID,
-		ExpiresIn: int64(DefaultTokenTTL.Seconds()),
+	tokens, err := h.tokenStore.CreateTokenBatch(roomID, count, TokenOptions{
+		TTL:         time.Duration(req.TTLSeconds) * time.Second,
+		Scope:       scope,
+		Fingerprint: req.Fingerprint,
+		Metadata:    req.Metadata,
 	})
+	if err != nil {
+		log.Printf("Token create failed for room %s...: %v", roomID[:8], err)
+		return nil, err
+	}
+
+	// Only log truncated room ID for privacy
+	log.Printf("%d token(s) created for room %s...", len(tokens), roomID[:8])
+
+	resp := make([]CreateTokenResponse, len(tokens))
+	for i, token := range tokens {
+		resp[i] = CreateTokenResponse{
+			Token:     token.ID,
+			RoomID:    roomID,
+			ExpiresIn: int64(time.Until(token.ExpiresAt).Round(time.Second).Seconds()),
+			ExpiresAt: token.ExpiresAt.Unix(),
+			Scope:     string(token.Scope),
+		}
+	}
+	return resp, nil
+}
+
+// tokenQuota returns the tenant a room belongs to and how many tokens its
+// rooms may have outstanding, 0 for no limit
+func (h *Handler) tokenQuota(roomID string) (string, int) {
+	if h.tenants == nil {
+		return "", 0
+	}
+	rm := h.registry.GetRoom(roomID)
+	if rm == nil || rm.Tenant() == "" {
+		return "", 0
+	}
+	return rm.Tenant(), h.tenants.MaxTokens(rm.Tenant())
+}
+
+// outstanding counts the live tokens of every room tenant holds
+func (h *Handler) outstanding(tenant string) int {
+	n := 0
+	for _, id := range h.registry.TenantRooms(tenant) {
+		n += len(h.tokenStore.ListRoomTokens(id))
+	}
+	return n
 }
 
 // handleValidate handles GET /invite/validate/{token}
@@ -163,15 +427,103 @@ func (h *Handler) handleValidate(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(ValidateTokenResponse{
-		Valid:  true,
-		RoomID: token.RoomID,
+		Valid:    true,
+		RoomID:   token.RoomID,
+		Scope:    string(token.Scope),
+		Bound:    token.Bound(),
+		Metadata: token.Metadata,
 	})
 }
 
-// ConsumeToken consumes a token and returns the room ID
+// handleList handles GET /invite/list/{roomId}
+// Lists a room's outstanding tokens with truncated IDs so hosts can manage them
+func (h *Handler) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	roomID := strings.TrimPrefix(r.URL.Path, "/invite/list/")
+	if !room.ValidID(roomID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid room ID format"})
+		return
+	}
+
+	h.serveHost(w, roomID, HostCall{Op: HostList, Secret: hostSecret(r)})
+}
+
+// handleRevoke handles DELETE /invite/{token}
+// Kills a single outstanding token without touching the room's other invites
+func (h *Handler) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	tokenID := strings.TrimPrefix(r.URL.Path, "/invite/")
+	if !tokenPattern.MatchString(tokenID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid token format"})
+		return
+	}
+
+	call := HostCall{Op: HostRevoke, Secret: hostSecret(r), Token: tokenID}
+	if token, err := h.tokenStore.Peek(tokenID); err == nil {
+		h.serveHost(w, token.RoomID, call)
+		return
+	}
+
+	// A token held only by the node its room's host is on is asked after
+	// there; used, expired and unknown tokens all look the same to the caller
+	if h.hosts != nil {
+		if reply, err := h.hosts.ForwardHostCall("", call); err == nil {
+			writeHostReply(w, reply)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "token not found"})
+}
+
+// hostSecret returns the host secret a request carries as
+// "Authorization: Bearer <secret>", or "" if none. The secret is issued
+// only to the host, in ROOM_CREATED, so invitees who know the room ID
+// still can't manage invites.
+func hostSecret(r *http.Request) string {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return secret
+}
+
+// ConsumeToken consumes a token and returns it, room ID and scope included.
+// fingerprint is the joiner's key fingerprint, checked if the token is bound.
+// Joining a room hosted on another node of a cluster, the token is
+// consumed on that node instead.
 // This is called during the WebSocket join flow, not via HTTP
-func (h *Handler) ConsumeToken(tokenID string) (string, error) {
-	return h.tokenStore.ValidateAndConsume(tokenID)
+func (h *Handler) ConsumeToken(roomID, tokenID, fingerprint string) (*Token, error) {
+	if h.remote == nil || !h.remote.Proxied(roomID) {
+		return h.tokenStore.Consume(tokenID, fingerprint)
+	}
+
+	token, err := h.remote.ConsumeRemote(roomID, tokenID, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	token.remote = true
+	return token, nil
+}
+
+// RestoreToken undoes ConsumeToken when the join it was for fails, so
+// consumption and join succeed or fail together. Tokens for rooms that
+// have since been destroyed are not brought back.
+func (h *Handler) RestoreToken(token *Token) {
+	if h.registry.GetRoom(token.RoomID) == nil {
+		return
+	}
+	if token.remote {
+		h.remote.RestoreRemote(token)
+		return
+	}
+	h.tokenStore.Restore(token)
 }
 
 // RevokeRoomTokens revokes all tokens for a room
@@ -182,14 +534,3 @@ func (h *Handler) RevokeRoomTokens(roomID string) {
 		log.Printf("Revoked %d tokens for room %s...", count, roomID[:8])
 	}
 }
-
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-	return strings.Split(r.RemoteAddr, ":")[0]
-}
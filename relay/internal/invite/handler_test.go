@@ -0,0 +1,289 @@
+package invite
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/gorilla/websocket"
+)
+
+const handlerTestRoomID = "invite-handler-room-abcdefghijklmnopqrstuvw"
+
+func newTestInviteHandler(t *testing.T) (*Handler, *room.Room) {
+	t.Helper()
+	ts := NewTokenStore()
+	t.Cleanup(ts.Stop)
+
+	registry := room.NewRegistry()
+	rm, err := registry.CreateRoom(handlerTestRoomID, &websocket.Conn{})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	limits := ratelimit.Profile{InviteRate: 1000, InviteBurst: 1000, ProbeRate: 1000, ProbeBurst: 1000}.NewLimiters()
+	t.Cleanup(limits.Stop)
+	return NewHandler(ts, registry, limits, nil, nil), rm
+}
+
+func serve(h *Handler, method, path, secret, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestCreateRequiresHostSecret verifies only the host can mint invites
+func TestCreateRequiresHostSecret(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+	path := "/invite/create/" + handlerTestRoomID
+
+	for _, secret := range []string{"", "wrong-secret", handlerTestRoomID} {
+		if rec := serve(h, http.MethodPost, path, secret, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("Secret %q: expected 403, got %d", secret, rec.Code)
+		}
+	}
+
+	rec := serve(h, http.MethodPost, path, rm.HostSecret(), `{"ttlSeconds":300}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 with host secret, got %d", rec.Code)
+	}
+
+	var resp CreateTokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.ExpiresIn < 299 || resp.ExpiresIn > 300 {
+		t.Errorf("Expected effective TTL of 300s, got %d", resp.ExpiresIn)
+	}
+}
+
+// TestListAndRevokeRequireHostSecret verifies invite management is host-only
+func TestListAndRevokeRequireHostSecret(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+	secret := rm.HostSecret()
+
+	var created CreateTokenResponse
+	rec := serve(h, http.MethodPost, "/invite/create/"+handlerTestRoomID, secret, "")
+	json.NewDecoder(rec.Body).Decode(&created)
+
+	listPath := "/invite/list/" + handlerTestRoomID
+	if rec := serve(h, http.MethodGet, listPath, "", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("List without secret: expected 403, got %d", rec.Code)
+	}
+
+	rec = serve(h, http.MethodGet, listPath, secret, "")
+	var list ListTokensResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if rec.Code != http.StatusOK || len(list.Tokens) != 1 {
+		t.Fatalf("Expected 1 listed token, got %d (status %d)", len(list.Tokens), rec.Code)
+	}
+	if list.Tokens[0].ID != created.Token[:TokenDisplayLength] {
+		t.Errorf("Listed ID should be truncated, got %q", list.Tokens[0].ID)
+	}
+
+	revokePath := "/invite/" + created.Token
+	if rec := serve(h, http.MethodDelete, revokePath, "", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Revoke without secret: expected 403, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, revokePath, secret, ""); rec.Code != http.StatusOK {
+		t.Errorf("Revoke with secret: expected 200, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, revokePath, secret, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Second revoke: expected 404, got %d", rec.Code)
+	}
+}
+
+// TestQRRendersLiveTokensOnly verifies QR output for valid tokens and no caching
+func TestQRRendersLiveTokensOnly(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+
+	var created CreateTokenResponse
+	rec := serve(h, http.MethodPost, "/invite/create/"+handlerTestRoomID, rm.HostSecret(), "")
+	json.NewDecoder(rec.Body).Decode(&created)
+
+	rec = serve(h, http.MethodGet, "/invite/qr/"+created.Token, "", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected PNG, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(rec.Body.String(), "\x89PNG") {
+		t.Error("Body should be a PNG image")
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Error("QR response must not be cacheable")
+	}
+
+	rec = serve(h, http.MethodGet, "/invite/qr/"+created.Token+"?format=svg", "", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Errorf("Expected SVG, got %d", rec.Code)
+	}
+
+	unknown := strings.Repeat("A", 32)
+	if rec := serve(h, http.MethodGet, "/invite/qr/"+unknown, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Unknown token: expected 404, got %d", rec.Code)
+	}
+}
+
+// TestValidateReturnsMetadata verifies the host's blob comes back untouched on validation
+func TestValidateReturnsMetadata(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+
+	var created CreateTokenResponse
+	rec := serve(h, http.MethodPost, "/invite/create/"+handlerTestRoomID, rm.HostSecret(), `{"metadata":"c2VhbGVkLWtleS13cmFw"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rec.Code)
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+
+	var validated ValidateTokenResponse
+	rec = serve(h, http.MethodGet, "/invite/validate/"+created.Token, "", "")
+	json.NewDecoder(rec.Body).Decode(&validated)
+	if !validated.Valid || string(validated.Metadata) != "sealed-key-wrap" {
+		t.Errorf("Expected metadata back on validation, got %+v", validated)
+	}
+
+	tooBig := `{"metadata":"` + strings.Repeat("A", (MaxTokenMetadataSize+3)/3*4+4) + `"}`
+	if rec := serve(h, http.MethodPost, "/invite/create/"+handlerTestRoomID, rm.HostSecret(), tooBig); rec.Code != http.StatusBadRequest {
+		t.Errorf("Oversized metadata: expected 400, got %d", rec.Code)
+	}
+}
+
+// TestCreateBatch verifies the batch endpoint returns count tokens in one call
+func TestCreateBatch(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+	path := "/invite/create-batch/" + handlerTestRoomID
+
+	if rec := serve(h, http.MethodPost, path, "", `{"count":5}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Batch without secret: expected 403, got %d", rec.Code)
+	}
+
+	rec := serve(h, http.MethodPost, path, rm.HostSecret(), `{"count":5,"scope":"observer"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rec.Code)
+	}
+	var resp CreateBatchResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Tokens) != 5 || resp.Tokens[0].Scope != "observer" {
+		t.Errorf("Expected 5 observer tokens, got %+v", resp.Tokens)
+	}
+
+	for _, body := range []string{"", `{"count":0}`, `{"count":101}`} {
+		if rec := serve(h, http.MethodPost, path, rm.HostSecret(), body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Body %q: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+// quotas gives every tenant the same token quota
+type quotas int
+
+func (q quotas) MaxTokens(string) int { return int(q) }
+
+// TestTokenQuota verifies a tenant's tokens are counted across all its
+// rooms, and a batch that would pass the quota is refused whole
+func TestTokenQuota(t *testing.T) {
+	ts := NewTokenStore()
+	t.Cleanup(ts.Stop)
+	registry := room.NewRegistry()
+	first, _ := registry.CreateTenantRoom(handlerTestRoomID, &websocket.Conn{}, "acme", 0)
+	second, _ := registry.CreateTenantRoom("invite-handler-room-zyxwvutsrqponmlkjihgfed", &websocket.Conn{}, "acme", 0)
+	limits := ratelimit.Profile{InviteRate: 1000, InviteBurst: 1000}.NewLimiters()
+	t.Cleanup(limits.Stop)
+	h := NewHandler(ts, registry, limits, nil, nil)
+	h.SetTenants(quotas(3))
+
+	if _, err := h.CreateInviteBatch(first.ID, 2, CreateTokenRequest{}); err != nil {
+		t.Fatalf("Failed to create tokens within the quota: %v", err)
+	}
+	if _, err := h.CreateInviteBatch(second.ID, 2, CreateTokenRequest{}); err != ErrTokenQuota {
+		t.Errorf("Expected ErrTokenQuota across rooms, got %v", err)
+	}
+	if n := len(ts.ListRoomTokens(second.ID)); n != 0 {
+		t.Errorf("Expected a refused batch to mint nothing, got %d", n)
+	}
+	if _, err := h.CreateInviteBatch(second.ID, 1, CreateTokenRequest{}); err != nil {
+		t.Errorf("Expected the last token of the quota, got %v", err)
+	}
+
+	rec := serve(h, http.MethodPost, "/invite/create/"+first.ID, first.HostSecret(), "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over HTTP past the quota, got %d", rec.Code)
+	}
+}
+
+// TestRestoreTokenSkipsDestroyedRoom verifies invites for dead rooms stay dead
+func TestRestoreTokenSkipsDestroyedRoom(t *testing.T) {
+	h, rm := newTestInviteHandler(t)
+
+	resp, _ := h.CreateInvite(rm.ID, CreateTokenRequest{})
+	token, err := h.ConsumeToken(rm.ID, resp.Token, "")
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+
+	h.registry.DestroyRoom(rm.ID, "test")
+	h.RestoreToken(token)
+
+	if _, err := h.tokenStore.Peek(resp.Token); err != ErrTokenNotFound {
+		t.Errorf("Token for destroyed room should not come back, got %v", err)
+	}
+}
+
+// TestOnionRequestsPayInWork verifies requests with no address need a
+// solved challenge each, and skip the per-IP budgets they would share
+func TestOnionRequestsPayInWork(t *testing.T) {
+	h, _ := newTestInviteHandler(t)
+	h.limits = ratelimit.Profile{InviteRate: 1, InviteBurst: 1, ProbeRate: 1, ProbeBurst: 1}.NewLimiters()
+	t.Cleanup(h.limits.Stop)
+	pow := ratelimit.NewPoW(8)
+	h.SetProofOfWork(pow)
+
+	validate := func(solution string) int {
+		req := httptest.NewRequest(http.MethodGet, "/invite/validate/nope", nil)
+		req = req.WithContext(clientip.Anonymous(req.Context()))
+		if solution != "" {
+			req.Header.Set(ratelimit.PoWHeader, solution)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := validate(""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without proof of work, got %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		c := pow.Challenge()
+		for nonce := 0; ; nonce++ {
+			s := c.Challenge + ":" + strconv.Itoa(nonce)
+			if sum := sha256.Sum256([]byte(s)); sum[0] == 0 {
+				if code := validate(s); code == http.StatusForbidden || code == http.StatusTooManyRequests {
+					t.Errorf("Request %d: expected solved challenge to pass, got %d", i, code)
+				}
+				break
+			}
+		}
+	}
+}
+
+// TestCreateErrorReason verifies hosts are told this package's errors as
+// they are, and nothing of a backend's
+func TestCreateErrorReason(t *testing.T) {
+	if got := CreateErrorReason(ErrTokenQuota); got != ErrTokenQuota.Error() {
+		t.Errorf("Expected the quota error passed on, got %q", got)
+	}
+	backend := errors.New("dial tcp 10.0.0.5:6379: connect: connection refused")
+	if got := CreateErrorReason(backend); strings.Contains(got, "6379") {
+		t.Errorf("Expected the backend error hidden, got %q", got)
+	}
+}
@@ -0,0 +1,151 @@
+package invite
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Host calls, the invite API requests only a room's host may make
+const (
+	HostCreate      = "create"
+	HostCreateBatch = "create-batch"
+	HostList        = "list"
+	HostRevoke      = "revoke"
+)
+
+// HostCall is a host's invite API request, as passed to whichever relay
+// node its room's host is connected to
+type HostCall struct {
+	Op     string `json:"op"`
+	Secret string `json:"secret"`          // the host secret the caller presented
+	Token  string `json:"token,omitempty"` // the token to revoke
+	Body   []byte `json:"body,omitempty"`  // a create's JSON body, as sent
+}
+
+// HostReply is the HTTP status and JSON body a HostCall is answered with
+type HostReply struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// RemoteHosts has hosts' invite API calls answered by the relay node a
+// room's host is connected to, the only one holding its host secret
+type RemoteHosts interface {
+	HostedElsewhere(roomID string) bool // the room's host is on another node
+	// ForwardHostCall has the node hosting roomID answer call. A revoke of
+	// a token this node can't look up has an empty roomID, and is answered
+	// by whichever node holds the token.
+	ForwardHostCall(roomID string, call HostCall) (HostReply, error)
+}
+
+// SetRemoteHosts has host calls for rooms hosted on other nodes answered
+// through r
+func (h *Handler) SetRemoteHosts(r RemoteHosts) {
+	h.hosts = r
+}
+
+// serveHost has call answered where roomID's host is connected: here, or
+// on the node hosting it
+func (h *Handler) serveHost(w http.ResponseWriter, roomID string, call HostCall) {
+	if !h.hostedElsewhere(roomID) {
+		writeHostReply(w, h.ServeHostCall(roomID, call))
+		return
+	}
+	reply, err := h.hosts.ForwardHostCall(roomID, call)
+	if err != nil {
+		log.Printf("Host call for room %s... not answered: %v", roomID[:8], err)
+		reply = hostReply(http.StatusServiceUnavailable, ErrorResponse{Error: "room's relay node unavailable"})
+	}
+	writeHostReply(w, reply)
+}
+
+func (h *Handler) hostedElsewhere(roomID string) bool {
+	return h.hosts != nil && h.hosts.HostedElsewhere(roomID)
+}
+
+// ServeHostCall answers call for a room whose host is connected to this
+// node, checking the host secret as the HTTP endpoints do. A revoke's room
+// is its token's, so roomID may be empty for one; a token whose room is
+// hosted elsewhere is not found.
+func (h *Handler) ServeHostCall(roomID string, call HostCall) HostReply {
+	if call.Op == HostRevoke {
+		token, err := h.tokenStore.Peek(call.Token)
+		if err != nil || (roomID != "" && token.RoomID != roomID) || h.hostedElsewhere(token.RoomID) {
+			return hostReply(http.StatusNotFound, ErrorResponse{Error: "token not found"})
+		}
+		roomID = token.RoomID
+	}
+
+	// Only the host may manage invites; an unknown room fails the same way
+	rm := h.registry.GetRoom(roomID)
+	if rm == nil || h.hostedElsewhere(roomID) || !rm.CheckHostSecret(call.Secret) {
+		return hostReply(http.StatusForbidden, ErrorResponse{Error: "forbidden"})
+	}
+
+	switch call.Op {
+	case HostCreate:
+		var req CreateTokenRequest
+		if !decodeBody(call.Body, &req) {
+			return hostReply(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		}
+		resp, err := h.CreateInvite(roomID, req)
+		if err != nil {
+			return hostReply(createErrorStatus(err), ErrorResponse{Error: CreateErrorReason(err)})
+		}
+		return hostReply(http.StatusCreated, resp)
+
+	case HostCreateBatch:
+		var req CreateBatchRequest
+		if !decodeBody(call.Body, &req) {
+			return hostReply(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		}
+		resp, err := h.CreateInviteBatch(roomID, req.Count, req.CreateTokenRequest)
+		if err != nil {
+			return hostReply(createErrorStatus(err), ErrorResponse{Error: CreateErrorReason(err)})
+		}
+		return hostReply(http.StatusCreated, CreateBatchResponse{Tokens: resp})
+
+	case HostList:
+		tokens := h.tokenStore.ListRoomTokens(roomID)
+		resp := ListTokensResponse{Tokens: make([]TokenSummary, 0, len(tokens))}
+		for _, token := range tokens {
+			resp.Tokens = append(resp.Tokens, TokenSummary{
+				ID:        token.ID[:TokenDisplayLength],
+				CreatedAt: token.CreatedAt.Unix(),
+				ExpiresAt: token.ExpiresAt.Unix(),
+				Scope:     string(token.Scope),
+			})
+		}
+		return hostReply(http.StatusOK, resp)
+
+	case HostRevoke:
+		if err := h.tokenStore.RevokeToken(call.Token); err != nil {
+			return hostReply(http.StatusNotFound, ErrorResponse{Error: "token not found"})
+		}
+		log.Printf("Token revoked for room %s...", roomID[:8])
+		return hostReply(http.StatusOK, RevokeTokenResponse{Revoked: true})
+	}
+	return hostReply(http.StatusNotFound, ErrorResponse{Error: "not found"})
+}
+
+// decodeBody decodes a create's optional JSON body into req
+func decodeBody(body []byte, req any) bool {
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(req)
+	return err == nil || err == io.EOF
+}
+
+func hostReply(status int, v any) HostReply {
+	body, _ := json.Marshal(v)
+	return HostReply{Status: status, Body: body}
+}
+
+// writeHostReply writes a host call's answer. It may list or mint tokens,
+// so it's never cached.
+func writeHostReply(w http.ResponseWriter, reply HostReply) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(reply.Status)
+	w.Write(append(reply.Body, '\n'))
+}
@@ -4,45 +4,103 @@ package invite
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/ephemeral/relay/internal/room"
 )
 
 // Errors
 var (
-	ErrTokenNotFound     = errors.New("token not found or expired")
-	ErrTokenAlreadyUsed  = errors.New("token already used")
-	ErrInvalidToken      = errors.New("invalid token format")
-	ErrRoomTokenLimit    = errors.New("room has too many active tokens")
-	ErrTooManyTokens     = errors.New("server token limit reached")
+	ErrTokenNotFound      = errors.New("token not found or expired")
+	ErrTokenAlreadyUsed   = errors.New("token already used")
+	ErrInvalidToken       = errors.New("invalid token format")
+	ErrRoomTokenLimit     = errors.New("room has too many active tokens")
+	ErrTooManyTokens      = errors.New("server token limit reached")
+	ErrTokenQuota         = errors.New("token quota reached")
+	ErrInvalidTTL         = errors.New("invalid ttl")
+	ErrFingerprint        = errors.New("token bound to a different key")
+	ErrInvalidFingerprint = errors.New("invalid fingerprint")
+	ErrMetadataTooLarge   = errors.New("token metadata too large")
+	ErrInvalidCount       = errors.New("invalid token count")
 )
 
 // Limits
 const (
-	TokenLength           = 24              // 192 bits of entropy (base64 encoded = 32 chars)
-	DefaultTokenTTL       = 24 * time.Hour  // Tokens expire after 24 hours
-	MaxTokensPerRoom      = 100             // Max active tokens per room
-	MaxTotalTokens        = 100000          // Max total tokens server-wide
-	CleanupInterval       = 5 * time.Minute // How often to clean expired tokens
+	TokenLength      = 24              // 192 bits of entropy (base64 encoded = 32 chars)
+	DefaultTokenTTL  = 24 * time.Hour  // Tokens expire after 24 hours
+	MinTokenTTL      = time.Minute     // Shortest TTL a host may request
+	MaxTokenTTL      = 24 * time.Hour  // Longest TTL a host may request
+	MaxTokensPerRoom = 100             // Max active tokens per room
+	MaxTotalTokens   = 100000          // Max total tokens server-wide
+	CleanupInterval  = 5 * time.Minute // How often to clean expired tokens
+
+	// MaxTokenMetadataSize bounds the opaque blob a host may attach to a token
+	MaxTokenMetadataSize = 512
 )
 
 // Token represents a single-use invite token
 type Token struct {
-	ID        string    // The token string (base64url)
-	RoomID    string    // Associated room
+	ID        string // The token string (base64url)
+	RoomID    string // Associated room
 	CreatedAt time.Time
 	ExpiresAt time.Time
 	Used      bool
+	Scope     room.Role // Role granted to whoever joins with this token
+	Metadata  []byte    // Host-encrypted blob returned on validation; never inspected
+
+	boundTo []byte // fingerprintDigest of the only key allowed to use it; nil if unbound
+	remote  bool   // consumed on another node, so restored there
+}
+
+// TokenOptions customizes a token at creation. The zero value gives an
+// unbound participant token with DefaultTokenTTL.
+type TokenOptions struct {
+	TTL         time.Duration // clamped with ClampTTL
+	Scope       room.Role     // empty means room.RoleParticipant
+	Fingerprint string        // joiner's public key fingerprint; empty means unbound
+	Metadata    []byte        // opaque, at most MaxTokenMetadataSize bytes
+}
+
+// fingerprintDigestSize is how much of SHA-256(fingerprint) a bound token keeps
+const fingerprintDigestSize = 16
+
+// fingerprintDigest normalizes a client-supplied fingerprint to a fixed size,
+// so the stored form is the same whatever encoding the client uses
+func fingerprintDigest(fingerprint string) []byte {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return sum[:fingerprintDigestSize]
+}
+
+// Bound reports whether the token may only be used with one key fingerprint
+func (t *Token) Bound() bool {
+	return t.boundTo != nil
+}
+
+// allows reports whether fingerprint may use the token
+func (t *Token) allows(fingerprint string) bool {
+	if t.boundTo == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare(t.boundTo, fingerprintDigest(fingerprint)) == 1
+}
+
+func (t *Token) copy() *Token {
+	c := *t
+	return &c
 }
 
 // TokenStore manages all invite tokens in memory
 type TokenStore struct {
-	tokens       map[string]*Token // token ID -> Token
-	roomTokens   map[string]int    // roomID -> count of active tokens
-	mu           sync.RWMutex
-	cleanupDone  chan struct{}
+	tokens      map[string]*Token // token ID -> Token
+	roomTokens  map[string]int    // roomID -> count of active tokens
+	mu          sync.RWMutex
+	cleanupDone chan struct{}
 }
 
 // NewTokenStore creates a new in-memory token store with background cleanup
@@ -59,52 +117,122 @@ func NewTokenStore() *TokenStore {
 	return ts
 }
 
+// ClampTTL bounds a requested TTL to [MinTokenTTL, MaxTokenTTL].
+// Zero means DefaultTokenTTL.
+func ClampTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl == 0:
+		return DefaultTokenTTL
+	case ttl < MinTokenTTL:
+		return MinTokenTTL
+	case ttl > MaxTokenTTL:
+		return MaxTokenTTL
+	}
+	return ttl
+}
+
+// scope returns the effective role for the options
+func (o TokenOptions) scope() room.Role {
+	if o.Scope == "" {
+		return room.RoleParticipant
+	}
+	return o.Scope
+}
+
+// boundTo returns the fingerprint digest for the options, or nil if unbound
+func (o TokenOptions) boundTo() []byte {
+	if o.Fingerprint == "" {
+		return nil
+	}
+	return fingerprintDigest(o.Fingerprint)
+}
+
 // CreateToken generates a new single-use invite token for a room
 func (ts *TokenStore) CreateToken(roomID string) (*Token, error) {
+	return ts.CreateTokenWithOptions(roomID, TokenOptions{})
+}
+
+// CreateTokenWithOptions generates a token with a custom TTL and scope
+func (ts *TokenStore) CreateTokenWithOptions(roomID string, opts TokenOptions) (*Token, error) {
+	tokens, err := ts.CreateTokenBatch(roomID, 1, opts)
+	if err != nil {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+// CreateTokenBatch generates n tokens sharing the same options.
+// Either all n are created or none are.
+func (ts *TokenStore) CreateTokenBatch(roomID string, n int, opts TokenOptions) ([]*Token, error) {
+	if n < 1 || n > MaxTokensPerRoom {
+		return nil, ErrInvalidCount
+	}
+	ttl := ClampTTL(opts.TTL)
+	if len(opts.Metadata) > MaxTokenMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
 	// Check server-wide limit
-	if len(ts.tokens) >= MaxTotalTokens {
+	if len(ts.tokens)+n > MaxTotalTokens {
 		return nil, ErrTooManyTokens
 	}
 
 	// Check per-room limit
-	if ts.roomTokens[roomID] >= MaxTokensPerRoom {
+	if ts.roomTokens[roomID]+n > MaxTokensPerRoom {
 		return nil, ErrRoomTokenLimit
 	}
 
-	// Generate cryptographically secure token
-	tokenBytes := make([]byte, TokenLength)
+	// Generate cryptographically secure tokens
+	tokenBytes := make([]byte, TokenLength*n)
 	if _, err := rand.Read(tokenBytes); err != nil {
 		return nil, err
 	}
 
-	tokenID := base64.RawURLEncoding.EncodeToString(tokenBytes)
-
-	token := &Token{
-		ID:        tokenID,
-		RoomID:    roomID,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(DefaultTokenTTL),
-		Used:      false,
+	now := time.Now()
+	tokens := make([]*Token, n)
+	for i := range tokens {
+		tokenID := base64.RawURLEncoding.EncodeToString(tokenBytes[i*TokenLength : (i+1)*TokenLength])
+		token := &Token{
+			ID:        tokenID,
+			RoomID:    roomID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+			Used:      false,
+			Scope:     opts.scope(),
+			Metadata:  append([]byte(nil), opts.Metadata...),
+			boundTo:   opts.boundTo(),
+		}
+		ts.tokens[tokenID] = token
+		tokens[i] = token
 	}
+	ts.roomTokens[roomID] += n
 
-	ts.tokens[tokenID] = token
-	ts.roomTokens[roomID]++
-
-	return token, nil
+	return tokens, nil
 }
 
 // ValidateAndConsume validates a token and marks it as used (single-use)
 // Returns the room ID if valid, or an error if invalid/expired/used
 func (ts *TokenStore) ValidateAndConsume(tokenID string) (string, error) {
+	token, err := ts.Consume(tokenID, "")
+	if err != nil {
+		return "", err
+	}
+	return token.RoomID, nil
+}
+
+// Consume is ValidateAndConsume returning the whole token, scope included.
+// A bound token is only consumed when fingerprint matches; a mismatch
+// leaves it intact for its rightful holder.
+func (ts *TokenStore) Consume(tokenID, fingerprint string) (*Token, error) {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
 	token, exists := ts.tokens[tokenID]
 	if !exists {
-		return "", ErrTokenNotFound
+		return nil, ErrTokenNotFound
 	}
 
 	// Check expiration
@@ -112,12 +240,16 @@ func (ts *TokenStore) ValidateAndConsume(tokenID string) (string, error) {
 		// Clean up expired token
 		delete(ts.tokens, tokenID)
 		ts.roomTokens[token.RoomID]--
-		return "", ErrTokenNotFound
+		return nil, ErrTokenNotFound
 	}
 
 	// Check if already used
 	if token.Used {
-		return "", ErrTokenAlreadyUsed
+		return nil, ErrTokenAlreadyUsed
+	}
+
+	if !token.allows(fingerprint) {
+		return nil, ErrFingerprint
 	}
 
 	// Mark as used and remove from store (single-use)
@@ -128,7 +260,27 @@ func (ts *TokenStore) ValidateAndConsume(tokenID string) (string, error) {
 		delete(ts.roomTokens, roomID)
 	}
 
-	return roomID, nil
+	return token.copy(), nil
+}
+
+// Restore puts back a token returned by Consume whose join then failed,
+// so a full or not-yet-open room doesn't burn a valid invite.
+// Expired tokens stay gone.
+func (ts *TokenStore) Restore(token *Token) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if time.Now().After(token.ExpiresAt) {
+		return
+	}
+	if _, exists := ts.tokens[token.ID]; exists {
+		return
+	}
+
+	restored := token.copy()
+	restored.Used = false
+	ts.tokens[token.ID] = restored
+	ts.roomTokens[token.RoomID]++
 }
 
 // Peek checks if a token is valid without consuming it
@@ -153,13 +305,26 @@ func (ts *TokenStore) Peek(tokenID string) (*Token, error) {
 	}
 
 	// Return a copy to prevent external modification
-	return &Token{
-		ID:        token.ID,
-		RoomID:    token.RoomID,
-		CreatedAt: token.CreatedAt,
-		ExpiresAt: token.ExpiresAt,
-		Used:      token.Used,
-	}, nil
+	return token.copy(), nil
+}
+
+// RevokeToken removes a single unused token, e.g. a leaked invite link
+func (ts *TokenStore) RevokeToken(tokenID string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	token, exists := ts.tokens[tokenID]
+	if !exists {
+		return ErrTokenNotFound
+	}
+
+	delete(ts.tokens, tokenID)
+	ts.roomTokens[token.RoomID]--
+	if ts.roomTokens[token.RoomID] <= 0 {
+		delete(ts.roomTokens, token.RoomID)
+	}
+
+	return nil
 }
 
 // RevokeRoomTokens removes all tokens for a specific room
@@ -180,6 +345,27 @@ func (ts *TokenStore) RevokeRoomTokens(roomID string) int {
 	return count
 }
 
+// ListRoomTokens returns copies of a room's unexpired tokens, oldest first
+func (ts *TokenStore) ListRoomTokens(roomID string) []*Token {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	now := time.Now()
+	var list []*Token
+	for _, token := range ts.tokens {
+		if token.RoomID != roomID || now.After(token.ExpiresAt) {
+			continue
+		}
+		list = append(list, token.copy())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list
+}
+
 // TokenCount returns the number of active tokens
 func (ts *TokenStore) TokenCount() int {
 	ts.mu.RLock()
@@ -4,6 +4,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/ephemeral/relay/internal/room"
 )
 
 // TestTokenCreation verifies basic token creation
@@ -369,3 +371,189 @@ func BenchmarkTokenValidate(b *testing.B) {
 		ts.ValidateAndConsume(tokenIDs[i])
 	}
 }
+
+// TestTokenCustomTTL verifies requested TTLs are honored within server bounds
+func TestTokenCustomTTL(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	tests := []struct {
+		requested time.Duration
+		effective time.Duration
+	}{
+		{5 * time.Minute, 5 * time.Minute},
+		{0, DefaultTokenTTL},
+		{time.Second, MinTokenTTL},
+		{7 * 24 * time.Hour, MaxTokenTTL},
+	}
+
+	for _, tt := range tests {
+		before := time.Now()
+		token, err := ts.CreateTokenWithOptions("ttl-room-12345678901234567890123456789", TokenOptions{TTL: tt.requested})
+		if err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+
+		got := token.ExpiresAt.Sub(before)
+		if got < tt.effective || got > tt.effective+time.Second {
+			t.Errorf("TTL %v: expected effective TTL %v, got %v", tt.requested, tt.effective, got)
+		}
+	}
+}
+
+// TestRevokeSingleToken verifies one token can be killed without touching the rest
+func TestRevokeSingleToken(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	roomID := "revoke-one-room-12345678901234567890123"
+	leaked, _ := ts.CreateToken(roomID)
+	kept, _ := ts.CreateToken(roomID)
+
+	if err := ts.RevokeToken(leaked.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if err := ts.RevokeToken(leaked.ID); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound on second revoke, got %v", err)
+	}
+
+	if _, err := ts.ValidateAndConsume(leaked.ID); err != ErrTokenNotFound {
+		t.Errorf("Revoked token should be unusable, got %v", err)
+	}
+	if ts.RoomTokenCount(roomID) != 1 {
+		t.Errorf("Expected 1 remaining token, got %d", ts.RoomTokenCount(roomID))
+	}
+	if _, err := ts.ValidateAndConsume(kept.ID); err != nil {
+		t.Errorf("Other token should still be valid: %v", err)
+	}
+}
+
+// TestListRoomTokens verifies listing returns only the room's live tokens in order
+func TestListRoomTokens(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	roomID := "list-room-123456789012345678901234567890"
+	first, _ := ts.CreateToken(roomID)
+	time.Sleep(time.Millisecond)
+	second, _ := ts.CreateToken(roomID)
+	ts.CreateToken("other-room-12345678901234567890123456789")
+
+	list := ts.ListRoomTokens(roomID)
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(list))
+	}
+	if list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Error("Tokens should be listed oldest first")
+	}
+
+	ts.ValidateAndConsume(first.ID)
+	if len(ts.ListRoomTokens(roomID)) != 1 {
+		t.Error("Consumed token should no longer be listed")
+	}
+}
+
+// TestTokenScope verifies a token's scope survives to consumption
+func TestTokenScope(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	roomID := "scope-room-12345678901234567890123456789"
+	plain, _ := ts.CreateToken(roomID)
+	observer, _ := ts.CreateTokenWithOptions(roomID, TokenOptions{Scope: room.RoleObserver})
+
+	if plain.Scope != room.RoleParticipant {
+		t.Errorf("Default scope should be participant, got %q", plain.Scope)
+	}
+
+	consumed, err := ts.Consume(observer.ID, "")
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if consumed.Scope != room.RoleObserver || consumed.RoomID != roomID {
+		t.Errorf("Expected observer token for %s, got %+v", roomID, consumed)
+	}
+}
+
+// TestFingerprintBoundToken verifies only the bound key can consume the token
+func TestFingerprintBoundToken(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	token, _ := ts.CreateTokenWithOptions("bound-room-123456789012345678901234567890",
+		TokenOptions{Fingerprint: "SHA256:alice-key-fingerprint"})
+	if !token.Bound() {
+		t.Fatal("Token should be bound")
+	}
+
+	for _, fp := range []string{"", "SHA256:mallory-key-fingerprint"} {
+		if _, err := ts.Consume(token.ID, fp); err != ErrFingerprint {
+			t.Errorf("Fingerprint %q: expected ErrFingerprint, got %v", fp, err)
+		}
+	}
+
+	// A mismatch must not burn the token for its rightful holder
+	if _, err := ts.Consume(token.ID, "SHA256:alice-key-fingerprint"); err != nil {
+		t.Errorf("Bound key should consume the token: %v", err)
+	}
+}
+
+// TestCreateTokenBatch verifies batches are bounded and all-or-nothing
+func TestCreateTokenBatch(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	roomID := "batch-room-123456789012345678901234567890"
+	tokens, err := ts.CreateTokenBatch(roomID, 40, TokenOptions{Scope: room.RoleObserver})
+	if err != nil {
+		t.Fatalf("Batch create failed: %v", err)
+	}
+	if len(tokens) != 40 || ts.RoomTokenCount(roomID) != 40 {
+		t.Fatalf("Expected 40 tokens, got %d (room count %d)", len(tokens), ts.RoomTokenCount(roomID))
+	}
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token.ID] || token.Scope != room.RoleObserver {
+			t.Fatalf("Unexpected token in batch: %+v", token)
+		}
+		seen[token.ID] = true
+	}
+
+	// 40 + 61 exceeds the per-room limit: nothing may be created
+	if _, err := ts.CreateTokenBatch(roomID, MaxTokensPerRoom-39, TokenOptions{}); err != ErrRoomTokenLimit {
+		t.Errorf("Expected ErrRoomTokenLimit, got %v", err)
+	}
+	if ts.RoomTokenCount(roomID) != 40 {
+		t.Errorf("Failed batch should create nothing, room has %d", ts.RoomTokenCount(roomID))
+	}
+
+	for _, n := range []int{0, -1, MaxTokensPerRoom + 1} {
+		if _, err := ts.CreateTokenBatch("other-room", n, TokenOptions{}); err != ErrInvalidCount {
+			t.Errorf("Count %d: expected ErrInvalidCount, got %v", n, err)
+		}
+	}
+}
+
+// TestRestoreToken verifies a consumed token can be put back once, unless expired
+func TestRestoreToken(t *testing.T) {
+	ts := NewTokenStore()
+	defer ts.Stop()
+
+	roomID := "restore-room-1234567890123456789012345678"
+	token, _ := ts.CreateToken(roomID)
+	consumed, _ := ts.Consume(token.ID, "")
+
+	ts.Restore(consumed)
+	if ts.RoomTokenCount(roomID) != 1 {
+		t.Errorf("Expected restored token to count again, got %d", ts.RoomTokenCount(roomID))
+	}
+	if _, err := ts.Consume(token.ID, ""); err != nil {
+		t.Errorf("Restored token should be usable: %v", err)
+	}
+
+	expired := &Token{ID: "expired-restore-token-123456789012", RoomID: roomID, ExpiresAt: time.Now().Add(-time.Minute)}
+	ts.Restore(expired)
+	if ts.TokenCount() != 0 {
+		t.Error("Expired token must not be restored")
+	}
+}
@@ -0,0 +1,98 @@
+package invite
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR rendering
+const (
+	DeepLinkPrefix = "secretr00m://join/" // Opens the app's join flow
+	QRImageSize    = 512                  // PNG edge length in pixels
+	qrModulePixels = 8                    // SVG units per QR module
+)
+
+// DeepLink returns the app link that joins with a token
+func DeepLink(tokenID string) string {
+	return DeepLinkPrefix + tokenID
+}
+
+// handleQR handles GET /invite/qr/{token}?format=png|svg
+// Renders the token's deep link as a QR code. Only live tokens are rendered,
+// so this can't be used as a general-purpose QR service.
+func (h *Handler) handleQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	tokenID := strings.TrimPrefix(r.URL.Path, "/invite/qr/")
+	if !tokenPattern.MatchString(tokenID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "invalid token format"})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "format must be png or svg"})
+		return
+	}
+
+	if _, err := h.tokenStore.Peek(tokenID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "token not found"})
+		return
+	}
+
+	qr, err := qrcode.New(DeepLink(tokenID), qrcode.Medium)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "qr encoding failed"})
+		return
+	}
+
+	var body []byte
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = renderSVG(qr.Bitmap())
+	} else {
+		body, err = qr.PNG(QRImageSize)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "qr encoding failed"})
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	}
+
+	// The image is the invite itself; don't let anything keep a copy
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// renderSVG draws a QR bitmap (quiet zone included) as one SVG path
+func renderSVG(bitmap [][]bool) []byte {
+	size := len(bitmap) * qrModulePixels
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh%dv%dh-%dz", x*qrModulePixels, y*qrModulePixels,
+					qrModulePixels, qrModulePixels, qrModulePixels)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
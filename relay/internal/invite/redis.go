@@ -0,0 +1,362 @@
+package invite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis layout
+const (
+	DefaultRedisPrefix = "relay:invite:"
+	RedisTimeout       = 2 * time.Second // Per-operation deadline
+)
+
+// RedisTokens keeps invite tokens in Redis so every relay node behind a load
+// balancer sees the same set. Each token is one key expiring with the token;
+// a per-room set indexes them for limits, listing and revocation.
+//
+// Single use holds cluster-wide: consumption is a compare-and-delete, so of
+// two nodes racing on the same token exactly one wins. MaxTotalTokens is not
+// enforced here; Redis memory limits play that role.
+type RedisTokens struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisToken is the stored form of a Token
+type redisToken struct {
+	RoomID    string    `json:"r"`
+	CreatedAt int64     `json:"c"` // unix nanos
+	ExpiresAt int64     `json:"e"` // unix nanos
+	Scope     room.Role `json:"s"`
+	Metadata  []byte    `json:"m,omitempty"`
+	BoundTo   []byte    `json:"b,omitempty"`
+}
+
+// createScript prunes the room index, enforces the per-room limit and stores
+// a batch atomically.
+// KEYS[1] room set; ARGV: token key prefix, room limit, ttl ms, then id/value pairs
+var createScript = redis.NewScript(`
+for _, id in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	if redis.call('EXISTS', ARGV[1] .. id) == 0 then
+		redis.call('SREM', KEYS[1], id)
+	end
+end
+local n = (#ARGV - 3) / 2
+if redis.call('SCARD', KEYS[1]) + n > tonumber(ARGV[2]) then
+	return redis.error_reply('room token limit')
+end
+for i = 4, #ARGV, 2 do
+	redis.call('SET', ARGV[1] .. ARGV[i], ARGV[i + 1], 'PX', ARGV[3])
+	redis.call('SADD', KEYS[1], ARGV[i])
+end
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return n
+`)
+
+// takeScript deletes a token only if it still holds the value the caller
+// checked, so consumption and revocation are single-winner.
+// KEYS[1] token key, KEYS[2] room set; ARGV: expected value, token ID
+var takeScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[2])
+return 1
+`)
+
+// NewRedisTokens creates a Redis-backed token store.
+// The store owns the client and closes it on Stop.
+func NewRedisTokens(client *redis.Client, prefix string) *RedisTokens {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &RedisTokens{client: client, prefix: prefix}
+}
+
+func (rt *RedisTokens) tokenKey(tokenID string) string {
+	return rt.prefix + "tok:" + tokenID
+}
+
+func (rt *RedisTokens) roomKey(roomID string) string {
+	return rt.prefix + "room:" + roomID
+}
+
+func (rt *RedisTokens) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), RedisTimeout)
+}
+
+// CreateToken generates a new single-use invite token for a room
+func (rt *RedisTokens) CreateToken(roomID string) (*Token, error) {
+	return rt.CreateTokenWithOptions(roomID, TokenOptions{})
+}
+
+// CreateTokenWithOptions generates a token with a custom TTL and scope
+func (rt *RedisTokens) CreateTokenWithOptions(roomID string, opts TokenOptions) (*Token, error) {
+	tokens, err := rt.CreateTokenBatch(roomID, 1, opts)
+	if err != nil {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+// CreateTokenBatch generates n tokens sharing the same options, all or nothing
+func (rt *RedisTokens) CreateTokenBatch(roomID string, n int, opts TokenOptions) ([]*Token, error) {
+	if n < 1 || n > MaxTokensPerRoom {
+		return nil, ErrInvalidCount
+	}
+	if len(opts.Metadata) > MaxTokenMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+	ttl := ClampTTL(opts.TTL)
+
+	tokenBytes := make([]byte, TokenLength*n)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tokens := make([]*Token, n)
+	args := []interface{}{rt.tokenKey(""), MaxTokensPerRoom, ttl.Milliseconds()}
+	for i := range tokens {
+		token := &Token{
+			ID:        base64.RawURLEncoding.EncodeToString(tokenBytes[i*TokenLength : (i+1)*TokenLength]),
+			RoomID:    roomID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+			Scope:     opts.scope(),
+			Metadata:  append([]byte(nil), opts.Metadata...),
+			boundTo:   opts.boundTo(),
+		}
+		value, err := encodeRedisToken(token)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, token.ID, value)
+		tokens[i] = token
+	}
+
+	ctx, cancel := rt.ctx()
+	defer cancel()
+	if err := createScript.Run(ctx, rt.client, []string{rt.roomKey(roomID)}, args...).Err(); err != nil {
+		if err.Error() == "room token limit" {
+			return nil, ErrRoomTokenLimit
+		}
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// ValidateAndConsume validates a token and deletes it (single-use)
+// Returns the room ID if valid, or an error if invalid/expired/used
+func (rt *RedisTokens) ValidateAndConsume(tokenID string) (string, error) {
+	token, err := rt.Consume(tokenID, "")
+	if err != nil {
+		return "", err
+	}
+	return token.RoomID, nil
+}
+
+// Consume is ValidateAndConsume returning the whole token, scope included.
+// A bound token is only consumed when fingerprint matches.
+func (rt *RedisTokens) Consume(tokenID, fingerprint string) (*Token, error) {
+	token, raw, err := rt.get(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if !token.allows(fingerprint) {
+		return nil, ErrFingerprint
+	}
+	if err := rt.take(token, raw); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Restore puts back a token returned by Consume whose join then failed
+func (rt *RedisTokens) Restore(token *Token) {
+	ttl := time.Until(token.ExpiresAt)
+	if ttl <= 0 {
+		return
+	}
+	value, err := encodeRedisToken(token)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := rt.ctx()
+	defer cancel()
+	pipe := rt.client.TxPipeline()
+	pipe.SetNX(ctx, rt.tokenKey(token.ID), value, ttl)
+	pipe.SAdd(ctx, rt.roomKey(token.RoomID), token.ID)
+	pipe.Exec(ctx)
+}
+
+// Peek checks if a token is valid without consuming it
+func (rt *RedisTokens) Peek(tokenID string) (*Token, error) {
+	token, _, err := rt.get(tokenID)
+	return token, err
+}
+
+// RevokeToken removes a single unused token
+func (rt *RedisTokens) RevokeToken(tokenID string) error {
+	token, raw, err := rt.get(tokenID)
+	if err != nil {
+		return err
+	}
+	return rt.take(token, raw)
+}
+
+// RevokeRoomTokens removes all tokens for a room and returns how many there were
+func (rt *RedisTokens) RevokeRoomTokens(roomID string) int {
+	ctx, cancel := rt.ctx()
+	defer cancel()
+
+	ids, err := rt.client.SMembers(ctx, rt.roomKey(roomID)).Result()
+	if err != nil {
+		return 0
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, rt.tokenKey(id))
+	}
+
+	pipe := rt.client.TxPipeline()
+	var deleted *redis.IntCmd
+	if len(keys) > 0 {
+		deleted = pipe.Del(ctx, keys...)
+	}
+	pipe.Del(ctx, rt.roomKey(roomID))
+	if _, err := pipe.Exec(ctx); err != nil || deleted == nil {
+		return 0
+	}
+	return int(deleted.Val())
+}
+
+// ListRoomTokens returns a room's unexpired tokens, oldest first
+func (rt *RedisTokens) ListRoomTokens(roomID string) []*Token {
+	ctx, cancel := rt.ctx()
+	defer cancel()
+
+	ids, err := rt.client.SMembers(ctx, rt.roomKey(roomID)).Result()
+	if err != nil || len(ids) == 0 {
+		return nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = rt.tokenKey(id)
+	}
+	values, err := rt.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil
+	}
+
+	var list []*Token
+	for i, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			continue // expired since SMEMBERS
+		}
+		if token, err := decodeRedisToken(ids[i], raw); err == nil {
+			list = append(list, token)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Stop closes the Redis client
+func (rt *RedisTokens) Stop() {
+	rt.client.Close()
+}
+
+// get loads a token and the raw value it was decoded from
+func (rt *RedisTokens) get(tokenID string) (*Token, string, error) {
+	ctx, cancel := rt.ctx()
+	defer cancel()
+
+	raw, err := rt.client.Get(ctx, rt.tokenKey(tokenID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, "", ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := decodeRedisToken(tokenID, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, "", ErrTokenNotFound
+	}
+	return token, raw, nil
+}
+
+// take deletes a token if it is still exactly what get returned
+func (rt *RedisTokens) take(token *Token, raw string) error {
+	ctx, cancel := rt.ctx()
+	defer cancel()
+
+	won, err := takeScript.Run(ctx, rt.client,
+		[]string{rt.tokenKey(token.ID), rt.roomKey(token.RoomID)}, raw, token.ID).Int()
+	if err != nil {
+		return err
+	}
+	if won == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+func encodeRedisToken(token *Token) (string, error) {
+	data, err := json.Marshal(redisToken{
+		RoomID:    token.RoomID,
+		CreatedAt: token.CreatedAt.UnixNano(),
+		ExpiresAt: token.ExpiresAt.UnixNano(),
+		Scope:     token.Scope,
+		Metadata:  token.Metadata,
+		BoundTo:   token.boundTo,
+	})
+	return string(data), err
+}
+
+func decodeRedisToken(tokenID, raw string) (*Token, error) {
+	var rec redisToken
+	if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+		return nil, errors.New("corrupt token record " + strconv.Quote(truncateID(tokenID)))
+	}
+	return &Token{
+		ID:        tokenID,
+		RoomID:    rec.RoomID,
+		CreatedAt: time.Unix(0, rec.CreatedAt),
+		ExpiresAt: time.Unix(0, rec.ExpiresAt),
+		Scope:     rec.Scope,
+		Metadata:  rec.Metadata,
+		boundTo:   rec.BoundTo,
+	}, nil
+}
+
+// truncateID shortens a token ID to the prefix used in errors
+func truncateID(tokenID string) string {
+	if len(tokenID) > 8 {
+		return tokenID[:8]
+	}
+	return tokenID
+}
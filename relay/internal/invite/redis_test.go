@@ -0,0 +1,130 @@
+package invite
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*RedisTokens, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rt := NewRedisTokens(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	t.Cleanup(rt.Stop)
+	return rt, mr
+}
+
+// TestRedisRoundTrip verifies tokens keep their options and are single-use
+func TestRedisRoundTrip(t *testing.T) {
+	rt, _ := newTestRedis(t)
+
+	roomID := "redis-room-12345678901234567890123456789"
+	token, err := rt.CreateTokenWithOptions(roomID, TokenOptions{
+		Scope:       room.RoleObserver,
+		Fingerprint: "SHA256:alice-key-fingerprint",
+		Metadata:    []byte("sealed"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	peeked, err := rt.Peek(token.ID)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if peeked.RoomID != roomID || peeked.Scope != room.RoleObserver || string(peeked.Metadata) != "sealed" || !peeked.Bound() {
+		t.Errorf("Token options lost in Redis: %+v", peeked)
+	}
+
+	if _, err := rt.Consume(token.ID, "SHA256:mallory"); err != ErrFingerprint {
+		t.Errorf("Expected ErrFingerprint, got %v", err)
+	}
+	if _, err := rt.Consume(token.ID, "SHA256:alice-key-fingerprint"); err != nil {
+		t.Fatalf("First use should succeed: %v", err)
+	}
+	if _, err := rt.Consume(token.ID, "SHA256:alice-key-fingerprint"); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound on reuse, got %v", err)
+	}
+}
+
+// TestRedisSharedAcrossNodes verifies two nodes on one Redis see one token set
+// and exactly one of them wins a race to consume
+func TestRedisSharedAcrossNodes(t *testing.T) {
+	node1, mr := newTestRedis(t)
+	node2 := NewRedisTokens(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	defer node2.Stop()
+
+	token, _ := node1.CreateToken("shared-room")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for _, node := range []*RedisTokens{node1, node2, node1, node2} {
+		wg.Add(1)
+		go func(n *RedisTokens) {
+			defer wg.Done()
+			if _, err := n.ValidateAndConsume(token.ID); err == nil {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if wins != 1 {
+		t.Errorf("Expected exactly 1 successful consume, got %d", wins)
+	}
+}
+
+// TestRedisExpiry verifies tokens vanish with their TTL
+func TestRedisExpiry(t *testing.T) {
+	rt, mr := newTestRedis(t)
+
+	token, _ := rt.CreateTokenWithOptions("expiry-room", TokenOptions{TTL: 5 * time.Minute})
+	mr.FastForward(6 * time.Minute)
+
+	if _, err := rt.Peek(token.ID); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound after TTL, got %v", err)
+	}
+}
+
+// TestRedisRoomLimitAndRevoke verifies per-room limits, listing and revocation
+func TestRedisRoomLimitAndRevoke(t *testing.T) {
+	rt, _ := newTestRedis(t)
+
+	roomID := "limit-room"
+	if _, err := rt.CreateTokenBatch(roomID, MaxTokensPerRoom, TokenOptions{}); err != nil {
+		t.Fatalf("Batch create failed: %v", err)
+	}
+	if _, err := rt.CreateToken(roomID); err != ErrRoomTokenLimit {
+		t.Errorf("Expected ErrRoomTokenLimit, got %v", err)
+	}
+	if got := len(rt.ListRoomTokens(roomID)); got != MaxTokensPerRoom {
+		t.Errorf("Expected %d listed tokens, got %d", MaxTokensPerRoom, got)
+	}
+
+	if n := rt.RevokeRoomTokens(roomID); n != MaxTokensPerRoom {
+		t.Errorf("Expected %d revoked, got %d", MaxTokensPerRoom, n)
+	}
+	if _, err := rt.CreateToken(roomID); err != nil {
+		t.Errorf("Room should accept tokens after revocation: %v", err)
+	}
+}
+
+// TestRedisRestore verifies a consumed token can be put back
+func TestRedisRestore(t *testing.T) {
+	rt, _ := newTestRedis(t)
+
+	token, _ := rt.CreateToken("restore-room")
+	consumed, _ := rt.Consume(token.ID, "")
+	rt.Restore(consumed)
+
+	if _, err := rt.Consume(token.ID, ""); err != nil {
+		t.Errorf("Restored token should be usable: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package invite
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Errors
+var (
+	ErrKeyTooShort   = errors.New("stateless token key must be at least 32 bytes")
+	ErrTokenRevoked  = errors.New("token revoked")
+	ErrRoomIDTooLong = errors.New("room ID too long for stateless token")
+)
+
+// Stateless token layout
+const (
+	StatelessPrefix  = "v1."
+	MinStatelessKey  = 32
+	statelessNonce   = 16
+	statelessMACSize = 16        // truncated HMAC-SHA256, 128-bit tag
+	maxRoomIDLen     = 64        // keeps the longest token, with metadata, within tokenPattern
+	statelessFixed   = 8 + 8 + 1 // issued, expires, flags
+	statelessBound   = 0x80      // flags bit: fingerprint digest follows
+	statelessMeta    = 0x40      // flags bit: uint16 length + metadata follows
+	statelessScope   = 0x0f      // flags bits: index into statelessScopes
+)
+
+// statelessScopes is the wire encoding of token scopes; index is the byte
+var statelessScopes = []room.Role{room.RoleParticipant, room.RoleObserver, room.RoleCoHost}
+
+// StatelessTokens issues HMAC-signed invite tokens that carry their own room
+// ID, issue time, expiry and nonce. Validation needs only the key, so there is
+// no server-wide token ceiling and any node sharing the key can validate.
+//
+// Single use is enforced with a set of consumed nonces, each kept only until
+// its token would have expired anyway. That set is per node; sharing it across
+// a cluster is up to the deployment.
+type StatelessTokens struct {
+	key         []byte
+	consumed    map[string]time.Time // nonce -> token expiry
+	revoked     map[string]time.Time // roomID -> tokens issued before this are dead
+	mu          sync.Mutex
+	cleanupDone chan struct{}
+}
+
+// NewStatelessTokens creates a stateless token issuer with background cleanup
+func NewStatelessTokens(key []byte) (*StatelessTokens, error) {
+	if len(key) < MinStatelessKey {
+		return nil, ErrKeyTooShort
+	}
+
+	st := &StatelessTokens{
+		key:         append([]byte(nil), key...),
+		consumed:    make(map[string]time.Time),
+		revoked:     make(map[string]time.Time),
+		cleanupDone: make(chan struct{}),
+	}
+
+	go st.cleanupLoop()
+
+	return st, nil
+}
+
+// CreateToken signs a new single-use invite token for a room
+func (st *StatelessTokens) CreateToken(roomID string) (*Token, error) {
+	return st.CreateTokenWithOptions(roomID, TokenOptions{})
+}
+
+// CreateTokenWithOptions signs a token with a custom TTL and scope
+func (st *StatelessTokens) CreateTokenWithOptions(roomID string, opts TokenOptions) (*Token, error) {
+	if len(roomID) > maxRoomIDLen {
+		return nil, ErrRoomIDTooLong
+	}
+	if len(opts.Metadata) > MaxTokenMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+	scope := opts.scope()
+	scopeByte := -1
+	for i, s := range statelessScopes {
+		if s == scope {
+			scopeByte = i
+		}
+	}
+	if scopeByte < 0 {
+		return nil, room.ErrUnknownRole
+	}
+
+	now := time.Now()
+	expires := now.Add(ClampTTL(opts.TTL))
+
+	// len(roomID) | roomID | issued | expires | flags | [digest] | [len | metadata] | nonce | mac
+	boundTo := opts.boundTo()
+	flags := byte(scopeByte)
+	if boundTo != nil {
+		flags |= statelessBound
+	}
+	if len(opts.Metadata) > 0 {
+		flags |= statelessMeta
+	}
+	body := make([]byte, 0, 1+len(roomID)+statelessFixed+len(boundTo)+2+len(opts.Metadata)+statelessNonce+statelessMACSize)
+	body = append(body, byte(len(roomID)))
+	body = append(body, roomID...)
+	body = binary.BigEndian.AppendUint64(body, uint64(now.UnixNano()))
+	body = binary.BigEndian.AppendUint64(body, uint64(expires.Unix()))
+	body = append(body, flags)
+	body = append(body, boundTo...)
+	if len(opts.Metadata) > 0 {
+		body = binary.BigEndian.AppendUint16(body, uint16(len(opts.Metadata)))
+		body = append(body, opts.Metadata...)
+	}
+
+	nonce := make([]byte, statelessNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	body = append(body, nonce...)
+	body = append(body, st.mac(body)...)
+
+	return &Token{
+		ID:        StatelessPrefix + base64.RawURLEncoding.EncodeToString(body),
+		RoomID:    roomID,
+		CreatedAt: now,
+		ExpiresAt: time.Unix(expires.Unix(), 0),
+		Scope:     scope,
+		Metadata:  append([]byte(nil), opts.Metadata...),
+		boundTo:   boundTo,
+	}, nil
+}
+
+// ValidateAndConsume verifies a token's signature and expiry and burns its nonce.
+// Returns the room ID if valid, or an error if invalid/expired/used
+func (st *StatelessTokens) ValidateAndConsume(tokenID string) (string, error) {
+	token, err := st.Consume(tokenID, "")
+	if err != nil {
+		return "", err
+	}
+	return token.RoomID, nil
+}
+
+// Consume is ValidateAndConsume returning the whole token, scope included.
+// A bound token's nonce is only burned when fingerprint matches.
+func (st *StatelessTokens) Consume(tokenID, fingerprint string) (*Token, error) {
+	token, nonce, err := st.decode(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.checkRevokedLocked(token); err != nil {
+		return nil, err
+	}
+	if _, used := st.consumed[nonce]; used {
+		return nil, ErrTokenAlreadyUsed
+	}
+	if !token.allows(fingerprint) {
+		return nil, ErrFingerprint
+	}
+	st.consumed[nonce] = token.ExpiresAt
+
+	return token, nil
+}
+
+// Restore un-burns the nonce of a token returned by Consume whose join then failed
+func (st *StatelessTokens) Restore(token *Token) {
+	_, nonce, err := st.decode(token.ID)
+	if err != nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.consumed, nonce)
+}
+
+// Peek checks if a token is valid without consuming it
+func (st *StatelessTokens) Peek(tokenID string) (*Token, error) {
+	token, nonce, err := st.decode(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.checkRevokedLocked(token); err != nil {
+		return nil, err
+	}
+	if _, used := st.consumed[nonce]; used {
+		return nil, ErrTokenAlreadyUsed
+	}
+
+	return token, nil
+}
+
+// RevokeToken burns a single token's nonce so it can no longer be used
+func (st *StatelessTokens) RevokeToken(tokenID string) error {
+	token, nonce, err := st.decode(tokenID)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.checkRevokedLocked(token); err != nil {
+		return err
+	}
+	if _, used := st.consumed[nonce]; used {
+		return ErrTokenNotFound
+	}
+	st.consumed[nonce] = token.ExpiresAt
+
+	return nil
+}
+
+// RevokeRoomTokens invalidates every token issued for a room so far.
+// Stateless tokens can't be enumerated, so the returned count is always 0.
+func (st *StatelessTokens) RevokeRoomTokens(roomID string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.revoked[roomID] = time.Now()
+	return 0
+}
+
+// ListRoomTokens always returns nil: stateless tokens are not recorded
+// anywhere, so there is nothing to enumerate.
+func (st *StatelessTokens) ListRoomTokens(roomID string) []*Token {
+	return nil
+}
+
+// Stop stops the background cleanup goroutine
+func (st *StatelessTokens) Stop() {
+	close(st.cleanupDone)
+}
+
+// CreateTokenBatch signs n tokens sharing the same options
+func (st *StatelessTokens) CreateTokenBatch(roomID string, n int, opts TokenOptions) ([]*Token, error) {
+	if n < 1 || n > MaxTokensPerRoom {
+		return nil, ErrInvalidCount
+	}
+
+	tokens := make([]*Token, n)
+	for i := range tokens {
+		token, err := st.CreateTokenWithOptions(roomID, opts)
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+// decode verifies and unpacks a token, returning it with its nonce
+func (st *StatelessTokens) decode(tokenID string) (*Token, string, error) {
+	encoded, ok := strings.CutPrefix(tokenID, StatelessPrefix)
+	if !ok {
+		return nil, "", ErrInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(body) < 1 {
+		return nil, "", ErrInvalidToken
+	}
+
+	// The MAC covers everything before it, so check it before parsing
+	if len(body) < statelessMACSize {
+		return nil, "", ErrInvalidToken
+	}
+	signed, tag := body[:len(body)-statelessMACSize], body[len(body)-statelessMACSize:]
+	if !hmac.Equal(tag, st.mac(signed)) {
+		return nil, "", ErrInvalidToken
+	}
+
+	// Every length below was set by us and is covered by the MAC, but bounds
+	// are still checked so a key compromise can't crash the relay
+	rest := signed
+	take := func(n int) []byte {
+		if n < 0 || len(rest) < n {
+			rest = nil
+			return nil
+		}
+		b := rest[:n]
+		rest = rest[n:]
+		return b
+	}
+
+	roomLen := take(1)
+	if roomLen == nil {
+		return nil, "", ErrInvalidToken
+	}
+	roomID := take(int(roomLen[0]))
+	fixed := take(statelessFixed)
+	if fixed == nil {
+		return nil, "", ErrInvalidToken
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(fixed[:8])))
+	expires := time.Unix(int64(binary.BigEndian.Uint64(fixed[8:16])), 0)
+	flags := fixed[16]
+
+	scopeIndex := int(flags & statelessScope)
+	if flags&^(statelessBound|statelessMeta|statelessScope) != 0 || scopeIndex >= len(statelessScopes) {
+		return nil, "", ErrInvalidToken
+	}
+
+	var boundTo []byte
+	if flags&statelessBound != 0 {
+		if boundTo = take(fingerprintDigestSize); boundTo == nil {
+			return nil, "", ErrInvalidToken
+		}
+	}
+
+	var metadata []byte
+	if flags&statelessMeta != 0 {
+		metaLen := take(2)
+		if metaLen == nil {
+			return nil, "", ErrInvalidToken
+		}
+		if metadata = take(int(binary.BigEndian.Uint16(metaLen))); metadata == nil {
+			return nil, "", ErrInvalidToken
+		}
+	}
+
+	if len(rest) != statelessNonce {
+		return nil, "", ErrInvalidToken
+	}
+	nonce := string(rest)
+
+	if time.Now().After(expires) {
+		return nil, "", ErrTokenNotFound
+	}
+
+	return &Token{
+		ID:        tokenID,
+		RoomID:    string(roomID),
+		CreatedAt: issued,
+		ExpiresAt: expires,
+		Scope:     statelessScopes[scopeIndex],
+		Metadata:  metadata,
+		boundTo:   boundTo,
+	}, nonce, nil
+}
+
+func (st *StatelessTokens) checkRevokedLocked(token *Token) error {
+	if revokedAt, ok := st.revoked[token.RoomID]; ok && !token.CreatedAt.After(revokedAt) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+func (st *StatelessTokens) mac(data []byte) []byte {
+	m := hmac.New(sha256.New, st.key)
+	m.Write(data)
+	return m.Sum(nil)[:statelessMACSize]
+}
+
+// cleanupLoop periodically forgets nonces and revocations that can no longer matter
+func (st *StatelessTokens) cleanupLoop() {
+	ticker := time.NewTicker(CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			st.cleanupExpired()
+		case <-st.cleanupDone:
+			return
+		}
+	}
+}
+
+// cleanupExpired drops consumed nonces past their token's expiry and
+// revocations older than the longest token lifetime
+func (st *StatelessTokens) cleanupExpired() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for nonce, expires := range st.consumed {
+		if now.After(expires) {
+			delete(st.consumed, nonce)
+		}
+	}
+	for roomID, revokedAt := range st.revoked {
+		if now.Sub(revokedAt) > MaxTokenTTL {
+			delete(st.revoked, roomID)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package invite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func newTestStateless(t testing.TB) *StatelessTokens {
+	t.Helper()
+	st, err := NewStatelessTokens(testKey)
+	if err != nil {
+		t.Fatalf("Failed to create stateless tokens: %v", err)
+	}
+	return st
+}
+
+// TestStatelessRoundTrip verifies a signed token validates to its room once
+func TestStatelessRoundTrip(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	roomID := "stateless-room-1234567890123456789012345678"
+	token, err := st.CreateToken(roomID)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	if !strings.HasPrefix(token.ID, StatelessPrefix) {
+		t.Errorf("Stateless token should carry version prefix, got %s", token.ID)
+	}
+	if !tokenPattern.MatchString(token.ID) {
+		t.Errorf("Stateless token should pass handler format check: %s", token.ID)
+	}
+
+	peeked, err := st.Peek(token.ID)
+	if err != nil || peeked.RoomID != roomID {
+		t.Fatalf("Peek failed: %v", err)
+	}
+
+	gotRoomID, err := st.ValidateAndConsume(token.ID)
+	if err != nil {
+		t.Fatalf("First use should succeed: %v", err)
+	}
+	if gotRoomID != roomID {
+		t.Errorf("Room ID mismatch: expected %s, got %s", roomID, gotRoomID)
+	}
+
+	if _, err := st.ValidateAndConsume(token.ID); err != ErrTokenAlreadyUsed {
+		t.Errorf("Expected ErrTokenAlreadyUsed on reuse, got %v", err)
+	}
+}
+
+// TestStatelessCrossInstance verifies any instance sharing the key validates tokens
+func TestStatelessCrossInstance(t *testing.T) {
+	issuer := newTestStateless(t)
+	defer issuer.Stop()
+	validator := newTestStateless(t)
+	defer validator.Stop()
+
+	token, _ := issuer.CreateToken("cross-node-room")
+	if _, err := validator.ValidateAndConsume(token.ID); err != nil {
+		t.Errorf("Token should validate on another node with the same key: %v", err)
+	}
+
+	otherKey, _ := NewStatelessTokens(bytes.Repeat([]byte{0x07}, 32))
+	defer otherKey.Stop()
+	token, _ = issuer.CreateToken("cross-node-room")
+	if _, err := otherKey.ValidateAndConsume(token.ID); err != ErrInvalidToken {
+		t.Errorf("Token signed with another key should be invalid, got %v", err)
+	}
+}
+
+// TestStatelessTamperedToken verifies modified tokens fail the MAC check
+func TestStatelessTamperedToken(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	token, _ := st.CreateToken("tamper-room")
+
+	// Flip one character in the signed body
+	b := []byte(token.ID)
+	i := len(StatelessPrefix) + 3
+	if b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+
+	for _, bad := range []string{string(b), token.ID[:len(token.ID)-4], "v1.", "not-a-token"} {
+		if _, err := st.ValidateAndConsume(bad); err != ErrInvalidToken {
+			t.Errorf("Token %q: expected ErrInvalidToken, got %v", bad, err)
+		}
+	}
+}
+
+// TestStatelessRevokeRoom verifies revocation kills earlier tokens but not later ones
+func TestStatelessRevokeRoom(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	old, _ := st.CreateToken("revoke-room")
+	st.RevokeRoomTokens("revoke-room")
+	time.Sleep(time.Millisecond)
+	fresh, _ := st.CreateToken("revoke-room")
+
+	if _, err := st.ValidateAndConsume(old.ID); err != ErrTokenRevoked {
+		t.Errorf("Expected ErrTokenRevoked, got %v", err)
+	}
+	if _, err := st.ValidateAndConsume(fresh.ID); err != nil {
+		t.Errorf("Token issued after revocation should be valid: %v", err)
+	}
+}
+
+// TestStatelessShortKey verifies weak keys are rejected
+func TestStatelessShortKey(t *testing.T) {
+	if _, err := NewStatelessTokens([]byte("short")); err != ErrKeyTooShort {
+		t.Errorf("Expected ErrKeyTooShort, got %v", err)
+	}
+}
+
+// TestStatelessCustomTTL verifies the requested expiry is signed into the token
+func TestStatelessCustomTTL(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	token, _ := st.CreateTokenWithOptions("ttl-room", TokenOptions{TTL: 5 * time.Minute})
+	peeked, err := st.Peek(token.ID)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if !peeked.ExpiresAt.Equal(token.ExpiresAt) {
+		t.Errorf("Expected expiry %v, got %v", token.ExpiresAt, peeked.ExpiresAt)
+	}
+	if time.Until(peeked.ExpiresAt) > 5*time.Minute {
+		t.Errorf("Expiry should be at most 5 minutes out, got %v", time.Until(peeked.ExpiresAt))
+	}
+}
+
+// TestStatelessRevokeSingleToken verifies revoking one token leaves its siblings valid
+func TestStatelessRevokeSingleToken(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	leaked, _ := st.CreateToken("revoke-one-room")
+	kept, _ := st.CreateToken("revoke-one-room")
+
+	if err := st.RevokeToken(leaked.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := st.ValidateAndConsume(leaked.ID); err != ErrTokenAlreadyUsed {
+		t.Errorf("Revoked token should be unusable, got %v", err)
+	}
+	if _, err := st.ValidateAndConsume(kept.ID); err != nil {
+		t.Errorf("Other token should still be valid: %v", err)
+	}
+}
+
+// TestStatelessScope verifies the scope is signed into the token
+func TestStatelessScope(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	for _, scope := range []room.Role{room.RoleParticipant, room.RoleObserver, room.RoleCoHost} {
+		token, err := st.CreateTokenWithOptions("scope-room", TokenOptions{Scope: scope})
+		if err != nil {
+			t.Fatalf("Failed to create %s token: %v", scope, err)
+		}
+		consumed, err := st.Consume(token.ID, "")
+		if err != nil {
+			t.Fatalf("Consume failed: %v", err)
+		}
+		if consumed.Scope != scope {
+			t.Errorf("Expected scope %q, got %q", scope, consumed.Scope)
+		}
+	}
+
+	if _, err := st.CreateTokenWithOptions("scope-room", TokenOptions{Scope: "admin"}); err != room.ErrUnknownRole {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+}
+
+// TestStatelessFingerprintBound verifies the binding is signed in and enforced
+func TestStatelessFingerprintBound(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	token, err := st.CreateTokenWithOptions("bound-room", TokenOptions{
+		Scope:       room.RoleObserver,
+		Fingerprint: "SHA256:alice-key-fingerprint",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	peeked, err := st.Peek(token.ID)
+	if err != nil || !peeked.Bound() || peeked.Scope != room.RoleObserver {
+		t.Fatalf("Peek should report a bound observer token: %+v, %v", peeked, err)
+	}
+	if _, err := st.Consume(token.ID, "SHA256:mallory-key-fingerprint"); err != ErrFingerprint {
+		t.Errorf("Expected ErrFingerprint, got %v", err)
+	}
+	if _, err := st.Consume(token.ID, "SHA256:alice-key-fingerprint"); err != nil {
+		t.Errorf("Bound key should consume the token: %v", err)
+	}
+
+	unbound, _ := st.CreateToken("bound-room")
+	if peeked, _ := st.Peek(unbound.ID); peeked.Bound() {
+		t.Error("Token created without a fingerprint should be unbound")
+	}
+}
+
+// TestStatelessMetadata verifies the host's blob round-trips and stays within the token format
+func TestStatelessMetadata(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	meta := bytes.Repeat([]byte{0xA5}, MaxTokenMetadataSize)
+	roomID := strings.Repeat("r", maxRoomIDLen)
+	token, err := st.CreateTokenWithOptions(roomID, TokenOptions{
+		Fingerprint: "SHA256:alice-key-fingerprint",
+		Metadata:    meta,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if !tokenPattern.MatchString(token.ID) {
+		t.Errorf("Largest token (%d chars) should pass handler format check", len(token.ID))
+	}
+
+	peeked, err := st.Peek(token.ID)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if !bytes.Equal(peeked.Metadata, meta) || !peeked.Bound() {
+		t.Error("Metadata and binding should survive the round trip")
+	}
+
+	if _, err := st.CreateTokenWithOptions("meta-room", TokenOptions{Metadata: make([]byte, MaxTokenMetadataSize+1)}); err != ErrMetadataTooLarge {
+		t.Errorf("Expected ErrMetadataTooLarge, got %v", err)
+	}
+}
+
+// TestStatelessRestore verifies restoring un-burns the nonce
+func TestStatelessRestore(t *testing.T) {
+	st := newTestStateless(t)
+	defer st.Stop()
+
+	token, _ := st.CreateToken("restore-room")
+	consumed, _ := st.Consume(token.ID, "")
+	st.Restore(consumed)
+
+	if _, err := st.Consume(token.ID, ""); err != nil {
+		t.Errorf("Restored token should be usable: %v", err)
+	}
+	if _, err := st.Consume(token.ID, ""); err != ErrTokenAlreadyUsed {
+		t.Errorf("Expected ErrTokenAlreadyUsed after second use, got %v", err)
+	}
+}
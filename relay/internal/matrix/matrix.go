@@ -0,0 +1,224 @@
+// Package matrix speaks the Matrix application service API. The
+// homeserver pushes events from the rooms a service is in as transactions,
+// and the service acts in those rooms through the client-server API as its
+// bot user. Nothing is stored: a restart forgets every room.
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits
+const (
+	MaxTransactionSize = 4 * 1024 * 1024 // Bounds a pushed transaction's body
+	RememberedTxns     = 1024            // Transaction IDs kept to spot the homeserver's retries
+	RequestTimeout     = 30 * time.Second
+)
+
+// Errors
+var (
+	ErrNoHomeserver = errors.New("matrix homeserver URL required")
+	ErrNoToken      = errors.New("matrix as_token and hs_token required")
+)
+
+// Event is a room event as the homeserver pushes it
+type Event struct {
+	EventID  string          `json:"event_id"`
+	Type     string          `json:"type"`
+	RoomID   string          `json:"room_id"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// Membership returns a member event's membership, or ""
+func (e Event) Membership() string {
+	if e.Type != "m.room.member" {
+		return ""
+	}
+	var c struct {
+		Membership string `json:"membership"`
+	}
+	json.Unmarshal(e.Content, &c)
+	return c.Membership
+}
+
+// Client acts on the homeserver as the service's bot
+type Client struct {
+	homeserver string
+	token      string
+	userID     string
+	http       *http.Client
+	txnPrefix  string
+	txnSeq     atomic.Uint64
+}
+
+// NewClient creates a client for the homeserver at base, acting as userID
+// with the registration's as_token
+func NewClient(base, asToken, userID string) (*Client, error) {
+	if base == "" {
+		return nil, ErrNoHomeserver
+	}
+	if asToken == "" {
+		return nil, ErrNoToken
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &Client{
+		homeserver: strings.TrimRight(base, "/"),
+		token:      asToken,
+		userID:     userID,
+		http:       &http.Client{Timeout: RequestTimeout},
+		txnPrefix:  hex.EncodeToString(prefix),
+	}, nil
+}
+
+// UserID returns the bot's user ID
+func (c *Client) UserID() string {
+	return c.userID
+}
+
+// JoinRoom accepts an invite to roomID
+func (c *Client) JoinRoom(ctx context.Context, roomID string) error {
+	return c.do(ctx, http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/join", struct{}{})
+}
+
+// LeaveRoom leaves roomID
+func (c *Client) LeaveRoom(ctx context.Context, roomID string) error {
+	return c.do(ctx, http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/leave", struct{}{})
+}
+
+// SendEvent sends a message event of type eventType to roomID
+func (c *Client) SendEvent(ctx context.Context, roomID, eventType string, content any) error {
+	txn := fmt.Sprintf("%s.%d", c.txnPrefix, c.txnSeq.Add(1))
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/" + url.PathEscape(eventType) + "/" + txn
+	return c.do(ctx, http.MethodPut, path, content)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.homeserver+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errcode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		return fmt.Errorf("matrix %s %s: %d %s %s", method, path, resp.StatusCode, e.Errcode, e.Error)
+	}
+	return nil
+}
+
+// Transactions serves the homeserver's pushes under /_matrix/app/, handing
+// each event to handle in the order it arrives. Only requests bearing the
+// registration's hs_token are believed.
+type Transactions struct {
+	hsToken string
+	handle  func(Event)
+
+	mu   sync.Mutex // serializes transactions, keeping events in order
+	seen map[string]bool
+	ring []string // seen, oldest first
+}
+
+// NewTransactions creates the push endpoint
+func NewTransactions(hsToken string, handle func(Event)) (*Transactions, error) {
+	if hsToken == "" {
+		return nil, ErrNoToken
+	}
+	return &Transactions{
+		hsToken: hsToken,
+		handle:  handle,
+		seen:    make(map[string]bool),
+	}, nil
+}
+
+type errorResponse struct {
+	Errcode string `json:"errcode"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (t *Transactions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token") // homeservers before v1.4
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t.hsToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errorResponse{Errcode: "M_FORBIDDEN"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	switch {
+	case strings.HasPrefix(path, "/transactions/") && r.Method == http.MethodPut:
+		t.serveTransaction(w, r, strings.TrimPrefix(path, "/transactions/"))
+	case strings.HasPrefix(path, "/users/"), strings.HasPrefix(path, "/rooms/"):
+		// Nothing is provisioned on demand: users invite the bot
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse{Errcode: "M_NOT_FOUND"})
+	case path == "/ping" && r.Method == http.MethodPost:
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse{Errcode: "M_UNRECOGNIZED"})
+	}
+}
+
+func (t *Transactions) serveTransaction(w http.ResponseWriter, r *http.Request, txnID string) {
+	var txn struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxTransactionSize)).Decode(&txn); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Errcode: "M_NOT_JSON", Error: "invalid transaction"})
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// A retry of a transaction already handled is acknowledged again
+	if !t.seen[txnID] {
+		for _, ev := range txn.Events {
+			t.handle(ev)
+		}
+		t.seen[txnID] = true
+		t.ring = append(t.ring, txnID)
+		if len(t.ring) > RememberedTxns {
+			delete(t.seen, t.ring[0])
+			t.ring = t.ring[1:]
+		}
+	}
+	w.Write([]byte("{}"))
+}
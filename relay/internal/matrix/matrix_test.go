@@ -0,0 +1,82 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTransactions verifies only the homeserver is believed, events are
+// handed on in order, and a retried transaction isn't handled twice
+func TestTransactions(t *testing.T) {
+	var got []string
+	txns, err := NewTransactions("hs-secret", func(ev Event) { got = append(got, ev.EventID) })
+	if err != nil {
+		t.Fatalf("NewTransactions failed: %v", err)
+	}
+	push := func(txnID, token string) int {
+		body := `{"events":[{"event_id":"$1","type":"m.room.message","room_id":"!r:hs","sender":"@a:hs","content":{}},{"event_id":"$2","type":"m.room.message","room_id":"!r:hs","sender":"@a:hs","content":{}}]}`
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		txns.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := push("t1", "wrong"); code != http.StatusForbidden || len(got) != 0 {
+		t.Errorf("Expected 403 and nothing handled with a wrong token, got %d and %v", code, got)
+	}
+	if code := push("t1", "hs-secret"); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if code := push("t1", "hs-secret"); code != http.StatusOK {
+		t.Errorf("Expected a retry acknowledged, got %d", code)
+	}
+	if strings.Join(got, ",") != "$1,$2" {
+		t.Errorf("Expected events $1,$2 once, got %v", got)
+	}
+}
+
+// TestClientSendEvent verifies events go out as the bot with the as_token
+// and a fresh transaction ID each
+func TestClientSendEvent(t *testing.T) {
+	var paths []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer as-secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var content map[string]string
+		json.Unmarshal(body, &content)
+		if content["frame"] != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		w.Write([]byte(`{"event_id":"$e"}`))
+	}))
+	defer hs.Close()
+
+	c, err := NewClient(hs.URL, "as-secret", "@relay:hs")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.SendEvent(context.Background(), "!room:hs", "org.example.frame", map[string]string{"frame": "x"}); err != nil {
+			t.Fatalf("SendEvent failed: %v", err)
+		}
+	}
+	if len(paths) != 2 || paths[0] == paths[1] || !strings.HasPrefix(paths[0], "PUT /_matrix/client/v3/rooms/%21room:hs/send/org.example.frame/") {
+		t.Errorf("Expected two sends with distinct transaction IDs, got %v", paths)
+	}
+
+	c.token = "wrong"
+	if err := c.SendEvent(context.Background(), "!room:hs", "org.example.frame", map[string]string{"frame": "x"}); err == nil {
+		t.Error("Expected a refused send to fail")
+	}
+}
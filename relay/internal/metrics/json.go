@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// JSONFamily is one metric in the /metrics.json document
+type JSONFamily struct {
+	Type    string       `json:"type"` // counter, gauge, histogram or summary
+	Help    string       `json:"help"`
+	Metrics []JSONMetric `json:"metrics"`
+}
+
+// JSONMetric is one labelled series. Counters and gauges set Value;
+// histograms set Count, Sum and cumulative Buckets keyed by upper bound.
+type JSONMetric struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   *float64          `json:"value,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+// JSONHandler serves the same metrics as Handler as a JSON object keyed
+// by metric name, for consumers without a Prometheus parser
+func (m *Metrics) JSONHandler(rooms Rooms) http.Handler {
+	gatherer := m.Gatherer(rooms)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, "Failed to gather metrics", http.StatusInternalServerError)
+			return
+		}
+
+		doc := make(map[string]JSONFamily, len(families))
+		for _, mf := range families {
+			doc[mf.GetName()] = toJSONFamily(mf)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(doc)
+	})
+}
+
+func toJSONFamily(mf *dto.MetricFamily) JSONFamily {
+	f := JSONFamily{
+		Help:    mf.GetHelp(),
+		Metrics: make([]JSONMetric, 0, len(mf.GetMetric())),
+	}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		f.Type = "counter"
+	case dto.MetricType_GAUGE:
+		f.Type = "gauge"
+	case dto.MetricType_HISTOGRAM:
+		f.Type = "histogram"
+	case dto.MetricType_SUMMARY:
+		f.Type = "summary"
+	default:
+		f.Type = "untyped"
+	}
+
+	for _, metric := range mf.GetMetric() {
+		var jm JSONMetric
+		if len(metric.GetLabel()) > 0 {
+			jm.Labels = make(map[string]string, len(metric.GetLabel()))
+			for _, lp := range metric.GetLabel() {
+				jm.Labels[lp.GetName()] = lp.GetValue()
+			}
+		}
+
+		switch {
+		case metric.Counter != nil:
+			jm.Value = metric.Counter.Value
+		case metric.Gauge != nil:
+			jm.Value = metric.Gauge.Value
+		case metric.Untyped != nil:
+			jm.Value = metric.Untyped.Value
+		case metric.Histogram != nil:
+			h := metric.Histogram
+			jm.Count, jm.Sum = h.SampleCount, h.SampleSum
+			jm.Buckets = make(map[string]uint64, len(h.GetBucket()))
+			for _, b := range h.GetBucket() {
+				jm.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+			}
+		case metric.Summary != nil:
+			jm.Count, jm.Sum = metric.Summary.SampleCount, metric.Summary.SampleSum
+		}
+		f.Metrics = append(f.Metrics, jm)
+	}
+	return f
+}
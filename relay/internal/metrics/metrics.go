@@ -1,74 +1,464 @@
-// Package metrics provides simple in-memory metrics for the relay server
+// Package metrics provides Prometheus metrics for the relay server
 package metrics
 
 import (
-	"fmt"
+	"net/http"
+	"strings"
 	"sync/atomic"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 )
 
-// Metrics holds server metrics (counts only, no PII)
+// Metrics holds server metrics (counts only, no PII). Labels only ever
+// take values from fixed sets defined here, never identifiers, save the
+// tenant counters': those carry the names operators gave API keys.
 type Metrics struct {
-	RoomsCreated     uint64
-	RoomsDestroyed   uint64
-	ConnectionsTotal uint64
-	MessagesRelayed  uint64
-	RateLimited      uint64
+	registry *prometheus.Registry
+	runtime  *prometheus.Registry // Go and process collectors
+
+	roomsCreated     prometheus.Counter
+	roomsDestroyed   prometheus.Counter
+	roomsActive      prometheus.Gauge
+	roomsOccupancy   *prometheus.GaugeVec
+	connectionsTotal prometheus.Counter
+	connectionsOpen  prometheus.Gauge
+	queueFrames      *prometheus.GaugeVec
+	queueFill        *prometheus.GaugeVec
+	messagesRelayed  prometheus.Counter
+	coverFrames      prometheus.Counter
+	roomReports      prometheus.Counter
+	rateLimited      *prometheus.CounterVec
+	connectionsShed  prometheus.Counter
+	upgradeFailures  *prometheus.CounterVec
+	accessDenied     prometheus.Counter
+	bansIssued       prometheus.Counter
+	banRejected      prometheus.Counter
+	panicsRecovered  atomic.Uint64 // outside room loops; the room package counts its own
+
+	// Client-reported protocol errors, by category
+	clientErrors *prometheus.CounterVec
+
+	// Load by tenant, the API key a room's host presented
+	tenantRooms       *prometheus.CounterVec
+	tenantMessages    *prometheus.CounterVec
+	tenantRateLimited *prometheus.CounterVec
+
+	messageSize  prometheus.Histogram
+	relayLatency prometheus.Histogram
+	jitterDelay  prometheus.Histogram
+	connDuration *prometheus.HistogramVec
+
+	statsd atomic.Pointer[StatsD] // per-event timings also go here when set
+}
+
+// Histogram buckets. Sizes bracket the 64KB socket buffers and the 8MB
+// message limit; latencies run from an idle queue to a stalled reader.
+// Durations separate heartbeat (6s) and idle-proxy (~60s) cutoffs from
+// rooms that stay up for hours.
+var (
+	MessageSizeBuckets  = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 8 << 20}
+	RelayLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+	DurationBuckets     = []float64{1, 5, 10, 30, 60, 120, 300, 900, 1800, 3600, 4 * 3600}
+)
+
+// Occupancy buckets: the label for each range of clients per room, and
+// the largest count it covers. MaxClientsPerRoom is 50.
+var occupancyBuckets = []struct {
+	label string
+	max   int
+}{
+	{"0", 0},
+	{"1-2", 2},
+	{"3-10", 10},
+	{"11-50", 50},
 }
 
+// Connection roles accepted by ObserveConnection
+const (
+	RoleHost   = "host"
+	RoleClient = "client"
+)
+
 // Global metrics instance
-var Global = &Metrics{}
+var Global = New()
+
+// New creates a metrics set with its own registries
+func New() *Metrics {
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Namespace: "ephemeral", Name: name, Help: help})
+	}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		runtime:  prometheus.NewRegistry(),
+
+		roomsCreated:   counter("rooms_created_total", "Total rooms created"),
+		roomsDestroyed: counter("rooms_destroyed_total", "Total rooms destroyed"),
+		roomsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ephemeral", Name: "rooms_active", Help: "Current active rooms",
+		}),
+		roomsOccupancy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ephemeral", Name: "rooms_by_occupancy", Help: "Active rooms by number of clients",
+		}, []string{"clients"}),
+		connectionsTotal: counter("connections_total", "Total connections"),
+		connectionsOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ephemeral", Name: "connections_open", Help: "WebSocket connections currently open",
+		}),
+		queueFrames: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ephemeral", Name: "send_queue_frames", Help: "Frames waiting in send channels, by queue",
+		}, []string{"queue"}),
+		queueFill: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ephemeral", Name: "send_queue_fill_max", Help: "Fill ratio of the fullest send channel, by queue",
+		}, []string{"queue"}),
+		messagesRelayed: counter("messages_relayed_total", "Total messages relayed"),
+		coverFrames:     counter("cover_frames_total", "Dummy frames sent to rooms that asked for cover traffic"),
+		roomReports:     counter("room_reports_total", "Rooms reported for abuse, counting each member once per room"),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "rate_limited_total", Help: "Requests and messages refused, by scope and cause",
+		}, []string{"scope", "cause"}),
+		upgradeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "upgrade_failures_total", Help: "WebSocket upgrades that did not complete, by reason",
+		}, []string{"reason"}),
+		connectionsShed: counter("connections_shed_total", "Upgrades refused at the connection ceiling"),
+		accessDenied:    counter("access_denied_total", "Requests refused by the operator deny list"),
+		bansIssued:      counter("bans_total", "Temporary bans issued to repeat rate-limit offenders"),
+		banRejected:     counter("ban_rejected_total", "Requests refused while the source was banned"),
+		clientErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "client_errors_total", Help: "Protocol errors reported by clients",
+		}, []string{"category"}),
+		tenantRooms: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "tenant_rooms_created_total", Help: "Rooms created by hosts presenting an API key, by tenant",
+		}, []string{"tenant"}),
+		tenantMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "tenant_messages_relayed_total", Help: "Messages relayed in tenants' rooms, by tenant",
+		}, []string{"tenant"}),
+		tenantRateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "tenant_rate_limited_total", Help: "Host connections and messages refused in tenants' rooms, by tenant",
+		}, []string{"tenant"}),
+		messageSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "ephemeral", Name: "message_size_bytes", Help: "Payload size of relayed messages",
+			Buckets: MessageSizeBuckets,
+		}),
+		relayLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "ephemeral", Name: "relay_latency_seconds", Help: "Time frames spend queued before being written to a socket",
+			Buckets: RelayLatencyBuckets,
+		}),
+		jitterDelay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "ephemeral", Name: "jitter_delay_seconds", Help: "Random delay added before writing frames in rooms that asked for jitter",
+			Buckets: RelayLatencyBuckets,
+		}),
+		connDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ephemeral", Name: "connection_duration_seconds", Help: "Lifetime of WebSocket connections, by role",
+			Buckets: DurationBuckets,
+		}, []string{"role"}),
+	}
+
+	m.registry.MustRegister(
+		m.roomsCreated, m.roomsDestroyed, m.roomsActive, m.roomsOccupancy, m.connectionsTotal,
+		m.connectionsOpen, m.queueFrames, m.queueFill,
+		m.messagesRelayed, m.coverFrames, m.roomReports, m.rateLimited, m.connectionsShed, m.upgradeFailures, m.accessDenied,
+		m.bansIssued, m.banRejected, m.clientErrors, m.tenantRooms, m.tenantMessages,
+		m.tenantRateLimited, m.messageSize, m.relayLatency,
+		m.jitterDelay, m.connDuration,
+	)
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "ephemeral", Name: "panics_recovered_total", Help: "Panics recovered in connection and room goroutines",
+	}, func() float64 { return float64(m.panicsRecovered.Load() + room.Panics()) }))
+	// Frames dropped before reaching a send queue, counted in the room package
+	for cause, label := range map[room.DropCause]string{
+		room.DropHostFull:   "host_full",
+		room.DropClientFull: "client_full",
+		room.DropClosed:     "closed",
+	} {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "ephemeral", Name: "frames_dropped_total", Help: "Frames dropped without being queued, by cause",
+			ConstLabels: prometheus.Labels{"cause": label},
+		}, func() float64 { return float64(room.Dropped(cause)) }))
+	}
+	m.runtime.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	// Export every category from the start, not only once seen
+	for _, c := range []string{ClientErrorDecode, ClientErrorState, clientErrorOther} {
+		m.clientErrors.WithLabelValues(c)
+	}
+	for _, scope := range []string{ScopeConnection, ScopeMessage, ScopeInvite, ScopeTURN, ScopeReport} {
+		for _, cause := range []string{CauseLimiter, CauseDenylist, CauseJail, CauseNoProof, CauseQuota} {
+			m.rateLimited.WithLabelValues(scope, cause)
+		}
+	}
+	for _, reason := range upgradeReasons {
+		m.upgradeFailures.WithLabelValues(reason)
+	}
+	for _, b := range occupancyBuckets {
+		m.roomsOccupancy.WithLabelValues(b.label)
+	}
+	for _, r := range []string{RoleHost, RoleClient} {
+		m.connDuration.WithLabelValues(r)
+	}
+	return m
+}
 
 // IncRoomsCreated increments the rooms created counter
 func (m *Metrics) IncRoomsCreated() {
-	atomic.AddUint64(&m.RoomsCreated, 1)
+	m.roomsCreated.Inc()
 }
 
 // IncRoomsDestroyed increments the rooms destroyed counter
 func (m *Metrics) IncRoomsDestroyed() {
-	atomic.AddUint64(&m.RoomsDestroyed, 1)
+	m.roomsDestroyed.Inc()
 }
 
-// IncConnections increments the connections counter
+// IncConnections counts a connection as opened
 func (m *Metrics) IncConnections() {
-	atomic.AddUint64(&m.ConnectionsTotal, 1)
+	m.connectionsTotal.Inc()
+	m.connectionsOpen.Inc()
+}
+
+// DecOpenConnections counts a connection as closed
+func (m *Metrics) DecOpenConnections() {
+	m.connectionsOpen.Dec()
 }
 
 // IncMessages increments the messages relayed counter
 func (m *Metrics) IncMessages() {
-	atomic.AddUint64(&m.MessagesRelayed, 1)
+	m.messagesRelayed.Inc()
+}
+
+// IncCoverFrames counts a dummy frame sent as cover traffic
+func (m *Metrics) IncCoverFrames() {
+	m.coverFrames.Inc()
+}
+
+// IncReports counts a member's report of a room
+func (m *Metrics) IncReports() {
+	m.roomReports.Inc()
+}
+
+// Rate-limit scopes: what was refused
+const (
+	ScopeConnection = "connection" // WebSocket upgrade
+	ScopeMessage    = "message"    // frame on an open connection
+	ScopeInvite     = "invite"     // invite API request
+	ScopeTURN       = "turn"       // TURN credential request
+	ScopeReport     = "report"     // abuse report
+)
+
+// Rate-limit causes: what refused it
+const (
+	CauseLimiter  = "limiter"  // a rate or connection budget ran out
+	CauseDenylist = "denylist" // the operator deny list
+	CauseJail     = "jail"     // a temporary ban for repeat offenses
+	CauseNoProof  = "no_proof" // an onion service peer without proof of work
+	CauseQuota    = "quota"    // a tenant's quota ran out
+)
+
+// IncRateLimited counts a refusal by scope and cause. Deny list and jail
+// refusals also count toward access_denied_total and ban_rejected_total.
+func (m *Metrics) IncRateLimited(scope, cause string) {
+	m.rateLimited.WithLabelValues(scope, cause).Inc()
+	switch cause {
+	case CauseDenylist:
+		m.accessDenied.Inc()
+	case CauseJail:
+		m.banRejected.Inc()
+	}
+}
+
+// IncTenantRooms counts a room created by a host presenting tenant's key.
+// Rooms of no tenant, "", aren't counted here.
+func (m *Metrics) IncTenantRooms(tenant string) {
+	if tenant != "" {
+		m.tenantRooms.WithLabelValues(tenant).Inc()
+	}
+}
+
+// IncTenantMessages counts a message relayed in one of tenant's rooms
+func (m *Metrics) IncTenantMessages(tenant string) {
+	if tenant != "" {
+		m.tenantMessages.WithLabelValues(tenant).Inc()
+	}
+}
+
+// IncTenantRateLimited counts a host connection presenting tenant's key,
+// or a message in one of its rooms, refused by its limits. It's counted
+// by IncRateLimited as well.
+func (m *Metrics) IncTenantRateLimited(tenant string) {
+	if tenant != "" {
+		m.tenantRateLimited.WithLabelValues(tenant).Inc()
+	}
+}
+
+// Upgrade failure reasons accepted by IncUpgradeFailure
+const (
+	UpgradeInvalidRoom  = "invalid_room"
+	UpgradeDenied       = "denied"
+	UpgradeBanned       = "banned"
+	UpgradeRateLimited  = "rate_limited"
+	UpgradeShed         = "shed"
+	UpgradeTooManyConns = "too_many_connections"
+	UpgradeBadOrigin    = "bad_origin"
+	UpgradeHandshake    = "handshake"
+	UpgradeDraining     = "draining"
+	UpgradeNoProof      = "no_proof"
+	UpgradeNoCert       = "no_certificate"
+	UpgradeNoCredential = "no_credential"
+	UpgradeQuota        = "quota"
+)
+
+var upgradeReasons = []string{
+	UpgradeInvalidRoom, UpgradeDenied, UpgradeBanned, UpgradeRateLimited,
+	UpgradeShed, UpgradeTooManyConns, UpgradeBadOrigin, UpgradeHandshake,
+	UpgradeNoProof, UpgradeNoCert, UpgradeNoCredential, UpgradeQuota,
+}
+
+// IncUpgradeFailure counts a WebSocket upgrade that was refused or failed
+func (m *Metrics) IncUpgradeFailure(reason string) {
+	m.upgradeFailures.WithLabelValues(reason).Inc()
+}
+
+// IncConnectionsShed increments the counter of upgrades refused at capacity
+func (m *Metrics) IncConnectionsShed() {
+	m.connectionsShed.Inc()
+}
+
+// IncBans increments the counter of temporary bans issued
+func (m *Metrics) IncBans() {
+	m.bansIssued.Inc()
+}
+
+// IncPanics counts a panic recovered rather than crashing the relay
+func (m *Metrics) IncPanics() {
+	m.panicsRecovered.Add(1)
+}
+
+// ObserveMessageSize records the payload size of a relayed message
+func (m *Metrics) ObserveMessageSize(n int) {
+	m.messageSize.Observe(float64(n))
+	if s := m.statsd.Load(); s != nil {
+		s.timing("ephemeral_message_size", float64(n), "h")
+	}
+}
+
+// ObserveRelayLatency records how long a frame waited between being
+// queued for a connection and being written to it
+func (m *Metrics) ObserveRelayLatency(d time.Duration) {
+	m.relayLatency.Observe(d.Seconds())
+	if s := m.statsd.Load(); s != nil {
+		s.timing("ephemeral_relay_latency", float64(d)/float64(time.Millisecond), "ms")
+	}
+}
+
+// ObserveJitter records the random delay a frame was held back for
+func (m *Metrics) ObserveJitter(d time.Duration) {
+	m.jitterDelay.Observe(d.Seconds())
+	if s := m.statsd.Load(); s != nil {
+		s.timing("ephemeral_jitter_delay", float64(d)/float64(time.Millisecond), "ms")
+	}
 }
 
-// IncRateLimited increments the rate limited counter
-func (m *Metrics) IncRateLimited() {
-	atomic.AddUint64(&m.RateLimited, 1)
+// ObserveConnection records how long a host or client connection lasted
+func (m *Metrics) ObserveConnection(role string, d time.Duration) {
+	if role != RoleHost {
+		role = RoleClient
+	}
+	m.connDuration.WithLabelValues(role).Observe(d.Seconds())
+	if s := m.statsd.Load(); s != nil {
+		s.timing("ephemeral_connection_duration", float64(d.Milliseconds()), "ms", "role", role)
+	}
 }
 
-// String returns a prometheus-style metrics string
+// Client error categories accepted by IncClientError
+const (
+	ClientErrorDecode = "decode"
+	ClientErrorState  = "state"
+	clientErrorOther  = "other"
+)
+
+// ClientErrorCategory returns category if it's one the relay knows, and
+// "other" if not, so clients can't grow the label set
+func ClientErrorCategory(category string) string {
+	switch category {
+	case ClientErrorDecode, ClientErrorState:
+		return category
+	}
+	return clientErrorOther
+}
+
+// IncClientError increments the counter for a client-reported error
+// category, as ClientErrorCategory folds it
+func (m *Metrics) IncClientError(category string) {
+	m.clientErrors.WithLabelValues(ClientErrorCategory(category)).Inc()
+}
+
+// Rooms is where the room gauges are read from at scrape time
+type Rooms interface {
+	RoomCount() int
+	ClientCounts() []int
+	SendQueues() (host, clients room.QueueStats)
+}
+
+// SetOccupancy sets the occupancy gauges from per-room client counts
+func (m *Metrics) SetOccupancy(counts []int) {
+	tally := make([]int, len(occupancyBuckets))
+	for _, n := range counts {
+		i := 0
+		for i < len(occupancyBuckets)-1 && n > occupancyBuckets[i].max {
+			i++
+		}
+		tally[i]++
+	}
+	for i, b := range occupancyBuckets {
+		m.roomsOccupancy.WithLabelValues(b.label).Set(float64(tally[i]))
+	}
+}
+
+// SetSendQueues sets the send channel occupancy gauges
+func (m *Metrics) SetSendQueues(host, clients room.QueueStats) {
+	m.queueFrames.WithLabelValues(RoleHost).Set(float64(host.Frames))
+	m.queueFrames.WithLabelValues(RoleClient).Set(float64(clients.Frames))
+	m.queueFill.WithLabelValues(RoleHost).Set(host.MaxFill)
+	m.queueFill.WithLabelValues(RoleClient).Set(clients.MaxFill)
+}
+
+// Gatherer collects the relay metrics plus the standard Go and process
+// collectors (goroutines, heap in use and so on), refreshing the room
+// gauges from rooms first
+func (m *Metrics) Gatherer(rooms Rooms) prometheus.Gatherer {
+	all := prometheus.Gatherers{m.registry, m.runtime}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		m.roomsActive.Set(float64(rooms.RoomCount()))
+		m.SetOccupancy(rooms.ClientCounts())
+		m.SetSendQueues(rooms.SendQueues())
+		return all.Gather()
+	})
+}
+
+// Handler serves Gatherer's metrics for scraping
+func (m *Metrics) Handler(rooms Rooms) http.Handler {
+	return promhttp.HandlerFor(m.Gatherer(rooms), promhttp.HandlerOpts{})
+}
+
+// String returns the relay metrics, without the runtime collectors, in
+// the Prometheus text format
 func (m *Metrics) String(activeRooms int) string {
-	return fmt.Sprintf(`# HELP ephemeral_rooms_created_total Total rooms created
-# TYPE ephemeral_rooms_created_total counter
-ephemeral_rooms_created_total %d
-# HELP ephemeral_rooms_destroyed_total Total rooms destroyed
-# TYPE ephemeral_rooms_destroyed_total counter
-ephemeral_rooms_destroyed_total %d
-# HELP ephemeral_rooms_active Current active rooms
-# TYPE ephemeral_rooms_active gauge
-ephemeral_rooms_active %d
-# HELP ephemeral_connections_total Total connections
-# TYPE ephemeral_connections_total counter
-ephemeral_connections_total %d
-# HELP ephemeral_messages_relayed_total Total messages relayed
-# TYPE ephemeral_messages_relayed_total counter
-ephemeral_messages_relayed_total %d
-# HELP ephemeral_rate_limited_total Total rate limited requests
-# TYPE ephemeral_rate_limited_total counter
-ephemeral_rate_limited_total %d
-`,
-		atomic.LoadUint64(&m.RoomsCreated),
-		atomic.LoadUint64(&m.RoomsDestroyed),
-		activeRooms,
-		atomic.LoadUint64(&m.ConnectionsTotal),
-		atomic.LoadUint64(&m.MessagesRelayed),
-		atomic.LoadUint64(&m.RateLimited),
-	)
+	m.roomsActive.Set(float64(activeRooms))
+
+	families, err := m.registry.Gather()
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, mf := range families {
+		expfmt.MetricFamilyToText(&b, mf)
+	}
+	return b.String()
 }
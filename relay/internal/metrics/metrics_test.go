@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// TestClientErrorCategoriesBounded verifies unknown categories fold into "other"
+func TestClientErrorCategoriesBounded(t *testing.T) {
+	m := New()
+	m.IncClientError(ClientErrorDecode)
+	m.IncClientError("attacker-chosen-label")
+
+	out := m.String(0)
+	if strings.Contains(out, "attacker-chosen-label") {
+		t.Error("Unknown category should not become a label value")
+	}
+	for _, want := range []string{
+		`ephemeral_client_errors_total{category="decode"} 1`,
+		`ephemeral_client_errors_total{category="other"} 1`,
+		`ephemeral_client_errors_total{category="state"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+// TestHandlerIncludesRuntimeCollectors verifies scrapes carry Go and process metrics
+func TestHandlerIncludesRuntimeCollectors(t *testing.T) {
+	m := New()
+	m.IncRoomsCreated()
+
+	rec := httptest.NewRecorder()
+	m.Handler(fakeRooms{1, 3, 12}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"ephemeral_rooms_created_total 1",
+		"ephemeral_rooms_active 3",
+		`ephemeral_send_queue_frames{queue="host"} 4`,
+		"go_goroutines",
+		"go_memstats_heap_inuse_bytes",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in scrape", want)
+		}
+	}
+	if strings.Contains(m.String(3), "go_goroutines") {
+		t.Error("String should only render relay metrics")
+	}
+}
+
+// TestHistogramsBucketObservations verifies sizes and latencies land in the expected buckets
+func TestHistogramsBucketObservations(t *testing.T) {
+	m := New()
+	m.ObserveMessageSize(100 << 10)
+	m.ObserveRelayLatency(2 * time.Millisecond)
+
+	out := m.String(0)
+	for _, want := range []string{
+		`ephemeral_message_size_bytes_bucket{le="65536"} 0`,
+		`ephemeral_message_size_bytes_bucket{le="262144"} 1`,
+		`ephemeral_relay_latency_seconds_bucket{le="0.001"} 0`,
+		`ephemeral_relay_latency_seconds_bucket{le="0.005"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output", want)
+		}
+	}
+}
+
+// TestConnectionDurationByRole verifies lifetimes are split by host and client only
+func TestConnectionDurationByRole(t *testing.T) {
+	m := New()
+	m.ObserveConnection(RoleHost, 2*time.Hour)
+	m.ObserveConnection("observer", 3*time.Second)
+
+	out := m.String(0)
+	for _, want := range []string{
+		`ephemeral_connection_duration_seconds_count{role="host"} 1`,
+		`ephemeral_connection_duration_seconds_bucket{role="client",le="5"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output", want)
+		}
+	}
+	if strings.Contains(out, "observer") {
+		t.Error("Unknown role should not become a label value")
+	}
+}
+
+// fakeRooms reports fixed client counts, one per room
+type fakeRooms []int
+
+func (f fakeRooms) RoomCount() int      { return len(f) }
+func (f fakeRooms) ClientCounts() []int { return f }
+func (f fakeRooms) SendQueues() (host, clients room.QueueStats) {
+	return room.QueueStats{Frames: 4, Capacity: 256, MaxFill: 4.0 / 256}, room.QueueStats{}
+}
+
+// TestOccupancyBuckets verifies rooms are tallied into the client-count ranges
+func TestOccupancyBuckets(t *testing.T) {
+	m := New()
+	m.SetOccupancy([]int{0, 1, 2, 3, 10, 11, 50})
+
+	out := m.String(7)
+	for _, want := range []string{
+		`ephemeral_rooms_by_occupancy{clients="0"} 1`,
+		`ephemeral_rooms_by_occupancy{clients="1-2"} 2`,
+		`ephemeral_rooms_by_occupancy{clients="3-10"} 2`,
+		`ephemeral_rooms_by_occupancy{clients="11-50"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output", want)
+		}
+	}
+
+	// A later scrape replaces the tallies rather than adding to them
+	m.SetOccupancy(nil)
+	if out := m.String(0); !strings.Contains(out, `ephemeral_rooms_by_occupancy{clients="1-2"} 0`) {
+		t.Error("Expected tallies to reset between scrapes")
+	}
+}
+
+// TestJSONHandlerMirrorsScrape verifies /metrics.json carries counters, labels and histograms
+func TestJSONHandlerMirrorsScrape(t *testing.T) {
+	m := New()
+	m.IncRoomsCreated()
+	m.IncClientError(ClientErrorState)
+	m.ObserveMessageSize(100)
+
+	rec := httptest.NewRecorder()
+	m.JSONHandler(fakeRooms{1, 2}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics.json", nil))
+
+	var doc map[string]JSONFamily
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	created := doc["ephemeral_rooms_created_total"]
+	if created.Type != "counter" || len(created.Metrics) != 1 || *created.Metrics[0].Value != 1 {
+		t.Errorf("Unexpected rooms created entry: %+v", created)
+	}
+	if active := doc["ephemeral_rooms_active"]; len(active.Metrics) != 1 || *active.Metrics[0].Value != 2 {
+		t.Errorf("Unexpected rooms active entry: %+v", active)
+	}
+
+	var state float64
+	for _, jm := range doc["ephemeral_client_errors_total"].Metrics {
+		if jm.Labels["category"] == ClientErrorState {
+			state = *jm.Value
+		}
+	}
+	if state != 1 {
+		t.Errorf("Expected 1 state client error, got %v", state)
+	}
+
+	size := doc["ephemeral_message_size_bytes"].Metrics[0]
+	if *size.Count != 1 || size.Buckets["256"] != 1 || size.Buckets["64"] != 0 {
+		t.Errorf("Unexpected size histogram: %+v", size)
+	}
+}
+
+// TestRateLimitedByScopeAndCause verifies refusals split by label and feed the legacy counters
+func TestRateLimitedByScopeAndCause(t *testing.T) {
+	m := New()
+	m.IncRateLimited(ScopeMessage, CauseLimiter)
+	m.IncRateLimited(ScopeInvite, CauseDenylist)
+	m.IncRateLimited(ScopeConnection, CauseJail)
+
+	out := m.String(0)
+	for _, want := range []string{
+		`ephemeral_rate_limited_total{cause="limiter",scope="message"} 1`,
+		`ephemeral_rate_limited_total{cause="denylist",scope="invite"} 1`,
+		`ephemeral_rate_limited_total{cause="limiter",scope="connection"} 0`,
+		"ephemeral_access_denied_total 1",
+		"ephemeral_ban_rejected_total 1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output", want)
+		}
+	}
+}
+
+// TestTenantCounters verifies load is counted by tenant name, and rooms
+// of no tenant add no label
+func TestTenantCounters(t *testing.T) {
+	m := New()
+	m.IncTenantRooms("acme")
+	m.IncTenantMessages("acme")
+	m.IncTenantMessages("acme")
+	m.IncTenantRateLimited("globex")
+	m.IncTenantMessages("")
+
+	out := m.String(0)
+	for _, want := range []string{
+		`ephemeral_tenant_rooms_created_total{tenant="acme"} 1`,
+		`ephemeral_tenant_messages_relayed_total{tenant="acme"} 2`,
+		`ephemeral_tenant_rate_limited_total{tenant="globex"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output", want)
+		}
+	}
+	if strings.Contains(out, `tenant=""`) {
+		t.Error("Rooms of no tenant should not be labeled")
+	}
+}
+
+// TestUpgradeFailuresByReason verifies every reason is exported and counted separately
+func TestUpgradeFailuresByReason(t *testing.T) {
+	m := New()
+	m.IncUpgradeFailure(UpgradeHandshake)
+	m.IncUpgradeFailure(UpgradeHandshake)
+
+	out := m.String(0)
+	if !strings.Contains(out, `ephemeral_upgrade_failures_total{reason="handshake"} 2`) {
+		t.Error("Expected 2 handshake failures")
+	}
+	for _, reason := range upgradeReasons {
+		if !strings.Contains(out, `ephemeral_upgrade_failures_total{reason="`+reason+`"}`) {
+			t.Errorf("Expected reason %q to be exported", reason)
+		}
+	}
+}
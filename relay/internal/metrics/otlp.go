@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	promb "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// DefaultPushInterval is how often metrics are pushed when no interval is given
+const DefaultPushInterval = 30 * time.Second
+
+// PushOTLP sends the same metrics the scrape endpoint serves to an
+// OTLP/HTTP collector (e.g. http://collector:4318) every interval, for
+// deployments no Prometheus server can reach. The returned function
+// pushes once more and stops.
+func (m *Metrics) PushOTLP(ctx context.Context, endpoint string, interval time.Duration, rooms Rooms) (func(context.Context) error, error) {
+	if interval <= 0 {
+		interval = DefaultPushInterval
+	}
+	exporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	// The periodic reader gathers from our registries through the bridge;
+	// no metrics are defined on the OTel side
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithProducer(promb.NewMetricProducer(promb.WithGatherer(withoutSummaries(m.Gatherer(rooms))))),
+	)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(semconv.ServiceName("ephemeral-relay"))),
+	)
+	return provider.Shutdown, nil
+}
+
+// withoutSummaries drops summary metrics (only go_gc_duration_seconds),
+// which the OTLP exporter refuses, failing the whole batch
+func withoutSummaries(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		kept := families[:0]
+		for _, mf := range families {
+			if mf.GetType() != dto.MetricType_SUMMARY {
+				kept = append(kept, mf)
+			}
+		}
+		return kept, err
+	})
+}
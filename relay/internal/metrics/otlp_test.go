@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPushOTLPFlushesOnStop verifies stopping the pusher sends a final batch
+func TestPushOTLPFlushesOnStop(t *testing.T) {
+	var pushes atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/metrics" {
+			pushes.Add(1)
+		}
+	}))
+	defer collector.Close()
+
+	m := New()
+	m.IncRoomsCreated()
+	stop, err := m.PushOTLP(context.Background(), collector.URL, time.Hour, fakeRooms{2})
+	if err != nil {
+		t.Fatalf("PushOTLP failed: %v", err)
+	}
+	if err := stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if pushes.Load() != 1 {
+		t.Errorf("Expected 1 push on stop, got %d", pushes.Load())
+	}
+}
@@ -0,0 +1,185 @@
+package metrics
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatsD export limits
+const (
+	DefaultStatsDInterval = 10 * time.Second
+	MaxStatsDPacket       = 1432  // Fits one UDP datagram on a 1500 MTU path
+	MaxPendingTimings     = 10000 // Timings kept between flushes; extras are dropped
+)
+
+// StatsD emits metrics to a statsd or DogStatsD agent over UDP. Counters
+// and gauges are gathered from the registries on each flush, counters as
+// deltas since the last one; timings and sizes are sent per event. With
+// DogStatsD labels become tags, otherwise they're appended to the name.
+type StatsD struct {
+	metrics  *Metrics
+	conn     net.Conn
+	gatherer prometheus.Gatherer
+	dog      bool
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []string
+	last    map[string]float64 // counter values at the previous flush
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// StartStatsD begins flushing to the agent at addr every interval and
+// sends timings there until Stop
+func (m *Metrics) StartStatsD(addr string, dog bool, interval time.Duration, rooms Rooms) (*StatsD, error) {
+	if interval <= 0 {
+		interval = DefaultStatsDInterval
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsD{
+		metrics:  m,
+		conn:     conn,
+		gatherer: m.Gatherer(rooms),
+		dog:      dog,
+		interval: interval,
+		last:     make(map[string]float64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.statsd.Store(s)
+	go s.run()
+	return s, nil
+}
+
+// Stop flushes once more and closes the connection
+func (s *StatsD) Stop() {
+	s.metrics.statsd.CompareAndSwap(s, nil)
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+func (s *StatsD) run() {
+	defer close(s.done)
+	defer s.conn.Close()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// timing queues a per-event value of the given statsd type ("ms" or "h")
+func (s *StatsD) timing(name string, value float64, kind string, labels ...string) {
+	line := s.line(name, value, kind, labels)
+
+	s.mu.Lock()
+	if len(s.pending) < MaxPendingTimings {
+		s.pending = append(s.pending, line)
+	}
+	s.mu.Unlock()
+}
+
+// flush sends gathered counters and gauges plus the queued timings
+func (s *StatsD) flush() {
+	s.mu.Lock()
+	lines := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	families, _ := s.gatherer.Gather()
+	for _, mf := range families {
+		for _, metric := range mf.GetMetric() {
+			labels := make([]string, 0, 2*len(metric.GetLabel()))
+			for _, lp := range metric.GetLabel() {
+				labels = append(labels, lp.GetName(), lp.GetValue())
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				key := mf.GetName() + "\xff" + strings.Join(labels, "\xff")
+				v := metric.GetCounter().GetValue()
+				if delta := v - s.last[key]; delta > 0 {
+					lines = append(lines, s.line(mf.GetName(), delta, "c", labels))
+				}
+				s.last[key] = v
+			case dto.MetricType_GAUGE:
+				lines = append(lines, s.line(mf.GetName(), metric.GetGauge().GetValue(), "g", labels))
+			}
+		}
+	}
+
+	s.send(lines)
+}
+
+// send packs lines into as few datagrams as fit. Write errors are ignored:
+// statsd is lossy by design and the agent may simply not be up yet.
+func (s *StatsD) send(lines []string) {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > MaxStatsDPacket {
+			s.conn.Write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		s.conn.Write(packet)
+	}
+}
+
+// line formats one metric; labels are name/value pairs
+func (s *StatsD) line(name string, value float64, kind string, labels []string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if !s.dog {
+		for i := 1; i < len(labels); i += 2 {
+			b.WriteByte('.')
+			b.WriteString(labels[i])
+		}
+	}
+	b.WriteByte(':')
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		b.WriteString(strconv.FormatInt(int64(value), 10))
+	} else {
+		b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if s.dog && len(labels) > 0 {
+		b.WriteString("|#")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteByte(':')
+			b.WriteString(labels[i+1])
+		}
+	}
+	return b.String()
+}
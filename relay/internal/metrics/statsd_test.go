@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStatsD collects every line the agent receives until it goes quiet
+func readStatsD(t *testing.T, agent net.PacketConn) []string {
+	t.Helper()
+	var lines []string
+	buf := make([]byte, 2048)
+	for {
+		agent.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > MaxStatsDPacket {
+			t.Errorf("Packet of %d bytes exceeds %d", n, MaxStatsDPacket)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func contains(lines []string, want string) bool {
+	for _, l := range lines {
+		if l == want {
+			return true
+		}
+	}
+	return false
+}
+
+// TestStatsDSendsCounterDeltasAndTimings verifies counters go out as deltas and timings per event
+func TestStatsDSendsCounterDeltasAndTimings(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer agent.Close()
+
+	m := New()
+	s, err := m.StartStatsD(agent.LocalAddr().String(), true, time.Hour, fakeRooms{1})
+	if err != nil {
+		t.Fatalf("StartStatsD failed: %v", err)
+	}
+
+	m.IncRoomsCreated()
+	m.IncRoomsCreated()
+	m.IncClientError(ClientErrorDecode)
+	m.ObserveConnection(RoleHost, 1500*time.Millisecond)
+	s.flush()
+	lines := readStatsD(t, agent)
+
+	for _, want := range []string{
+		"ephemeral_rooms_created_total:2|c",
+		"ephemeral_client_errors_total:1|c|#category:decode",
+		"ephemeral_rooms_active:1|g",
+		"ephemeral_connection_duration:1500|ms|#role:host",
+	} {
+		if !contains(lines, want) {
+			t.Errorf("Expected %q, got %v", want, lines)
+		}
+	}
+
+	// Only the change since the previous flush is sent
+	m.IncRoomsCreated()
+	s.Stop()
+	lines = readStatsD(t, agent)
+	if !contains(lines, "ephemeral_rooms_created_total:1|c") {
+		t.Errorf("Expected a delta of 1 on the final flush, got %v", lines)
+	}
+	if contains(lines, "ephemeral_connection_duration:1500|ms|#role:host") {
+		t.Error("Timings should not be sent twice")
+	}
+}
+
+// TestStatsDPlainFoldsLabelsIntoName verifies plain statsd gets labels as name suffixes
+func TestStatsDPlainFoldsLabelsIntoName(t *testing.T) {
+	s := &StatsD{}
+	if got := s.line("ephemeral_client_errors_total", 3, "c", []string{"category", "state"}); got != "ephemeral_client_errors_total.state:3|c" {
+		t.Errorf("Expected name suffix, got %q", got)
+	}
+	if got := s.line("ephemeral_relay_latency", 0.25, "ms", nil); got != "ephemeral_relay_latency:0.25|ms" {
+		t.Errorf("Expected fractional value, got %q", got)
+	}
+}
@@ -0,0 +1,193 @@
+// Package proxyproto accepts the HAProxy PROXY protocol (v1 text and v2
+// binary) in front of a listener, so L4 load balancers that can't add HTTP
+// headers still hand the relay the real client address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits
+const (
+	HeaderTimeout = 5 * time.Second // Deadline for the header after accept
+	maxV1Length   = 107             // Longest v1 line, CRLF included
+)
+
+// Errors
+var (
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+	ErrMissingHeader = errors.New("missing PROXY protocol header")
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Listener requires every accepted connection to start with a PROXY header.
+// The header is read lazily on the connection's own goroutine so a slow
+// client can't stall Accept.
+type Listener struct {
+	net.Listener
+}
+
+// NewListener wraps l so accepted connections report the proxied address
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l}
+}
+
+// Accept waits for the next connection
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// Conn is a connection whose PROXY header has been (or will be) consumed
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read reads connection data following the header
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header. LOCAL and
+// UNKNOWN headers, and connections whose header failed, report the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = parseHeader(c.r)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// parseHeader consumes a v1 or v2 header and returns the source address,
+// or nil when the proxy didn't supply one
+func parseHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, ErrMissingHeader
+	}
+	if bytes.Equal(peek, v1Prefix) {
+		return parseV1(r)
+	}
+	if peek, err = r.Peek(len(v2Signature)); err == nil && bytes.Equal(peek, v2Signature) {
+		return parseV2(r)
+	}
+	return nil, ErrMissingHeader
+}
+
+// parseV1 handles "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func parseV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrInvalidHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseV2 handles the binary header; TLVs after the addresses are skipped
+func parseV2(r *bufio.Reader) (net.Addr, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	verCmd, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:]))
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: health check from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), block[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(block[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), block[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(block[32:34])),
+		}, nil
+	default: // UNSPEC, UDP, unix sockets: no usable client IP
+		return nil, nil
+	}
+}
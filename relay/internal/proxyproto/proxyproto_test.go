@@ -0,0 +1,103 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func v2Header(cmd, family byte, addrs []byte) []byte {
+	h := append([]byte(nil), v2Signature...)
+	h = append(h, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+// TestParseHeader covers v1 and v2 headers, passthrough data and rejects
+func TestParseHeader(t *testing.T) {
+	v4 := []byte{198, 51, 100, 7, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::9"))
+	binary.BigEndian.PutUint16(v6[32:], 4242)
+	tlv := append(append([]byte(nil), v4...), 0x04, 0x00, 0x02, 'o', 'k')
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // "" for no address
+		err    error
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 198.51.100.7 10.0.0.1 12345 443\r\n"), "198.51.100.7:12345", nil},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::9 2001:db8::1 4242 443\r\n"), "[2001:db8::9]:4242", nil},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::9 10.0.0.1 1 443\r\n"), "", ErrInvalidHeader},
+		{"v1 bad port", []byte("PROXY TCP4 198.51.100.7 10.0.0.1 99999 443\r\n"), "", ErrInvalidHeader},
+		{"v1 no CRLF", []byte("PROXY TCP4 " + strings.Repeat("1", 120)), "", ErrInvalidHeader},
+		{"v2 IPv4", v2Header(1, 0x11, v4), "198.51.100.7:12345", nil},
+		{"v2 IPv6", v2Header(1, 0x21, v6), "[2001:db8::9]:4242", nil},
+		{"v2 with TLVs", v2Header(1, 0x11, tlv), "198.51.100.7:12345", nil},
+		{"v2 LOCAL", v2Header(0, 0x00, nil), "", nil},
+		{"v2 short block", v2Header(1, 0x11, v4[:8]), "", ErrInvalidHeader},
+		{"v2 bad command", v2Header(7, 0x11, v4), "", ErrInvalidHeader},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", ErrMissingHeader},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.header), strings.NewReader("payload")))
+		addr, err := parseHeader(r)
+		if err != tt.err {
+			t.Errorf("%s: Expected error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: Expected %q, got %q", tt.name, tt.want, got)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%s: Expected data after header intact, got %q", tt.name, rest)
+		}
+	}
+}
+
+// TestListenerReportsProxiedAddress verifies a real connection end to end
+func TestListenerReportsProxiedAddress(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ln := NewListener(inner)
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 203.0.113.5 10.0.0.1 5555 443\r\nhello"))
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer c.Close()
+
+	if got := c.RemoteAddr().String(); got != "203.0.113.5:5555" {
+		t.Errorf("Expected proxied address, got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected hello after header, got %q (%v)", buf, err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package quota meters what each tenant, an API key hosts present, uses
+// of the relay against the limits of its key: rooms held and clients
+// connected at once, and bytes relayed per hour. The registry consults it
+// creating rooms, the handler admitting clients and relaying frames.
+package quota
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Resource is something a quota bounds
+type Resource string
+
+const (
+	Rooms   Resource = "rooms"   // held at once
+	Clients Resource = "clients" // connected at once, across the tenant's rooms
+	Bytes   Resource = "bytes"   // relayed per Window
+)
+
+// Window is the period Bytes are metered over
+const Window = time.Hour
+
+// ErrExceeded is the error every ExceededError wraps
+var ErrExceeded = errors.New("quota exceeded")
+
+// ExceededError is a tenant out of one resource's quota
+type ExceededError struct {
+	Resource   Resource
+	Limit      int64
+	RetryAfter time.Duration // until the window turns over, for Bytes; 0 otherwise
+}
+
+func (e *ExceededError) Error() string {
+	return string(e.Resource) + " quota exceeded"
+}
+
+func (e *ExceededError) Unwrap() error {
+	return ErrExceeded
+}
+
+// Usage is a point-in-time view of what a tenant uses
+type Usage struct {
+	Rooms   int64
+	Clients int64
+	Bytes   int64 // in the current window
+}
+
+// usage is one tenant's meters. Bytes count from windowStart.
+type usage struct {
+	Usage
+	windowStart time.Time
+}
+
+// Engine meters every tenant's use. Limits are passed in with each call,
+// from the tenant's key, so changing a key's quota needs nothing here;
+// a limit of 0 is none. The empty tenant, rooms created without a key, is
+// never metered.
+type Engine struct {
+	mu      sync.Mutex
+	tenants map[string]*usage
+	now     func() time.Time
+}
+
+// New returns an engine with nothing metered
+func New() *Engine {
+	return &Engine{tenants: make(map[string]*usage), now: time.Now}
+}
+
+// Acquire takes one of tenant's Rooms or Clients, failing with an
+// *ExceededError if it already holds limit of them. Each successful
+// Acquire must be matched by a Release.
+func (e *Engine) Acquire(tenant string, r Resource, limit int64) error {
+	if tenant == "" {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u := e.meter(tenant)
+	held := u.held(r)
+	if limit > 0 && *held >= limit {
+		return &ExceededError{Resource: r, Limit: limit}
+	}
+	*held++
+	return nil
+}
+
+// Release gives back one of tenant's Rooms or Clients
+func (e *Engine) Release(tenant string, r Resource) {
+	if tenant == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u, ok := e.tenants[tenant]
+	if !ok {
+		return
+	}
+	if held := u.held(r); *held > 0 {
+		*held--
+	}
+	e.forget(tenant, u)
+}
+
+// Available reports whether tenant could Acquire one more of r now
+func (e *Engine) Available(tenant string, r Resource, limit int64) bool {
+	if tenant == "" || limit <= 0 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u, ok := e.tenants[tenant]
+	return !ok || *u.held(r) < limit
+}
+
+// Charge meters n bytes relayed for tenant, failing with an
+// *ExceededError, and charging nothing, if they'd take it past limit in
+// the current window
+func (e *Engine) Charge(tenant string, n, limit int64) error {
+	if tenant == "" {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u := e.meter(tenant)
+	now := e.now()
+	if now.Sub(u.windowStart) >= Window {
+		u.Bytes, u.windowStart = 0, now
+	}
+	if limit > 0 && u.Bytes+n > limit {
+		return &ExceededError{Resource: Bytes, Limit: limit, RetryAfter: u.windowStart.Add(Window).Sub(now)}
+	}
+	u.Bytes += n
+	return nil
+}
+
+// Usage returns what tenant uses now
+func (e *Engine) Usage(tenant string) Usage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	u, ok := e.tenants[tenant]
+	if !ok {
+		return Usage{}
+	}
+	use := u.Usage
+	if e.now().Sub(u.windowStart) >= Window {
+		use.Bytes = 0
+	}
+	return use
+}
+
+// meter returns tenant's meters, starting them if need be. Callers hold
+// e.mu.
+func (e *Engine) meter(tenant string) *usage {
+	u, ok := e.tenants[tenant]
+	if !ok {
+		u = &usage{windowStart: e.now()}
+		e.tenants[tenant] = u
+	}
+	return u
+}
+
+// forget drops tenant's meters once it holds nothing and its bytes have
+// aged out of the window, so they can't be reset by closing every room.
+// Callers hold e.mu.
+func (e *Engine) forget(tenant string, u *usage) {
+	if u.Rooms == 0 && u.Clients == 0 && (u.Bytes == 0 || e.now().Sub(u.windowStart) >= Window) {
+		delete(e.tenants, tenant)
+	}
+}
+
+// held is the count of r, Rooms or Clients
+func (u *usage) held(r Resource) *int64 {
+	if r == Rooms {
+		return &u.Rooms
+	}
+	return &u.Clients
+}
@@ -0,0 +1,71 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAcquireRelease verifies a tenant holds no more than its limit, a
+// release frees a slot, and no limit or no tenant is never refused
+func TestAcquireRelease(t *testing.T) {
+	e := New()
+	if err := e.Acquire("acme", Rooms, 1); err != nil {
+		t.Fatalf("Failed to acquire within the limit: %v", err)
+	}
+	err := e.Acquire("acme", Rooms, 1)
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || exceeded.Resource != Rooms || !errors.Is(err, ErrExceeded) {
+		t.Fatalf("Expected rooms exceeded, got %v", err)
+	}
+	if err := e.Acquire("acme", Clients, 1); err != nil {
+		t.Errorf("Expected clients metered apart from rooms, got %v", err)
+	}
+	if e.Available("acme", Rooms, 1) {
+		t.Error("Expected no room available at the limit")
+	}
+
+	e.Release("acme", Rooms)
+	if err := e.Acquire("acme", Rooms, 1); err != nil {
+		t.Errorf("Expected a room once one was released, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Acquire("", Rooms, 1); err != nil {
+			t.Errorf("Expected no tenant never metered, got %v", err)
+		}
+		if err := e.Acquire("globex", Rooms, 0); err != nil {
+			t.Errorf("Expected no limit never refused, got %v", err)
+		}
+	}
+	if use := e.Usage("acme"); use.Rooms != 1 || use.Clients != 1 {
+		t.Errorf("Expected a room and a client in use, got %+v", use)
+	}
+}
+
+// TestChargeWindow verifies bytes are refused past the limit until the
+// window turns over, with the wait until then as the retry hint
+func TestChargeWindow(t *testing.T) {
+	e := New()
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	if err := e.Charge("acme", 600, 1000); err != nil {
+		t.Fatalf("Failed to charge within the limit: %v", err)
+	}
+	now = now.Add(15 * time.Minute)
+	var exceeded *ExceededError
+	if err := e.Charge("acme", 600, 1000); !errors.As(err, &exceeded) {
+		t.Fatalf("Expected bytes exceeded, got %v", err)
+	}
+	if exceeded.RetryAfter != 45*time.Minute {
+		t.Errorf("Expected to retry when the window turns over, got %v", exceeded.RetryAfter)
+	}
+	if use := e.Usage("acme"); use.Bytes != 600 {
+		t.Errorf("Expected a refused charge not counted, got %d", use.Bytes)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if err := e.Charge("acme", 600, 1000); err != nil {
+		t.Errorf("Expected a new window to start empty, got %v", err)
+	}
+}
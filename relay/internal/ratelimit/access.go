@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxAccessEntries bounds each access list
+const MaxAccessEntries = 10000
+
+// Errors
+var (
+	ErrInvalidPrefix   = errors.New("invalid address (want IP or CIDR)")
+	ErrUnknownList     = errors.New("unknown access list")
+	ErrAccessListFull  = errors.New("access list full")
+	ErrAccessNotListed = errors.New("prefix not listed")
+)
+
+// List names an access list
+type List string
+
+const (
+	ListAllow List = "allow" // exempt from per-IP limits
+	ListDeny  List = "deny"  // refused outright
+)
+
+// Verdict is the outcome of an access list check
+type Verdict int
+
+const (
+	VerdictNone  Verdict = iota // not listed: normal limits apply
+	VerdictAllow                // skip per-IP limits
+	VerdictDeny                 // refuse
+)
+
+// AccessList holds operator-managed allow and deny prefixes, consulted
+// before any rate limiter. It lives in memory only and is edited at
+// runtime through the admin API. The most specific matching prefix wins;
+// at equal length deny wins. A nil AccessList lists nothing.
+type AccessList struct {
+	mu    sync.RWMutex
+	lists map[List]map[netip.Prefix]struct{}
+}
+
+// NewAccessList creates empty allow and deny lists
+func NewAccessList() *AccessList {
+	return &AccessList{
+		lists: map[List]map[netip.Prefix]struct{}{
+			ListAllow: {},
+			ListDeny:  {},
+		},
+	}
+}
+
+// ParsePrefix parses an IP (as a single-address prefix) or a CIDR
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, ErrInvalidPrefix
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, ErrInvalidPrefix
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Add puts a prefix on a list, taking it off the other one
+func (a *AccessList) Add(list List, p netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries, ok := a.lists[list]
+	if !ok {
+		return ErrUnknownList
+	}
+	if _, listed := entries[p]; !listed && len(entries) >= MaxAccessEntries {
+		return ErrAccessListFull
+	}
+	for name, other := range a.lists {
+		if name != list {
+			delete(other, p)
+		}
+	}
+	entries[p] = struct{}{}
+	return nil
+}
+
+// Remove takes a prefix off a list
+func (a *AccessList) Remove(list List, p netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries, ok := a.lists[list]
+	if !ok {
+		return ErrUnknownList
+	}
+	if _, listed := entries[p]; !listed {
+		return ErrAccessNotListed
+	}
+	delete(entries, p)
+	return nil
+}
+
+// Entries returns a list's prefixes, sorted
+func (a *AccessList) Entries(list List) []string {
+	if a == nil {
+		return []string{}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	out := make([]string, 0, len(a.lists[list]))
+	for p := range a.lists[list] {
+		out = append(out, p.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Check returns the verdict for an IP
+func (a *AccessList) Check(ip string) Verdict {
+	if a == nil {
+		return VerdictNone
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return VerdictNone
+	}
+	addr = addr.Unmap()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	verdict, best := VerdictNone, -1
+	for p := range a.lists[ListAllow] {
+		if p.Bits() > best && p.Contains(addr) {
+			verdict, best = VerdictAllow, p.Bits()
+		}
+	}
+	for p := range a.lists[ListDeny] {
+		if p.Bits() >= best && p.Contains(addr) {
+			verdict, best = VerdictDeny, p.Bits()
+		}
+	}
+	return verdict
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ConnTracker caps simultaneously open connections per IP.
+// Unlike Limiter it counts sockets, not requests: a slot is held from
+// Acquire until the matching Release, however idle the socket is.
+type ConnTracker struct {
+	open map[string]int
+	mu   sync.Mutex
+	max  int
+}
+
+// NewConnTracker creates a tracker allowing max open connections per IP.
+// max <= 0 disables the cap.
+func NewConnTracker(max int) *ConnTracker {
+	return &ConnTracker{
+		open: make(map[string]int),
+		max:  max,
+	}
+}
+
+// Acquire takes a slot for ip, reporting false if it already holds max
+func (t *ConnTracker) Acquire(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.max > 0 && t.open[ip] >= t.max {
+		return false
+	}
+	t.open[ip]++
+	return true
+}
+
+// Release returns a slot taken by a successful Acquire
+func (t *ConnTracker) Release(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.open[ip] <= 1 {
+		delete(t.open, ip)
+		return
+	}
+	t.open[ip]--
+}
+
+// Open returns the number of connections ip holds
+func (t *ConnTracker) Open(ip string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.open[ip]
+}
+
+// ConnCeiling caps open connections server-wide so descriptor exhaustion
+// is refused up front instead of surfacing as accept errors
+type ConnCeiling struct {
+	open atomic.Int64
+	max  int64
+}
+
+// NewConnCeiling creates a ceiling of max open connections.
+// max <= 0 disables the cap but still counts.
+func NewConnCeiling(max int) *ConnCeiling {
+	return &ConnCeiling{max: int64(max)}
+}
+
+// Acquire takes a slot, reporting false once the ceiling is reached
+func (c *ConnCeiling) Acquire() bool {
+	if n := c.open.Add(1); c.max > 0 && n > c.max {
+		c.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release returns a slot taken by a successful Acquire
+func (c *ConnCeiling) Release() {
+	c.open.Add(-1)
+}
+
+// Open returns the number of open connections
+func (c *ConnCeiling) Open() int {
+	return int(c.open.Load())
+}
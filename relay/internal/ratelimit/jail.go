@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Jail timing
+const (
+	StrikeWindow  = time.Minute    // Strikes older than this are forgotten
+	OffenseMemory = 24 * time.Hour // Quiet time after a ban before escalation resets
+	maxEscalation = 16             // Doublings before the shift could overflow
+)
+
+// Jail bans IPs that keep hitting the rate limit. Every rejected request
+// is a strike; threshold strikes inside StrikeWindow earn a ban that
+// doubles with each repeat offense, from base up to max. Banned IPs are
+// turned away before any limiter does work for them.
+type Jail struct {
+	inmates   map[string]*inmate
+	mu        sync.Mutex
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type inmate struct {
+	strikes     int
+	windowStart time.Time
+	offenses    int
+	until       time.Time
+}
+
+// NewJail creates a jail. threshold <= 0 disables banning.
+func NewJail(threshold int, base, max time.Duration) *Jail {
+	j := &Jail{
+		inmates:   make(map[string]*inmate),
+		threshold: threshold,
+		base:      base,
+		max:       max,
+		stop:      make(chan struct{}),
+	}
+	go j.cleanup()
+	return j
+}
+
+// Check returns how long ip remains banned, or 0
+func (j *Jail) Check(ip string) time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	m, ok := j.inmates[ip]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(m.until); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Strike records a rate-limit rejection for ip. It returns the ban length
+// if this strike put ip in jail, or 0.
+func (j *Jail) Strike(ip string) time.Duration {
+	if j.threshold <= 0 {
+		return 0
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	m, ok := j.inmates[ip]
+	if !ok {
+		m = &inmate{windowStart: now}
+		j.inmates[ip] = m
+	}
+	if m.offenses > 0 && now.Sub(m.until) > OffenseMemory {
+		m.offenses = 0
+	}
+	if now.Sub(m.windowStart) > StrikeWindow {
+		m.strikes = 0
+		m.windowStart = now
+	}
+
+	m.strikes++
+	if m.strikes < j.threshold {
+		return 0
+	}
+
+	d := j.base << min(m.offenses, maxEscalation)
+	if d > j.max || d <= 0 {
+		d = j.max
+	}
+	m.offenses++
+	m.strikes = 0
+	m.until = now.Add(d)
+	return d
+}
+
+// cleanup forgets IPs with no live strikes, ban or offense history
+func (j *Jail) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			j.mu.Lock()
+			for ip, m := range j.inmates {
+				if now.Sub(m.windowStart) > StrikeWindow && now.Sub(m.until) > OffenseMemory {
+					delete(j.inmates, ip)
+				}
+			}
+			j.mu.Unlock()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the cleanup goroutine
+func (j *Jail) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+// RetryAfter formats a wait as a Retry-After header value, rounding up
+func RetryAfter(wait time.Duration) string {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
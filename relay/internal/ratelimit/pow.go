@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proof of work parameters
+const (
+	DefaultPoWBits = 18              // About a quarter million hashes to solve
+	MaxPoWBits     = 32              // Beyond this a browser can't keep up
+	PoWTTL         = 2 * time.Minute // How long a challenge may be solved and spent
+	PoWHeader      = "Relay-PoW"     // Carries a solution; ?pow= does where headers can't be set
+)
+
+// Errors
+var (
+	ErrNoProof      = errors.New("proof of work required")
+	ErrBadProof     = errors.New("proof of work invalid")
+	ErrProofExpired = errors.New("proof of work challenge expired")
+	ErrProofSpent   = errors.New("proof of work already spent")
+)
+
+// PoW issues hashcash challenges and checks their solutions. It stands in
+// for per-IP limits where peers have no address of their own, as on a Tor
+// onion service, where every connection comes from the local daemon.
+//
+// A challenge is stamped with an expiry and an HMAC under a key that lives
+// only in memory, so nothing is stored until it is spent. A solution is
+// the challenge, a colon and any nonce such that the SHA-256 of the whole
+// string starts with bits zero bits. Each challenge is good once, on the
+// node that issued it.
+type PoW struct {
+	key  []byte
+	bits int
+
+	mu    sync.Mutex
+	spent map[string]time.Time // challenge -> its expiry
+	swept time.Time
+}
+
+// Challenge is what a peer solves before connecting
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	Bits      int    `json:"bits"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix time
+}
+
+// NewPoW creates a PoW requiring bits leading zero bits, clamped to
+// 1..MaxPoWBits
+func NewPoW(bits int) *PoW {
+	bits = max(1, min(bits, MaxPoWBits))
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &PoW{
+		key:   key,
+		bits:  bits,
+		spent: make(map[string]time.Time),
+	}
+}
+
+// Bits returns the difficulty
+func (p *PoW) Bits() int {
+	return p.bits
+}
+
+// Challenge issues a challenge good for PoWTTL
+func (p *PoW) Challenge() Challenge {
+	expires := time.Now().Add(PoWTTL)
+	raw := make([]byte, 8+16, 8+16+sha256.Size)
+	binary.BigEndian.PutUint64(raw, uint64(expires.Unix()))
+	if _, err := rand.Read(raw[8:]); err != nil {
+		panic(err)
+	}
+	raw = append(raw, p.sign(raw)...)
+	return Challenge{
+		Challenge: base64.RawURLEncoding.EncodeToString(raw),
+		Bits:      p.bits,
+		ExpiresAt: expires.Unix(),
+	}
+}
+
+func (p *PoW) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Verify checks a solution and spends its challenge. A nil PoW accepts
+// nothing.
+func (p *PoW) Verify(solution string) error {
+	if p == nil || solution == "" {
+		return ErrNoProof
+	}
+	challenge, _, ok := strings.Cut(solution, ":")
+	if !ok {
+		return ErrBadProof
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(raw) != 8+16+sha256.Size {
+		return ErrBadProof
+	}
+	if !hmac.Equal(raw[24:], p.sign(raw[:24])) {
+		return ErrBadProof
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(raw)), 0)
+	now := time.Now()
+	if now.After(expires) {
+		return ErrProofExpired
+	}
+	sum := sha256.Sum256([]byte(solution))
+	if leadingZeros(sum[:]) < p.bits {
+		return ErrBadProof
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.swept) > PoWTTL {
+		for c, exp := range p.spent {
+			if now.After(exp) {
+				delete(p.spent, c)
+			}
+		}
+		p.swept = now
+	}
+	if _, ok := p.spent[challenge]; ok {
+		return ErrProofSpent
+	}
+	p.spent[challenge] = expires
+	return nil
+}
+
+// ServeHTTP hands out a fresh Challenge as JSON
+func (p *PoW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(p.Challenge())
+}
+
+// PoWSolution returns the solution a request carries, from PoWHeader or
+// else the pow query parameter
+func PoWSolution(r *http.Request) string {
+	if s := r.Header.Get(PoWHeader); s != "" {
+		return s
+	}
+	return r.URL.Query().Get("pow")
+}
+
+func leadingZeros(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
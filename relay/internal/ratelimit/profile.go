@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrUnknownProfile is returned when a profile name is not defined
+var ErrUnknownProfile = errors.New("unknown rate limit profile")
+
+// DefaultProfile is the profile used when none is configured
+const DefaultProfile = "default"
+
+// Profile bundles every limit applied to one class of traffic.
+// Profiles are plain values defined in code and selected by name at startup;
+// nothing is persisted.
+type Profile struct {
+	Name      string
+	Algorithm Algorithm // empty means TokenBucket
+
+	// Per-IP request budgets, one per endpoint class, so cheap probing of
+	// one endpoint can't exhaust the budget of another
+	ConnRate    rate.Limit // room-creating host sockets per second
+	ConnBurst   int
+	JoinRate    rate.Limit // join attempts per second
+	JoinBurst   int
+	InviteRate  rate.Limit // invite creation and revocation per second
+	InviteBurst int
+	ProbeRate   rate.Limit // invite validate, list and QR lookups per second
+	ProbeBurst  int
+
+	MsgRate   rate.Limit // messages per second per client
+	MsgBurst  int
+	ByteRate  rate.Limit // inbound payload bytes per second per client
+	ByteBurst int        // must cover the largest allowed frame
+
+	MaxConnsPerIP int // simultaneously open WebSockets per IP
+
+	// Request budgets are shared across these prefixes; 0 is per-IP.
+	// A single IPv6 host usually owns a whole /64.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// Repeat offenders: BanThreshold rejections within StrikeWindow earn a
+	// ban of BanBase, doubling per offense up to BanMax. 0 disables.
+	BanThreshold int
+	BanBase      time.Duration
+	BanMax       time.Duration
+}
+
+// Profiles holds the built-in named profiles
+var Profiles = map[string]Profile{
+	"strict": {
+		Name:     "strict",
+		ConnRate: 2, ConnBurst: 5,
+		JoinRate: 0.5, JoinBurst: 2,
+		InviteRate: 0.5, InviteBurst: 5,
+		ProbeRate: 2, ProbeBurst: 5,
+		MsgRate: 5, MsgBurst: 10,
+		ByteRate: 512 * 1024, ByteBurst: 8 * 1024 * 1024,
+		MaxConnsPerIP: 8, IPv4Prefix: 24, IPv6Prefix: 64,
+		BanThreshold: 10, BanBase: time.Minute, BanMax: 24 * time.Hour,
+	},
+	"default": {
+		Name:     "default",
+		ConnRate: 10, ConnBurst: 20,
+		JoinRate: 2, JoinBurst: 5,
+		InviteRate: 2, InviteBurst: 10,
+		ProbeRate: 10, ProbeBurst: 20,
+		MsgRate: 10, MsgBurst: 20,
+		ByteRate: 2 * 1024 * 1024, ByteBurst: 16 * 1024 * 1024,
+		MaxConnsPerIP: 32, IPv6Prefix: 64,
+		BanThreshold: 30, BanBase: time.Minute, BanMax: 6 * time.Hour,
+	},
+	"relaxed": {
+		Name:     "relaxed",
+		ConnRate: 50, ConnBurst: 100,
+		JoinRate: 10, JoinBurst: 20,
+		InviteRate: 10, InviteBurst: 50,
+		ProbeRate: 50, ProbeBurst: 100,
+		MsgRate: 50, MsgBurst: 100,
+		ByteRate: 8 * 1024 * 1024, ByteBurst: 32 * 1024 * 1024,
+		MaxConnsPerIP: 128, IPv6Prefix: 64,
+		BanThreshold: 100, BanBase: 30 * time.Second, BanMax: time.Hour,
+	},
+}
+
+// LookupProfile returns the named profile
+func LookupProfile(name string) (Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		return Profile{}, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+// ProfileNames returns the defined profile names, sorted, for flag help text
+func ProfileNames() string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Limiters is a live set of limiters built from a Profile.
+// Each tenant, API key or listener that selects a profile gets its own set.
+type Limiters struct {
+	Profile Profile
+	Conn    *Limiter
+	Join    *Limiter
+	Invite  *Limiter
+	Probe   *Limiter
+	Msg     *MessageLimiter
+	Bytes   *MessageLimiter
+	Open    *ConnTracker
+	Jail    *Jail
+}
+
+// NewLimiters builds the limiters described by the profile
+func (p Profile) NewLimiters() *Limiters {
+	return p.NewSharedLimiters(nil)
+}
+
+// NewSharedLimiters builds the profile's limiters with per-IP request
+// budgets kept in a shared backend, so every node behind a load balancer
+// enforces one budget. Per-client message budgets stay local: a client
+// is only ever connected to one node. A nil backend keeps everything local.
+func (p Profile) NewSharedLimiters(shared Backend) *Limiters {
+	perIP := func(name string, r rate.Limit, burst int) *Limiter {
+		l := newLimiter(p.Algorithm.budget(r, burst))
+		l.v4Bits, l.v6Bits = p.IPv4Prefix, p.IPv6Prefix
+		if shared != nil {
+			l.shared, l.sharedKey = shared, p.Name+":"+name+":"
+			l.r, l.burst = r, burst
+		}
+		return l
+	}
+
+	return &Limiters{
+		Profile: p,
+		Conn:    perIP("conn", p.ConnRate, p.ConnBurst),
+		Join:    perIP("join", p.JoinRate, p.JoinBurst),
+		Invite:  perIP("invite", p.InviteRate, p.InviteBurst),
+		Probe:   perIP("probe", p.ProbeRate, p.ProbeBurst),
+		Msg:     newMessageLimiter(p.Algorithm.budget(p.MsgRate, p.MsgBurst)),
+		Bytes:   newMessageLimiter(p.Algorithm.budget(p.ByteRate, p.ByteBurst)),
+		Open:    NewConnTracker(p.MaxConnsPerIP),
+		Jail:    NewJail(p.BanThreshold, p.BanBase, p.BanMax),
+	}
+}
+
+// RemoveRoom drops all per-client state for a room
+func (l *Limiters) RemoveRoom(roomID string) {
+	l.Msg.RemoveRoom(roomID)
+	l.Bytes.RemoveRoom(roomID)
+}
+
+// RemoveClient drops per-client state when a client leaves its room
+func (l *Limiters) RemoveClient(roomID, clientID string) {
+	l.Msg.RemoveClient(roomID, clientID)
+	l.Bytes.RemoveClient(roomID, clientID)
+}
+
+// Stop ends every limiter's cleanup goroutine
+func (l *Limiters) Stop() {
+	l.Conn.Stop()
+	l.Join.Stop()
+	l.Invite.Stop()
+	l.Probe.Stop()
+	l.Msg.Stop()
+	l.Bytes.Stop()
+	l.Jail.Stop()
+}
@@ -2,98 +2,234 @@
 package ratelimit
 
 import (
+	"net/netip"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-// Limiter provides rate limiting per IP address
+// Idle entry eviction
+const (
+	CleanupInterval = time.Minute
+	StaleAfter      = 3 * time.Minute // Longer than any profile takes to refill
+)
+
+// Limiter provides rate limiting per IP address, or per network prefix
+// when built with NewPrefixLimiter
 type Limiter struct {
-	visitors map[string]*visitor
-	mu       sync.RWMutex
-	r        rate.Limit
-	burst    int
+	visitors  map[string]*visitor
+	mu        sync.RWMutex
+	newBudget func() budget
+	v4Bits    int // 0 buckets each address separately
+	v6Bits    int
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	// Optional shared budget; the local one is the fallback when it fails
+	shared    Backend
+	sharedKey string
+	r         rate.Limit
+	burst     int
 }
 
 type visitor struct {
-	limiter  *rate.Limiter
+	limiter  budget
 	lastSeen time.Time
 }
 
-// NewLimiter creates a new rate limiter
+// budget is one key's allowance: a token bucket or a sliding window
+type budget interface {
+	AllowN(now time.Time, n int) bool
+	// state reports whole units left and how long until n more would fit
+	state(now time.Time, n int) (remaining int, wait time.Duration)
+	Burst() int
+}
+
+// NewLimiter creates a new token-bucket rate limiter
 func NewLimiter(r rate.Limit, burst int) *Limiter {
+	return newLimiter(tokenBucket(r, burst))
+}
+
+func newLimiter(newBudget func() budget) *Limiter {
 	l := &Limiter{
-		visitors: make(map[string]*visitor),
-		r:        r,
-		burst:    burst,
+		visitors:  make(map[string]*visitor),
+		newBudget: newBudget,
+		stop:      make(chan struct{}),
 	}
 	go l.cleanup()
 	return l
 }
 
+func tokenBucket(r rate.Limit, burst int) func() budget {
+	return func() budget { return tokenBudget{rate.NewLimiter(r, burst)} }
+}
+
+// tokenBudget adds state reporting to a token bucket
+type tokenBudget struct {
+	*rate.Limiter
+}
+
+func (b tokenBudget) state(now time.Time, n int) (int, time.Duration) {
+	tokens := b.TokensAt(now)
+	remaining := int(max(tokens, 0))
+	if tokens >= float64(n) || b.Limit() <= 0 || b.Limit() == rate.Inf {
+		return remaining, 0
+	}
+	return remaining, time.Duration((float64(n) - tokens) / float64(b.Limit()) * float64(time.Second))
+}
+
+// NewPrefixLimiter creates a rate limiter whose buckets cover whole
+// networks (e.g. /24 and /64), so rotating addresses inside one subnet
+// doesn't buy fresh budget. A zero prefix length keeps that family per-IP.
+func NewPrefixLimiter(r rate.Limit, burst, v4Bits, v6Bits int) *Limiter {
+	l := newLimiter(tokenBucket(r, burst))
+	l.v4Bits = v4Bits
+	l.v6Bits = v6Bits
+	return l
+}
+
 // Allow checks if a request from the given IP should be allowed
 func (l *Limiter) Allow(ip string) bool {
+	return l.Take(ip).Allowed
+}
+
+// Take spends one request from the IP's budget and reports the outcome
+func (l *Limiter) Take(ip string) Result {
+	key := l.bucket(ip)
+
+	if l.shared != nil {
+		if res, err := l.shared.Take(l.sharedKey+key, 1, l.r, l.burst); err == nil {
+			return res
+		}
+		// Shared store unavailable: this node enforces its own budget
+	}
+
 	l.mu.Lock()
-	v, exists := l.visitors[ip]
+	v, exists := l.visitors[key]
 	if !exists {
 		v = &visitor{
-			limiter: rate.NewLimiter(l.r, l.burst),
+			limiter: l.newBudget(),
 		}
-		l.visitors[ip] = v
+		l.visitors[key] = v
 	}
 	v.lastSeen = time.Now()
 	l.mu.Unlock()
 
-	return v.limiter.Allow()
+	return take(v.limiter, 1)
+}
+
+// bucket maps an IP to the key its budget is kept under
+func (l *Limiter) bucket(ip string) string {
+	if l.v4Bits == 0 && l.v6Bits == 0 {
+		return ip
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := l.v6Bits
+	if addr.Is4() {
+		bits = l.v4Bits
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
 }
 
 // cleanup removes stale visitors periodically
 func (l *Limiter) cleanup() {
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(CleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		l.mu.Lock()
-		for ip, v := range l.visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(l.visitors, ip)
+	for {
+		select {
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for ip, v := range l.visitors {
+				if now.Sub(v.lastSeen) > StaleAfter {
+					delete(l.visitors, ip)
+				}
 			}
+			l.mu.Unlock()
+		case <-l.stop:
+			return
 		}
-		l.mu.Unlock()
 	}
 }
 
-// MessageLimiter provides per-client message rate limiting
+// Stop ends the cleanup goroutine. The limiter keeps working, but idle
+// visitors are no longer evicted.
+func (l *Limiter) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// MessageLimiter provides per-client message rate limiting.
+// Entries go with RemoveClient/RemoveRoom, or after StaleAfter idle.
 type MessageLimiter struct {
-	limiters map[string]*rate.Limiter
-	mu       sync.RWMutex
-	r        rate.Limit
-	burst    int
+	limiters  map[string]*visitor
+	mu        sync.RWMutex
+	newBudget func() budget
+	stop      chan struct{}
+	stopOnce  sync.Once
 }
 
-// NewMessageLimiter creates a new message rate limiter
+// NewMessageLimiter creates a new token-bucket message rate limiter
 func NewMessageLimiter(r rate.Limit, burst int) *MessageLimiter {
-	return &MessageLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		r:        r,
-		burst:    burst,
+	return newMessageLimiter(tokenBucket(r, burst))
+}
+
+func newMessageLimiter(newBudget func() budget) *MessageLimiter {
+	l := &MessageLimiter{
+		limiters:  make(map[string]*visitor),
+		newBudget: newBudget,
+		stop:      make(chan struct{}),
 	}
+	go l.cleanup()
+	return l
 }
 
 // Allow checks if a message from the given room/client should be allowed
 func (l *MessageLimiter) Allow(roomID, clientID string) bool {
+	return l.AllowN(roomID, clientID, 1)
+}
+
+// AllowN checks if n units (messages or bytes) from the given room/client
+// should be allowed
+func (l *MessageLimiter) AllowN(roomID, clientID string, n int) bool {
+	return l.TakeN(roomID, clientID, n).Allowed
+}
+
+// TakeN spends n units from the room/client budget and reports the outcome
+func (l *MessageLimiter) TakeN(roomID, clientID string, n int) Result {
 	key := roomID + ":" + clientID
 
 	l.mu.Lock()
-	limiter, exists := l.limiters[key]
+	v, exists := l.limiters[key]
 	if !exists {
-		limiter = rate.NewLimiter(l.r, l.burst)
-		l.limiters[key] = limiter
+		v = &visitor{
+			limiter: l.newBudget(),
+		}
+		l.limiters[key] = v
 	}
+	v.lastSeen = time.Now()
 	l.mu.Unlock()
 
-	return limiter.Allow()
+	return take(v.limiter, n)
+}
+
+// RemoveClient drops a client's limiter when it leaves its room
+func (l *MessageLimiter) RemoveClient(roomID, clientID string) {
+	l.mu.Lock()
+	delete(l.limiters, roomID+":"+clientID)
+	l.mu.Unlock()
 }
 
 // RemoveRoom removes all limiters for a room
@@ -109,3 +245,36 @@ func (l *MessageLimiter) RemoveRoom(roomID string) {
 		}
 	}
 }
+
+// Stop ends the cleanup goroutine. The limiter keeps working, but idle
+// entries are no longer evicted.
+func (l *MessageLimiter) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// cleanup evicts clients idle past StaleAfter. Their budgets have long
+// since refilled, so dropping them gives nothing away.
+func (l *MessageLimiter) cleanup() {
+	ticker := time.NewTicker(CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.evictIdle(now)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *MessageLimiter) evictIdle(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, v := range l.limiters {
+		if now.Sub(v.lastSeen) > StaleAfter {
+			delete(l.limiters, key)
+		}
+	}
+}
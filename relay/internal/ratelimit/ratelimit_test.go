@@ -1,6 +1,11 @@
 package ratelimit
 
 import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"net/netip"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -127,3 +132,475 @@ func TestMessageLimiterRemoveRoom(t *testing.T) {
 		t.Error("Should be allowed after room removal")
 	}
 }
+
+func TestMessageLimiterAllowN(t *testing.T) {
+	// 1KB/s with a 4KB burst, used as a byte budget
+	limiter := NewMessageLimiter(1024, 4096)
+
+	if !limiter.AllowN("room1", "client1", 3000) {
+		t.Error("Frame within burst should be allowed")
+	}
+
+	if limiter.AllowN("room1", "client1", 3000) {
+		t.Error("Second large frame should exceed the byte budget")
+	}
+
+	if !limiter.AllowN("room1", "client1", 500) {
+		t.Error("Small frame within remaining budget should be allowed")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for _, name := range []string{"strict", "default", "relaxed"} {
+		p, err := LookupProfile(name)
+		if err != nil {
+			t.Fatalf("Profile %s should exist: %v", name, err)
+		}
+		if p.Name != name {
+			t.Errorf("Profile name mismatch: expected %s, got %s", name, p.Name)
+		}
+		if p.ByteBurst < 8*1024*1024 {
+			t.Errorf("Profile %s byte burst %d can't fit a max-size frame", name, p.ByteBurst)
+		}
+	}
+
+	if _, err := LookupProfile("nonexistent"); err != ErrUnknownProfile {
+		t.Errorf("Expected ErrUnknownProfile, got %v", err)
+	}
+}
+
+func TestProfileLimiters(t *testing.T) {
+	p, _ := LookupProfile("strict")
+	limits := p.NewLimiters()
+
+	for i := 0; i < p.ConnBurst; i++ {
+		if !limits.Conn.Allow("10.0.0.1") {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	if limits.Conn.Allow("10.0.0.1") {
+		t.Error("Request after strict burst should be rate limited")
+	}
+
+	// Join budget is independent of the connection budget
+	if !limits.Join.Allow("10.0.0.1") {
+		t.Error("Join should use its own bucket")
+	}
+}
+
+// TestConnTracker verifies per-IP slots are capped and released
+func TestConnTracker(t *testing.T) {
+	tracker := NewConnTracker(2)
+
+	if !tracker.Acquire("10.0.0.1") || !tracker.Acquire("10.0.0.1") {
+		t.Fatal("First two connections should be allowed")
+	}
+	if tracker.Acquire("10.0.0.1") {
+		t.Error("Third concurrent connection should be rejected")
+	}
+	if !tracker.Acquire("10.0.0.2") {
+		t.Error("Other IPs should have their own slots")
+	}
+
+	tracker.Release("10.0.0.1")
+	if !tracker.Acquire("10.0.0.1") {
+		t.Error("Released slot should be reusable")
+	}
+
+	tracker.Release("10.0.0.1")
+	tracker.Release("10.0.0.1")
+	if n := tracker.Open("10.0.0.1"); n != 0 {
+		t.Errorf("Expected 0 open after releasing all, got %d", n)
+	}
+	if len(tracker.open) != 1 {
+		t.Errorf("Expected idle IPs to be forgotten, got %d entries", len(tracker.open))
+	}
+}
+
+// TestConnTrackerUnlimited verifies a zero cap disables tracking limits
+func TestConnTrackerUnlimited(t *testing.T) {
+	tracker := NewConnTracker(0)
+	for i := 0; i < 100; i++ {
+		if !tracker.Acquire("10.0.0.1") {
+			t.Fatalf("Connection %d should be allowed with no cap", i)
+		}
+	}
+}
+
+// TestConnCeiling verifies the server-wide cap and its release
+func TestConnCeiling(t *testing.T) {
+	ceiling := NewConnCeiling(2)
+
+	if !ceiling.Acquire() || !ceiling.Acquire() {
+		t.Fatal("Connections under the ceiling should be allowed")
+	}
+	if ceiling.Acquire() {
+		t.Error("Connection over the ceiling should be refused")
+	}
+	if n := ceiling.Open(); n != 2 {
+		t.Errorf("Refused connection should not be counted, got %d open", n)
+	}
+
+	ceiling.Release()
+	if !ceiling.Acquire() {
+		t.Error("Released slot should be reusable")
+	}
+}
+
+// TestPrefixLimiterSharesSubnetBudget verifies rotating addresses in a subnet doesn't help
+func TestPrefixLimiterSharesSubnetBudget(t *testing.T) {
+	limiter := NewPrefixLimiter(1, 2, 24, 64)
+
+	if !limiter.Allow("198.51.100.1") || !limiter.Allow("198.51.100.2") {
+		t.Fatal("Burst should be allowed")
+	}
+	if limiter.Allow("198.51.100.3") {
+		t.Error("Another address in the same /24 should share the exhausted bucket")
+	}
+	if !limiter.Allow("198.51.101.1") {
+		t.Error("A different /24 should have its own bucket")
+	}
+
+	limiter.Allow("2001:db8::1")
+	limiter.Allow("2001:db8::2")
+	if limiter.Allow("2001:db8::ffff") {
+		t.Error("Another address in the same /64 should share the exhausted bucket")
+	}
+	if !limiter.Allow("::ffff:203.0.113.9") {
+		t.Error("IPv4-mapped addresses should be bucketed as IPv4")
+	}
+}
+
+// TestPrefixLimiterZeroIsPerIP verifies a zero prefix keeps per-address buckets
+func TestPrefixLimiterZeroIsPerIP(t *testing.T) {
+	limiter := NewPrefixLimiter(1, 1, 0, 64)
+
+	if !limiter.Allow("198.51.100.1") || !limiter.Allow("198.51.100.2") {
+		t.Error("IPv4 addresses should have separate buckets with a zero prefix")
+	}
+	if !limiter.Allow("not-an-ip") || limiter.Allow("not-an-ip") {
+		t.Error("Unparseable keys should be bucketed as-is")
+	}
+}
+
+// TestAccessListMostSpecificWins verifies prefix precedence between the lists
+func TestAccessListMostSpecificWins(t *testing.T) {
+	access := NewAccessList()
+	mustParse := func(s string) netip.Prefix {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			t.Fatalf("ParsePrefix(%q) failed: %v", s, err)
+		}
+		return p
+	}
+
+	access.Add(ListDeny, mustParse("198.51.100.0/24"))
+	access.Add(ListAllow, mustParse("198.51.100.7"))
+
+	tests := []struct {
+		ip   string
+		want Verdict
+	}{
+		{"198.51.100.1", VerdictDeny},
+		{"198.51.100.7", VerdictAllow},
+		{"::ffff:198.51.100.2", VerdictDeny},
+		{"203.0.113.1", VerdictNone},
+		{"garbage", VerdictNone},
+	}
+	for _, tt := range tests {
+		if got := access.Check(tt.ip); got != tt.want {
+			t.Errorf("Check(%s): expected %d, got %d", tt.ip, tt.want, got)
+		}
+	}
+
+	// Listing a prefix on one list takes it off the other
+	access.Add(ListDeny, mustParse("198.51.100.7/32"))
+	if got := access.Check("198.51.100.7"); got != VerdictDeny {
+		t.Errorf("Expected deny after moving the entry, got %d", got)
+	}
+	if n := len(access.Entries(ListAllow)); n != 0 {
+		t.Errorf("Expected allow list emptied, got %d entries", n)
+	}
+
+	var none *AccessList
+	if none.Check("198.51.100.1") != VerdictNone {
+		t.Error("Nil access list should list nothing")
+	}
+}
+
+// TestJailEscalates verifies bans start after the threshold and double per offense
+func TestJailEscalates(t *testing.T) {
+	jail := NewJail(3, time.Minute, 3*time.Minute)
+
+	if jail.Strike("10.0.0.1") != 0 || jail.Strike("10.0.0.1") != 0 {
+		t.Fatal("Strikes under the threshold should not ban")
+	}
+	if d := jail.Strike("10.0.0.1"); d != time.Minute {
+		t.Errorf("Expected first ban of 1m, got %v", d)
+	}
+	if wait := jail.Check("10.0.0.1"); wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected IP to be banned for up to 1m, got %v", wait)
+	}
+	if jail.Check("10.0.0.2") != 0 {
+		t.Error("Other IPs should not be banned")
+	}
+
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		jail.Strike("10.0.0.1")
+		jail.Strike("10.0.0.1")
+		if d := jail.Strike("10.0.0.1"); d != want {
+			t.Errorf("Expected escalated ban of %v, got %v", want, d)
+		}
+	}
+}
+
+// TestJailDisabled verifies a zero threshold never bans
+func TestJailDisabled(t *testing.T) {
+	jail := NewJail(0, time.Minute, time.Hour)
+	for i := 0; i < 100; i++ {
+		if jail.Strike("10.0.0.1") != 0 {
+			t.Fatal("Disabled jail should never ban")
+		}
+	}
+}
+
+// TestRetryAfterRoundsUp verifies Retry-After never undershoots the wait
+func TestRetryAfterRoundsUp(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		1500 * time.Millisecond: "2",
+		time.Minute:             "60",
+		0:                       "1",
+	} {
+		if got := RetryAfter(wait); got != want {
+			t.Errorf("RetryAfter(%v): expected %s, got %s", wait, want, got)
+		}
+	}
+}
+
+// TestSlidingWindowDeniesRefillGaming verifies a client can't re-burst right after a window rolls
+func TestSlidingWindowDeniesRefillGaming(t *testing.T) {
+	w := &slidingWindow{window: time.Second, limit: 10}
+	start := time.Unix(1000, 0)
+
+	for i := 0; i < 10; i++ {
+		if !w.AllowN(start.Add(900*time.Millisecond), 1) {
+			t.Fatalf("Request %d within the limit should be allowed", i)
+		}
+	}
+	if w.AllowN(start.Add(950*time.Millisecond), 1) {
+		t.Error("Request over the limit should be denied")
+	}
+
+	// Just into the next window most of the previous one still counts
+	if w.AllowN(start.Add(1100*time.Millisecond), 2) {
+		t.Error("Burst right after the window boundary should be denied")
+	}
+	if !w.AllowN(start.Add(1100*time.Millisecond), 1) {
+		t.Error("The share released by the sliding window should be allowed")
+	}
+
+	// Two windows later nothing carries over
+	if !w.AllowN(start.Add(3*time.Second), 10) {
+		t.Error("Full budget should be available after an idle window")
+	}
+}
+
+// TestSlidingProfileLimiters verifies profiles can select the sliding window
+func TestSlidingProfileLimiters(t *testing.T) {
+	if _, err := ParseAlgorithm("leaky"); err != ErrUnknownAlgorithm {
+		t.Errorf("Expected ErrUnknownAlgorithm, got %v", err)
+	}
+	alg, err := ParseAlgorithm("sliding-window")
+	if err != nil {
+		t.Fatalf("ParseAlgorithm failed: %v", err)
+	}
+
+	p, _ := LookupProfile("strict")
+	p.Algorithm = alg
+	limits := p.NewLimiters()
+
+	for i := 0; i < p.ConnBurst; i++ {
+		if !limits.Conn.Allow("10.0.0.1") {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	if limits.Conn.Allow("10.0.0.1") {
+		t.Error("Request after the window budget should be rate limited")
+	}
+	if !limits.Msg.Allow("room", "client") {
+		t.Error("Message limiter should allow the first message")
+	}
+}
+
+// TestTakeReportsRetryHints verifies refusals say how long to back off
+func TestTakeReportsRetryHints(t *testing.T) {
+	limiter := NewLimiter(2, 2)
+
+	res := limiter.Take("10.0.0.1")
+	if !res.Allowed || res.Limit != 2 || res.Remaining != 1 {
+		t.Errorf("Expected allowed with 1 of 2 remaining, got %+v", res)
+	}
+	limiter.Take("10.0.0.1")
+
+	res = limiter.Take("10.0.0.1")
+	if res.Allowed {
+		t.Fatal("Request over the burst should be refused")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > 500*time.Millisecond {
+		t.Errorf("Expected a retry hint up to one refill interval, got %v", res.RetryAfter)
+	}
+
+	rec := httptest.NewRecorder()
+	res.SetHeaders(rec.Header())
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("X-RateLimit-Limit") != "2" ||
+		rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected headers: %v", rec.Header())
+	}
+}
+
+// TestSlidingWindowRetryHint verifies the hint lands when the request would fit
+func TestSlidingWindowRetryHint(t *testing.T) {
+	w := &slidingWindow{window: time.Second, limit: 10}
+	start := time.Unix(1000, 0)
+	w.AllowN(start, 10)
+
+	remaining, wait := w.state(start.Add(500*time.Millisecond), 1)
+	if remaining != 0 || wait <= 0 {
+		t.Fatalf("Expected exhausted window with a wait, got %d, %v", remaining, wait)
+	}
+	retry := start.Add(500 * time.Millisecond).Add(wait)
+	if w.AllowN(retry.Add(-10*time.Millisecond), 1) {
+		t.Error("Request before the hint should still be refused")
+	}
+	if !w.AllowN(retry.Add(time.Millisecond), 1) {
+		t.Error("Request at the hint should be allowed")
+	}
+}
+
+// TestMessageLimiterRemoveClient verifies a leaving client's entry is dropped
+func TestMessageLimiterRemoveClient(t *testing.T) {
+	limiter := NewMessageLimiter(10, 20)
+	defer limiter.Stop()
+
+	limiter.Allow("room1", "client1")
+	limiter.Allow("room1", "client2")
+	limiter.RemoveClient("room1", "client1")
+
+	if _, ok := limiter.limiters["room1:client1"]; ok {
+		t.Error("Removed client should have no entry")
+	}
+	if _, ok := limiter.limiters["room1:client2"]; !ok {
+		t.Error("Other clients should keep their entries")
+	}
+}
+
+// TestMessageLimiterEvictsIdle verifies entries idle past StaleAfter are evicted
+func TestMessageLimiterEvictsIdle(t *testing.T) {
+	limiter := NewMessageLimiter(10, 20)
+	limiter.Stop()
+	limiter.Stop() // idempotent
+
+	limiter.Allow("room1", "client1")
+	limiter.evictIdle(time.Now())
+	if len(limiter.limiters) != 1 {
+		t.Fatal("Active entry should survive eviction")
+	}
+
+	limiter.evictIdle(time.Now().Add(StaleAfter + time.Second))
+	if len(limiter.limiters) != 0 {
+		t.Error("Idle entry should be evicted")
+	}
+}
+
+// TestLimitersStopEndsGoroutines verifies Stop releases every cleanup goroutine
+func TestLimitersStopEndsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	p, _ := LookupProfile("default")
+	limits := p.NewLimiters()
+	if runtime.NumGoroutine() <= before {
+		t.Fatal("Expected cleanup goroutines to be running")
+	}
+
+	limits.Stop()
+	limits.Stop() // idempotent
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected %d goroutines after Stop, got %d", before, n)
+	}
+
+	// Stopped limiters still limit
+	if !limits.Conn.Allow("10.0.0.1") {
+		t.Error("Stopped limiter should still allow requests")
+	}
+}
+
+// TestEndpointBudgetsIndependent verifies probing one endpoint class spares the others
+func TestEndpointBudgetsIndependent(t *testing.T) {
+	p, _ := LookupProfile("strict")
+	limits := p.NewLimiters()
+	defer limits.Stop()
+
+	for limits.Probe.Allow("10.0.0.1") {
+	}
+	for name, l := range map[string]*Limiter{"conn": limits.Conn, "join": limits.Join, "invite": limits.Invite} {
+		if !l.Allow("10.0.0.1") {
+			t.Errorf("Exhausted probe budget should not affect the %s budget", name)
+		}
+	}
+}
+
+// TestPoWVerify verifies a solved challenge is accepted once, and forged,
+// unsolved or foreign ones never
+func TestPoWVerify(t *testing.T) {
+	pow := NewPoW(8)
+	solve := func(c Challenge) string {
+		for nonce := 0; ; nonce++ {
+			s := c.Challenge + ":" + strconv.Itoa(nonce)
+			sum := sha256.Sum256([]byte(s))
+			if leadingZeros(sum[:]) >= c.Bits {
+				return s
+			}
+		}
+	}
+
+	c := pow.Challenge()
+	if c.Bits != 8 {
+		t.Errorf("Expected 8 bits, got %d", c.Bits)
+	}
+	solution := solve(c)
+	if err := pow.Verify(solution); err != nil {
+		t.Fatalf("Expected solution to verify, got %v", err)
+	}
+	if err := pow.Verify(solution); err != ErrProofSpent {
+		t.Errorf("Expected ErrProofSpent on reuse, got %v", err)
+	}
+
+	// A nonce that misses the target
+	c = pow.Challenge()
+	for nonce := 0; ; nonce++ {
+		s := c.Challenge + ":" + strconv.Itoa(nonce)
+		if sum := sha256.Sum256([]byte(s)); leadingZeros(sum[:]) < c.Bits {
+			if err := pow.Verify(s); err != ErrBadProof {
+				t.Errorf("Expected ErrBadProof for unsolved challenge, got %v", err)
+			}
+			break
+		}
+	}
+
+	// Another node's challenge carries the wrong signature
+	if err := pow.Verify(solve(NewPoW(8).Challenge())); err != ErrBadProof {
+		t.Errorf("Expected ErrBadProof for foreign challenge, got %v", err)
+	}
+	if err := pow.Verify(""); err != ErrNoProof {
+		t.Errorf("Expected ErrNoProof, got %v", err)
+	}
+	var none *PoW
+	if err := none.Verify(solution); err != ErrNoProof {
+		t.Errorf("Expected nil PoW to refuse, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// Redis layout
+const (
+	DefaultRedisPrefix = "relay:ratelimit:"
+	RedisTimeout       = 250 * time.Millisecond // Per-check deadline; slower falls back to local
+)
+
+// errLocalOnly marks budgets a backend leaves to the local limiter
+var errLocalOnly = errors.New("budget not shareable")
+
+// Backend keeps per-key request budgets somewhere other than this process,
+// so relay nodes behind one load balancer spend from a single budget
+// instead of each granting the full allowance.
+type Backend interface {
+	Take(key string, n int, r rate.Limit, burst int) (Result, error)
+}
+
+// RedisBackend is a Backend using GCRA in Redis. Each key is one value,
+// the theoretical arrival time, expiring once the bucket would be full,
+// so idle clients cost nothing. Redis's clock is used so node clock skew
+// doesn't matter. It is token-bucket shaped whatever the profile's
+// Algorithm.
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+}
+
+// gcraScript checks and spends n units atomically.
+// KEYS[1] key; ARGV: emission interval us, burst, n
+// Returns {allowed, remaining, retry after us}
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local newTat = tat + n * interval
+local allowAt = newTat - burst * interval
+if allowAt > now then
+	return {0, math.floor((burst * interval - (tat - now)) / interval), allowAt - now}
+end
+
+redis.call('SET', KEYS[1], newTat, 'PX', math.ceil((newTat - now) / 1000))
+return {1, math.floor((burst * interval - (newTat - now)) / interval), 0}
+`)
+
+// NewRedisBackend creates a Redis rate-limit backend.
+// The backend owns the client and closes it on Stop.
+func NewRedisBackend(client *redis.Client, prefix string) *RedisBackend {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &RedisBackend{client: client, prefix: prefix}
+}
+
+// Take spends n units from key's budget
+func (rb *RedisBackend) Take(key string, n int, r rate.Limit, burst int) (Result, error) {
+	if r <= 0 || r == rate.Inf {
+		return Result{}, errLocalOnly
+	}
+	interval := int64(float64(time.Second/time.Microsecond) / float64(r))
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	reply, err := gcraScript.Run(ctx, rb.client, []string{rb.prefix + key}, interval, burst, n).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    reply[0] == 1,
+		Limit:      burst,
+		Remaining:  int(max(reply[1], 0)),
+		RetryAfter: time.Duration(reply[2]) * time.Microsecond,
+	}, nil
+}
+
+// Stop closes the Redis client
+func (rb *RedisBackend) Stop() {
+	rb.client.Close()
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*RedisBackend, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rb := NewRedisBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	t.Cleanup(rb.Stop)
+	return rb, mr
+}
+
+// TestRedisBudgetSharedAcrossNodes verifies two nodes spend from one budget
+func TestRedisBudgetSharedAcrossNodes(t *testing.T) {
+	rb, _ := newTestRedis(t)
+	p := Profile{Name: "test", ConnRate: 1, ConnBurst: 4, JoinRate: 1, JoinBurst: 1}
+	nodeA, nodeB := p.NewSharedLimiters(rb), p.NewSharedLimiters(rb)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+
+	for i := 0; i < 2; i++ {
+		if !nodeA.Conn.Allow("10.0.0.1") || !nodeB.Conn.Allow("10.0.0.1") {
+			t.Fatalf("Round %d within the shared burst should be allowed", i)
+		}
+	}
+
+	res := nodeB.Conn.Take("10.0.0.1")
+	if res.Allowed {
+		t.Fatal("Request over the shared burst should be refused on either node")
+	}
+	if res.Limit != 4 || res.Remaining != 0 || res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Errorf("Unexpected refusal metadata: %+v", res)
+	}
+
+	if !nodeA.Conn.Allow("10.0.0.2") {
+		t.Error("Other IPs should have their own shared budget")
+	}
+	if !nodeA.Join.Allow("10.0.0.1") {
+		t.Error("Endpoint classes should not share a key")
+	}
+}
+
+// TestRedisBudgetFallsBackLocally verifies an unreachable Redis leaves local limits in force
+func TestRedisBudgetFallsBackLocally(t *testing.T) {
+	rb, mr := newTestRedis(t)
+	limits := Profile{Name: "test", ConnRate: 1, ConnBurst: 2}.NewSharedLimiters(rb)
+	defer limits.Stop()
+
+	mr.Close()
+	if !limits.Conn.Allow("10.0.0.1") || !limits.Conn.Allow("10.0.0.1") {
+		t.Fatal("Local burst should be allowed while Redis is down")
+	}
+	if limits.Conn.Allow("10.0.0.1") {
+		t.Error("Local budget should still be enforced while Redis is down")
+	}
+}
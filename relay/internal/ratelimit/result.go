@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Result describes one limiter decision so callers can tell clients how
+// to back off instead of leaving them to retry blindly
+type Result struct {
+	Allowed    bool
+	Limit      int           // burst size
+	Remaining  int           // whole units left after this decision
+	RetryAfter time.Duration // when refused: until the request would fit
+}
+
+// take spends n units from b and describes the outcome
+func take(b budget, n int) Result {
+	now := time.Now()
+	res := Result{Allowed: b.AllowN(now, n), Limit: b.Burst()}
+	res.Remaining, res.RetryAfter = b.state(now, n)
+	if res.Allowed {
+		res.RetryAfter = 0
+	}
+	return res
+}
+
+// SetHeaders writes X-RateLimit-Limit and X-RateLimit-Remaining, plus
+// Retry-After when the request was refused
+func (r Result) SetHeaders(h http.Header) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(r.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	if !r.Allowed {
+		h.Set("Retry-After", RetryAfter(r.RetryAfter))
+	}
+}
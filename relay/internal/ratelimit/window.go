@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrUnknownAlgorithm is returned when an algorithm name is not defined
+var ErrUnknownAlgorithm = errors.New("unknown rate limit algorithm")
+
+// Algorithm selects how a limiter spends a (rate, burst) budget
+type Algorithm string
+
+const (
+	// TokenBucket refills continuously, so a client can idle and then
+	// spend a full burst, repeatedly
+	TokenBucket Algorithm = "token-bucket"
+	// SlidingWindow allows at most burst units in any window of
+	// burst/rate seconds, so timing requests around refills gains nothing
+	SlidingWindow Algorithm = "sliding-window"
+)
+
+// ParseAlgorithm returns the named algorithm; empty means TokenBucket
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch Algorithm(name) {
+	case "", TokenBucket:
+		return TokenBucket, nil
+	case SlidingWindow:
+		return SlidingWindow, nil
+	}
+	return "", ErrUnknownAlgorithm
+}
+
+// String returns the algorithm name, resolving the empty default
+func (a Algorithm) String() string {
+	if a == "" {
+		return string(TokenBucket)
+	}
+	return string(a)
+}
+
+// budget returns a constructor for per-key budgets of this algorithm
+func (a Algorithm) budget(r rate.Limit, burst int) func() budget {
+	if a != SlidingWindow || r <= 0 || r == rate.Inf {
+		return tokenBucket(r, burst)
+	}
+	window := time.Duration(float64(burst) / float64(r) * float64(time.Second))
+	return func() budget {
+		return &slidingWindow{window: window, limit: burst}
+	}
+}
+
+// NewSlidingLimiter creates a per-IP (or per-prefix) sliding-window limiter
+func NewSlidingLimiter(r rate.Limit, burst, v4Bits, v6Bits int) *Limiter {
+	l := newLimiter(SlidingWindow.budget(r, burst))
+	l.v4Bits = v4Bits
+	l.v6Bits = v6Bits
+	return l
+}
+
+// NewSlidingMessageLimiter creates a per-client sliding-window limiter
+func NewSlidingMessageLimiter(r rate.Limit, burst int) *MessageLimiter {
+	return newMessageLimiter(SlidingWindow.budget(r, burst))
+}
+
+// slidingWindow is a sliding-window counter: the previous fixed window's
+// count, weighted by how much of it still overlaps, plus the current one
+type slidingWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	limit  int
+	start  time.Time // start of the current fixed window
+	prev   int
+	curr   int
+}
+
+// AllowN reports whether n units fit in the window ending at now
+func (w *slidingWindow) AllowN(now time.Time, n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.used(now)+float64(n) > float64(w.limit) {
+		return false
+	}
+	w.curr += n
+	return true
+}
+
+// Burst returns the most units any window may hold
+func (w *slidingWindow) Burst() int {
+	return w.limit
+}
+
+func (w *slidingWindow) state(now time.Time, n int) (int, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	used := w.used(now)
+	remaining := int(max(float64(w.limit)-used, 0))
+	if used+float64(n) <= float64(w.limit) || n > w.limit {
+		return remaining, 0
+	}
+
+	// Until the previous window's weight decays enough, or failing that
+	// until the current window becomes the decaying one
+	elapsed := now.Sub(w.start)
+	free := float64(w.limit - w.curr - n)
+	if free >= 0 && w.prev > 0 {
+		return remaining, time.Duration(float64(w.window)*(1-free/float64(w.prev))) - elapsed
+	}
+	free = float64(w.limit - n)
+	return remaining, w.window - elapsed + time.Duration(float64(w.window)*(1-free/float64(w.curr)))
+}
+
+// used rolls the fixed windows forward to now and returns the weighted count
+func (w *slidingWindow) used(now time.Time) float64 {
+	if start := now.Truncate(w.window); !start.Equal(w.start) {
+		if start.Sub(w.start) == w.window {
+			w.prev = w.curr
+		} else {
+			w.prev = 0
+		}
+		w.curr = 0
+		w.start = start
+	}
+	overlap := 1 - float64(now.Sub(w.start))/float64(w.window)
+	return float64(w.prev)*overlap + float64(w.curr)
+}
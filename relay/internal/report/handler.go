@@ -0,0 +1,154 @@
+// Package report lets members flag a room for abuse. The relay can't see
+// what's said in a room and doesn't try: it counts how many distinct
+// members reported it and, past the operator's threshold, destroys it.
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// MaxBodySize bounds the JSON body of a report
+const MaxBodySize = 256
+
+// DestroyReason is what a room destroyed for its reports tells its
+// members
+const DestroyReason = "reported"
+
+// Handler serves POST /report/{roomId}. A report names the client ID the
+// reporter joined under and the secret CONNECTED gave it; only clients the
+// host confirmed may report, each counted once.
+type Handler struct {
+	registry  *room.Registry
+	threshold int // reports that destroy a room; 0 only counts them
+	limits    *ratelimit.Limiters
+	ips       *clientip.Resolver
+	access    *ratelimit.AccessList
+	pow       *ratelimit.PoW // nil unless SetProofOfWork
+}
+
+type Request struct {
+	ClientID string `json:"clientId"`
+	Secret   string `json:"secret"` // the clientSecret from CONNECTED
+}
+
+type Response struct {
+	Recorded bool `json:"recorded"` // false if the client had reported the room already
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates a report handler destroying rooms once threshold
+// distinct members have reported them, never if threshold is 0
+func NewHandler(registry *room.Registry, threshold int, limits *ratelimit.Limiters, ips *clientip.Resolver, access *ratelimit.AccessList) *Handler {
+	return &Handler{
+		registry:  registry,
+		threshold: threshold,
+		limits:    limits,
+		ips:       ips,
+		access:    access,
+	}
+}
+
+// SetProofOfWork makes requests with no address of their own, from the
+// onion service, each pay in work in place of the per-IP budget
+func (h *Handler) SetProofOfWork(pow *ratelimit.PoW) {
+	h.pow = pow
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Operator access lists come before the rate limiter
+	clientIP := h.ips.ClientIP(r)
+	verdict := h.access.Check(clientIP)
+	if verdict == ratelimit.VerdictDeny {
+		metrics.Global.IncRateLimited(metrics.ScopeReport, metrics.CauseDenylist)
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if clientIP == "" {
+		if err := h.pow.Verify(ratelimit.PoWSolution(r)); err != nil {
+			metrics.Global.IncRateLimited(metrics.ScopeReport, metrics.CauseNoProof)
+			writeError(w, http.StatusForbidden, "proof of work required")
+			return
+		}
+	}
+
+	exempt := verdict == ratelimit.VerdictAllow || clientIP == ""
+	if wait := h.limits.Jail.Check(clientIP); wait > 0 && !exempt {
+		metrics.Global.IncRateLimited(metrics.ScopeReport, metrics.CauseJail)
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		writeError(w, http.StatusTooManyRequests, "temporarily banned")
+		return
+	}
+
+	// Reports draw on the probe budget: a guessed client secret costs as
+	// much as a guessed invite token
+	if !exempt {
+		res := h.limits.Probe.Take(clientIP)
+		res.SetHeaders(w.Header())
+		if !res.Allowed {
+			metrics.Global.IncRateLimited(metrics.ScopeReport, metrics.CauseLimiter)
+			if d := h.limits.Jail.Strike(clientIP); d > 0 {
+				metrics.Global.IncBans()
+				log.Printf("Client jailed for %v after repeated rate limiting", d)
+			}
+			writeError(w, http.StatusTooManyRequests, "rate limited")
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	roomID := strings.TrimPrefix(r.URL.Path, "/report/")
+	if !room.ValidID(roomID) {
+		writeError(w, http.StatusBadRequest, "invalid room ID format")
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&req); err != nil || req.ClientID == "" || req.Secret == "" {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// A missing room and a stranger's report look alike
+	rm := h.registry.GetRoom(roomID)
+	if rm == nil {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	reports, counted, err := rm.Report(req.ClientID, req.Secret)
+	if err != nil {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if counted {
+		metrics.Global.IncReports()
+		log.Printf("Room reported: %s... (%d)", roomID[:8], reports)
+	}
+	if counted && h.threshold > 0 && reports >= h.threshold {
+		log.Printf("Room destroyed after %d reports: %s...", reports, roomID[:8])
+		h.registry.DestroyRoom(roomID, DestroyReason)
+	}
+
+	json.NewEncoder(w).Encode(Response{Recorded: counted})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
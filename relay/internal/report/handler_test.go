@@ -0,0 +1,85 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/gorilla/websocket"
+)
+
+const testRoomID = "report-handler-room-abcdefghijklmnopqrstuvw"
+
+// TestReportsDestroyRoom verifies only confirmed members' reports count,
+// each once, a report naming a member without its secret is refused, and
+// the room is destroyed at the threshold
+func TestReportsDestroyRoom(t *testing.T) {
+	registry := room.NewRegistry()
+	rm, err := registry.CreateRoom(testRoomID, &websocket.Conn{})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	rm.OpenRoom()
+	secrets := make(map[string]string)
+	for _, id := range []string{"alice", "bob", "mallory"} {
+		client, err := rm.AddClientWithRole(id, &websocket.Conn{}, room.RoleParticipant)
+		if err != nil {
+			t.Fatalf("Failed to add %s: %v", id, err)
+		}
+		secrets[id] = client.Secret()
+	}
+	rm.ConfirmClient("alice")
+	rm.ConfirmClient("bob")
+
+	limits := ratelimit.Profile{ProbeRate: 1000, ProbeBurst: 1000}.NewLimiters()
+	t.Cleanup(limits.Stop)
+	h := NewHandler(registry, 2, limits, nil, nil)
+
+	post := func(roomID, clientID, secret string) (int, Response) {
+		body := `{"clientId":"` + clientID + `","secret":"` + secret + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/report/"+roomID, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp Response
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	if code, _ := post(testRoomID, "mallory", secrets["mallory"]); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a client the host hasn't confirmed, got %d", code)
+	}
+	if code, _ := post(testRoomID, "stranger", secrets["mallory"]); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a stranger, got %d", code)
+	}
+
+	// Members learn each other's IDs, but not each other's secrets
+	for _, forged := range []string{"", secrets["alice"], secrets["bob"][1:]} {
+		if code, _ := post(testRoomID, "bob", forged); code == http.StatusOK {
+			t.Errorf("Expected a report for bob with secret %q refused", forged)
+		}
+	}
+
+	if code, resp := post(testRoomID, "alice", secrets["alice"]); code != http.StatusOK || !resp.Recorded {
+		t.Fatalf("Expected alice's report recorded, got %d %+v", code, resp)
+	}
+	if _, resp := post(testRoomID, "alice", secrets["alice"]); resp.Recorded {
+		t.Error("Expected a second report by alice not counted")
+	}
+	if registry.GetRoom(testRoomID) == nil {
+		t.Fatal("Expected the room to survive one member's reports")
+	}
+
+	if code, resp := post(testRoomID, "bob", secrets["bob"]); code != http.StatusOK || !resp.Recorded {
+		t.Fatalf("Expected bob's report recorded, got %d %+v", code, resp)
+	}
+	if registry.GetRoom(testRoomID) != nil {
+		t.Error("Expected the room destroyed at the threshold")
+	}
+	if code, _ := post(testRoomID, "bob", secrets["bob"]); code != http.StatusForbidden {
+		t.Errorf("Expected 403 once the room is gone, got %d", code)
+	}
+}
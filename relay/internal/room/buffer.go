@@ -0,0 +1,78 @@
+package room
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Frame buffers are pooled in power-of-two size classes from
+// MinPooledFrame to MaxPooledFrame bytes. Larger frames are allocated
+// and, once zeroed, left to the collector.
+const (
+	MinPooledFrame = 256
+	MaxPooledFrame = 64 * 1024
+)
+
+// framePools holds one pool per size class, 256 B to 64 KiB
+var framePools [9]sync.Pool
+
+// frameClass is the pool for buffers of capacity n, or -1 if n isn't a
+// class size
+func frameClass(n int) int {
+	if n < MinPooledFrame || n > MaxPooledFrame || n&(n-1) != 0 {
+		return -1
+	}
+	return bits.TrailingZeros(uint(n)) - bits.TrailingZeros(MinPooledFrame)
+}
+
+// NewBuffer returns an n byte buffer for an outbound frame, reusing one a
+// zeroed frame left behind if one fits
+func NewBuffer(n int) []byte {
+	if n > MaxPooledFrame {
+		return make([]byte, n)
+	}
+	size := MinPooledFrame
+	for size < n {
+		size *= 2
+	}
+	if p, ok := framePools[frameClass(size)].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, size)
+}
+
+// FreeBuffer zeroes b and returns it to the pool. The caller must not
+// touch b afterwards.
+func FreeBuffer(b []byte) {
+	b = b[:cap(b)]
+	clear(b)
+	if class := frameClass(cap(b)); class >= 0 {
+		framePools[class].Put(&b)
+	}
+}
+
+// lease is a frame shared by every recipient it was queued for. The
+// buffer is zeroed and pooled once the last of them releases it, so
+// ciphertext doesn't linger in the heap until the collector runs.
+type lease struct {
+	data []byte
+	refs atomic.Int32
+}
+
+// newLease takes msg over, held once by the caller queuing it
+func newLease(msg []byte) *lease {
+	l := &lease{data: msg}
+	l.refs.Store(1)
+	return l
+}
+
+func (l *lease) hold() {
+	l.refs.Add(1)
+}
+
+func (l *lease) release() {
+	if l.refs.Add(-1) == 0 {
+		FreeBuffer(l.data)
+	}
+}
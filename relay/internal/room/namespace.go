@@ -0,0 +1,82 @@
+package room
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// A room ID is 43 characters of base64url, the encoding of 32 random
+// bytes. Rooms of one application can be kept apart from another's
+// behind a namespace, "chat/" + ID, which is then the room's ID
+// everywhere: in the registry, its invites and its limits. Each
+// namespace has a pool of rooms of its own, so applications sharing a
+// relay don't compete for MaxRooms.
+
+var (
+	idPattern        = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+	namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+var (
+	ErrUnknownNamespace = errors.New("unknown namespace")
+	ErrInvalidNamespace = errors.New("invalid namespace")
+)
+
+// ValidID reports whether id is a room ID, namespaced or not
+func ValidID(id string) bool {
+	ns, bare, found := strings.Cut(id, "/")
+	if !found {
+		return idPattern.MatchString(id)
+	}
+	return ValidNamespace(ns) && idPattern.MatchString(bare)
+}
+
+// ValidNamespace reports whether ns can name a namespace: lowercase
+// letters, digits and dashes, at most 32 of them
+func ValidNamespace(ns string) bool {
+	return namespacePattern.MatchString(ns)
+}
+
+// Namespace returns the namespace of a room ID, "" for the default pool
+func Namespace(id string) string {
+	ns, _, found := strings.Cut(id, "/")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+// SetNamespace lets rooms be created in namespace ns, at most maxRooms of
+// them at once. Rooms in namespaces never set are refused.
+func (r *Registry) SetNamespace(ns string, maxRooms int) error {
+	if !ValidNamespace(ns) || maxRooms <= 0 {
+		return ErrInvalidNamespace
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.namespaces[ns] = maxRooms
+	return nil
+}
+
+// NamespaceCounts returns the number of active rooms in each namespace,
+// "" being the default pool
+func (r *Registry) NamespaceCounts() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]int, len(r.counts))
+	for ns, n := range r.counts {
+		counts[ns] = n
+	}
+	return counts
+}
+
+// roomLimit is how many rooms namespace ns may hold, false if it isn't
+// served. Callers hold r.mu.
+func (r *Registry) roomLimit(ns string) (int, bool) {
+	if ns == "" {
+		return MaxRooms, true
+	}
+	limit, ok := r.namespaces[ns]
+	return limit, ok
+}
@@ -0,0 +1,71 @@
+package room
+
+import "bytes"
+
+// MaxProfileSize bounds the encrypted profile a client may join with
+const MaxProfileSize = 4 * 1024
+
+// SetProfile keeps frame, the client's PROFILE frame, until the client
+// confirms; the room then shares it. It has no effect once it has.
+func (room *Room) SetProfile(clientID string, frame []byte) {
+	room.do(func() {
+		if client, exists := room.members[clientID]; exists && !client.confirmed {
+			client.profile = bytes.Clone(frame)
+		}
+	})
+}
+
+// shareProfiles hands a newly confirmed client every other member's
+// profile, and its own to every other confirmed member on this node.
+// Returns its profile for the fanout, nil if it joined without one; loop
+// only.
+func (room *Room) shareProfiles(client *Client) []byte {
+	for id, frame := range room.profiles {
+		if id != client.ID {
+			room.sendMsg(client, bytes.Clone(frame))
+		}
+	}
+	if client.profile == nil {
+		return nil
+	}
+	room.keepProfile(client.ID, client.profile)
+	return client.profile
+}
+
+// keepProfile records a member's profile and passes it to every confirmed
+// client on this node but the member; loop only
+func (room *Room) keepProfile(clientID string, frame []byte) {
+	if room.profiles == nil {
+		room.profiles = make(map[string][]byte)
+	}
+	room.profiles[clientID] = frame
+
+	l := newLease(bytes.Clone(frame))
+	defer l.release()
+	for _, c := range room.members {
+		if c.confirmed && c.ID != clientID {
+			room.sendTo(c, l)
+		}
+	}
+}
+
+// StoreProfile records the profile of a member held on another node and
+// passes it to this node's confirmed clients; an empty frame forgets it.
+// Nodes only learn profiles shared while they hold the room.
+func (room *Room) StoreProfile(clientID string, frame []byte) {
+	room.do(func() {
+		if len(frame) == 0 {
+			delete(room.profiles, clientID)
+			return
+		}
+		room.keepProfile(clientID, bytes.Clone(frame))
+	})
+}
+
+// fanoutProfile passes a member's profile, or nil once it has left, to
+// the room's other nodes; never on the loop
+func (room *Room) fanoutProfile(clientID string, frame []byte) {
+	if f := room.fanout.Load(); f != nil {
+		(*f).Profile(clientID, bytes.Clone(frame))
+	}
+}
@@ -0,0 +1,34 @@
+package room
+
+import "errors"
+
+// Members can report a room for abuse. All the relay keeps of it is how
+// many distinct members have, never who or why; the operator decides
+// how many reports a room may take before it's destroyed.
+
+// ErrNotMember is a report from a client that isn't a confirmed member,
+// or that didn't present its secret
+var ErrNotMember = errors.New("not a member of the room")
+
+// Report counts a report by clientID, a client the host has confirmed
+// presenting the secret it joined with, once however often it reports.
+// Other members know its ID, so the ID alone proves nothing. It returns
+// how many distinct clients have reported the room, and whether this one
+// counted.
+func (room *Room) Report(clientID, secret string) (reports int, counted bool, err error) {
+	err = ErrNotMember
+	room.do(func() {
+		client, exists := room.members[clientID]
+		if !exists || !client.confirmed || !client.checkSecret(secret) {
+			return
+		}
+		err = nil
+		if !client.reported {
+			client.reported = true
+			room.reports++
+			counted = true
+		}
+		reports = room.reports
+	})
+	return reports, counted, err
+}
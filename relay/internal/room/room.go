@@ -1,13 +1,30 @@
 // Package room provides in-memory room management for the ephemeral relay server.
 // All state is memory-only and destroyed on room close or server restart.
+//
+// Each Room is an actor: a single event-loop goroutine owns the client map,
+// the open flag, the heartbeat time and every channel close. Room methods
+// submit commands to that loop and wait for them to run, so there are no
+// per-room locks and a channel can only ever be closed once.
+//
+// Broadcasts are the exception: they read an immutable client snapshot that
+// the loop swaps atomically on every join and leave, so the hot path never
+// waits on the loop. Client send channels are therefore never closed; a
+// removed client's done channel is closed instead.
 package room
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"log"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/ephemeral/relay/internal/quota"
 )
 
 // Errors
@@ -16,71 +33,683 @@ var (
 	ErrRoomNotFound     = errors.New("room not found")
 	ErrServerAtCapacity = errors.New("server at capacity")
 	ErrRoomFull         = errors.New("room is full")
+	ErrTooManyPending   = errors.New("too many joins awaiting approval")
 	ErrRoomNotOpen      = errors.New("room is not open for joins")
+	ErrRoomClosing      = errors.New("room is closing")
+	ErrUnknownRole      = errors.New("unknown role")
 )
 
+// Role is what a client may do in a room, fixed when it joins
+type Role string
+
+const (
+	RoleParticipant Role = "participant" // may send messages (default)
+	RoleObserver    Role = "observer"    // receive only
+	RoleCoHost      Role = "cohost"      // participant who may also kick
+)
+
+// ParseRole validates a role name. The empty string means RoleParticipant.
+func ParseRole(s string) (Role, error) {
+	switch Role(s) {
+	case "", RoleParticipant:
+		return RoleParticipant, nil
+	case RoleObserver, RoleCoHost:
+		return Role(s), nil
+	}
+	return "", ErrUnknownRole
+}
+
 // Limits
 const (
 	MaxRooms          = 10000
 	MaxClientsPerRoom = 50
+	// MaxPendingClients caps the clients a room holds that its host hasn't
+	// approved yet, so a flood of joiners can't fill it first
+	MaxPendingClients = 10
+
+	// MaxRoomMemoryBytes is the budget for frames queued to a room's clients
+	// but not yet written to their sockets
+	MaxRoomMemoryBytes = 128 * 1024 * 1024
+	// MemoryEvictionGrace is how long a warned client has to drain its
+	// backlog before it is evicted
+	MemoryEvictionGrace = 5 * time.Second
+
+	// HostSecretLength is the number of random bytes in a room's host secret
+	HostSecretLength = 32
+	// ClientSecretLength is the number of random bytes in a client's secret
+	ClientSecretLength = 32
 )
 
+// Frame is an outbound message and when it was queued. Whoever takes a
+// frame off a send channel calls Release once it's written, or dropped.
+type Frame struct {
+	Data   []byte
+	Queued time.Time
+
+	lease *lease // shared with the frame's other recipients
+}
+
+// newFrame queues a copy of l for one more recipient
+func newFrame(l *lease) Frame {
+	l.hold()
+	return Frame{Data: l.data, Queued: time.Now(), lease: l}
+}
+
+// Release says the frame's recipient is done with it. When every
+// recipient is, Data is zeroed and its buffer reused.
+func (f Frame) Release() {
+	if f.lease != nil {
+		f.lease.release()
+	}
+}
+
+// Conn is a host's or client's connection. The room only ever closes it;
+// reading and writing is up to the transport that made it.
+type Conn interface {
+	Close() error
+}
+
 // Client represents a connected client in a room
 type Client struct {
 	ID     string
-	Conn   *websocket.Conn
-	SendCh chan []byte
+	Conn   Conn
+	SendCh chan Frame
+	Role   Role
+
+	secret      string        // proves the client on the report API; immutable
+	done        chan struct{} // closed when the client leaves the room
+	reason      string        // why it was removed, if the room said; set before done closes
+	queuedBytes int64         // bytes sitting in SendCh (atomic)
+	approved    atomic.Bool   // the host accepted its JOIN_REQUEST
+	warnedAt    time.Time     // when the client was warned about its backlog (loop-owned)
+	confirmed   bool          // client has sent JOIN_CONFIRM (loop-owned)
+	profile     []byte        // PROFILE frame from its JOIN_REQUEST, shared on confirm (loop-owned)
+	reported    bool          // client has reported the room (loop-owned)
+}
+
+func newClient(clientID string, conn Conn, role Role) *Client {
+	return &Client{
+		ID:     clientID,
+		Conn:   conn,
+		SendCh: make(chan Frame, 64),
+		Role:   role,
+		done:   make(chan struct{}),
+	}
+}
+
+// Secret returns the secret issued to the client as it joined. It is sent
+// only in CONNECTED and must never be logged.
+func (c *Client) Secret() string {
+	return c.secret
+}
+
+// checkSecret compares a presented secret against the client's in
+// constant time
+func (c *Client) checkSecret(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.secret)) == 1
+}
+
+// Done is closed once the client has been removed from the room.
+// Writers should flush whatever is left in SendCh and hang up.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Reason returns why the client was removed, as the frame telling it so
+// gave it: the room's destroy reason, or why it was evicted. "" if it
+// left, was kicked, or hasn't been removed.
+func (c *Client) Reason() string {
+	select {
+	case <-c.done:
+		return c.reason
+	default:
+		return ""
+	}
+}
+
+// send queues a message for the client without blocking.
+// Safe from any goroutine: SendCh is never closed.
+// Returns false if the client is gone or its buffer is full.
+func (c *Client) send(l *lease) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	f := newFrame(l)
+	select {
+	case c.SendCh <- f:
+		atomic.AddInt64(&c.queuedBytes, int64(len(l.data)))
+		return true
+	default:
+		f.Release()
+		return false
+	}
 }
 
-// Room represents an active ephemeral room
+// dropCause says why a failed send didn't queue
+func (c *Client) dropCause() DropCause {
+	select {
+	case <-c.done:
+		return DropClosed
+	default:
+		return DropClientFull
+	}
+}
+
+// Dequeued records that n bytes were taken off SendCh by the writer
+func (c *Client) Dequeued(n int) {
+	atomic.AddInt64(&c.queuedBytes, -int64(n))
+}
+
+// QueuedBytes returns the bytes queued for the client but not yet written
+func (c *Client) QueuedBytes() int64 {
+	return atomic.LoadInt64(&c.queuedBytes)
+}
+
+// Room represents an active ephemeral room. Its state is owned by the
+// room's event loop, which every method reaching it goes through.
 type Room struct {
-	ID            string
-	HostConn      *websocket.Conn
-	HostSendCh    chan []byte
-	Clients       map[string]*Client
-	CreatedAt     time.Time
-	LastHeartbeat time.Time
-	IsOpen        bool
-	mu            sync.RWMutex
+	ID         string
+	HostConn   Conn
+	HostSendCh chan Frame
+	CreatedAt  time.Time
+
+	members       map[string]*Client        // by client ID (loop-owned)
+	lastHeartbeat time.Time                 // the host's last heartbeat (loop-owned)
+	open          bool                      // taking joins (loop-owned)
+	hostSecret    string                    // proves host control on the invite API; immutable
+	tenant        string                    // the API key its host created it with, if any; immutable
+	clock         Clock                     // the registry's, or nil for the system's; immutable
+	registry      *Registry                 // holds the room, nil for one made outside it; immutable
+	proxy         bool                      // stands in for a room hosted on another relay node; immutable
+	snapshot      atomic.Pointer[[]*Client] // immutable copy of members for broadcasts
+	fanout        atomic.Pointer[Fanout]    // reaches clients on other relay nodes; nil when standalone
+	padding       atomic.Int64              // smallest size relayed frames are padded to; 0 for none
+	jitter        atomic.Int64              // longest random delay before writing a frame; 0 for none
+	reports       int                       // distinct clients that reported the room (loop-owned)
+	profiles      map[string][]byte         // PROFILE frames of confirmed members, by client ID (loop-owned)
+	closing       bool                      // in its closing countdown, refusing joins (loop-owned)
+	reason        string                    // why it was destroyed; set before done closes
+	stats         roomCounters
+	startOnce     sync.Once
+	cmds          chan func()
+	done          chan struct{}
+}
+
+// roomCounters are per-room traffic counters, updated atomically
+type roomCounters struct {
+	messages uint64
+	bytes    uint64
+	dropped  uint64
+}
+
+// RoomStats is a point-in-time view of a room's health for its host
+type RoomStats struct {
+	Clients  int
+	Pending  int // connected but not yet confirmed via JOIN_CONFIRM
+	Messages uint64
+	Bytes    uint64
+	Dropped  uint64 // frames dropped because a recipient's buffer was full
+	Uptime   time.Duration
+}
+
+// SetPadding has relayed ciphertext frames padded to size buckets
+// starting at bucket bytes, as the host asked at creation; 0 turns it off
+func (room *Room) SetPadding(bucket int) {
+	room.padding.Store(int64(bucket))
+}
+
+// Padding returns the room's smallest padding bucket, 0 if frames aren't
+// padded
+func (room *Room) Padding() int {
+	return int(room.padding.Load())
+}
+
+// SetJitter has frames to the room's members held back a random delay of
+// up to max before being written, as the host asked at creation; 0 turns
+// it off
+func (room *Room) SetJitter(max time.Duration) {
+	room.jitter.Store(int64(max))
+}
+
+// Jitter returns the longest delay frames are held back, 0 if they aren't
+func (room *Room) Jitter() time.Duration {
+	return time.Duration(room.jitter.Load())
+}
+
+// RecordMessage counts a relayed message of n payload bytes
+func (room *Room) RecordMessage(n int) {
+	atomic.AddUint64(&room.stats.messages, 1)
+	atomic.AddUint64(&room.stats.bytes, uint64(n))
+}
+
+// DropCause says why a frame was never queued
+type DropCause int
+
+const (
+	DropHostFull   DropCause = iota // host send channel full
+	DropClientFull                  // client send channel full
+	DropClosed                      // room destroyed or client already gone
+	numDropCauses
+)
+
+// dropped counts frames never queued, across all rooms
+var dropped [numDropCauses]atomic.Uint64
+
+// Dropped returns how many frames have been dropped for cause since start
+func Dropped(cause DropCause) uint64 {
+	return dropped[cause].Load()
+}
+
+// recordDrop counts a frame that could not be queued. Only full buffers
+// count toward the room's own stats; the host can act on those.
+func (room *Room) recordDrop(cause DropCause) {
+	dropped[cause].Add(1)
+	if cause != DropClosed {
+		atomic.AddUint64(&room.stats.dropped, 1)
+	}
+}
+
+// sendTo queues a frame for a client, counting it if dropped
+func (room *Room) sendTo(c *Client, l *lease) bool {
+	if c.send(l) {
+		return true
+	}
+	room.recordDrop(c.dropCause())
+	return false
+}
+
+// sendMsg queues msg for a client alone
+func (room *Room) sendMsg(c *Client, msg []byte) bool {
+	l := newLease(msg)
+	defer l.release()
+	return room.sendTo(c, l)
+}
+
+// ConfirmClient marks a client as having completed the join handshake,
+// and swaps profiles between it and the room's other members
+func (room *Room) ConfirmClient(clientID string) {
+	var profile []byte
+	room.do(func() {
+		if client, exists := room.members[clientID]; exists && !client.confirmed {
+			client.confirmed = true
+			profile = room.shareProfiles(client)
+		}
+	})
+	if profile != nil {
+		room.fanoutProfile(clientID, profile)
+	}
+}
+
+// Approved reports whether the host has accepted the client. Until then
+// its messages aren't relayed.
+func (c *Client) Approved() bool {
+	return c.approved.Load()
+}
+
+// ApproveClient marks a client the host accepted with its JOIN_RESPONSE.
+// Reports false if the room holds no such client on this node.
+func (room *Room) ApproveClient(clientID string) bool {
+	var client *Client
+	room.do(func() {
+		client = room.members[clientID]
+	})
+	if client == nil {
+		return false
+	}
+	client.approved.Store(true)
+	return true
+}
+
+// ExpirePending queues msg for clientID and removes it, as long as it
+// hasn't completed the join handshake. Its writer flushes msg and hangs
+// up. Reports whether it was removed.
+func (room *Room) ExpirePending(clientID string, msg []byte) bool {
+	expired := false
+	room.do(func() {
+		client, exists := room.members[clientID]
+		if !exists || client.confirmed {
+			return
+		}
+		room.sendMsg(client, msg)
+		room.removeClient(client, "join_timeout")
+		room.publishClients()
+		expired = true
+	})
+	return expired
+}
+
+// ConfirmedClients returns the clients that have completed the join
+// handshake, i.e. those the host has approved
+func (room *Room) ConfirmedClients() []*Client {
+	var confirmed []*Client
+	room.do(func() {
+		for _, client := range room.members {
+			if client.confirmed {
+				confirmed = append(confirmed, client)
+			}
+		}
+	})
+	return confirmed
+}
+
+// Stats returns the room's current counters
+func (room *Room) Stats() RoomStats {
+	stats := RoomStats{
+		Messages: atomic.LoadUint64(&room.stats.messages),
+		Bytes:    atomic.LoadUint64(&room.stats.bytes),
+		Dropped:  atomic.LoadUint64(&room.stats.dropped),
+		Uptime:   room.now().Sub(room.CreatedAt),
+	}
+	room.do(func() {
+		stats.Clients = len(room.members)
+		stats.Pending = room.pending()
+	})
+	return stats
+}
+
+// publishClients swaps in a fresh snapshot of the client map.
+// Called by the loop after every membership change.
+func (room *Room) publishClients() {
+	clients := make([]*Client, 0, len(room.members))
+	for _, client := range room.members {
+		clients = append(clients, client)
+	}
+	room.snapshot.Store(&clients)
+}
+
+// clients returns the current broadcast snapshot; callers must not modify it
+func (room *Room) clients() []*Client {
+	if p := room.snapshot.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Done is closed once the room has been destroyed, after its members'
+// final frames are queued. Goroutines serving the room should stop.
+func (room *Room) Done() <-chan struct{} {
+	room.startOnce.Do(room.start)
+	return room.done
+}
+
+// DestroyReason returns why the room was destroyed, as its ROOM_DESTROYED
+// frame gave it. Only meaningful once Done is closed.
+func (room *Room) DestroyReason() string {
+	select {
+	case <-room.Done():
+		return room.reason
+	default:
+		return ""
+	}
+}
+
+// removeClient drops a client and signals its writer, giving it reason
+// to hang up with; loop only
+func (room *Room) removeClient(client *Client, reason string) {
+	delete(room.members, client.ID)
+	delete(room.profiles, client.ID)
+	client.reason = reason
+	close(client.done)
+}
+
+// start launches the room's event loop
+func (room *Room) start() {
+	room.cmds = make(chan func())
+	room.done = make(chan struct{})
+	go room.loop()
+}
+
+// ReasonPanic is the reason a room is destroyed with when one of its
+// commands panics: its state can no longer be trusted
+const ReasonPanic = "internal_error"
+
+// panics counts room commands that panicked, across all rooms
+var panics atomic.Uint64
+
+// Panics returns how many room commands have panicked since start
+func Panics() uint64 {
+	return panics.Load()
+}
+
+// loop runs commands one at a time until the room is destroyed
+func (room *Room) loop() {
+	for {
+		select {
+		case cmd := <-room.cmds:
+			room.run(cmd)
+		case <-room.done:
+			return
+		}
+	}
+}
+
+// run runs one command. A panic in it is logged and counted instead of
+// taking the relay down, and destroys the room; loop only.
+func (room *Room) run(cmd func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			panics.Add(1)
+			log.Printf("Panic in room command: %v\n%s", r, debug.Stack())
+			room.run(func() { room.teardown(ReasonPanic) })
+			if room.registry != nil && room.registry.GetRoom(room.ID) == room {
+				room.registry.DestroyRoom(room.ID, ReasonPanic)
+			}
+		}
+	}()
+	cmd()
+}
+
+// do runs fn on the room's event loop and waits for it to finish, or to
+// panic. Returns false without running fn if the room has been destroyed.
+func (room *Room) do(fn func()) bool {
+	room.startOnce.Do(room.start)
+
+	ran := make(chan struct{})
+	select {
+	case room.cmds <- func() { defer close(ran); fn() }:
+		<-ran
+		return true
+	case <-room.done:
+		return false
+	}
 }
 
+// destroy notifies everyone in the room, closes all send channels and stops
+// the event loop. Safe to call more than once.
+func (room *Room) destroy(reason string) {
+	room.do(func() { room.teardown(reason) })
+}
+
+// teardown is destroy on the loop. It stops the loop even if it panics
+// partway, and does nothing once the loop has stopped.
+func (room *Room) teardown(reason string) {
+	select {
+	case <-room.done:
+		return
+	default:
+	}
+	room.reason = reason
+	// Later commands see done and bail out
+	defer close(room.done)
+
+	msg := newLease([]byte(`{"type":"ROOM_DESTROYED","reason":"` + reason + `"}`))
+	defer msg.release()
+
+	// Notify and close all clients
+	for _, client := range room.members {
+		room.sendTo(client, msg)
+		room.removeClient(client, reason)
+	}
+	room.members = nil
+	room.open = false
+	room.publishClients()
+
+	// Close host channel
+	if room.HostSendCh != nil {
+		room.sendToHost(msg)
+		close(room.HostSendCh)
+	}
+}
+
+// Clock tells rooms the time: when they were created, when their host
+// last heartbeated, and how long a client has been over the memory budget.
+// Tests substitute one they move by hand.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
 // Registry manages all active rooms in memory
 type Registry struct {
-	rooms map[string]*Room
-	mu    sync.RWMutex
+	rooms      map[string]*Room
+	counts     map[string]int                 // active rooms by namespace
+	namespaces map[string]int                 // most rooms by namespace, from SetNamespace
+	tenants    map[string]map[string]struct{} // active rooms by tenant, for those created as one
+	quotas     *quota.Engine                  // meters tenants' rooms, clients and bytes
+	mu         sync.RWMutex
+	clock      Clock
+
+	onCreated        []func(room *Room)
+	onDestroyed      []func(roomID, reason string)
+	onProxyDestroyed []func(roomID, reason string)
+}
+
+// OnRoomCreated registers a callback run after a room is created.
+// Hooks run synchronously on the creating goroutine; keep them cheap.
+func (r *Registry) OnRoomCreated(fn func(room *Room)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCreated = append(r.onCreated, fn)
+}
+
+// OnRoomDestroyed registers a callback run once after a room is destroyed,
+// whatever the cause, so subsystems holding per-room state can release it
+func (r *Registry) OnRoomDestroyed(fn func(roomID, reason string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDestroyed = append(r.onDestroyed, fn)
+}
+
+// OnProxyDestroyed registers a callback run once after a proxy room from
+// CreateProxyRoom is destroyed. Proxies don't run the room hooks: the
+// room's per-room state belongs to the node hosting it.
+func (r *Registry) OnProxyDestroyed(fn func(roomID, reason string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onProxyDestroyed = append(r.onProxyDestroyed, fn)
 }
 
 // NewRegistry creates a new in-memory room registry
 func NewRegistry() *Registry {
 	return &Registry{
-		rooms: make(map[string]*Room),
+		rooms:      make(map[string]*Room),
+		counts:     make(map[string]int),
+		namespaces: make(map[string]int),
+		tenants:    make(map[string]map[string]struct{}),
+		quotas:     quota.New(),
+		clock:      systemClock{},
 	}
 }
 
-// CreateRoom creates a new room with the given host connection
-func (r *Registry) CreateRoom(roomID string, hostConn *websocket.Conn) (*Room, error) {
+// SetClock replaces the time the registry's rooms keep, for rooms created
+// after the call
+func (r *Registry) SetClock(c Clock) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.clock = c
+}
+
+// CreateRoom creates a new room with the given host connection, in the
+// namespace its ID names
+func (r *Registry) CreateRoom(roomID string, hostConn Conn) (*Room, error) {
+	return r.CreateTenantRoom(roomID, hostConn, "", 0)
+}
+
+// CreateTenantRoom is CreateRoom for a host that presented tenant's API
+// key, which may hold at most maxRooms at once; 0 is no limit beyond the
+// namespace's. An empty tenant is no one's. Past the quota it fails with
+// a *quota.ExceededError.
+func (r *Registry) CreateTenantRoom(roomID string, hostConn Conn, tenant string, maxRooms int) (*Room, error) {
+	return r.create(roomID, hostConn, tenant, maxRooms, false)
+}
+
+// CreateProxyRoom creates a local stand-in for a room hosted on another
+// relay node, for clients joining here. It counts against its namespace
+// like any room, but the OnRoomCreated and OnRoomDestroyed hooks don't
+// run for it.
+func (r *Registry) CreateProxyRoom(roomID string) (*Room, error) {
+	return r.create(roomID, nil, "", 0, true)
+}
+
+func (r *Registry) create(roomID string, hostConn Conn, tenant string, maxRooms int, proxy bool) (*Room, error) {
+	r.mu.Lock()
 
 	if _, exists := r.rooms[roomID]; exists {
+		r.mu.Unlock()
 		return nil, ErrRoomExists
 	}
 
-	if len(r.rooms) >= MaxRooms {
+	ns := Namespace(roomID)
+	limit, ok := r.roomLimit(ns)
+	if !ok {
+		r.mu.Unlock()
+		return nil, ErrUnknownNamespace
+	}
+	if r.counts[ns] >= limit {
+		r.mu.Unlock()
 		return nil, ErrServerAtCapacity
 	}
+	if err := r.quotas.Acquire(tenant, quota.Rooms, int64(maxRooms)); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
 
+	secret := make([]byte, HostSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		r.quotas.Release(tenant, quota.Rooms)
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	now := r.clock.Now()
 	room := &Room{
 		ID:            roomID,
+		hostSecret:    base64.RawURLEncoding.EncodeToString(secret),
+		tenant:        tenant,
 		HostConn:      hostConn,
-		HostSendCh:    make(chan []byte, 256),
-		Clients:       make(map[string]*Client),
-		CreatedAt:     time.Now(),
-		LastHeartbeat: time.Now(),
-		IsOpen:        false,
+		HostSendCh:    make(chan Frame, 256),
+		members:       make(map[string]*Client),
+		CreatedAt:     now,
+		lastHeartbeat: now,
+		clock:         r.clock,
+		registry:      r,
+		proxy:         proxy,
 	}
+	room.startOnce.Do(room.start)
 
 	r.rooms[roomID] = room
+	r.counts[ns]++
+	if tenant != "" {
+		if r.tenants[tenant] == nil {
+			r.tenants[tenant] = make(map[string]struct{})
+		}
+		r.tenants[tenant][roomID] = struct{}{}
+	}
+	hooks := r.onCreated
+	if proxy {
+		hooks = nil
+	}
+	r.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(room)
+	}
 	return room, nil
 }
 
@@ -100,28 +729,43 @@ func (r *Registry) DestroyRoom(roomID string, reason string) {
 		return
 	}
 	delete(r.rooms, roomID)
+	if ns := Namespace(roomID); r.counts[ns] > 1 {
+		r.counts[ns]--
+	} else {
+		delete(r.counts, ns)
+	}
+	if owned := r.tenants[room.tenant]; owned != nil {
+		delete(owned, roomID)
+		if len(owned) == 0 {
+			delete(r.tenants, room.tenant)
+		}
+	}
+	r.quotas.Release(room.tenant, quota.Rooms)
+	hooks := r.onDestroyed
+	if room.proxy {
+		hooks = r.onProxyDestroyed
+	}
 	r.mu.Unlock()
 
-	// Notify and close all clients
-	room.mu.Lock()
-	for _, client := range room.Clients {
-		select {
-		case client.SendCh <- []byte(`{"type":"ROOM_DESTROYED","reason":"` + reason + `"}`):
-		default:
-		}
-		close(client.SendCh)
+	room.destroy(reason)
+
+	for _, fn := range hooks {
+		fn(roomID, reason)
 	}
-	room.Clients = nil
-	room.mu.Unlock()
+}
 
-	// Close host channel
-	if room.HostSendCh != nil {
-		select {
-		case room.HostSendCh <- []byte(`{"type":"ROOM_DESTROYED","reason":"` + reason + `"}`):
-		default:
+// MatchPrefix returns the IDs of the active rooms starting with prefix, as
+// the truncated IDs in Snapshot do
+func (r *Registry) MatchPrefix(prefix string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ids []string
+	for id := range r.rooms {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
 		}
-		close(room.HostSendCh)
 	}
+	return ids
 }
 
 // RoomCount returns the number of active rooms
@@ -131,100 +775,448 @@ func (r *Registry) RoomCount() int {
 	return len(r.rooms)
 }
 
-// OpenRoom marks a room as open for client joins
-func (room *Room) OpenRoom() {
-	room.mu.Lock()
-	defer room.mu.Unlock()
-	room.IsOpen = true
+// ClientCounts returns the number of clients in each active room.
+// Counts come from the broadcast snapshots, so no room loop is waited on.
+func (r *Registry) ClientCounts() []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make([]int, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		counts = append(counts, len(room.clients()))
+	}
+	return counts
 }
 
-// AddClient adds a client to the room
-func (room *Room) AddClient(clientID string, conn *websocket.Conn) (*Client, error) {
-	room.mu.Lock()
-	defer room.mu.Unlock()
+// QueueStats summarizes send channel occupancy across rooms
+type QueueStats struct {
+	Frames   int     // frames waiting in all queues
+	Capacity int     // total buffer slots
+	MaxFill  float64 // fullest single queue, 0 to 1
+}
 
-	if !room.IsOpen {
-		return nil, ErrRoomNotOpen
+func (q *QueueStats) add(length, capacity int) {
+	q.Frames += length
+	q.Capacity += capacity
+	if capacity > 0 {
+		q.MaxFill = max(q.MaxFill, float64(length)/float64(capacity))
 	}
+}
 
-	if len(room.Clients) >= MaxClientsPerRoom {
-		return nil, ErrRoomFull
+// SendQueues summarizes how full the host and client send channels are,
+// from channel lengths and the broadcast snapshots, without entering any
+// room loop
+func (r *Registry) SendQueues() (host, clients QueueStats) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, room := range r.rooms {
+		host.add(len(room.HostSendCh), cap(room.HostSendCh))
+		for _, c := range room.clients() {
+			clients.add(len(c.SendCh), cap(c.SendCh))
+		}
 	}
+	return host, clients
+}
 
-	client := &Client{
-		ID:     clientID,
-		Conn:   conn,
-		SendCh: make(chan []byte, 64),
+// OpenRoom marks a room as open for client joins
+func (room *Room) OpenRoom() {
+	room.do(func() {
+		room.open = true
+	})
+}
+
+// BeginClosing starts the room's closing countdown, during which joins
+// are refused so its members can wrap up. Reports false if it had already
+// started, or the room is gone.
+func (room *Room) BeginClosing() bool {
+	started := false
+	room.do(func() {
+		if !room.closing {
+			room.closing = true
+			started = true
+		}
+	})
+	return started
+}
+
+// AddClient adds a participant to the room
+func (room *Room) AddClient(clientID string, conn Conn) (*Client, error) {
+	return room.AddClientWithRole(clientID, conn, RoleParticipant)
+}
+
+// AddClientWithRole adds a client whose role was granted by its invite.
+// It awaits the host's approval, as one of at most MaxPendingClients.
+func (room *Room) AddClientWithRole(clientID string, conn Conn, role Role) (*Client, error) {
+	return room.addClient(clientID, conn, role, false)
+}
+
+// AddConfirmedClient adds a client the host approved already, such as one
+// resuming after a drain, approved and confirmed straight away
+func (room *Room) AddConfirmedClient(clientID string, conn Conn, role Role) (*Client, error) {
+	return room.addClient(clientID, conn, role, true)
+}
+
+func (room *Room) addClient(clientID string, conn Conn, role Role, confirmed bool) (*Client, error) {
+	secret := make([]byte, ClientSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
 	}
 
-	room.Clients[clientID] = client
-	return client, nil
+	var client *Client
+	err := ErrRoomNotOpen
+
+	room.do(func() {
+		if !room.open {
+			return
+		}
+		if room.closing {
+			err = ErrRoomClosing
+			return
+		}
+
+		if len(room.members) >= MaxClientsPerRoom {
+			err = ErrRoomFull
+			return
+		}
+		if !confirmed && room.pending() >= MaxPendingClients {
+			err = ErrTooManyPending
+			return
+		}
+
+		client = newClient(clientID, conn, role)
+		client.secret = base64.RawURLEncoding.EncodeToString(secret)
+		client.confirmed = confirmed
+		client.approved.Store(confirmed)
+		room.members[clientID] = client
+		room.publishClients()
+		err = nil
+	})
+
+	return client, err
+}
+
+// pending counts the clients the host hasn't approved; loop only
+func (room *Room) pending() int {
+	n := 0
+	for _, client := range room.members {
+		if !client.confirmed {
+			n++
+		}
+	}
+	return n
 }
 
 // RemoveClient removes a client from the room
 func (room *Room) RemoveClient(clientID string) {
-	room.mu.Lock()
-	defer room.mu.Unlock()
-
-	if client, exists := room.Clients[clientID]; exists {
-		close(client.SendCh)
-		delete(room.Clients, clientID)
+	shared := false
+	room.do(func() {
+		if client, exists := room.members[clientID]; exists {
+			_, shared = room.profiles[clientID]
+			room.removeClient(client, "")
+			room.publishClients()
+		}
+	})
+	if shared {
+		room.fanoutProfile(clientID, nil)
 	}
 }
 
 // GetClient retrieves a client by ID
 func (room *Room) GetClient(clientID string) *Client {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
-	return room.Clients[clientID]
+	var client *Client
+	room.do(func() {
+		client = room.members[clientID]
+	})
+	return client
 }
 
-// BroadcastToClients sends a message to all clients
-func (room *Room) BroadcastToClients(msg []byte) {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
+// SendToClient queues a message for one client. A client this node
+// doesn't hold is handed to the room's fanout, if it has one.
+// Returns false if the client is gone or its buffer is full.
+//
+// Like every message handed to the room, msg is the room's from then on:
+// it's zeroed once written, so the caller mustn't keep or reuse it.
+func (room *Room) SendToClient(clientID string, msg []byte) bool {
+	l := newLease(msg)
+	defer l.release()
 
-	for _, client := range room.Clients {
-		select {
-		case client.SendCh <- msg:
-		default:
-			// Client buffer full, skip
+	sent, local := false, false
+	ran := room.do(func() {
+		var client *Client
+		if client, local = room.members[clientID]; local {
+			sent = room.sendTo(client, l)
+		}
+	})
+	if ran && !local {
+		if f := room.fanout.Load(); f != nil {
+			(*f).Direct(clientID, msg)
+			return true
+		}
+	}
+	if !ran || !local {
+		room.recordDrop(DropClosed)
+	}
+	return sent
+}
+
+// DeliverToClient queues a message for a client on this node only, for
+// frames that arrived from another node. Absent clients are ignored: the
+// frame was sent to every node holding the room.
+func (room *Room) DeliverToClient(clientID string, msg []byte) bool {
+	l := newLease(msg)
+	defer l.release()
+
+	sent := false
+	room.do(func() {
+		if client, exists := room.members[clientID]; exists {
+			sent = room.sendTo(client, l)
 		}
+	})
+	return sent
+}
+
+// SendToHost queues a message for the host.
+// Returns false if the room is destroyed or the host buffer is full.
+func (room *Room) SendToHost(msg []byte) bool {
+	l := newLease(msg)
+	defer l.release()
+
+	sent := false
+	ran := room.do(func() {
+		sent = room.sendToHost(l)
+	})
+	if !ran {
+		room.recordDrop(DropClosed)
 	}
+	return sent
+}
+
+// sendToHost queues a frame for the host, counting it if dropped; loop only
+func (room *Room) sendToHost(l *lease) bool {
+	f := newFrame(l)
+	select {
+	case room.HostSendCh <- f:
+		return true
+	default:
+		f.Release()
+		room.recordDrop(DropHostFull)
+		return false
+	}
+}
+
+// BroadcastToClients sends a message to all clients.
+// Lock-free: reads the client snapshot without going through the loop.
+func (room *Room) BroadcastToClients(msg []byte) {
+	room.BroadcastToOthers("", msg)
 }
 
 // BroadcastToOthers sends a message to all clients except the sender
 func (room *Room) BroadcastToOthers(senderID string, msg []byte) {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
-
-	for id, client := range room.Clients {
-		if id != senderID {
-			select {
-			case client.SendCh <- msg:
-			default:
-			}
+	l := newLease(msg)
+	defer l.release()
+
+	room.deliverToClients(senderID, l)
+	if f := room.fanout.Load(); f != nil {
+		(*f).Broadcast(senderID, msg)
+	}
+}
+
+// DeliverToClients sends a message to this node's clients except exceptID,
+// without passing it to the fanout
+func (room *Room) DeliverToClients(exceptID string, msg []byte) {
+	l := newLease(msg)
+	defer l.release()
+	room.deliverToClients(exceptID, l)
+}
+
+func (room *Room) deliverToClients(exceptID string, l *lease) {
+	for _, client := range room.clients() {
+		// Client buffer full, skip
+		if client.ID != exceptID {
+			room.sendTo(client, l)
 		}
 	}
 }
 
+// Fanout carries a room's frames to its clients on other relay nodes.
+// Neither method may keep msg once it returns: the room zeroes it.
+type Fanout interface {
+	// Broadcast sends msg to every remote client except exceptID
+	Broadcast(exceptID string, msg []byte)
+	// Direct sends msg to one remote client
+	Direct(clientID string, msg []byte)
+	// Profile shares a member's PROFILE frame, nil once it has left
+	Profile(clientID string, msg []byte)
+}
+
+// SetFanout routes broadcasts, and direct frames for clients this node
+// doesn't hold, through f as well. Set it before the room opens.
+func (room *Room) SetFanout(f Fanout) {
+	room.fanout.Store(&f)
+}
+
 // UpdateHeartbeat updates the last heartbeat time
 func (room *Room) UpdateHeartbeat() {
-	room.mu.Lock()
-	defer room.mu.Unlock()
-	room.LastHeartbeat = time.Now()
+	room.do(func() {
+		room.lastHeartbeat = room.now()
+	})
+}
+
+// now is the time by the room's clock
+func (room *Room) now() time.Time {
+	if room.clock == nil {
+		return time.Now()
+	}
+	return room.clock.Now()
+}
+
+// SinceHeartbeat returns how long it's been since the host's last heartbeat
+func (room *Room) SinceHeartbeat() time.Duration {
+	return room.now().Sub(room.GetLastHeartbeat())
 }
 
 // GetLastHeartbeat returns the last heartbeat time
 func (room *Room) GetLastHeartbeat() time.Time {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
-	return room.LastHeartbeat
+	var last time.Time
+	if !room.do(func() { last = room.lastHeartbeat }) {
+		// The loop has exited, so nothing writes the field any more
+		return room.lastHeartbeat
+	}
+	return last
 }
 
 // ClientCount returns the number of clients in the room
 func (room *Room) ClientCount() int {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
-	return len(room.Clients)
+	var count int
+	room.do(func() {
+		count = len(room.members)
+	})
+	return count
+}
+
+// MemoryUsage returns the total bytes queued to the room's clients
+func (room *Room) MemoryUsage() int64 {
+	var total int64
+	room.do(func() {
+		for _, client := range room.members {
+			total += client.QueuedBytes()
+		}
+	})
+	return total
+}
+
+// EnforceMemoryBudget keeps the room's queued bytes under budget by warning,
+// and after grace evicting, the client with the largest backlog.
+// One slow member can otherwise hold the whole room's memory hostage.
+// Evicted clients are removed from the room; the caller closes their connections.
+func (room *Room) EnforceMemoryBudget(budget int64, grace time.Duration) []*Client {
+	var evicted []*Client
+	room.do(func() {
+		now := room.now()
+
+		for {
+			var total int64
+			var worst *Client
+			for _, client := range room.members {
+				queued := client.QueuedBytes()
+				total += queued
+				if worst == nil || queued > worst.QueuedBytes() {
+					worst = client
+				}
+			}
+
+			if total <= budget || worst == nil {
+				// Back under budget: forgive earlier warnings
+				for _, client := range room.members {
+					client.warnedAt = time.Time{}
+				}
+				return
+			}
+
+			if worst.warnedAt.IsZero() {
+				worst.warnedAt = now
+				room.sendMsg(worst, []byte(`{"type":"MEMORY_WARNING","reason":"backlog_over_budget"}`))
+				return
+			}
+
+			if now.Sub(worst.warnedAt) < grace {
+				return
+			}
+
+			room.sendMsg(worst, []byte(`{"type":"KICKED","reason":"memory_budget_exceeded"}`))
+			room.removeClient(worst, "memory_budget_exceeded")
+			room.publishClients()
+			evicted = append(evicted, worst)
+		}
+	})
+	for _, client := range evicted {
+		room.fanoutProfile(client.ID, nil)
+	}
+	return evicted
+}
+
+// RoomInfo is an anonymized view of one room for operators.
+// It never carries payloads, full room IDs or client addresses.
+type RoomInfo struct {
+	ID        string // truncated room ID, same form as in logs
+	CreatedAt time.Time
+	Clients   int
+	IsOpen    bool
+}
+
+// HostSecret returns the secret issued to the host at creation.
+// It is sent only in ROOM_CREATED and must never be logged.
+func (room *Room) HostSecret() string {
+	return room.hostSecret
+}
+
+// CheckHostSecret compares a presented secret against the room's in constant time
+func (room *Room) CheckHostSecret(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(room.hostSecret)) == 1
+}
+
+// truncateID shortens a room ID to the prefix used in logs, after its
+// namespace if it has one
+func truncateID(roomID string) string {
+	ns, bare, found := strings.Cut(roomID, "/")
+	if !found {
+		ns, bare = "", roomID
+	}
+	if len(bare) > 8 {
+		bare = bare[:8]
+	}
+	if found {
+		return ns + "/" + bare
+	}
+	return bare
+}
+
+// Info returns an anonymized view of the room
+func (room *Room) Info() RoomInfo {
+	info := RoomInfo{
+		ID:        truncateID(room.ID),
+		CreatedAt: room.CreatedAt,
+		Clients:   len(room.clients()),
+	}
+	room.do(func() {
+		info.IsOpen = room.open
+	})
+	return info
+}
+
+// Snapshot returns an anonymized view of every active room
+func (r *Registry) Snapshot() []RoomInfo {
+	r.mu.RLock()
+	rooms := make([]*Room, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		rooms = append(rooms, room)
+	}
+	r.mu.RUnlock()
+
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		infos = append(infos, room.Info())
+	}
+	return infos
 }
@@ -1,9 +1,13 @@
 package room
 
 import (
+	"errors"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ephemeral/relay/internal/quota"
 	"github.com/gorilla/websocket"
 )
 
@@ -70,13 +74,23 @@ func TestRegistryDestroyRoom(t *testing.T) {
 	conn := &websocket.Conn{}
 	roomID := "test-room-123456789012345678901234567890123"
 
-	_, err := registry.CreateRoom(roomID, conn)
+	rm, err := registry.CreateRoom(roomID, conn)
 	if err != nil {
 		t.Fatalf("Failed to create room: %v", err)
 	}
+	select {
+	case <-rm.Done():
+		t.Fatal("Expected Done open while the room is live")
+	default:
+	}
 
 	registry.DestroyRoom(roomID, "test")
 
+	select {
+	case <-rm.Done():
+	default:
+		t.Error("Expected Done closed once the room is destroyed")
+	}
 	if registry.RoomCount() != 0 {
 		t.Errorf("Expected 0 rooms after destroy, got %d", registry.RoomCount())
 	}
@@ -87,30 +101,118 @@ func TestRegistryDestroyRoom(t *testing.T) {
 	}
 }
 
-func TestRoomOpenClose(t *testing.T) {
-	room := &Room{
-		ID:       "test",
-		Clients:  make(map[string]*Client),
-		IsOpen:   false,
+// newTestRoom returns a room outside any registry, destroyed once the test
+// ends so its loop doesn't outlive it
+func newTestRoom(t *testing.T) *Room {
+	room := &Room{ID: "test", members: make(map[string]*Client)}
+	t.Cleanup(func() { room.destroy("test_over") })
+	return room
+}
+
+// TestRoomCommandsSerialize verifies commands from many goroutines run
+// one at a time on the loop; run with -race
+func TestRoomCommandsSerialize(t *testing.T) {
+	room := newTestRoom(t)
+	n := 0
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				room.do(func() { n++ })
+			}
+		}()
+	}
+	wg.Wait()
+	room.do(func() {
+		if n != 5000 {
+			t.Errorf("Expected 5000 commands run, got %d", n)
+		}
+	})
+}
+
+// TestRoomDestroyOnce verifies a second destroy changes nothing and
+// commands after it don't run
+func TestRoomDestroyOnce(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
+	client, _ := room.AddClient("a", nil)
+
+	room.destroy("first")
+	room.destroy("second")
+	if reason := room.DestroyReason(); reason != "first" {
+		t.Errorf("Expected the first reason kept, got %q", reason)
+	}
+	if reason := client.Reason(); reason != "first" {
+		t.Errorf("Expected the client removed once, with the first reason, got %q", reason)
+	}
+	if room.do(func() { t.Error("Expected no command run after destroy") }) {
+		t.Error("Expected do to report a destroyed room")
+	}
+	if _, err := room.AddClient("b", nil); err != ErrRoomNotOpen {
+		t.Errorf("Expected a destroyed room to refuse joins, got %v", err)
+	}
+}
+
+// TestRoomPanicDestroysRoom verifies a command that panics doesn't take
+// the relay down or leave its caller waiting: the room is destroyed, its
+// members told why, and its registry lets go of it
+func TestRoomPanicDestroysRoom(t *testing.T) {
+	registry := NewRegistry()
+	destroyed := make(chan string, 1)
+	registry.OnRoomDestroyed(func(roomID, reason string) { destroyed <- reason })
+	roomID := "panic-room-12345678901234567890123456789012"
+	room, err := registry.CreateRoom(roomID, &websocket.Conn{})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	room.OpenRoom()
+	client, _ := room.AddClient("a", nil)
+	before := Panics()
+
+	if !room.do(func() { panic("boom") }) {
+		t.Error("Expected the command to have run")
 	}
+	if Panics() != before+1 {
+		t.Errorf("Expected the panic counted, got %d", Panics()-before)
+	}
+	if reason := room.DestroyReason(); reason != ReasonPanic {
+		t.Errorf("Expected the room destroyed with %q, got %q", ReasonPanic, reason)
+	}
+	if reason := client.Reason(); reason != ReasonPanic {
+		t.Errorf("Expected the client removed with %q, got %q", ReasonPanic, reason)
+	}
+	if _, ok := <-room.HostSendCh; !ok {
+		t.Error("Expected ROOM_DESTROYED queued for the host")
+	}
+	if registry.GetRoom(roomID) != nil {
+		t.Error("Expected the registry to have let go of the room")
+	}
+	if reason := <-destroyed; reason != ReasonPanic {
+		t.Errorf("Expected the destroy hooks run with %q, got %q", ReasonPanic, reason)
+	}
+	if room.do(func() {}) {
+		t.Error("Expected do to report a destroyed room")
+	}
+}
 
-	if room.IsOpen {
+func TestRoomOpenClose(t *testing.T) {
+	room := newTestRoom(t)
+
+	if room.Info().IsOpen {
 		t.Error("Room should not be open initially")
 	}
 
 	room.OpenRoom()
 
-	if !room.IsOpen {
+	if !room.Info().IsOpen {
 		t.Error("Room should be open after OpenRoom()")
 	}
 }
 
 func TestRoomAddClient(t *testing.T) {
-	room := &Room{
-		ID:       "test",
-		Clients:  make(map[string]*Client),
-		IsOpen:   false,
-	}
+	room := newTestRoom(t)
 
 	conn := &websocket.Conn{}
 
@@ -138,20 +240,18 @@ func TestRoomAddClient(t *testing.T) {
 }
 
 func TestRoomClientLimit(t *testing.T) {
-	room := &Room{
-		ID:       "test",
-		Clients:  make(map[string]*Client),
-		IsOpen:   true,
-	}
+	room := newTestRoom(t)
+	room.OpenRoom()
 
 	conn := &websocket.Conn{}
 
-	// Add max clients
+	// Add max clients, each approved so the pending cap doesn't bite
 	for i := 0; i < MaxClientsPerRoom; i++ {
 		_, err := room.AddClient(string(rune('a'+i)), conn)
 		if err != nil {
 			t.Fatalf("Failed to add client %d: %v", i, err)
 		}
+		room.ConfirmClient(string(rune('a' + i)))
 	}
 
 	// Try to add one more
@@ -161,12 +261,34 @@ func TestRoomClientLimit(t *testing.T) {
 	}
 }
 
-func TestRoomRemoveClient(t *testing.T) {
-	room := &Room{
-		ID:       "test",
-		Clients:  make(map[string]*Client),
-		IsOpen:   true,
+func TestRoomPendingLimit(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
+
+	conn := &websocket.Conn{}
+
+	for i := 0; i < MaxPendingClients; i++ {
+		if _, err := room.AddClient(string(rune('a'+i)), conn); err != nil {
+			t.Fatalf("Failed to add client %d: %v", i, err)
+		}
+	}
+	if _, err := room.AddClient("flood", conn); err != ErrTooManyPending {
+		t.Errorf("Expected ErrTooManyPending, got %v", err)
+	}
+
+	// Approving one frees a place; approved clients never count
+	room.ConfirmClient("a")
+	if _, err := room.AddClient("next", conn); err != nil {
+		t.Errorf("Expected a place after an approval, got %v", err)
+	}
+	if _, err := room.AddConfirmedClient("resumed", conn, RoleParticipant); err != nil {
+		t.Errorf("Expected a resumed client past the pending cap, got %v", err)
 	}
+}
+
+func TestRoomRemoveClient(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
 
 	conn := &websocket.Conn{}
 	room.AddClient("client1", conn)
@@ -183,11 +305,8 @@ func TestRoomRemoveClient(t *testing.T) {
 }
 
 func TestRoomHeartbeat(t *testing.T) {
-	room := &Room{
-		ID:            "test",
-		Clients:       make(map[string]*Client),
-		LastHeartbeat: time.Now().Add(-time.Hour),
-	}
+	room := newTestRoom(t)
+	room.lastHeartbeat = time.Now().Add(-time.Hour)
 
 	oldTime := room.GetLastHeartbeat()
 	room.UpdateHeartbeat()
@@ -206,6 +325,7 @@ func TestRegistryCapacity(t *testing.T) {
 	for i := 0; i < MaxRooms; i++ {
 		registry.rooms[string(rune(i))] = &Room{}
 	}
+	registry.counts[""] = MaxRooms
 
 	conn := &websocket.Conn{}
 	_, err := registry.CreateRoom("overflow", conn)
@@ -213,3 +333,541 @@ func TestRegistryCapacity(t *testing.T) {
 		t.Errorf("Expected ErrServerAtCapacity, got %v", err)
 	}
 }
+
+func TestRoomMemoryBudgetEviction(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
+
+	conn := &websocket.Conn{}
+	small, _ := room.AddClient("small", conn)
+	big, _ := room.AddClient("big", conn)
+
+	small.send(newLease(make([]byte, 100)))
+	for i := 0; i < 10; i++ {
+		big.send(newLease(make([]byte, 1000)))
+	}
+
+	if room.MemoryUsage() != 10100 {
+		t.Fatalf("Expected 10100 queued bytes, got %d", room.MemoryUsage())
+	}
+
+	// First pass over budget only warns
+	if evicted := room.EnforceMemoryBudget(5000, time.Hour); len(evicted) != 0 {
+		t.Fatalf("Expected warning only, got %d evictions", len(evicted))
+	}
+	if big.warnedAt.IsZero() {
+		t.Error("Largest backlog client should be warned")
+	}
+
+	// After the grace period the largest backlog is evicted
+	evicted := room.EnforceMemoryBudget(5000, 0)
+	if len(evicted) != 1 || evicted[0].ID != "big" {
+		t.Fatalf("Expected big client evicted, got %v", evicted)
+	}
+	if room.GetClient("big") != nil {
+		t.Error("Evicted client should be removed from room")
+	}
+	if room.GetClient("small") == nil {
+		t.Error("Small client should remain")
+	}
+}
+
+func TestRoomMemoryBudgetForgivesDrainedClient(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
+
+	client, _ := room.AddClient("client1", &websocket.Conn{})
+	client.send(newLease(make([]byte, 1000)))
+
+	room.EnforceMemoryBudget(500, time.Hour)
+	if client.warnedAt.IsZero() {
+		t.Fatal("Client should be warned")
+	}
+
+	// Writer drains the backlog
+	<-client.SendCh
+	<-client.SendCh
+	client.Dequeued(1000)
+
+	if evicted := room.EnforceMemoryBudget(500, 0); len(evicted) != 0 {
+		t.Error("Drained client should not be evicted")
+	}
+	if !client.warnedAt.IsZero() {
+		t.Error("Warning should be cleared once back under budget")
+	}
+}
+
+func TestRoomBroadcastSnapshot(t *testing.T) {
+	room := newTestRoom(t)
+	room.OpenRoom()
+
+	a, _ := room.AddClient("a", &websocket.Conn{})
+	b, _ := room.AddClient("b", &websocket.Conn{})
+
+	room.BroadcastToOthers("a", []byte("hello"))
+	if len(a.SendCh) != 0 {
+		t.Error("Sender should not receive its own broadcast")
+	}
+	if len(b.SendCh) != 1 {
+		t.Errorf("Expected 1 queued message for b, got %d", len(b.SendCh))
+	}
+
+	// Removed clients drop out of the snapshot and are signalled via Done
+	room.RemoveClient("b")
+	select {
+	case <-b.Done():
+	default:
+		t.Error("Removed client's Done channel should be closed")
+	}
+
+	room.BroadcastToClients([]byte("world"))
+	if len(b.SendCh) != 1 {
+		t.Error("Removed client should not receive further broadcasts")
+	}
+	if len(a.SendCh) != 1 {
+		t.Errorf("Expected 1 queued message for a, got %d", len(a.SendCh))
+	}
+}
+
+func TestRoomBroadcastConcurrentWithLeave(t *testing.T) {
+	registry := NewRegistry()
+	room, _ := registry.CreateRoom("test-room-123456789012345678901234567890123", &websocket.Conn{})
+	room.OpenRoom()
+
+	for i := 0; i < MaxClientsPerRoom; i++ {
+		room.AddClient(string(rune('a'+i)), &websocket.Conn{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			room.BroadcastToClients([]byte("x"))
+		}
+	}()
+
+	// Removing clients and destroying the room mid-broadcast must not panic
+	for i := 0; i < MaxClientsPerRoom/2; i++ {
+		room.RemoveClient(string(rune('a' + i)))
+	}
+	registry.DestroyRoom(room.ID, "test")
+	<-done
+}
+
+func TestRegistryLifecycleHooks(t *testing.T) {
+	registry := NewRegistry()
+	roomID := "test-room-123456789012345678901234567890123"
+
+	var created []string
+	var destroyed []string
+	registry.OnRoomCreated(func(room *Room) {
+		created = append(created, room.ID)
+	})
+	registry.OnRoomDestroyed(func(id, reason string) {
+		destroyed = append(destroyed, id+":"+reason)
+	})
+
+	registry.CreateRoom(roomID, &websocket.Conn{})
+	if len(created) != 1 || created[0] != roomID {
+		t.Errorf("Expected created hook for %s, got %v", roomID, created)
+	}
+
+	// Failed creation must not fire the hook
+	registry.CreateRoom(roomID, &websocket.Conn{})
+	if len(created) != 1 {
+		t.Errorf("Duplicate create should not fire hook, got %v", created)
+	}
+
+	registry.DestroyRoom(roomID, "test")
+	registry.DestroyRoom(roomID, "test")
+	if len(destroyed) != 1 || destroyed[0] != roomID+":test" {
+		t.Errorf("Expected exactly one destroyed hook, got %v", destroyed)
+	}
+
+	// A proxy's lifecycle runs only the proxy hooks
+	var proxies []string
+	registry.OnProxyDestroyed(func(id, reason string) {
+		proxies = append(proxies, id+":"+reason)
+	})
+	if _, err := registry.CreateProxyRoom(roomID); err != nil {
+		t.Fatalf("CreateProxyRoom failed: %v", err)
+	}
+	registry.DestroyRoom(roomID, "idle")
+	if len(created) != 1 || len(destroyed) != 1 {
+		t.Errorf("Expected no room hooks for a proxy, got %v and %v", created, destroyed)
+	}
+	if len(proxies) != 1 || proxies[0] != roomID+":idle" {
+		t.Errorf("Expected exactly one proxy destroyed hook, got %v", proxies)
+	}
+}
+
+func TestRoomStats(t *testing.T) {
+	room := newTestRoom(t)
+	room.HostSendCh = make(chan Frame, 1)
+	room.CreatedAt = time.Now().Add(-time.Minute)
+	room.OpenRoom()
+
+	room.AddClient("a", &websocket.Conn{})
+	room.AddClient("b", &websocket.Conn{})
+	room.ConfirmClient("a")
+
+	room.RecordMessage(100)
+	room.RecordMessage(50)
+
+	// Fill the host buffer so the second send is dropped
+	room.SendToHost([]byte("one"))
+	room.SendToHost([]byte("two"))
+
+	stats := room.Stats()
+	if stats.Clients != 2 || stats.Pending != 1 {
+		t.Errorf("Expected 2 clients with 1 pending, got %d/%d", stats.Clients, stats.Pending)
+	}
+	if stats.Messages != 2 || stats.Bytes != 150 {
+		t.Errorf("Expected 2 messages / 150 bytes, got %d/%d", stats.Messages, stats.Bytes)
+	}
+	if stats.Dropped != 1 {
+		t.Errorf("Expected 1 dropped frame, got %d", stats.Dropped)
+	}
+	if stats.Uptime < time.Minute {
+		t.Errorf("Uptime should be at least a minute, got %v", stats.Uptime)
+	}
+}
+
+// TestHostSecret verifies each room gets a distinct secret checked in full
+func TestHostSecret(t *testing.T) {
+	registry := NewRegistry()
+	a, _ := registry.CreateRoom("secret-room-a", &websocket.Conn{})
+	b, _ := registry.CreateRoom("secret-room-b", &websocket.Conn{})
+
+	if a.HostSecret() == "" || a.HostSecret() == b.HostSecret() {
+		t.Fatal("Rooms should get distinct non-empty host secrets")
+	}
+	if !a.CheckHostSecret(a.HostSecret()) {
+		t.Error("Room should accept its own secret")
+	}
+	for _, bad := range []string{"", b.HostSecret(), a.HostSecret()[:10]} {
+		if a.CheckHostSecret(bad) {
+			t.Errorf("Room should reject secret %q", bad)
+		}
+	}
+}
+
+// TestClientRole verifies roles are parsed strictly and attached at join
+func TestClientRole(t *testing.T) {
+	for _, s := range []string{"", "participant"} {
+		if role, err := ParseRole(s); err != nil || role != RoleParticipant {
+			t.Errorf("ParseRole(%q): expected participant, got %q, %v", s, role, err)
+		}
+	}
+	if _, err := ParseRole("admin"); err != ErrUnknownRole {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+
+	registry := NewRegistry()
+	rm, _ := registry.CreateRoom("role-room", &websocket.Conn{})
+	rm.OpenRoom()
+	client, err := rm.AddClientWithRole("observer-1", &websocket.Conn{}, RoleObserver)
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	if client.Role != RoleObserver || rm.GetClient("observer-1").Role != RoleObserver {
+		t.Error("Client should keep the role it joined with")
+	}
+}
+
+func TestRegistrySendQueues(t *testing.T) {
+	registry := NewRegistry()
+	room, _ := registry.CreateRoom("test-room-123456789012345678901234567890123", &websocket.Conn{})
+	room.OpenRoom()
+	room.AddClient("a", &websocket.Conn{})
+	room.AddClient("b", &websocket.Conn{})
+
+	room.SendToHost([]byte("one"))
+	room.SendToClient("a", []byte("one"))
+	room.SendToClient("a", []byte("two"))
+
+	host, clients := registry.SendQueues()
+	if host.Frames != 1 || host.Capacity != 256 {
+		t.Errorf("Expected 1 of 256 host frames, got %+v", host)
+	}
+	if clients.Frames != 2 || clients.Capacity != 128 {
+		t.Errorf("Expected 2 of 128 client frames, got %+v", clients)
+	}
+	if clients.MaxFill != 2.0/64 {
+		t.Errorf("Expected fullest client queue at 2/64, got %v", clients.MaxFill)
+	}
+}
+
+func TestDroppedFramesByCause(t *testing.T) {
+	hostFull, clientFull, closed := Dropped(DropHostFull), Dropped(DropClientFull), Dropped(DropClosed)
+
+	registry := NewRegistry()
+	roomID := "drop-room-123456789012345678901234567890123"
+	room, _ := registry.CreateRoom(roomID, &websocket.Conn{})
+	room.OpenRoom()
+	room.AddClient("a", &websocket.Conn{})
+
+	for i := 0; i < cap(room.HostSendCh)+1; i++ {
+		room.SendToHost([]byte("x"))
+	}
+	for i := 0; i < 65; i++ {
+		room.SendToClient("a", []byte("x"))
+	}
+	room.SendToClient("missing", []byte("x"))
+
+	if got := Dropped(DropHostFull) - hostFull; got != 1 {
+		t.Errorf("Expected 1 host_full drop, got %d", got)
+	}
+	if got := Dropped(DropClientFull) - clientFull; got != 1 {
+		t.Errorf("Expected 1 client_full drop, got %d", got)
+	}
+	if got := Dropped(DropClosed) - closed; got != 1 {
+		t.Errorf("Expected 1 closed drop, got %d", got)
+	}
+	if room.Stats().Dropped != 2 {
+		t.Errorf("Expected room stats to count only full buffers, got %d", room.Stats().Dropped)
+	}
+
+	registry.DestroyRoom(roomID, "test")
+	room.SendToHost([]byte("late"))
+	if got := Dropped(DropClosed) - closed; got != 2 {
+		t.Errorf("Expected a send to a destroyed room to count as closed, got %d", got)
+	}
+}
+
+// recordingFanout remembers what a room handed to other nodes
+type recordingFanout struct {
+	broadcasts []string // except IDs
+	directs    []string // recipient IDs
+	profiles   []string // member IDs, "-" for those forgotten
+}
+
+func (f *recordingFanout) Broadcast(exceptID string, msg []byte) {
+	f.broadcasts = append(f.broadcasts, exceptID)
+}
+
+func (f *recordingFanout) Direct(clientID string, msg []byte) {
+	f.directs = append(f.directs, clientID)
+}
+
+func (f *recordingFanout) Profile(clientID string, msg []byte) {
+	if msg == nil {
+		clientID = "-" + clientID
+	}
+	f.profiles = append(f.profiles, clientID)
+}
+
+// TestRoomFanout verifies broadcasts and frames for absent clients reach
+// the fanout while local deliveries don't
+func TestRoomFanout(t *testing.T) {
+	registry := NewRegistry()
+	room, _ := registry.CreateRoom("fanout-room", nil)
+	room.OpenRoom()
+	local, _ := room.AddClient("local", nil)
+
+	fanout := &recordingFanout{}
+	room.SetFanout(fanout)
+
+	room.BroadcastToClients([]byte("all"))
+	room.BroadcastToOthers("local", []byte("others"))
+	if !room.SendToClient("remote", []byte("direct")) {
+		t.Error("Expected a frame for a remote client to be handed off")
+	}
+	room.SendToClient("local", []byte("mine"))
+	room.DeliverToClients("", []byte("from-peer"))
+	room.DeliverToClient("remote", []byte("from-peer"))
+
+	if len(fanout.broadcasts) != 2 || fanout.broadcasts[0] != "" || fanout.broadcasts[1] != "local" {
+		t.Errorf("Expected two broadcasts to be fanned out, got %v", fanout.broadcasts)
+	}
+	if len(fanout.directs) != 1 || fanout.directs[0] != "remote" {
+		t.Errorf("Expected only the remote client's frame to be fanned out, got %v", fanout.directs)
+	}
+	if len(local.SendCh) != 3 {
+		t.Errorf("Expected 3 frames queued locally, got %d", len(local.SendCh))
+	}
+}
+
+// TestProfilesShared verifies a confirming client gets every member's
+// profile, local or remote, and its own goes to the members and the fanout
+func TestProfilesShared(t *testing.T) {
+	registry := NewRegistry()
+	room, _ := registry.CreateRoom("profile-room", nil)
+	room.OpenRoom()
+	fanout := &recordingFanout{}
+	room.SetFanout(fanout)
+
+	a, _ := room.AddClient("a", nil)
+	room.SetProfile("a", []byte("profile-a"))
+	room.ConfirmClient("a")
+	room.StoreProfile("remote", []byte("profile-remote"))
+	if got := drain(a); !slices.Equal(got, []string{"profile-remote"}) {
+		t.Errorf("Expected a to get only the remote profile, got %v", got)
+	}
+
+	b, _ := room.AddClient("b", nil)
+	room.SetProfile("b", []byte("profile-b"))
+	room.BroadcastToClients([]byte("before-confirm"))
+	if got := drain(a); !slices.Equal(got, []string{"before-confirm"}) {
+		t.Errorf("Expected b's profile held back until it confirms, got %v", got)
+	}
+	drain(b)
+	room.ConfirmClient("b")
+	got := drain(b)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"profile-a", "profile-remote"}) {
+		t.Errorf("Expected b to get the members' profiles, got %v", got)
+	}
+	if got := drain(a); !slices.Equal(got, []string{"profile-b"}) {
+		t.Errorf("Expected a to get b's profile, got %v", got)
+	}
+
+	room.RemoveClient("a")
+	room.StoreProfile("remote", nil)
+	c, _ := room.AddClient("c", nil)
+	room.ConfirmClient("c")
+	if got := drain(c); !slices.Equal(got, []string{"profile-b"}) {
+		t.Errorf("Expected c to get only the remaining member's profile, got %v", got)
+	}
+	if !slices.Equal(fanout.profiles, []string{"a", "b", "-a"}) {
+		t.Errorf("Expected the shared and forgotten profiles fanned out, got %v", fanout.profiles)
+	}
+}
+
+// drain returns the frames queued for a client
+func drain(c *Client) []string {
+	var frames []string
+	for {
+		select {
+		case f := <-c.SendCh:
+			frames = append(frames, string(f.Data))
+			f.Release()
+		default:
+			return frames
+		}
+	}
+}
+
+// TestFrameZeroedAfterLastRecipient verifies a broadcast frame survives
+// until every recipient has released it, and is zeroed then
+func TestFrameZeroedAfterLastRecipient(t *testing.T) {
+	registry := NewRegistry()
+	room, _ := registry.CreateRoom("zero-room", nil)
+	room.OpenRoom()
+	a, _ := room.AddClient("a", nil)
+	b, _ := room.AddClient("b", nil)
+
+	msg := NewBuffer(len("ciphertext"))
+	copy(msg, "ciphertext")
+	room.BroadcastToClients(msg)
+
+	first := <-a.SendCh
+	first.Release()
+	if string(msg) != "ciphertext" {
+		t.Fatalf("Expected the frame intact while a recipient holds it, got %q", msg)
+	}
+
+	second := <-b.SendCh
+	second.Release()
+	for _, c := range msg {
+		if c != 0 {
+			t.Fatalf("Expected the frame zeroed once every recipient released it, got %q", msg)
+		}
+	}
+}
+
+func TestNewBufferSizes(t *testing.T) {
+	for _, n := range []int{0, 1, MinPooledFrame, MinPooledFrame + 1, MaxPooledFrame, MaxPooledFrame + 1} {
+		b := NewBuffer(n)
+		if len(b) != n {
+			t.Errorf("NewBuffer(%d) has length %d", n, len(b))
+		}
+		FreeBuffer(b)
+	}
+}
+
+// TestRegistryNamespaces verifies namespaced rooms come out of their own
+// pool, apart from the default one and from rooms of the same bare ID
+func TestRegistryNamespaces(t *testing.T) {
+	registry := NewRegistry()
+	bare := "ns-room-1234567890123456789012345678901234"
+
+	if _, err := registry.CreateRoom("chat/"+bare, nil); err != ErrUnknownNamespace {
+		t.Errorf("Expected ErrUnknownNamespace before the namespace is set, got %v", err)
+	}
+	if err := registry.SetNamespace("Chat", 1); err != ErrInvalidNamespace {
+		t.Errorf("Expected an uppercase namespace refused, got %v", err)
+	}
+	if err := registry.SetNamespace("chat", 1); err != nil {
+		t.Fatalf("Failed to set namespace: %v", err)
+	}
+
+	if _, err := registry.CreateRoom("chat/"+bare, nil); err != nil {
+		t.Fatalf("Failed to create namespaced room: %v", err)
+	}
+	if _, err := registry.CreateRoom(bare, nil); err != nil {
+		t.Errorf("Expected the same bare ID free in the default pool, got %v", err)
+	}
+	other := "ns-room-abcdefghijabcdefghijabcdefghijabcdef"
+	if _, err := registry.CreateRoom("chat/"+other, nil); err != ErrServerAtCapacity {
+		t.Errorf("Expected the namespace's pool full, got %v", err)
+	}
+	if counts := registry.NamespaceCounts(); counts["chat"] != 1 || counts[""] != 1 {
+		t.Errorf("Expected one room in each pool, got %v", counts)
+	}
+
+	registry.DestroyRoom("chat/"+bare, "test")
+	if _, err := registry.CreateRoom("chat/"+other, nil); err != nil {
+		t.Errorf("Expected room in the namespace once one left, got %v", err)
+	}
+}
+
+// TestRegistryTenantQuota verifies a tenant's rooms are capped at its
+// quota, rooms of no tenant aren't counted against it, and destroying one
+// frees its slot
+func TestRegistryTenantQuota(t *testing.T) {
+	registry := NewRegistry()
+	first := "tenant-room-1234567890123456789012345678901"
+	second := "tenant-room-abcdefghijabcdefghijabcdefghija"
+
+	rm, err := registry.CreateTenantRoom(first, nil, "acme", 1)
+	if err != nil {
+		t.Fatalf("Failed to create tenant room: %v", err)
+	}
+	if rm.Tenant() != "acme" {
+		t.Errorf("Expected the room to belong to acme, got %q", rm.Tenant())
+	}
+	if _, err := registry.CreateTenantRoom(second, nil, "acme", 1); !errors.Is(err, quota.ErrExceeded) {
+		t.Errorf("Expected the quota exceeded, got %v", err)
+	}
+	if _, err := registry.CreateRoom(second, nil); err != nil {
+		t.Errorf("Expected a room of no tenant created, got %v", err)
+	}
+	if rooms := registry.TenantRooms("acme"); len(rooms) != 1 || rooms[0] != first {
+		t.Errorf("Expected acme to hold only %s, got %v", first, rooms)
+	}
+
+	registry.DestroyRoom(first, "test")
+	registry.DestroyRoom(second, "test")
+	if _, err := registry.CreateTenantRoom(second, nil, "acme", 1); err != nil {
+		t.Errorf("Expected a room once the tenant's last left, got %v", err)
+	}
+}
+
+func TestValidID(t *testing.T) {
+	id := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	for in, want := range map[string]bool{
+		id:               true,
+		"chat/" + id:     true,
+		"my-app2/" + id:  true,
+		"Chat/" + id:     false,
+		"/" + id:         false,
+		"chat/" + id[1:]: false,
+		"a/b/" + id:      false,
+		"join":           false,
+	} {
+		if got := ValidID(in); got != want {
+			t.Errorf("ValidID(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
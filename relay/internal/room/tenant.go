@@ -0,0 +1,34 @@
+package room
+
+import (
+	"sort"
+
+	"github.com/ephemeral/relay/internal/quota"
+)
+
+// A room created by a host presenting an API key belongs to that key's
+// tenant, whose quota caps how many rooms it holds at once alongside the
+// namespace's pool. Rooms created without a key belong to no one.
+
+// Tenant returns the API key the room's host created it with, "" if none
+func (room *Room) Tenant() string {
+	return room.tenant
+}
+
+// TenantRooms returns the IDs of tenant's active rooms, sorted
+func (r *Registry) TenantRooms(tenant string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.tenants[tenant]))
+	for id := range r.tenants[tenant] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Quotas returns the engine metering tenants' use, which the registry
+// consults for rooms and the handler for clients and bytes
+func (r *Registry) Quotas() *quota.Engine {
+	return r.quotas
+}
@@ -0,0 +1,61 @@
+package secheaders
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serve(p Policy, r *http.Request) http.Header {
+	rec := httptest.NewRecorder()
+	p.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})).ServeHTTP(rec, r)
+	return rec.Header()
+}
+
+// TestDefaultHeaders verifies the default policy sets every header, HSTS
+// only over TLS
+func TestDefaultHeaders(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/health", nil)
+	h := serve(Default(), r)
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected nosniff, got %q", got)
+	}
+	if got := h.Get("Content-Security-Policy"); got != DefaultCSP {
+		t.Errorf("Expected the default CSP, got %q", got)
+	}
+	if got := h.Get("Referrer-Policy"); got != "no-referrer" {
+		t.Errorf("Expected no-referrer, got %q", got)
+	}
+	if got := h.Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Expected no HSTS over plain HTTP, got %q", got)
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	if got := serve(Default(), r).Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Expected a year's HSTS over TLS, got %q", got)
+	}
+}
+
+// TestPolicyConfigurable verifies fields left empty are left out and the
+// others follow the policy
+func TestPolicyConfigurable(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/invite/x", nil)
+	r.TLS = &tls.ConnectionState{}
+	h := serve(Policy{HSTSMaxAge: time.Hour, HSTSIncludeSubdomains: true, ReferrerPolicy: "same-origin"}, r)
+
+	if got := h.Get("Strict-Transport-Security"); got != "max-age=3600; includeSubDomains" {
+		t.Errorf("Expected an hour's HSTS with subdomains, got %q", got)
+	}
+	if got := h.Get("Referrer-Policy"); got != "same-origin" {
+		t.Errorf("Expected same-origin, got %q", got)
+	}
+	for _, name := range []string{"Content-Security-Policy", "X-Content-Type-Options"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("Expected no %s, got %q", name, got)
+		}
+	}
+}
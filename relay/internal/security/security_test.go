@@ -133,14 +133,14 @@ func TestLogsNoIPAddresses(t *testing.T) {
 }
 
 func TestMetricsNoPII(t *testing.T) {
-	m := &metrics.Metrics{}
+	m := metrics.New()
 
 	// Increment various counters
 	m.IncRoomsCreated()
 	m.IncRoomsDestroyed()
 	m.IncConnections()
 	m.IncMessages()
-	m.IncRateLimited()
+	m.IncRateLimited(metrics.ScopeConnection, metrics.CauseLimiter)
 
 	output := m.String(5)
 
@@ -377,9 +377,9 @@ func TestMaxClientsPerRoomEnforced(t *testing.T) {
 	r, _ := registry.CreateRoom("full-room-test-123456789012345678901", &websocket.Conn{})
 	r.OpenRoom()
 
-	// Fill to capacity
+	// Fill to capacity with approved clients, past the pending cap
 	for i := 0; i < room.MaxClientsPerRoom; i++ {
-		_, err := r.AddClient(fmt.Sprintf("client-%d", i), &websocket.Conn{})
+		_, err := r.AddConfirmedClient(fmt.Sprintf("client-%d", i), &websocket.Conn{}, room.RoleParticipant)
 		if err != nil {
 			t.Fatalf("Failed to add client %d: %v", i, err)
 		}
@@ -509,7 +509,7 @@ func TestConcurrentClientJoin(t *testing.T) {
 		wg.Add(1)
 		go func(n int) {
 			defer wg.Done()
-			_, err := r.AddClient(fmt.Sprintf("client-%d", n), &websocket.Conn{})
+			_, err := r.AddConfirmedClient(fmt.Sprintf("client-%d", n), &websocket.Conn{}, room.RoleParticipant)
 			if err == nil {
 				countMu.Lock()
 				successCount++
@@ -536,13 +536,14 @@ func TestConcurrentClientJoin(t *testing.T) {
 // ============================================================================
 
 func TestHeartbeatUpdates(t *testing.T) {
-	r := &room.Room{
-		ID:            "heartbeat-test",
-		Clients:       make(map[string]*room.Client),
-		LastHeartbeat: time.Now().Add(-time.Hour), // Old heartbeat
-	}
+	clock := &setClock{now: time.Now().Add(-time.Hour)} // Old heartbeat
+	registry := room.NewRegistry()
+	registry.SetClock(clock)
+	r, _ := registry.CreateRoom("heartbeat-test", nil)
+	defer registry.DestroyRoom("heartbeat-test", "test_over")
 
 	oldTime := r.GetLastHeartbeat()
+	clock.set(time.Now())
 	r.UpdateHeartbeat()
 	newTime := r.GetLastHeartbeat()
 
@@ -551,6 +552,24 @@ func TestHeartbeatUpdates(t *testing.T) {
 	}
 }
 
+// setClock is a room clock set by hand
+type setClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *setClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *setClock) set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+}
+
 // ============================================================================
 // TEST-RELAY-010: Input Validation
 // ============================================================================
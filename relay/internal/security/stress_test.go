@@ -753,7 +753,7 @@ func TestStressPredictableFailures(t *testing.T) {
 	r.OpenRoom()
 
 	for i := 0; i < room.MaxClientsPerRoom; i++ {
-		r.AddClient(fmt.Sprintf("client-%d", i), &websocket.Conn{})
+		r.AddConfirmedClient(fmt.Sprintf("client-%d", i), &websocket.Conn{}, room.RoleParticipant)
 	}
 
 	_, err = r.AddClient("overflow-client", &websocket.Conn{})
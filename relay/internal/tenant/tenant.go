@@ -0,0 +1,153 @@
+// Package tenant shares one relay between customers. Every API key hosts
+// present is a tenant of its own: the rooms and invite tokens its hosts
+// hold are bounded by the key's quota, and their rooms' traffic is held to
+// the rate limit profile it names rather than the relay's.
+package tenant
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/ratelimit"
+)
+
+// ErrNegativeQuota is a quota with a limit below zero
+var ErrNegativeQuota = errors.New("quota limits can't be negative")
+
+// Tenant is one API key's share of the relay
+type Tenant struct {
+	ID     string // the key's, which rooms it creates are counted under
+	Name   string
+	Quota  hostauth.Quota
+	Limits *ratelimit.Limiters // from the key's profile, or the relay's
+}
+
+// Tenants resolves host credentials to the keys they belong to. Limiter
+// sets are built once per profile and shared by every key naming it:
+// their budgets are keyed by address, room and client, so no tenant
+// draws on another's.
+type Tenants struct {
+	keys   *hostauth.Keys
+	base   *ratelimit.Limiters
+	shared ratelimit.Backend
+
+	mu     sync.RWMutex
+	seen   map[string]*Tenant             // by key ID, as last presented
+	limits map[string]*ratelimit.Limiters // by profile name
+}
+
+// New returns the tenants of keys. Keys that name no profile use base;
+// per-IP budgets of the others are kept in shared, if not nil.
+func New(keys *hostauth.Keys, base *ratelimit.Limiters, shared ratelimit.Backend) *Tenants {
+	return &Tenants{
+		keys:   keys,
+		base:   base,
+		shared: shared,
+		seen:   make(map[string]*Tenant),
+		limits: make(map[string]*ratelimit.Limiters),
+	}
+}
+
+// Validate checks a quota can be enforced
+func Validate(q hostauth.Quota) error {
+	if q.Rooms < 0 || q.Clients < 0 || q.BytesPerHour < 0 || q.Tokens < 0 {
+		return ErrNegativeQuota
+	}
+	if q.Profile != "" {
+		if _, err := ratelimit.LookupProfile(q.Profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the tenant whose key credential is, nil if it's none of
+// them. A nil *Tenants has no tenants.
+func (t *Tenants) Lookup(credential string) *Tenant {
+	if t == nil {
+		return nil
+	}
+	key, ok := t.keys.Lookup(credential)
+	if !ok {
+		return nil
+	}
+	tn := &Tenant{ID: key.ID, Name: key.Name, Quota: key.Quota, Limits: t.profileLimits(key.Quota.Profile)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen[key.ID] = tn
+	return tn
+}
+
+// Get returns the tenant with key ID id as it was last presented, so its
+// rooms stay bound by its quota after the key is revoked. Nil if no host
+// has presented it.
+func (t *Tenants) Get(id string) *Tenant {
+	if t == nil || id == "" {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.seen[id]
+}
+
+// MaxTokens returns how many invite tokens tenant id's rooms may have
+// outstanding, 0 for no limit
+func (t *Tenants) MaxTokens(id string) int {
+	if tn := t.Get(id); tn != nil {
+		return tn.Quota.Tokens
+	}
+	return 0
+}
+
+// Limits returns the limiters traffic in tenant id's rooms is held to,
+// nil for rooms created without a key, which the relay's own hold
+func (t *Tenants) Limits(id string) *ratelimit.Limiters {
+	if tn := t.Get(id); tn != nil {
+		return tn.Limits
+	}
+	return nil
+}
+
+// RemoveRoom drops per-client state for a room from every profile's set
+func (t *Tenants) RemoveRoom(roomID string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, l := range t.limits {
+		l.RemoveRoom(roomID)
+	}
+}
+
+// Stop ends the cleanup goroutines of every set built for a profile
+func (t *Tenants) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, l := range t.limits {
+		l.Stop()
+		delete(t.limits, name)
+	}
+}
+
+// profileLimits returns the set for the named profile, building it the
+// first time a key names it
+func (t *Tenants) profileLimits(name string) *ratelimit.Limiters {
+	if name == "" || name == t.base.Profile.Name {
+		return t.base
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.limits[name]; ok {
+		return l
+	}
+	p, err := ratelimit.LookupProfile(name)
+	if err != nil {
+		return t.base // refused when the key was added
+	}
+	l := p.NewSharedLimiters(t.shared)
+	t.limits[name] = l
+	return l
+}
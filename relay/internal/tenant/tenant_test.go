@@ -0,0 +1,66 @@
+package tenant
+
+import (
+	"testing"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/ratelimit"
+)
+
+// TestLookup verifies a key's tenant carries its quota and its profile's
+// limiters, shared by keys naming the same profile, and stays known after
+// the key is revoked
+func TestLookup(t *testing.T) {
+	base := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	defer base.Stop()
+	keys := hostauth.NewKeys()
+	keys.AddStatic("acme", "acme-secret", hostauth.Quota{Rooms: 2, Tokens: 10, Profile: "strict"})
+	keys.AddStatic("globex", "globex-secret", hostauth.Quota{Profile: "strict"})
+	secret, plain, _ := keys.Create("initech", hostauth.Quota{})
+	tenants := New(keys, base, nil)
+	defer tenants.Stop()
+
+	acme := tenants.Lookup("acme-secret")
+	if acme == nil || acme.Name != "acme" || acme.Quota.Rooms != 2 {
+		t.Fatalf("Expected acme's tenant with its quota, got %+v", acme)
+	}
+	if acme.Limits.Profile.Name != "strict" {
+		t.Errorf("Expected the strict profile's limiters, got %q", acme.Limits.Profile.Name)
+	}
+	if globex := tenants.Lookup("globex-secret"); globex.Limits != acme.Limits {
+		t.Error("Expected keys naming one profile to share its limiters")
+	}
+	if tn := tenants.Lookup(secret); tn == nil || tn.Limits != base {
+		t.Errorf("Expected a key naming no profile on the relay's limiters, got %+v", tn)
+	}
+	if tn := tenants.Lookup("guess"); tn != nil {
+		t.Errorf("Expected no tenant for an unknown credential, got %+v", tn)
+	}
+
+	if n := tenants.MaxTokens(acme.ID); n != 10 {
+		t.Errorf("Expected acme's token quota of 10, got %d", n)
+	}
+	keys.Revoke(plain.ID)
+	if tenants.Get(plain.ID) == nil {
+		t.Error("Expected a revoked key's tenant still known to its rooms")
+	}
+	if l := tenants.Limits(""); l != nil {
+		t.Error("Expected no limiters for rooms of no tenant")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		quota hostauth.Quota
+		ok    bool
+	}{
+		{hostauth.Quota{}, true},
+		{hostauth.Quota{Rooms: 5, Tokens: 50, Profile: "relaxed"}, true},
+		{hostauth.Quota{Rooms: -1}, false},
+		{hostauth.Quota{Profile: "unlimited"}, false},
+	} {
+		if err := Validate(tt.quota); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok=%v", tt.quota, err, tt.ok)
+		}
+	}
+}
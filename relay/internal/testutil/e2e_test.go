@@ -0,0 +1,515 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/tenant"
+	"github.com/ephemeral/relay/internal/websocket"
+)
+
+// TestHostAdmitsAndBroadcasts verifies the whole happy path over real
+// sockets: create, open, join, approve, then a broadcast, a client message
+// and a direct message each reaching exactly who they should
+func TestHostAdmitsAndBroadcasts(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+
+	alice, bob := s.Join(host.RoomID), s.Join(host.RoomID)
+	if alice.Role != "participant" {
+		t.Errorf("Expected a participant without an invite, got %q", alice.Role)
+	}
+	host.Admit(alice)
+	host.Admit(bob)
+
+	host.Broadcast(`{"n":1}`)
+	for _, c := range []*Client{alice, bob} {
+		if msg := c.Expect("MESSAGE"); string(msg.Payload) != `{"n":1}` || msg.ClientID != "" {
+			t.Errorf("Expected the broadcast with no sender, got %+v", msg)
+		}
+	}
+
+	alice.Say(`{"n":2}`)
+	if msg := host.Expect("CLIENT_MESSAGE"); msg.ClientID != alice.ID || string(msg.Payload) != `{"n":2}` {
+		t.Errorf("Expected alice's message at the host, got %+v", msg)
+	}
+	if msg := bob.Expect("MESSAGE"); msg.ClientID != alice.ID || string(msg.Payload) != `{"n":2}` {
+		t.Errorf("Expected alice's message at bob, got %+v", msg)
+	}
+
+	host.Direct(bob.ID, `{"n":3}`)
+	host.Broadcast(`{"n":4}`)
+	if msg := bob.Expect("MESSAGE"); string(msg.Payload) != `{"n":3}` {
+		t.Errorf("Expected the direct message at bob, got %+v", msg)
+	}
+	if msg := alice.Expect("MESSAGE"); string(msg.Payload) != `{"n":4}` {
+		t.Errorf("Expected alice to skip the direct message, got %+v", msg)
+	}
+}
+
+// TestJoinRefused verifies joining a room that isn't open, or doesn't
+// exist, is answered with an ERROR and the connection closed
+func TestJoinRefused(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+
+	for roomID, reason := range map[string]string{
+		host.RoomID: "room is not open for joins",
+		NewRoomID(): "Room not found",
+	} {
+		p, err := s.Dial("/rooms/" + roomID + "/join")
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		if msg := p.Expect("ERROR"); msg.Reason != reason {
+			t.Errorf("Expected %q, got %q", reason, msg.Reason)
+		}
+		p.ExpectClosed()
+	}
+
+	var dialErr *DialError
+	if _, err := s.Dial("/rooms/short/join"); !errors.As(err, &dialErr) || dialErr.Status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid room ID refused with 400, got %v", err)
+	}
+}
+
+// TestUniformJoinErrors verifies that with uniform errors a missing room
+// and one not open look alike to an outsider, and take as long, while a
+// joiner with a valid invite is still told why
+func TestUniformJoinErrors(t *testing.T) {
+	s := NewServer(t)
+	s.Handler.UniformJoinErrors()
+	host := s.CreateRoom()
+
+	for _, roomID := range []string{host.RoomID, NewRoomID()} {
+		start := time.Now()
+		p, err := s.Dial("/rooms/" + roomID + "/join")
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		if msg := p.Expect("ERROR"); msg.Reason != websocket.ErrRoomUnavailable {
+			t.Errorf("Expected %q, got %q", websocket.ErrRoomUnavailable, msg.Reason)
+		}
+		if elapsed := time.Since(start); elapsed < websocket.UniformErrorDelay {
+			t.Errorf("Expected the refusal held back %v, got it after %v", websocket.UniformErrorDelay, elapsed)
+		}
+		p.ExpectClosed()
+	}
+
+	host.Send(websocket.Message{Type: "CREATE_INVITE"})
+	var created invite.CreateTokenResponse
+	if err := json.Unmarshal(host.Expect("INVITE_CREATED").Payload, &created); err != nil {
+		t.Fatalf("Expected an invite token: %v", err)
+	}
+	p, err := s.Dial("/rooms/" + host.RoomID + "/join?token=" + created.Token)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Reason != "room is not open for joins" {
+		t.Errorf("Expected an invited joiner told the room isn't open, got %q", msg.Reason)
+	}
+}
+
+// TestTenantQuotas verifies a host presenting a key is refused another
+// room past its quota with a 429 before the upgrade, and a joiner past the
+// key's clients is told which quota ran out
+func TestTenantQuotas(t *testing.T) {
+	s := NewServer(t)
+	keys := hostauth.NewKeys()
+	keys.AddStatic("acme", "acme-key", hostauth.Quota{Rooms: 1, Clients: 1})
+	s.Handler.SetTenants(tenant.New(keys, s.Limits, nil))
+
+	roomID := NewRoomID()
+	host, err := s.Dial("/rooms/" + roomID + "?auth=acme-key")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	host.Expect("ROOM_CREATED")
+	host.Send(websocket.Message{Type: "ROOM_OPEN"})
+	host.Send(websocket.Message{Type: "HEARTBEAT"})
+	host.Expect("HEARTBEAT_ACK")
+
+	_, err = s.Dial("/rooms/" + NewRoomID() + "?auth=acme-key")
+	var refused *DialError
+	if !errors.As(err, &refused) || refused.Status != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 past the room quota, got %v", err)
+	}
+	s.CreateRoom() // hosts without a key aren't counted
+
+	s.Join(roomID)
+	p, err := s.Dial("/rooms/" + roomID + "/join")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Quota != "clients" {
+		t.Errorf("Expected the clients quota named, got %+v", msg)
+	}
+	p.ExpectClosed()
+}
+
+// TestNamespacedRooms verifies a room in a namespace is reached by its
+// namespaced path and is a different room from the same ID outside it,
+// and that namespaces the relay doesn't serve are refused
+func TestNamespacedRooms(t *testing.T) {
+	s := NewServer(t)
+	if err := s.Registry.SetNamespace("chat", 10); err != nil {
+		t.Fatalf("Failed to set namespace: %v", err)
+	}
+	bare := NewRoomID()
+	plain := s.CreateRoomWithID(bare)
+	chat := s.CreateRoomWithID("chat/" + bare)
+	chat.Open()
+
+	c := s.Join("chat/" + bare)
+	chat.Admit(c)
+	chat.Broadcast(`"hi"`)
+	c.Expect("MESSAGE")
+
+	// The room outside the namespace was never opened
+	p, err := s.Dial("/rooms/" + plain.RoomID + "/join")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Reason != "room is not open for joins" {
+		t.Errorf("Expected the unnamespaced room to be its own, got %q", msg.Reason)
+	}
+
+	p, err = s.Dial("/rooms/game/" + NewRoomID())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Reason != "unknown namespace" {
+		t.Errorf("Expected an unknown namespace refused, got %q", msg.Reason)
+	}
+}
+
+// TestKickClosesClient verifies a kicked client is told why and hung up
+// on, and the host told it's gone
+func TestKickClosesClient(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	host.Kick(c.ID)
+	if msg := c.Expect("KICKED"); msg.Reason != "kicked_by_host" {
+		t.Errorf("Expected kicked_by_host, got %q", msg.Reason)
+	}
+	c.ExpectClosed()
+	if msg := host.Expect("CLIENT_LEFT"); msg.ClientID != c.ID {
+		t.Errorf("Expected CLIENT_LEFT for %s, got %+v", c.ID, msg)
+	}
+}
+
+// TestHostLeavingDestroysRoom verifies the room ends with its host's
+// connection, telling every client
+func TestHostLeavingDestroysRoom(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	host.Close()
+	if msg := c.Expect("ROOM_DESTROYED"); msg.Reason != "host_disconnected" {
+		t.Errorf("Expected host_disconnected, got %q", msg.Reason)
+	}
+	if reason := c.ExpectClosed(); reason != "host_disconnected" {
+		t.Errorf("Expected a close frame saying host_disconnected, got %q", reason)
+	}
+
+	deadline := time.Now().Add(ReadTimeout)
+	for s.Registry.GetRoom(host.RoomID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the room gone from the registry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRoomCloseDestroysRoom verifies ROOM_CLOSE destroys the room while
+// the host still holds its connection open, and then hangs up on the host
+func TestRoomCloseDestroysRoom(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	host.Send(websocket.Message{Type: "ROOM_CLOSE"})
+	c.Expect("ROOM_DESTROYED")
+	c.ExpectClosed()
+	host.ExpectClosed()
+	if s.Registry.GetRoom(host.RoomID) != nil {
+		t.Error("Expected the room gone from the registry")
+	}
+}
+
+// TestJoinTimeout verifies a joiner the host leaves waiting is told so
+// and hung up on, and the host told it's gone
+func TestJoinTimeout(t *testing.T) {
+	s := NewServer(t)
+	s.Handler.SetJoinTimeout(100 * time.Millisecond)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+
+	c.Expect("JOIN_TIMEOUT")
+	if reason := c.ExpectClosed(); reason != "join_timeout" {
+		t.Errorf("Expected a close frame saying join_timeout, got %q", reason)
+	}
+	if msg := host.Expect("CLIENT_LEFT"); msg.ClientID != c.ID {
+		t.Errorf("Expected CLIENT_LEFT for %s, got %+v", c.ID, msg)
+	}
+
+	// An admitted client stays
+	c = s.Join(host.RoomID)
+	host.Admit(c)
+	time.Sleep(200 * time.Millisecond)
+	host.Broadcast(`"still here"`)
+	c.Expect("MESSAGE")
+}
+
+// TestUnapprovedClientSilenced verifies nothing a client says reaches the
+// room until the host accepts it, nor after the host turns it down or
+// answers without accepting it
+func TestUnapprovedClientSilenced(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+
+	// Admit fails if the message or confirm reaches the host before the
+	// JOIN_REQUEST sent after them
+	c := s.Join(host.RoomID)
+	c.Say(`"too early"`)
+	c.Send(websocket.Message{Type: "JOIN_CONFIRM"})
+	host.Admit(c)
+	c.Say(`"admitted"`)
+	if msg := host.Expect("CLIENT_MESSAGE"); string(msg.Payload) != `"admitted"` {
+		t.Errorf("Expected the admitted client's message, got %+v", msg)
+	}
+
+	denied := false
+	d := s.Join(host.RoomID)
+	host.Send(websocket.Message{Type: "JOIN_RESPONSE", ClientID: d.ID, Approved: &denied, Payload: json.RawMessage(`"no"`)})
+	d.Expect("JOIN_RESPONSE")
+	d.Say(`"turned down"`)
+	d.Send(websocket.Message{Type: "JOIN_REQUEST"})
+	if msg := host.Expect("JOIN_REQUEST"); msg.ClientID != d.ID {
+		t.Errorf("Expected a JOIN_REQUEST from %s, got %+v", d.ID, msg)
+	}
+
+	// An answer that doesn't say approved turns the joiner down too
+	e := s.Join(host.RoomID)
+	host.Send(websocket.Message{Type: "JOIN_RESPONSE", ClientID: e.ID, Payload: json.RawMessage(`{"approved":true}`)})
+	e.Expect("JOIN_RESPONSE")
+	e.Say(`"unanswered"`)
+	e.Send(websocket.Message{Type: "JOIN_REQUEST"})
+	if msg := host.Expect("JOIN_REQUEST"); msg.ClientID != e.ID {
+		t.Errorf("Expected a JOIN_REQUEST from %s, got %+v", e.ID, msg)
+	}
+}
+
+// TestUnapprovedClientUncharged verifies what a client says before the
+// host lets it in is dropped without spending the room's byte budget, so
+// a joiner can't starve the room while it waits
+func TestUnapprovedClientUncharged(t *testing.T) {
+	s := NewServerWithConfig(t, Config{Profile: "strict"})
+	host := s.CreateRoom()
+	host.Open()
+
+	// Three of these would outrun the strict profile's 8MB burst
+	c := s.Join(host.RoomID)
+	chunk := `"` + strings.Repeat("a", 3*1024*1024) + `"`
+	c.Say(chunk)
+	c.Say(chunk)
+	c.Say(chunk)
+	host.Admit(c)
+	c.Say(`"admitted"`)
+	if msg := host.Expect("CLIENT_MESSAGE"); string(msg.Payload) != `"admitted"` {
+		t.Errorf("Expected the admitted client's message, got %+v", msg)
+	}
+}
+
+// TestProfilesRedelivered verifies a member's profile reaches whoever is
+// admitted after it, and theirs reaches it, without anyone resending them
+func TestProfilesRedelivered(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+
+	alice := s.Join(host.RoomID)
+	host.AdmitWithProfile(alice, `"alice-profile"`)
+	bob := s.Join(host.RoomID)
+	host.AdmitWithProfile(bob, `"bob-profile"`)
+
+	if msg := bob.Expect("PROFILE"); msg.ClientID != alice.ID || string(msg.Profile) != `"alice-profile"` {
+		t.Errorf("Expected alice's profile at bob, got %+v", msg)
+	}
+	if msg := alice.Expect("PROFILE"); msg.ClientID != bob.ID || string(msg.Profile) != `"bob-profile"` {
+		t.Errorf("Expected bob's profile at alice, got %+v", msg)
+	}
+
+	// One who leaves is forgotten, and one with no profile shares nothing
+	alice.Close()
+	host.Expect("CLIENT_LEFT")
+	carol := s.Join(host.RoomID)
+	host.Admit(carol)
+	if msg := carol.Expect("PROFILE"); msg.ClientID != bob.ID {
+		t.Errorf("Expected only bob's profile at carol, got %+v", msg)
+	}
+	host.Broadcast(`"after"`)
+	carol.Expect("MESSAGE")
+	bob.Expect("MESSAGE")
+}
+
+// TestClientErrorForwarded verifies a client's CLIENT_ERROR reaches the
+// host with its category folded to one the relay knows, and without a
+// diagnostic blob over MaxClientErrorSize
+func TestClientErrorForwarded(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+
+	c.Send(websocket.Message{Type: "CLIENT_ERROR", Category: "made-up", Payload: json.RawMessage(`{"detail":"x"}`)})
+	msg := host.Expect("CLIENT_ERROR")
+	if msg.ClientID != c.ID || msg.Category != "other" || string(msg.Payload) != `{"detail":"x"}` {
+		t.Errorf("Expected the error forwarded as other, got %+v", msg)
+	}
+
+	big := `"` + strings.Repeat("a", websocket.MaxClientErrorSize) + `"`
+	c.Send(websocket.Message{Type: "CLIENT_ERROR", Category: "decode", Payload: json.RawMessage(big)})
+	c.Send(websocket.Message{Type: "CLIENT_ERROR", Category: "state", Payload: json.RawMessage(`"small"`)})
+	if msg := host.Expect("CLIENT_ERROR"); msg.Category != "state" {
+		t.Errorf("Expected the oversize blob dropped, got %+v", msg)
+	}
+}
+
+// TestRoomCloseCountdown verifies a host closing its room with a grace
+// period has its clients warned, joins refused, and the room destroyed
+// once it runs out
+func TestRoomCloseCountdown(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	host.Send(websocket.Message{Type: "ROOM_CLOSE", GraceMs: 200})
+	if msg := c.Expect("ROOM_CLOSING"); msg.GraceMs != 200 {
+		t.Errorf("Expected a 200ms countdown, got %dms", msg.GraceMs)
+	}
+
+	p, err := s.Dial("/rooms/" + host.RoomID + "/join")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Reason != "room is closing" {
+		t.Errorf("Expected the join refused, got %q", msg.Reason)
+	}
+
+	if msg := c.Expect("ROOM_DESTROYED"); msg.Reason != "host_closed" {
+		t.Errorf("Expected host_closed, got %q", msg.Reason)
+	}
+	c.ExpectClosed()
+}
+
+// TestShutdownHangsUp verifies shutting the handler down hangs up on the
+// host and its clients, destroys the room, and turns new peers away
+func TestShutdownHangsUp(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReadTimeout)
+	defer cancel()
+	if err := s.Handler.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected every connection finished, got %v", err)
+	}
+	host.ExpectClosed()
+	c.ExpectClosed()
+	if s.Registry.GetRoom(host.RoomID) != nil {
+		t.Error("Expected the room destroyed")
+	}
+
+	p, err := s.Dial("/rooms/" + NewRoomID())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if msg := p.Expect("ERROR"); msg.Reason != "Server shutting down" {
+		t.Errorf("Expected a shutdown refusal, got %q", msg.Reason)
+	}
+}
+
+// TestInviteGrantsRole verifies an invite minted over the host's socket
+// makes its joiner an observer, whose messages go nowhere, and is spent
+// by that join
+func TestInviteGrantsRole(t *testing.T) {
+	s := NewServer(t)
+	host := s.CreateRoom()
+	host.Open()
+
+	host.Send(websocket.Message{Type: "CREATE_INVITE", Payload: json.RawMessage(`{"scope":"observer"}`)})
+	var created invite.CreateTokenResponse
+	if err := json.Unmarshal(host.Expect("INVITE_CREATED").Payload, &created); err != nil || created.Token == "" {
+		t.Fatalf("Expected an invite token, got %+v (%v)", created, err)
+	}
+
+	observer := s.JoinWithOptions(host.RoomID, JoinOptions{Token: created.Token})
+	if observer.Role != "observer" {
+		t.Errorf("Expected the invite's observer role, got %q", observer.Role)
+	}
+	host.Admit(observer)
+
+	// The reader handles one connection's frames in order, so the host
+	// sees the second JOIN_REQUEST with nothing before it
+	observer.Say(`"ignored"`)
+	observer.Send(websocket.Message{Type: "JOIN_REQUEST"})
+	if msg := host.Next(); msg.Type != "JOIN_REQUEST" {
+		t.Errorf("Expected an observer's message dropped, got %+v", msg)
+	}
+
+	if again := s.JoinWithOptions(host.RoomID, JoinOptions{Token: created.Token}); again.Role != "participant" {
+		t.Errorf("Expected a spent invite to grant nothing, got %q", again.Role)
+	}
+}
+
+// TestHostByteBudget verifies the host's broadcasts and direct messages
+// are charged to the room's byte budget, and once it's spent are dropped
+// with a RATE_LIMITED notice rather than reaching the clients
+func TestHostByteBudget(t *testing.T) {
+	s := NewServerWithConfig(t, Config{Profile: "strict"})
+	host := s.CreateRoom()
+	host.Open()
+	c := s.Join(host.RoomID)
+	host.Admit(c)
+
+	// Three of these outrun the strict profile's 8MB burst
+	chunk := `"` + strings.Repeat("a", 3*1024*1024) + `"`
+	host.Broadcast(chunk)
+	host.Broadcast(chunk)
+	host.Broadcast(chunk)
+	if msg := host.Expect("RATE_LIMITED"); msg.Reason != websocket.LimitBytes {
+		t.Errorf("Expected the byte budget named, got %+v", msg)
+	}
+	host.Direct(c.ID, chunk)
+	host.Broadcast(`"after"`)
+
+	c.Expect("MESSAGE")
+	c.Expect("MESSAGE")
+	if msg := c.Expect("MESSAGE"); string(msg.Payload) != `"after"` {
+		t.Errorf("Expected the frames over budget dropped, got a %d byte payload", len(msg.Payload))
+	}
+}
@@ -0,0 +1,336 @@
+package testutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/websocket"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// ReadTimeout bounds how long a peer waits for the relay's next message
+var ReadTimeout = 5 * time.Second
+
+// HeartbeatInterval is how often a Host heartbeats, well inside the
+// relay's HeartbeatTimeout
+const HeartbeatInterval = 2 * time.Second
+
+// DialError is an upgrade the relay refused
+type DialError struct {
+	Status  int
+	Message string
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("upgrade refused: %d %s", e.Status, e.Message)
+}
+
+// Peer is one WebSocket connection to the relay
+type Peer struct {
+	t  testing.TB
+	ws *gorilla.Conn
+
+	mu   sync.Mutex   // serializes writes; a Host heartbeats concurrently
+	acks atomic.Int64 // HEARTBEAT_ACKs owed for the Host's own heartbeats
+}
+
+// Dial connects to path, e.g. "/rooms/{id}/join?token=...". A refused
+// upgrade is a *DialError. The connection is closed when the test ends.
+func (s *Server) Dial(path string) (*Peer, error) {
+	ws, resp, err := gorilla.DefaultDialer.Dial(s.URL+path, nil)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, &DialError{Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		}
+		return nil, err
+	}
+	p := &Peer{t: s.t, ws: ws}
+	s.t.Cleanup(func() { ws.Close() })
+	return p, nil
+}
+
+// Send writes msg, failing the test if it can't
+func (p *Peer) Send(msg websocket.Message) {
+	p.t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		p.t.Fatalf("Failed to encode %s: %v", msg.Type, err)
+	}
+	p.SendRaw(data)
+}
+
+// SendRaw writes data as one text message, well-formed or not
+func (p *Peer) SendRaw(data []byte) {
+	p.t.Helper()
+	if err := p.write(data); err != nil {
+		p.t.Fatalf("Failed to send %s: %v", data, err)
+	}
+}
+
+func (p *Peer) write(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ws.SetWriteDeadline(time.Now().Add(ReadTimeout))
+	return p.ws.WriteMessage(gorilla.TextMessage, data)
+}
+
+// Read returns the relay's next message, skipping the acks for a Host's
+// own heartbeats
+func (p *Peer) Read() (websocket.Message, []byte, error) {
+	for {
+		p.ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+		_, data, err := p.ws.ReadMessage()
+		if err != nil {
+			return websocket.Message{}, nil, err
+		}
+		var msg websocket.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return websocket.Message{}, data, fmt.Errorf("undecodable message %s: %w", data, err)
+		}
+		if msg.Type == "HEARTBEAT_ACK" && p.acks.Load() > 0 {
+			p.acks.Add(-1)
+			continue
+		}
+		return msg, data, nil
+	}
+}
+
+// Next returns the relay's next message, failing the test if none comes
+func (p *Peer) Next() websocket.Message {
+	p.t.Helper()
+	msg, _, err := p.Read()
+	if err != nil {
+		p.t.Fatalf("Expected a message, got %v", err)
+	}
+	return msg
+}
+
+// Expect returns the relay's next message, failing the test unless it's
+// of type typ
+func (p *Peer) Expect(typ string) websocket.Message {
+	p.t.Helper()
+	msg, data, err := p.Read()
+	if err != nil {
+		p.t.Fatalf("Expected %s, got %v", typ, err)
+	}
+	if msg.Type != typ {
+		p.t.Fatalf("Expected %s, got %s", typ, data)
+	}
+	return msg
+}
+
+// ExpectClosed fails the test unless the relay closes the connection
+// within ReadTimeout, whatever it sends first. It returns the reason the
+// relay's close frame gave, "" if it sent none.
+func (p *Peer) ExpectClosed() string {
+	p.t.Helper()
+	deadline := time.Now().Add(ReadTimeout)
+	p.ws.SetReadDeadline(deadline)
+	for {
+		_, _, err := p.ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			p.t.Fatalf("Expected the relay to close the connection within %v", ReadTimeout)
+		}
+		var closeErr *gorilla.CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.Text
+		}
+		return ""
+	}
+}
+
+// Close hangs up
+func (p *Peer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ws.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	p.ws.Close()
+}
+
+// Host is a room's host connection, heartbeating until it's closed
+type Host struct {
+	*Peer
+	RoomID string
+	Secret string // for the invite API
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// CreateRoom dials a new room as its host, failing the test unless the
+// relay answers ROOM_CREATED
+func (s *Server) CreateRoom() *Host {
+	s.t.Helper()
+	return s.CreateRoomWithID(NewRoomID())
+}
+
+// CreateRoomWithID is CreateRoom for a chosen room ID
+func (s *Server) CreateRoomWithID(roomID string) *Host {
+	s.t.Helper()
+	p, err := s.Dial("/rooms/" + roomID)
+	if err != nil {
+		s.t.Fatalf("Failed to dial room: %v", err)
+	}
+	created := p.Expect("ROOM_CREATED")
+	if created.RoomID != roomID || created.Secret == "" {
+		s.t.Fatalf("Expected ROOM_CREATED for %s with a host secret, got %+v", roomID, created)
+	}
+
+	h := &Host{Peer: p, RoomID: roomID, Secret: created.Secret, stop: make(chan struct{})}
+	go h.heartbeat()
+	s.t.Cleanup(h.Close)
+	return h
+}
+
+func (h *Host) heartbeat() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.acks.Add(1)
+			if h.write([]byte(`{"type":"HEARTBEAT"}`)) != nil {
+				return
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// Sync returns once the relay has handled everything the host has sent,
+// by waiting for the ack to a heartbeat sent after it. It fails the test
+// if something other than an ack arrives first.
+func (h *Host) Sync() {
+	h.t.Helper()
+	h.Send(websocket.Message{Type: "HEARTBEAT"})
+	h.Expect("HEARTBEAT_ACK")
+}
+
+// Open opens the room for joins. ROOM_OPEN has no reply, so it syncs.
+func (h *Host) Open() {
+	h.t.Helper()
+	h.Send(websocket.Message{Type: "ROOM_OPEN"})
+	h.Sync()
+}
+
+// Broadcast sends payload, raw JSON, to every confirmed client
+func (h *Host) Broadcast(payload string) {
+	h.t.Helper()
+	h.Send(websocket.Message{Type: "BROADCAST", Payload: json.RawMessage(payload)})
+}
+
+// Direct sends payload, raw JSON, to one client
+func (h *Host) Direct(clientID, payload string) {
+	h.t.Helper()
+	h.Send(websocket.Message{Type: "DIRECT", ClientID: clientID, Payload: json.RawMessage(payload)})
+}
+
+// Kick removes a client from the room
+func (h *Host) Kick(clientID string) {
+	h.t.Helper()
+	h.Send(websocket.Message{Type: "KICK", ClientID: clientID})
+}
+
+// Admit runs the approval handshake for c: its JOIN_REQUEST reaches the
+// host, the host's JOIN_RESPONSE reaches it, and its JOIN_CONFIRM comes
+// back. c is confirmed, and receives broadcasts, once Admit returns.
+func (h *Host) Admit(c *Client) {
+	h.t.Helper()
+	h.AdmitWithProfile(c, "")
+}
+
+// AdmitWithProfile is Admit with c joining with profile, raw JSON, or
+// none if it's empty
+func (h *Host) AdmitWithProfile(c *Client, profile string) {
+	h.t.Helper()
+	req := websocket.Message{Type: "JOIN_REQUEST", Payload: json.RawMessage(`{"name":"test"}`)}
+	if profile != "" {
+		req.Profile = json.RawMessage(profile)
+	}
+	c.Send(req)
+	if req := h.Expect("JOIN_REQUEST"); req.ClientID != c.ID || string(req.Profile) != profile {
+		h.t.Fatalf("Expected a JOIN_REQUEST from %s with profile %q, got %+v", c.ID, profile, req)
+	}
+	approved := true
+	h.Send(websocket.Message{Type: "JOIN_RESPONSE", ClientID: c.ID, Approved: &approved, Payload: json.RawMessage(`{"approved":true}`)})
+	c.Expect("JOIN_RESPONSE")
+	c.Send(websocket.Message{Type: "JOIN_CONFIRM"})
+	if confirm := h.Expect("JOIN_CONFIRM"); confirm.ClientID != c.ID {
+		h.t.Fatalf("Expected a JOIN_CONFIRM from %s, got one from %s", c.ID, confirm.ClientID)
+	}
+}
+
+// Close stops heartbeating and hangs up, which destroys the room
+func (h *Host) Close() {
+	h.once.Do(func() {
+		close(h.stop)
+		h.Peer.Close()
+	})
+}
+
+// JoinOptions are what a joiner may present besides the room ID
+type JoinOptions struct {
+	Token       string // invite token
+	Fingerprint string // the joiner's key fingerprint, for a bound token
+}
+
+// Client is a joiner's connection
+type Client struct {
+	*Peer
+	ID     string
+	Role   string
+	Secret string // for the report API
+}
+
+// Join dials a room as a joiner, failing the test unless the relay
+// answers CONNECTED. The host must still approve it.
+func (s *Server) Join(roomID string) *Client {
+	s.t.Helper()
+	return s.JoinWithOptions(roomID, JoinOptions{})
+}
+
+// JoinWithOptions is Join presenting an invite token
+func (s *Server) JoinWithOptions(roomID string, opts JoinOptions) *Client {
+	s.t.Helper()
+	q := url.Values{}
+	if opts.Token != "" {
+		q.Set("token", opts.Token)
+	}
+	if opts.Fingerprint != "" {
+		q.Set("fingerprint", opts.Fingerprint)
+	}
+	path := "/rooms/" + roomID + "/join"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	p, err := s.Dial(path)
+	if err != nil {
+		s.t.Fatalf("Failed to dial room: %v", err)
+	}
+	connected := p.Expect("CONNECTED")
+	if connected.ClientID == "" || connected.ClientSecret == "" {
+		s.t.Fatalf("Expected CONNECTED to carry a client ID and secret, got %+v", connected)
+	}
+	return &Client{Peer: p, ID: connected.ClientID, Role: connected.Role, Secret: connected.ClientSecret}
+}
+
+// Say sends payload, raw JSON, to the host and the other confirmed clients
+func (c *Client) Say(payload string) {
+	c.t.Helper()
+	c.Send(websocket.Message{Type: "MESSAGE", Payload: json.RawMessage(payload)})
+}
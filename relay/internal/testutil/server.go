@@ -0,0 +1,134 @@
+// Package testutil runs the relay end to end for tests: the real room,
+// invite and WebSocket handlers behind an httptest server, wired as
+// cmd/relay wires them, and real WebSocket peers to drive them with.
+//
+// A test creates a room, opens it, joins and approves clients and passes
+// messages between them over actual sockets, so the handlers' read and
+// write loops run exactly as they do in production:
+//
+//	s := testutil.NewServer(t)
+//	host := s.CreateRoom()
+//	host.Open()
+//	c := s.Join(host.RoomID)
+//	host.Admit(c)
+//	host.Broadcast(`"hello"`)
+//	c.Expect("MESSAGE")
+//
+// Every helper fails the test rather than returning an error, and
+// everything is torn down when the test ends.
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/websocket"
+)
+
+// Config adjusts the server NewServerWithConfig starts
+type Config struct {
+	// Profile names the rate limit profile; empty means the default
+	Profile string
+
+	// Limited subjects the test's peers to the per-IP limits. They all
+	// share the loopback address, so by default it's allowlisted, as an
+	// operator would allowlist a load balancer.
+	Limited bool
+}
+
+// Server is a relay listening on a loopback port
+type Server struct {
+	// URL is the ws:// base URL peers dial
+	URL string
+
+	HTTP     *httptest.Server
+	Registry *room.Registry
+	Limits   *ratelimit.Limiters
+	Access   *ratelimit.AccessList
+	Tokens   *invite.TokenStore
+	Invites  *invite.Handler
+	Handler  *websocket.Handler
+
+	t testing.TB
+}
+
+// NewServer starts a relay with the default limits, stopped when the test
+// ends
+func NewServer(t testing.TB) *Server {
+	return NewServerWithConfig(t, Config{})
+}
+
+// NewServerWithConfig starts a relay configured by cfg, stopped when the
+// test ends
+func NewServerWithConfig(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	name := cfg.Profile
+	if name == "" {
+		name = ratelimit.DefaultProfile
+	}
+	profile, ok := ratelimit.Profiles[name]
+	if !ok {
+		t.Fatalf("Unknown rate limit profile %q", name)
+	}
+
+	registry := room.NewRegistry()
+	limits := profile.NewLimiters()
+	t.Cleanup(limits.Stop)
+	access := ratelimit.NewAccessList()
+	if !cfg.Limited {
+		access.Add(ratelimit.ListAllow, netip.MustParsePrefix("127.0.0.0/8"))
+		access.Add(ratelimit.ListAllow, netip.MustParsePrefix("::1/128"))
+	}
+	ips := clientip.NewResolver(nil)
+	tokens := invite.NewTokenStore()
+	t.Cleanup(tokens.Stop)
+
+	inviteHandler := invite.NewHandler(tokens, registry, limits, ips, access)
+	handler := websocket.NewHandler(registry, limits, inviteHandler, ips, ratelimit.NewConnCeiling(0), access, nil)
+
+	// As in cmd/relay: per-room state elsewhere is released on destroy
+	registry.OnRoomDestroyed(func(roomID, reason string) {
+		limits.RemoveRoom(roomID)
+		inviteHandler.RevokeRoomTokens(roomID)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/rooms/", handler)
+	mux.Handle("/invite/", inviteHandler)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return &Server{
+		URL:      "ws" + strings.TrimPrefix(srv.URL, "http"),
+		HTTP:     srv,
+		Registry: registry,
+		Limits:   limits,
+		Access:   access,
+		Tokens:   tokens,
+		Invites:  inviteHandler,
+		Handler:  handler,
+		t:        t,
+	}
+}
+
+// NewRoomID returns a random room ID of the form the relay accepts
+func NewRoomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,83 @@
+// Package tracing provides OpenTelemetry spans for the relay's connection
+// paths. Room and client IDs never appear in spans, only short hashes of
+// them, and no addresses or payloads are recorded.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the relay in exported traces
+const ServiceName = "ephemeral-relay"
+
+// hashLength is how many hex characters of an ID's hash go into a span:
+// enough to follow one room through a trace, too few to recover the ID
+const hashLength = 12
+
+// Span attribute keys
+const (
+	AttrRoom    = attribute.Key("relay.room")
+	AttrClient  = attribute.Key("relay.client")
+	AttrRole    = attribute.Key("relay.role")
+	AttrBytes   = attribute.Key("relay.bytes")
+	AttrOutcome = attribute.Key("relay.outcome")
+)
+
+var tracer = otel.Tracer("github.com/ephemeral/relay")
+
+// Setup exports spans over OTLP/HTTP to endpoint (e.g.
+// http://collector:4318), keeping the given fraction of new traces.
+// Until Setup is called spans are no-ops. The returned function flushes
+// and stops the exporter.
+func Setup(ctx context.Context, endpoint string, sample float64) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sample))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start begins a span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Room returns the span attribute for a room, hashed
+func Room(roomID string) attribute.KeyValue {
+	return AttrRoom.String(Hash(roomID))
+}
+
+// Client returns the span attribute for a client, hashed
+func Client(clientID string) attribute.KeyValue {
+	return AttrClient.String(Hash(clientID))
+}
+
+// Hash returns a short one-way digest of an identifier
+func Hash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// Fail marks a span as ended by a refusal or error, with a fixed outcome
+// label such as "rate_limited"
+func Fail(span trace.Span, outcome string) {
+	span.SetAttributes(AttrOutcome.String(outcome))
+	span.SetStatus(codes.Error, outcome)
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestSpansCarryHashedIDs verifies room and client IDs only reach spans hashed
+func TestSpansCarryHashedIDs(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	roomID := "room-abcdefghijklmnopqrstuvwxyz0123456789"
+	clientID := "0123456789abcdef0123456789abcdef"
+	_, span := Start(context.Background(), "relay.join", Room(roomID), Client(clientID))
+	Fail(span, "room_not_found")
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	for _, kv := range spans[0].Attributes() {
+		v := kv.Value.Emit()
+		if strings.Contains(v, roomID[:8]) || strings.Contains(v, clientID[:8]) {
+			t.Errorf("Attribute %s leaks an ID prefix: %q", kv.Key, v)
+		}
+		if (kv.Key == AttrRoom || kv.Key == AttrClient) && len(v) != hashLength {
+			t.Errorf("Expected %d-char hash for %s, got %q", hashLength, kv.Key, v)
+		}
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("Expected error status on a failed span, got %v", spans[0].Status().Code)
+	}
+	if Hash(roomID) != Hash(roomID) || Hash(roomID) == Hash(clientID) {
+		t.Error("Hash should be stable per ID and differ between IDs")
+	}
+}
@@ -0,0 +1,113 @@
+package turn
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Handler serves POST /turn/{roomId}, which mints credentials for the
+// room's host. Only the host's secret is accepted, as on the invite API;
+// the host passes the credentials on to its peers over the room.
+type Handler struct {
+	issuer   *Issuer
+	registry *room.Registry
+	limits   *ratelimit.Limiters
+	ips      *clientip.Resolver
+	access   *ratelimit.AccessList
+	pow      *ratelimit.PoW // nil unless SetProofOfWork
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates a TURN credential handler
+func NewHandler(issuer *Issuer, registry *room.Registry, limits *ratelimit.Limiters, ips *clientip.Resolver, access *ratelimit.AccessList) *Handler {
+	return &Handler{
+		issuer:   issuer,
+		registry: registry,
+		limits:   limits,
+		ips:      ips,
+		access:   access,
+	}
+}
+
+// SetProofOfWork makes requests with no address of their own, from the
+// onion service, each pay in work in place of the per-IP budget
+func (h *Handler) SetProofOfWork(pow *ratelimit.PoW) {
+	h.pow = pow
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Operator access lists come before the rate limiter
+	clientIP := h.ips.ClientIP(r)
+	verdict := h.access.Check(clientIP)
+	if verdict == ratelimit.VerdictDeny {
+		metrics.Global.IncRateLimited(metrics.ScopeTURN, metrics.CauseDenylist)
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if clientIP == "" {
+		if err := h.pow.Verify(ratelimit.PoWSolution(r)); err != nil {
+			metrics.Global.IncRateLimited(metrics.ScopeTURN, metrics.CauseNoProof)
+			writeError(w, http.StatusForbidden, "proof of work required")
+			return
+		}
+	}
+
+	exempt := verdict == ratelimit.VerdictAllow || clientIP == ""
+	if wait := h.limits.Jail.Check(clientIP); wait > 0 && !exempt {
+		metrics.Global.IncRateLimited(metrics.ScopeTURN, metrics.CauseJail)
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		writeError(w, http.StatusTooManyRequests, "temporarily banned")
+		return
+	}
+
+	// Minting draws on the invite budget, as creating invites does
+	if !exempt {
+		res := h.limits.Invite.Take(clientIP)
+		res.SetHeaders(w.Header())
+		if !res.Allowed {
+			metrics.Global.IncRateLimited(metrics.ScopeTURN, metrics.CauseLimiter)
+			if d := h.limits.Jail.Strike(clientIP); d > 0 {
+				metrics.Global.IncBans()
+				log.Printf("Client jailed for %v after repeated rate limiting", d)
+			}
+			writeError(w, http.StatusTooManyRequests, "rate limited")
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	roomID := strings.TrimPrefix(r.URL.Path, "/turn/")
+	if !room.ValidID(roomID) {
+		writeError(w, http.StatusBadRequest, "invalid room ID format")
+		return
+	}
+	rm := h.registry.GetRoom(roomID)
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if rm == nil || !ok || !rm.CheckHostSecret(secret) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(h.issuer.Issue(roomID))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
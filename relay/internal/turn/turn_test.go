@@ -0,0 +1,106 @@
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/gorilla/websocket"
+)
+
+const testSecret = "coturn-static-auth-secret"
+const testRoomID = "turn-handler-room-abcdefghijklmnopqrstuvwxy"
+
+// TestIssueMatchesRESTAPI verifies credentials are what coturn's
+// use-auth-secret computes: base64 HMAC-SHA1 of an expiry-prefixed username
+func TestIssueMatchesRESTAPI(t *testing.T) {
+	issuer, err := NewIssuer([]byte(testSecret), 30*time.Minute, []string{"turn:turn.example.org:3478"})
+	if err != nil {
+		t.Fatalf("NewIssuer failed: %v", err)
+	}
+	creds := issuer.Issue(testRoomID)
+
+	expiry, tag, ok := strings.Cut(creds.Username, ":")
+	if !ok {
+		t.Fatalf("Expected expiry:tag username, got %q", creds.Username)
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || exp < time.Now().Add(29*time.Minute).Unix() || exp > time.Now().Add(31*time.Minute).Unix() {
+		t.Errorf("Expected expiry 30m out, got %q", expiry)
+	}
+	if tag != issuer.RoomTag(testRoomID) || strings.Contains(creds.Username, testRoomID) {
+		t.Errorf("Expected username to carry the room tag only, got %q", creds.Username)
+	}
+	if tag == issuer.RoomTag("another-room") {
+		t.Error("Expected rooms to get different tags")
+	}
+
+	mac := hmac.New(sha1.New, []byte(testSecret))
+	mac.Write([]byte(creds.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); creds.Password != want {
+		t.Errorf("Expected password %s, got %s", want, creds.Password)
+	}
+	if creds.TTL != 1800 {
+		t.Errorf("Expected TTL 1800, got %d", creds.TTL)
+	}
+
+	if _, err := NewIssuer([]byte("short"), 0, creds.URIs); err != ErrSecretTooShort {
+		t.Errorf("Expected ErrSecretTooShort, got %v", err)
+	}
+	if _, err := NewIssuer([]byte(testSecret), 0, nil); err != ErrNoURIs {
+		t.Errorf("Expected ErrNoURIs, got %v", err)
+	}
+}
+
+// TestHandlerRequiresHostSecret verifies only the room's host can mint credentials
+func TestHandlerRequiresHostSecret(t *testing.T) {
+	issuer, _ := NewIssuer([]byte(testSecret), 0, []string{"turn:turn.example.org:3478"})
+	registry := room.NewRegistry()
+	rm, err := registry.CreateRoom(testRoomID, &websocket.Conn{})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	limits := ratelimit.Profile{InviteRate: 1000, InviteBurst: 1000, ProbeRate: 1000, ProbeBurst: 1000}.NewLimiters()
+	t.Cleanup(limits.Stop)
+	h := NewHandler(issuer, registry, limits, nil, nil)
+
+	mint := func(method, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/turn/"+testRoomID, nil)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		if rec := mint(http.MethodPost, secret); rec.Code != http.StatusForbidden {
+			t.Errorf("Secret %q: expected 403, got %d", secret, rec.Code)
+		}
+	}
+	if rec := mint(http.MethodGet, rm.HostSecret()); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+
+	rec := mint(http.MethodPost, rm.HostSecret())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with host secret, got %d", rec.Code)
+	}
+	var creds Credentials
+	if err := json.NewDecoder(rec.Body).Decode(&creds); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !strings.HasSuffix(creds.Username, ":"+issuer.RoomTag(testRoomID)) || creds.Password == "" || len(creds.URIs) != 1 {
+		t.Errorf("Expected credentials for the room, got %+v", creds)
+	}
+}
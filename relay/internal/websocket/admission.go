@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/quota"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/tenant"
+)
+
+// refusal is admission turning a new connection away
+type refusal struct {
+	outcome    string // for the upgrade failure metric
+	status     int
+	message    string
+	retryAfter string // seconds, if trying again later may help
+}
+
+// hostProof is what a connection offers to show it may host: its TLS
+// state, nil without TLS, and the credential it presented, if any
+type hostProof struct {
+	tls        *tls.ConnectionState
+	credential string
+}
+
+// admit runs a new connection from clientIP past the access lists, rate
+// limits and connection ceilings, whatever transport it came in on. The
+// limiter's rate headers are set on hdr. A host must also pass whatever
+// checks the relay makes of proof. Once admitted, the connection holds
+// its slots until release is called.
+//
+// An empty clientIP is an onion service peer that has already proven its
+// work; only the server-wide ceiling applies to it. The Matrix bridge
+// passes a user's Matrix ID instead, which the limits key on as they would
+// an address.
+func (h *Handler) admit(clientIP string, isJoin bool, proof hostProof, hdr http.Header) (release func(), refused *refusal) {
+	// Private deployments restrict who may host
+	if h.hostCerts && !isJoin && (proof.tls == nil || len(proof.tls.VerifiedChains) == 0) {
+		return nil, &refusal{outcome: metrics.UpgradeNoCert, status: http.StatusForbidden, message: "Client certificate required"}
+	}
+	if h.hostAuth != nil && !isJoin {
+		if err := h.hostAuth.AuthorizeHost(proof.credential); err != nil {
+			return nil, &refusal{outcome: metrics.UpgradeNoCredential, status: http.StatusUnauthorized, message: "Host credential required"}
+		}
+	}
+
+	// Hosts presenting a tenant's key are held to its quota and profile. One
+	// out of rooms is refused before anything is spent on it.
+	var tn *tenant.Tenant
+	if !isJoin {
+		tn = h.tenants.Lookup(proof.credential)
+	}
+	if tn != nil && !h.registry.Quotas().Available(tn.ID, quota.Rooms, int64(tn.Quota.Rooms)) {
+		metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseQuota)
+		metrics.Global.IncTenantRateLimited(tn.Name)
+		return nil, &refusal{outcome: metrics.UpgradeQuota, status: http.StatusTooManyRequests, message: "Room quota exceeded"}
+	}
+
+	// Operator access lists come before any limiter
+	verdict := h.access.Check(clientIP)
+	if verdict == ratelimit.VerdictDeny {
+		metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseDenylist)
+		return nil, &refusal{outcome: metrics.UpgradeDenied, status: http.StatusForbidden, message: "Forbidden"}
+	}
+	exempt := verdict == ratelimit.VerdictAllow || clientIP == ""
+
+	// Repeat offenders sit out their ban without costing a limiter lookup
+	if wait := h.limits.Jail.Check(clientIP); wait > 0 && !exempt {
+		metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseJail)
+		return nil, &refusal{outcome: metrics.UpgradeBanned, status: http.StatusTooManyRequests, message: "Temporarily banned", retryAfter: ratelimit.RetryAfter(wait)}
+	}
+
+	// Rate limiting by IP: hosts and joiners draw on separate budgets, and
+	// hosts presenting a tenant's key on its profile's
+	if !exempt {
+		budget, name := h.limits.Conn, ""
+		if isJoin {
+			budget = h.limits.Join
+		} else if tn != nil {
+			budget, name = tn.Limits.Conn, tn.Name
+		}
+		res := budget.Take(clientIP)
+		res.SetHeaders(hdr)
+		if !res.Allowed {
+			h.strike(clientIP)
+			metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseLimiter)
+			metrics.Global.IncTenantRateLimited(name)
+			return nil, &refusal{outcome: metrics.UpgradeRateLimited, status: http.StatusTooManyRequests, message: "Rate limited"}
+		}
+	}
+
+	// Shed load at the server-wide ceiling before spending anything per IP
+	if !h.ceiling.Acquire() {
+		metrics.Global.IncConnectionsShed()
+		return nil, &refusal{outcome: metrics.UpgradeShed, status: http.StatusServiceUnavailable, message: "Server at capacity", retryAfter: strconv.Itoa(ShedRetryAfter)}
+	}
+
+	// Cap sockets held open per IP
+	if exempt {
+		return h.ceiling.Release, nil
+	}
+	if !h.limits.Open.Acquire(clientIP) {
+		h.ceiling.Release()
+		h.strike(clientIP)
+		metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseLimiter)
+		return nil, &refusal{outcome: metrics.UpgradeTooManyConns, status: http.StatusTooManyRequests, message: "Too many connections"}
+	}
+	return func() {
+		h.limits.Open.Release(clientIP)
+		h.ceiling.Release()
+	}, nil
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/ratelimit"
+)
+
+// TestHostCertificateRequired verifies that once hosts need certificates,
+// only a host whose certificate the TLS layer verified is admitted, and
+// joiners are admitted with none
+func TestHostCertificateRequired(t *testing.T) {
+	limits := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	defer limits.Stop()
+	h := &Handler{limits: limits, access: ratelimit.NewAccessList(), ceiling: ratelimit.NewConnCeiling(0)}
+	h.RequireHostCertificates()
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	tests := []struct {
+		name  string
+		join  bool
+		state *tls.ConnectionState
+		ok    bool
+	}{
+		{"host without TLS", false, nil, false},
+		{"host without a certificate", false, &tls.ConnectionState{}, false},
+		{"host with a verified certificate", false, verified, true},
+		{"joiner without TLS", true, nil, true},
+	}
+	for _, tt := range tests {
+		release, refused := h.admit("192.0.2.1", tt.join, hostProof{tls: tt.state}, http.Header{})
+		if tt.ok {
+			if refused != nil {
+				t.Errorf("%s: Expected admission, got %+v", tt.name, refused)
+				continue
+			}
+			release()
+			continue
+		}
+		if refused == nil {
+			release()
+			t.Errorf("%s: Expected a refusal", tt.name)
+			continue
+		}
+		if refused.status != http.StatusForbidden || refused.outcome != metrics.UpgradeNoCert {
+			t.Errorf("%s: Expected 403 %s, got %d %s", tt.name, metrics.UpgradeNoCert, refused.status, refused.outcome)
+		}
+	}
+}
+
+// TestHostCredentialRequired verifies that once hosts need a credential,
+// only a host presenting an accepted one is admitted, and joiners are
+// admitted with none
+func TestHostCredentialRequired(t *testing.T) {
+	limits := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	defer limits.Stop()
+	h := &Handler{limits: limits, access: ratelimit.NewAccessList(), ceiling: ratelimit.NewConnCeiling(0)}
+	keys := hostauth.NewKeys()
+	keys.AddStatic("app", "secret", hostauth.Quota{})
+	h.SetHostAuthorizer(keys)
+
+	tests := []struct {
+		name       string
+		join       bool
+		credential string
+		ok         bool
+	}{
+		{"host without a credential", false, "", false},
+		{"host with a wrong credential", false, "guess", false},
+		{"host with a key", false, "secret", true},
+		{"joiner without a credential", true, "", true},
+	}
+	for _, tt := range tests {
+		release, refused := h.admit("192.0.2.1", tt.join, hostProof{credential: tt.credential}, http.Header{})
+		if tt.ok {
+			if refused != nil {
+				t.Errorf("%s: Expected admission, got %+v", tt.name, refused)
+				continue
+			}
+			release()
+			continue
+		}
+		if refused == nil {
+			release()
+			t.Errorf("%s: Expected a refusal", tt.name)
+			continue
+		}
+		if refused.status != http.StatusUnauthorized || refused.outcome != metrics.UpgradeNoCredential {
+			t.Errorf("%s: Expected 401 %s, got %d %s", tt.name, metrics.UpgradeNoCredential, refused.status, refused.outcome)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// DefaultJoinTimeout is how long a joiner may wait for its host's
+// approval unless SetJoinTimeout says otherwise
+const DefaultJoinTimeout = 2 * time.Minute
+
+// SetJoinTimeout has joiners the host hasn't approved within d sent
+// JOIN_TIMEOUT and hung up on, so they don't hold places in the room
+// forever; 0 lets them wait as long as they stay connected
+func (h *Handler) SetJoinTimeout(d time.Duration) {
+	h.joinTimeout = d
+}
+
+// expireJoin hangs up on client unless it completes the join, with
+// JOIN_CONFIRM, within the join timeout or leaves before then
+func (h *Handler) expireJoin(ctx context.Context, rm *room.Room, client *room.Client) {
+	timer := time.NewTimer(h.joinTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-client.Done():
+		return
+	case <-ctx.Done():
+		return
+	}
+	if rm.ExpirePending(client.ID, []byte(`{"type":"JOIN_TIMEOUT"}`)) {
+		log.Printf("Client timed out awaiting approval: %s... room: %s...", client.ID[:8], rm.ID[:8])
+	}
+}
@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// coalescingConn wraps the hijacked network connection so a writer goroutine
+// can batch several WebSocket frames into a single write syscall.
+// Outside of a batch writes pass straight through, so control frames written
+// by gorilla itself (pongs, close replies) are never held back.
+type coalescingConn struct {
+	net.Conn
+	mu       sync.Mutex
+	buf      []byte
+	batching bool
+}
+
+// Write buffers p while a batch is open and it fits in the byte budget,
+// otherwise flushes anything pending and writes p directly
+func (c *coalescingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.batching && len(c.buf)+len(p) <= MaxCoalesceBytes {
+		c.buf = append(growZeroed(c.buf, len(p)), p...)
+		return len(p), nil
+	}
+
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// begin opens a batch; subsequent writes are buffered until flush
+func (c *coalescingConn) begin() {
+	c.mu.Lock()
+	c.batching = true
+	c.mu.Unlock()
+}
+
+// flush closes the batch and writes all buffered frames at once
+func (c *coalescingConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	return c.flushLocked()
+}
+
+func (c *coalescingConn) flushLocked() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.Conn.Write(c.buf)
+	// The batch was ciphertext; don't leave it for the next to overwrite
+	clear(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// coalescingResponseWriter hands the upgrader a coalescingConn on hijack
+type coalescingResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Hijack implements http.Hijacker
+func (w coalescingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &coalescingConn{Conn: conn}, brw, nil
+}
+
+// writeCoalesced writes first plus any frames already queued on ch, up to
+// MaxCoalesceBytes, as one batch.
+// dequeued, if non-nil, is told the size of every message taken off ch.
+// Each frame's time in the queue is recorded once it has been written,
+// and every frame taken is released, written or not.
+// Reports whether ch was found closed while draining.
+func writeCoalesced(conn Conn, first room.Frame, ch <-chan room.Frame, dequeued func(int)) (closed bool, err error) {
+	conn.Batch()
+
+	err = conn.WriteMessage(first.Data)
+	queued := len(first.Data)
+	written := []room.Frame{first}
+
+drain:
+	for err == nil && queued < MaxCoalesceBytes {
+		select {
+		case message, ok := <-ch:
+			if !ok {
+				closed = true
+				break drain
+			}
+			if dequeued != nil {
+				dequeued(len(message.Data))
+			}
+			err = conn.WriteMessage(message.Data)
+			queued += len(message.Data)
+			written = append(written, message)
+		default:
+			break drain
+		}
+	}
+
+	if flushErr := conn.Flush(); err == nil {
+		err = flushErr
+	}
+	now := time.Now()
+	for _, f := range written {
+		if err == nil {
+			metrics.Global.ObserveRelayLatency(now.Sub(f.Queued))
+		}
+		f.Release()
+	}
+	return closed, err
+}
+
+// flushQueued writes the frames left on ch, as a writer does before
+// hanging up on a peer whose membership or room has ended
+func flushQueued(conn Conn, ch <-chan room.Frame, dequeued func(int)) error {
+	for {
+		select {
+		case message, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if dequeued != nil {
+				dequeued(len(message.Data))
+			}
+			if closed, err := writeCoalesced(conn, message, ch, dequeued); closed || err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// discardQueued releases the frames left on ch once its writer has given
+// up, so they're zeroed rather than left for the collector
+func discardQueued(ch <-chan room.Frame, dequeued func(int)) {
+	for {
+		select {
+		case f, ok := <-ch:
+			if !ok {
+				return
+			}
+			if dequeued != nil {
+				dequeued(len(f.Data))
+			}
+			f.Release()
+		default:
+			return
+		}
+	}
+}
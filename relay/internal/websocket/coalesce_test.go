@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// writeRecorder is a net.Conn remembering each write that reaches it
+type writeRecorder struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+// TestCoalescingConnBatches verifies writes pass straight through outside
+// a batch, are held inside one until flush, and flush early rather than
+// outgrow MaxCoalesceBytes
+func TestCoalescingConnBatches(t *testing.T) {
+	rec := &writeRecorder{}
+	c := &coalescingConn{Conn: rec}
+
+	c.Write([]byte("pong"))
+	if len(rec.writes) != 1 {
+		t.Fatalf("Expected a write outside a batch to pass through, got %d writes", len(rec.writes))
+	}
+
+	c.begin()
+	c.Write([]byte("a"))
+	c.Write([]byte("b"))
+	if len(rec.writes) != 1 {
+		t.Fatalf("Expected writes held while batching, got %d writes", len(rec.writes))
+	}
+	if err := c.flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(rec.writes) != 2 || string(rec.writes[1]) != "ab" {
+		t.Fatalf("Expected the batch written at once, got %q", rec.writes)
+	}
+	if held := c.buf[:cap(c.buf)]; bytes.ContainsAny(held, "ab") {
+		t.Errorf("Expected the written batch zeroed, still holding %q", held)
+	}
+
+	c.begin()
+	c.Write(make([]byte, MaxCoalesceBytes-10))
+	c.Write(make([]byte, 20))
+	if len(rec.writes) != 4 || len(rec.writes[2]) != MaxCoalesceBytes-10 || len(rec.writes[3]) != 20 {
+		t.Errorf("Expected an overflowing write to flush the batch and go alone, got %d writes", len(rec.writes))
+	}
+	c.flush()
+	if len(rec.writes) != 4 {
+		t.Errorf("Expected nothing left to flush, got %d writes", len(rec.writes))
+	}
+}
+
+// batchConn is a Conn remembering its messages and batches
+type batchConn struct {
+	scriptConn
+	messages []string
+	batches  int
+	flushes  int
+}
+
+func (c *batchConn) WriteMessage(data []byte) error {
+	c.messages = append(c.messages, string(data))
+	return nil
+}
+
+func (c *batchConn) Batch()       { c.batches++ }
+func (c *batchConn) Flush() error { c.flushes++; return nil }
+
+// TestWriteCoalesced verifies a writer sends what's queued behind a frame
+// in the same batch, stops at MaxCoalesceBytes, and notices a closed queue
+func TestWriteCoalesced(t *testing.T) {
+	conn := &batchConn{}
+	ch := make(chan room.Frame, 4)
+	ch <- room.Frame{Data: []byte("second")}
+	ch <- room.Frame{Data: []byte("third")}
+	dequeued := 0
+	closed, err := writeCoalesced(conn, room.Frame{Data: []byte("first")}, ch, func(n int) { dequeued += n })
+	if closed || err != nil {
+		t.Fatalf("Expected an open queue written cleanly, got closed=%v, %v", closed, err)
+	}
+	if conn.batches != 1 || conn.flushes != 1 || len(conn.messages) != 3 {
+		t.Errorf("Expected 3 messages in one batch, got %d in %d batches", len(conn.messages), conn.batches)
+	}
+	if dequeued != len("second")+len("third") {
+		t.Errorf("Expected the drained frames counted, got %d bytes", dequeued)
+	}
+
+	conn = &batchConn{}
+	ch <- room.Frame{Data: make([]byte, MaxCoalesceBytes)}
+	ch <- room.Frame{Data: []byte("next batch")}
+	writeCoalesced(conn, room.Frame{Data: []byte("first")}, ch, nil)
+	if len(conn.messages) != 2 || len(ch) != 1 {
+		t.Errorf("Expected the batch to stop at MaxCoalesceBytes, got %d messages, %d left", len(conn.messages), len(ch))
+	}
+
+	<-ch
+	close(ch)
+	if closed, _ := writeCoalesced(&batchConn{}, room.Frame{Data: []byte("last")}, ch, nil); !closed {
+		t.Error("Expected a closed queue reported")
+	}
+}
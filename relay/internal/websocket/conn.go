@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a host's or client's connection to the relay, over a WebSocket
+// or one of the fallback transports. Each message is one relay protocol
+// frame. One goroutine reads and one writes; Close may be called from
+// anywhere and unblocks both.
+type Conn interface {
+	// ReadMessage returns the peer's next message
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a message straight away, or holds it until Flush
+	// while a batch is open. data is zeroed once it returns, so a
+	// transport holding on to it must keep a copy.
+	WriteMessage(data []byte) error
+	// Batch opens a batch, letting the transport send the messages
+	// written until Flush together
+	Batch()
+	Flush() error
+	// Ping checks that a quiet peer is still there
+	Ping() error
+	Close() error
+}
+
+// wsConn is a Conn over a WebSocket
+type wsConn struct {
+	ws *websocket.Conn
+	cc *coalescingConn // nil unless upgraded through a coalescingResponseWriter
+}
+
+// newWSConn wraps an upgraded connection. A peer that goes ReadTimeout
+// without a message or a pong is dropped, as is one sending a message
+// over MaxMessageSize.
+func newWSConn(ws *websocket.Conn) *wsConn {
+	ws.SetReadLimit(MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+		return nil
+	})
+	cc, _ := ws.UnderlyingConn().(*coalescingConn)
+	return &wsConn{ws: ws, cc: cc}
+}
+
+// ReadMessage reads the next message into a buffer of its own, zeroing
+// any it outgrows on the way
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	_, r, err := c.ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	return readZeroed(r)
+}
+
+func (c *wsConn) WriteMessage(data []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Batch merges the frames written until Flush into one write syscall.
+// Each message is still its own WebSocket frame.
+func (c *wsConn) Batch() {
+	if c.cc != nil {
+		c.cc.begin()
+	}
+}
+
+func (c *wsConn) Flush() error {
+	if c.cc != nil {
+		return c.cc.flush()
+	}
+	return nil
+}
+
+func (c *wsConn) Ping() error {
+	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+// CloseWithReason sends a normal closure frame carrying reason before
+// closing
+func (c *wsConn) CloseWithReason(reason string) error {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(CloseTimeout))
+	return c.ws.Close()
+}
+
+// reasonCloser is a Conn able to tell its peer why it's hung up on, as a
+// WebSocket close frame does
+type reasonCloser interface {
+	CloseWithReason(reason string) error
+}
+
+// closeWithReason hangs up on conn, saying why if its transport can
+func closeWithReason(conn Conn, reason string) error {
+	if rc, ok := conn.(reasonCloser); ok {
+		return rc.CloseWithReason(reason)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Cover traffic bounds: the mean interval a host may ask for, and the
+// random payload sizes of the dummy frames when the room isn't padded
+const (
+	MinCoverInterval = 100 * time.Millisecond
+	MaxCoverInterval = 10 * time.Minute
+	MinCoverPayload  = 16
+	MaxCoverPayload  = 1024
+)
+
+var errInvalidCover = errors.New("invalid cover interval")
+
+// parseCover reads the mean interval of cover traffic a host asked for,
+// empty or 0 for none
+func parseCover(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || (d != 0 && (d < MinCoverInterval || d > MaxCoverInterval)) {
+		return 0, errInvalidCover
+	}
+	return d, nil
+}
+
+// coverTraffic sends the room's host and clients COVER frames, which
+// they discard, at random intervals averaging mean until the room is
+// gone or ctx done. The intervals are exponentially distributed, as
+// independent messages would be, so an observer can't tell the dummies by
+// timing; nor by size, padded as the room's messages are.
+func (h *Handler) coverTraffic(ctx context.Context, rm *room.Room, mean time.Duration) {
+	next := func() time.Duration {
+		return time.Duration(mrand.ExpFloat64() * float64(mean))
+	}
+	timer := time.NewTimer(next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-rm.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+		// The room zeroes a frame once it's written, so the host and the
+		// clients each get their own
+		frame := coverFrame(rm.Padding())
+		rm.BroadcastToClients(bytes.Clone(frame))
+		rm.SendToHost(frame)
+		metrics.Global.IncCoverFrames()
+		timer.Reset(next())
+	}
+}
+
+// coverFrame builds a dummy frame with a random payload, padded to the
+// room's smallest bucket if it has one
+func coverFrame(padding int) []byte {
+	b := make([]byte, MinCoverPayload+mrand.IntN(MaxCoverPayload-MinCoverPayload+1))
+	if padding > 0 {
+		b = b[:MinCoverPayload]
+	}
+	rand.Read(b)
+	payload := make([]byte, 0, base64.RawURLEncoding.EncodedLen(len(b))+2)
+	payload = append(payload, '"')
+	payload = base64.RawURLEncoding.AppendEncode(payload, b)
+	payload = append(payload, '"')
+	return encodePadded("COVER", "", payload, padding)
+}
@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestParseCover verifies intervals outside the bounds are refused
+func TestParseCover(t *testing.T) {
+	for s, want := range map[string]time.Duration{"": 0, "0s": 0, "100ms": 100 * time.Millisecond, "10m": 10 * time.Minute} {
+		if got, err := parseCover(s); err != nil || got != want {
+			t.Errorf("Expected %q to be %v, got %v (%v)", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"99ms", "11m", "-1s", "often"} {
+		if _, err := parseCover(s); err == nil {
+			t.Errorf("Expected %q refused", s)
+		}
+	}
+}
+
+// TestCoverFrame verifies dummy frames decode as COVER with a string
+// payload, sized like a padded room's smallest messages
+func TestCoverFrame(t *testing.T) {
+	var msg Message
+	data := coverFrame(0)
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "COVER" {
+		t.Fatalf("Expected a COVER frame, got %s (%v)", data, err)
+	}
+	var payload string
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || len(payload) == 0 {
+		t.Errorf("Expected a string payload, got %s", msg.Payload)
+	}
+
+	for range 10 {
+		if data := coverFrame(256); len(data) != 256 {
+			t.Errorf("Expected a 256 byte frame in a padded room, got %d", len(data))
+		}
+	}
+}
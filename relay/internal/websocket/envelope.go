@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// encodeEnvelope builds the JSON for a relayed Message without reflection.
+// The payload is opaque ciphertext that was already validated as JSON when the
+// inbound frame was decoded, so it is copied through verbatim.
+// The returned slice is exactly sized and owned by the caller. It comes from
+// the room's frame pool, to which the room returns it zeroed once written,
+// and is encoded straight into it so no other copy of the payload is left.
+func encodeEnvelope(msgType, clientID string, payload json.RawMessage) []byte {
+	n := len(`{"type":}`) + jsonStringLen(msgType)
+	if clientID != "" {
+		n += len(`,"clientId":`) + jsonStringLen(clientID)
+	}
+	if len(payload) > 0 {
+		n += len(`,"payload":`) + len(payload)
+	}
+
+	out := room.NewBuffer(n)[:0]
+	out = append(out, `{"type":`...)
+	out = appendJSONString(out, msgType)
+	if clientID != "" {
+		out = append(out, `,"clientId":`...)
+		out = appendJSONString(out, clientID)
+	}
+	if len(payload) > 0 {
+		out = append(out, `,"payload":`...)
+		out = append(out, payload...)
+	}
+	return append(out, '}')
+}
+
+// jsonStringLen returns the length of s quoted by appendJSONString
+func jsonStringLen(s string) int {
+	n := len(s) + 2
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			n++
+		case c < 0x20:
+			n += len(`\u00XX`) - 1
+		}
+	}
+	return n
+}
+
+// appendJSONString appends s as a quoted JSON string
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20:
+			buf = append(buf, `\u00`...)
+			buf = append(buf, hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// TestEncodeEnvelopeMatchesMarshal verifies the encoder produces the same
+// wire format as encoding/json
+func TestEncodeEnvelopeMatchesMarshal(t *testing.T) {
+	cases := []Message{
+		{Type: "MESSAGE", Payload: json.RawMessage(`{"ciphertext":"AAAA"}`)},
+		{Type: "CLIENT_MESSAGE", ClientID: "0123456789abcdef", Payload: json.RawMessage(`"opaque"`)},
+		{Type: "JOIN_REQUEST", ClientID: "weird\"\\\x01id"},
+		{Type: "MESSAGE", Payload: json.RawMessage(`null`)},
+	}
+
+	for _, msg := range cases {
+		want, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		got := encodeEnvelope(msg.Type, msg.ClientID, msg.Payload)
+		if !bytes.Equal(got, want) {
+			t.Errorf("Envelope mismatch:\n got  %s\n want %s", got, want)
+		}
+	}
+}
+
+// TestJSONStringLen verifies the size an envelope is leased at matches
+// what's written into it, so encoding never grows it into a second copy
+func TestJSONStringLen(t *testing.T) {
+	for _, s := range []string{"", "MESSAGE", "weird\"\\\x01id", "\x00\x1f\x7f"} {
+		if got, want := jsonStringLen(s), len(appendJSONString(nil, s)); got != want {
+			t.Errorf("jsonStringLen(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
+
+// TestEncodeEnvelopeOwnsResult verifies returned slices don't alias pooled memory
+func TestEncodeEnvelopeOwnsResult(t *testing.T) {
+	first := encodeEnvelope("MESSAGE", "aaaa", json.RawMessage(`"first"`))
+	snapshot := append([]byte(nil), first...)
+
+	for i := 0; i < 100; i++ {
+		encodeEnvelope("MESSAGE", "bbbb", json.RawMessage(`"second"`))
+	}
+
+	if !bytes.Equal(first, snapshot) {
+		t.Errorf("Envelope was modified after buffer reuse: %s", first)
+	}
+}
+
+var benchPayload = json.RawMessage(`"` + string(bytes.Repeat([]byte("A"), 4096)) + `"`)
+
+func BenchmarkEnvelopeJSONMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := Message{Type: "MESSAGE", ClientID: "0123456789abcdef", Payload: benchPayload}
+		if _, err := json.Marshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnvelopePooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeEnvelope("MESSAGE", "0123456789abcdef", benchPayload)
+	}
+}
@@ -0,0 +1,314 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Run one target at a time, e.g.
+//
+//	go test -run='^$' -fuzz='^FuzzHostReader$' -fuzztime=1m ./internal/websocket
+//
+// Without -fuzz the seeds below run as ordinary tests.
+
+// fuzzClientID is a client already in every fuzzed room, for host frames
+// and client frames to address
+const fuzzClientID = "0123456789abcdef"
+
+// fuzzRoomSeq numbers the fuzzed rooms, each of which gets its own budgets
+var fuzzRoomSeq atomic.Int64
+
+func fuzzRoomID() string {
+	return fmt.Sprintf("fuzz%039d", fuzzRoomSeq.Add(1))
+}
+
+// scriptConn is a Conn that reads a fixed list of messages and then EOF,
+// discarding whatever is written to it
+type scriptConn struct {
+	mu     sync.Mutex
+	frames [][]byte
+	closed bool
+}
+
+// newScriptConn reads script one line per message
+func newScriptConn(script []byte) *scriptConn {
+	return &scriptConn{frames: bytes.Split(script, []byte("\n"))}
+}
+
+func (c *scriptConn) ReadMessage() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if len(c.frames) == 0 {
+		return nil, io.EOF
+	}
+	data := c.frames[0]
+	c.frames = c.frames[1:]
+	return data, nil
+}
+
+func (c *scriptConn) WriteMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *scriptConn) Batch()       {}
+func (c *scriptConn) Flush() error { return nil }
+func (c *scriptConn) Ping() error  { return nil }
+
+func (c *scriptConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+// newFuzzHandler builds a handler with the default limits whose rooms are
+// created open, with fuzzClientID already confirmed in them. The log is
+// silenced: every iteration creates and destroys a room.
+func newFuzzHandler(f *testing.F) *Handler {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	registry := room.NewRegistry()
+	registry.OnRoomCreated(func(rm *room.Room) {
+		rm.OpenRoom()
+		rm.AddClient(fuzzClientID, &scriptConn{})
+		rm.ConfirmClient(fuzzClientID)
+	})
+	limits := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	f.Cleanup(limits.Stop)
+	tokens := invite.NewTokenStore()
+	f.Cleanup(tokens.Stop)
+	inviteHandler := invite.NewHandler(tokens, registry, limits, nil, nil)
+	return NewHandler(registry, limits, inviteHandler, nil, nil, nil, nil)
+}
+
+// serveScript runs a connection to its end, failing if the reader is still
+// going long after its input ran out
+func serveScript(t *testing.T, h *Handler, conn Conn, a attachment) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.serve(context.Background(), conn, a)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the connection to end with its input, the reader hung")
+	}
+}
+
+// script joins messages into one newline-separated seed
+func script(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// FuzzDecodeMessage verifies any frame the readers accept as a Message
+// re-encodes as an envelope that decodes to the same type, client and
+// payload
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"HEARTBEAT"}`))
+	f.Add([]byte(`{"type":"BROADCAST","payload":{"ciphertext":"AAAA"}}`))
+	f.Add([]byte(`{"type":"DIRECT","clientId":"0123456789abcdef","payload":"opaque"}`))
+	f.Add([]byte(`{"type":"MESSAGE","payload":null}`))
+	f.Add([]byte(`{"type":"JOIN_REQUEST","clientId":"weird\"\\\u0001id","payload":[1, 2 ,3]}`))
+	f.Add([]byte(`{"type":" <&>","payload":  {"a" : "b"}  }`))
+	f.Add([]byte(`{"type":"BROADCAST","payload":}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if json.Unmarshal(data, &msg) != nil {
+			return
+		}
+		envelope := encodeEnvelope(msg.Type, msg.ClientID, msg.Payload)
+		var got Message
+		if err := json.Unmarshal(envelope, &got); err != nil {
+			t.Fatalf("Expected a valid envelope for %q, got %s: %v", data, envelope, err)
+		}
+		if got.Type != msg.Type || got.ClientID != msg.ClientID || !bytes.Equal(got.Payload, msg.Payload) {
+			t.Errorf("Expected %q to survive re-encoding, got %s", data, envelope)
+		}
+	})
+}
+
+// FuzzExtractRoomID verifies any request path yields at most one whole
+// path segment, the one after /rooms, or a valid namespaced room ID
+func FuzzExtractRoomID(f *testing.F) {
+	id := strings.Repeat("a", 43)
+	f.Add("/rooms/" + id)
+	f.Add("/rooms/" + id + "/join")
+	f.Add("/rooms/" + id + "/sse")
+	f.Add("/rooms/chat/" + id + "/join")
+	f.Add("//rooms//" + id)
+	f.Add("/rooms")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		roomID := extractRoomID(path)
+		if strings.Contains(roomID, "/") && !room.ValidID(roomID) {
+			t.Errorf("Expected one path segment or a namespaced ID from %q, got %q", path, roomID)
+		}
+		if roomID != "" && !strings.HasPrefix(strings.Trim(path, "/"), "rooms/"+roomID) {
+			t.Errorf("Expected the segment after /rooms from %q, got %q", path, roomID)
+		}
+		if _, bare, _ := strings.Cut(roomID, "/"); room.ValidID(roomID) && len(roomID) != 43 && len(bare) != 43 {
+			t.Errorf("Expected a valid room ID to be 43 bytes, got %q", roomID)
+		}
+	})
+}
+
+// FuzzReadFrame verifies length-prefixed frames are read back exactly as
+// written, and a stream that isn't whole frames is an error
+func FuzzReadFrame(f *testing.F) {
+	var seed bytes.Buffer
+	writeFrame(&seed, nil)
+	writeFrame(&seed, []byte(`{"type":"HEARTBEAT"}`))
+	f.Add(seed.Bytes())
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 5, '{'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		var out bytes.Buffer
+		for {
+			msg, err := readFrame(r)
+			if err != nil {
+				break
+			}
+			if len(msg) > MaxMessageSize {
+				t.Fatalf("Expected frames of at most %d bytes, got %d", MaxMessageSize, len(msg))
+			}
+			writeFrame(&out, msg)
+		}
+		if !bytes.HasPrefix(data, out.Bytes()) {
+			t.Errorf("Expected frames read from %x to write back the same bytes, got %x", data, out.Bytes())
+		}
+	})
+}
+
+// FuzzMQTTPacket verifies malformed MQTT packets, CONNECTs and SUBSCRIBEs
+// are refused without panicking
+func FuzzMQTTPacket(f *testing.F) {
+	connect := append(encodeMQTTString("MQTT"), 4, 0xc2, 0, 30)
+	connect = append(connect, encodeMQTTString("device-1")...)
+	connect = append(connect, encodeMQTTString("join")...)
+	connect = append(connect, encodeMQTTString("token=abc&fingerprint=fp")...)
+	subscribe := append([]byte{0, 1}, encodeMQTTString("rooms/"+strings.Repeat("a", 43)+"/out")...)
+	subscribe = append(subscribe, 0)
+
+	var seed bytes.Buffer
+	writeMQTTPacket(&seed, mqttConnect<<4, connect)
+	writeMQTTPacket(&seed, mqttSubscribe<<4|0x02, subscribe)
+	writeMQTTPacket(&seed, mqttPingreq<<4)
+	f.Add(seed.Bytes())
+	f.Add([]byte{mqttConnect << 4, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{mqttSubscribe<<4 | 0x02, 3, 0, 1, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			p, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			if len(p.body) > mqttMaxPacket {
+				t.Fatalf("Expected packets of at most %d bytes, got %d", mqttMaxPacket, len(p.body))
+			}
+			switch p.kind {
+			case mqttConnect:
+				parseMQTTConnect(p.body)
+			case mqttSubscribe:
+				if _, filters, ok := parseMQTTSubscribe(p); ok {
+					mqttRoom(filters)
+				}
+			}
+		}
+	})
+}
+
+// FuzzHostReader verifies any sequence of frames from a host, well-formed
+// or not, leaves the relay standing and the reader returning when the
+// connection ends
+func FuzzHostReader(f *testing.F) {
+	h := newFuzzHandler(f)
+
+	f.Add(script(
+		`{"type":"HEARTBEAT"}`,
+		`{"type":"ROOM_OPEN"}`,
+		`{"type":"BROADCAST","payload":{"ciphertext":"AAAA"}}`,
+		`{"type":"DIRECT","clientId":"`+fuzzClientID+`","payload":"opaque"}`,
+		`{"type":"JOIN_RESPONSE","clientId":"`+fuzzClientID+`","payload":{"key":"k"}}`,
+		`{"type":"ROOM_STATS"}`,
+		`{"type":"CREATE_INVITE","payload":{"ttlSeconds":60,"scope":"observer"}}`,
+		`{"type":"KICK","clientId":"`+fuzzClientID+`"}`,
+		`{"type":"ROOM_CLOSE"}`,
+	))
+	f.Add(script(`{"type":"CREATE_INVITE","payload":"not an object"}`, `{"type":"DIRECT","clientId":"nobody"}`))
+	f.Add(script(`{"type":`, `null`, `[]`, `{"type":"BROADCAST","payload":}`, ``))
+	f.Add(script(`{"type":"KICK"}`, `{"type":"JOIN_RESPONSE","payload":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roomID := fuzzRoomID()
+		serveScript(t, h, newScriptConn(data), attachment{roomID: roomID})
+		if h.registry.GetRoom(roomID) != nil {
+			t.Errorf("Expected the room destroyed once its host left")
+		}
+	})
+}
+
+// FuzzClientReader verifies any sequence of frames from a joining client,
+// well-formed or not, leaves the relay standing and the reader returning
+// when the connection ends
+func FuzzClientReader(f *testing.F) {
+	h := newFuzzHandler(f)
+
+	f.Add(script(
+		`{"type":"JOIN_REQUEST","payload":{"name":"fuzz"}}`,
+		`{"type":"JOIN_CONFIRM","payload":{"proof":"p"}}`,
+		`{"type":"MESSAGE","payload":{"ciphertext":"AAAA"}}`,
+		`{"type":"CLIENT_ERROR","category":"decode","payload":{"detail":"bad"}}`,
+		`{"type":"KICK","clientId":"`+fuzzClientID+`"}`,
+	))
+	f.Add(script(`{"type":"MESSAGE","payload":"before confirming"}`, `{"type":"CLIENT_ERROR","category":"anything"}`))
+	f.Add(script(`{"type":`, `null`, `[]`, `{"type":"MESSAGE","payload":}`, ``))
+	f.Add(script(`{"type":"JOIN_CONFIRM"}`, `{"type":"JOIN_REQUEST"}`, `{"type":"JOIN_REQUEST"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roomID := fuzzRoomID()
+		host := &scriptConn{}
+		rm, err := h.registry.CreateRoom(roomID, host)
+		if err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+		defer h.registry.DestroyRoom(roomID, "host_disconnected")
+
+		serveScript(t, h, newScriptConn(data), attachment{roomID: roomID, join: true})
+		if n := rm.ClientCount(); n != 1 {
+			t.Errorf("Expected the client gone once it left, %d still in the room", n)
+		}
+	})
+}
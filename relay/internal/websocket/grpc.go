@@ -0,0 +1,315 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/api/relaypb"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcOutbox is how many messages may wait to be sent down a stream
+// before the writer blocks
+const grpcOutbox = 16
+
+// NewGRPCServer returns a gRPC server offering the Relay service, through
+// which native clients reach rooms without a WebSocket
+func (h *Handler) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		// Room protocol messages, with room for the frame around them
+		grpc.MaxRecvMsgSize(MaxMessageSize + 1024),
+		grpc.MaxSendMsgSize(MaxMessageSize + 1024),
+		// As a WebSocket is pinged, a peer that stops answering is dropped
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    PingInterval,
+			Timeout: ReadTimeout - PingInterval,
+		}),
+	}, opts...)
+	s := grpc.NewServer(opts...)
+	relaypb.RegisterRelayServer(s, &grpcRelay{h: h})
+	return s
+}
+
+type grpcRelay struct {
+	relaypb.UnimplementedRelayServer
+	h *Handler
+}
+
+// Attach admits a stream as ServeHTTP does a WebSocket upgrade, going by
+// its Attach frame rather than a URL. Refusals come back as gRPC status
+// codes, with Retry-After and the rate limit headers in the metadata. A
+// host's credential, where one is required, is a bearer token in the
+// authorization metadata, as per-RPC credentials send it; its room
+// options are in the pad, cover and jitter metadata.
+func (g *grpcRelay) Attach(stream relaypb.Relay_AttachServer) error {
+	h := g.h
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	at := first.GetAttach()
+	if at == nil || !room.ValidID(at.RoomId) {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeInvalidRoom)
+		return status.Error(codes.InvalidArgument, "Invalid room ID")
+	}
+
+	// A draining node is handing its rooms to the others
+	if h.cluster.Draining() {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeDraining)
+		stream.SetTrailer(metadata.Pairs("retry-after", "1"))
+		return status.Error(codes.Unavailable, "Node draining")
+	}
+
+	role := metrics.RoleHost
+	if at.Join {
+		role = metrics.RoleClient
+	}
+	ctx, span := tracing.Start(stream.Context(), "relay.upgrade", tracing.Room(at.RoomId), tracing.AttrRole.String(role))
+
+	hdr := http.Header{}
+	proof := grpcHostProof(stream.Context())
+	release, refused := h.admit(h.grpcClientIP(stream.Context()), at.Join, proof, hdr)
+	if refused != nil {
+		metrics.Global.IncUpgradeFailure(refused.outcome)
+		tracing.Fail(span, refused.outcome)
+		span.End()
+		if refused.retryAfter != "" {
+			hdr.Set("Retry-After", refused.retryAfter)
+		}
+		stream.SetTrailer(headerMetadata(hdr))
+		return status.Error(grpcCode(refused.status), refused.message)
+	}
+	defer release()
+	stream.SetHeader(headerMetadata(hdr))
+	span.End()
+
+	conn := newGRPCConn(stream)
+	served := make(chan struct{})
+	safeGo("gRPC stream", func() {
+		defer close(served)
+		defer conn.Close()
+		h.serve(ctx, conn, attachment{
+			roomID:      at.RoomId,
+			join:        at.Join,
+			credential:  proof.credential,
+			token:       at.Token,
+			fingerprint: at.Fingerprint,
+			resume:      at.Resume,
+			pad:         grpcMetadata(stream.Context(), "pad"),
+			cover:       grpcMetadata(stream.Context(), "cover"),
+			jitter:      grpcMetadata(stream.Context(), "jitter"),
+		})
+	}, nil)
+	err = conn.pump()
+	<-served
+	return err
+}
+
+// grpcMetadata returns the first value of key in a stream's metadata, for
+// what the Attach frame has no field for
+func grpcMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcHostProof returns a stream's TLS state, nil without TLS, and the
+// bearer token in its authorization metadata
+func grpcHostProof(ctx context.Context) hostProof {
+	var proof hostProof
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if bearer, ok := strings.CutPrefix(v, "Bearer "); ok {
+			proof.credential = bearer
+			break
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			proof.tls = &info.State
+		}
+	}
+	return proof
+}
+
+// grpcClientIP resolves a stream's client address as ClientIP does a
+// request's, believing X-Forwarded-For metadata only from trusted proxies
+func (h *Handler) grpcClientIP(ctx context.Context) string {
+	r := &http.Request{Header: http.Header{}}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		for _, v := range md.Get(key) {
+			r.Header.Add(key, v)
+		}
+	}
+	return h.ips.ClientIP(r)
+}
+
+func headerMetadata(hdr http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range hdr {
+		md.Append(k, v...)
+	}
+	return md
+}
+
+// grpcCode is the status code for a refusal's HTTP status
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// grpcConn is a Conn over a Relay.Attach stream. Only the RPC's own
+// goroutine may send on the stream, and only until it returns, so
+// messages written are queued for pump, which it runs.
+//
+// gRPC can't put a deadline on a send, so a peer that stops reading holds
+// the RPC until its connection's keep-alives fail; it holds its admission
+// slots meanwhile, which bounds how many one address can pin.
+type grpcConn struct {
+	stream relaypb.Relay_AttachServer
+	inbox  chan []byte
+	outbox chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newGRPCConn(stream relaypb.Relay_AttachServer) *grpcConn {
+	c := &grpcConn{
+		stream: stream,
+		inbox:  make(chan []byte),
+		outbox: make(chan []byte, grpcOutbox),
+		done:   make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// receive passes the peer's messages to the reader until the stream ends
+func (c *grpcConn) receive() {
+	defer c.Close()
+	for {
+		frame, err := c.stream.Recv()
+		if err != nil {
+			return
+		}
+		data := frame.GetMessage()
+		if data == nil {
+			// A second Attach, or a frame this relay doesn't know
+			return
+		}
+		select {
+		case c.inbox <- data:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// pump sends queued messages until the Conn is closed, and then whatever
+// is still queued, such as a ROOM_DESTROYED written just before
+func (c *grpcConn) pump() error {
+	defer c.Close()
+	for {
+		select {
+		case data := <-c.outbox:
+			if err := c.send(data); err != nil {
+				return err
+			}
+		case <-c.done:
+			for {
+				select {
+				case data := <-c.outbox:
+					if err := c.send(data); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (c *grpcConn) send(data []byte) error {
+	return c.stream.Send(&relaypb.Frame{Kind: &relaypb.Frame_Message{Message: data}})
+}
+
+func (c *grpcConn) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-c.inbox:
+		return data, nil
+	case <-c.done:
+		return nil, errSessionClosed
+	}
+}
+
+// WriteMessage queues a copy of data for pump, waiting up to WriteTimeout
+// for room. The relay zeroes data once this returns.
+func (c *grpcConn) WriteMessage(data []byte) error {
+	select {
+	case <-c.done:
+		return errSessionClosed
+	default:
+	}
+
+	timer := time.NewTimer(WriteTimeout)
+	defer timer.Stop()
+	select {
+	case c.outbox <- bytes.Clone(data):
+		return nil
+	case <-c.done:
+		return errSessionClosed
+	case <-timer.C:
+		return context.DeadlineExceeded
+	}
+}
+
+// Batch and Flush have nothing to do: gRPC buffers its own writes
+func (c *grpcConn) Batch()       {}
+func (c *grpcConn) Flush() error { return nil }
+
+// Ping only reports a stream already gone; keep-alives check the peer
+func (c *grpcConn) Ping() error {
+	select {
+	case <-c.done:
+		return errSessionClosed
+	default:
+		return nil
+	}
+}
+
+// Close ends the stream once pump has sent what's queued
+func (c *grpcConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/api/relaypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// echoRelay answers an Attach by echoing every message through a grpcConn
+type echoRelay struct {
+	relaypb.UnimplementedRelayServer
+}
+
+func (echoRelay) Attach(stream relaypb.Relay_AttachServer) error {
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	c := newGRPCConn(stream)
+	go func() {
+		defer c.Close()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(msg)
+			if string(msg) == "bye" {
+				return
+			}
+		}
+	}()
+	return c.pump()
+}
+
+// TestGRPCConn verifies messages go both ways over an Attach stream, and
+// the last one written before Close still reaches the peer
+func TestGRPCConn(t *testing.T) {
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	relaypb.RegisterRelayServer(s, echoRelay{})
+	go s.Serve(ln)
+	defer s.Stop()
+
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return ln.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := relaypb.NewRelayClient(cc).Attach(ctx)
+	if err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	stream.Send(&relaypb.Frame{Kind: &relaypb.Frame_Attach{Attach: &relaypb.Attach{RoomId: "room"}}})
+
+	for _, want := range []string{`{"type":"HEARTBEAT"}`, "bye"} {
+		stream.Send(&relaypb.Frame{Kind: &relaypb.Frame_Message{Message: []byte(want)}})
+		frame, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Expected %q back, got %v", want, err)
+		}
+		if got := string(frame.GetMessage()); got != want {
+			t.Errorf("Expected %q back, got %q", want, got)
+		}
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("Expected the stream to end after Close")
+	}
+}
@@ -1,19 +1,31 @@
-// Package websocket provides WebSocket handling for the ephemeral relay server
+// Package websocket provides WebSocket handling for the ephemeral relay
+// server, with WebTransport sessions as an alternative, and Server-Sent
+// Events and long-polling fallbacks for peers that can use neither
 package websocket
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/cluster"
+	"github.com/ephemeral/relay/internal/hostauth"
 	"github.com/ephemeral/relay/internal/invite"
 	"github.com/ephemeral/relay/internal/metrics"
 	"github.com/ephemeral/relay/internal/ratelimit"
 	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tenant"
+	"github.com/ephemeral/relay/internal/tracing"
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/webtransport-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Constants
@@ -24,9 +36,22 @@ const (
 	MaxMessageSize         = 8 * 1024 * 1024 // 8MB
 	ReadTimeout            = 60 * time.Second
 	WriteTimeout           = 30 * time.Second // Increased for large messages
+	CloseTimeout           = time.Second      // for the close frame sent hanging up
 	PingInterval           = 30 * time.Second
 	HeartbeatCheckInterval = 3 * time.Second
 	HeartbeatTimeout       = 6 * time.Second
+	// MaxClientErrorSize bounds the diagnostic blob a client may attach to
+	// CLIENT_ERROR; larger blobs are counted but not forwarded
+	MaxClientErrorSize = 4 * 1024
+	// MaxCoalesceBytes caps how many bytes of queued frames a writer batches
+	// into a single network write
+	MaxCoalesceBytes = 64 * 1024
+	// ShedRetryAfter is the Retry-After (seconds) sent when the server-wide
+	// connection ceiling turns an upgrade away
+	ShedRetryAfter = 5
+	// MaxCloseGrace caps the countdown a host may give its room's members
+	// closing it
+	MaxCloseGrace = time.Minute
 )
 
 // Message types
@@ -36,32 +61,140 @@ type Message struct {
 	ClientID string          `json:"clientId,omitempty"`
 	Payload  json.RawMessage `json:"payload,omitempty"`
 	Reason   string          `json:"reason,omitempty"`
+	Category string          `json:"category,omitempty"`
+	Role     string          `json:"role,omitempty"`
+	Secret   string          `json:"hostSecret,omitempty"` // ROOM_CREATED only
+
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"` // RATE_LIMITED, and ERROR from a quota
+	Quota        string `json:"quota,omitempty"`        // the resource a tenant's quota ran out of
+	GraceMs      int64  `json:"graceMs,omitempty"`      // ROOM_CLOSE and ROOM_CLOSING: until the room is destroyed
+	Approved     *bool  `json:"approved,omitempty"`     // JOIN_RESPONSE: true accepts the joiner; absent or false turns it down
+	ClientSecret string `json:"clientSecret,omitempty"` // CONNECTED: proves the client on the report API
+
+	Profile json.RawMessage `json:"profile,omitempty"` // JOIN_REQUEST and PROFILE: the member's encrypted profile
+}
+
+// zero clears the ciphertext decoding a frame into m copied out of it
+func (m *Message) zero() {
+	clear(m.Payload)
+	clear(m.Profile)
 }
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  64 * 1024,  // 64KB buffer for reading large messages
-	WriteBufferSize: 64 * 1024,  // 64KB buffer for writing large messages
+	ReadBufferSize:  64 * 1024, // 64KB buffer for reading large messages
+	WriteBufferSize: 64 * 1024, // 64KB buffer for writing large messages
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
-
 // Handler handles WebSocket connections
 type Handler struct {
-	registry       *room.Registry
-	connLimiter    *ratelimit.Limiter
-	msgLimiter     *ratelimit.MessageLimiter
-	inviteHandler  *invite.Handler
+	registry      *room.Registry
+	limits        *ratelimit.Limiters
+	inviteHandler *invite.Handler
+	ips           *clientip.Resolver
+	ceiling       *ratelimit.ConnCeiling
+	access        *ratelimit.AccessList
+	cluster       *cluster.Node        // nil when standalone
+	sessions      *sessions            // HTTP fallback transports
+	webtransport  *webtransport.Server // nil unless EnableWebTransport
+	pow           *ratelimit.PoW       // nil unless SetProofOfWork
+	hostCerts     bool                 // hosts need a verified client certificate
+	hostAuth      hostauth.Authorizer  // nil unless SetHostAuthorizer
+	uniformErrors bool                 // refused outsiders aren't told why
+	tenants       *tenant.Tenants      // nil unless SetTenants
+	joinTimeout   time.Duration        // for the host's approval; 0 for none
+
+	// Every connection's context derives from ctx, which Shutdown cancels.
+	// mu orders adding to conns against it, so none is added once Shutdown
+	// waits.
+	ctx      context.Context
+	shutdown context.CancelFunc
+	mu       sync.Mutex
+	conns    sync.WaitGroup // connections being served
 }
 
-// NewHandler creates a new WebSocket handler
-func NewHandler(registry *room.Registry, connLimiter *ratelimit.Limiter, msgLimiter *ratelimit.MessageLimiter, inviteHandler *invite.Handler) *Handler {
+// NewHandler creates a new WebSocket handler. node is nil unless the
+// relay runs in cluster mode.
+func NewHandler(registry *room.Registry, limits *ratelimit.Limiters, inviteHandler *invite.Handler, ips *clientip.Resolver, ceiling *ratelimit.ConnCeiling, access *ratelimit.AccessList, node *cluster.Node) *Handler {
+	ctx, shutdown := context.WithCancel(context.Background())
 	return &Handler{
 		registry:      registry,
-		connLimiter:   connLimiter,
-		msgLimiter:    msgLimiter,
+		limits:        limits,
 		inviteHandler: inviteHandler,
+		ips:           ips,
+		ceiling:       ceiling,
+		access:        access,
+		cluster:       node,
+		sessions:      newSessions(),
+		joinTimeout:   DefaultJoinTimeout,
+		ctx:           ctx,
+		shutdown:      shutdown,
+	}
+}
+
+// Shutdown hangs up every connection the handler serves, destroying the
+// rooms it hosts, and waits for them to finish or ctx to expire.
+// Connections arriving afterwards are closed straight away.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shutdown()
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetProofOfWork makes peers with no address of their own, on the onion
+// service, pay in work for the per-IP limits they escape
+func (h *Handler) SetProofOfWork(pow *ratelimit.PoW) {
+	h.pow = pow
+}
+
+// RequireHostCertificates lets only peers with a client certificate the
+// TLS layer verified create rooms. Joins stay open to anyone, invite
+// tokens deciding their roles as before. Hosts arriving without TLS, or
+// through the Matrix bridge, can then never create rooms.
+func (h *Handler) RequireHostCertificates() {
+	h.hostCerts = true
+}
+
+// SetHostAuthorizer lets only peers presenting a credential a accepts
+// create rooms, such as an API key. Joining stays anonymous.
+func (h *Handler) SetHostAuthorizer(a hostauth.Authorizer) {
+	h.hostAuth = a
+}
+
+// SetTenants holds hosts presenting an API key to its quotas: the rooms
+// they may create, and the rate limit profile of their traffic
+func (h *Handler) SetTenants(t *tenant.Tenants) {
+	h.tenants = t
+}
+
+// roomLimits returns the limiters traffic in rm is held to: its tenant's,
+// or the relay's
+func (h *Handler) roomLimits(rm *room.Room) *ratelimit.Limiters {
+	if l := h.tenants.Limits(rm.Tenant()); l != nil {
+		return l
+	}
+	return h.limits
+}
+
+// tenantName returns the name of the API key rm's host presented, for the
+// tenant metrics; "" for rooms of no tenant
+func (h *Handler) tenantName(rm *room.Room) string {
+	if t := h.tenants.Get(rm.Tenant()); t != nil {
+		return t.Name
 	}
+	return ""
 }
 
 // ServeHTTP handles incoming HTTP requests and upgrades to WebSocket
@@ -70,101 +203,384 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Extract room ID from path
 	roomID := extractRoomID(path)
-	if roomID == "" || !roomIDPattern.MatchString(roomID) {
+	if roomID == "" || !room.ValidID(roomID) {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeInvalidRoom)
 		http.Error(w, "Invalid room ID", http.StatusBadRequest)
 		return
 	}
 
-	// Rate limiting by IP
-	clientIP := getClientIP(r)
-	if !h.connLimiter.Allow(clientIP) {
-		metrics.Global.IncRateLimited()
-		http.Error(w, "Rate limited", http.StatusTooManyRequests)
+	// The HTTP fallback transports: a peer's messages come up as POSTs
+	// beside its event stream or polls
+	isSSE := strings.HasSuffix(path, "/sse")
+	isPoll := strings.HasSuffix(path, "/poll")
+	if isSSE || isPoll {
+		switch {
+		case r.Method == http.MethodOptions:
+			servePreflight(w)
+			return
+		case r.Method == http.MethodPost:
+			h.sessions.serveUpstream(w, r, roomID)
+			return
+		case r.Method != http.MethodGet:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		case isPoll && r.Header.Get(SessionHeader) != "":
+			h.sessions.servePoll(w, r, roomID)
+			return
+		}
+	}
+
+	// A draining node is handing its rooms to the others; the load
+	// balancer should be sending new connections there too
+	if h.cluster.Draining() {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeDraining)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Node draining", http.StatusServiceUnavailable)
 		return
 	}
 
-	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+	// After the ID, which a namespace such as "joint" may start
+	isJoin := strings.Contains(path[strings.Index(path, roomID)+len(roomID):], "/join")
+	role := metrics.RoleHost
+	if isJoin {
+		role = metrics.RoleClient
+	}
+
+	// The upgrade span covers admission and the handshake only
+	ctx, span := tracing.Start(r.Context(), "relay.upgrade", tracing.Room(roomID), tracing.AttrRole.String(role))
+	refuse := func(outcome string) {
+		metrics.Global.IncUpgradeFailure(outcome)
+		tracing.Fail(span, outcome)
+		span.End()
+	}
+
+	// Onion service peers all arrive from the Tor daemon, so each upgrade
+	// costs a solved challenge instead
+	clientIP := h.ips.ClientIP(r)
+	if clientIP == "" {
+		if err := h.pow.Verify(ratelimit.PoWSolution(r)); err != nil {
+			metrics.Global.IncRateLimited(metrics.ScopeConnection, metrics.CauseNoProof)
+			refuse(metrics.UpgradeNoProof)
+			http.Error(w, "Proof of work required", http.StatusForbidden)
+			return
+		}
+	}
+
+	// What admission takes is held until the connection closes, which for
+	// a long-poll session is long after this request has been answered
+	credential := hostauth.FromRequest(r)
+	release, refused := h.admit(clientIP, isJoin, hostProof{tls: r.TLS, credential: credential}, w.Header())
+	if refused != nil {
+		refuse(refused.outcome)
+		if refused.retryAfter != "" {
+			w.Header().Set("Retry-After", refused.retryAfter)
+		}
+		http.Error(w, refused.message, refused.status)
 		return
 	}
+	detached := false
+	defer func() {
+		if !detached {
+			release()
+		}
+	}()
+
+	// Checked here rather than inside Upgrade so it's counted apart from
+	// malformed handshakes
+	if !upgrader.CheckOrigin(r) {
+		refuse(metrics.UpgradeBadOrigin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	a := attachment{
+		roomID:      roomID,
+		join:        isJoin,
+		credential:  credential,
+		token:       q.Get("token"),
+		fingerprint: q.Get("fingerprint"),
+		resume:      q.Get("resume"),
+		pad:         q.Get("pad"),
+		cover:       q.Get("cover"),
+		jitter:      q.Get("jitter"),
+	}
+
+	// Upgrade to WebSocket, or open a WebTransport or fallback session
+	switch {
+	case isPoll:
+		session, err := h.sessions.openPoll(roomID)
+		if err != nil {
+			log.Printf("Long-poll session failed: %v", err)
+			refuse(metrics.UpgradeHandshake)
+			return
+		}
+		span.End()
+
+		// The session outlives this request, which answers its first poll
+		detached = true
+		safeGo("long-poll session", func() {
+			defer release()
+			defer session.finish()
+			h.serve(context.WithoutCancel(ctx), session, a)
+		}, nil)
+		session.serve(w, r, 0, true)
+	case isSSE:
+		stream, err := h.sessions.openSSE(w, r, roomID)
+		if err != nil {
+			log.Printf("SSE stream failed: %v", err)
+			refuse(metrics.UpgradeHandshake)
+			return
+		}
+		defer stream.finish()
+		span.End()
+		h.serve(ctx, stream, a)
+	case h.webtransport != nil && r.Method == http.MethodConnect:
+		session, err := h.openWebTransport(w, r)
+		if err != nil {
+			log.Printf("WebTransport session failed: %v", err)
+			refuse(metrics.UpgradeHandshake)
+			return
+		}
+		span.End()
+		h.serve(ctx, session, a)
+	default:
+		ws, err := upgrader.Upgrade(coalescingResponseWriter{w}, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %v", err)
+			refuse(metrics.UpgradeHandshake)
+			return
+		}
+		span.End()
+		h.serve(ctx, newWSConn(ws), a)
+	}
+}
+
+// attachment is what a new connection is for
+type attachment struct {
+	roomID      string
+	join        bool   // as a client, rather than the room's host
+	credential  string // what a host presented to show it may, such as an API key
+	token       string // the invite token
+	fingerprint string // the key fingerprint a bound token requires
+	resume      string // a MIGRATE message's resume token, after a drain
+	pad         string // the smallest padding bucket a host asks for
+	cover       string // the mean interval of cover traffic a host asks for
+	jitter      string // the longest delay before writing a frame a host asks for
+}
 
+// serve runs an admitted connection until it closes, or ctx or the
+// handler is done
+func (h *Handler) serve(ctx context.Context, conn Conn, a attachment) {
 	metrics.Global.IncConnections()
+	defer metrics.Global.DecOpenConnections()
+	h.mu.Lock()
+	if h.ctx.Err() != nil {
+		h.mu.Unlock()
+		sendError(conn, "Server shutting down")
+		conn.Close()
+		return
+	}
+	h.conns.Add(1)
+	h.mu.Unlock()
+	defer h.conns.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(h.ctx, cancel)()
+
+	switch {
+	case a.join && a.resume != "":
+		h.handleClientResume(ctx, conn, a.roomID, a.resume)
+	case a.join:
+		h.handleClientJoin(ctx, conn, a.roomID, a.token, a.fingerprint)
+	default:
+		h.handleHostCreate(ctx, conn, a)
+	}
+}
+
+// AttachOptions say what a connection handed to Attach is for
+type AttachOptions struct {
+	Join        bool          // as a client, rather than the room's host
+	Token       string        // the invite token a client presents
+	Fingerprint string        // the key fingerprint a bound token requires
+	Pad         int           // the smallest padding bucket a host asks for, 0 for none
+	Cover       time.Duration // the mean interval of cover traffic a host asks for, 0 for none
+	Jitter      time.Duration // the longest delay before writing a frame a host asks for, 0 for none
+}
+
+// Attach serves conn for roomID until it closes, as ServeHTTP serves an
+// upgraded socket. Admission and the upgrade are skipped: a transport
+// the relay doesn't know, or a test with an in-memory Conn, has already
+// decided to let the peer in. An invalid room ID is answered with an
+// ERROR and the connection closed.
+func (h *Handler) Attach(ctx context.Context, conn Conn, roomID string, opts AttachOptions) {
+	if !room.ValidID(roomID) {
+		sendError(conn, "Invalid room ID")
+		conn.Close()
+		return
+	}
+	h.serve(ctx, conn, attachment{
+		roomID:      roomID,
+		join:        opts.Join,
+		token:       opts.Token,
+		fingerprint: opts.Fingerprint,
+		pad:         strconv.Itoa(opts.Pad),
+		cover:       opts.Cover.String(),
+		jitter:      opts.Jitter.String(),
+	})
+}
 
-	// Route based on path
-	if strings.Contains(path, "/join") {
-		// Extract invite token from query parameter
-		inviteToken := r.URL.Query().Get("token")
-		h.handleClientJoin(conn, roomID, inviteToken)
-	} else {
-		h.handleHostCreate(conn, roomID)
+// hangUp returns a context derived from ctx that closes conn when done,
+// by which the goroutines serving conn end one another
+func hangUp(ctx context.Context, conn Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	context.AfterFunc(ctx, func() { conn.Close() })
+	return ctx, cancel
+}
+
+// strike counts a rate-limit rejection toward a temporary ban
+func (h *Handler) strike(ip string) {
+	if d := h.limits.Jail.Strike(ip); d > 0 {
+		metrics.Global.IncBans()
+		log.Printf("Client jailed for %v after repeated rate limiting", d)
 	}
 }
 
-func (h *Handler) handleHostCreate(conn *websocket.Conn, roomID string) {
-	// Create room
-	rm, err := h.registry.CreateRoom(roomID, conn)
+func (h *Handler) handleHostCreate(ctx context.Context, conn Conn, a attachment) {
+	roomID := a.roomID
+	_, span := tracing.Start(ctx, "relay.create", tracing.Room(roomID))
+
+	// Create room; in a cluster the ID must not be live on another node,
+	// unless its host is bringing it over from a drained one. A room is
+	// never created other than as its host asked.
+	var grant cluster.Grant
+	padding, err := parsePadding(a.pad)
+	var cover, delay time.Duration
+	if err == nil {
+		cover, err = parseCover(a.cover)
+	}
+	if err == nil {
+		delay, err = parseJitter(a.jitter)
+	}
+	if err == nil && a.resume != "" {
+		grant, err = h.cluster.Resume(roomID, a.resume, true)
+	} else if err == nil && h.cluster.HostedElsewhere(roomID) {
+		err = room.ErrRoomExists
+	}
+	var rm *room.Room
+	if err == nil {
+		if t := h.tenants.Lookup(a.credential); t != nil {
+			rm, err = h.registry.CreateTenantRoom(roomID, conn, t.ID, t.Quota.Rooms)
+			if err == nil {
+				metrics.Global.IncTenantRooms(t.Name)
+			}
+		} else {
+			rm, err = h.registry.CreateRoom(roomID, conn)
+		}
+	}
+	if err == nil {
+		rm.SetPadding(padding)
+		rm.SetJitter(delay)
+		if err = h.cluster.Hosting(rm); err != nil {
+			log.Printf("Cluster: room not shared: %v", err)
+			h.registry.DestroyRoom(roomID, "cluster_unavailable")
+		} else if grant.Open {
+			rm.OpenRoom()
+			h.cluster.Opened(rm)
+		}
+	}
 	if err != nil {
-		sendError(conn, err.Error())
+		tracing.Fail(span, "create_failed")
+		span.End()
+		sendRefusal(conn, err)
 		conn.Close()
 		return
 	}
 
-	metrics.Global.IncRoomsCreated()
 	log.Printf("Room created: %s...", roomID[:8])
+	connected := time.Now()
 
 	// Ensure room is destroyed when this function exits
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Panic in host handler: %v", r)
+			logPanic("host handler", r)
 		}
 		h.registry.DestroyRoom(roomID, "host_disconnected")
-		h.msgLimiter.RemoveRoom(roomID)
-		metrics.Global.IncRoomsDestroyed()
+		metrics.Global.ObserveConnection(metrics.RoleHost, time.Since(connected))
 		log.Printf("Room destroyed: %s...", roomID[:8])
 	}()
 
-	// Configure connection
-	conn.SetReadLimit(MaxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-		return nil
-	})
-
-	// Start writer goroutine
+	// The room's goroutines share a context ending with the connection,
+	// the handler, or the writer, once it has written the host its last
+	// frame. The host is hung up on then, so the reader returns.
+	ctx, cancel := hangUp(ctx, conn)
+	defer cancel()
+
+	// Start writer goroutine. The room can't outlive its writer or monitor:
+	// if either panics it's destroyed and the host disconnected.
+	fail := func() {
+		h.registry.DestroyRoom(roomID, "server_error")
+		cancel()
+	}
+	// A host the writer can no longer reach is gone: its clients are told
+	// so at once, not when the reader next notices.
 	writerDone := make(chan struct{})
-	go func() {
+	safeGo("host writer", func() {
 		defer close(writerDone)
-		h.hostWriter(rm, conn)
-	}()
+		defer cancel()
+		h.hostWriter(ctx, rm, conn)
+		h.registry.DestroyRoom(roomID, "host_disconnected")
+	}, fail)
 
 	// Start heartbeat monitor
 	heartbeatDone := make(chan struct{})
-	go func() {
+	safeGo("heartbeat monitor", func() {
 		defer close(heartbeatDone)
-		h.heartbeatMonitor(rm, roomID)
-	}()
+		h.heartbeatMonitor(ctx, rm, roomID)
+	}, fail)
 
-	// Send room created confirmation
-	sendJSON(conn, Message{Type: "ROOM_CREATED", RoomID: roomID})
+	if cover > 0 {
+		safeGo("cover traffic", func() { h.coverTraffic(ctx, rm, cover) }, nil)
+	}
+
+	// Send room created confirmation with the secret for the invite API
+	sendJSON(conn, Message{Type: "ROOM_CREATED", RoomID: roomID, Secret: rm.HostSecret()})
+	span.End()
 
 	// Read loop (blocks until disconnect)
 	h.hostReader(rm, conn)
 
-	// Cleanup
+	// Cleanup: destroying the room closes HostSendCh, which stops the writer.
+	// Waiting on the writer first would keep the room alive after ROOM_CLOSE.
+	h.registry.DestroyRoom(roomID, "host_disconnected")
 	<-writerDone
+	conn.Close()
 }
 
-func (h *Handler) hostReader(rm *room.Room, conn *websocket.Conn) {
+// hostBudgetKey is the host's key in the per-room byte budget. Client IDs
+// are hex, so it can't collide with one.
+const hostBudgetKey = "host"
+
+func (h *Handler) hostReader(rm *room.Room, conn Conn) {
+	notices := limitNotices{tenant: h.tenantName(rm)}
+
+	// A frame's ciphertext, and the copies decoding it made, have been
+	// copied into what it was relayed as by the time the next is read, so
+	// they're zeroed then rather than left in the heap. A frame the room
+	// took as it was, the room zeroes.
+	var message []byte
+	var msg Message
+	defer func() { clear(message); msg.zero() }()
 	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
+		clear(message)
+		msg.zero()
+		var err error
+		if message, err = conn.ReadMessage(); err != nil {
 			return
 		}
 
-		var msg Message
+		msg = Message{}
 		if err := json.Unmarshal(message, &msg); err != nil {
 			continue
 		}
@@ -173,36 +589,97 @@ func (h *Handler) hostReader(rm *room.Room, conn *websocket.Conn) {
 
 		switch msg.Type {
 		case "HEARTBEAT":
-			select {
-			case rm.HostSendCh <- []byte(`{"type":"HEARTBEAT_ACK"}`):
-			default:
-			}
+			rm.SendToHost([]byte(`{"type":"HEARTBEAT_ACK"}`))
 
 		case "ROOM_OPEN":
 			rm.OpenRoom()
+			h.cluster.Opened(rm)
 			log.Printf("Room opened: %s...", rm.ID[:8])
 
 		case "BROADCAST":
-			h.handleBroadcast(rm, msg.Payload)
+			if h.hostBudget(rm, &notices, len(message)) {
+				h.handleBroadcast(rm, msg.Payload)
+			}
 
 		case "DIRECT":
-			h.handleDirect(rm, msg.ClientID, msg.Payload)
+			if h.hostBudget(rm, &notices, len(message)) {
+				h.handleDirect(rm, msg.ClientID, msg.Payload)
+			}
 
 		case "JOIN_RESPONSE":
-			h.handleJoinResponse(rm, msg.ClientID, message)
+			h.handleJoinResponse(rm, msg.ClientID, msg.Approved != nil && *msg.Approved, message)
+			message = nil
 
 		case "KICK":
 			h.handleKick(rm, msg.ClientID)
 
+		case "ROOM_STATS":
+			h.handleRoomStats(rm)
+
+		case "CREATE_INVITE":
+			h.handleCreateInvite(rm, msg.Payload)
+
 		case "ROOM_CLOSE":
-			return
+			if msg.GraceMs <= 0 {
+				return
+			}
+			h.closeRoom(rm, min(time.Duration(msg.GraceMs)*time.Millisecond, MaxCloseGrace))
 		}
 	}
 }
 
-func (h *Handler) hostWriter(rm *room.Room, conn *websocket.Conn) {
+// closeRoom starts rm's closing countdown: its members are told how long
+// they have, joins are refused on every node, and the room is destroyed
+// once grace has passed. A countdown already running isn't restarted.
+func (h *Handler) closeRoom(rm *room.Room, grace time.Duration) {
+	if !rm.BeginClosing() {
+		return
+	}
+	h.cluster.Closing(rm)
+	log.Printf("Room closing in %v: %s...", grace, rm.ID[:8])
+
+	// The room zeroes a frame once it's written, so the host and the
+	// clients each get their own
+	if data, err := json.Marshal(Message{Type: "ROOM_CLOSING", GraceMs: grace.Milliseconds()}); err == nil {
+		rm.BroadcastToClients(bytes.Clone(data))
+		rm.SendToHost(data)
+	}
+
+	timer := time.NewTimer(grace)
+	safeGo("room close", func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			h.registry.DestroyRoom(rm.ID, "host_closed")
+		case <-rm.Done():
+		}
+	}, nil)
+}
+
+// hostBudget charges a host frame to the room's byte budget and its
+// tenant's quota, telling the host when frames start being dropped
+func (h *Handler) hostBudget(rm *room.Room, notices *limitNotices, size int) bool {
+	res := h.roomLimits(rm).Bytes.TakeN(rm.ID, hostBudgetKey, size)
+	if !res.Allowed {
+		if data := notices.next(res, LimitBytes); data != nil {
+			rm.SendToHost(data)
+		}
+		return false
+	}
+	if exceeded := h.chargeBytes(rm, size); exceeded != nil {
+		if data := notices.exceeded(exceeded); data != nil {
+			rm.SendToHost(data)
+		}
+		return false
+	}
+	return true
+}
+
+func (h *Handler) hostWriter(ctx context.Context, rm *room.Room, conn Conn) {
 	ticker := time.NewTicker(PingInterval)
 	defer ticker.Stop()
+	defer discardQueued(rm.HostSendCh, nil)
+	delay := jitter{max: rm.Jitter()}
 
 	for {
 		select {
@@ -210,277 +687,537 @@ func (h *Handler) hostWriter(rm *room.Room, conn *websocket.Conn) {
 			if !ok {
 				return
 			}
-			conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			delay.wait(message)
+			closed, err := writeCoalesced(conn, message, rm.HostSendCh, nil)
+			if closed || err != nil {
 				return
 			}
 
+		case <-rm.Done():
+			// Flush the final ROOM_DESTROYED before hanging up
+			flushQueued(conn, rm.HostSendCh, nil)
+			closeWithReason(conn, rm.DestroyReason())
+			return
+
+		case <-ctx.Done():
+			return
+
 		case <-ticker.C:
-			conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := conn.Ping(); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func (h *Handler) heartbeatMonitor(rm *room.Room, roomID string) {
+func (h *Handler) heartbeatMonitor(ctx context.Context, rm *room.Room, roomID string) {
 	ticker := time.NewTicker(HeartbeatCheckInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		lastHB := rm.GetLastHeartbeat()
-		if time.Since(lastHB) > HeartbeatTimeout {
+	for {
+		select {
+		case <-ticker.C:
+		case <-rm.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+		if rm.SinceHeartbeat() > HeartbeatTimeout {
 			log.Printf("Heartbeat timeout: %s...", roomID[:8])
 			h.registry.DestroyRoom(roomID, "heartbeat_timeout")
 			return
 		}
 
-		// Check if room still exists
-		if h.registry.GetRoom(roomID) == nil {
-			return
+		for _, client := range rm.EnforceMemoryBudget(room.MaxRoomMemoryBytes, room.MemoryEvictionGrace) {
+			log.Printf("Client evicted over memory budget: %s... room: %s...", client.ID[:8], roomID[:8])
+			client.Conn.Close()
 		}
 	}
 }
 
-func (h *Handler) handleClientJoin(conn *websocket.Conn, roomID string, inviteToken string) {
-	// Check if room exists first
+func (h *Handler) handleClientJoin(ctx context.Context, conn Conn, roomID, inviteToken, fingerprint string) {
+	arrived := time.Now()
+	ctx, span := tracing.Start(ctx, "relay.join", tracing.Room(roomID))
+
+	// Check if room exists first, here or on another node
 	rm := h.registry.GetRoom(roomID)
 	if rm == nil {
-		sendError(conn, "Room not found")
+		rm = h.cluster.Proxy(roomID)
+	}
+	if rm == nil {
+		tracing.Fail(span, "room_not_found")
+		span.End()
+		sendError(conn, h.joinRefusal("Room not found", false, arrived))
 		conn.Close()
 		return
 	}
 
 	// Generate client ID
 	clientID := generateClientID()
+	span.SetAttributes(tracing.Client(clientID))
 
 	// If invite token provided, validate and consume it (optional - for invite link flow)
-	// Even with valid token, host must still approve the join request
+	// Even with valid token, host must still approve the join request.
+	// A valid token's scope becomes the client's role; otherwise it's a participant.
+	// A token is only spent if the join goes through: any failure below restores it.
+	role := room.RoleParticipant
+	var consumed *invite.Token
 	if inviteToken != "" {
-		tokenRoomID, err := h.inviteHandler.ConsumeToken(inviteToken)
+		token, err := h.inviteHandler.ConsumeToken(roomID, inviteToken, fingerprint)
 		if err != nil {
 			log.Printf("Client %s... invite token invalid: %v (host approval still required)", clientID[:8], err)
-		} else if tokenRoomID != roomID {
+		} else if token.RoomID != roomID {
+			h.inviteHandler.RestoreToken(token)
 			log.Printf("Client %s... token/room mismatch (host approval still required)", clientID[:8])
 		} else {
-			log.Printf("Client %s... has valid invite token for room %s...", clientID[:8], roomID[:8])
+			consumed = token
+			role = token.Scope
+			log.Printf("Client %s... has valid %s invite token for room %s...", clientID[:8], role, roomID[:8])
 		}
 	}
 
-	// Add client to room
-	client, err := rm.AddClient(clientID, conn)
+	// Add client to room, if its tenant may have another connected
+	var client *room.Client
+	err := h.acquireClient(rm)
+	if err == nil {
+		if client, err = rm.AddClientWithRole(clientID, conn, role); err != nil {
+			h.releaseClient(rm)
+		}
+	}
 	if err != nil {
-		sendError(conn, err.Error())
+		if consumed != nil {
+			h.inviteHandler.RestoreToken(consumed)
+		}
+		tracing.Fail(span, "add_failed")
+		span.End()
+		h.sendJoinRefusal(conn, err, consumed != nil, arrived)
 		conn.Close()
 		return
 	}
 
 	log.Printf("Client connected, awaiting host approval: %s... room: %s...", clientID[:8], roomID[:8])
+	connected := time.Now()
 
 	// Send connected message
-	sendJSON(conn, Message{Type: "CONNECTED", ClientID: clientID})
+	sendJSON(conn, Message{Type: "CONNECTED", ClientID: clientID, Role: string(role), ClientSecret: client.Secret()})
+	span.SetAttributes(tracing.AttrRole.String(string(role)))
+	span.End()
+
+	// The writer ending, for whatever reason, ends the reader too
+	ctx, cancel := hangUp(ctx, conn)
+	defer cancel()
+
+	// Cleanup, even if the reader panics
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic("client reader", r)
+		}
+		h.clientLeft(rm, clientID, roomID, connected)
+	}()
 
 	// Start writer goroutine
-	go h.clientWriter(client)
+	safeGo("client writer", func() {
+		defer cancel()
+		h.clientWriter(ctx, rm, client, conn)
+	}, cancel)
+	if h.joinTimeout > 0 {
+		safeGo("join timeout", func() { h.expireJoin(ctx, rm, client) }, nil)
+	}
 
 	// Read loop
-	h.clientReader(rm, client, roomID)
+	h.clientReader(ctx, rm, client, conn, roomID)
+}
 
-	// Cleanup
+// clientLeft removes a client whose reader has returned from its room and
+// tells the host
+func (h *Handler) clientLeft(rm *room.Room, clientID, roomID string, connected time.Time) {
 	rm.RemoveClient(clientID)
+	h.releaseClient(rm)
+	h.roomLimits(rm).RemoveClient(roomID, clientID)
+	metrics.Global.ObserveConnection(metrics.RoleClient, time.Since(connected))
 	log.Printf("Client left: %s... room: %s...", clientID[:8], roomID[:8])
 
 	// Notify host
-	select {
-	case rm.HostSendCh <- []byte(`{"type":"CLIENT_LEFT","clientId":"` + clientID + `"}`):
-	default:
+	rm.SendToHost([]byte(`{"type":"CLIENT_LEFT","clientId":"` + clientID + `"}`))
+}
+
+// handleClientResume puts a client moved off a drained node back in its
+// room under its old ID and role. The host approved it once already, so
+// it's confirmed straight away and the host told it's back.
+func (h *Handler) handleClientResume(ctx context.Context, conn Conn, roomID, resume string) {
+	ctx, span := tracing.Start(ctx, "relay.join", tracing.Room(roomID))
+
+	// The host may not have resumed the room yet; Rejoin waits for it
+	grant, err := h.cluster.Resume(roomID, resume, false)
+	var rm *room.Room
+	if err == nil {
+		rm = h.cluster.Rejoin(ctx, roomID, grant)
+	}
+	var client *room.Client
+	if rm != nil {
+		if err = h.acquireClient(rm); err == nil {
+			if client, err = rm.AddConfirmedClient(grant.ClientID, conn, grant.Role); err != nil {
+				h.releaseClient(rm)
+			}
+		}
+	}
+	if client == nil {
+		tracing.Fail(span, "resume_failed")
+		span.End()
+		if err != nil {
+			sendRefusal(conn, err)
+		} else {
+			sendError(conn, "Room not found")
+		}
+		conn.Close()
+		return
 	}
+	clientID := client.ID
+
+	log.Printf("Client resumed: %s... room: %s...", clientID[:8], roomID[:8])
+	connected := time.Now()
+
+	sendJSON(conn, Message{Type: "CONNECTED", ClientID: clientID, Role: string(grant.Role), ClientSecret: client.Secret()})
+	span.SetAttributes(tracing.Client(clientID), tracing.AttrRole.String(string(grant.Role)))
+	span.End()
+	if data, err := json.Marshal(Message{Type: "CLIENT_RESUMED", ClientID: clientID, Role: string(grant.Role)}); err == nil {
+		rm.SendToHost(data)
+	}
+
+	ctx, cancel := hangUp(ctx, conn)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic("client reader", r)
+		}
+		h.clientLeft(rm, clientID, roomID, connected)
+	}()
+
+	safeGo("client writer", func() {
+		defer cancel()
+		h.clientWriter(ctx, rm, client, conn)
+	}, cancel)
+	h.clientReader(ctx, rm, client, conn, roomID)
 }
 
-func (h *Handler) clientReader(rm *room.Room, client *room.Client, roomID string) {
-	conn := client.Conn
-	conn.SetReadLimit(MaxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-		return nil
-	})
+func (h *Handler) clientReader(ctx context.Context, rm *room.Room, client *room.Client, conn Conn, roomID string) {
+	// Spans the wait from JOIN_REQUEST to JOIN_CONFIRM
+	var approval trace.Span
+	defer func() {
+		if approval != nil {
+			tracing.Fail(approval, "left")
+			approval.End()
+		}
+	}()
 
+	tenant := h.tenantName(rm)
+	notices := limitNotices{tenant: tenant}
+	limits := h.roomLimits(rm)
+
+	// A frame's ciphertext, and the copies decoding it made, have been
+	// copied into what it was relayed as by the time the next is read, so
+	// they're zeroed then
+	var message []byte
+	var msg Message
+	defer func() { clear(message); msg.zero() }()
 	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
+		clear(message)
+		msg.zero()
+		var err error
+		if message, err = conn.ReadMessage(); err != nil {
 			return
 		}
 
-		var msg Message
+		msg = Message{}
 		if err := json.Unmarshal(message, &msg); err != nil {
 			continue
 		}
 
 		// Rate limit messages
-		if !h.msgLimiter.Allow(roomID, client.ID) {
+		if res := limits.Msg.TakeN(roomID, client.ID, 1); !res.Allowed {
+			if data := notices.next(res, LimitMessages); data != nil {
+				rm.SendToClient(client.ID, data)
+			}
+			continue
+		}
+
+		// Nothing a client says goes anywhere before the host lets it in, so
+		// it's dropped before it can spend the room's byte budget
+		if !client.Approved() && (msg.Type == "MESSAGE" || msg.Type == "KICK") {
+			continue
+		}
+
+		// Size-weighted budget so large media can't saturate the room
+		if res := limits.Bytes.TakeN(roomID, client.ID, len(message)); !res.Allowed {
+			if data := notices.next(res, LimitBytes); data != nil {
+				rm.SendToClient(client.ID, data)
+			}
+			continue
+		}
+
+		// The room's tenant pays for every byte relayed
+		if exceeded := h.chargeBytes(rm, len(message)); exceeded != nil {
+			if data := notices.exceeded(exceeded); data != nil {
+				rm.SendToClient(client.ID, data)
+			}
 			continue
 		}
 
 		switch msg.Type {
 		case "JOIN_REQUEST":
-			// Forward to host for approval
-			fwd := Message{
-				Type:     "JOIN_REQUEST",
-				ClientID: client.ID,
-				Payload:  msg.Payload,
+			if len(msg.Profile) > room.MaxProfileSize {
+				continue
+			}
+			if approval == nil {
+				_, approval = tracing.Start(ctx, "relay.approval", tracing.Room(roomID), tracing.Client(client.ID))
 			}
-			if data, err := json.Marshal(fwd); err == nil {
-				select {
-				case rm.HostSendCh <- data:
-				default:
+
+			// The room hands the profile to the other members once the
+			// client confirms, and theirs to it
+			if msg.Profile != nil {
+				if data, err := json.Marshal(Message{Type: "PROFILE", ClientID: client.ID, Profile: msg.Profile}); err == nil {
+					rm.SetProfile(client.ID, data)
 				}
 			}
 
-		case "JOIN_CONFIRM":
-			// Forward to host
-			fwd := Message{
-				Type:     "JOIN_CONFIRM",
+			// Forward to host for approval, with the role the invite granted
+			if data, err := json.Marshal(Message{
+				Type:     "JOIN_REQUEST",
 				ClientID: client.ID,
 				Payload:  msg.Payload,
+				Role:     string(client.Role),
+				Profile:  msg.Profile,
+			}); err == nil {
+				rm.SendToHost(data)
 			}
-			if data, err := json.Marshal(fwd); err == nil {
-				select {
-				case rm.HostSendCh <- data:
-				default:
-				}
+
+		case "JOIN_CONFIRM":
+			// Only the host's approval admits a client
+			if !client.Approved() {
+				continue
+			}
+			rm.ConfirmClient(client.ID)
+			if approval != nil {
+				approval.End()
+				approval = nil
 			}
 
+			// Forward to host
+			rm.SendToHost(encodeEnvelope("JOIN_CONFIRM", client.ID, msg.Payload))
+
 		case "MESSAGE":
+			// Observers receive only
+			if client.Role == room.RoleObserver {
+				continue
+			}
+
+			_, span := tracing.Start(context.Background(), "relay.message",
+				tracing.Room(roomID), tracing.Client(client.ID), tracing.AttrBytes.Int(len(msg.Payload)))
 			metrics.Global.IncMessages()
+			metrics.Global.IncTenantMessages(tenant)
+			metrics.Global.ObserveMessageSize(len(msg.Payload))
+			rm.RecordMessage(len(msg.Payload))
 
 			// Forward to host
-			fwd := Message{
-				Type:     "CLIENT_MESSAGE",
-				ClientID: client.ID,
-				Payload:  msg.Payload,
-			}
-			if data, err := json.Marshal(fwd); err == nil {
-				select {
-				case rm.HostSendCh <- data:
-				default:
-				}
-			}
+			rm.SendToHost(encodePadded("CLIENT_MESSAGE", client.ID, msg.Payload, rm.Padding()))
 
 			// Broadcast to other clients
-			bcast := Message{
-				Type:     "MESSAGE",
-				ClientID: client.ID,
-				Payload:  msg.Payload,
+			rm.BroadcastToOthers(client.ID, encodePadded("MESSAGE", client.ID, msg.Payload, rm.Padding()))
+			span.End()
+
+		case "KICK":
+			// Co-hosts may remove ordinary members, never the other co-hosts
+			if client.Role != room.RoleCoHost {
+				continue
 			}
-			if data, err := json.Marshal(bcast); err == nil {
-				rm.BroadcastToOthers(client.ID, data)
+			if target := rm.GetClient(msg.ClientID); target != nil && target.Role != room.RoleCoHost {
+				h.handleKick(rm, msg.ClientID)
 			}
+
+		case "CLIENT_ERROR":
+			h.handleClientError(rm, client.ID, msg.Category, msg.Payload)
 		}
 	}
 }
 
-func (h *Handler) clientWriter(client *room.Client) {
+func (h *Handler) clientWriter(ctx context.Context, rm *room.Room, client *room.Client, conn Conn) {
 	ticker := time.NewTicker(PingInterval)
 	defer ticker.Stop()
+	defer discardQueued(client.SendCh, client.Dequeued)
+	delay := jitter{max: rm.Jitter()}
 
 	for {
 		select {
-		case message, ok := <-client.SendCh:
-			if !ok {
-				client.Conn.Close()
-				return
-			}
-			client.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-			if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case message := <-client.SendCh:
+			client.Dequeued(len(message.Data))
+			delay.wait(message)
+			if _, err := writeCoalesced(conn, message, client.SendCh, client.Dequeued); err != nil {
 				return
 			}
 
+		case <-client.Done():
+			// Flush final frames (KICKED, ROOM_DESTROYED) before hanging up
+			flushQueued(conn, client.SendCh, client.Dequeued)
+			closeWithReason(conn, client.Reason())
+			return
+
+		case <-rm.Done():
+			// The room removed the client as it went, queuing ROOM_DESTROYED
+			flushQueued(conn, client.SendCh, client.Dequeued)
+			closeWithReason(conn, client.Reason())
+			return
+
+		case <-ctx.Done():
+			return
+
 		case <-ticker.C:
-			client.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := conn.Ping(); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// handleClientError records a client-reported protocol error and, if the
+// client attached an opaque diagnostic blob, forwards it to the host.
+// The relay never inspects the blob; only the category reaches metrics.
+func (h *Handler) handleClientError(rm *room.Room, clientID, category string, payload json.RawMessage) {
+	category = metrics.ClientErrorCategory(category)
+	metrics.Global.IncClientError(category)
+
+	if len(payload) == 0 || len(payload) > MaxClientErrorSize {
+		return
+	}
+
+	fwd := Message{
+		Type:     "CLIENT_ERROR",
+		ClientID: clientID,
+		Category: category,
+		Payload:  payload,
+	}
+	if data, err := json.Marshal(fwd); err == nil {
+		rm.SendToHost(data)
+	}
+}
+
 func (h *Handler) handleBroadcast(rm *room.Room, payload json.RawMessage) {
+	_, span := tracing.Start(context.Background(), "relay.broadcast", tracing.Room(rm.ID), tracing.AttrBytes.Int(len(payload)))
+	defer span.End()
+
 	metrics.Global.IncMessages()
-	msg := Message{Type: "MESSAGE", Payload: payload}
-	if data, err := json.Marshal(msg); err == nil {
-		rm.BroadcastToClients(data)
-	}
+	metrics.Global.IncTenantMessages(h.tenantName(rm))
+	metrics.Global.ObserveMessageSize(len(payload))
+	rm.RecordMessage(len(payload))
+	rm.BroadcastToClients(encodePadded("MESSAGE", "", payload, rm.Padding()))
 }
 
 func (h *Handler) handleDirect(rm *room.Room, clientID string, payload json.RawMessage) {
-	client := rm.GetClient(clientID)
-	if client == nil {
-		return
+	_, span := tracing.Start(context.Background(), "relay.direct",
+		tracing.Room(rm.ID), tracing.Client(clientID), tracing.AttrBytes.Int(len(payload)))
+	defer span.End()
+
+	metrics.Global.ObserveMessageSize(len(payload))
+	rm.RecordMessage(len(payload))
+	rm.SendToClient(clientID, encodePadded("MESSAGE", "", payload, rm.Padding()))
+}
+
+// handleJoinResponse passes the host's answer to a joiner on verbatim,
+// having first let its messages through if the host accepted it
+func (h *Handler) handleJoinResponse(rm *room.Room, clientID string, accepted bool, message []byte) {
+	if accepted && !rm.ApproveClient(clientID) {
+		h.cluster.Approve(rm, clientID)
 	}
+	rm.SendToClient(clientID, message)
+}
 
-	msg := Message{Type: "MESSAGE", Payload: payload}
-	if data, err := json.Marshal(msg); err == nil {
-		select {
-		case client.SendCh <- data:
-		default:
+// RoomStatsPayload is the payload of a ROOM_STATS reply
+type RoomStatsPayload struct {
+	Clients       int    `json:"clients"`
+	Pending       int    `json:"pending"`
+	Messages      uint64 `json:"messages"`
+	Bytes         uint64 `json:"bytes"`
+	Dropped       uint64 `json:"dropped"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// handleCreateInvite mints an invite for the host over its own socket.
+// Owning the host connection is the authorization, so no host secret is needed.
+// The optional payload is the same JSON the HTTP create endpoint accepts.
+func (h *Handler) handleCreateInvite(rm *room.Room, payload json.RawMessage) {
+	var req invite.CreateTokenRequest
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			h.sendInviteError(rm, "invalid request")
+			return
 		}
 	}
-}
 
-func (h *Handler) handleJoinResponse(rm *room.Room, clientID string, message []byte) {
-	client := rm.GetClient(clientID)
-	if client == nil {
+	resp, err := h.inviteHandler.CreateInvite(rm.ID, req)
+	if err != nil {
+		h.sendInviteError(rm, invite.CreateErrorReason(err))
 		return
 	}
 
-	select {
-	case client.SendCh <- message:
-	default:
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
 	}
+	rm.SendToHost(encodeEnvelope("INVITE_CREATED", "", data))
+}
+
+func (h *Handler) sendInviteError(rm *room.Room, reason string) {
+	if data, err := json.Marshal(Message{Type: "INVITE_ERROR", Reason: reason}); err == nil {
+		rm.SendToHost(data)
+	}
+}
+
+// handleRoomStats replies to the host with the room's counters so it can
+// tell whether the relay is dropping its traffic
+func (h *Handler) handleRoomStats(rm *room.Room) {
+	stats := rm.Stats()
+	payload, err := json.Marshal(RoomStatsPayload{
+		Clients:       stats.Clients,
+		Pending:       stats.Pending,
+		Messages:      stats.Messages,
+		Bytes:         stats.Bytes,
+		Dropped:       stats.Dropped,
+		UptimeSeconds: int64(stats.Uptime.Seconds()),
+	})
+	if err != nil {
+		return
+	}
+	rm.SendToHost(encodeEnvelope("ROOM_STATS", "", payload))
 }
 
 func (h *Handler) handleKick(rm *room.Room, clientID string) {
 	client := rm.GetClient(clientID)
 	if client == nil {
+		h.cluster.Kick(rm, clientID)
 		return
 	}
 
-	// Send kick message and close
-	kickMsg := []byte(`{"type":"KICKED","reason":"kicked_by_host"}`)
-	select {
-	case client.SendCh <- kickMsg:
-	default:
-	}
-
+	// Removing the client has its writer flush KICKED and hang up;
+	// closing the connection here could beat the frame out
+	rm.SendToClient(clientID, []byte(`{"type":"KICKED","reason":"kicked_by_host"}`))
 	rm.RemoveClient(clientID)
-	client.Conn.Close()
 }
 
 // Helper functions
 
 func extractRoomID(path string) string {
-	// Path format: /rooms/{roomId} or /rooms/{roomId}/join
+	// Path format: /rooms/{roomId} or /rooms/{roomId}/join, either with
+	// /sse appended for the event stream transport. A room in a namespace
+	// is /rooms/{namespace}/{roomId}, its ID the two together.
 	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) >= 2 && parts[0] == "rooms" {
-		return parts[1]
-	}
-	return ""
-}
-
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
+	if len(parts) < 2 || parts[0] != "rooms" {
+		return ""
 	}
-	// Check X-Real-IP
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	if len(parts) >= 3 {
+		if id := parts[1] + "/" + parts[2]; room.ValidID(id) {
+			return id
+		}
 	}
-	// Fall back to RemoteAddr
-	return strings.Split(r.RemoteAddr, ":")[0]
+	return parts[1]
 }
 
 func generateClientID() string {
@@ -494,16 +1231,15 @@ func generateClientID() string {
 	return string(b)
 }
 
-func sendJSON(conn *websocket.Conn, msg Message) {
+func sendJSON(conn Conn, msg Message) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return
 	}
-	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	conn.WriteMessage(websocket.TextMessage, data)
+	conn.WriteMessage(data)
 }
 
-func sendError(conn *websocket.Conn, errMsg string) {
+func sendError(conn Conn, errMsg string) {
 	msg := Message{Type: "ERROR", Reason: errMsg}
 	sendJSON(conn, msg)
 }
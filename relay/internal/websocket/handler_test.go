@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+var errBrokenPipe = errors.New("broken pipe")
+
+// peerConn is a Conn whose reads block until readable closes, by default
+// when it's closed, and whose writes are handed to the test, or fail once
+// it's broken
+type peerConn struct {
+	written  chan Message
+	closed   chan struct{}
+	readable chan struct{}
+	broken   atomic.Bool
+
+	once   sync.Once
+	reason string // the close frame's reason; set before closed closes
+}
+
+func newPeerConn() *peerConn {
+	c := &peerConn{written: make(chan Message, 64), closed: make(chan struct{})}
+	c.readable = c.closed
+	return c
+}
+
+func (c *peerConn) ReadMessage() ([]byte, error) {
+	<-c.readable
+	return nil, errBrokenPipe
+}
+
+func (c *peerConn) WriteMessage(data []byte) error {
+	if c.broken.Load() {
+		return errBrokenPipe
+	}
+	var msg Message
+	json.Unmarshal(bytes.Clone(data), &msg)
+	c.written <- msg
+	return nil
+}
+
+func (c *peerConn) Batch()       {}
+func (c *peerConn) Flush() error { return nil }
+func (c *peerConn) Ping() error  { return nil }
+func (c *peerConn) Close() error { return c.CloseWithReason("") }
+
+func (c *peerConn) CloseWithReason(reason string) error {
+	c.once.Do(func() {
+		c.reason = reason
+		close(c.closed)
+	})
+	return nil
+}
+
+// expect returns the next message written to c, failing unless it's of
+// type typ
+func (c *peerConn) expect(t *testing.T, typ string) Message {
+	t.Helper()
+	select {
+	case msg := <-c.written:
+		if msg.Type != typ {
+			t.Fatalf("Expected %s, got %+v", typ, msg)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %s within a second", typ)
+		return Message{}
+	}
+}
+
+// TestHostWriteFailureDestroysRoom verifies a host the relay can no
+// longer write to takes its room down at once: its clients are sent
+// ROOM_DESTROYED and hung up on with the reason, without waiting for the
+// host's reader or heartbeat to notice it's gone
+func TestHostWriteFailureDestroysRoom(t *testing.T) {
+	registry := room.NewRegistry()
+	limits := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	t.Cleanup(limits.Stop)
+	tokens := invite.NewTokenStore()
+	t.Cleanup(tokens.Stop)
+	h := NewHandler(registry, limits, invite.NewHandler(tokens, registry, limits, nil, nil), nil, nil, nil, nil)
+	roomID := fuzzRoomID()
+
+	// The host's reader doesn't notice it's been hung up on until the end
+	host := newPeerConn()
+	host.readable = make(chan struct{})
+	hostDone := make(chan struct{})
+	go func() {
+		defer close(hostDone)
+		h.serve(context.Background(), host, attachment{roomID: roomID})
+	}()
+	host.expect(t, "ROOM_CREATED")
+	rm := registry.GetRoom(roomID)
+	rm.OpenRoom()
+
+	client := newPeerConn()
+	go h.serve(context.Background(), client, attachment{roomID: roomID, join: true})
+	client.expect(t, "CONNECTED")
+
+	host.broken.Store(true)
+	rm.SendToHost([]byte(`{"type":"HEARTBEAT_ACK"}`))
+
+	if msg := client.expect(t, "ROOM_DESTROYED"); msg.Reason != "host_disconnected" {
+		t.Errorf("Expected host_disconnected, got %q", msg.Reason)
+	}
+	select {
+	case <-client.closed:
+		if client.reason != "host_disconnected" {
+			t.Errorf("Expected a close frame saying host_disconnected, got %q", client.reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the client hung up on")
+	}
+	if registry.GetRoom(roomID) != nil {
+		t.Error("Expected the room gone from the registry")
+	}
+
+	close(host.readable)
+	select {
+	case <-hostDone:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the host's handler to return")
+	}
+}
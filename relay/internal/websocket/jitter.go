@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"errors"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// MaxJitter is the longest random delay a host may ask for frames to be
+// held back
+const MaxJitter = 500 * time.Millisecond
+
+var errInvalidJitter = errors.New("invalid jitter")
+
+// parseJitter reads the longest delay a host asked for, empty or 0 for
+// none
+func parseJitter(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d > MaxJitter {
+		return 0, errInvalidJitter
+	}
+	return d, nil
+}
+
+// jitter holds a connection's frames back a random delay of up to max
+// past when they were queued, so when a frame leaves the relay says
+// little about when its sender sent it. Release times never go backwards,
+// which keeps frames in order; since the delay runs from when a frame
+// was queued, delays don't add up behind one another.
+type jitter struct {
+	max  time.Duration // 0 for none
+	last time.Time     // when the previous frame was released
+}
+
+// wait blocks until f may be written
+func (j *jitter) wait(f room.Frame) {
+	if j.max <= 0 {
+		return
+	}
+	release := f.Queued.Add(time.Duration(mrand.Int64N(int64(j.max) + 1)))
+	if release.Before(j.last) {
+		release = j.last
+	}
+	j.last = release
+
+	d := time.Until(release)
+	if d > 0 {
+		time.Sleep(d)
+	}
+	metrics.Global.ObserveJitter(max(d, 0))
+}
@@ -0,0 +1,43 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// TestParseJitter verifies delays beyond MaxJitter are refused
+func TestParseJitter(t *testing.T) {
+	for _, s := range []string{"", "0s", "1ms", "500ms"} {
+		if _, err := parseJitter(s); err != nil {
+			t.Errorf("Expected %q accepted, got %v", s, err)
+		}
+	}
+	for _, s := range []string{"501ms", "-1ms", "soon"} {
+		if _, err := parseJitter(s); err == nil {
+			t.Errorf("Expected %q refused", s)
+		}
+	}
+}
+
+// TestJitterDoesNotAccumulate verifies frames queued together are all
+// released within one maximum delay of being queued, in order
+func TestJitterDoesNotAccumulate(t *testing.T) {
+	j := jitter{max: 20 * time.Millisecond}
+	queued := time.Now()
+	var last time.Time
+	for range 10 {
+		j.wait(room.Frame{Queued: queued})
+		if j.last.Before(last) {
+			t.Errorf("Expected release times in order, got %v after %v", j.last, last)
+		}
+		last = j.last
+	}
+	if last.Sub(queued) > j.max {
+		t.Errorf("Expected every frame released within %v, the last after %v", j.max, last.Sub(queued))
+	}
+	if elapsed := time.Since(queued); elapsed > j.max+100*time.Millisecond {
+		t.Errorf("Expected delays not to add up, took %v", elapsed)
+	}
+}
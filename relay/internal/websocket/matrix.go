@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/matrix"
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tracing"
+)
+
+// Matrix event types carrying the relay protocol
+const (
+	MatrixAttachEvent  = "org.ephemeral.relay.attach"
+	MatrixMessageEvent = "org.ephemeral.relay.message"
+	// MaxMatrixFrame is the largest message that fits in an event under
+	// the homeserver's 64KiB cap
+	MaxMatrixFrame = 60 * 1024
+)
+
+// MatrixFrame is a MatrixMessageEvent's content: one relay message
+type MatrixFrame struct {
+	Frame string `json:"frame"`
+}
+
+// MatrixBridge lets a Matrix user take part in a room through a Matrix
+// application service, with the relay holding nothing but the attachment.
+//
+// The user invites the service's bot to a Matrix room, which it joins,
+// and sends a MatrixAttachEvent whose content is a TCPAttach (its type is
+// ignored). From then on the Matrix room is that user's connection: each
+// relay message comes and goes as a MatrixMessageEvent, passed through
+// untouched, so the Matrix client does the room's end-to-end encryption as
+// any other client would. Events from anyone else in the Matrix room are
+// ignored. The Matrix room itself must be unencrypted; the bot can't read
+// it otherwise, and what it carries is ciphertext already.
+//
+// Admission goes by the user's Matrix ID where other transports use an
+// address. The attachment ends, and the bot leaves, when the relay is
+// done with it, when the user leaves, or when the user sends nothing for
+// ReadTimeout. A message over MaxMatrixFrame ends it too.
+type MatrixBridge struct {
+	h      *Handler
+	client *matrix.Client
+
+	mu      sync.Mutex
+	portals map[string]*matrixConn // by Matrix room ID
+}
+
+// NewMatrixBridge creates a bridge acting through client. Its HandleEvent
+// takes the homeserver's pushes.
+func (h *Handler) NewMatrixBridge(client *matrix.Client) *MatrixBridge {
+	return &MatrixBridge{
+		h:       h,
+		client:  client,
+		portals: make(map[string]*matrixConn),
+	}
+}
+
+// HandleEvent acts on one pushed event. Events arrive in order and must
+// not be held up, so anything slow happens elsewhere.
+func (b *MatrixBridge) HandleEvent(ev matrix.Event) {
+	bot := b.client.UserID()
+	if ev.Sender == bot {
+		return
+	}
+	switch ev.Type {
+	case "m.room.member":
+		if ev.StateKey == nil {
+			return
+		}
+		membership := ev.Membership()
+		switch {
+		case *ev.StateKey == bot && membership == "invite":
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), matrix.RequestTimeout)
+				defer cancel()
+				if err := b.client.JoinRoom(ctx, ev.RoomID); err != nil {
+					log.Printf("Matrix bridge: join failed: %v", err)
+				}
+			}()
+		case membership == "leave" || membership == "ban":
+			if c := b.portal(ev.RoomID); c != nil && c.owner == *ev.StateKey {
+				c.Close()
+			}
+		}
+	case MatrixAttachEvent:
+		var at TCPAttach
+		json.Unmarshal(ev.Content, &at)
+		b.mu.Lock()
+		if b.portals[ev.RoomID] != nil {
+			// One attachment per Matrix room
+			b.mu.Unlock()
+			return
+		}
+		c := newMatrixConn(b.client, ev.RoomID, ev.Sender)
+		b.portals[ev.RoomID] = c
+		b.mu.Unlock()
+		go b.serve(c, at)
+	case MatrixMessageEvent:
+		c := b.portal(ev.RoomID)
+		if c == nil || c.owner != ev.Sender {
+			return
+		}
+		var f MatrixFrame
+		if json.Unmarshal(ev.Content, &f) != nil || f.Frame == "" {
+			return
+		}
+		c.deliver([]byte(f.Frame))
+	}
+}
+
+func (b *MatrixBridge) portal(roomID string) *matrixConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.portals[roomID]
+}
+
+// serve admits an attachment as ServeHTTP does a WebSocket upgrade, and
+// leaves the Matrix room once it's over
+func (b *MatrixBridge) serve(c *matrixConn, at TCPAttach) {
+	h := b.h
+	defer func() {
+		c.Close()
+		b.mu.Lock()
+		delete(b.portals, c.room)
+		b.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), matrix.RequestTimeout)
+		defer cancel()
+		b.client.LeaveRoom(ctx, c.room)
+	}()
+
+	if !room.ValidID(at.RoomID) {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeInvalidRoom)
+		sendError(c, "Invalid room ID")
+		return
+	}
+
+	// A draining node is handing its rooms to the others
+	if h.cluster.Draining() {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeDraining)
+		sendJSON(c, Message{Type: "ERROR", Reason: "Node draining", RetryAfterMs: 1000})
+		return
+	}
+
+	role := metrics.RoleHost
+	if at.Join {
+		role = metrics.RoleClient
+	}
+	ctx, span := tracing.Start(context.Background(), "relay.upgrade", tracing.Room(at.RoomID), tracing.AttrRole.String(role))
+
+	release, refused := h.admit(c.owner, at.Join, hostProof{}, http.Header{})
+	if refused != nil {
+		metrics.Global.IncUpgradeFailure(refused.outcome)
+		tracing.Fail(span, refused.outcome)
+		span.End()
+		msg := Message{Type: "ERROR", Reason: refused.message}
+		if secs, err := strconv.Atoi(refused.retryAfter); err == nil {
+			msg.RetryAfterMs = int64(secs) * 1000
+		}
+		sendJSON(c, msg)
+		return
+	}
+	defer release()
+	span.End()
+
+	h.serve(ctx, c, attachment{
+		roomID:      at.RoomID,
+		join:        at.Join,
+		token:       at.Token,
+		fingerprint: at.Fingerprint,
+		resume:      at.Resume,
+		pad:         at.Pad.String(),
+		cover:       at.Cover,
+		jitter:      at.Jitter,
+	})
+}
+
+// matrixConn is a Conn over a Matrix room, carrying one user's messages
+type matrixConn struct {
+	client *matrix.Client
+	room   string // the Matrix room ID
+	owner  string // the Matrix user attached
+	inbox  chan []byte
+
+	mu   sync.Mutex
+	seen time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMatrixConn(client *matrix.Client, room, owner string) *matrixConn {
+	return &matrixConn{
+		client: client,
+		room:   room,
+		owner:  owner,
+		inbox:  make(chan []byte, sessionInbox),
+		seen:   time.Now(),
+		done:   make(chan struct{}),
+	}
+}
+
+// deliver passes on a message from the owner. One arriving faster than
+// the room takes them ends the attachment, since the homeserver can't be
+// made to wait.
+func (c *matrixConn) deliver(data []byte) {
+	c.mu.Lock()
+	c.seen = time.Now()
+	c.mu.Unlock()
+	select {
+	case c.inbox <- data:
+	case <-c.done:
+	default:
+		c.Close()
+	}
+}
+
+// ReadMessage returns the owner's next message, failing once they've gone
+// ReadTimeout without one
+func (c *matrixConn) ReadMessage() ([]byte, error) {
+	for {
+		c.mu.Lock()
+		idle := time.Until(c.seen.Add(ReadTimeout))
+		c.mu.Unlock()
+		if idle <= 0 {
+			c.Close()
+			return nil, errPollIdle
+		}
+
+		timer := time.NewTimer(idle)
+		select {
+		case data := <-c.inbox:
+			timer.Stop()
+			return data, nil
+		case <-c.done:
+			timer.Stop()
+			return nil, errSessionClosed
+		case <-timer.C:
+		}
+	}
+}
+
+// WriteMessage sends data into the Matrix room as an event
+func (c *matrixConn) WriteMessage(data []byte) error {
+	if len(data) > MaxMatrixFrame {
+		c.Close()
+		return errFrameTooLarge
+	}
+	select {
+	case <-c.done:
+		return errSessionClosed
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WriteTimeout)
+	defer cancel()
+	return c.client.SendEvent(ctx, c.room, MatrixMessageEvent, MatrixFrame{Frame: string(data)})
+}
+
+// Batch and Flush have nothing to do: every message is its own event
+func (c *matrixConn) Batch()       {}
+func (c *matrixConn) Flush() error { return nil }
+
+// Ping only reports an attachment already over
+func (c *matrixConn) Ping() error {
+	select {
+	case <-c.done:
+		return errSessionClosed
+	default:
+		return nil
+	}
+}
+
+func (c *matrixConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ephemeral/relay/internal/matrix"
+)
+
+// TestMatrixBridgeRoutesOwnerOnly verifies only the attached user's events
+// reach the room, messages go back as events, and the user leaving ends it
+func TestMatrixBridgeRoutesOwnerOnly(t *testing.T) {
+	sent := make(chan string, 4)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var f MatrixFrame
+		json.NewDecoder(r.Body).Decode(&f)
+		sent <- f.Frame
+		w.Write([]byte(`{}`))
+	}))
+	defer hs.Close()
+	client, _ := matrix.NewClient(hs.URL, "as-secret", "@relay:hs")
+	b := (&Handler{}).NewMatrixBridge(client)
+	c := newMatrixConn(client, "!r:hs", "@alice:hs")
+	b.portals["!r:hs"] = c
+
+	event := func(sender, frame string) matrix.Event {
+		content, _ := json.Marshal(MatrixFrame{Frame: frame})
+		return matrix.Event{Type: MatrixMessageEvent, RoomID: "!r:hs", Sender: sender, Content: content}
+	}
+	b.HandleEvent(event("@mallory:hs", `{"type":"MESSAGE"}`))
+	b.HandleEvent(event("@alice:hs", `{"type":"HEARTBEAT"}`))
+	if got, err := c.ReadMessage(); err != nil || string(got) != `{"type":"HEARTBEAT"}` {
+		t.Errorf("Expected only the owner's message, got %q (%v)", got, err)
+	}
+
+	if err := c.WriteMessage([]byte(`{"type":"HEARTBEAT_ACK"}`)); err != nil || <-sent != `{"type":"HEARTBEAT_ACK"}` {
+		t.Errorf("Expected the message sent as an event, got %v", err)
+	}
+	if err := c.WriteMessage([]byte(strings.Repeat("x", MaxMatrixFrame+1))); err != errFrameTooLarge {
+		t.Errorf("Expected an oversized message to fail, got %v", err)
+	}
+
+	c = newMatrixConn(client, "!r:hs", "@alice:hs")
+	b.portals["!r:hs"] = c
+	alice := "@alice:hs"
+	b.HandleEvent(matrix.Event{Type: "m.room.member", RoomID: "!r:hs", Sender: alice, StateKey: &alice, Content: json.RawMessage(`{"membership":"leave"}`)})
+	if _, err := c.ReadMessage(); err != errSessionClosed {
+		t.Errorf("Expected the owner leaving to end the attachment, got %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tracing"
+)
+
+// MQTTTopicPrefix begins every room's topics: a peer subscribes to
+// rooms/{roomId}/out and publishes to rooms/{roomId}/in
+const MQTTTopicPrefix = "rooms/"
+
+// mqttMaxPacket bounds a packet's remaining length: a message and its topic
+const mqttMaxPacket = MaxMessageSize + 1024
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes
+const (
+	mqttAccepted       = 0
+	mqttBadVersion     = 1
+	mqttUnavailable    = 3
+	mqttBadCredentials = 4
+	mqttNotAuthorized  = 5
+)
+
+// mqttSubscribeFailed is a SUBACK's code for a refused subscription
+const mqttSubscribeFailed = 0x80
+
+var errMQTTProtocol = errors.New("MQTT protocol violation")
+
+// ServeMQTT takes MQTT 3.1.1 connections from ln until ln fails, so
+// devices with an MQTT stack and nothing else can join rooms. The relay
+// is not a broker: each connection is one host or client in one room.
+//
+// The CONNECT's username is "host" (or empty) or "join", and its password
+// the options a WebSocket URL would carry as a query, such as
+// "token=...&fingerprint=..." for a client, or a host's credential and
+// room options, "auth=...&pad=...". Admission answers with the CONNACK; a
+// refused peer gets "server unavailable" when trying later may help and
+// "not authorized" otherwise. The peer then subscribes to
+// rooms/{roomId}/out, which names the room, and receives the relay's
+// messages there. It publishes its own to rooms/{roomId}/in at QoS 0 or 1.
+// Unsubscribing or disconnecting leaves the room.
+//
+// The relay sends nothing unasked but its messages, so the peer's
+// keep-alive must be under ReadTimeout.
+func (h *Handler) ServeMQTT(ln net.Listener) error {
+	return acceptLoop(ln, h.serveMQTT)
+}
+
+// serveMQTT admits an MQTT connection as ServeHTTP does a WebSocket upgrade
+func (h *Handler) serveMQTT(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+
+	nc.SetReadDeadline(time.Now().Add(AttachTimeout))
+	p, err := readMQTTPacket(r)
+	if err != nil || p.kind != mqttConnect {
+		return
+	}
+	connect, code := parseMQTTConnect(p.body)
+	if code != mqttAccepted {
+		writeMQTTPacket(nc, mqttConnack<<4, []byte{0, code})
+		return
+	}
+
+	// A draining node is handing its rooms to the others
+	if h.cluster.Draining() {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeDraining)
+		writeMQTTPacket(nc, mqttConnack<<4, []byte{0, mqttUnavailable})
+		return
+	}
+
+	role := metrics.RoleHost
+	if connect.join {
+		role = metrics.RoleClient
+	}
+	ctx, span := tracing.Start(context.Background(), "relay.upgrade", tracing.AttrRole.String(role))
+
+	release, refused := h.admit(h.ips.ClientIP(&http.Request{RemoteAddr: nc.RemoteAddr().String()}), connect.join, hostProof{tls: tlsState(nc), credential: connect.options.Get("auth")}, http.Header{})
+	if refused != nil {
+		metrics.Global.IncUpgradeFailure(refused.outcome)
+		tracing.Fail(span, refused.outcome)
+		span.End()
+		code := byte(mqttNotAuthorized)
+		if refused.status == http.StatusServiceUnavailable {
+			code = mqttUnavailable
+		}
+		writeMQTTPacket(nc, mqttConnack<<4, []byte{0, code})
+		return
+	}
+	defer release()
+	if writeMQTTPacket(nc, mqttConnack<<4, []byte{0, mqttAccepted}) != nil {
+		span.End()
+		return
+	}
+
+	// The peer's subscription names the room
+	id, filters, err := awaitMQTTSubscribe(nc, r)
+	if err != nil {
+		span.End()
+		return
+	}
+	roomID := mqttRoom(filters)
+	if roomID == "" {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeInvalidRoom)
+		tracing.Fail(span, metrics.UpgradeInvalidRoom)
+		span.End()
+		writeMQTTPacket(nc, mqttSuback<<4, id, mqttRefusals(len(filters)))
+		return
+	}
+	span.SetAttributes(tracing.Room(roomID))
+	span.End()
+	if writeMQTTPacket(nc, mqttSuback<<4, id, []byte{0}) != nil {
+		return
+	}
+
+	conn := newMQTTConn(nc, r, roomID, connect.keepAlive)
+	h.serve(ctx, conn, attachment{
+		roomID:      roomID,
+		join:        connect.join,
+		credential:  connect.options.Get("auth"),
+		token:       connect.options.Get("token"),
+		fingerprint: connect.options.Get("fingerprint"),
+		resume:      connect.options.Get("resume"),
+		pad:         connect.options.Get("pad"),
+		cover:       connect.options.Get("cover"),
+		jitter:      connect.options.Get("jitter"),
+	})
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readMQTTPacket reads one control packet
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	n, shift := 0, 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errMQTTProtocol
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if n > mqttMaxPacket {
+		return mqttPacket{}, errFrameTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{kind: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// writeMQTTPacket writes a control packet whose fixed header starts with
+// header and whose remaining bytes are parts
+func writeMQTTPacket(w io.Writer, header byte, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	buf := []byte{header}
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// mqttString splits a length-prefixed string off the front of b
+func mqttString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, false
+	}
+	return string(b[2 : 2+n]), b[2+n:], true
+}
+
+func encodeMQTTString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+type mqttConnectRequest struct {
+	join      bool
+	options   url.Values
+	keepAlive time.Duration
+}
+
+// parseMQTTConnect reads a CONNECT's body, returning the CONNACK code to
+// refuse it with if it isn't acceptable
+func parseMQTTConnect(b []byte) (mqttConnectRequest, byte) {
+	var req mqttConnectRequest
+	name, b, ok := mqttString(b)
+	if !ok || name != "MQTT" || len(b) < 4 {
+		return req, mqttBadVersion
+	}
+	level, flags := b[0], b[1]
+	if level != 4 {
+		return req, mqttBadVersion
+	}
+	req.keepAlive = time.Duration(binary.BigEndian.Uint16(b[2:4])) * time.Second
+	b = b[4:]
+
+	// The client ID names nothing here, and the will is never sent
+	if _, b, ok = mqttString(b); !ok {
+		return req, mqttBadCredentials
+	}
+	if flags&0x04 != 0 {
+		if _, b, ok = mqttString(b); ok {
+			_, b, ok = mqttString(b)
+		}
+		if !ok {
+			return req, mqttBadCredentials
+		}
+	}
+
+	var username, password string
+	if flags&0x80 != 0 {
+		if username, b, ok = mqttString(b); !ok {
+			return req, mqttBadCredentials
+		}
+	}
+	if flags&0x40 != 0 {
+		if password, _, ok = mqttString(b); !ok {
+			return req, mqttBadCredentials
+		}
+	}
+	switch username {
+	case "", "host":
+	case "join":
+		req.join = true
+	default:
+		return req, mqttBadCredentials
+	}
+	options, err := url.ParseQuery(password)
+	if err != nil {
+		return req, mqttBadCredentials
+	}
+	req.options = options
+	return req, mqttAccepted
+}
+
+// awaitMQTTSubscribe answers pings until the peer subscribes, returning
+// the SUBSCRIBE's packet ID and topic filters
+func awaitMQTTSubscribe(nc net.Conn, r *bufio.Reader) ([]byte, []string, error) {
+	for {
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch p.kind {
+		case mqttPingreq:
+			if err := writeMQTTPacket(nc, mqttPingresp<<4); err != nil {
+				return nil, nil, err
+			}
+		case mqttSubscribe:
+			id, filters, ok := parseMQTTSubscribe(p)
+			if !ok {
+				return nil, nil, errMQTTProtocol
+			}
+			return id, filters, nil
+		case mqttDisconnect:
+			return nil, nil, io.EOF
+		default:
+			return nil, nil, errMQTTProtocol
+		}
+	}
+}
+
+// mqttRoom returns the room whose out topic is the only filter, or ""
+func mqttRoom(filters []string) string {
+	if len(filters) != 1 {
+		return ""
+	}
+	roomID, ok := strings.CutPrefix(filters[0], MQTTTopicPrefix)
+	if !ok {
+		return ""
+	}
+	roomID, ok = strings.CutSuffix(roomID, "/out")
+	if !ok || !room.ValidID(roomID) {
+		return ""
+	}
+	return roomID
+}
+
+// mqttRefusals is a SUBACK's return codes refusing n filters
+func mqttRefusals(n int) []byte {
+	codes := make([]byte, n)
+	for i := range codes {
+		codes[i] = mqttSubscribeFailed
+	}
+	return codes
+}
+
+// parseMQTTSubscribe returns a SUBSCRIBE's packet ID and topic filters
+func parseMQTTSubscribe(p mqttPacket) ([]byte, []string, bool) {
+	if p.flags != 0x02 || len(p.body) < 2 {
+		return nil, nil, false
+	}
+	id, b := p.body[:2], p.body[2:]
+	var filters []string
+	for len(b) > 0 {
+		filter, rest, ok := mqttString(b)
+		if !ok || len(rest) < 1 {
+			return nil, nil, false
+		}
+		filters = append(filters, filter)
+		b = rest[1:] // the requested QoS; everything is sent at QoS 0
+	}
+	return id, filters, len(filters) > 0
+}
+
+// mqttConn is a Conn over an MQTT connection subscribed to one room
+type mqttConn struct {
+	nc   net.Conn
+	r    *bufio.Reader
+	in   []byte // the topic the peer publishes to
+	out  []byte // the topic it's sent messages on, encoded
+	idle time.Duration
+
+	mu       sync.Mutex // guards w for the writer and the reader's replies
+	w        *bufio.Writer
+	batching bool
+}
+
+// newMQTTConn wraps a connection subscribed to roomID. As a broker does,
+// it drops a peer silent for half again its keep-alive, but never waits
+// longer than ReadTimeout.
+func newMQTTConn(nc net.Conn, r *bufio.Reader, roomID string, keepAlive time.Duration) *mqttConn {
+	idle := keepAlive * 3 / 2
+	if idle <= 0 || idle > ReadTimeout {
+		idle = ReadTimeout
+	}
+	nc.SetReadDeadline(time.Now().Add(idle))
+	return &mqttConn{
+		nc:   nc,
+		r:    r,
+		in:   []byte(MQTTTopicPrefix + roomID + "/in"),
+		out:  encodeMQTTString(MQTTTopicPrefix + roomID + "/out"),
+		idle: idle,
+		w:    bufio.NewWriterSize(nc, MaxCoalesceBytes),
+	}
+}
+
+// ReadMessage returns the next message the peer publishes, answering its
+// pings and acknowledgements along the way
+func (c *mqttConn) ReadMessage() ([]byte, error) {
+	for {
+		p, err := readMQTTPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		c.nc.SetReadDeadline(time.Now().Add(c.idle))
+
+		switch p.kind {
+		case mqttPublish:
+			qos := p.flags >> 1 & 0x03
+			topic, b, ok := mqttString(p.body)
+			if !ok || qos > 1 || topic != string(c.in) {
+				return nil, errMQTTProtocol
+			}
+			if qos == 1 {
+				if len(b) < 2 {
+					return nil, errMQTTProtocol
+				}
+				if err := c.reply(mqttPuback<<4, b[:2]); err != nil {
+					return nil, err
+				}
+				b = b[2:]
+			}
+			if len(b) > MaxMessageSize {
+				return nil, errFrameTooLarge
+			}
+			return b, nil
+		case mqttPingreq:
+			if err := c.reply(mqttPingresp << 4); err != nil {
+				return nil, err
+			}
+		case mqttSubscribe:
+			// One room per connection
+			id, filters, ok := parseMQTTSubscribe(p)
+			if !ok {
+				return nil, errMQTTProtocol
+			}
+			if err := c.reply(mqttSuback<<4, id, mqttRefusals(len(filters))); err != nil {
+				return nil, err
+			}
+		case mqttUnsubscribe:
+			if len(p.body) < 2 {
+				return nil, errMQTTProtocol
+			}
+			c.reply(mqttUnsuback<<4, p.body[:2])
+			return nil, io.EOF
+		case mqttDisconnect:
+			return nil, io.EOF
+		default:
+			return nil, errMQTTProtocol
+		}
+	}
+}
+
+// reply sends a control packet straight away, whatever batch is open
+func (c *mqttConn) reply(header byte, parts ...[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := writeMQTTPacket(c.w, header, parts...); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// WriteMessage publishes data to the room's out topic at QoS 0
+func (c *mqttConn) WriteMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := writeMQTTPacket(c.w, mqttPublish<<4, c.out, data); err != nil {
+		return err
+	}
+	if c.batching {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// Batch holds messages until Flush, to go out in one write
+func (c *mqttConn) Batch() {
+	c.mu.Lock()
+	c.batching = true
+	c.mu.Unlock()
+}
+
+func (c *mqttConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.w.Flush()
+}
+
+// Ping does nothing: an MQTT server can't ping, and the read deadline
+// catches a peer whose keep-alive has lapsed
+func (c *mqttConn) Ping() error {
+	return nil
+}
+
+func (c *mqttConn) Close() error {
+	return c.nc.Close()
+}
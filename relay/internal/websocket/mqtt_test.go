@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMQTTConn verifies pings and QoS 1 publishes are answered on read,
+// messages go out on the room's topic, and DISCONNECT ends the read
+func TestMQTTConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	roomID := strings.Repeat("a", 43)
+	c := newMQTTConn(server, bufio.NewReader(server), roomID, 10*time.Second)
+	defer c.Close()
+
+	replies := make(chan mqttPacket, 4)
+	go func() {
+		defer close(replies)
+		r := bufio.NewReader(client)
+		for {
+			p, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			replies <- p
+		}
+	}()
+	go func() {
+		writeMQTTPacket(client, mqttPingreq<<4)
+		writeMQTTPacket(client, mqttPublish<<4|0x02, encodeMQTTString("rooms/"+roomID+"/in"), []byte{0, 7}, []byte(`{"type":"HEARTBEAT"}`))
+		writeMQTTPacket(client, mqttDisconnect<<4)
+	}()
+
+	if got, err := c.ReadMessage(); err != nil || string(got) != `{"type":"HEARTBEAT"}` {
+		t.Errorf("Expected the published message, got %q (%v)", got, err)
+	}
+	if p := <-replies; p.kind != mqttPingresp {
+		t.Errorf("Expected PINGRESP, got type %d", p.kind)
+	}
+	if p := <-replies; p.kind != mqttPuback || string(p.body) != "\x00\x07" {
+		t.Errorf("Expected PUBACK for packet 7, got type %d %q", p.kind, p.body)
+	}
+	if _, err := c.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected DISCONNECT to end the read, got %v", err)
+	}
+
+	go c.WriteMessage([]byte(`{"type":"ROOM_CREATED"}`))
+	p := <-replies
+	topic, payload, _ := mqttString(p.body)
+	if p.kind != mqttPublish || topic != "rooms/"+roomID+"/out" || string(payload) != `{"type":"ROOM_CREATED"}` {
+		t.Errorf("Expected a publish on the out topic, got type %d %q %q", p.kind, topic, payload)
+	}
+}
+
+// TestParseMQTTConnect verifies the role and options come from the
+// CONNECT's credentials, and what isn't MQTT 3.1.1 is refused
+func TestParseMQTTConnect(t *testing.T) {
+	connect := func(level byte, username, password string) []byte {
+		b := append(encodeMQTTString("MQTT"), level, 0xc2, 0, 30)
+		b = append(b, encodeMQTTString("device-1")...)
+		b = append(b, encodeMQTTString(username)...)
+		return append(b, encodeMQTTString(password)...)
+	}
+
+	req, code := parseMQTTConnect(connect(4, "join", "token=abc&fingerprint=fp"))
+	if code != mqttAccepted || !req.join || req.options.Get("token") != "abc" || req.options.Get("fingerprint") != "fp" || req.keepAlive != 30*time.Second {
+		t.Errorf("Expected an accepted join, got %+v (code %d)", req, code)
+	}
+	if _, code := parseMQTTConnect(connect(4, "admin", "")); code != mqttBadCredentials {
+		t.Errorf("Expected an unknown role refused, got code %d", code)
+	}
+	if _, code := parseMQTTConnect(connect(3, "host", "")); code != mqttBadVersion {
+		t.Errorf("Expected MQTT 3.1 refused, got code %d", code)
+	}
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// Padding bounds. A room's buckets double from its smallest up to
+// PadCeiling; larger frames are padded to a multiple of PadCeiling, so
+// padding never costs more than a megabyte a frame.
+const (
+	MinPadBucket = 64
+	MaxPadBucket = 64 * 1024
+	PadCeiling   = 1024 * 1024
+)
+
+var errInvalidPadding = errors.New("invalid padding")
+
+// parsePadding reads the smallest padding bucket a host asked for, empty
+// or 0 for none
+func parsePadding(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	bucket, err := strconv.Atoi(s)
+	if err != nil || (bucket != 0 && (bucket < MinPadBucket || bucket > MaxPadBucket)) {
+		return 0, errInvalidPadding
+	}
+	return bucket, nil
+}
+
+// paddedSize is the bucket a frame of n bytes is padded to
+func paddedSize(n, bucket int) int {
+	if n > PadCeiling {
+		return (n + PadCeiling - 1) / PadCeiling * PadCeiling
+	}
+	size := bucket
+	for size < n {
+		size *= 2
+	}
+	return min(size, PadCeiling)
+}
+
+// encodePadded is encodeEnvelope padded with whitespace before the
+// closing brace up to the frame's bucket, so any JSON parser reads the
+// same message and an observer sees only the bucket. A bucket of 0 pads
+// nothing.
+func encodePadded(msgType, clientID string, payload []byte, bucket int) []byte {
+	data := encodeEnvelope(msgType, clientID, payload)
+	if bucket == 0 {
+		return data
+	}
+	size := paddedSize(len(data), bucket)
+	if size == len(data) {
+		return data
+	}
+	out := room.NewBuffer(size)
+	n := copy(out, data[:len(data)-1])
+	room.FreeBuffer(data)
+	for i := n; i < size-1; i++ {
+		out[i] = ' '
+	}
+	out[size-1] = '}'
+	return out
+}
@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestPaddedSize verifies frames round up to doubling buckets, then to
+// whole multiples of PadCeiling
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		n, bucket, want int
+	}{
+		{10, 256, 256},
+		{256, 256, 256},
+		{257, 256, 512},
+		{5000, 256, 8192},
+		{1000, 3000, 3000},
+		{900 * 1024, 3000, PadCeiling},
+		{PadCeiling + 1, 256, 2 * PadCeiling},
+	}
+	for _, tt := range tests {
+		if got := paddedSize(tt.n, tt.bucket); got != tt.want {
+			t.Errorf("Expected %d bytes padded to %d with bucket %d, got %d", tt.n, tt.want, tt.bucket, got)
+		}
+	}
+}
+
+// TestEncodePaddedParsesAsEnvelope verifies a padded frame fills its
+// bucket and decodes to the same message as an unpadded one
+func TestEncodePaddedParsesAsEnvelope(t *testing.T) {
+	payload := json.RawMessage(`{"ciphertext":"AAAA"}`)
+	data := encodePadded("MESSAGE", "0123456789abcdef", payload, 256)
+	if len(data) != 256 {
+		t.Errorf("Expected a 256 byte frame, got %d", len(data))
+	}
+
+	var padded, plain Message
+	if err := json.Unmarshal(data, &padded); err != nil {
+		t.Fatalf("Padded frame isn't JSON: %v", err)
+	}
+	json.Unmarshal(encodeEnvelope("MESSAGE", "0123456789abcdef", payload), &plain)
+	if !reflect.DeepEqual(padded, plain) {
+		t.Errorf("Expected %+v, got %+v", plain, padded)
+	}
+
+	if got := encodePadded("MESSAGE", "", payload, 0); len(got) != len(encodeEnvelope("MESSAGE", "", payload)) {
+		t.Errorf("Expected no padding with bucket 0, got %d bytes", len(got))
+	}
+}
+
+// TestParsePadding verifies buckets outside the bounds are refused
+func TestParsePadding(t *testing.T) {
+	for _, s := range []string{"", "0", "64", "65536"} {
+		if _, err := parsePadding(s); err != nil {
+			t.Errorf("Expected %q accepted, got %v", s, err)
+		}
+	}
+	for _, s := range []string{"63", "65537", "-1", "big"} {
+		if _, err := parsePadding(s); err == nil {
+			t.Errorf("Expected %q refused", s)
+		}
+	}
+}
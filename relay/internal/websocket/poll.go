@@ -0,0 +1,264 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Long-poll timing and limits
+const (
+	// PollWait is how long a poll is held open with nothing to return.
+	// It stays under the idle timeouts of the proxies long-polling is for.
+	PollWait = 25 * time.Second
+	// PollLinger is how long a finished session's last messages wait to be
+	// collected
+	PollLinger = PollWait + 5*time.Second
+	// MaxPollBacklog bounds the bytes waiting for the peer's next poll;
+	// past it the writer blocks, as it would on a full socket
+	MaxPollBacklog = 2 * MaxMessageSize
+)
+
+var errPollIdle = errors.New("peer stopped polling")
+
+// PollResponse answers a poll
+type PollResponse struct {
+	Session  string   `json:"session,omitempty"` // the first poll only
+	Cursor   int64    `json:"cursor"`            // pass on the next poll to acknowledge these messages
+	Messages []string `json:"messages"`          // relay messages, each a JSON text
+	Closed   bool     `json:"closed,omitempty"`  // the session is over; nothing follows
+}
+
+// pollConn is a Conn over HTTP long-polling, for networks where neither
+// WebSockets nor event streams survive. A GET to a room's URL with /poll
+// appended opens the session, answering as the first poll does. Later
+// polls are GETs with the session secret in the Relay-Session header and
+// ?cursor= the previous answer's cursor. A poll returns every message
+// after the cursor, waiting up to PollWait for one; messages are only
+// dropped once a later poll acknowledges them, so a lost answer is simply
+// polled again. The peer POSTs its own messages to the same URL.
+//
+// A peer that doesn't poll or POST for ReadTimeout is disconnected.
+type pollConn struct {
+	*httpSession
+	sessions *sessions
+
+	mu      sync.Mutex
+	pending []polled // not yet acknowledged
+	bytes   int      // in pending
+	seq     int64    // the latest message's
+	seen    time.Time
+	ended   bool          // the session's handler has returned
+	changed chan struct{} // closed and replaced when pending or ended change
+}
+
+type polled struct {
+	seq  int64
+	data []byte
+}
+
+// openPoll starts a long-poll session for roomID
+func (s *sessions) openPoll(roomID string) (*pollConn, error) {
+	sess, err := newHTTPSession(roomID)
+	if err != nil {
+		return nil, err
+	}
+	c := &pollConn{
+		httpSession: sess,
+		sessions:    s,
+		seen:        time.Now(),
+		changed:     make(chan struct{}),
+	}
+	s.add(c)
+	return c, nil
+}
+
+// servePoll answers a poll on an open session
+func (s *sessions) servePoll(w http.ResponseWriter, r *http.Request, roomID string) {
+	allowCORS(w)
+	c, _ := s.lookup(r, roomID).(*pollConn)
+	if c == nil {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	cursor, err := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	c.serve(w, r, cursor, false)
+}
+
+func (c *pollConn) session() *httpSession {
+	return c.httpSession
+}
+
+// touch records that the peer is still there
+func (c *pollConn) touch() {
+	c.mu.Lock()
+	c.seen = time.Now()
+	c.mu.Unlock()
+}
+
+// notify wakes pollers and a blocked writer; c.mu must be held
+func (c *pollConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// serve acknowledges everything up to cursor and answers with what
+// follows, once there is something
+func (c *pollConn) serve(w http.ResponseWriter, r *http.Request, cursor int64, first bool) {
+	c.touch()
+	defer c.touch()
+	wait := time.NewTimer(PollWait)
+	defer wait.Stop()
+
+	c.mu.Lock()
+	acked := 0
+	for acked < len(c.pending) && c.pending[acked].seq <= cursor {
+		c.bytes -= len(c.pending[acked].data)
+		clear(c.pending[acked].data)
+		acked++
+	}
+	if acked > 0 {
+		c.pending = append([]polled(nil), c.pending[acked:]...)
+		c.notify()
+	}
+
+	waited := false
+	for len(c.pending) == 0 && !c.ended && !waited {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-wait.C:
+			waited = true
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+	}
+
+	resp := PollResponse{Cursor: cursor, Messages: make([]string, 0, len(c.pending)), Closed: c.ended}
+	for _, m := range c.pending {
+		resp.Messages = append(resp.Messages, string(m.data))
+		resp.Cursor = m.seq
+	}
+	c.mu.Unlock()
+
+	if first {
+		resp.Session = c.id
+		w.Header().Set(SessionHeader, c.id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ReadMessage returns the next POSTed message, failing once the peer has
+// gone ReadTimeout without polling or posting
+func (c *pollConn) ReadMessage() ([]byte, error) {
+	for {
+		c.mu.Lock()
+		idle := time.Until(c.seen.Add(ReadTimeout))
+		c.mu.Unlock()
+		if idle <= 0 {
+			c.Close()
+			return nil, errPollIdle
+		}
+
+		timer := time.NewTimer(idle)
+		select {
+		case data := <-c.inbox:
+			timer.Stop()
+			c.touch()
+			return data, nil
+		case <-c.done:
+			timer.Stop()
+			return nil, errSessionClosed
+		case <-timer.C:
+		}
+	}
+}
+
+// WriteMessage queues data for the next poll, waiting up to WriteTimeout
+// for the backlog to drain
+func (c *pollConn) WriteMessage(data []byte) error {
+	deadline := time.NewTimer(WriteTimeout)
+	defer deadline.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.ended && c.bytes > 0 && c.bytes+len(data) > MaxPollBacklog {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-c.done:
+		case <-deadline.C:
+			c.mu.Lock()
+			return errPollIdle
+		}
+		c.mu.Lock()
+		select {
+		case <-c.done:
+			return errSessionClosed
+		default:
+		}
+	}
+	if c.ended {
+		return errSessionClosed
+	}
+
+	c.seq++
+	c.pending = append(c.pending, polled{seq: c.seq, data: append([]byte(nil), data...)})
+	c.bytes += len(data)
+	c.notify()
+	return nil
+}
+
+// Batch and Flush have nothing to do: a poll collects whatever is queued
+func (c *pollConn) Batch()       {}
+func (c *pollConn) Flush() error { return nil }
+
+// Ping fails once the peer has stopped polling
+func (c *pollConn) Ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.seen) > ReadTimeout {
+		return errPollIdle
+	}
+	return nil
+}
+
+// finish ends the session as its handler returns. Its last messages are
+// kept for PollLinger so the peer can still collect them.
+func (c *pollConn) finish() {
+	c.Close()
+	c.mu.Lock()
+	c.ended = true
+	c.notify()
+	c.mu.Unlock()
+
+	time.AfterFunc(PollLinger, func() {
+		c.sessions.remove(c)
+		c.discard()
+	})
+}
+
+// discard zeroes what was left unread in both directions once the
+// session is gone
+func (c *pollConn) discard() {
+	c.httpSession.discard()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.pending {
+		clear(m.data)
+	}
+	c.pending = nil
+	c.bytes = 0
+}
@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestPollConn verifies polls return what was written after their cursor,
+// a lost answer can be polled again, and the session's end is reported
+func TestPollConn(t *testing.T) {
+	sessions := newSessions()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			sessions.serveUpstream(w, r, "room")
+			return
+		case r.Header.Get(SessionHeader) != "":
+			sessions.servePoll(w, r, "room")
+			return
+		}
+		c, err := sessions.openPoll("room")
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.finish()
+			c.WriteMessage([]byte(`{"type":"CONNECTED"}`))
+			for {
+				msg, err := c.ReadMessage()
+				if err != nil || string(msg) == "bye" {
+					return
+				}
+				c.WriteMessage(msg)
+			}
+		}()
+		c.serve(w, r, 0, true)
+	}))
+	defer srv.Close()
+
+	poll := func(secret string, cursor int64) PollResponse {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"?cursor="+strconv.FormatInt(cursor, 10), nil)
+		if secret != "" {
+			req.Header.Set(SessionHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var pr PollResponse
+		if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+			t.Fatalf("Expected a poll response, got status %d: %v", resp.StatusCode, err)
+		}
+		return pr
+	}
+	post := func(secret, body string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		req.Header.Set(SessionHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204 for a delivered message, got %d", resp.StatusCode)
+		}
+	}
+
+	first := poll("", 0)
+	if first.Session == "" {
+		t.Fatal("Expected the first poll to carry the session secret")
+	}
+	if len(first.Messages) != 1 || first.Messages[0] != `{"type":"CONNECTED"}` || first.Cursor != 1 {
+		t.Errorf("Expected CONNECTED at cursor 1, got %v at %d", first.Messages, first.Cursor)
+	}
+
+	post(first.Session, `{"type":"HEARTBEAT"}`)
+	got := poll(first.Session, first.Cursor)
+	if len(got.Messages) != 1 || got.Messages[0] != `{"type":"HEARTBEAT"}` || got.Cursor != 2 {
+		t.Errorf("Expected the echo at cursor 2, got %v at %d", got.Messages, got.Cursor)
+	}
+	again := poll(first.Session, first.Cursor)
+	if len(again.Messages) != 1 || again.Cursor != 2 {
+		t.Errorf("Expected an unacknowledged message to be polled again, got %v at %d", again.Messages, again.Cursor)
+	}
+
+	post(first.Session, "bye")
+	if end := poll(first.Session, got.Cursor); !end.Closed || len(end.Messages) != 0 {
+		t.Errorf("Expected the session reported closed, got %+v", end)
+	}
+}
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ephemeral/relay/internal/hostauth"
+	"github.com/ephemeral/relay/internal/quota"
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// tenantQuota returns the quota of rm's tenant, zero for rooms of no
+// tenant
+func (h *Handler) tenantQuota(rm *room.Room) hostauth.Quota {
+	if t := h.tenants.Get(rm.Tenant()); t != nil {
+		return t.Quota
+	}
+	return hostauth.Quota{}
+}
+
+// acquireClient takes one of the clients rm's tenant may have connected.
+// A nil error must be matched by releaseClient.
+func (h *Handler) acquireClient(rm *room.Room) error {
+	return h.registry.Quotas().Acquire(rm.Tenant(), quota.Clients, int64(h.tenantQuota(rm).Clients))
+}
+
+func (h *Handler) releaseClient(rm *room.Room) {
+	h.registry.Quotas().Release(rm.Tenant(), quota.Clients)
+}
+
+// chargeBytes meters a frame of n bytes relayed in rm against its
+// tenant's hourly quota, nil if it may be relayed
+func (h *Handler) chargeBytes(rm *room.Room, n int) *quota.ExceededError {
+	var exceeded *quota.ExceededError
+	if rm.Tenant() == "" {
+		return nil
+	}
+	err := h.registry.Quotas().Charge(rm.Tenant(), int64(n), h.tenantQuota(rm).BytesPerHour)
+	if errors.As(err, &exceeded) {
+		return exceeded
+	}
+	return nil
+}
+
+// sendRefusal tells conn err refused it. A quota is named, with how long
+// until the window turns over for bytes; anything else is a plain ERROR.
+func sendRefusal(conn Conn, err error) {
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		sendError(conn, err.Error())
+		return
+	}
+	sendJSON(conn, Message{
+		Type:         "ERROR",
+		Reason:       exceeded.Error(),
+		Quota:        string(exceeded.Resource),
+		RetryAfterMs: exceeded.RetryAfter.Milliseconds(),
+	})
+}
+
+// sendJoinRefusal refuses a joiner for err: as sendRefusal does to
+// insiders, or to anyone without uniform join errors, and otherwise with
+// joinRefusal's reason
+func (h *Handler) sendJoinRefusal(conn Conn, err error, insider bool, arrived time.Time) {
+	if insider || !h.uniformErrors {
+		sendRefusal(conn, err)
+		return
+	}
+	sendError(conn, h.joinRefusal(err.Error(), insider, arrived))
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/quota"
+	"github.com/ephemeral/relay/internal/ratelimit"
+)
+
+// RATE_LIMITED reasons
+const (
+	LimitMessages = "messages" // message count budget
+	LimitBytes    = "bytes"    // payload byte budget
+	LimitQuota    = "quota"    // the room's tenant's quota, named in the notice
+)
+
+// MinNoticeInterval spaces RATE_LIMITED notices when the retry hint is tiny
+const MinNoticeInterval = time.Second
+
+// limitNotices tells one sender its frames are being dropped. A notice is
+// sent at most once per retry period, so a flooding sender isn't answered
+// frame for frame. Owned by the sender's read loop; not safe for sharing.
+type limitNotices struct {
+	tenant     string // the name of the room's tenant, "" for none
+	quietUntil time.Time
+}
+
+// next counts a refused frame and returns the RATE_LIMITED notice for
+// it, or nil while an earlier notice still covers it
+func (n *limitNotices) next(res ratelimit.Result, reason string) []byte {
+	metrics.Global.IncRateLimited(metrics.ScopeMessage, metrics.CauseLimiter)
+	metrics.Global.IncTenantRateLimited(n.tenant)
+	return n.notice(Message{Type: "RATE_LIMITED", Reason: reason}, res.RetryAfter)
+}
+
+// exceeded is next for a frame refused by the room's tenant's quota
+func (n *limitNotices) exceeded(e *quota.ExceededError) []byte {
+	metrics.Global.IncRateLimited(metrics.ScopeMessage, metrics.CauseQuota)
+	metrics.Global.IncTenantRateLimited(n.tenant)
+	return n.notice(Message{Type: "RATE_LIMITED", Reason: LimitQuota, Quota: string(e.Resource)}, e.RetryAfter)
+}
+
+// notice returns msg with its retry hint set, or nil while an earlier
+// notice still covers it
+func (n *limitNotices) notice(msg Message, retryAfter time.Duration) []byte {
+	now := time.Now()
+	if now.Before(n.quietUntil) {
+		return nil
+	}
+	n.quietUntil = now.Add(max(retryAfter, MinNoticeInterval))
+
+	msg.RetryAfterMs = retryAfter.Milliseconds()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return data
+}
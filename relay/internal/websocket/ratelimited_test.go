@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/ratelimit"
+)
+
+// TestLimitNoticesThrottled verifies a flooding sender gets one notice per retry period
+func TestLimitNoticesThrottled(t *testing.T) {
+	var notices limitNotices
+	res := ratelimit.Result{RetryAfter: 1500 * time.Millisecond}
+
+	data := notices.next(res, LimitBytes)
+	if data == nil {
+		t.Fatal("First refusal should produce a notice")
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Notice should be valid JSON: %v", err)
+	}
+	if msg.Type != "RATE_LIMITED" || msg.Reason != LimitBytes || msg.RetryAfterMs != 1500 {
+		t.Errorf("Unexpected notice: %+v", msg)
+	}
+
+	if notices.next(res, LimitBytes) != nil {
+		t.Error("Refusals within the retry period should not produce more notices")
+	}
+
+	notices.quietUntil = time.Now().Add(-time.Millisecond)
+	if notices.next(res, LimitMessages) == nil {
+		t.Error("A refusal after the quiet period should produce a notice")
+	}
+}
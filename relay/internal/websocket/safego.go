@@ -0,0 +1,32 @@
+package websocket
+
+import (
+	"log"
+	"runtime/debug"
+
+	"github.com/ephemeral/relay/internal/metrics"
+)
+
+// safeGo runs fn on a goroutine of its own. A panic in fn is logged and
+// counted instead of taking the relay down; cleanup, if not nil, then runs
+// so the room or client fn served isn't left half alive without it.
+func safeGo(what string, fn func(), cleanup func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(what, r)
+				if cleanup != nil {
+					cleanup()
+				}
+			}
+		}()
+		fn()
+	}()
+}
+
+// logPanic reports a recovered panic. The stack holds no frame contents,
+// only code locations and argument words.
+func logPanic(what string, r any) {
+	metrics.Global.IncPanics()
+	log.Printf("Panic in %s: %v\n%s", what, r, debug.Stack())
+}
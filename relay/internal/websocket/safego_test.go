@@ -0,0 +1,23 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSafeGoRecovers verifies a panicking goroutine runs its cleanup
+// instead of crashing the process, and that one returning normally doesn't
+func TestSafeGoRecovers(t *testing.T) {
+	cleaned := make(chan struct{})
+	safeGo("test", func() { panic("boom") }, func() { close(cleaned) })
+	select {
+	case <-cleaned:
+	case <-time.After(time.Second):
+		t.Fatal("Expected cleanup after a panic")
+	}
+
+	done := make(chan struct{})
+	safeGo("test", func() { close(done) }, func() { t.Error("Expected no cleanup without a panic") })
+	<-done
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import "io"
+
+// growZeroed returns b with room for n more bytes. If it has to move b to
+// a larger array, it zeroes the one left behind, since what the relay
+// buffers is ciphertext.
+func growZeroed(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	grown := make([]byte, len(b), max(2*cap(b), len(b)+n))
+	copy(grown, b)
+	clear(b)
+	return grown
+}
+
+// readZeroed reads r to the end like io.ReadAll, zeroing every buffer it
+// outgrows, and what it read if it fails
+func readZeroed(r io.Reader) ([]byte, error) {
+	b := make([]byte, 0, 512)
+	for {
+		b = growZeroed(b, 1)
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			clear(b)
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestGrowZeroed verifies a buffer is moved only when it must be, and
+// that the array it leaves behind is zeroed
+func TestGrowZeroed(t *testing.T) {
+	b := append(make([]byte, 0, 4), "abc"...)
+	if grown := growZeroed(b, 1); &grown[0] != &b[0] {
+		t.Error("Expected a buffer with room kept")
+	}
+
+	grown := growZeroed(b, 2)
+	if string(grown) != "abc" || cap(grown) < 5 {
+		t.Errorf("Expected abc with room for 2 more, got %q cap %d", grown, cap(grown))
+	}
+	if !bytes.Equal(b[:cap(b)], make([]byte, 4)) {
+		t.Errorf("Expected the old array zeroed, got %q", b[:cap(b)])
+	}
+}
+
+// errReader returns its data and then fails
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, e.err
+	}
+	return n, err
+}
+
+// TestReadZeroed verifies a body is read whole across several grows, and
+// that a failed read returns nothing
+func TestReadZeroed(t *testing.T) {
+	body := strings.Repeat("ciphertext", 1000)
+	got, err := readZeroed(strings.NewReader(body))
+	if err != nil || string(got) != body {
+		t.Errorf("Expected the whole body, got %d bytes, %v", len(got), err)
+	}
+
+	broken := errors.New("broken")
+	if got, err := readZeroed(&errReader{strings.NewReader(body), broken}); err != broken || got != nil {
+		t.Errorf("Expected the read error and nothing read, got %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// SessionHeader carries an HTTP fallback session's secret on the requests
+// that make it up after the first
+const SessionHeader = "Relay-Session"
+
+// sessionInbox is how many POSTed messages may wait for the reader before
+// further POSTs block
+const sessionInbox = 16
+
+var errSessionClosed = errors.New("session closed")
+
+// httpSession is what the HTTP fallback transports share: a secret naming
+// the session on each request, and an inbox for the messages the peer
+// POSTs, one per request. A peer waits for each POST to be answered
+// before sending the next, so they stay in order.
+//
+// In a cluster a session's requests must all reach the node holding it;
+// the load balancer can key on the Relay-Session header.
+type httpSession struct {
+	id     string
+	roomID string
+	inbox  chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHTTPSession(roomID string) (*httpSession, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &httpSession{
+		id:     base64.RawURLEncoding.EncodeToString(b),
+		roomID: roomID,
+		inbox:  make(chan []byte, sessionInbox),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// read returns the next POSTed message
+func (s *httpSession) read(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-s.inbox:
+		return data, nil
+	case <-s.done:
+		return nil, errSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close ends the session
+func (s *httpSession) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// discard zeroes the messages the peer POSTed that were never read, once
+// the session is over
+func (s *httpSession) discard() {
+	for {
+		select {
+		case data := <-s.inbox:
+			clear(data)
+		default:
+			return
+		}
+	}
+}
+
+// sessionConn is a Conn made of HTTP requests tied together by a session
+type sessionConn interface {
+	Conn
+	session() *httpSession
+}
+
+// sessions indexes the open HTTP fallback sessions by secret
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]sessionConn
+}
+
+func newSessions() *sessions {
+	return &sessions{m: make(map[string]sessionConn)}
+}
+
+func (s *sessions) add(c sessionConn) {
+	s.mu.Lock()
+	s.m[c.session().id] = c
+	s.mu.Unlock()
+}
+
+func (s *sessions) remove(c sessionConn) {
+	s.mu.Lock()
+	delete(s.m, c.session().id)
+	s.mu.Unlock()
+}
+
+// lookup finds the session named by r's Relay-Session header, if it
+// belongs to roomID
+func (s *sessions) lookup(r *http.Request, roomID string) sessionConn {
+	id := r.Header.Get(SessionHeader)
+	if id == "" {
+		return nil
+	}
+	s.mu.Lock()
+	c := s.m[id]
+	s.mu.Unlock()
+	if c == nil || c.session().roomID != roomID {
+		return nil
+	}
+	return c
+}
+
+// allowCORS lets browser peers on other origins use the fallback
+// transports, as the WebSocket upgrader does
+func allowCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", SessionHeader)
+}
+
+// servePreflight answers a CORS preflight for a fallback transport
+func servePreflight(w http.ResponseWriter) {
+	allowCORS(w)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", SessionHeader+", Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveUpstream takes a message POSTed to an open session
+func (s *sessions) serveUpstream(w http.ResponseWriter, r *http.Request, roomID string) {
+	allowCORS(w)
+	c := s.lookup(r, roomID)
+	if c == nil {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	sess := c.session()
+
+	data, err := readZeroed(http.MaxBytesReader(w, r.Body, MaxMessageSize))
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		// As with a WebSocket over its read limit, the session ends
+		c.Close()
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case sess.inbox <- data:
+		w.WriteHeader(http.StatusNoContent)
+	case <-sess.done:
+		http.Error(w, "Session closed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseConn is a Conn over Server-Sent Events, for peers behind proxies that
+// won't pass a WebSocket. A GET to a room's URL with /sse appended opens
+// the stream: its first event, "session", carries the session secret, and
+// every other event is one relay message. The peer POSTs its own messages
+// to the same URL.
+type sseConn struct {
+	*httpSession
+	sessions *sessions
+	ctx      context.Context // the stream request's
+
+	mu       sync.Mutex // guards w for the writer and finish
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	batching bool
+	ended    bool // the stream's handler has returned; w is off limits
+}
+
+// openSSE starts an event stream for roomID on w. The caller must call
+// finish before its handler returns.
+func (s *sessions) openSSE(w http.ResponseWriter, r *http.Request, roomID string) (*sseConn, error) {
+	sess, err := newHTTPSession(roomID)
+	if err != nil {
+		return nil, err
+	}
+	c := &sseConn{
+		httpSession: sess,
+		sessions:    s,
+		ctx:         r.Context(),
+		w:           w,
+		rc:          http.NewResponseController(w),
+	}
+
+	allowCORS(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep buffering reverse proxies from holding events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	c.rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := io.WriteString(w, "event: session\ndata: {\"session\":\""+c.id+"\"}\n\n"); err != nil {
+		return nil, err
+	}
+	if err := c.rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	s.add(c)
+	return c, nil
+}
+
+func (c *sseConn) session() *httpSession {
+	return c.httpSession
+}
+
+func (c *sseConn) ReadMessage() ([]byte, error) {
+	return c.read(c.ctx)
+}
+
+// WriteMessage sends data as one event. A line break in the message
+// starts another data line, which the peer's parser joins back up. The
+// event is zeroed once written, as data is.
+func (c *sseConn) WriteMessage(data []byte) error {
+	lines := bytes.Count(data, []byte("\n")) + 1
+	ev := make([]byte, 0, len(data)+lines*len("data: \n")+1)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		ev = append(ev, "data: "...)
+		ev = append(ev, line...)
+		ev = append(ev, '\n')
+	}
+	ev = append(ev, '\n')
+	defer clear(ev)
+	return c.write(ev)
+}
+
+func (c *sseConn) Batch() {
+	c.mu.Lock()
+	c.batching = true
+	c.mu.Unlock()
+}
+
+func (c *sseConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	if c.ended {
+		return errSessionClosed
+	}
+	return c.rc.Flush()
+}
+
+// Ping sends a comment, which peers ignore
+func (c *sseConn) Ping() error {
+	return c.write([]byte(": ping\n\n"))
+}
+
+func (c *sseConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return errSessionClosed
+	}
+	c.rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	if c.batching {
+		return nil
+	}
+	return c.rc.Flush()
+}
+
+// finish retires the session as the stream's handler returns. Writers
+// still running, such as a client's after it has left its room, get an
+// error from then on rather than touching the finished response.
+func (c *sseConn) finish() {
+	c.Close()
+	c.mu.Lock()
+	c.ended = true
+	c.mu.Unlock()
+
+	c.sessions.remove(c)
+	c.discard()
+}
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent returns the data of the next event on an SSE stream
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != nil:
+			return strings.Join(data, "\n")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+// TestSSEConn verifies messages POSTed with the session secret reach the
+// reader, and messages written go down the stream whole
+func TestSSEConn(t *testing.T) {
+	sessions := newSessions()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			sessions.serveUpstream(w, r, "room")
+			return
+		}
+		c, err := sessions.openSSE(w, r, "room")
+		if err != nil {
+			return
+		}
+		defer c.finish()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(append(msg, "\nechoed"...))
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+	session := readEvent(t, stream)
+	secret := strings.TrimSuffix(strings.TrimPrefix(session, `{"session":"`), `"}`)
+
+	post := func(secret, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		req.Header.Set(SessionHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("wrong", `{"type":"HEARTBEAT"}`); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown session, got %d", code)
+	}
+	if code := post(secret, `{"type":"HEARTBEAT"}`); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a delivered message, got %d", code)
+	}
+	if got := readEvent(t, stream); got != "{\"type\":\"HEARTBEAT\"}\nechoed" {
+		t.Errorf("Expected the message back with its line break, got %q", got)
+	}
+
+	if code := post(secret, strings.Repeat("x", MaxMessageSize+1)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized message, got %d", code)
+	}
+	if code := post(secret, `{}`); code != http.StatusNotFound && code != http.StatusGone {
+		t.Errorf("Expected an oversized message to end the session, got %d", code)
+	}
+}
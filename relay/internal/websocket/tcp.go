@@ -0,0 +1,210 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ephemeral/relay/internal/metrics"
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/tracing"
+)
+
+// AttachTimeout is how long a raw TCP connection has to send its Attach
+const AttachTimeout = 10 * time.Second
+
+// TCPAttach is the first message on a raw TCP connection, naming the room
+// and how to connect to it, as a WebSocket URL does
+type TCPAttach struct {
+	Type        string      `json:"type"` // "ATTACH"
+	RoomID      string      `json:"roomId"`
+	Join        bool        `json:"join,omitempty"`        // as a client, rather than the room's host
+	Token       string      `json:"token,omitempty"`       // the invite token
+	Fingerprint string      `json:"fingerprint,omitempty"` // the key fingerprint a bound token requires
+	Resume      string      `json:"resume,omitempty"`      // a MIGRATE message's resume token
+	Auth        string      `json:"auth,omitempty"`        // the host credential, where one is required
+	Pad         json.Number `json:"pad,omitempty"`         // the smallest padding bucket a host asks for
+	Cover       string      `json:"cover,omitempty"`       // the mean interval of cover traffic a host asks for, such as "2s"
+	Jitter      string      `json:"jitter,omitempty"`      // the longest delay before writing a frame a host asks for, such as "50ms"
+}
+
+// ServeTCP takes raw framed connections from ln, for embedded clients that
+// can't afford an HTTP stack, until ln fails. Each message either way is
+// the same JSON a WebSocket would carry, prefixed by its length as a
+// 4-byte big-endian integer. The first must be a TCPAttach; a refusal
+// comes back as an ERROR before the connection is closed.
+//
+// A message of length zero is a ping. The relay sends one every
+// PingInterval and the peer answers with one of its own; a peer that sends
+// nothing for ReadTimeout is dropped.
+func (h *Handler) ServeTCP(ln net.Listener) error {
+	return acceptLoop(ln, h.serveTCP)
+}
+
+// acceptLoop serves each connection ln accepts on its own goroutine until
+// ln fails
+func acceptLoop(ln net.Listener, serve func(net.Conn)) error {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		safeGo("TCP connection", func() { serve(nc) }, func() { nc.Close() })
+	}
+}
+
+// serveTCP admits a raw connection as ServeHTTP does a WebSocket upgrade
+func (h *Handler) serveTCP(nc net.Conn) {
+	conn := newTCPConn(nc)
+	defer conn.Close()
+
+	nc.SetReadDeadline(time.Now().Add(AttachTimeout))
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	var at TCPAttach
+	if json.Unmarshal(data, &at) != nil || at.Type != "ATTACH" || !room.ValidID(at.RoomID) {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeInvalidRoom)
+		sendError(conn, "Invalid room ID")
+		return
+	}
+
+	// A draining node is handing its rooms to the others
+	if h.cluster.Draining() {
+		metrics.Global.IncUpgradeFailure(metrics.UpgradeDraining)
+		sendJSON(conn, Message{Type: "ERROR", Reason: "Node draining", RetryAfterMs: 1000})
+		return
+	}
+
+	role := metrics.RoleHost
+	if at.Join {
+		role = metrics.RoleClient
+	}
+	ctx, span := tracing.Start(context.Background(), "relay.upgrade", tracing.Room(at.RoomID), tracing.AttrRole.String(role))
+
+	release, refused := h.admit(h.ips.ClientIP(&http.Request{RemoteAddr: nc.RemoteAddr().String()}), at.Join, hostProof{tls: tlsState(nc), credential: at.Auth}, http.Header{})
+	if refused != nil {
+		metrics.Global.IncUpgradeFailure(refused.outcome)
+		tracing.Fail(span, refused.outcome)
+		span.End()
+		msg := Message{Type: "ERROR", Reason: refused.message}
+		if refused.retryAfter != "" {
+			if secs, err := strconv.Atoi(refused.retryAfter); err == nil {
+				msg.RetryAfterMs = int64(secs) * 1000
+			}
+		}
+		sendJSON(conn, msg)
+		return
+	}
+	defer release()
+	span.End()
+
+	h.serve(ctx, conn, attachment{
+		roomID:      at.RoomID,
+		join:        at.Join,
+		credential:  at.Auth,
+		token:       at.Token,
+		fingerprint: at.Fingerprint,
+		resume:      at.Resume,
+		pad:         at.Pad.String(),
+		cover:       at.Cover,
+		jitter:      at.Jitter,
+	})
+}
+
+// tlsState returns nc's TLS state, nil unless it's a TLS connection. The
+// handshake has run by the time the first message is read.
+func tlsState(nc net.Conn) *tls.ConnectionState {
+	tc, ok := nc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+// tcpConn is a Conn over a raw TCP or TLS connection
+type tcpConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+
+	mu       sync.Mutex // guards w for the writer and the pinger
+	w        *bufio.Writer
+	batching bool
+}
+
+func newTCPConn(nc net.Conn) *tcpConn {
+	return &tcpConn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriterSize(nc, MaxCoalesceBytes),
+	}
+}
+
+// ReadMessage returns the peer's next message, passing over pings
+func (c *tcpConn) ReadMessage() ([]byte, error) {
+	for {
+		data, err := readFrame(c.r)
+		if err != nil {
+			return nil, err
+		}
+		c.nc.SetReadDeadline(time.Now().Add(ReadTimeout))
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+}
+
+func (c *tcpConn) WriteMessage(data []byte) error {
+	return c.write(data)
+}
+
+func (c *tcpConn) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := writeFrame(c.w, data); err != nil {
+		return err
+	}
+	if c.batching {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// Batch holds messages until Flush, to go out in one write
+func (c *tcpConn) Batch() {
+	c.mu.Lock()
+	c.batching = true
+	c.mu.Unlock()
+}
+
+func (c *tcpConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	c.nc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.w.Flush()
+}
+
+// Ping sends an empty message, which the peer answers in kind
+func (c *tcpConn) Ping() error {
+	return c.write(nil)
+}
+
+func (c *tcpConn) Close() error {
+	return c.nc.Close()
+}
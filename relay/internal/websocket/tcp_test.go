@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// TestTCPConn verifies pings are passed over on read, answered in kind on
+// write, and an oversized message fails the read
+func TestTCPConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newTCPConn(server)
+	defer c.Close()
+
+	go func() {
+		writeFrame(client, nil)
+		writeFrame(client, []byte(`{"type":"HEARTBEAT"}`))
+		client.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}()
+	if got, err := c.ReadMessage(); err != nil || string(got) != `{"type":"HEARTBEAT"}` {
+		t.Errorf("Expected the message after the ping, got %q (%v)", got, err)
+	}
+	if _, err := c.ReadMessage(); err != errFrameTooLarge {
+		t.Errorf("Expected an oversized message to fail, got %v", err)
+	}
+
+	go c.Ping()
+	if got, err := readFrame(bufio.NewReader(client)); err != nil || len(got) != 0 {
+		t.Errorf("Expected an empty ping, got %q (%v)", got, err)
+	}
+}
+
+// TestTCPAttachInvalidRoom verifies a bad Attach is answered with an
+// ERROR and the connection closed
+func TestTCPAttachInvalidRoom(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&Handler{}).serveTCP(server)
+
+	go writeFrame(client, []byte(`{"type":"ATTACH","roomId":"short"}`))
+	r := bufio.NewReader(client)
+	data, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("Expected an ERROR, got %v", err)
+	}
+	var msg Message
+	json.Unmarshal(data, &msg)
+	if msg.Type != "ERROR" || msg.Reason != "Invalid room ID" {
+		t.Errorf("Expected an invalid room ERROR, got %s", data)
+	}
+	if _, err := readFrame(r); err == nil {
+		t.Error("Expected the connection closed")
+	}
+}
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	mrand "math/rand/v2"
+	"time"
+)
+
+// Uniform join errors. Every join refused to an outsider is answered
+// ErrRoomUnavailable no sooner than UniformErrorDelay after it arrived,
+// plus a random slack of up to UniformErrorSlack, so neither the reason
+// nor the time taken tells which room IDs exist, are full or aren't
+// open yet.
+const (
+	ErrRoomUnavailable = "Room unavailable"
+	UniformErrorDelay  = 250 * time.Millisecond
+	UniformErrorSlack  = 50 * time.Millisecond
+)
+
+// UniformJoinErrors hides why a join failed from joiners without a valid
+// invite for the room: a missing room, a full one and one not open yet
+// all look alike. Joiners whose invite checked out, and clients resuming
+// after a drain, still learn the reason.
+func (h *Handler) UniformJoinErrors() {
+	h.uniformErrors = true
+}
+
+// joinRefusal is the reason a refused joiner is given, waiting out the
+// uniform delay first for an outsider when the mode is on
+func (h *Handler) joinRefusal(reason string, insider bool, arrived time.Time) string {
+	if !h.uniformErrors || insider {
+		return reason
+	}
+	slack := time.Duration(mrand.Int64N(int64(UniformErrorSlack) + 1))
+	time.Sleep(time.Until(arrived.Add(UniformErrorDelay + slack)))
+	return ErrRoomUnavailable
+}
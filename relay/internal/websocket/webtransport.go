@@ -0,0 +1,258 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// WebTransport framing and limits
+const (
+	// MaxInlineMessage is the largest message sent on a session's control
+	// stream; bigger ones each get a stream of their own
+	MaxInlineMessage = 16 * 1024
+	// MaxMediaStreams bounds the large messages being sent to one peer at
+	// once; past it the writer waits, as it would on a full socket
+	MaxMediaStreams = 4
+	// ControlStreamTimeout is how long a new session may wait for the peer
+	// to allow the control stream
+	ControlStreamTimeout = 10 * time.Second
+	// closeGrace gives the control stream's last messages time to go out
+	// before the session is torn down
+	closeGrace = time.Second
+)
+
+// EnableWebTransport returns an HTTP/3 server for addr taking WebTransport
+// sessions to h. routes serves its requests, and must send room URLs to h
+// as the TCP server's mux does.
+func (h *Handler) EnableWebTransport(addr string, routes http.Handler) *webtransport.Server {
+	h.webtransport = &webtransport.Server{
+		H3: http3.Server{
+			Addr:    addr,
+			Handler: routes,
+			QUICConfig: &quic.Config{
+				MaxIdleTimeout:  ReadTimeout,
+				KeepAlivePeriod: PingInterval,
+			},
+		},
+		CheckOrigin: upgrader.CheckOrigin,
+	}
+	return h.webtransport
+}
+
+// wtConn is a Conn over a WebTransport session, for peers that can reach
+// the relay over HTTP/3. The peer sends a CONNECT to a room's URL as it
+// would a WebSocket upgrade, and the relay opens a bidirectional control
+// stream, which the peer sees with the relay's first message. Every
+// stream carries messages each prefixed by its length as a 4-byte
+// big-endian integer.
+//
+// The relay writes to the control stream, except that a message over
+// MaxInlineMessage goes out on a unidirectional stream of its own, so a
+// large media frame never holds up the small ones queued behind it. The
+// peer may likewise open more streams for its own large messages.
+// Messages on different streams can overtake one another.
+//
+// QUIC keep-alives stand in for pings; a peer gone quiet for ReadTimeout
+// is dropped with its connection.
+type wtConn struct {
+	sess  *webtransport.Session
+	inbox chan []byte
+	media chan struct{} // a slot per large message being sent
+
+	mu       sync.Mutex // guards out for the writer and Close
+	control  webtransport.Stream
+	out      *bufio.Writer
+	batching bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// openWebTransport upgrades a WebTransport CONNECT and opens the session's
+// control stream
+func (h *Handler) openWebTransport(w http.ResponseWriter, r *http.Request) (*wtConn, error) {
+	sess, err := h.webtransport.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(sess.Context(), ControlStreamTimeout)
+	defer cancel()
+	control, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		sess.CloseWithError(0, "no control stream")
+		return nil, err
+	}
+	return newWTConn(sess, control), nil
+}
+
+func newWTConn(sess *webtransport.Session, control webtransport.Stream) *wtConn {
+	c := &wtConn{
+		sess:    sess,
+		inbox:   make(chan []byte, sessionInbox),
+		media:   make(chan struct{}, MaxMediaStreams),
+		control: control,
+		out:     bufio.NewWriterSize(control, MaxCoalesceBytes),
+		done:    make(chan struct{}),
+	}
+	safeGo("WebTransport stream", func() {
+		// The peer ends the session by closing its control stream
+		c.readStream(control)
+		c.Close()
+	}, c.abort)
+	safeGo("WebTransport stream", c.acceptStreams, c.abort)
+	return c
+}
+
+// acceptStreams reads each stream the peer opens
+func (c *wtConn) acceptStreams() {
+	ctx := c.sess.Context()
+	go func() {
+		for {
+			str, err := c.sess.AcceptUniStream(ctx)
+			if err != nil {
+				return
+			}
+			c.goRead(str)
+		}
+	}()
+	for {
+		str, err := c.sess.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		c.goRead(str)
+	}
+}
+
+// goRead reads str on a goroutine of its own
+func (c *wtConn) goRead(str io.Reader) {
+	safeGo("WebTransport stream", func() { c.readStream(str) }, c.abort)
+}
+
+// readStream passes the messages on one stream to the reader until it ends
+func (c *wtConn) readStream(str io.Reader) {
+	r := bufio.NewReader(str)
+	for {
+		data, err := readFrame(r)
+		if errors.Is(err, errFrameTooLarge) {
+			// As with a WebSocket over its read limit, the session ends
+			c.Close()
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case c.inbox <- data:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wtConn) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-c.inbox:
+		return data, nil
+	case <-c.done:
+		return nil, errSessionClosed
+	}
+}
+
+func (c *wtConn) WriteMessage(data []byte) error {
+	if len(data) > MaxInlineMessage {
+		return c.writeStream(data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.control.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := writeFrame(c.out, data); err != nil {
+		return err
+	}
+	if c.batching {
+		return nil
+	}
+	return c.out.Flush()
+}
+
+// writeStream sends data on a stream of its own without waiting for it to
+// go out. A failure ends the session, since the message is lost.
+func (c *wtConn) writeStream(data []byte) error {
+	select {
+	case c.media <- struct{}{}:
+	case <-c.done:
+		return errSessionClosed
+	}
+
+	go func() {
+		defer func() { <-c.media }()
+		ctx, cancel := context.WithTimeout(c.sess.Context(), WriteTimeout)
+		defer cancel()
+		str, err := c.sess.OpenUniStreamSync(ctx)
+		if err == nil {
+			str.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			if err = writeFrame(str, data); err == nil {
+				err = str.Close()
+			}
+		}
+		if err != nil {
+			c.Close()
+		}
+	}()
+	return nil
+}
+
+// Batch holds control stream messages until Flush, to go out together
+func (c *wtConn) Batch() {
+	c.mu.Lock()
+	c.batching = true
+	c.mu.Unlock()
+}
+
+func (c *wtConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	c.control.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return c.out.Flush()
+}
+
+// Ping only reports a session already gone; QUIC keeps the rest alive
+func (c *wtConn) Ping() error {
+	select {
+	case <-c.done:
+		return errSessionClosed
+	case <-c.sess.Context().Done():
+		return errSessionClosed
+	default:
+		return nil
+	}
+}
+
+// Close ends the control stream after what's been written, and the
+// session once that has had closeGrace to arrive
+// abort ends a session whose reading failed by panicking
+func (c *wtConn) abort() {
+	c.Close()
+}
+
+func (c *wtConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.control.Close()
+		c.mu.Unlock()
+		time.AfterFunc(closeGrace, func() { c.sess.CloseWithError(0, "") })
+	})
+	return nil
+}
@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// selfSigned returns a certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Certificate creation failed: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestWTConn verifies small messages come back on the control stream and
+// large ones on a stream of their own
+func TestWTConn(t *testing.T) {
+	h := &Handler{}
+	srv := h.EnableWebTransport("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := h.openWebTransport(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(msg)
+		}
+	}))
+	srv.H3.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go srv.Serve(udp)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d := webtransport.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}}
+	defer d.Close()
+	_, sess, err := d.Dial(ctx, "https://"+udp.LocalAddr().String()+"/rooms/x", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	// The handler's first message comes with the control stream
+	small := []byte(`{"type":"HEARTBEAT"}`)
+	up, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("Opening a stream failed: %v", err)
+	}
+	writeFrame(up, small)
+	control, err := sess.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("Expected the control stream: %v", err)
+	}
+	replies := bufio.NewReader(control)
+
+	if got, err := readFrame(replies); err != nil || !bytes.Equal(got, small) {
+		t.Errorf("Expected the message back on the control stream, got %q (%v)", got, err)
+	}
+
+	large := bytes.Repeat([]byte("x"), MaxInlineMessage+1)
+	writeFrame(control, large)
+	str, err := sess.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatalf("Expected a stream for the large message: %v", err)
+	}
+	if got, err := readFrame(bufio.NewReader(str)); err != nil || !bytes.Equal(got, large) {
+		t.Errorf("Expected the large message back whole, got %d bytes (%v)", len(got), err)
+	}
+
+	var size [4]byte
+	size[0] = 0xff
+	control.Write(size[:])
+	control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readFrame(replies); err == nil {
+		t.Error("Expected an oversized message to end the session")
+	}
+}
@@ -0,0 +1,41 @@
+package relaytest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock that only moves when told to. Give it to a registry
+// with NewRegistry, or take the one a Relay keeps, and a room's uptime,
+// its host's heartbeat age and a slow client's eviction grace all follow
+// Advance instead of the wall clock.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock stopped at start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t, backwards if need be
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
@@ -0,0 +1,233 @@
+package relaytest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Errors
+var (
+	ErrClosed  = errors.New("relaytest: connection closed")
+	ErrTimeout = errors.New("relaytest: timed out waiting for a message")
+)
+
+// Timeout bounds how long Expect waits for the relay's next message
+var Timeout = 5 * time.Second
+
+// inboxSize is how many sent messages may wait for the relay's reader
+// before Send blocks
+const inboxSize = 64
+
+// Conn is an in-memory connection standing in for a peer's socket. The
+// relay's side reads what the test sends and writes what the test
+// receives; it's a Conn to both the WebSocket handler and the rooms.
+// Nothing the relay writes is ever dropped or blocks: unread messages
+// queue up until the test receives them, even after the connection
+// closes.
+type Conn struct {
+	inbox chan []byte
+
+	mu       sync.Mutex
+	outbox   [][]byte
+	batch    [][]byte // written since Batch, sent on Flush
+	batching bool
+	pings    int
+	written  chan struct{} // signalled on every write
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn returns an open connection
+func NewConn() *Conn {
+	return &Conn{
+		inbox:   make(chan []byte, inboxSize),
+		written: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// The relay's side
+
+// ReadMessage returns the next message the test sent, or io.EOF once the
+// connection is closed
+func (c *Conn) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-c.inbox:
+		return data, nil
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage queues data for the test to receive, or holds it until
+// Flush while a batch is open
+func (c *Conn) WriteMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed() {
+		return ErrClosed
+	}
+	msg := append([]byte(nil), data...)
+	if c.batching {
+		c.batch = append(c.batch, msg)
+		return nil
+	}
+	c.push(msg)
+	return nil
+}
+
+// Batch opens a batch
+func (c *Conn) Batch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = true
+}
+
+// Flush delivers the batch's messages, in order
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batching = false
+	for _, msg := range c.batch {
+		c.push(msg)
+	}
+	c.batch = nil
+	if c.closed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Ping counts a keepalive
+func (c *Conn) Ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed() {
+		return ErrClosed
+	}
+	c.pings++
+	return nil
+}
+
+// Close hangs up. Either side may call it, any number of times.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// push queues msg for the test; mu held
+func (c *Conn) push(msg []byte) {
+	c.outbox = append(c.outbox, msg)
+	select {
+	case c.written <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// The test's side
+
+// Send hands data to the relay's reader as one message
+func (c *Conn) Send(data []byte) error {
+	if c.closed() {
+		return ErrClosed
+	}
+	select {
+	case c.inbox <- data:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// SendJSON sends v encoded as JSON
+func (c *Conn) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(data)
+}
+
+// Receive returns the relay's next message, waiting up to timeout for
+// one. Once the connection is closed and everything written has been
+// received it returns ErrClosed.
+func (c *Conn) Receive(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.outbox) > 0 {
+			msg := c.outbox[0]
+			c.outbox = c.outbox[1:]
+			c.mu.Unlock()
+			return msg, nil
+		}
+		closed := c.closed()
+		c.mu.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+
+		select {
+		case <-c.written:
+		case <-c.done:
+		case <-timer.C:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Expect returns the relay's next message, failing the test unless one
+// of type typ arrives within Timeout
+func (c *Conn) Expect(t testing.TB, typ string) Message {
+	t.Helper()
+	data, err := c.Receive(Timeout)
+	if err != nil {
+		t.Fatalf("Expected %s, got %v", typ, err)
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Expected %s, got undecodable %s", typ, data)
+	}
+	if msg.Type != typ {
+		t.Fatalf("Expected %s, got %s", typ, data)
+	}
+	return msg
+}
+
+// ExpectClosed fails the test unless the relay closes the connection
+// within Timeout, whatever it writes first
+func (c *Conn) ExpectClosed(t testing.TB) {
+	t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(Timeout):
+		t.Fatalf("Expected the relay to close the connection within %v", Timeout)
+	}
+}
+
+// Done is closed once the connection is
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Pings returns how many keepalives the relay has sent
+func (c *Conn) Pings() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pings
+}
@@ -0,0 +1,147 @@
+package relaytest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/clientip"
+	"github.com/ephemeral/relay/internal/invite"
+	"github.com/ephemeral/relay/internal/ratelimit"
+	"github.com/ephemeral/relay/internal/websocket"
+)
+
+// Relay is the relay's protocol handler over a registry, with no
+// listener: peers are Conns attached straight to the handler, past the
+// upgrade and the per-IP limits. The per-room message limits still apply.
+type Relay struct {
+	Registry *Registry
+	Handler  *Handler
+	Clock    *Clock // the registry's, starting at the Unix epoch
+
+	t testing.TB
+}
+
+// NewRelay starts a relay with the default rate limit profile, stopped
+// when the test ends
+func NewRelay(t testing.TB) *Relay {
+	clock := NewClock(time.Unix(0, 0))
+	registry := NewRegistry(t, clock)
+
+	limits := ratelimit.Profiles[ratelimit.DefaultProfile].NewLimiters()
+	t.Cleanup(limits.Stop)
+	tokens := invite.NewTokenStore()
+	t.Cleanup(tokens.Stop)
+	ips := clientip.NewResolver(nil)
+	access := ratelimit.NewAccessList()
+
+	inviteHandler := invite.NewHandler(tokens, registry, limits, ips, access)
+	handler := websocket.NewHandler(registry, limits, inviteHandler, ips, ratelimit.NewConnCeiling(0), access, nil)
+
+	// As in cmd/relay: per-room state elsewhere is released on destroy
+	registry.OnRoomDestroyed(func(roomID, reason string) {
+		limits.RemoveRoom(roomID)
+		inviteHandler.RevokeRoomTokens(roomID)
+	})
+
+	return &Relay{Registry: registry, Handler: handler, Clock: clock, t: t}
+}
+
+// Attach hands conn to the handler for roomID, as a host or as a client
+// per opts, and returns at once. The connection is closed when the test
+// ends.
+func (r *Relay) Attach(conn *Conn, roomID string, opts AttachOptions) {
+	r.t.Cleanup(func() { conn.Close() })
+	go r.Handler.Attach(context.Background(), conn, roomID, opts)
+}
+
+// Host is a room's host connection
+type Host struct {
+	*Conn
+	RoomID string
+	Secret string // for the invite API
+}
+
+// Host creates a room, failing the test unless the relay answers
+// ROOM_CREATED. Its Clock doesn't move by itself, so the room never
+// times out waiting for heartbeats.
+func (r *Relay) Host(roomID string) *Host {
+	r.t.Helper()
+	return r.HostWithOptions(roomID, AttachOptions{})
+}
+
+// HostWithOptions is Host asking for room options, such as padding
+func (r *Relay) HostWithOptions(roomID string, opts AttachOptions) *Host {
+	r.t.Helper()
+	opts.Join = false
+	conn := NewConn()
+	r.Attach(conn, roomID, opts)
+	created := conn.Expect(r.t, "ROOM_CREATED")
+	return &Host{Conn: conn, RoomID: roomID, Secret: created.Secret}
+}
+
+// Sync returns once the relay has handled everything the host has sent,
+// by waiting for the ack to a heartbeat sent after it
+func (h *Host) Sync(t testing.TB) {
+	t.Helper()
+	if err := h.SendJSON(Message{Type: "HEARTBEAT"}); err != nil {
+		t.Fatalf("Failed to send HEARTBEAT: %v", err)
+	}
+	h.Expect(t, "HEARTBEAT_ACK")
+}
+
+// Open opens the room for joins
+func (h *Host) Open(t testing.TB) {
+	t.Helper()
+	if err := h.SendJSON(Message{Type: "ROOM_OPEN"}); err != nil {
+		t.Fatalf("Failed to send ROOM_OPEN: %v", err)
+	}
+	h.Sync(t)
+}
+
+// Admit runs the approval handshake for c, which receives broadcasts once
+// it returns
+func (h *Host) Admit(t testing.TB, c *Client) {
+	t.Helper()
+	send := func(conn *Conn, msg Message) {
+		if err := conn.SendJSON(msg); err != nil {
+			t.Fatalf("Failed to send %s: %v", msg.Type, err)
+		}
+	}
+	send(c.Conn, Message{Type: "JOIN_REQUEST"})
+	if req := h.Expect(t, "JOIN_REQUEST"); req.ClientID != c.ID {
+		t.Fatalf("Expected a JOIN_REQUEST from %s, got one from %s", c.ID, req.ClientID)
+	}
+	approved := true
+	send(h.Conn, Message{Type: "JOIN_RESPONSE", ClientID: c.ID, Approved: &approved, Payload: json.RawMessage(`{"approved":true}`)})
+	c.Expect(t, "JOIN_RESPONSE")
+	send(c.Conn, Message{Type: "JOIN_CONFIRM"})
+	if confirm := h.Expect(t, "JOIN_CONFIRM"); confirm.ClientID != c.ID {
+		t.Fatalf("Expected a JOIN_CONFIRM from %s, got one from %s", c.ID, confirm.ClientID)
+	}
+}
+
+// Client is a joiner's connection
+type Client struct {
+	*Conn
+	ID   string
+	Role string
+}
+
+// Join joins a room, failing the test unless the relay answers CONNECTED.
+// The host must still admit it.
+func (r *Relay) Join(roomID string) *Client {
+	r.t.Helper()
+	return r.JoinWithOptions(roomID, AttachOptions{})
+}
+
+// JoinWithOptions is Join presenting an invite token
+func (r *Relay) JoinWithOptions(roomID string, opts AttachOptions) *Client {
+	r.t.Helper()
+	opts.Join = true
+	conn := NewConn()
+	r.Attach(conn, roomID, opts)
+	connected := conn.Expect(r.t, "CONNECTED")
+	return &Client{Conn: conn, ID: connected.ClientID, Role: connected.Role}
+}
@@ -0,0 +1,50 @@
+// Package relaytest helps programs that embed the relay unit test against
+// it without sockets or gorilla/websocket.
+//
+// Conn is an in-memory connection: the relay reads what a test sends on
+// it and writes what the test receives. Clock is a clock that moves only
+// when told to, so room uptimes, heartbeat ages and memory eviction grace
+// periods are deterministic. NewRegistry and BuildRoom set up rooms in any
+// state directly, for testing code that works on rooms; NewRelay runs the
+// relay's protocol handler over Conns, for testing code that talks to it:
+//
+//	r := relaytest.NewRelay(t)
+//	host := r.Host(relaytest.NewRoomID())
+//	host.Open(t)
+//	c := r.Join(host.RoomID)
+//	host.Admit(t, c)
+//	host.SendJSON(relaytest.Message{Type: "BROADCAST", Payload: json.RawMessage(`"hi"`)})
+//	c.Expect(t, "MESSAGE")
+//
+// Helpers taking a testing.TB fail the test rather than return an error,
+// and everything is torn down when the test ends.
+package relaytest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/ephemeral/relay/internal/room"
+	"github.com/ephemeral/relay/internal/websocket"
+)
+
+// The relay's own types, under names importers can use
+type (
+	// Message is a protocol frame in either direction
+	Message = websocket.Message
+	// Registry holds a relay's rooms
+	Registry = room.Registry
+	// Handler serves the relay protocol on connections
+	Handler = websocket.Handler
+	// AttachOptions say whether a Conn attached to a Relay is a host or
+	// a client, what invite it presents, and what room options a host asks
+	// for
+	AttachOptions = websocket.AttachOptions
+)
+
+// NewRoomID returns a random room ID of the form the relay accepts
+func NewRoomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
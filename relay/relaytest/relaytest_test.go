@@ -0,0 +1,159 @@
+package relaytest
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestConnQueuesUntilReceived verifies what the relay writes waits for the
+// test, batched frames only after Flush, and survives the close
+func TestConnQueuesUntilReceived(t *testing.T) {
+	c := NewConn()
+	c.WriteMessage([]byte("one"))
+	c.Batch()
+	c.WriteMessage([]byte("two"))
+	if _, err := c.Receive(0); err != nil {
+		t.Fatalf("Expected the first frame, got %v", err)
+	}
+	if _, err := c.Receive(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a batched frame held until Flush, got %v", err)
+	}
+	c.Flush()
+	c.Close()
+
+	if data, err := c.Receive(0); err != nil || string(data) != "two" {
+		t.Errorf("Expected the flushed frame after the close, got %q (%v)", data, err)
+	}
+	if _, err := c.Receive(0); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed once drained, got %v", err)
+	}
+	if err := c.Send([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected a send after the close refused, got %v", err)
+	}
+}
+
+// TestBuildRoom verifies a built room has the clients, roles and
+// confirmations its spec asks for
+func TestBuildRoom(t *testing.T) {
+	r := BuildRoom(t, NewRegistry(t, nil), RoomSpec{
+		Open: true,
+		Clients: []ClientSpec{
+			{ID: "alice", Confirmed: true},
+			{ID: "bob", Role: "observer"},
+		},
+	})
+
+	if got := r.ClientCount(); got != 2 {
+		t.Errorf("Expected 2 clients, got %d", got)
+	}
+	if role := r.GetClient("bob").Role; role != "observer" {
+		t.Errorf("Expected bob an observer, got %q", role)
+	}
+	if stats := r.Stats(); stats.Pending != 1 {
+		t.Errorf("Expected only bob pending, got %d", stats.Pending)
+	}
+
+	r.BroadcastToClients([]byte("hello"))
+	if data := r.NextToClient("alice"); string(data) != "hello" {
+		t.Errorf("Expected the broadcast at alice, got %q", data)
+	}
+}
+
+// TestClockDrivesRooms verifies rooms in a registry given a Clock age by
+// it rather than the wall clock
+func TestClockDrivesRooms(t *testing.T) {
+	clock := NewClock(time.Unix(1000, 0))
+	r := BuildRoom(t, NewRegistry(t, clock), RoomSpec{})
+
+	clock.Advance(time.Hour)
+	if up := r.Stats().Uptime; up != time.Hour {
+		t.Errorf("Expected an hour's uptime, got %v", up)
+	}
+	if age := r.SinceHeartbeat(); age != time.Hour {
+		t.Errorf("Expected an hour since the heartbeat, got %v", age)
+	}
+	r.UpdateHeartbeat()
+	if age := r.SinceHeartbeat(); age != 0 {
+		t.Errorf("Expected a fresh heartbeat, got %v", age)
+	}
+}
+
+// TestRelayOverConns verifies the protocol handler runs over Conns: a
+// host admits a client, a broadcast reaches it, and a kick hangs it up
+func TestRelayOverConns(t *testing.T) {
+	r := NewRelay(t)
+	host := r.Host(NewRoomID())
+	host.Open(t)
+	c := r.Join(host.RoomID)
+	if c.ID == "" || c.Role != "participant" {
+		t.Errorf("Expected a participant with an ID, got %+v", c)
+	}
+	host.Admit(t, c)
+
+	host.SendJSON(Message{Type: "BROADCAST", Payload: json.RawMessage(`"hi"`)})
+	if msg := c.Expect(t, "MESSAGE"); string(msg.Payload) != `"hi"` {
+		t.Errorf("Expected the broadcast, got %+v", msg)
+	}
+
+	host.SendJSON(Message{Type: "KICK", ClientID: c.ID})
+	c.Expect(t, "KICKED")
+	c.ExpectClosed(t)
+	if msg := host.Expect(t, "CLIENT_LEFT"); msg.ClientID != c.ID {
+		t.Errorf("Expected CLIENT_LEFT for %s, got %+v", c.ID, msg)
+	}
+}
+
+// TestRelayRejectsInvalidRoomID verifies an attached Conn for a malformed
+// room ID is refused as an upgrade would be
+func TestRelayRejectsInvalidRoomID(t *testing.T) {
+	r := NewRelay(t)
+	conn := NewConn()
+	r.Attach(conn, "short", AttachOptions{})
+	if msg := conn.Expect(t, "ERROR"); msg.Reason != "Invalid room ID" {
+		t.Errorf("Expected Invalid room ID, got %q", msg.Reason)
+	}
+	conn.ExpectClosed(t)
+}
+
+// TestRelayPadsFrames verifies a room created with padding has relayed
+// messages padded to its buckets both ways
+func TestRelayPadsFrames(t *testing.T) {
+	r := NewRelay(t)
+	host := r.HostWithOptions(NewRoomID(), AttachOptions{Pad: 512})
+	host.Open(t)
+	c := r.Join(host.RoomID)
+	host.Admit(t, c)
+
+	host.SendJSON(Message{Type: "BROADCAST", Payload: json.RawMessage(`"hi"`)})
+	if data, err := c.Receive(Timeout); err != nil || len(data) != 512 {
+		t.Errorf("Expected a 512 byte MESSAGE, got %d bytes (%v)", len(data), err)
+	}
+	c.SendJSON(Message{Type: "MESSAGE", Payload: json.RawMessage(`"hello"`)})
+	if msg := host.Expect(t, "CLIENT_MESSAGE"); string(msg.Payload) != `"hello"` {
+		t.Errorf("Expected the padded message to decode, got %+v", msg)
+	}
+}
+
+// TestRelayRefusesBadPadding verifies a host asking for padding outside
+// the bounds gets no room
+func TestRelayRefusesBadPadding(t *testing.T) {
+	r := NewRelay(t)
+	conn := NewConn()
+	r.Attach(conn, NewRoomID(), AttachOptions{Pad: 1})
+	if msg := conn.Expect(t, "ERROR"); msg.Reason != "invalid padding" {
+		t.Errorf("Expected invalid padding, got %q", msg.Reason)
+	}
+	conn.ExpectClosed(t)
+}
+
+// TestRelaySendsCover verifies a room created with cover traffic has the
+// relay send its host COVER frames unprompted
+func TestRelaySendsCover(t *testing.T) {
+	r := NewRelay(t)
+	host := r.HostWithOptions(NewRoomID(), AttachOptions{Cover: 100 * time.Millisecond})
+	for range 3 {
+		host.Expect(t, "COVER")
+	}
+}
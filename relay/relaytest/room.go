@@ -0,0 +1,127 @@
+package relaytest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ephemeral/relay/internal/room"
+)
+
+// NewRegistry returns an empty registry whose rooms keep clock's time, or
+// the wall clock's if clock is nil. Rooms still in it when the test ends
+// are destroyed.
+func NewRegistry(t testing.TB, clock *Clock) *Registry {
+	r := room.NewRegistry()
+	if clock != nil {
+		r.SetClock(clock)
+	}
+	t.Cleanup(func() {
+		for _, id := range r.MatchPrefix("") {
+			r.DestroyRoom(id, "test_ended")
+		}
+	})
+	return r
+}
+
+// RoomSpec is the state BuildRoom puts a room in
+type RoomSpec struct {
+	ID      string // empty means a random one
+	Open    bool   // open for joins; rooms with clients must be
+	Clients []ClientSpec
+}
+
+// ClientSpec is one client of a RoomSpec
+type ClientSpec struct {
+	ID        string // empty means one numbered by its place in the spec
+	Role      string // "participant", "observer" or "cohost"; empty means participant
+	Confirmed bool   // has sent JOIN_CONFIRM, so receives broadcasts
+}
+
+// Room is a room BuildRoom made, with the Conns standing in for its
+// members. Nothing reads or writes the Conns: what the room sends its
+// members waits in their send queues, for NextToHost and NextToClient.
+type Room struct {
+	*room.Room
+	Host    *Conn
+	Clients map[string]*Conn // by client ID
+
+	t testing.TB
+}
+
+// BuildRoom creates a room in r as spec describes, failing the test if it
+// can't
+func BuildRoom(t testing.TB, r *Registry, spec RoomSpec) *Room {
+	t.Helper()
+	if len(spec.Clients) > 0 && !spec.Open {
+		t.Fatalf("Room spec has clients but isn't open")
+	}
+	id := spec.ID
+	if id == "" {
+		id = NewRoomID()
+	}
+
+	host := NewConn()
+	t.Cleanup(func() { host.Close() })
+	rm, err := r.CreateRoom(id, host)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	if spec.Open {
+		rm.OpenRoom()
+	}
+
+	built := &Room{Room: rm, Host: host, Clients: make(map[string]*Conn), t: t}
+	for i, cs := range spec.Clients {
+		clientID := cs.ID
+		if clientID == "" {
+			clientID = fmt.Sprintf("%016x", i+1)
+		}
+		role, err := room.ParseRole(cs.Role)
+		if err != nil {
+			t.Fatalf("Client %s: %v", clientID, err)
+		}
+		conn := NewConn()
+		t.Cleanup(func() { conn.Close() })
+		add := rm.AddClientWithRole
+		if cs.Confirmed {
+			add = rm.AddConfirmedClient
+		}
+		if _, err := add(clientID, conn, role); err != nil {
+			t.Fatalf("Failed to add client %s: %v", clientID, err)
+		}
+		built.Clients[clientID] = conn
+	}
+	return built
+}
+
+// NextToHost returns the next frame queued for the host, failing the test
+// if none is within Timeout
+func (r *Room) NextToHost() []byte {
+	r.t.Helper()
+	select {
+	case f := <-r.HostSendCh:
+		return f.Data
+	case <-time.After(Timeout):
+		r.t.Fatalf("Expected a frame queued for the host")
+		return nil
+	}
+}
+
+// NextToClient returns the next frame queued for a client, failing the
+// test if none is within Timeout
+func (r *Room) NextToClient(clientID string) []byte {
+	r.t.Helper()
+	client := r.GetClient(clientID)
+	if client == nil {
+		r.t.Fatalf("No client %s in the room", clientID)
+	}
+	select {
+	case f := <-client.SendCh:
+		client.Dequeued(len(f.Data))
+		return f.Data
+	case <-time.After(Timeout):
+		r.t.Fatalf("Expected a frame queued for client %s", clientID)
+		return nil
+	}
+}